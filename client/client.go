@@ -0,0 +1,349 @@
+// Package client is the Go client of the scratch HTTP API. It inserts rows through /data in batches, decodes the
+// results of /query into structs or maps, authenticates with an API key or token and retries the requests the server
+// turned away because it was busy.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchRows is how many rows an insert sends per request.
+	DefaultBatchRows = 1000
+	// DefaultRetries is how often a request is retried after the first attempt.
+	DefaultRetries = 3
+	// DefaultBackoff is the wait before the first retry, doubled for every further one unless the server asks for a
+	// wait with Retry-After.
+	DefaultBackoff = 200 * time.Millisecond
+)
+
+// requestIDHeader identifies a request in the logs of the server. The attempts of a request share it.
+const requestIDHeader = "X-Request-ID"
+
+// queryTagHeader attributes the queries of a request to a workload on the server.
+const queryTagHeader = "X-Query-Tag"
+
+// Client calls a scratch server. It is safe for concurrent use.
+type Client struct {
+	base      *url.URL
+	http      *http.Client
+	token     string
+	tag       string
+	retries   int
+	backoff   time.Duration
+	batchRows int
+}
+
+type Option func(*Client)
+
+// WithToken authenticates the requests with an API key or a JWT.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithQueryTag attributes the queries of the client to the tag, e.g. the name of a dashboard, in the query history,
+// audit log and per-tag stats of the server, which may limit the concurrency of the tag.
+func WithQueryTag(tag string) Option {
+	return func(c *Client) {
+		c.tag = tag
+	}
+}
+
+// WithHTTPClient sends the requests with the client, e.g. one presenting a client certificate. It defaults to
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithRetries sets how often a request is retried and the wait before the first retry, which doubles for every
+// further one. Zero retries disables them.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = retries, backoff
+	}
+}
+
+// WithBatchRows sets how many rows an insert sends per request.
+func WithBatchRows(rows int) Option {
+	return func(c *Client) {
+		c.batchRows = rows
+	}
+}
+
+// New returns a client of the server at the base URL, e.g. http://localhost:8000.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("client: parsing base url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("client: base url %q is not http or https", baseURL)
+	}
+	c := &Client{
+		base:      base,
+		http:      http.DefaultClient,
+		retries:   DefaultRetries,
+		backoff:   DefaultBackoff,
+		batchRows: DefaultBatchRows,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.batchRows <= 0 {
+		return nil, fmt.Errorf("client: batch rows must be positive, got %d", c.batchRows)
+	}
+	return c, nil
+}
+
+// Error is a response of the server with an error status.
+type Error struct {
+	StatusCode int `json:"-"`
+	// Code names the error, e.g. not_found or the code of an exceeded limit.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details are the details of limit and schema policy errors.
+	Details json.RawMessage `json:"details,omitempty"`
+	// RetryAfter is the wait the server asked for, zero if it didn't.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("scratch: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Insert inserts the rows into the table, which is created or extended with the missing columns on the way. Rows is
+// a struct or map encoded as a JSON object, or a slice of them sent in batches. The batches before a failed one stay
+// inserted.
+func (c *Client) Insert(ctx context.Context, table string, rows any) error {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return c.insert(ctx, table, rows)
+	}
+	for start := 0; start < v.Len(); start += c.batchRows {
+		end := min(start+c.batchRows, v.Len())
+		if err := c.insert(ctx, table, v.Slice(start, end).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) insert(ctx context.Context, table string, rows any) error {
+	body, err := json.Marshal(rows)
+	if err != nil {
+		return fmt.Errorf("client: encoding rows: %w", err)
+	}
+	return c.do(ctx, http.MethodPost, "/data?Table="+url.QueryEscape(table), body, false, nil)
+}
+
+// Query runs the read-only query with the parameters bound to its placeholders and decodes the rows into dest, a
+// pointer to a slice of structs, matched by their JSON field names, or of maps. Numbers decoded into interfaces are
+// json.Number, which keeps 64-bit integers exact.
+func (c *Client) Query(ctx context.Context, sql string, params []any, dest any) error {
+	body, err := encodeQuery(sql, params)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/query", body, true, dest)
+}
+
+func encodeQuery(sql string, params []any) ([]byte, error) {
+	body, err := json.Marshal(struct {
+		SQL    string `json:"sql"`
+		Params []any  `json:"params,omitempty"`
+	}{SQL: sql, Params: params})
+	if err != nil {
+		return nil, fmt.Errorf("client: encoding query: %w", err)
+	}
+	return body, nil
+}
+
+// retryable reports whether a request that failed with the status is retried. The server answers 429 and 503 before
+// it writes anything, the other statuses are only retried for idempotent requests, which may have been applied.
+func retryable(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	default:
+		return false
+	}
+}
+
+// do sends the request until it succeeds, fails for good or runs out of retries, and decodes the response into out
+// unless it is nil. Failures to reach the server are retried only for idempotent requests.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotent bool, out any) error {
+	id, err := newRequestID()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		wait := c.backoff << attempt
+		res, err := c.send(ctx, method, path, body, id)
+		switch {
+		case err != nil && (!idempotent || ctx.Err() != nil || attempt >= c.retries):
+			return err
+		case err != nil:
+		case res.StatusCode >= http.StatusBadRequest:
+			apiErr := readError(res)
+			if !retryable(res.StatusCode, idempotent) || attempt >= c.retries {
+				return apiErr
+			}
+			if apiErr.RetryAfter > 0 {
+				wait = apiErr.RetryAfter
+			}
+		default:
+			return decode(res, out)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, id string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base.String()+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("client: creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(requestIDHeader, id)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tag != "" {
+		req.Header.Set(queryTagHeader, c.tag)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client: %s %s: %w", method, path, err)
+	}
+	return res, nil
+}
+
+// readError reads the error response and closes its body.
+func readError(res *http.Response) *Error {
+	defer res.Body.Close()
+	apiErr := &Error{StatusCode: res.StatusCode}
+	data, err := io.ReadAll(res.Body)
+	if err != nil || json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(res.StatusCode)), " ", "_")
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// decode decodes the response into out, or discards it if out is nil, and closes its body.
+func decode(res *http.Response, out any) error {
+	defer res.Body.Close()
+	if out == nil {
+		_, err := io.Copy(io.Discard, res.Body)
+		return err
+	}
+	dec := json.NewDecoder(res.Body)
+	dec.UseNumber()
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("client: decoding response: %w", err)
+	}
+	return nil
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("client: generating request id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ErrBatcherClosed is returned when adding rows to a closed Batcher.
+var ErrBatcherClosed = errors.New("client: batcher is closed")
+
+// Batcher collects rows for a table and inserts them once a batch is full or when flushed.
+type Batcher struct {
+	client *Client
+	table  string
+
+	mu     sync.Mutex
+	rows   []any
+	closed bool
+}
+
+// NewBatcher returns a batcher inserting into the table in batches of the client's batch rows.
+func (c *Client) NewBatcher(table string) *Batcher {
+	return &Batcher{client: c, table: table}
+}
+
+// Add adds the row, inserting the batch if it is full. The rows of a failed insert are kept for the next attempt.
+func (b *Batcher) Add(ctx context.Context, row any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBatcherClosed
+	}
+	b.rows = append(b.rows, row)
+	if len(b.rows) < b.client.batchRows {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// Flush inserts the collected rows.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(ctx)
+}
+
+// Close flushes the collected rows and refuses further ones.
+func (b *Batcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.flush(ctx)
+}
+
+// flush inserts the collected rows. The caller holds the lock.
+func (b *Batcher) flush(ctx context.Context) error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	if err := b.client.insert(ctx, b.table, b.rows); err != nil {
+		return err
+	}
+	b.rows = nil
+	return nil
+}
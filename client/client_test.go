@@ -0,0 +1,87 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"scratch/client"
+	"scratch/internal"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type event struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestClient(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{{Name: "root", Key: "root-key", Admin: true}})
+	require.NoError(t, err)
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys)).Handler()
+	var inserts, busy atomic.Int32
+	var tag atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag.Store(r.Header.Get(internal.QueryTagHeader))
+		if r.URL.Path == "/data" {
+			inserts.Add(1)
+			if busy.Add(-1) >= 0 {
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, `{"code": "busy", "message": "write queue is full"}`, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	ctx := context.Background()
+	c, err := client.New(server.URL, client.WithToken("root-key"), client.WithBatchRows(2),
+		client.WithRetries(2, time.Millisecond))
+	require.NoError(t, err)
+
+	busy.Store(1)
+	require.NoError(t, c.Insert(ctx, "events", []event{{1, "a"}, {2, "b"}, {3, "c"}}))
+	assert.EqualValues(t, 3, inserts.Load(), "two batches and one retry")
+	require.NoError(t, c.Insert(ctx, "events", event{4, "d"}))
+
+	batcher := c.NewBatcher("events")
+	require.NoError(t, batcher.Add(ctx, event{5, "e"}))
+	require.NoError(t, batcher.Close(ctx))
+	assert.ErrorIs(t, batcher.Add(ctx, event{6, "f"}), client.ErrBatcherClosed)
+
+	var events []event
+	require.NoError(t, c.Query(ctx, "select id, name from events where id > ? order by id", []any{1}, &events))
+	assert.Equal(t, []event{{2, "b"}, {3, "c"}, {4, "d"}, {5, "e"}}, events)
+	assert.Empty(t, tag.Load())
+
+	tagged, err := client.New(server.URL, client.WithToken("root-key"), client.WithQueryTag("client-test"))
+	require.NoError(t, err)
+	require.NoError(t, tagged.Query(ctx, "select id, name from events where id = ?", []any{1}, &events))
+	assert.Equal(t, "client-test", tag.Load())
+
+	var apiErr *client.Error
+	busy.Store(3)
+	require.ErrorAs(t, c.Insert(ctx, "events", event{7, "g"}), &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, "busy", apiErr.Code)
+
+	require.ErrorAs(t, c.Query(ctx, "select nope from events", nil, &events), &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+
+	anonymous, err := client.New(server.URL)
+	require.NoError(t, err)
+	require.ErrorAs(t, anonymous.Query(ctx, "select 1", nil, &events), &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	_, err = client.New("localhost:8000")
+	assert.Error(t, err)
+}
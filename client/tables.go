@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Column struct {
+	Name string `json:"name"`
+	// Type is the DuckDB type name, e.g. BIGINT or DECIMAL(18,3).
+	Type string `json:"type"`
+}
+
+// Result is a query result with its columns in the order of the query.
+type Result struct {
+	Columns    []Column         `json:"columns"`
+	Rows       []map[string]any `json:"rows"`
+	RowCount   int              `json:"row_count"`
+	ElapsedMS  int64            `json:"elapsed_ms"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	// Truncated is set when the server cut the result at its row limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// QueryResult runs the read-only query like Query and returns the result with its columns.
+func (c *Client) QueryResult(ctx context.Context, sql string, params []any) (*Result, error) {
+	body, err := encodeQuery(sql, params)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	if err = c.do(ctx, http.MethodPost, "/query?envelope=true", body, true, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Exec runs any statement, including DDL and writes, through the admin endpoint. It needs an admin key.
+func (c *Client) Exec(ctx context.Context, sql string, params []any) (*Result, error) {
+	body, err := encodeQuery(sql, params)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	if err = c.do(ctx, http.MethodPost, "/admin/query?envelope=true", body, false, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type Table struct {
+	Schema  string `json:"schema"`
+	Name    string `json:"name"`
+	Columns int    `json:"columns"`
+	Rows    int64  `json:"rows"`
+	// ApproxBytes estimates the uncompressed size of the table.
+	ApproxBytes int64 `json:"approx_bytes"`
+	InMemory    bool  `json:"in_memory,omitempty"`
+}
+
+// Tables lists the tables ordered by schema and name.
+func (c *Client) Tables(ctx context.Context) ([]Table, error) {
+	var tables []Table
+	if err := c.do(ctx, http.MethodGet, "/tables", nil, true, &tables); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+type ColumnInfo struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Nullable  bool       `json:"nullable"`
+	Default   *string    `json:"default,omitempty"`
+	Generated string     `json:"generated,omitempty"`
+	AddedAt   *time.Time `json:"added_at,omitempty"`
+}
+
+type TableSchema struct {
+	Table   string       `json:"table"`
+	Version int          `json:"version"`
+	Columns []ColumnInfo `json:"columns"`
+}
+
+// Schema describes the columns of the table.
+func (c *Client) Schema(ctx context.Context, table string) (*TableSchema, error) {
+	schema := &TableSchema{}
+	if err := c.do(ctx, http.MethodGet, tablePath(table, "schema"), nil, true, schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// DropTable drops the table. It needs an admin key.
+func (c *Client) DropTable(ctx context.Context, table string) error {
+	_, err := c.Exec(ctx, "DROP TABLE "+quoteIdentifier(table), nil)
+	return err
+}
+
+type ImportRequest struct {
+	// URL may contain globs, e.g. s3://bucket/events/*.parquet.
+	URL string `json:"url"`
+	// Format is parquet, csv or json. Empty infers it from the extension of the URL.
+	Format string `json:"format,omitempty"`
+	// Append inserts into an existing table. Otherwise the table is created and must not exist yet.
+	Append bool `json:"append,omitempty"`
+	// CSV sets the dialect of CSV files.
+	CSV *CSVOptions `json:"csv,omitempty"`
+}
+
+// CSVOptions sets the dialect of CSV files where auto-detection guesses wrong. Unset fields are still detected.
+type CSVOptions struct {
+	Delimiter string `json:"delimiter,omitempty"`
+	Quote     string `json:"quote,omitempty"`
+	// Header tells whether the first line names the columns.
+	Header *bool `json:"header,omitempty"`
+	// Null is the field read as NULL instead of the empty field.
+	Null string `json:"null,omitempty"`
+	// DecimalSeparator is "," for numbers written like 1234,5.
+	DecimalSeparator string `json:"decimal_separator,omitempty"`
+	// Types overrides the detected types of the columns by name.
+	Types map[string]string `json:"types,omitempty"`
+	// IgnoreErrors skips the lines that don't parse or convert instead of failing the import.
+	IgnoreErrors bool `json:"ignore_errors,omitempty"`
+}
+
+// RejectedRow is a line of a CSV file skipped for CSVOptions.IgnoreErrors.
+type RejectedRow struct {
+	File   string `json:"file"`
+	Line   int64  `json:"line"`
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error"`
+}
+
+type ImportResponse struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	// Rejected samples the skipped lines.
+	Rejected []RejectedRow `json:"rejected,omitempty"`
+}
+
+// Import imports the files the server reads at the URL into the table.
+func (c *Client) Import(ctx context.Context, table string, req ImportRequest) (*ImportResponse, error) {
+	res := &ImportResponse{}
+	if err := c.post(ctx, tablePath(table, "import"), req, false, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ImportJob is an import running in the background on the server.
+type ImportJob struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Source string `json:"source"`
+	// Status is running, succeeded, failed or cancelled.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Rows   int64  `json:"rows"`
+	// BytesRead and BytesTotal are the progress of assembling an upload session.
+	BytesRead  int64         `json:"bytes_read"`
+	BytesTotal int64         `json:"bytes_total,omitempty"`
+	Rejected   []RejectedRow `json:"rejected,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// StartImport starts importing the files the server reads at the URL into the table in the background.
+func (c *Client) StartImport(ctx context.Context, table string, req ImportRequest) (*ImportJob, error) {
+	body := struct {
+		ImportRequest
+		Async bool `json:"async"`
+	}{req, true}
+	job := &ImportJob{}
+	if err := c.post(ctx, tablePath(table, "import"), body, false, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ImportJob reports the import job.
+func (c *Client) ImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	job := &ImportJob{}
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, true, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CancelImportJob cancels the import job, which rolls back its load unless it committed already.
+func (c *Client) CancelImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	job := &ImportJob{}
+	if err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, true, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type ExportRequest struct {
+	// URL is the Parquet file or the directory of a partitioned export the server writes. A path without scheme is
+	// relative to the export directory of the server.
+	URL string `json:"url"`
+	// Filters select the exported rows, in the form column:op:value.
+	Filters     []string `json:"filters,omitempty"`
+	PartitionBy []string `json:"partition_by,omitempty"`
+	// Compression is snappy, the default, zstd, gzip or uncompressed.
+	Compression string `json:"compression,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+}
+
+type ExportManifest struct {
+	Table string   `json:"table"`
+	Rows  int64    `json:"rows"`
+	Files []string `json:"files"`
+}
+
+// Export exports the table to Parquet.
+func (c *Client) Export(ctx context.Context, table string, req ExportRequest) (*ExportManifest, error) {
+	res := &ExportManifest{}
+	if err := c.post(ctx, tablePath(table, "export"), req, false, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, req any, idempotent bool, out any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("client: encoding request: %w", err)
+	}
+	return c.do(ctx, http.MethodPost, path, body, idempotent, out)
+}
+
+func tablePath(table, sub string) string {
+	return "/tables/" + url.PathEscape(table) + "/" + sub
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
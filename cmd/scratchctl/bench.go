@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"scratch/client"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//nolint:gochecknoglobals // Read-only values of the kind column of the generated rows.
+var benchKinds = []string{"view", "click", "purchase", "signup", "error"}
+
+// benchStats records the requests of a workload.
+type benchStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	rows      int
+	firstErr  error
+}
+
+func (s *benchStats) record(latency time.Duration, rows int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		if s.firstErr == nil {
+			s.firstErr = err
+		}
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+	s.rows += rows
+}
+
+// report summarizes the workload over the elapsed time. Latencies are in milliseconds, of the successful requests.
+func (s *benchStats) report(workload string, elapsed time.Duration) map[string]any {
+	slices.Sort(s.latencies)
+	percentile := func(p float64) float64 {
+		if len(s.latencies) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(p*float64(len(s.latencies)))) - 1
+		return round2(float64(s.latencies[max(i, 0)]) / float64(time.Millisecond))
+	}
+	return map[string]any{
+		"workload": workload,
+		"requests": len(s.latencies) + s.errors,
+		"errors":   s.errors,
+		"rows":     s.rows,
+		"req_s":    round2(float64(len(s.latencies)) / elapsed.Seconds()),
+		"rows_s":   round2(float64(s.rows) / elapsed.Seconds()),
+		"p50_ms":   percentile(0.5),
+		"p90_ms":   percentile(0.9),
+		"p99_ms":   percentile(0.99),
+		"max_ms":   percentile(1),
+	}
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// benchRows generates a batch of rows with sequence numbers from seq, reproducible for a seed but for the ts column.
+func benchRows(rng *rand.Rand, seq *atomic.Int64, n, users, payload int) []map[string]any {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	rows := make([]map[string]any, n)
+	b := make([]byte, payload)
+	for i := range rows {
+		for j := range b {
+			b[j] = letters[rng.Intn(len(letters))]
+		}
+		rows[i] = map[string]any{
+			"seq":     seq.Add(1),
+			"ts":      time.Now().UTC().Format(time.RFC3339Nano),
+			"user_id": fmt.Sprintf("user-%d", rng.Intn(users)),
+			"kind":    benchKinds[rng.Intn(len(benchKinds))],
+			"value":   round2(rng.Float64() * 1000),
+			"payload": string(b),
+		}
+	}
+	return rows
+}
+
+// bench runs synthetic ingest and query workloads against the server for a duration and reports the throughput and
+// the latency percentiles of each, so capacity changes can be compared run to run.
+func bench(ctx context.Context, c *client.Client, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("bench", "")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	table := fs.String("table", "bench_events", "table the ingest workload inserts into and the default queries read")
+	duration := fs.Duration("duration", 10*time.Second, "how long the workloads run")
+	ingesters := fs.Int("ingest-workers", 4, "concurrent insert requests, 0 disables the ingest workload")
+	batchRows := fs.Int("rows", 100, "rows per insert request")
+	users := fs.Int("users", 1000, "distinct user_id values of the generated rows")
+	payload := fs.Int("payload", 64, "bytes of the payload column of the generated rows")
+	queriers := fs.Int("query-workers", 2, "concurrent queries, 0 disables the query workload")
+	seed := fs.Int64("seed", 1, "seed of the generated rows")
+	drop := fs.Bool("drop", false, "drop the table when done")
+	var queries []string
+	fs.Func("query", "SQL the query workers run in turn, repeatable, aggregates over the table by default",
+		func(v string) error {
+			queries = append(queries, v)
+			return nil
+		})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *duration <= 0 || *batchRows <= 0 || *users <= 0 || *payload < 0 || *ingesters < 0 ||
+		*queriers < 0 || *ingesters+*queriers == 0 {
+		fs.Usage()
+		return errors.New("bench: invalid flags")
+	}
+	quoted := `"` + strings.ReplaceAll(*table, `"`, `""`) + `"`
+	if len(queries) == 0 {
+		queries = []string{
+			"SELECT count(*), sum(value) FROM " + quoted,
+			"SELECT kind, count(*), avg(value) FROM " + quoted + " GROUP BY kind",
+			"SELECT user_id, max(value) FROM " + quoted + " GROUP BY user_id ORDER BY 2 DESC LIMIT 10",
+		}
+	}
+
+	var seq atomic.Int64
+	if *ingesters > 0 {
+		// A first batch creates the table outside the measurement, so the queries have something to read.
+		rng := rand.New(rand.NewSource(*seed - 1))
+		if err := c.Insert(ctx, *table, benchRows(rng, &seq, *batchRows, *users, *payload)); err != nil {
+			return fmt.Errorf("bench: creating %s: %w", *table, err)
+		}
+	}
+	runCtx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+	var ingest, query benchStats
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *ingesters; i++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			for runCtx.Err() == nil {
+				rows := benchRows(rng, &seq, *batchRows, *users, *payload)
+				began := time.Now()
+				err := c.Insert(runCtx, *table, rows)
+				if runCtx.Err() != nil {
+					return
+				}
+				ingest.record(time.Since(began), len(rows), err)
+			}
+		}(rand.New(rand.NewSource(*seed + int64(i))))
+	}
+	for i := 0; i < *queriers; i++ {
+		wg.Add(1)
+		go func(next int) {
+			defer wg.Done()
+			for ; runCtx.Err() == nil; next++ {
+				began := time.Now()
+				res, err := c.QueryResult(runCtx, queries[next%len(queries)], nil)
+				if runCtx.Err() != nil {
+					return
+				}
+				rows := 0
+				if err == nil {
+					rows = len(res.Rows)
+				}
+				query.record(time.Since(began), rows, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var report []map[string]any
+	for _, w := range []struct {
+		name    string
+		workers int
+		stats   *benchStats
+	}{{"ingest", *ingesters, &ingest}, {"query", *queriers, &query}} {
+		if w.workers == 0 {
+			continue
+		}
+		report = append(report, w.stats.report(w.name, elapsed))
+		if w.stats.firstErr != nil {
+			fmt.Fprintf(os.Stderr, "%s: %d errors, the first: %v\n", w.name, w.stats.errors, w.stats.firstErr)
+		}
+	}
+	if *drop {
+		if err := c.DropTable(ctx, *table); err != nil {
+			return fmt.Errorf("bench: %w", err)
+		}
+	}
+	return write(stdout, *format,
+		[]string{"workload", "requests", "errors", "rows", "req_s", "rows_s", "p50_ms", "p90_ms", "p99_ms", "max_ms"},
+		report)
+}
@@ -0,0 +1,437 @@
+// Command scratchctl inserts, queries, imports and exports the tables of a scratch server from the terminal, and
+// benchmarks it.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"scratch/client"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: scratchctl [flags] <command> [arguments]
+
+Commands:
+  insert -table <table> [file ...]         insert JSON objects, arrays or lines from the files or stdin
+  query [-format f] [-admin] [sql]         run a query, read from stdin without sql
+  tables [-format f] [list]                list the tables
+  tables [-format f] schema <table>        describe the columns of a table
+  tables drop <table>                      drop a table
+  import [-format f] [-append] [-async] <table> <url>
+                                           import files the server reads into a table
+  job [-cancel] <id>                       report or cancel an import job
+  export [flags] <table> <url>             export a table to Parquet the server writes
+  bench [flags]                            run synthetic ingest and query workloads and report their latencies
+
+Formats are table, csv and json, which writes one object per line.
+
+Flags:
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout)
+	stop()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scratchctl:", err)
+		os.Exit(1)
+	}
+}
+
+type command func(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"insert": insert,
+	"query":  query,
+	"tables": tables,
+	"import": importTable,
+	"job":    importJob,
+	"export": exportTable,
+	"bench":  bench,
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("scratchctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	baseURL := fs.String("url", envOr("SCRATCH_URL", "http://localhost:8000"), "URL of the server, env SCRATCH_URL")
+	token := fs.String("token", os.Getenv("SCRATCH_TOKEN"), "API key or JWT, env SCRATCH_TOKEN")
+	tag := fs.String("tag", os.Getenv("SCRATCH_QUERY_TAG"), "query tag attributing the queries, env SCRATCH_QUERY_TAG")
+	caCert := fs.String("cacert", "", "PEM file of the CAs verifying the server certificate")
+	cert := fs.String("cert", "", "PEM file of the client certificate")
+	key := fs.String("key", "", "PEM file of the client certificate key")
+	timeout := fs.Duration("timeout", 0, "timeout of every request, none by default")
+	retries := fs.Int("retries", client.DefaultRetries, "retries of requests the server was too busy for")
+	batchRows := fs.Int("batch-rows", client.DefaultBatchRows, "rows per insert request")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	httpClient, err := newHTTPClient(*caCert, *cert, *key, *timeout)
+	if err != nil {
+		return err
+	}
+	c, err := client.New(*baseURL, client.WithToken(*token), client.WithQueryTag(*tag), client.WithHTTPClient(httpClient),
+		client.WithRetries(*retries, client.DefaultBackoff), client.WithBatchRows(*batchRows))
+	if err != nil {
+		return err
+	}
+	return cmd(ctx, c, fs.Args()[1:], stdin, stdout)
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func newHTTPClient(caCert, cert, key string, timeout time.Duration) (*http.Client, error) {
+	if caCert == "" && cert == "" && key == "" {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caCert)
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratchctl %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// insert inserts the JSON values of the files, or of stdin, into the table. A value is an object or an array of
+// objects, so a file may hold an array, an object, or one object per line.
+func insert(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("insert", "[file ...]")
+	table := fs.String("table", "", "table to insert into")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *table == "" {
+		return errors.New("insert: missing -table")
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	batcher := c.NewBatcher(*table)
+	rows := 0
+	for _, name := range files {
+		n, err := insertFile(ctx, batcher, name, stdin)
+		rows += n
+		if err != nil {
+			return fmt.Errorf("insert %s: %w", name, err)
+		}
+	}
+	if err := batcher.Close(ctx); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	_, err := fmt.Fprintf(stdout, "%d rows inserted into %s\n", rows, *table)
+	return err
+}
+
+func insertFile(ctx context.Context, batcher *client.Batcher, name string, stdin io.Reader) (int, error) {
+	r := stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	rows := 0
+	for {
+		var value any
+		err := dec.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			if _, ok := v.(map[string]any); !ok {
+				return rows, fmt.Errorf("row %d is not an object", rows+1)
+			}
+			if err = batcher.Add(ctx, v); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+	}
+}
+
+func query(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("query", "[sql]")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	admin := fs.Bool("admin", false, "run the statement through the admin endpoint, allowing DDL and writes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sql := strings.Join(fs.Args(), " ")
+	if sql == "" || sql == "-" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("query: reading stdin: %w", err)
+		}
+		sql = string(b)
+	}
+	exec := c.QueryResult
+	if *admin {
+		exec = c.Exec
+	}
+	res, err := exec(ctx, sql, nil)
+	if err != nil {
+		return err
+	}
+	columns := make([]string, len(res.Columns))
+	for i, col := range res.Columns {
+		columns[i] = col.Name
+	}
+	if err = write(stdout, *format, columns, res.Rows); err != nil {
+		return err
+	}
+	if res.Truncated {
+		fmt.Fprintf(os.Stderr, "truncated at %d rows\n", res.RowCount)
+	}
+	return nil
+}
+
+func tables(ctx context.Context, c *client.Client, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("tables", "[list | schema <table> | drop <table>]")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sub, rest := "list", fs.Args()
+	if len(rest) > 0 {
+		sub, rest = rest[0], rest[1:]
+	}
+	switch {
+	case sub == "list" && len(rest) == 0:
+		list, err := c.Tables(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([]map[string]any, len(list))
+		for i, t := range list {
+			rows[i] = map[string]any{
+				"schema": t.Schema, "name": t.Name, "columns": t.Columns, "rows": t.Rows,
+				"approx_bytes": t.ApproxBytes, "in_memory": t.InMemory,
+			}
+		}
+		return write(stdout, *format, []string{"schema", "name", "columns", "rows", "approx_bytes", "in_memory"}, rows)
+	case sub == "schema" && len(rest) == 1:
+		schema, err := c.Schema(ctx, rest[0])
+		if err != nil {
+			return err
+		}
+		rows := make([]map[string]any, len(schema.Columns))
+		for i, col := range schema.Columns {
+			rows[i] = map[string]any{"name": col.Name, "type": col.Type, "nullable": col.Nullable}
+			if col.Default != nil {
+				rows[i]["default"] = *col.Default
+			}
+			if col.Generated != "" {
+				rows[i]["generated"] = col.Generated
+			}
+		}
+		return write(stdout, *format, []string{"name", "type", "nullable", "default", "generated"}, rows)
+	case sub == "drop" && len(rest) == 1:
+		if err := c.DropTable(ctx, rest[0]); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(stdout, "dropped %s\n", rest[0])
+		return err
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+}
+
+func importTable(ctx context.Context, c *client.Client, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("import", "<table> <url>")
+	req := client.ImportRequest{}
+	var csv client.CSVOptions
+	fs.StringVar(&req.Format, "format", "", "parquet, csv or json, inferred from the extension by default")
+	fs.BoolVar(&req.Append, "append", false, "insert into an existing table instead of creating it")
+	fs.StringVar(&csv.Delimiter, "delimiter", "", "field delimiter of csv files, detected by default")
+	fs.StringVar(&csv.Quote, "quote", "", "quote character of csv files, detected by default")
+	fs.StringVar(&csv.Null, "null", "", "field of csv files read as NULL instead of the empty field")
+	fs.StringVar(&csv.DecimalSeparator, "decimal-separator", "", "decimal separator of numbers in csv files")
+	fs.Func("header", "whether the first line of csv files names the columns, detected by default", func(v string) error {
+		header, err := strconv.ParseBool(v)
+		csv.Header = &header
+		return err
+	})
+	fs.Func("type", "column=TYPE overriding the detected type of a csv column, repeatable", func(v string) error {
+		column, dataType, ok := strings.Cut(v, "=")
+		if !ok {
+			return errors.New("expected column=TYPE")
+		}
+		if csv.Types == nil {
+			csv.Types = make(map[string]string)
+		}
+		csv.Types[column] = dataType
+		return nil
+	})
+	fs.BoolVar(&csv.IgnoreErrors, "ignore-errors", false, "skip the lines of csv files that don't parse or convert")
+	async := fs.Bool("async", false, "start an import job and print its ID instead of waiting for the import")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	req.URL = fs.Arg(1)
+	if csv.Delimiter != "" || csv.Quote != "" || csv.Null != "" || csv.DecimalSeparator != "" || csv.Header != nil ||
+		csv.Types != nil || csv.IgnoreErrors {
+		req.CSV = &csv
+	}
+	if *async {
+		job, err := c.StartImport(ctx, fs.Arg(0), req)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stdout, "import job %s started\n", job.ID)
+		return err
+	}
+	res, err := c.Import(ctx, fs.Arg(0), req)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(stdout, "%d rows imported into %s\n", res.Rows, res.Table); err != nil {
+		return err
+	}
+	return writeRejected(stdout, res.Rejected)
+}
+
+func writeRejected(stdout io.Writer, rejected []client.RejectedRow) error {
+	for _, row := range rejected {
+		if _, err := fmt.Fprintf(stdout, "skipped %s:%d: %s\n", row.File, row.Line, row.Error); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importJob(ctx context.Context, c *client.Client, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("job", "<id>")
+	cancel := fs.Bool("cancel", false, "cancel the job, rolling back its load")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	get := c.ImportJob
+	if *cancel {
+		get = c.CancelImportJob
+	}
+	job, err := get(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	progress := fmt.Sprintf("%d rows", job.Rows)
+	if job.BytesTotal > 0 {
+		progress += fmt.Sprintf(", %d of %d bytes read", job.BytesRead, job.BytesTotal)
+	}
+	if _, err = fmt.Fprintf(stdout, "%s %s into %s: %s\n", job.Kind, job.Status, job.Table, progress); err != nil {
+		return err
+	}
+	if job.Error != "" {
+		if _, err = fmt.Fprintln(stdout, job.Error); err != nil {
+			return err
+		}
+	}
+	return writeRejected(stdout, job.Rejected)
+}
+
+func exportTable(ctx context.Context, c *client.Client, args []string, _ io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("export", "<table> <url>")
+	var req client.ExportRequest
+	fs.Func("filter", "column:op:value selecting the exported rows, repeatable", func(v string) error {
+		req.Filters = append(req.Filters, v)
+		return nil
+	})
+	partitionBy := fs.String("partition-by", "", "comma separated columns of a Hive partitioned layout")
+	fs.StringVar(&req.Compression, "compression", "", "snappy, the default, zstd, gzip or uncompressed")
+	fs.BoolVar(&req.Overwrite, "overwrite", false, "replace existing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	req.URL = fs.Arg(1)
+	if *partitionBy != "" {
+		req.PartitionBy = strings.Split(*partitionBy, ",")
+	}
+	manifest, err := c.Export(ctx, fs.Arg(0), req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d rows exported from %s\n", manifest.Rows, manifest.Table)
+	for _, f := range manifest.Files {
+		fmt.Fprintln(stdout, f)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"scratch/internal"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchctl(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	ctl := func(stdin string, args ...string) string {
+		var out bytes.Buffer
+		args = append([]string{"-url", server.URL, "-batch-rows", "2"}, args...)
+		require.NoError(t, run(context.Background(), args, strings.NewReader(stdin), &out))
+		return out.String()
+	}
+
+	assert.Equal(t, "3 rows inserted into events\n",
+		ctl(`{"id": 1, "name": "a"}
+			[{"id": 2, "name": "b\tc"}, {"id": 3}]`, "insert", "-table", "events"))
+	assert.Equal(t, "{\"id\":2,\"name\":\"b\\tc\"}\n{\"id\":3,\"name\":null}\n",
+		ctl("", "query", "-format", "json", "select id, name from events where id > 1 order by id"))
+	assert.Equal(t, "id,name\n1,a\n", ctl("select id, name from events where id = 1", "query", "-format", "csv"))
+	assert.Equal(t, "id  name\n1   a\n2   b c\n3   NULL\n",
+		ctl("", "query", "select id, name from events order by id"))
+	assert.Contains(t, ctl("", "tables"), "events")
+	assert.Contains(t, ctl("", "tables", "-format", "csv", "schema", "events"), "id,DOUBLE,true")
+	assert.Equal(t, "dropped events\n", ctl("", "tables", "drop", "events"))
+	assert.NotContains(t, ctl("", "tables"), "events")
+
+	var out bytes.Buffer
+	err = run(context.Background(), []string{"-url", server.URL, "query", "select nope"}, nil, &out)
+	assert.ErrorContains(t, err, "400")
+	err = run(context.Background(), []string{"-url", server.URL, "job", "nope"}, nil, &out)
+	assert.ErrorContains(t, err, "404")
+	err = run(context.Background(), []string{"-url", server.URL, "nope"}, nil, &out)
+	assert.ErrorContains(t, err, `unknown command "nope"`)
+}
+
+func TestBench(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	var out bytes.Buffer
+	require.NoError(t, run(context.Background(), []string{"-url", server.URL, "bench", "-duration", "300ms",
+		"-ingest-workers", "1", "-query-workers", "1", "-rows", "10", "-format", "json"}, nil, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	for i, workload := range []string{"ingest", "query"} {
+		var report map[string]any
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &report))
+		assert.Equal(t, workload, report["workload"])
+		assert.Positive(t, report["requests"])
+		assert.Zero(t, report["errors"])
+	}
+	out.Reset()
+	require.NoError(t, run(context.Background(), []string{"-url", server.URL, "tables"}, nil, &out))
+	assert.Contains(t, out.String(), "bench_events")
+
+	err = run(context.Background(), []string{"-url", server.URL, "bench", "-ingest-workers", "0", "-query-workers",
+		"0"}, nil, &out)
+	assert.Error(t, err)
+}
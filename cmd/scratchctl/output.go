@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// write writes the rows with the columns in order in the format.
+func write(w io.Writer, format string, columns []string, rows []map[string]any) error {
+	switch format {
+	case "table":
+		return writeTable(w, columns, rows)
+	case "csv":
+		return writeCSV(w, columns, rows)
+	case "json":
+		return writeJSON(w, columns, rows)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func writeTable(w io.Writer, columns []string, rows []map[string]any) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, col := range columns {
+			// Tabs and newlines would break the alignment.
+			values[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(formatValue(row[col]))
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, columns []string, rows []map[string]any) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	values := make([]string, len(columns))
+	for _, row := range rows {
+		for i, col := range columns {
+			if row[col] == nil {
+				values[i] = ""
+				continue
+			}
+			values[i] = formatValue(row[col])
+		}
+		if err := cw.Write(values); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes a JSON object per row with the keys in the order of the columns, which insert reads back.
+func writeJSON(w io.Writer, columns []string, rows []map[string]any) error {
+	var buf bytes.Buffer
+	for _, row := range rows {
+		buf.Reset()
+		buf.WriteByte('{')
+		for i, col := range columns {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(col)
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(row[col])
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteString("}\n")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// WithAccessLog logs every request to the logger once it is answered, with its method, path, status, duration,
+// response bytes, caller and request id. Requests without an X-Request-ID header get a generated one, which the
+// response carries and the handlers use, e.g. to deduplicate inserts.
+func WithAccessLog(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.accessLog = logger
+	}
+}
+
+type accessEntryContextKey struct{}
+
+// accessEntry collects what the handlers learn about the request for its access log line.
+type accessEntry struct {
+	caller string
+}
+
+// setAccessCaller records the authenticated caller of the request for the access log.
+func setAccessCaller(ctx context.Context, caller string) {
+	if e, ok := ctx.Value(accessEntryContextKey{}).(*accessEntry); ok {
+		e.caller = caller
+	}
+}
+
+// accessRecorder captures the status and size of the response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecorder) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Flush and Hijack keep the streaming and WebSocket endpoints working behind the recorder.
+func (a *accessRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (a *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		a.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// logAccess wraps next with the access log, see WithAccessLog.
+func (s *Server) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// requestID sets the response header and reuses the id for the handlers through the request header.
+		r.Header.Set(RequestIDHeader, requestID(w, r))
+		entry := &accessEntry{caller: r.RemoteAddr}
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryContextKey{}, entry)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		s.accessLog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("caller", entry.caller),
+			slog.String("request_id", r.Header.Get(RequestIDHeader)),
+		)
+	})
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ErrTableAccessDenied is returned when the API key or token of a request lacks the grant a TableACL requires.
+var ErrTableAccessDenied = errors.New("table access denied")
+
+// TableACL restricts the tables matching Table, a path.Match pattern such as finance_*, to the grantees listed.
+// Grantees are roles of API keys and tokens, or a key or token itself as key:<name> or jwt:<subject>. The first ACL
+// matching a table applies, tables matching none are open to every key and token. Admins aren't restricted.
+type TableACL struct {
+	Table string   `json:"table" yaml:"table"`
+	Read  []string `json:"read,omitempty" yaml:"read"`
+	// Write grants inserts and the other writes to the table through the API. It doesn't imply Read.
+	Write []string `json:"write,omitempty" yaml:"write"`
+}
+
+// WithTableACLs enforces the ACLs on the requests of API keys and tokens, see TableACL.
+func WithTableACLs(acls []TableACL) StoreOption {
+	return func(s *Store) {
+		s.acls = acls
+	}
+}
+
+// ValidateTableACLs checks the patterns of the ACLs.
+func ValidateTableACLs(acls []TableACL) error {
+	for i, acl := range acls {
+		if acl.Table == "" {
+			return fmt.Errorf("table acl %d: missing table", i)
+		}
+		if _, err := path.Match(acl.Table, ""); err != nil {
+			return fmt.Errorf("table acl %d: table %q: %w", i, acl.Table, err)
+		}
+	}
+	return nil
+}
+
+// granted reports whether the principal is one of the grantees or has one of their roles.
+func (p Principal) granted(grantees []string) bool {
+	return slices.Contains(grantees, p.Name) || slices.ContainsFunc(p.Roles, func(role string) bool {
+		return slices.Contains(grantees, role)
+	})
+}
+
+// aclFor returns the first ACL matching the table, ignoring case like the catalog.
+func (s *Store) aclFor(table string) (TableACL, bool) {
+	for _, acl := range s.acls {
+		if ok, _ := path.Match(strings.ToLower(acl.Table), strings.ToLower(table)); ok {
+			return acl, true
+		}
+	}
+	return TableACL{}, false
+}
+
+// restricted reports whether the principal of the context is subject to the ACLs: it has no admin scope, and requests
+// without a principal come from servers without authentication or from the store itself.
+func (s *Store) restricted(ctx context.Context) (Principal, bool) {
+	p, ok := requestPrincipal(ctx)
+	return p, ok && len(s.acls) > 0 && !slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+// checkTableAccess refuses reading, or writing if write is set, the table if its ACL doesn't grant it to the principal
+// of the context.
+func (s *Store) checkTableAccess(ctx context.Context, table string, write bool) error {
+	p, ok := s.restricted(ctx)
+	if !ok {
+		return nil
+	}
+	acl, ok := s.aclFor(table)
+	if !ok {
+		return nil
+	}
+	grantees, op := acl.Read, "read"
+	if write {
+		grantees, op = acl.Write, "write"
+	}
+	if p.granted(grantees) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s may not %s %s", ErrTableAccessDenied, p.Name, op, table)
+}
+
+// checkQueryAccess refuses the query if it references a table the principal of the context may not read. Every
+// identifier of the query naming an existing table counts as a reference, which errs on the side of refusing: a column
+// or alias named like a restricted table is refused too. Tables and views derived from a restricted table, e.g. by
+// WithViews or WithRollups, need an ACL of their own.
+func (s *Store) checkQueryAccess(ctx context.Context, query string) error {
+	if _, ok := s.restricted(ctx); !ok {
+		return nil
+	}
+	tokens, err := lexSQL(query)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, t := range tokens {
+		if t.kind == sqlWord || t.kind == sqlQuotedIdent {
+			names[strings.ToLower(t.text)] = true
+		}
+	}
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT DISTINCT lower(table_name) FROM information_schema.tables WHERE table_catalog IN "+ownCatalogs)
+	if err != nil {
+		return fmt.Errorf("listing tables: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return fmt.Errorf("listing tables: %w", err)
+		}
+		if !names[table] {
+			continue
+		}
+		if err = s.checkTableAccess(ctx, table, false); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("listing tables: %w", err)
+	}
+	return nil
+}
+
+// checkQuery validates the statement, its SQL policy and the access of the principal of the context to the tables it
+// references, including AuditTable, and returns it with row-level security applied. A statement it returned is
+// returned as is.
+func (s *Store) checkQuery(ctx context.Context, stmt *QueryStatement) (*QueryStatement, error) {
+	if err := stmt.Valid(); err != nil {
+		return nil, err
+	}
+	if stmt.secured {
+		return stmt, nil
+	}
+	if err := s.checkSQLPolicy(ctx, stmt.Query); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuditAccess(ctx, stmt.Query); err != nil {
+		return nil, err
+	}
+	if err := s.checkQueryAccess(ctx, stmt.Query); err != nil {
+		return nil, err
+	}
+	query, err := s.secureQuery(ctx, stmt.Query)
+	if err != nil {
+		return nil, err
+	}
+	out := *stmt
+	out.Query, out.secured = query, true
+	return &out, nil
+}
+
+// routeTable returns the table a request to the route pattern addresses: the {table} segment of the path, or the
+// Table parameter of POST /data.
+func routeTable(r *http.Request, pattern string) string {
+	if pattern == "POST /data" || pattern == "POST /data/preview" {
+		return r.URL.Query().Get("Table")
+	}
+	_, route, _ := strings.Cut(pattern, " ")
+	i := slices.Index(strings.Split(route, "/"), "{table}")
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	if i < 0 || i >= len(segments) {
+		return ""
+	}
+	table, err := url.PathUnescape(segments[i])
+	if err != nil {
+		return ""
+	}
+	return table
+}
+
+// checkRouteAccess refuses requests to the table routes whose ACL doesn't grant the principal of the request reading,
+// or for the writes, writing the table, those row-level security and column masks don't allow and those of AuditTable.
+func (s *Server) checkRouteAccess(r *http.Request, pattern string) error {
+	table := routeTable(r, pattern)
+	if table == "" {
+		return nil
+	}
+	if err := s.store.checkAuditRoute(r.Context(), table, isWritePattern(pattern)); err != nil {
+		return err
+	}
+	if err := s.store.checkTableAccess(r.Context(), table, isWritePattern(pattern)); err != nil {
+		return err
+	}
+	return s.store.checkGuardedRoute(r.Context(), pattern, table)
+}
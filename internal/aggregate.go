@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aggregateFuncs maps the functions of the metrics parameter to SQL.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var aggregateFuncs = map[string]string{
+	"count":          "count(%s)",
+	"count_distinct": "count(DISTINCT %s)",
+	"sum":            "sum(%s)",
+	"avg":            "avg(%s)",
+	"min":            "min(%s)",
+	"max":            "max(%s)",
+}
+
+var metricRegex = regexp.MustCompile(`^([a-z_]+)(?:\(([^()]*)\))?$`)
+
+// metricExpr builds the select expression of a metric such as count, sum(amount) or count_distinct(user_id). The
+// result column is named after the function and column, e.g. sum_amount.
+func metricExpr(cols map[string]bool, metric string) (string, error) {
+	m := metricRegex.FindStringSubmatch(strings.TrimSpace(metric))
+	if m == nil {
+		return "", fmt.Errorf("invalid metric %q: expected function or function(column)", metric)
+	}
+	fn, arg := m[1], m[2]
+	format, ok := aggregateFuncs[fn]
+	if !ok {
+		return "", fmt.Errorf("invalid metric %q: unknown function %q", metric, fn)
+	}
+	if arg == "" {
+		if fn != "count" {
+			return "", fmt.Errorf("invalid metric %q: %s takes a column", metric, fn)
+		}
+		return "count(*) AS count", nil
+	}
+	col, err := column(cols, arg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(format+" AS %s", col, quoteIdent(fn+"_"+arg)), nil
+}
+
+// parseSince reads a point in time as RFC 3339 or as a duration before now, e.g. 24h.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or a duration", v)
+	}
+	return t, nil
+}
+
+// aggregateStatement builds the parameterized GROUP BY query of the aggregate endpoint. Metrics default to count.
+func (s *Store) aggregateStatement(ctx context.Context, table string, params url.Values) (*QueryStatement, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	var groups, selected []string
+	if v := params.Get("group_by"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			col, colErr := column(cols, name)
+			if colErr != nil {
+				return nil, colErr
+			}
+			groups = append(groups, col)
+		}
+	}
+	selected = append(selected, groups...)
+	metrics := params.Get("metrics")
+	if metrics == "" {
+		metrics = "count"
+	}
+	for _, metric := range strings.Split(metrics, ",") {
+		expr, metricErr := metricExpr(cols, metric)
+		if metricErr != nil {
+			return nil, metricErr
+		}
+		selected = append(selected, expr)
+	}
+
+	stmt := &QueryStatement{}
+	var conditions []string
+	for _, filter := range params["filter"] {
+		condition, values, filterErr := filterCondition(cols, filter)
+		if filterErr != nil {
+			return nil, filterErr
+		}
+		conditions = append(conditions, condition)
+		stmt.Params = append(stmt.Params, values...)
+	}
+	now := time.Now()
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		param, op := bound.param, bound.op
+		v := params.Get(param)
+		if v == "" {
+			continue
+		}
+		name := params.Get("time_column")
+		if name == "" {
+			return nil, fmt.Errorf("%s requires time_column", param)
+		}
+		col, colErr := column(cols, name)
+		if colErr != nil {
+			return nil, colErr
+		}
+		t, timeErr := parseSince(v, now)
+		if timeErr != nil {
+			return nil, timeErr
+		}
+		// Columns without time zone are compared in UTC.
+		conditions = append(conditions, fmt.Sprintf("%s %s ?::TIMESTAMP", col, op))
+		stmt.Params = append(stmt.Params, t.UTC().Format("2006-01-02 15:04:05.999999"))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(selected, ", "), quoteIdent(table))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if len(groups) > 0 {
+		query += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	}
+	stmt.Query = query
+	if v := params.Get("limit"); v != "" {
+		if stmt.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("parsing limit: %w", err)
+		}
+	}
+	stmt.Cursor = params.Get("cursor")
+	return stmt, nil
+}
+
+// HandleTableAggregate responds with metrics of the table in the path, without SQL: group_by=a,b,
+// metrics=count,sum(amount) with the functions count, count_distinct, sum, avg, min and max, since and until as RFC
+// 3339 or a duration before now along with time_column, and filter as on the rows endpoint.
+func (s *Server) HandleTableAggregate(w http.ResponseWriter, r *http.Request) {
+	stmt, err := s.store.aggregateStatement(r.Context(), r.PathValue("table"), r.URL.Query())
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle table aggregate", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle table aggregate", err)
+		return
+	}
+	s.writeQuery(w, r, stmt)
+}
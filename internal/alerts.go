@@ -0,0 +1,415 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlertNotFound = errors.New("alert not found")
+	ErrInvalidAlert  = errors.New("invalid alert")
+	ErrAlertRunning  = errors.New("alert is being evaluated")
+)
+
+// alertRows is how many rows of a firing alert its notifications carry.
+const alertRows = 10
+
+// AlertState is the outcome of the last evaluation of an alert.
+type AlertState string
+
+const (
+	AlertOK     AlertState = "ok"
+	AlertFiring AlertState = "firing"
+	// AlertError is the state of an alert whose query failed.
+	AlertError AlertState = "error"
+)
+
+// The kinds of targets notified of alerts.
+const (
+	// AlertTargetWebhook receives an AlertNotification, signed like the schema change webhooks.
+	AlertTargetWebhook = "webhook"
+	// AlertTargetSlack is a Slack incoming webhook URL and receives a message.
+	AlertTargetSlack = "slack"
+)
+
+// AlertTarget is where the state changes of an alert are sent.
+type AlertTarget struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Secret signs the notifications of webhook targets. It is write-only, responses only carry it redacted.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Alert evaluates SQL every Interval and fires while it returns rows, so the condition goes into the query, e.g.
+// SELECT count(*) AS errors FROM logs WHERE level = 'error' AND ts > now() - INTERVAL 5 MINUTE HAVING count(*) > 100.
+// The target is notified when the alert starts firing, resolves, or its query starts failing.
+type Alert struct {
+	Name     string      `json:"name"`
+	SQL      string      `json:"sql"`
+	Params   []any       `json:"params,omitempty"`
+	Interval string      `json:"interval"`
+	Target   AlertTarget `json:"target"`
+	Disabled bool        `json:"disabled,omitempty"`
+
+	// State is unset until the first evaluation. Since is when the alert entered it.
+	State          AlertState       `json:"state,omitempty"`
+	Since          *time.Time       `json:"since,omitempty"`
+	LastEvaluation *time.Time       `json:"last_evaluation,omitempty"`
+	NextEvaluation *time.Time       `json:"next_evaluation,omitempty"`
+	LastRows       []map[string]any `json:"last_rows,omitempty"`
+	LastError      string           `json:"last_error,omitempty"`
+	// LastNotification is when the target was last notified, NotifyError why the last notification was given up.
+	LastNotification *time.Time `json:"last_notification,omitempty"`
+	NotifyError      string     `json:"notify_error,omitempty"`
+}
+
+// AlertNotification is the body posted to webhook targets on a state change of an alert.
+type AlertNotification struct {
+	Alert    string     `json:"alert"`
+	State    AlertState `json:"state"`
+	Previous AlertState `json:"previous,omitempty"`
+	SQL      string     `json:"sql"`
+	// Rows are the first rows of a firing alert.
+	Rows  []map[string]any `json:"rows,omitempty"`
+	Error string           `json:"error,omitempty"`
+	At    time.Time        `json:"at"`
+}
+
+// Validate checks the name, query and target and returns the interval.
+func (a *Alert) Validate() (time.Duration, error) {
+	if !savedQueryNameRegex.MatchString(a.Name) {
+		return 0, fmt.Errorf("%w: name must match %s", ErrInvalidAlert, savedQueryNameRegex)
+	}
+	if _, err := (&QueryStatement{Query: a.SQL}).singleRead(); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidAlert, err)
+	}
+	interval, err := time.ParseDuration(a.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("%w: parsing interval: %w", ErrInvalidAlert, err)
+	}
+	if interval < time.Second {
+		return 0, fmt.Errorf("%w: interval must be at least 1s", ErrInvalidAlert)
+	}
+	if err = a.Target.validate(); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidAlert, err)
+	}
+	return interval, nil
+}
+
+func (t AlertTarget) validate() error {
+	if t.Type != AlertTargetWebhook && t.Type != AlertTargetSlack {
+		return fmt.Errorf("target type must be %s or %s", AlertTargetWebhook, AlertTargetSlack)
+	}
+	if !webhookURL(t.URL) {
+		return fmt.Errorf("target url must be an absolute http or https URL: %q", t.URL)
+	}
+	return nil
+}
+
+// redact returns the alert with the secret of its target replaced.
+func (a Alert) redact() Alert {
+	if a.Target.Secret != "" {
+		a.Target.Secret = redacted
+	}
+	return a
+}
+
+type alertEntry struct {
+	alert      Alert
+	interval   time.Duration
+	evaluating bool
+}
+
+// Alerts evaluates the registered alerts once Run is called and notifies their targets of state changes.
+type Alerts struct {
+	store   *Store
+	timeout time.Duration
+	client  *webhookClient
+
+	mu      sync.Mutex
+	entries map[string]*alertEntry
+	wake    chan struct{}
+}
+
+// NewAlerts returns an alert manager whose evaluations are bound by timeout, zero for no bound. Notifications are
+// retried like the deliveries of the webhook configuration.
+func NewAlerts(store *Store, timeout time.Duration, cfg WebhookConfig) *Alerts {
+	return &Alerts{
+		store:   store,
+		timeout: timeout,
+		client:  newWebhookClient(cfg),
+		entries: make(map[string]*alertEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Put registers or replaces an alert, which starts over without a state, and reports whether it is new. It returns
+// the alert redacted.
+func (as *Alerts) Put(a Alert) (Alert, bool, error) {
+	interval, err := a.Validate()
+	if err != nil {
+		return Alert{}, false, err
+	}
+	a.State, a.Since, a.LastEvaluation, a.NextEvaluation, a.LastRows, a.LastError = "", nil, nil, nil, nil, ""
+	a.LastNotification, a.NotifyError = nil, ""
+	if !a.Disabled {
+		next := time.Now().UTC()
+		a.NextEvaluation = &next
+	}
+	as.mu.Lock()
+	_, exists := as.entries[a.Name]
+	as.entries[a.Name] = &alertEntry{alert: a, interval: interval}
+	as.mu.Unlock()
+	select {
+	case as.wake <- struct{}{}:
+	default:
+	}
+	return a.redact(), !exists, nil
+}
+
+// Get returns the alert redacted.
+func (as *Alerts) Get(name string) (Alert, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	e, ok := as.entries[name]
+	if !ok {
+		return Alert{}, fmt.Errorf("%w: %s", ErrAlertNotFound, name)
+	}
+	return e.alert.redact(), nil
+}
+
+// List returns the alerts redacted.
+func (as *Alerts) List() []Alert {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	out := make([]Alert, 0, len(as.entries))
+	for _, e := range as.entries {
+		out = append(out, e.alert.redact())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (as *Alerts) Delete(name string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.entries[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrAlertNotFound, name)
+	}
+	delete(as.entries, name)
+	return nil
+}
+
+// Run evaluates the alerts that are due until ctx is done. An alert still being evaluated when it comes due again is
+// skipped for that evaluation.
+func (as *Alerts) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-as.wake:
+		case <-timer.C:
+		}
+		next := as.evaluateDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// evaluateDue starts the evaluations that are due and returns the time until the next one.
+func (as *Alerts) evaluateDue(ctx context.Context) time.Duration {
+	now := time.Now().UTC()
+	wait := time.Minute
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for _, e := range as.entries {
+		if e.alert.NextEvaluation == nil {
+			continue
+		}
+		if !e.alert.NextEvaluation.After(now) {
+			next := now.Add(e.interval)
+			e.alert.NextEvaluation = &next
+			if !e.evaluating {
+				e.evaluating = true
+				go as.evaluate(ctx, e)
+			}
+		}
+		wait = min(wait, e.alert.NextEvaluation.Sub(now))
+	}
+	return wait
+}
+
+// EvaluateNow evaluates the alert immediately, notifying its target of a state change, and waits for it to finish.
+func (as *Alerts) EvaluateNow(ctx context.Context, name string) (Alert, error) {
+	as.mu.Lock()
+	e, ok := as.entries[name]
+	if !ok {
+		as.mu.Unlock()
+		return Alert{}, fmt.Errorf("%w: %s", ErrAlertNotFound, name)
+	}
+	if e.evaluating {
+		as.mu.Unlock()
+		return Alert{}, fmt.Errorf("%w: %s", ErrAlertRunning, name)
+	}
+	e.evaluating = true
+	as.mu.Unlock()
+	as.evaluate(ctx, e)
+	return as.Get(name)
+}
+
+// evaluate runs the query of the alert, records its state and notifies the target if the state changed, except for
+// a first evaluation that finds the alert ok.
+func (as *Alerts) evaluate(ctx context.Context, e *alertEntry) {
+	as.mu.Lock()
+	a := e.alert
+	as.mu.Unlock()
+	queryCtx := ctx
+	if as.timeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, as.timeout)
+		defer cancel()
+	}
+	res, err := as.store.Fetch(queryCtx, &QueryStatement{Query: a.SQL, Params: a.Params, MaxRows: alertRows})
+	now := time.Now().UTC()
+	n := AlertNotification{Alert: a.Name, State: AlertOK, Previous: a.State, SQL: a.SQL, At: now}
+	switch {
+	case err != nil:
+		n.State, n.Error = AlertError, err.Error()
+	case len(res.Rows) > 0:
+		n.State, n.Rows = AlertFiring, res.Rows
+	}
+
+	as.mu.Lock()
+	e.evaluating = false
+	e.alert.LastEvaluation, e.alert.LastRows, e.alert.LastError = &now, n.Rows, n.Error
+	changed := n.State != e.alert.State
+	if changed {
+		e.alert.State, e.alert.Since = n.State, &now
+	}
+	as.mu.Unlock()
+	if !changed || (n.Previous == "" && n.State == AlertOK) {
+		return
+	}
+
+	notifyErr := as.notify(ctx, a.Target, n)
+	if notifyErr != nil {
+		slog.Error("alerts: notifying target", "name", a.Name, "state", n.State, "err", notifyErr)
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	// The outcome is dropped if the alert was replaced or deleted meanwhile.
+	if as.entries[a.Name] != e {
+		return
+	}
+	e.alert.NotifyError = ""
+	if notifyErr != nil {
+		e.alert.NotifyError = notifyErr.Error()
+		return
+	}
+	notified := time.Now().UTC()
+	e.alert.LastNotification = &notified
+}
+
+// notify posts the notification to the target, as a message for Slack.
+func (as *Alerts) notify(ctx context.Context, target AlertTarget, n AlertNotification) error {
+	var payload any = n
+	if target.Type == AlertTargetSlack {
+		payload = map[string]string{"text": slackAlertText(n)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding notification: %w", err)
+	}
+	return as.client.post(ctx, target.URL, target.Secret, "alert_"+string(n.State), body)
+}
+
+// slackAlertText formats the notification as a Slack message with the first row of a firing alert.
+func slackAlertText(n AlertNotification) string {
+	var sb strings.Builder
+	switch n.State {
+	case AlertFiring:
+		fmt.Fprintf(&sb, ":rotating_light: Alert *%s* is firing", n.Alert)
+	case AlertError:
+		fmt.Fprintf(&sb, ":warning: Alert *%s* failed to evaluate: %s", n.Alert, n.Error)
+	default:
+		fmt.Fprintf(&sb, ":white_check_mark: Alert *%s* resolved", n.Alert)
+	}
+	if len(n.Rows) > 0 {
+		if row, err := json.Marshal(n.Rows[0]); err == nil {
+			fmt.Fprintf(&sb, "\n```%s```", row)
+		}
+	}
+	return sb.String()
+}
+
+func (s *Server) HandleListAlerts(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list alerts: writing response", s.alerts.List())
+}
+
+// HandlePutAlert creates or replaces the alert named in the path.
+func (s *Server) HandlePutAlert(w http.ResponseWriter, r *http.Request) {
+	var a Alert
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put alert: decoding request body", err)
+		return
+	}
+	a.Name = r.PathValue("name")
+	a, created, err := s.alerts.Put(a)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put alert", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put alert: writing response", a)
+}
+
+func (s *Server) HandleGetAlert(w http.ResponseWriter, r *http.Request) {
+	a, err := s.alerts.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get alert", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get alert: writing response", a)
+}
+
+func (s *Server) HandleDeleteAlert(w http.ResponseWriter, r *http.Request) {
+	if err := s.alerts.Delete(r.PathValue("name")); err != nil {
+		s.writeError(w, http.StatusNotFound, "handle delete alert", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEvaluateAlert evaluates the alert named in the path outside of its interval and responds with its state.
+func (s *Server) HandleEvaluateAlert(w http.ResponseWriter, r *http.Request) {
+	a, err := s.alerts.EvaluateNow(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrAlertRunning) {
+		s.writeError(w, http.StatusConflict, "handle evaluate alert", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle evaluate alert", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle evaluate alert: writing response", a)
+}
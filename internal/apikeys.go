@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
+
+// apiKeyPrefix starts every generated key, so leaked keys are easy to search for.
+const apiKeyPrefix = "scratch_"
+
+// APIKey grants access to the server, sent as Authorization: Bearer <key>. Only admin keys reach the /admin
+// endpoints.
+type APIKey struct {
+	ID   string `json:"id" yaml:"-"`
+	Name string `json:"name" yaml:"name"`
+	// Key is the secret. It is only returned when the key is created, the server keeps its SHA-256 hash.
+	Key   string `json:"key,omitempty" yaml:"key"`
+	Admin bool   `json:"admin,omitempty" yaml:"admin"`
+	// Tenant is who the inserts with the key are accounted to, see Quotas.
+	Tenant string `json:"tenant,omitempty" yaml:"tenant"`
+	// Roles are granted access to tables by TableACL.
+	Roles []string `json:"roles,omitempty" yaml:"roles"`
+	// ResultLimits override the result limits of the server for the key. Zero fields keep those of the server.
+	ResultLimits *ResultLimits `json:"result_limits,omitempty" yaml:"result_limits"`
+	// Configured keys come from the configuration and can't be revoked through the API.
+	Configured bool       `json:"configured,omitempty" yaml:"-"`
+	Created    time.Time  `json:"created" yaml:"-"`
+	LastUsed   *time.Time `json:"last_used,omitempty" yaml:"-"`
+}
+
+// storedAPIKey is an API key as kept in the keys file.
+type storedAPIKey struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Hash         string        `json:"hash"`
+	Admin        bool          `json:"admin,omitempty"`
+	Tenant       string        `json:"tenant,omitempty"`
+	Roles        []string      `json:"roles,omitempty"`
+	ResultLimits *ResultLimits `json:"result_limits,omitempty"`
+	Created      time.Time     `json:"created"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyEntry struct {
+	key  APIKey
+	hash string
+}
+
+// APIKeys holds the API keys of the server. Keys created through the admin endpoints are kept hashed in the file at
+// path, if there is one, and survive restarts.
+type APIKeys struct {
+	path string
+
+	mu     sync.Mutex
+	byID   map[string]*apiKeyEntry
+	byHash map[string]*apiKeyEntry
+}
+
+// NewAPIKeys loads the keys in the file at path, if it exists, and adds the configured keys. At least one of them must
+// be an admin key, or nobody could manage the keys.
+func NewAPIKeys(path string, configured []APIKey) (*APIKeys, error) {
+	ks := &APIKeys{path: path, byID: make(map[string]*apiKeyEntry), byHash: make(map[string]*apiKeyEntry)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("api keys: reading %s: %w", path, err)
+		}
+		var stored []storedAPIKey
+		if err == nil {
+			if err = json.Unmarshal(data, &stored); err != nil {
+				return nil, fmt.Errorf("api keys: parsing %s: %w", path, err)
+			}
+		}
+		for _, k := range stored {
+			ks.add(&apiKeyEntry{
+				key: APIKey{
+					ID: k.ID, Name: k.Name, Admin: k.Admin, Tenant: k.Tenant, Roles: k.Roles, ResultLimits: k.ResultLimits,
+					Created: k.Created,
+				},
+				hash: k.Hash,
+			})
+		}
+	}
+	if err := ks.configure(configured); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload replaces the configured keys, keeping the created ones. Requests with a removed key are refused from now on.
+func (ks *APIKeys) Reload(configured []APIKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.configure(configured)
+}
+
+// configure replaces the configured keys, unless one is invalid or no admin key would remain. Keys configured before
+// keep their creation and last use. The caller holds the lock.
+func (ks *APIKeys) configure(configured []APIKey) error {
+	now := time.Now().UTC()
+	entries := make(map[string]*apiKeyEntry, len(configured))
+	admin := false
+	for i, k := range configured {
+		if k.Name == "" || k.Key == "" {
+			return fmt.Errorf("%w: configured key %d needs a name and a key", ErrInvalidAPIKey, i)
+		}
+		hash := hashAPIKey(k.Key)
+		previous, exists := ks.byHash[hash]
+		if _, duplicate := entries[hash]; duplicate || (exists && !previous.key.Configured) {
+			return fmt.Errorf("%w: configured key %s is not unique", ErrInvalidAPIKey, k.Name)
+		}
+		e := &apiKeyEntry{
+			key: APIKey{
+				ID: "config-" + hash[:12], Name: k.Name, Admin: k.Admin, Tenant: k.Tenant, Roles: k.Roles,
+				ResultLimits: k.ResultLimits, Configured: true, Created: now,
+			},
+			hash: hash,
+		}
+		if exists {
+			e.key.Created, e.key.LastUsed = previous.key.Created, previous.key.LastUsed
+		}
+		entries[hash] = e
+		admin = admin || k.Admin
+	}
+	for _, e := range ks.byID {
+		admin = admin || (e.key.Admin && !e.key.Configured)
+	}
+	if !admin {
+		return fmt.Errorf("%w: at least one admin key must be configured", ErrInvalidAPIKey)
+	}
+	for id, e := range ks.byID {
+		if e.key.Configured {
+			delete(ks.byID, id)
+			delete(ks.byHash, e.hash)
+		}
+	}
+	for _, e := range entries {
+		ks.add(e)
+	}
+	return nil
+}
+
+// add indexes the key. The caller holds the lock.
+func (ks *APIKeys) add(e *apiKeyEntry) {
+	ks.byID[e.key.ID] = e
+	ks.byHash[e.hash] = e
+}
+
+// Create generates a key and persists its hash. The returned key carries the secret, which can't be read again.
+func (ks *APIKeys) Create(req CreateAPIKeyRequest) (APIKey, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return APIKey{}, fmt.Errorf("%w: missing name", ErrInvalidAPIKey)
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, fmt.Errorf("api keys: generating key: %w", err)
+	}
+	id, err := newID()
+	if err != nil {
+		return APIKey{}, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	e := &apiKeyEntry{
+		key: APIKey{
+			ID: id, Name: name, Admin: req.Admin, Tenant: req.Tenant, Roles: req.Roles, ResultLimits: req.ResultLimits,
+			Created: time.Now().UTC(),
+		},
+		hash: hashAPIKey(key),
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.add(e)
+	if err = ks.save(); err != nil {
+		delete(ks.byID, e.key.ID)
+		delete(ks.byHash, e.hash)
+		return APIKey{}, err
+	}
+	out := e.key
+	out.Key = key
+	return out, nil
+}
+
+// List returns the keys without their secrets, oldest first.
+func (ks *APIKeys) List() []APIKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	out := make([]APIKey, 0, len(ks.byID))
+	for _, e := range ks.byID {
+		out = append(out, e.key)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Revoke deletes the key, requests with it are refused from now on.
+func (ks *APIKeys) Revoke(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e, ok := ks.byID[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	if e.key.Configured {
+		return fmt.Errorf("%w: %s is configured, remove it from the configuration", ErrInvalidAPIKey, e.key.Name)
+	}
+	delete(ks.byID, id)
+	delete(ks.byHash, e.hash)
+	if err := ks.save(); err != nil {
+		ks.add(e)
+		return err
+	}
+	return nil
+}
+
+// authenticate returns the key with the secret and records its use.
+func (ks *APIKeys) authenticate(secret string) (APIKey, bool) {
+	hash := hashAPIKey(secret)
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e, ok := ks.byHash[hash]
+	if !ok {
+		return APIKey{}, false
+	}
+	now := time.Now().UTC()
+	e.key.LastUsed = &now
+	return e.key, true
+}
+
+// save writes the hashes of the created keys to the file, replacing it atomically. The caller holds the lock.
+func (ks *APIKeys) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	stored := make([]storedAPIKey, 0, len(ks.byID))
+	for _, e := range ks.byID {
+		if e.key.Configured {
+			continue
+		}
+		stored = append(stored, storedAPIKey{
+			ID: e.key.ID, Name: e.key.Name, Hash: e.hash, Admin: e.key.Admin, Tenant: e.key.Tenant, Roles: e.key.Roles,
+			ResultLimits: e.key.ResultLimits, Created: e.key.Created,
+		})
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].ID < stored[j].ID
+	})
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("api keys: encoding: %w", err)
+	}
+	if err = writeFileAtomic(ks.path, data); err != nil {
+		return fmt.Errorf("api keys: %w", err)
+	}
+	return nil
+}
+
+// principal returns the scopes of the key: all of them for admin keys, ingest and query for the others.
+func (k APIKey) principal() Principal {
+	p := Principal{
+		Name: "key:" + k.Name, Tenant: k.Tenant, Roles: k.Roles, ResultLimits: k.ResultLimits,
+		Scopes: []Scope{ScopeIngest, ScopeQuery},
+	}
+	if k.Admin {
+		p.Scopes = []Scope{ScopeAdmin}
+	}
+	return p
+}
+
+// WithAPIKeys requires an API key or, with WithJWT, a token on every request and exposes the keys on the admin
+// endpoints.
+func WithAPIKeys(keys *APIKeys) ServerOption {
+	return func(s *Server) {
+		s.apiKeys = keys
+	}
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/keys.
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Admin  bool     `json:"admin,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	// ResultLimits override the result limits of the server for the key.
+	ResultLimits *ResultLimits `json:"result_limits,omitempty"`
+}
+
+func (s *Server) HandleListAPIKeys(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list api keys: writing response", s.apiKeys.List())
+}
+
+// HandleCreateAPIKey creates a key and responds with its secret, the only time it is shown.
+func (s *Server) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create api key: decoding request body", err)
+		return
+	}
+	key, err := s.apiKeys.Create(req)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		s.writeError(w, http.StatusBadRequest, "handle create api key", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle create api key", err)
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, "handle create api key: writing response", key)
+}
+
+// HandleRevokeAPIKey revokes the key with the ID in the path.
+func (s *Server) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := s.apiKeys.Revoke(r.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrAPIKeyNotFound):
+		s.writeError(w, http.StatusNotFound, "handle revoke api key", err)
+	case errors.Is(err, ErrInvalidAPIKey):
+		s.writeError(w, http.StatusConflict, "handle revoke api key", err)
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, "handle revoke api key", err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+	"github.com/marcboeker/go-duckdb"
+)
+
+// CopyArrow runs the statement through DuckDB's Arrow interface and writes the result as an Arrow IPC stream, which
+// keeps the exact column types. A Limit on the statement is applied, cursors are not supported.
+func (s *Store) CopyArrow(ctx context.Context, stmt *QueryStatement, w io.Writer) error {
+	return s.queryArrow(ctx, stmt, func(reader array.RecordReader) error {
+		writer := ipc.NewWriter(w, ipc.WithSchema(reader.Schema()))
+		for reader.Next() {
+			if writeErr := writer.Write(reader.Record()); writeErr != nil {
+				return fmt.Errorf("writing arrow record: %w", writeErr)
+			}
+		}
+		if readErr := reader.Err(); readErr != nil {
+			return fmt.Errorf("reading arrow records: %w", s.memoryError(readErr))
+		}
+		if closeErr := writer.Close(); closeErr != nil {
+			return fmt.Errorf("closing arrow stream: %w", closeErr)
+		}
+		return nil
+	})
+}
+
+// queryArrow runs the statement through DuckDB's Arrow interface and passes the reader of the result to fn, which must
+// not keep the reader or its records past its return without retaining them.
+func (s *Store) queryArrow(ctx context.Context, stmt *QueryStatement, fn func(array.RecordReader) error) error {
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	query, err := stmt.limited()
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			slog.Error("closing connection", "err", closeErr)
+		}
+	}()
+
+	return conn.Raw(func(driverConn any) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return errors.New("arrow: not a driver connection")
+		}
+		ar, arrowErr := duckdb.NewArrowFromConn(dc)
+		if arrowErr != nil {
+			return fmt.Errorf("arrow: %w", arrowErr)
+		}
+		reader, queryErr := ar.QueryContext(ctx, query, stmt.Params...)
+		if queryErr != nil {
+			return fmt.Errorf("query: %w", s.memoryError(queryErr))
+		}
+		defer reader.Release()
+		return fn(reader)
+	})
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrInvalidAttachment  = errors.New("invalid attachment")
+)
+
+// attachmentExtensions are the DuckDB extensions reading each type of attached database, empty for DuckDB files.
+var attachmentExtensions = map[string]string{"duckdb": "", "sqlite": "sqlite", "postgres": "postgres"}
+
+// reservedDatabases are the names DuckDB or the store use for their own databases.
+var reservedDatabases = map[string]bool{
+	"memory": true, "temp": true, "system": true, "main": true, fileDatabase: true,
+}
+
+var passwordRegex = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// Attachment is an external database attached to DuckDB, so queries can join its tables as name.schema.table, e.g.
+// ref.main.countries.
+type Attachment struct {
+	Name string `json:"name" yaml:"name"`
+	// Type is duckdb, sqlite or postgres.
+	Type string `json:"type" yaml:"type"`
+	// Path is the database file, or the libpq connection string of a Postgres database, e.g.
+	// host=db dbname=reference user=scratch. Passwords are redacted in responses.
+	Path     string `json:"path" yaml:"path"`
+	ReadOnly bool   `json:"read_only,omitempty" yaml:"read_only"`
+	// Error is set when the database failed to attach on startup.
+	Error string `json:"error,omitempty" yaml:"-"`
+}
+
+func (a *Attachment) Validate() error {
+	if !tableNameRegex.MatchString(a.Name) || reservedDatabases[strings.ToLower(a.Name)] {
+		return fmt.Errorf("%w: name must match %s and not be reserved", ErrInvalidAttachment, tableNameRegex)
+	}
+	if _, ok := attachmentExtensions[strings.ToLower(a.Type)]; !ok {
+		return fmt.Errorf("%w: type must be duckdb, sqlite or postgres: %q", ErrInvalidAttachment, a.Type)
+	}
+	if a.Path == "" {
+		return fmt.Errorf("%w: missing path", ErrInvalidAttachment)
+	}
+	return nil
+}
+
+// redact returns the attachment with the password of its connection string replaced.
+func (a Attachment) redact() Attachment {
+	a.Path = passwordRegex.ReplaceAllString(a.Path, "${1}"+redacted)
+	return a
+}
+
+// Attach attaches the database, replacing an attachment of the same name. Errors are returned without the statement,
+// which may carry a password.
+func (s *Store) Attach(ctx context.Context, a *Attachment) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	typ := strings.ToLower(a.Type)
+	if ext := attachmentExtensions[typ]; ext != "" {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("INSTALL %s; LOAD %s", ext, ext)); err != nil {
+			return fmt.Errorf("attach: loading extension %s: %w", ext, err)
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, "DETACH DATABASE IF EXISTS "+a.Name); err != nil {
+		return fmt.Errorf("attach: detaching %s: %w", a.Name, err)
+	}
+	options := "TYPE " + typ
+	if a.ReadOnly {
+		options += ", READ_ONLY"
+	}
+	if _, err := s.db.ExecContext(
+		ctx, fmt.Sprintf("ATTACH %s AS %s (%s)", quoteLiteral(a.Path), a.Name, options),
+	); err != nil {
+		return fmt.Errorf("attach: %w", err)
+	}
+	return nil
+}
+
+// Detach detaches the database if it is attached.
+func (s *Store) Detach(ctx context.Context, name string) error {
+	if !tableNameRegex.MatchString(name) || reservedDatabases[strings.ToLower(name)] {
+		return fmt.Errorf("%w: name must match %s and not be reserved", ErrInvalidAttachment, tableNameRegex)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err := s.db.ExecContext(ctx, "DETACH DATABASE IF EXISTS "+name); err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	return nil
+}
+
+// Attachments manages the external databases of a store. Those of the configuration are attached by NewAttachments,
+// changes through the admin endpoints last until the server stops.
+type Attachments struct {
+	store *Store
+
+	mu     sync.Mutex
+	byName map[string]*Attachment
+}
+
+// NewAttachments attaches the configured databases. A database that fails to attach is kept with its error, so the
+// server starts without it.
+func NewAttachments(ctx context.Context, store *Store, configured []Attachment) *Attachments {
+	as := &Attachments{store: store, byName: make(map[string]*Attachment)}
+	for i := range configured {
+		a := configured[i]
+		a.Error = ""
+		if err := store.Attach(ctx, &a); err != nil {
+			slog.Error("attachments: attaching database", "name", a.Name, "err", err)
+			a.Error = err.Error()
+		}
+		as.byName[strings.ToLower(a.Name)] = &a
+	}
+	return as
+}
+
+// Put attaches the database. It returns the attachment redacted and reports whether it is new.
+func (as *Attachments) Put(ctx context.Context, a Attachment) (Attachment, bool, error) {
+	a.Error = ""
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if err := as.store.Attach(ctx, &a); err != nil {
+		return Attachment{}, false, err
+	}
+	_, exists := as.byName[strings.ToLower(a.Name)]
+	as.byName[strings.ToLower(a.Name)] = &a
+	return a.redact(), !exists, nil
+}
+
+func (as *Attachments) Get(name string) (Attachment, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	a, ok := as.byName[strings.ToLower(name)]
+	if !ok {
+		return Attachment{}, fmt.Errorf("%w: %s", ErrAttachmentNotFound, name)
+	}
+	return a.redact(), nil
+}
+
+func (as *Attachments) List() []Attachment {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	out := make([]Attachment, 0, len(as.byName))
+	for _, a := range as.byName {
+		out = append(out, a.redact())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete detaches the database.
+func (as *Attachments) Delete(ctx context.Context, name string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.byName[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("%w: %s", ErrAttachmentNotFound, name)
+	}
+	if err := as.store.Detach(ctx, name); err != nil {
+		return err
+	}
+	delete(as.byName, strings.ToLower(name))
+	return nil
+}
+
+func (s *Server) HandleListAttachments(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list attachments: writing response", s.attachments.List())
+}
+
+// HandlePutAttachment attaches the database named in the path, replacing an existing attachment.
+func (s *Server) HandlePutAttachment(w http.ResponseWriter, r *http.Request) {
+	var a Attachment
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put attachment: decoding request body", err)
+		return
+	}
+	a.Name = r.PathValue("name")
+	a, created, err := s.attachments.Put(r.Context(), a)
+	if errors.Is(err, ErrInvalidAttachment) {
+		s.writeError(w, http.StatusBadRequest, "handle put attachment", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, "handle put attachment", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put attachment: writing response", a)
+}
+
+func (s *Server) HandleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	a, err := s.attachments.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get attachment", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get attachment: writing response", a)
+}
+
+func (s *Server) HandleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	err := s.attachments.Delete(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrAttachmentNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete attachment", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete attachment", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
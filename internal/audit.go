@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditTable records the queries and ingests of the API. It is created with the first entry, only admins read it and
+// nothing but the server writes it.
+const AuditTable = "_audit"
+
+// auditPruneEvery is how many entries are recorded between two deletions of those past the retention.
+const auditPruneEvery = 1000
+
+// AuditKind is what an entry of the audit log records.
+type AuditKind string
+
+const (
+	AuditQuery  AuditKind = "query"
+	AuditIngest AuditKind = "ingest"
+)
+
+// AuditEntry is a row of AuditTable.
+type AuditEntry struct {
+	Time   time.Time
+	Caller string
+	Kind   AuditKind
+	// Target is the SQL of a query or the table of an ingest.
+	Target string
+	// Rows are the rows returned or inserted, negative when unknown, e.g. for failed requests or streamed results.
+	Rows      int64
+	Duration  time.Duration
+	Status    int
+	RequestID string
+	// Tag is the query tag of the request, see QueryTagHeader.
+	Tag string
+}
+
+// WithAuditLog records every query and ingest of the API in AuditTable and keeps the entries for the retention. Zero
+// disables the audit log.
+func WithAuditLog(retention time.Duration) StoreOption {
+	return func(s *Store) {
+		s.audit = &auditLog{retention: retention}
+		if retention <= 0 {
+			s.audit = nil
+		}
+	}
+}
+
+// auditLog is the state of the audit log. Entries are recorded under its own lock, so auditing queries doesn't wait
+// for inserts.
+type auditLog struct {
+	retention time.Duration
+	mu        sync.Mutex
+	ready     bool
+	count     int
+}
+
+// recordAudit appends the entry to AuditTable.
+func (s *Store) recordAudit(ctx context.Context, e AuditEntry) error {
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+	if !s.audit.ready {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			created_at TIMESTAMP NOT NULL,
+			caller VARCHAR NOT NULL,
+			kind VARCHAR NOT NULL,
+			target VARCHAR NOT NULL,
+			row_count BIGINT,
+			duration_ms BIGINT NOT NULL,
+			status INTEGER NOT NULL,
+			request_id VARCHAR,
+			tag VARCHAR
+		)`, AuditTable)); err != nil {
+			return fmt.Errorf("audit: creating %s: %w", AuditTable, err)
+		}
+		// Audit logs of databases older than query tags lack their column.
+		if _, err := s.db.ExecContext(ctx, "ALTER TABLE "+AuditTable+" ADD COLUMN IF NOT EXISTS tag VARCHAR"); err != nil {
+			return fmt.Errorf("audit: adding the tag column: %w", err)
+		}
+		s.audit.ready = true
+	}
+	rows := sql.NullInt64{Int64: e.Rows, Valid: e.Rows >= 0}
+	requestID := sql.NullString{String: e.RequestID, Valid: e.RequestID != ""}
+	tag := sql.NullString{String: e.Tag, Valid: e.Tag != ""}
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s
+		(created_at, caller, kind, target, row_count, duration_ms, status, request_id, tag)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, AuditTable),
+		e.Time.UTC(), e.Caller, string(e.Kind), e.Target, rows, e.Duration.Milliseconds(), e.Status, requestID, tag,
+	); err != nil {
+		return fmt.Errorf("audit: recording %s: %w", e.Kind, err)
+	}
+	s.audit.count++
+	if s.audit.count%auditPruneEvery == 0 {
+		if _, err := s.db.ExecContext(
+			ctx, fmt.Sprintf("DELETE FROM %s WHERE created_at < ?", AuditTable), time.Now().UTC().Add(-s.audit.retention),
+		); err != nil {
+			return fmt.Errorf("audit: pruning: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkAuditAccess refuses queries referencing AuditTable to principals other than admins. Like checkQueryAccess, any
+// identifier named like the table counts as a reference.
+func (s *Store) checkAuditAccess(ctx context.Context, query string) error {
+	p, ok := requestPrincipal(ctx)
+	if s.audit == nil || !ok || slices.Contains(p.Scopes, ScopeAdmin) {
+		return nil
+	}
+	tokens, err := lexSQL(query)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if (t.kind == sqlWord || t.kind == sqlQuotedIdent) && strings.EqualFold(t.text, AuditTable) {
+			return fmt.Errorf("%w: %s may not read %s", ErrTableAccessDenied, p.Name, AuditTable)
+		}
+	}
+	return nil
+}
+
+// checkAuditRoute refuses the table routes addressing AuditTable, but the reads of admins.
+func (s *Store) checkAuditRoute(ctx context.Context, table string, write bool) error {
+	if s.audit == nil || !strings.EqualFold(table, AuditTable) {
+		return nil
+	}
+	p, ok := requestPrincipal(ctx)
+	switch {
+	case write:
+		return fmt.Errorf("%w: %s is only written by the server", ErrTableAccessDenied, AuditTable)
+	case ok && !slices.Contains(p.Scopes, ScopeAdmin):
+		return fmt.Errorf("%w: %s may not read %s", ErrTableAccessDenied, p.Name, AuditTable)
+	default:
+		return nil
+	}
+}
+
+type auditContextKey struct{}
+
+// auditMark is what the handler of a request learns for its audit entry.
+type auditMark struct {
+	kind   AuditKind
+	target string
+	rows   int64
+}
+
+// markAudit records the request as a query of the SQL or an ingest into the table in the audit log, with unknown
+// rows. Requests of servers without the audit log and requests never marked aren't recorded.
+func markAudit(ctx context.Context, kind AuditKind, target string) {
+	if m, ok := ctx.Value(auditContextKey{}).(*auditMark); ok {
+		m.kind, m.target, m.rows = kind, target, -1
+	}
+}
+
+// markAuditRows records the rows returned or inserted by the request marked by markAudit.
+func markAuditRows(ctx context.Context, rows int) {
+	if m, ok := ctx.Value(auditContextKey{}).(*auditMark); ok {
+		m.rows = int64(rows)
+	}
+}
+
+// auditRequests wraps next with the audit log, see WithAuditLog. It runs after authentication, so requests refused
+// by it are only in the access log.
+func (s *Server) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mark := &auditMark{}
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, mark)))
+		if mark.kind == "" {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// Requests with an invalid tag are recorded without it.
+		tag, _ := queryTag(r)
+		if err := s.store.recordAudit(context.WithoutCancel(r.Context()), AuditEntry{
+			Time:      start,
+			Caller:    caller(r),
+			Kind:      mark.kind,
+			Target:    mark.target,
+			Rows:      mark.rows,
+			Duration:  time.Since(start),
+			Status:    rec.status,
+			RequestID: w.Header().Get(RequestIDHeader),
+			Tag:       tag,
+		}); err != nil {
+			slog.Error("recording audit entry", "err", err)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned for requests without a valid API key or token.
+	ErrUnauthorized = errors.New("missing or invalid credentials")
+	// ErrScopeRequired is returned for requests to routes outside the scopes of their key or token.
+	ErrScopeRequired = errors.New("missing scope")
+)
+
+// Scope is a permission of a key or token. Each route requires one, see routeScope.
+type Scope string
+
+const (
+	// ScopeIngest grants the routes that write data.
+	ScopeIngest Scope = "ingest"
+	// ScopeQuery grants the routes that read data.
+	ScopeQuery Scope = "query"
+	// ScopeAdmin grants the admin endpoints and every other route.
+	ScopeAdmin Scope = "admin"
+)
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	// Name is key:<name> for API keys and jwt:<subject> for tokens.
+	Name   string
+	Scopes []Scope
+	// Tenant is who the inserts of the request are accounted to, empty for none.
+	Tenant string
+	// Roles are granted access to tables by TableACL.
+	Roles []string
+	// ResultLimits override the result limits of the server, nil for none.
+	ResultLimits *ResultLimits
+}
+
+func (p Principal) has(scope Scope) bool {
+	return slices.Contains(p.Scopes, ScopeAdmin) || slices.Contains(p.Scopes, scope)
+}
+
+type principalContextKey struct{}
+
+// requestPrincipal returns who the request was authenticated as.
+func requestPrincipal(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(Principal)
+	return p, ok
+}
+
+// isAdminPattern reports whether the route pattern is one of the admin endpoints.
+func isAdminPattern(pattern string) bool {
+	_, path, _ := strings.Cut(pattern, " ")
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// isWritePattern reports whether the route pattern writes data: every method but GET and HEAD outside readRoutes.
+func isWritePattern(pattern string) bool {
+	method, _, _ := strings.Cut(pattern, " ")
+	return method != http.MethodGet && method != http.MethodHead && !readRoutes[pattern]
+}
+
+// routeScope returns the scope the route pattern requires: admin for the admin endpoints, ingest for the writes and
+// query for the rest.
+func routeScope(pattern string) Scope {
+	switch {
+	case isAdminPattern(pattern):
+		return ScopeAdmin
+	case isWritePattern(pattern):
+		return ScopeIngest
+	default:
+		return ScopeQuery
+	}
+}
+
+// bearerToken returns the token of the Authorization header.
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	token = strings.TrimSpace(token)
+	return token, ok && strings.EqualFold(scheme, "Bearer") && token != ""
+}
+
+// authenticate checks the verified client certificate of the request against the ClientCerts, and else the bearer
+// token: tokens shaped like a JWT against the JWT verifier, others against the API keys.
+func (s *Server) authenticate(r *http.Request) (Principal, error) {
+	authorization := r.Header.Get("Authorization")
+	if key, ok := s.clickHouseKey(r); ok {
+		authorization = "Bearer " + key
+	} else if key, ok := segmentKey(r); ok {
+		authorization = "Bearer " + key
+	}
+	return s.authenticateCredentials(r.Context(), r.TLS, authorization)
+}
+
+// authenticateCredentials authenticates the connection state and Authorization header of a request like authenticate,
+// for protocols other than HTTP.
+func (s *Server) authenticateCredentials(
+	ctx context.Context, state *tls.ConnectionState, authorization string,
+) (Principal, error) {
+	if p, ok := s.certPrincipal(state); ok {
+		return p, nil
+	}
+	token, ok := bearerToken(authorization)
+	if !ok {
+		return Principal{}, ErrUnauthorized
+	}
+	if s.jwt != nil && strings.Count(token, ".") == 2 {
+		p, err := s.jwt.Verify(ctx, token)
+		if err != nil {
+			return Principal{}, fmt.Errorf("%w: %w", ErrUnauthorized, err)
+		}
+		return p, nil
+	}
+	if s.apiKeys != nil {
+		if key, found := s.apiKeys.authenticate(token); found {
+			return key.principal(), nil
+		}
+	}
+	return Principal{}, ErrUnauthorized
+}
+
+// requireAuth refuses requests without a valid API key or token, requests to routes outside its scopes and requests to
+// tables its ACL doesn't grant. Only the files of the web UI are served to anyone.
+func (s *Server) requireAuth(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests matching no route fall through to the 404 or 405 of the mux.
+		_, pattern := mux.Handler(r)
+		if uiRoutes[pattern] {
+			// The files of the web UI carry no data, browsers load them without the key.
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scratch"`)
+			s.writeError(w, http.StatusUnauthorized, "handle request", err)
+			return
+		}
+		if pattern != "" && !p.has(routeScope(pattern)) {
+			s.writeError(w, http.StatusForbidden, "handle request",
+				fmt.Errorf("%w: %s", ErrScopeRequired, routeScope(pattern)))
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		setAccessCaller(r.Context(), p.Name)
+		if err = s.checkRouteAccess(r, pattern); err != nil {
+			s.writeQueryError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBackupNotFound = errors.New("backup not found")
+	ErrInvalidBackup  = errors.New("invalid backup")
+	// ErrDatabaseNotEmpty is returned when restoring into a database that has tables.
+	ErrDatabaseNotEmpty = errors.New("database is not empty")
+)
+
+// backupTimeFormat names a backup after the time it was taken, so names sort by time.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+var backupNameRegex = regexp.MustCompile(`^[0-9A-Za-z._-]+$`)
+
+// WithBackupDirectory keeps backups in the directory. Without it backups can only be taken to object stores.
+func WithBackupDirectory(dir string) StoreOption {
+	return func(s *Store) {
+		s.backupDir = dir
+	}
+}
+
+// BackupRequest is the body of POST /admin/backup and POST /admin/restore.
+type BackupRequest struct {
+	// URL is the object store prefix the backup is kept under, e.g. s3://bucket/backups. Empty uses the backup
+	// directory of the server.
+	URL string `json:"url,omitempty"`
+	// Name selects the backup to restore.
+	Name string `json:"name,omitempty"`
+	// Until replays the inserts of the ingest log made after the backup and up to the time on restore.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Backup is a copy of the database made by EXPORT DATABASE: its schema, and the data of every table as Parquet.
+type Backup struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+}
+
+// RestoreResult is the backup a restore imported and the inserts it replayed on top.
+type RestoreResult struct {
+	Backup
+	Replayed int `json:"replayed,omitempty"`
+	// Skipped counts the logged inserts that failed again, as they did originally.
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// backupLocation returns the directory backups are kept in and whether it is local.
+func (s *Store) backupLocation(location string) (string, bool, error) {
+	if location == "" {
+		if s.backupDir == "" {
+			return "", false, fmt.Errorf("%w: local backups are disabled, set url", ErrInvalidBackup)
+		}
+		return s.backupDir, true, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || !exportSchemes[strings.ToLower(u.Scheme)] {
+		return "", false, fmt.Errorf("%w: url must be an object store, e.g. s3://bucket/backups", ErrInvalidBackup)
+	}
+	return strings.TrimSuffix(location, "/"), false, nil
+}
+
+// CreateBackup exports the database to a new backup. Writes wait while it runs, so the backup holds exactly the inserts
+// logged before its creation time.
+func (s *Store) CreateBackup(ctx context.Context, req BackupRequest) (*Backup, error) {
+	dir, local, err := s.backupLocation(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	created := time.Now().UTC()
+	name := created.Format(backupTimeFormat)
+	dest := dir + "/" + name
+	if local {
+		dest = filepath.Join(dir, name)
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("backup: creating directory: %w", err)
+		}
+		if _, err = os.Stat(dest); err == nil {
+			return nil, fmt.Errorf("%w: %s exists", ErrInvalidBackup, name)
+		}
+	}
+	if err = s.exportDatabase(ctx, dest); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	return &Backup{Name: name, URL: dest, Created: created}, nil
+}
+
+// exportDatabase writes the schema of the database and the data of every table as Parquet to the directory, a local
+// path or an object store prefix. The caller holds the write lock.
+func (s *Store) exportDatabase(ctx context.Context, dest string) error {
+	if _, err := s.db.ExecContext(
+		ctx, fmt.Sprintf("EXPORT DATABASE %s (FORMAT PARQUET, COMPRESSION zstd)", quoteLiteral(dest)),
+	); err != nil {
+		return s.memoryError(err)
+	}
+	return nil
+}
+
+// Backups lists the backups at the location of the request, oldest first.
+func (s *Store) Backups(ctx context.Context, req BackupRequest) ([]Backup, error) {
+	dir, local, err := s.backupLocation(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	var schemas []string
+	if local {
+		schemas, err = filepath.Glob(filepath.Join(dir, "*", "schema.sql"))
+	} else {
+		schemas, err = s.globFiles(ctx, dir+"/*/schema.sql")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing backups: %w", err)
+	}
+	out := make([]Backup, 0, len(schemas))
+	for _, schema := range schemas {
+		backupDir := path.Dir(filepath.ToSlash(schema))
+		if local {
+			backupDir = filepath.Dir(schema)
+		}
+		b := Backup{Name: path.Base(filepath.ToSlash(backupDir)), URL: backupDir}
+		if created, parseErr := time.Parse(backupTimeFormat, b.Name); parseErr == nil {
+			b.Created = created
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// RestoreBackup imports the backup named in the request and replays the ingest log up to Until. The database must not
+// have tables, restoring is meant for a new server replacing a lost one.
+func (s *Store) RestoreBackup(ctx context.Context, req BackupRequest) (*RestoreResult, error) {
+	if !backupNameRegex.MatchString(req.Name) || req.Name == "." || req.Name == ".." {
+		return nil, fmt.Errorf("%w: name must match %s", ErrInvalidBackup, backupNameRegex)
+	}
+	if req.Until != nil && s.ingestLog == nil {
+		return nil, fmt.Errorf("%w: until requires the ingest log", ErrInvalidBackup)
+	}
+	backups, err := s.Backups(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(backups), func(i int) bool {
+		return backups[i].Name >= req.Name
+	})
+	if i == len(backups) || backups[i].Name != req.Name {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, req.Name)
+	}
+	out := &RestoreResult{Backup: backups[i]}
+	if req.Until != nil && req.Until.Before(out.Created) {
+		return nil, fmt.Errorf("%w: until is before the backup was created", ErrInvalidBackup)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	var tables int
+	if err = s.db.QueryRowContext(
+		ctx, "SELECT count(*) FROM duckdb_tables() WHERE database_name = current_database() AND NOT internal",
+	).Scan(&tables); err != nil {
+		return nil, fmt.Errorf("restore: counting tables: %w", err)
+	}
+	if tables > 0 {
+		return nil, fmt.Errorf("%w: it has %d tables", ErrDatabaseNotEmpty, tables)
+	}
+	if _, err = s.db.ExecContext(ctx, "IMPORT DATABASE "+quoteLiteral(out.URL)); err != nil {
+		return nil, fmt.Errorf("restore: %w", s.memoryError(err))
+	}
+	if req.Until != nil {
+		if out.Replayed, out.Skipped, err = s.replayIngestLog(ctx, out.Created, *req.Until); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// HandleCreateBackup exports the database to a new backup in the backup directory or on an object store.
+func (s *Server) HandleCreateBackup(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.writeError(w, http.StatusBadRequest, "handle create backup: decoding request body", err)
+		return
+	}
+	res, err := s.store.CreateBackup(r.Context(), req)
+	switch {
+	case errors.Is(err, ErrInvalidBackup):
+		s.writeError(w, http.StatusBadRequest, "handle create backup", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusCreated, "handle create backup: writing response", res)
+	}
+}
+
+// HandleListBackups lists the backups in the backup directory, or under the url parameter.
+func (s *Server) HandleListBackups(w http.ResponseWriter, r *http.Request) {
+	res, err := s.store.Backups(r.Context(), BackupRequest{URL: r.URL.Query().Get("url")})
+	switch {
+	case errors.Is(err, ErrInvalidBackup):
+		s.writeError(w, http.StatusBadRequest, "handle list backups", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle list backups: writing response", res)
+	}
+}
+
+// HandleRestoreBackup imports a backup into the empty database, replaying the ingest log up to a point in time.
+func (s *Server) HandleRestoreBackup(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle restore backup: decoding request body", err)
+		return
+	}
+	res, err := s.store.RestoreBackup(r.Context(), req)
+	switch {
+	case errors.Is(err, ErrBackupNotFound):
+		s.writeError(w, http.StatusNotFound, "handle restore backup", err)
+	case errors.Is(err, ErrInvalidBackup):
+		s.writeError(w, http.StatusBadRequest, "handle restore backup", err)
+	case errors.Is(err, ErrDatabaseNotEmpty):
+		s.writeError(w, http.StatusConflict, "handle restore backup", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle restore backup: writing response", res)
+	}
+}
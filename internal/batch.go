@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// BatchStatement is one statement of a multi-statement POST /query request.
+type BatchStatement struct {
+	SQL    string `json:"sql"`
+	Params []any  `json:"params"`
+}
+
+// BatchResponse holds the result of each statement of a batch, in order.
+type BatchResponse struct {
+	Results []*Envelope `json:"results"`
+}
+
+// StatementError is returned when a statement of a batch fails. The batch is rolled back as a whole.
+type StatementError struct {
+	Index int
+	Err   error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d: %s", e.Index, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// FetchBatch runs the statements in a single transaction and returns the result of each. Either all statements take
+// effect or, if one fails, none does. Reads see one consistent snapshot of the database. Cursors are not supported.
+func (s *Store) FetchBatch(ctx context.Context, stmts []*QueryStatement) ([]*QueryResult, error) {
+	if slices.ContainsFunc(stmts, s.replicated) {
+		return s.cluster.fetch(ctx, stmts, true)
+	}
+	return s.fetchBatch(ctx, stmts)
+}
+
+// fetchBatch is FetchBatch on this store only.
+func (s *Store) fetchBatch(ctx context.Context, stmts []*QueryStatement) ([]*QueryResult, error) {
+	if len(stmts) == 0 {
+		return nil, errors.New("invalid batch: no statements")
+	}
+	writes := false
+	checked := make([]*QueryStatement, len(stmts))
+	for i, stmt := range stmts {
+		var err error
+		if checked[i], err = s.checkQuery(ctx, stmt); err != nil {
+			return nil, &StatementError{Index: i, Err: err}
+		}
+		if stmt.Limit > 0 || stmt.Cursor != "" {
+			return nil, &StatementError{Index: i, Err: errors.New("limit and cursor are not supported in a batch")}
+		}
+		writes = writes || stmt.AllowWrites
+	}
+	if writes {
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back batch", "err", rollbackErr)
+		}
+	}()
+
+	out := make([]*QueryResult, 0, len(stmts))
+	for i, stmt := range checked {
+		res, fetchErr := s.fetch(ctx, tx, stmt)
+		if fetchErr != nil {
+			return nil, &StatementError{Index: i, Err: fetchErr}
+		}
+		out = append(out, res)
+	}
+	if err = recordClusterIndex(ctx, tx); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing batch: %w", err)
+	}
+	committed = true
+	return out, nil
+}
+
+// writeBatch runs the statements of a multi-statement request and responds with a BatchResponse.
+func (s *Server) writeBatch(w http.ResponseWriter, r *http.Request, req *QueryRequest, allowWrites bool) {
+	if req.SQL != "" || req.Limit > 0 || req.Cursor != "" {
+		s.writeError(w, http.StatusBadRequest, "handle query batch",
+			errors.New("sql, limit and cursor can't be combined with statements"))
+		return
+	}
+	if r.Header.Get(SessionHeader) != "" {
+		s.writeError(w, http.StatusBadRequest, "handle query batch", errors.New("statements are not supported in sessions"))
+		return
+	}
+	stmts := make([]*QueryStatement, len(req.Statements))
+	queries := make([]string, len(req.Statements))
+	for i, stmt := range req.Statements {
+		stmts[i] = &QueryStatement{Query: stmt.SQL, Params: stmt.Params, AllowWrites: allowWrites}
+		s.requestResultLimits(r.Context()).apply(stmts[i])
+		queries[i] = stmt.SQL
+	}
+	markAudit(r.Context(), AuditQuery, strings.Join(queries, ";\n"))
+	ctx, cancel, err := s.queryContext(r, &QueryStatement{Query: strings.Join(queries, ";\n")})
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	results, err := s.store.FetchBatch(ctx, stmts)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	rows := 0
+	for _, res := range results {
+		rows += len(res.Rows)
+	}
+	markAuditRows(r.Context(), rows)
+	resp := &BatchResponse{Results: make([]*Envelope, len(results))}
+	for i, res := range results {
+		resp.Results[i] = NewEnvelope(res)
+	}
+	s.writeJSON(w, http.StatusOK, "handle query batch: writing response", resp)
+}
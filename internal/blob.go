@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// decodeBlobs replaces the base64 strings sent for the columns declared BLOB in the table configuration by the bytes
+// they encode, which JSON can't carry otherwise. Query results write BLOB values as base64 again.
+func (s *InsertStatement) decodeBlobs(cfg TableConfig) error {
+	blobs := make(map[string]bool)
+	for _, c := range cfg.Columns {
+		if ParseDataType(c.Type) == BLOB {
+			blobs[strings.ToLower(c.Name)] = true
+		}
+	}
+	if len(blobs) == 0 {
+		return nil
+	}
+	for _, row := range s.rows() {
+		for k, v := range row {
+			str, ok := v.(string)
+			if !ok || !blobs[strings.ToLower(k)] {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return fmt.Errorf("%w: column %s: decoding base64: %w", ErrInvalidInsert, k, err)
+			}
+			row[k] = b
+		}
+	}
+	return nil
+}
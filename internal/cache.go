@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedResults bounds the number of results held by the query cache.
+const maxCachedResults = 1024
+
+// CacheStatusHeader reports whether the result was served from the query cache, hit or miss.
+const CacheStatusHeader = "X-Cache"
+
+type cachedResult struct {
+	res        *QueryResult
+	generation int64
+	expires    time.Time
+}
+
+// queryCache holds results of read-only statements for a TTL. Entries are only valid for the store generation they
+// were read at, so any write invalidates them.
+type queryCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedResult
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{ttl: ttl, entries: make(map[string]cachedResult)}
+}
+
+func (c *queryCache) get(key string, generation int64) (*QueryResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e.generation != generation || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.res, true
+}
+
+func (c *queryCache) put(key string, generation int64, res *QueryResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxCachedResults {
+		for k, e := range c.entries {
+			if e.generation != generation || now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= maxCachedResults {
+		return
+	}
+	c.entries[key] = cachedResult{res: res, generation: generation, expires: now.Add(c.ttl)}
+}
+
+func cacheKey(stmt *QueryStatement) string {
+	return queryHash(stmt.Query, stmt.Params) + "/" + strconv.Itoa(stmt.Limit) + "/" + strconv.Itoa(stmt.MaxRows) + "/" +
+		stmt.Cursor
+}
+
+// fetch runs the statement through the query cache if it is enabled, or in the session if one is given, and records
+// it in the query history. Writes, profiled statements and requests with Cache-Control: no-cache bypass the cache.
+func (s *Server) fetch(r *http.Request, stmt *QueryStatement, session *Session) (*QueryResult, bool, error) {
+	started := time.Now()
+	res, hit, err := s.fetchCached(r, stmt, session)
+	var rows *int
+	if res != nil {
+		n := len(res.Rows)
+		rows = &n
+	}
+	s.record(r, stmt, started, rows, hit, err)
+	return res, hit, err
+}
+
+func (s *Server) fetchCached(r *http.Request, stmt *QueryStatement, session *Session) (*QueryResult, bool, error) {
+	if session != nil {
+		res, err := session.Fetch(r.Context(), stmt)
+		return res, false, err
+	}
+	if !s.cacheable(r, stmt) {
+		res, err := s.store.Fetch(r.Context(), stmt)
+		return res, false, err
+	}
+	// Cached results are shared across keys and tokens, their access is checked and their rows are secured before the
+	// cache.
+	stmt, err := s.store.checkQuery(r.Context(), stmt)
+	if err != nil {
+		return nil, false, err
+	}
+	key, generation := cacheKey(stmt), s.store.Generation()
+	if res, ok := s.cache.get(key, generation); ok {
+		return res, true, nil
+	}
+	res, err := s.store.Fetch(r.Context(), stmt)
+	if err != nil {
+		return nil, false, err
+	}
+	s.cache.put(key, generation, res)
+	return res, false, nil
+}
+
+// cacheable reports whether the result of the statement goes through the query cache.
+func (s *Server) cacheable(r *http.Request, stmt *QueryStatement) bool {
+	return s.cache != nil && !stmt.AllowWrites && !stmt.Profile &&
+		!strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+}
+
+// etag is a strong validator of the encoded response.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header of the request lists the tag.
+func etagMatches(r *http.Request, tag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChangesTable holds the change feed. It is created with the first change.
+const ChangesTable = "_changes"
+
+// ErrChangeFeedDisabled is returned when reading the change feed of a store without one.
+var ErrChangeFeedDisabled = errors.New("change feed is disabled")
+
+const (
+	// changePruneEvery is how many changes are recorded between two deletions of those past the retention.
+	changePruneEvery   = 1000
+	defaultChangeLimit = 1000
+	maxChangeLimit     = 10000
+)
+
+// ChangeKind is what a change of the feed records.
+type ChangeKind string
+
+const (
+	ChangeInsert ChangeKind = "insert"
+	ChangeSchema ChangeKind = "schema"
+)
+
+// Change is an entry of the change feed. Sequence numbers increase across all tables in the order of the writes.
+type Change struct {
+	Seq   int64      `json:"seq"`
+	Table string     `json:"table"`
+	Kind  ChangeKind `json:"kind"`
+	Time  time.Time  `json:"time"`
+	// Rows are the rows of an insert.
+	Rows []map[string]any `json:"rows,omitempty"`
+	// Schema is the column created by a schema change.
+	Schema *SchemaChange `json:"schema,omitempty"`
+}
+
+// ChangesResponse is the body of GET /tables/{table}/changes.
+type ChangesResponse struct {
+	Changes []Change `json:"changes"`
+	// Next is the since parameter of the following poll.
+	Next int64 `json:"next"`
+}
+
+// WithChangeFeed records the inserted rows and the columns created by ingestion in ChangesTable, where consumers poll
+// them by sequence number, and keeps them for the retention. Zero disables the feed. Imports and writes through SQL
+// are not recorded.
+func WithChangeFeed(retention time.Duration) StoreOption {
+	return func(s *Store) {
+		s.changeFeed = changeFeed{retention: retention}
+	}
+}
+
+// changeFeed is the state of the change feed, guarded by the write lock.
+type changeFeed struct {
+	retention time.Duration
+	// seq is the last sequence number recorded, read from ChangesTable on the first change.
+	seq   int64
+	ready bool
+}
+
+// recordChanges appends the schema changes the chunk caused and its rows to the change feed. The caller holds the write
+// lock and has written the chunk.
+func (s *Store) recordChanges(ctx context.Context, schema []SchemaChange, chunk *InsertStatement) error {
+	if s.changeFeed.retention <= 0 {
+		return nil
+	}
+	if !s.changeFeed.ready {
+		if _, err := s.writer.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			seq BIGINT PRIMARY KEY,
+			table_name VARCHAR NOT NULL,
+			kind VARCHAR NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			payload VARCHAR NOT NULL
+		)`, ChangesTable)); err != nil {
+			return fmt.Errorf("change feed: creating %s: %w", ChangesTable, err)
+		}
+		if err := s.writer.QueryRowContext(
+			ctx, fmt.Sprintf("SELECT coalesce(max(seq), 0) FROM %s", ChangesTable),
+		).Scan(&s.changeFeed.seq); err != nil {
+			return fmt.Errorf("change feed: reading sequence: %w", err)
+		}
+		s.changeFeed.ready = true
+	}
+
+	now := time.Now().UTC()
+	record := func(kind ChangeKind, payload any) error {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("change feed: encoding %s: %w", kind, err)
+		}
+		if _, err = s.writer.ExecContext(
+			ctx, fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?)", ChangesTable),
+			s.changeFeed.seq+1, chunk.Table, string(kind), now, string(encoded),
+		); err != nil {
+			return fmt.Errorf("change feed: recording %s: %w", kind, err)
+		}
+		s.changeFeed.seq++
+		if s.changeFeed.seq%changePruneEvery == 0 {
+			if _, err = s.writer.ExecContext(
+				ctx, fmt.Sprintf("DELETE FROM %s WHERE created_at < ?", ChangesTable), now.Add(-s.changeFeed.retention),
+			); err != nil {
+				return fmt.Errorf("change feed: pruning: %w", err)
+			}
+		}
+		return nil
+	}
+	for _, change := range schema {
+		if err := record(ChangeSchema, change); err != nil {
+			return err
+		}
+	}
+	return record(ChangeInsert, chunk.rows())
+}
+
+// Changes returns up to limit changes of the table, or of all tables if it is empty, after the sequence number since,
+// oldest first.
+func (s *Store) Changes(ctx context.Context, table string, since int64, limit int) (*ChangesResponse, error) {
+	s.settingsLock.RLock()
+	enabled := s.changeFeed.retention > 0
+	s.settingsLock.RUnlock()
+	if !enabled {
+		return nil, ErrChangeFeedDisabled
+	}
+	out := &ChangesResponse{Changes: []Change{}, Next: since}
+	cols, err := s.tableColumns(ctx, ChangesTable)
+	if err != nil || len(cols) == 0 {
+		return out, err
+	}
+	where, params := "seq > ?", []any{since}
+	if table != "" {
+		where, params = "lower(table_name) = ? AND "+where, append([]any{strings.ToLower(table)}, params...)
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT seq, table_name, kind, created_at, payload FROM %s WHERE %s ORDER BY seq LIMIT ?", ChangesTable, where,
+	), append(params, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("reading changes: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	for rows.Next() {
+		var (
+			c       Change
+			kind    string
+			payload string
+		)
+		if err = rows.Scan(&c.Seq, &c.Table, &kind, &c.Time, &payload); err != nil {
+			return nil, fmt.Errorf("reading changes: %w", err)
+		}
+		c.Kind = ChangeKind(kind)
+		switch c.Kind {
+		case ChangeSchema:
+			err = json.Unmarshal([]byte(payload), &c.Schema)
+		default:
+			err = decodeRows([]byte(payload), &c.Rows)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding change %d: %w", c.Seq, err)
+		}
+		out.Changes = append(out.Changes, c)
+		out.Next = c.Seq
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading changes: %w", err)
+	}
+	return out, nil
+}
+
+// HandleChanges lists the changes of the table in the path after the since parameter, up to the limit parameter.
+func (s *Server) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	since, limit, ok := s.changesParams(w, r)
+	if !ok {
+		return
+	}
+	res, err := s.store.Changes(r.Context(), r.PathValue("table"), since, limit)
+	switch {
+	case errors.Is(err, ErrChangeFeedDisabled):
+		s.writeError(w, http.StatusNotFound, "handle changes", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle changes: writing response", res)
+	}
+}
+
+// changesParams reads the since and limit parameters of the change feed, or writes the error and returns false.
+func (s *Server) changesParams(w http.ResponseWriter, r *http.Request) (int64, int, bool) {
+	var since int64
+	limit := defaultChangeLimit
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			s.writeError(w, http.StatusBadRequest, "handle changes", fmt.Errorf("invalid since %q", v))
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxChangeLimit {
+			s.writeError(w, http.StatusBadRequest, "handle changes",
+				fmt.Errorf("invalid limit %q: expected 1 to %d", v, maxChangeLimit))
+			return 0, 0, false
+		}
+	}
+	return since, limit, true
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrDatabaseReadOnly is returned for maintenance of a database opened read-only.
+var ErrDatabaseReadOnly = errors.New("database is read-only")
+
+// CheckpointRun describes a VACUUM and CHECKPOINT of the database. The sizes count the used blocks of the database
+// and its write-ahead log, the file itself only shrinks when DuckDB truncates free blocks at its end.
+type CheckpointRun struct {
+	Started        time.Time `json:"started"`
+	DurationMS     int64     `json:"duration_ms"`
+	BytesBefore    int64     `json:"bytes_before"`
+	BytesAfter     int64     `json:"bytes_after"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes"`
+	// FreeBlocks are the blocks of the file that later writes reuse.
+	FreeBlocks int64 `json:"free_blocks"`
+}
+
+// databaseSize returns the bytes of the used blocks and the write-ahead log of the database, and its free blocks.
+func (s *Store) databaseSize(ctx context.Context) (int64, int64, error) {
+	var blockSize, usedBlocks, freeBlocks int64
+	if err := s.db.QueryRowContext(
+		ctx,
+		"SELECT block_size, used_blocks, free_blocks FROM pragma_database_size() WHERE database_name = current_database()",
+	).Scan(&blockSize, &usedBlocks, &freeBlocks); err != nil {
+		return 0, 0, fmt.Errorf("reading database size: %w", err)
+	}
+	size := blockSize * usedBlocks
+	if s.database.Path != "" {
+		info, err := os.Stat(s.database.walPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, 0, fmt.Errorf("reading write-ahead log size: %w", err)
+		}
+		if err == nil {
+			size += info.Size()
+		}
+	}
+	return size, freeBlocks, nil
+}
+
+// Checkpoint rebuilds the statistics of the tables with VACUUM ANALYZE and writes the write-ahead log into the database
+// file with CHECKPOINT, which frees the blocks of deleted rows. It waits for the running write and blocks writes while
+// it runs.
+func (s *Store) Checkpoint(ctx context.Context) (*CheckpointRun, error) {
+	if s.database.ReadOnly {
+		return nil, fmt.Errorf("checkpoint: %w", ErrDatabaseReadOnly)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	out := &CheckpointRun{Started: time.Now()}
+	before, _, err := s.databaseSize(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	for _, stmt := range []string{"VACUUM ANALYZE", "CHECKPOINT"} {
+		if _, err = s.db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("checkpoint: %s: %w", stmt, err)
+		}
+	}
+	after, free, err := s.databaseSize(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	out.DurationMS = time.Since(out.Started).Milliseconds()
+	out.BytesBefore, out.BytesAfter, out.FreeBlocks = before, after, free
+	out.ReclaimedBytes = max(before-after, 0)
+	return out, nil
+}
+
+// CheckpointStats are the totals of the checkpoints since the server started.
+type CheckpointStats struct {
+	Runs           int64          `json:"runs"`
+	Failures       int64          `json:"failures"`
+	ReclaimedBytes int64          `json:"reclaimed_bytes"`
+	Interval       string         `json:"interval,omitempty"`
+	Last           *CheckpointRun `json:"last,omitempty"`
+	LastError      string         `json:"last_error,omitempty"`
+	NextRun        *time.Time     `json:"next_run,omitempty"`
+}
+
+// Checkpointer checkpoints the store on demand and, with an interval, in the background once Run is called.
+type Checkpointer struct {
+	store    *Store
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats CheckpointStats
+}
+
+// NewCheckpointer returns a checkpointer running every interval, zero for on demand only.
+func NewCheckpointer(store *Store, interval time.Duration) *Checkpointer {
+	c := &Checkpointer{store: store, interval: interval}
+	if interval > 0 {
+		c.stats.Interval = interval.String()
+	}
+	return c
+}
+
+// Checkpoint checkpoints the store and adds the run to the stats.
+func (c *Checkpointer) Checkpoint(ctx context.Context) (*CheckpointRun, error) {
+	run, err := c.store.Checkpoint(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.stats.Failures++
+		c.stats.LastError = err.Error()
+		return nil, err
+	}
+	c.stats.Runs++
+	c.stats.ReclaimedBytes += run.ReclaimedBytes
+	c.stats.Last, c.stats.LastError = run, ""
+	return run, nil
+}
+
+func (c *Checkpointer) Stats() CheckpointStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Run checkpoints every interval until the context is done. It returns at once without an interval.
+func (c *Checkpointer) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		next := time.Now().Add(c.interval)
+		c.mu.Lock()
+		c.stats.NextRun = &next
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := c.Checkpoint(ctx); err != nil {
+			slog.Error("checkpoint: scheduled run", "err", err)
+		}
+	}
+}
+
+// HandleCheckpoint checkpoints the database now and responds with the run.
+func (s *Server) HandleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	res, err := s.checkpointer.Checkpoint(r.Context())
+	switch {
+	case errors.Is(err, ErrDatabaseReadOnly):
+		s.writeError(w, http.StatusConflict, "handle checkpoint", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle checkpoint: writing response", res)
+	}
+}
+
+func (s *Server) HandleCheckpointStats(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle checkpoint stats: writing response", s.checkpointer.Stats())
+}
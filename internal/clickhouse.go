@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrClickHouseUnsupported is returned for statements and formats of ClickHouse the interface doesn't implement.
+var ErrClickHouseUnsupported = errors.New("not supported by the ClickHouse interface")
+
+//nolint:gochecknoglobals // Compiled once.
+var (
+	clickHouseInsertRegex = regexp.MustCompile(
+		"(?is)^\\s*INSERT\\s+INTO\\s+(`[^`]+`|\"[^\"]+\"|\\w+)\\s+FORMAT\\s+JSONEachRow\\b(.*)$")
+	clickHouseFormatRegex = regexp.MustCompile(`(?is)\s+FORMAT\s+(\w+)\s*;?\s*$`)
+	anyInsertRegex        = regexp.MustCompile(`(?i)^\s*INSERT\s`)
+)
+
+// clickHouseFormats are the output formats by lower-case name. The TSV ones are aliases of the TabSeparated ones.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var clickHouseFormats = map[string]string{
+	"tabseparated":                  "TabSeparated",
+	"tsv":                           "TabSeparated",
+	"tabseparatedwithnames":         "TabSeparatedWithNames",
+	"tsvwithnames":                  "TabSeparatedWithNames",
+	"tabseparatedwithnamesandtypes": "TabSeparatedWithNamesAndTypes",
+	"tsvwithnamesandtypes":          "TabSeparatedWithNamesAndTypes",
+	"json":                          "JSON",
+	"jsoneachrow":                   "JSONEachRow",
+}
+
+// WithClickHouseHTTP serves a subset of the ClickHouse HTTP interface at the root path, so ClickHouse clients and
+// dashboards can query the tables: queries in the query parameter or the body, answered in the format of their FORMAT
+// clause, TabSeparated by default, and INSERT INTO <table> FORMAT JSONEachRow with the rows in the body. The key is
+// read from the X-ClickHouse-Key header, the password of basic authentication or the password parameter.
+func WithClickHouseHTTP() ServerOption {
+	return func(s *Server) {
+		s.clickHouse = true
+	}
+}
+
+func (s *Server) handleClickHouse(m *routeMux) {
+	m.HandleFunc("GET /{$}", s.HandleClickHouse)
+	m.HandleFunc("POST /{$}", s.HandleClickHouse)
+	m.HandleFunc("GET /ping", func(w http.ResponseWriter, _ *http.Request) {
+		s.writeClickHouseOK(w)
+	})
+}
+
+// clickHouseKey returns the API key a ClickHouse client sent with a request to the routes of the interface, which
+// authenticate like ClickHouse does.
+func (s *Server) clickHouseKey(r *http.Request) (string, bool) {
+	if !s.clickHouse || (r.URL.Path != "/" && r.URL.Path != "/ping") {
+		return "", false
+	}
+	if key := r.Header.Get("X-ClickHouse-Key"); key != "" {
+		return key, true
+	}
+	if _, password, ok := r.BasicAuth(); ok && password != "" {
+		return password, true
+	}
+	if password := r.URL.Query().Get("password"); password != "" {
+		return password, true
+	}
+	return "", false
+}
+
+// HandleClickHouse runs the statement of the query parameter followed by the body, or of the body alone. Reads are
+// answered like ClickHouse does, inserts need the ingest scope and are checked like POST /data.
+func (s *Server) HandleClickHouse(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	query := r.URL.Query().Get("query")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle clickhouse: reading request body", err)
+			return
+		}
+		if query != "" && len(body) > 0 {
+			query += "\n"
+		}
+		query += string(body)
+	}
+	if strings.TrimSpace(query) == "" {
+		s.writeClickHouseOK(w)
+		return
+	}
+	if m := clickHouseInsertRegex.FindStringSubmatch(query); m != nil {
+		if r.Method != http.MethodPost {
+			s.writeError(w, http.StatusBadRequest, "handle clickhouse",
+				fmt.Errorf("%w: inserts must be POSTed", ErrClickHouseUnsupported))
+			return
+		}
+		s.clickHouseInsert(w, r, strings.Trim(m[1], "`\""), m[2])
+		return
+	}
+	if anyInsertRegex.MatchString(query) {
+		s.writeError(w, http.StatusBadRequest, "handle clickhouse",
+			fmt.Errorf("%w: only INSERT INTO <table> FORMAT JSONEachRow is", ErrClickHouseUnsupported))
+		return
+	}
+	s.clickHouseQuery(w, r, query)
+}
+
+func (s *Server) clickHouseQuery(w http.ResponseWriter, r *http.Request, query string) {
+	format := r.URL.Query().Get("default_format")
+	if m := clickHouseFormatRegex.FindStringSubmatchIndex(query); m != nil {
+		format, query = query[m[2]:m[3]], query[:m[0]]
+	}
+	name := "TabSeparated"
+	if format != "" {
+		var ok bool
+		if name, ok = clickHouseFormats[strings.ToLower(format)]; !ok {
+			s.writeError(w, http.StatusBadRequest, "handle clickhouse",
+				fmt.Errorf("%w: format %s", ErrClickHouseUnsupported, format))
+			return
+		}
+	}
+	stmt := &QueryStatement{Query: strings.TrimSuffix(strings.TrimSpace(query), ";")}
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+	s.requestResultLimits(r.Context()).apply(stmt)
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	res, _, err := s.fetch(r.WithContext(ctx), stmt, nil)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	markAuditRows(r.Context(), len(res.Rows))
+	var buf bytes.Buffer
+	contentType := "text/tab-separated-values; charset=UTF-8"
+	if strings.HasPrefix(name, "JSON") {
+		contentType = "application/json; charset=UTF-8"
+		err = writeClickHouseJSON(&buf, name, res)
+	} else {
+		writeClickHouseTSV(&buf, name, res)
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle clickhouse: encoding response", err)
+		return
+	}
+	if res.Truncated {
+		w.Header().Set(TruncatedHeader, "true")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-ClickHouse-Format", name)
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		slog.Error("handle clickhouse: writing response", "err", err)
+	}
+}
+
+// clickHouseInsert inserts the JSON object per line of the data.
+func (s *Server) clickHouseInsert(w http.ResponseWriter, r *http.Request, table, data string) {
+	ctx := r.Context()
+	markAudit(ctx, AuditIngest, table)
+	if s.follower != nil {
+		s.writeError(w, http.StatusForbidden, "handle clickhouse",
+			fmt.Errorf("%w at %s", ErrFollowerReadOnly, s.follower.leader.Redacted()))
+		return
+	}
+	if p, ok := requestPrincipal(ctx); ok && !p.has(ScopeIngest) {
+		s.writeError(w, http.StatusForbidden, "handle clickhouse", fmt.Errorf("%w: %s", ErrScopeRequired, ScopeIngest))
+		return
+	}
+	err := s.store.checkAuditRoute(ctx, table, true)
+	if err == nil {
+		err = s.store.checkTableAccess(ctx, table, true)
+	}
+	if err == nil {
+		err = s.store.checkGuardedRoute(ctx, "POST /data", table)
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	stmt := &InsertStatement{Table: table, RequestID: requestID(w, r)}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	for {
+		var row map[string]any
+		err = dec.Decode(&row)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = exactRows(row)
+		}
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle clickhouse: decoding JSONEachRow", err)
+			return
+		}
+		stmt.Rows = append(stmt.Rows, row)
+	}
+	if len(stmt.Rows) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err = stmt.Validate(); err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, "handle clickhouse: validating insert statement", err)
+		return
+	}
+	release, ok := s.acquireWrite(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	err = s.store.Insert(ctx, stmt)
+	switch {
+	case errors.Is(err, ErrInvalidInsert), errors.Is(err, ErrConstraintViolation), errors.Is(err, ErrGeneratedColumn):
+		s.writeError(w, http.StatusUnprocessableEntity, "handle clickhouse", err)
+	case errors.Is(err, ErrTypeConflict), errors.Is(err, ErrConstrainedColumn):
+		s.writeError(w, http.StatusConflict, "handle clickhouse", err)
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, "handle clickhouse", err)
+	default:
+		markAuditRows(ctx, len(stmt.Rows))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// writeClickHouseOK answers the health checks of ClickHouse clients.
+func (s *Server) writeClickHouseOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if _, err := io.WriteString(w, "Ok.\n"); err != nil {
+		slog.Error("handle clickhouse: writing response", "err", err)
+	}
+}
+
+// ClickHouseColumn is a column of the meta of the JSON format.
+type ClickHouseColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ClickHouseResult is the body of the JSON format.
+type ClickHouseResult struct {
+	Meta       []ClickHouseColumn   `json:"meta"`
+	Data       []map[string]any     `json:"data"`
+	Rows       int                  `json:"rows"`
+	Statistics ClickHouseStatistics `json:"statistics"`
+}
+
+type ClickHouseStatistics struct {
+	// Elapsed is in seconds.
+	Elapsed  float64 `json:"elapsed"`
+	RowsRead int     `json:"rows_read"`
+}
+
+func writeClickHouseJSON(w io.Writer, format string, res *QueryResult) error {
+	rows := make([]map[string]any, len(res.Rows))
+	for i, row := range res.Rows {
+		rows[i] = make(map[string]any, len(row))
+		for _, col := range res.Columns {
+			rows[i][col.Name] = clickHouseValue(col, row[col.Name])
+		}
+	}
+	if format == "JSONEachRow" {
+		return writeNDJSON(w, &QueryResult{Rows: rows})
+	}
+	out := ClickHouseResult{
+		Meta:       make([]ClickHouseColumn, len(res.Columns)),
+		Data:       rows,
+		Rows:       len(rows),
+		Statistics: ClickHouseStatistics{Elapsed: res.Elapsed.Seconds(), RowsRead: len(rows)},
+	}
+	for i, col := range res.Columns {
+		out.Meta[i] = ClickHouseColumn{Name: col.Name, Type: clickHouseType(col.Type)}
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("marshalling rows: %w", err)
+	}
+	return nil
+}
+
+// writeClickHouseTSV writes the rows escaped like ClickHouse does, with NULL as \N.
+func writeClickHouseTSV(buf *bytes.Buffer, format string, res *QueryResult) {
+	line := func(values []string) {
+		buf.WriteString(strings.Join(values, "\t"))
+		buf.WriteByte('\n')
+	}
+	values := make([]string, len(res.Columns))
+	if format != "TabSeparated" {
+		for i, col := range res.Columns {
+			values[i] = clickHouseEscaper.Replace(col.Name)
+		}
+		line(values)
+	}
+	if format == "TabSeparatedWithNamesAndTypes" {
+		for i, col := range res.Columns {
+			values[i] = clickHouseType(col.Type)
+		}
+		line(values)
+	}
+	for _, row := range res.Rows {
+		for i, col := range res.Columns {
+			v := clickHouseValue(col, row[col.Name])
+			if v == nil {
+				values[i] = `\N`
+				continue
+			}
+			values[i] = clickHouseEscaper.Replace(formatCSVValue(v))
+		}
+		line(values)
+	}
+}
+
+//nolint:gochecknoglobals // Stateless replacer.
+var clickHouseEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+
+// clickHouseValue formats times like ClickHouse does, dates without the time.
+func clickHouseValue(col Column, v any) any {
+	t, ok := v.(time.Time)
+	switch {
+	case !ok:
+		return v
+	case col.Type == "DATE":
+		return t.Format(time.DateOnly)
+	default:
+		return t.UTC().Format("2006-01-02 15:04:05.999999")
+	}
+}
+
+//nolint:gochecknoglobals // Read-only lookup table.
+var clickHouseTypes = map[string]string{
+	"BOOLEAN": "Bool", "TINYINT": "Int8", "SMALLINT": "Int16", "INTEGER": "Int32", "BIGINT": "Int64",
+	"HUGEINT": "Int128", "UTINYINT": "UInt8", "USMALLINT": "UInt16", "UINTEGER": "UInt32", "UBIGINT": "UInt64",
+	"FLOAT": "Float32", "DOUBLE": "Float64", "DATE": "Date", "UUID": "UUID",
+}
+
+// clickHouseType returns the ClickHouse type of the DuckDB type. Every column may hold NULL, types without a
+// counterpart are reported as String.
+func clickHouseType(duckType string) string {
+	var t string
+	switch upper := strings.ToUpper(duckType); {
+	case strings.HasPrefix(upper, "DECIMAL"):
+		t = "Decimal" + strings.ReplaceAll(strings.TrimPrefix(upper, "DECIMAL"), ",", ", ")
+	case strings.HasPrefix(upper, "TIMESTAMP"):
+		t = "DateTime64(6, 'UTC')"
+	default:
+		if t = clickHouseTypes[upper]; t == "" {
+			t = "String"
+		}
+	}
+	return "Nullable(" + t + ")"
+}
@@ -0,0 +1,769 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// ClusterTable records the index of the last entry of the Raft log applied to the store, so a restarted node doesn't
+// apply the entries of its log twice.
+const ClusterTable = "_cluster"
+
+// ClusterForwardedHeader marks the writes a node forwarded to the leader, which are not forwarded again.
+const ClusterForwardedHeader = "X-Scratch-Forwarded"
+
+// ErrNotLeader is returned for writes to a cluster node that isn't the leader.
+var ErrNotLeader = errors.New("not the cluster leader")
+
+// ClusterNode is a member of the cluster.
+type ClusterNode struct {
+	ID string `yaml:"id" json:"id"`
+	// Raft is the host:port the node replicates the log on, reachable by the other nodes.
+	Raft string `yaml:"raft" json:"raft"`
+	// API is the base URL of the API of the node, the other nodes forward writes to it while it leads.
+	API string `yaml:"api" json:"api"`
+}
+
+// ClusterConfig makes the server a node of a Raft cluster once NodeID is set.
+type ClusterConfig struct {
+	// NodeID is the ID of this node among Nodes.
+	NodeID string `yaml:"node_id"`
+	// Dir keeps the Raft log and the snapshots of the node.
+	Dir string `yaml:"dir"`
+	// Nodes are all the nodes of the cluster, this one included, the same on every node. They bootstrap the cluster
+	// on its first start.
+	Nodes []ClusterNode `yaml:"nodes"`
+	// SnapshotThreshold is how many entries the log grows by before a snapshot replaces them, zero for the Raft
+	// default.
+	SnapshotThreshold uint64 `yaml:"snapshot_threshold"`
+	// SnapshotInterval is how often the node checks the threshold, zero for the Raft default.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+// node returns the node of the ID.
+func (c ClusterConfig) node(id string) (ClusterNode, bool) {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+func (c ClusterConfig) valid() error {
+	if c.Dir == "" {
+		return errors.New("cluster: dir is required")
+	}
+	seen := make(map[string]bool, len(c.Nodes))
+	for _, n := range c.Nodes {
+		if n.ID == "" || seen[n.ID] {
+			return fmt.Errorf("cluster: node IDs must be unique and not empty: %q", n.ID)
+		}
+		seen[n.ID] = true
+		if _, _, err := net.SplitHostPort(n.Raft); err != nil {
+			return fmt.Errorf("cluster: node %s: raft must be host:port: %w", n.ID, err)
+		}
+		if u, err := url.Parse(n.API); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("cluster: node %s: api must be an http or https URL: %q", n.ID, n.API)
+		}
+	}
+	if !seen[c.NodeID] {
+		return fmt.Errorf("cluster: node %q is not among the nodes", c.NodeID)
+	}
+	return nil
+}
+
+// ClusterStatus describes a node and the leader it knows of.
+type ClusterStatus struct {
+	NodeID string `json:"node_id"`
+	// State is Leader, Follower, Candidate or Shutdown.
+	State string `json:"state"`
+	// Leader is the ID of the leader, empty while none is elected.
+	Leader string `json:"leader,omitempty"`
+	// Applied is the index of the last entry of the log applied to the store.
+	Applied uint64 `json:"applied"`
+	// LastSnapshot is the index of the last entry of the latest snapshot, zero before the first.
+	LastSnapshot uint64        `json:"last_snapshot"`
+	Nodes        []ClusterNode `json:"nodes"`
+}
+
+// Cluster replicates the writes of the store through a Raft log, so every node holds the same data and another node
+// takes over writing when the leader is lost. Inserts and SQL writes, e.g. the statements of POST /admin/query, are
+// applied by every node in the order of the log. The server forwards the other writes to the leader, which applies
+// them to its own store only like the leader of a Follower: deletes, imports, session writes and the admin endpoints
+// writing files. The values of inserts are replicated as JSON like the ingest log, so every node, the leader included,
+// infers the column types from their JSON encoding. Statements depending on the time or randomness, e.g. now() or
+// random(), may write different values on each node.
+//
+// Snapshots are exports of the database like backups. On start a node applies the entries after the index recorded in
+// ClusterTable, after restoring the latest snapshot if the database is older, e.g. in memory.
+type Cluster struct {
+	store     *Store
+	config    ClusterConfig
+	raft      *raft.Raft
+	logs      *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+	// applied is the index of the last entry applied, only written by the FSM methods, which Raft calls one at a time.
+	applied atomic.Uint64
+}
+
+// NewCluster starts the node of the configuration on the store, bootstrapping the cluster on its first start. Writes
+// to the store go through the log from then on.
+func NewCluster(store *Store, config ClusterConfig) (*Cluster, error) {
+	if err := config.valid(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cluster: creating directory: %w", err)
+	}
+	c := &Cluster{store: store, config: config}
+	applied, err := store.clusterIndex(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	c.applied.Store(applied)
+	logger := &raftLogger{Logger: hclog.NewNullLogger(), logger: slog.Default().With("component", "raft")}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(config.Dir, 2, logger)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: opening snapshots: %w", err)
+	}
+	if err = c.restoreLatest(snapshots); err != nil {
+		return nil, err
+	}
+	if c.logs, err = raftboltdb.NewBoltStore(filepath.Join(config.Dir, "raft.db")); err != nil {
+		return nil, fmt.Errorf("cluster: opening log: %w", err)
+	}
+	node, _ := config.node(config.NodeID)
+	if c.transport, err = raft.NewTCPTransportWithLogger(node.Raft, nil, 3, 10*time.Second, logger); err != nil {
+		return nil, errors.Join(fmt.Errorf("cluster: listening on %s: %w", node.Raft, err), c.logs.Close())
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(config.NodeID)
+	rc.Logger = logger
+	// The store keeps its data across restarts, the entries it holds are skipped by index instead, see Apply.
+	rc.NoSnapshotRestoreOnStart = true
+	if config.SnapshotThreshold > 0 {
+		rc.SnapshotThreshold = config.SnapshotThreshold
+		rc.TrailingLogs = config.SnapshotThreshold
+	}
+	if config.SnapshotInterval > 0 {
+		rc.SnapshotInterval = config.SnapshotInterval
+	}
+	hasState, err := raft.HasExistingState(c.logs, c.logs, snapshots)
+	if err == nil && !hasState {
+		servers := make([]raft.Server, len(config.Nodes))
+		for i, n := range config.Nodes {
+			servers[i] = raft.Server{ID: raft.ServerID(n.ID), Address: raft.ServerAddress(n.Raft)}
+		}
+		// Every node bootstraps the same configuration, so they can start in any order.
+		err = raft.BootstrapCluster(rc, c.logs, c.logs, snapshots, c.transport, raft.Configuration{Servers: servers})
+	}
+	if err == nil {
+		c.raft, err = raft.NewRaft(rc, c, c.logs, c.logs, snapshots, c.transport)
+	}
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("cluster: starting raft: %w", err), c.transport.Close(), c.logs.Close())
+	}
+	store.cluster = c
+	return c, nil
+}
+
+// raftLogger writes the logs of Raft to slog, its other methods do nothing.
+type raftLogger struct {
+	hclog.Logger
+	logger *slog.Logger
+}
+
+func (l *raftLogger) Log(level hclog.Level, msg string, args ...any) {
+	for i, arg := range args {
+		// Values of hclog.Fmt are a format and its arguments.
+		if f, ok := arg.(hclog.Format); ok && len(f) > 0 {
+			if format, ok := f[0].(string); ok {
+				args[i] = fmt.Sprintf(format, f[1:]...)
+			}
+		}
+	}
+	switch level {
+	case hclog.Trace, hclog.Debug:
+		l.logger.Debug(msg, args...)
+	case hclog.Warn:
+		l.logger.Warn(msg, args...)
+	case hclog.Error:
+		l.logger.Error(msg, args...)
+	default:
+		l.logger.Info(msg, args...)
+	}
+}
+
+func (l *raftLogger) Trace(msg string, args ...any) { l.Log(hclog.Trace, msg, args...) }
+func (l *raftLogger) Debug(msg string, args ...any) { l.Log(hclog.Debug, msg, args...) }
+func (l *raftLogger) Info(msg string, args ...any)  { l.Log(hclog.Info, msg, args...) }
+func (l *raftLogger) Warn(msg string, args ...any)  { l.Log(hclog.Warn, msg, args...) }
+func (l *raftLogger) Error(msg string, args ...any) { l.Log(hclog.Error, msg, args...) }
+
+func (l *raftLogger) With(args ...any) hclog.Logger {
+	return &raftLogger{Logger: l.Logger, logger: l.logger.With(args...)}
+}
+
+func (l *raftLogger) Named(name string) hclog.Logger {
+	return &raftLogger{Logger: l.Logger, logger: l.logger.With("name", name)}
+}
+
+// restoreLatest restores the latest snapshot if the store hasn't applied its entries yet, Raft only replays the log
+// after it.
+func (c *Cluster) restoreLatest(snapshots raft.SnapshotStore) error {
+	metas, err := snapshots.List()
+	if err != nil {
+		return fmt.Errorf("cluster: listing snapshots: %w", err)
+	}
+	if len(metas) == 0 || metas[0].Index <= c.applied.Load() {
+		return nil
+	}
+	_, rc, err := snapshots.Open(metas[0].ID)
+	if err != nil {
+		return fmt.Errorf("cluster: opening snapshot %s: %w", metas[0].ID, err)
+	}
+	return c.Restore(rc)
+}
+
+// Close stops the node, a leader hands over to another node first. Writes to the store fail with ErrNotLeader
+// afterwards.
+func (c *Cluster) Close() error {
+	var err error
+	if c.raft.State() == raft.Leader {
+		if transferErr := c.raft.LeadershipTransfer().Error(); transferErr != nil {
+			slog.Warn("cluster: transferring leadership", "err", transferErr)
+		}
+	}
+	if shutdownErr := c.raft.Shutdown().Error(); shutdownErr != nil {
+		err = fmt.Errorf("cluster: shutting down: %w", shutdownErr)
+	}
+	if closeErr := c.transport.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("cluster: closing transport: %w", closeErr))
+	}
+	if closeErr := c.logs.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("cluster: closing log: %w", closeErr))
+	}
+	return err
+}
+
+// Status reports the state of the node, see GET /admin/cluster.
+func (c *Cluster) Status() ClusterStatus {
+	_, leader := c.raft.LeaderWithID()
+	// Stats reports numbers as strings.
+	lastSnapshot, _ := strconv.ParseUint(c.raft.Stats()["last_snapshot_index"], 10, 64)
+	return ClusterStatus{
+		NodeID:       c.config.NodeID,
+		State:        c.raft.State().String(),
+		Leader:       string(leader),
+		Applied:      c.applied.Load(),
+		LastSnapshot: lastSnapshot,
+		Nodes:        c.config.Nodes,
+	}
+}
+
+// leaderAPI returns the base URL of the API of the leader, false while none is elected or this node leads.
+func (c *Cluster) leaderAPI() (*url.URL, bool) {
+	_, id := c.raft.LeaderWithID()
+	if id == "" || string(id) == c.config.NodeID {
+		return nil, false
+	}
+	node, ok := c.config.node(string(id))
+	if !ok {
+		return nil, false
+	}
+	u, err := url.Parse(node.API)
+	return u, err == nil
+}
+
+// notLeader returns ErrNotLeader naming the leader to write to, if one is elected.
+func (c *Cluster) notLeader() error {
+	if u, ok := c.leaderAPI(); ok {
+		return fmt.Errorf("%w, write to %s", ErrNotLeader, u.Redacted())
+	}
+	return fmt.Errorf("%w, no leader is elected", ErrNotLeader)
+}
+
+// clusterCommand is an entry of the log: an insert or the statements of a write, along with whom the request was
+// authenticated as, which the checks of the store depend on.
+type clusterCommand struct {
+	Principal *Principal        `json:"principal,omitempty"`
+	Insert    *InsertStatement  `json:"insert,omitempty"`
+	Queries   []*QueryStatement `json:"queries,omitempty"`
+	// Batch keeps the errors of the statements wrapped in StatementError, as FetchBatch does.
+	Batch bool `json:"batch,omitempty"`
+}
+
+// clusterResult is what applying a command returned, handed to the node that appended it.
+type clusterResult struct {
+	results []*QueryResult
+	err     error
+}
+
+// apply appends the command to the log and returns its result once the leader applied it. It waits for the entry to
+// be committed even if the context is done, the write may be applied anyway.
+func (c *Cluster) apply(ctx context.Context, cmd *clusterCommand) ([]*QueryResult, error) {
+	if p, ok := requestPrincipal(ctx); ok {
+		cmd.Principal = &p
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: encoding write: %w", err)
+	}
+	future := c.raft.Apply(data, 0)
+	if err = future.Error(); errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrRaftShutdown) {
+		return nil, c.notLeader()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cluster: replicating write: %w", err)
+	}
+	res, _ := future.Response().(clusterResult)
+	return res.results, res.err
+}
+
+// insert writes the statement through the log, see Store.Insert.
+func (c *Cluster) insert(ctx context.Context, stmt *InsertStatement) error {
+	_, err := c.apply(ctx, &clusterCommand{Insert: stmt})
+	return err
+}
+
+// fetch runs the statements of a write through the log, see Store.FetchBatch.
+func (c *Cluster) fetch(ctx context.Context, stmts []*QueryStatement, batch bool) ([]*QueryResult, error) {
+	return c.apply(ctx, &clusterCommand{Queries: stmts, Batch: batch})
+}
+
+// replicated reports whether the statement runs through the log of the cluster: it is allowed to write and does on
+// a cluster node.
+func (s *Store) replicated(stmt *QueryStatement) bool {
+	return s.cluster != nil && stmt != nil && stmt.AllowWrites && CheckReadOnly(stmt.Query) != nil
+}
+
+// applyQuery runs the statement on this store in a transaction, see Store.Fetch.
+func (s *Store) applyQuery(ctx context.Context, stmt *QueryStatement) (*QueryResult, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("cluster: rolling back", "err", rollbackErr)
+		}
+	}()
+	res, err := s.fetch(ctx, tx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if err = recordClusterIndex(ctx, tx); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing: %w", err)
+	}
+	return res, nil
+}
+
+// streamCluster is Store.stream for writes on a cluster node: the statement runs through the log and its result is
+// passed to onColumns and fn once applied.
+func (s *Store) streamCluster(
+	ctx context.Context,
+	stmt *QueryStatement,
+	onColumns func(cols []Column) error,
+	fn func(row map[string]any) error,
+) (*QueryResult, error) {
+	results, err := s.cluster.fetch(ctx, []*QueryStatement{stmt}, false)
+	if err != nil {
+		return nil, err
+	}
+	res := results[0]
+	if onColumns != nil {
+		if err = onColumns(res.Columns); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range res.Rows {
+		if err = fn(row); err != nil {
+			return nil, err
+		}
+	}
+	return &QueryResult{Columns: res.Columns, Elapsed: res.Elapsed, Truncated: res.Truncated}, nil
+}
+
+// clusterIndexContextKey carries the index of the entry being applied, which the store records along with its write.
+type clusterIndexContextKey struct{}
+
+// Apply writes the command of the entry to the store, unless the store applied it before a restart. Commands that fail
+// fail alike on every node, they aren't retried.
+func (c *Cluster) Apply(l *raft.Log) any {
+	if l.Index <= c.applied.Load() {
+		return clusterResult{}
+	}
+	defer c.applied.Store(l.Index)
+	var cmd clusterCommand
+	dec := json.NewDecoder(bytes.NewReader(l.Data))
+	dec.UseNumber()
+	if err := dec.Decode(&cmd); err != nil {
+		return clusterResult{err: fmt.Errorf("cluster: decoding entry %d: %w", l.Index, err)}
+	}
+	ctx := context.WithValue(context.Background(), clusterIndexContextKey{}, l.Index)
+	if cmd.Principal != nil {
+		ctx = context.WithValue(ctx, principalContextKey{}, *cmd.Principal)
+	}
+	if cmd.Insert != nil {
+		if err := exactRows(cmd.Insert.rows()...); err != nil {
+			return clusterResult{err: fmt.Errorf("cluster: decoding entry %d: %w", l.Index, err)}
+		}
+		return clusterResult{err: c.store.applyInsert(ctx, cmd.Insert)}
+	}
+	for _, stmt := range cmd.Queries {
+		if _, err := exactNumbers(stmt.Params); err != nil {
+			return clusterResult{err: fmt.Errorf("cluster: decoding entry %d: %w", l.Index, err)}
+		}
+	}
+	if cmd.Batch {
+		results, err := c.store.fetchBatch(ctx, cmd.Queries)
+		return clusterResult{results: results, err: err}
+	}
+	if len(cmd.Queries) != 1 {
+		return clusterResult{err: fmt.Errorf("cluster: entry %d has no insert or statement", l.Index)}
+	}
+	res, err := c.store.applyQuery(ctx, cmd.Queries[0])
+	if err != nil {
+		return clusterResult{err: err}
+	}
+	return clusterResult{results: []*QueryResult{res}}
+}
+
+// Snapshot exports the database while the entries after it wait, Persist archives the export.
+func (c *Cluster) Snapshot() (raft.FSMSnapshot, error) {
+	dir, err := os.MkdirTemp(c.config.Dir, "export-")
+	if err != nil {
+		return nil, fmt.Errorf("cluster: creating snapshot directory: %w", err)
+	}
+	if err = c.store.exportSnapshot(context.Background(), filepath.Join(dir, "db")); err != nil {
+		return nil, errors.Join(err, os.RemoveAll(dir))
+	}
+	return &clusterSnapshot{dir: filepath.Join(dir, "db"), tmp: dir}, nil
+}
+
+// Restore replaces the database with the export of a snapshot.
+func (c *Cluster) Restore(rc io.ReadCloser) error {
+	defer func() {
+		if err := rc.Close(); err != nil {
+			slog.Error("cluster: closing snapshot", "err", err)
+		}
+	}()
+	dir, err := os.MkdirTemp(c.config.Dir, "import-")
+	if err != nil {
+		return fmt.Errorf("cluster: creating snapshot directory: %w", err)
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			slog.Error("cluster: removing snapshot directory", "path", dir, "err", removeErr)
+		}
+	}()
+	if err = untarFiles(rc, dir); err != nil {
+		return fmt.Errorf("cluster: reading snapshot: %w", err)
+	}
+	index, err := c.store.importSnapshot(context.Background(), dir)
+	if err != nil {
+		return err
+	}
+	c.applied.Store(index)
+	return nil
+}
+
+// clusterSnapshot is an export of the database in dir, within the temporary directory tmp.
+type clusterSnapshot struct {
+	dir string
+	tmp string
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := tarFiles(sink, s.dir); err != nil {
+		return errors.Join(fmt.Errorf("cluster: writing snapshot: %w", err), sink.Cancel())
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("cluster: closing snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s *clusterSnapshot) Release() {
+	if err := os.RemoveAll(s.tmp); err != nil {
+		slog.Error("cluster: removing snapshot directory", "path", s.tmp, "err", err)
+	}
+}
+
+// tarFiles writes the files of the directory, which has no subdirectories, to w as a tar archive.
+func tarFiles(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err = tarFile(tw, filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func tarFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("closing file", "path", path, "err", closeErr)
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// untarFiles extracts the files of the tar archive of tarFiles into the directory.
+func untarFiles(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) || hdr.Name == ".." {
+			return fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		if _, err = copyFileAtomic(filepath.Join(dir, hdr.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// clusterIndex returns the index of the last entry of the log applied to the store, creating ClusterTable on first
+// use.
+func (s *Store) clusterIndex(ctx context.Context) (uint64, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, applied UBIGINT NOT NULL)", ClusterTable,
+	)); err != nil {
+		return 0, fmt.Errorf("creating %s: %w", ClusterTable, err)
+	}
+	var index uint64
+	err := s.db.QueryRowContext(ctx, "SELECT applied FROM "+ClusterTable+" WHERE id = 1").Scan(&index)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("reading applied index: %w", err)
+	}
+	return index, nil
+}
+
+// execer is implemented by both a connection and a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// recordClusterIndex records the index of the entry applied with the context in the transaction of its write, if the
+// write comes from the log.
+func recordClusterIndex(ctx context.Context, tx execer) error {
+	index, ok := ctx.Value(clusterIndexContextKey{}).(uint64)
+	if !ok {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO "+ClusterTable+" VALUES (1, ?)", index); err != nil {
+		return fmt.Errorf("recording applied index: %w", err)
+	}
+	return nil
+}
+
+// exportSnapshot exports the database to the directory, waiting for the running write.
+func (s *Store) exportSnapshot(ctx context.Context, dir string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.exportDatabase(ctx, dir); err != nil {
+		return fmt.Errorf("cluster: exporting snapshot: %w", err)
+	}
+	return nil
+}
+
+// importSnapshot replaces the objects of the database with the export in the directory and returns the index of the
+// last entry it applied.
+func (s *Store) importSnapshot(ctx context.Context, dir string) (uint64, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	// The prepared inserts and the checked tables refer to the replaced tables.
+	s.inserts.close()
+	s.changeFeed.ready = false
+	s.quotaReady = false
+	if err := s.clearDatabase(ctx); err != nil {
+		return 0, fmt.Errorf("cluster: restoring snapshot: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "IMPORT DATABASE "+quoteLiteral(dir)); err != nil {
+		return 0, fmt.Errorf("cluster: restoring snapshot: %w", s.memoryError(err))
+	}
+	var index uint64
+	if err := s.db.QueryRowContext(ctx, "SELECT applied FROM "+ClusterTable+" WHERE id = 1").Scan(&index); err != nil {
+		return 0, fmt.Errorf("cluster: reading applied index of snapshot: %w", err)
+	}
+	return index, nil
+}
+
+// clearStatements list the objects of the database that EXPORT DATABASE writes, with the statement dropping them, in
+// the order of their dependencies.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var clearStatements = []struct{ list, drop string }{
+	{
+		"SELECT schema_name, view_name FROM duckdb_views() " +
+			"WHERE database_name = current_database() AND NOT internal AND NOT temporary",
+		"DROP VIEW IF EXISTS %s.%s",
+	},
+	{
+		"SELECT schema_name, function_name FROM duckdb_functions() " +
+			"WHERE database_name = current_database() AND NOT internal AND function_type = 'macro'",
+		"DROP MACRO IF EXISTS %s.%s",
+	},
+	{
+		"SELECT schema_name, function_name FROM duckdb_functions() " +
+			"WHERE database_name = current_database() AND NOT internal AND function_type = 'table_macro'",
+		"DROP MACRO TABLE IF EXISTS %s.%s",
+	},
+	{
+		"SELECT schema_name, table_name FROM duckdb_tables() " +
+			"WHERE database_name = current_database() AND NOT internal AND NOT temporary",
+		"DROP TABLE IF EXISTS %s.%s",
+	},
+	{
+		"SELECT schema_name, sequence_name FROM duckdb_sequences() " +
+			"WHERE database_name = current_database() AND NOT temporary",
+		"DROP SEQUENCE IF EXISTS %s.%s",
+	},
+	{
+		"SELECT schema_name, type_name FROM duckdb_types() " +
+			"WHERE database_name = current_database() AND NOT internal AND schema_name <> 'pg_catalog'",
+		"DROP TYPE IF EXISTS %s.%s",
+	},
+}
+
+// clearDatabase drops the objects of the database an import creates. The caller holds the write lock.
+func (s *Store) clearDatabase(ctx context.Context) error {
+	for _, c := range clearStatements {
+		names, err := s.queryPairs(ctx, c.list)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if _, err = s.db.ExecContext(ctx, fmt.Sprintf(c.drop, quoteIdent(n[0]), quoteIdent(n[1]))); err != nil {
+				return fmt.Errorf("dropping %s.%s: %w", n[0], n[1], err)
+			}
+		}
+	}
+	return nil
+}
+
+// queryPairs returns the rows of a query selecting two strings.
+func (s *Store) queryPairs(ctx context.Context, query string) ([][2]string, error) {
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var out [][2]string
+	for rows.Next() {
+		var pair [2]string
+		if err = rows.Scan(&pair[0], &pair[1]); err != nil {
+			return nil, fmt.Errorf("listing objects: %w", err)
+		}
+		out = append(out, pair)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+	return out, nil
+}
+
+// WithCluster makes the server a node of the cluster: writes reaching a node that isn't the leader are forwarded to
+// the leader, and the admin endpoints expose the status of the node.
+func WithCluster(cluster *Cluster) ServerOption {
+	return func(s *Server) {
+		s.cluster = cluster
+	}
+}
+
+// clusterGuard forwards the writes of other routes than readRoutes to the leader, and refuses them while no leader is
+// elected or when they were forwarded already.
+func (s *Server) clusterGuard(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || s.cluster.raft.State() == raft.Leader {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := mux.Handler(r); pattern == "" || readRoutes[pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leader, ok := s.cluster.leaderAPI()
+		if !ok || r.Header.Get(ClusterForwardedHeader) != "" {
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, http.StatusServiceUnavailable, "forward write to leader", s.cluster.notLeader())
+			return
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(leader)
+				pr.SetXForwarded()
+				pr.Out.Header.Set(ClusterForwardedHeader, s.cluster.config.NodeID)
+			},
+			ErrorHandler: func(rw http.ResponseWriter, _ *http.Request, err error) {
+				s.writeError(rw, http.StatusBadGateway, "forward write to leader", err)
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) HandleClusterStatus(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle cluster status: writing response", s.cluster.Status())
+}
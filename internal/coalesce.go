@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCoalesceRows bounds the rows of the inserts of POST /data committed as one statement unless configured
+// otherwise.
+const DefaultCoalesceRows = 1000
+
+// The states of a queued insert. The requester may only give up on an insert the drainer hasn't taken.
+const (
+	insertQueued int32 = iota
+	insertTaken
+	insertAbandoned
+)
+
+// queuedInsert is an insert of POST /data waiting for its batch.
+type queuedInsert struct {
+	ctx   context.Context
+	stmt  *InsertStatement
+	state atomic.Int32
+	done  chan error
+}
+
+// insertCoalescer group-commits the inserts of POST /data: while a batch holds the write path, the inserts arriving
+// queue up, and the next batch writes those of the same table and tenant as one statement.
+type insertCoalescer struct {
+	maxRows  int
+	mu       sync.Mutex
+	pending  []*queuedInsert
+	draining bool
+}
+
+// WithInsertCoalescing commits the concurrent inserts of POST /data into the same table as one multi-row statement of
+// up to maxRows rows, rather than one after the other. An insert failing in a batch is retried on its own, so only
+// the faulty inserts fail. The queue is bounded like WithWriteBackpressure. Zero disables coalescing.
+func WithInsertCoalescing(maxRows int) ServerOption {
+	return func(s *Server) {
+		s.coalescer = nil
+		if maxRows > 0 {
+			s.coalescer = &insertCoalescer{maxRows: maxRows}
+		}
+	}
+}
+
+// depth returns the inserts queued for a batch.
+func (c *insertCoalescer) depth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// coalescedInsert queues the insert for the next batch and waits for its result. It fails with ErrTooManyWrites
+// when the queue is full and with ErrWritePathBusy when the batch doesn't start within the maximum write wait.
+func (s *Server) coalescedInsert(ctx context.Context, stmt *InsertStatement) error {
+	c := s.coalescer
+	q := &queuedInsert{ctx: ctx, stmt: stmt, done: make(chan error, 1)}
+	c.mu.Lock()
+	if len(c.pending) >= max(s.writeSlots.maxQueued, 1) {
+		c.mu.Unlock()
+		return ErrTooManyWrites
+	}
+	c.pending = append(c.pending, q)
+	start := !c.draining
+	c.draining = true
+	c.mu.Unlock()
+	if start {
+		go s.drainInserts()
+	}
+
+	var timeout <-chan time.Time
+	if s.maxWriteWait > 0 {
+		timer := time.NewTimer(s.maxWriteWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-q.done:
+		return err
+	case <-ctx.Done():
+	case <-timeout:
+	}
+	if q.state.CompareAndSwap(insertQueued, insertAbandoned) {
+		return fmt.Errorf("%w: waited %s", ErrWritePathBusy, s.maxWriteWait)
+	}
+	// The batch has started, its result is due.
+	return <-q.done
+}
+
+// drainInserts writes the queued inserts batch by batch until the queue is empty.
+func (s *Server) drainInserts() {
+	c := s.coalescer
+	for {
+		c.mu.Lock()
+		batch := c.pending
+		c.pending = nil
+		if len(batch) == 0 {
+			c.draining = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		// The batch holds the write path like a single insert, the other writers wait for it.
+		s.writeSlots.slots <- struct{}{}
+		groups := make(map[string][]*queuedInsert)
+		var keys []string
+		for _, q := range batch {
+			if !q.state.CompareAndSwap(insertQueued, insertTaken) {
+				continue
+			}
+			key := strings.ToLower(q.stmt.Table) + "\x00" + requestTenant(q.ctx)
+			if groups[key] == nil {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], q)
+		}
+		for _, key := range keys {
+			s.insertGroup(groups[key])
+		}
+		<-s.writeSlots.slots
+	}
+}
+
+// insertGroup writes the inserts of a table and tenant in statements of up to maxRows rows.
+func (s *Server) insertGroup(group []*queuedInsert) {
+	for len(group) > 0 {
+		n, rows := 1, len(group[0].stmt.rows())
+		for n < len(group) && rows+len(group[n].stmt.rows()) <= s.coalescer.maxRows {
+			rows += len(group[n].stmt.rows())
+			n++
+		}
+		s.insertRun(group[:n])
+		group = group[n:]
+	}
+}
+
+// insertRun writes the inserts as one statement. If it fails, which rolls it back, the inserts are written one by one
+// instead, so only the faulty ones fail.
+func (s *Server) insertRun(run []*queuedInsert) {
+	// The inserts were accepted, they complete even if their requests go away meanwhile.
+	ctx := context.WithoutCancel(run[0].ctx)
+	if len(run) > 1 {
+		combined := &InsertStatement{Table: run[0].stmt.Table, RequestID: run[0].stmt.RequestID}
+		for _, q := range run {
+			combined.Rows = append(combined.Rows, q.stmt.rows()...)
+		}
+		if err := s.store.Insert(ctx, combined); err == nil {
+			for _, q := range run {
+				q.done <- nil
+			}
+			return
+		}
+	}
+	for _, q := range run {
+		q.done <- s.store.Insert(context.WithoutCancel(q.ctx), q.stmt)
+	}
+}
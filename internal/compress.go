@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressBytes is the smallest response worth compressing, below it the framing outweighs the savings.
+const minCompressBytes = 1 << 10
+
+// contentEncoding compresses responses for clients listing its name in Accept-Encoding.
+type contentEncoding struct {
+	name      string
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+// contentEncodings are the encodings offered in order of preference, for clients accepting several equally.
+//
+//nolint:gochecknoglobals // Read-only encoding descriptors.
+var contentEncodings = []contentEncoding{
+	{name: "gzip", newWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// negotiateEncoding returns the encoding the Accept-Encoding header of the request prefers, nil for none.
+func negotiateEncoding(r *http.Request) *contentEncoding {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		accepted[name] = q
+	}
+	var (
+		out   *contentEncoding
+		bestQ float64
+	)
+	for i, enc := range contentEncodings {
+		q, ok := accepted[enc.name]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			out, bestQ = &contentEncodings[i], q
+		}
+	}
+	return out
+}
+
+// responseEncoding returns the encoding of a response body of the size for the request, nil when the client accepts
+// no encoding or the body is too small to bother.
+func responseEncoding(r *http.Request, size int) *contentEncoding {
+	if size < minCompressBytes {
+		return nil
+	}
+	return negotiateEncoding(r)
+}
+
+// compress returns the body encoded.
+func (e *contentEncoding) compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := e.newWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, fmt.Errorf("%s: %w", e.name, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("%s: %w", e.name, err)
+	}
+	return buf.Bytes(), nil
+}
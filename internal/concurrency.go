@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConcurrentQueries bounds the queries executing at once unless the server is configured otherwise.
+	DefaultMaxConcurrentQueries = 8
+	// DefaultMaxQueuedQueries bounds the queries waiting for an execution slot unless the server is configured
+	// otherwise.
+	DefaultMaxQueuedQueries = 64
+	// DefaultMaxQueuedWrites bounds the inserts waiting for the write path unless the server is configured otherwise.
+	DefaultMaxQueuedWrites = 64
+	// DefaultMaxWriteWait bounds how long an insert waits for the write path unless the server is configured otherwise.
+	DefaultMaxWriteWait = 10 * time.Second
+)
+
+var (
+	ErrTooManyQueries = errors.New("too many queries")
+	// ErrTooManyWrites is returned when the queue of inserts waiting for the write path is full.
+	ErrTooManyWrites = errors.New("too many writes queued")
+	// ErrWritePathBusy is returned when an insert waited longer than the configured maximum for the write path.
+	ErrWritePathBusy = errors.New("write path busy")
+)
+
+// WriteQueueDepthHeader carries the inserts holding or waiting for the write path on rejected inserts, so clients can
+// back off in proportion.
+const WriteQueueDepthHeader = "X-Write-Queue-Depth"
+
+// querySlots is a semaphore of query executions with a bounded queue of waiting queries. A nil querySlots doesn't
+// limit anything.
+type querySlots struct {
+	slots     chan struct{}
+	mu        sync.Mutex
+	queued    int
+	maxQueued int
+	// errFull is returned when the queue is full.
+	errFull error
+}
+
+func newQuerySlots(maxConcurrent, maxQueued int) *querySlots {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &querySlots{
+		slots: make(chan struct{}, maxConcurrent), maxQueued: max(maxQueued, 0), errFull: ErrTooManyQueries,
+	}
+}
+
+// newWriteSlots returns the slot of the write path with the bounded queue of inserts waiting for it. Inserts take
+// the write lock of the store one at a time anyway, the slot keeps those waiting for it countable and bounded.
+func newWriteSlots(maxQueued int) *querySlots {
+	return &querySlots{slots: make(chan struct{}, 1), maxQueued: max(maxQueued, 0), errFull: ErrTooManyWrites}
+}
+
+// depth returns the slots held and the queue waiting for them.
+func (q *querySlots) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.slots) + q.queued
+}
+
+// acquire waits for an execution slot until the context is done and returns the function releasing it. It fails
+// with the error of a full queue, e.g. ErrTooManyQueries, right away if the queue is full.
+func (q *querySlots) acquire(ctx context.Context) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	release := func() { <-q.slots }
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.mu.Lock()
+	if q.queued >= q.maxQueued {
+		q.mu.Unlock()
+		return nil, q.errFull
+	}
+	q.queued++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.queued--
+		q.mu.Unlock()
+	}()
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WithWriteBackpressure bounds the inserts of POST /data queued for the write path and how long each waits for it.
+// Inserts beyond the queue are rejected with 429, those waiting longer with 503, both with Retry-After and
+// WriteQueueDepthHeader. A maxWait of zero waits as long as the request.
+func WithWriteBackpressure(maxQueued int, maxWait time.Duration) ServerOption {
+	return func(s *Server) {
+		s.writeSlots = newWriteSlots(maxQueued)
+		s.maxWriteWait = maxWait
+	}
+}
+
+// acquireWrite waits for the write path and returns the function releasing it. It answers the request itself and
+// returns false if the write path is saturated.
+func (s *Server) acquireWrite(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	ctx := r.Context()
+	if s.maxWriteWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.maxWriteWait)
+		defer cancel()
+	}
+	release, err := s.writeSlots.acquire(ctx)
+	if err == nil {
+		return release, true
+	}
+	if !errors.Is(err, ErrTooManyWrites) {
+		err = fmt.Errorf("%w: waited %s", ErrWritePathBusy, s.maxWriteWait)
+	}
+	s.rejectWrite(w, err)
+	return nil, false
+}
+
+// rejectWrite answers an insert refused for a saturated write path, ErrTooManyWrites with 429 and ErrWritePathBusy
+// with 503.
+func (s *Server) rejectWrite(w http.ResponseWriter, err error) {
+	code := http.StatusTooManyRequests
+	if !errors.Is(err, ErrTooManyWrites) {
+		code = http.StatusServiceUnavailable
+	}
+	depth := s.writeSlots.depth()
+	if s.coalescer != nil {
+		depth += s.coalescer.depth()
+	}
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set(WriteQueueDepthHeader, strconv.Itoa(depth))
+	s.writeError(w, code, "handle data: waiting for the write path", err)
+}
@@ -0,0 +1,592 @@
+// Package config assembles the server configuration from defaults, an optional YAML file, environment variables and
+// flags, each overriding the one before.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"scratch/internal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to the upper cased flag name, with dashes turned into underscores, to get the environment
+// variable of a setting, e.g. SCRATCH_DB_PATH for -db-path.
+const EnvPrefix = "SCRATCH_"
+
+// Config is everything main needs to wire the server. The YAML file mirrors its structure.
+type Config struct {
+	Server   Server                  `yaml:"server"`
+	Database internal.DatabaseConfig `yaml:"database"`
+	Limits   internal.Limits         `yaml:"limits"`
+	Query    Query                   `yaml:"query"`
+	Log      internal.LogConfig      `yaml:"log"`
+	// MacrosFile keeps the user-defined macros across restarts, empty keeps them in memory only.
+	MacrosFile string `yaml:"macros_file"`
+	// ExportDir is the directory local exports are written to, empty disables them.
+	ExportDir string `yaml:"export_dir"`
+	// BackupDir is the directory backups are kept in, empty allows only backups to object stores.
+	BackupDir string `yaml:"backup_dir"`
+	// DownloadDir is the directory the files of resumable downloads are written to, empty disables them.
+	DownloadDir string `yaml:"download_dir"`
+	// DownloadRetention is how long a download is kept before its file is removed.
+	DownloadRetention time.Duration `yaml:"download_retention"`
+	// UploadDir is the directory the parts of upload sessions are kept in until they are committed, empty disables
+	// upload sessions.
+	UploadDir string `yaml:"upload_dir"`
+	// UploadRetention is how long an upload session is kept before its parts are removed.
+	UploadRetention time.Duration `yaml:"upload_retention"`
+	// TieringInterval is how often the tiering policies of the tables run, zero for on demand only.
+	TieringInterval time.Duration `yaml:"tiering_interval"`
+	// IngestLog is the file every insert is logged to for point-in-time recovery, empty disables it.
+	IngestLog string `yaml:"ingest_log"`
+	// ChangeFeedRetention is how long the change feed keeps inserts and schema changes, zero disables it.
+	ChangeFeedRetention time.Duration `yaml:"change_feed_retention"`
+	// AuditRetention is how long the audit log of queries and ingests is kept in the _audit table, zero disables it.
+	AuditRetention time.Duration `yaml:"audit_retention"`
+	// Follow is the base URL of the leader this instance replicates as a read-only follower, empty to accept writes.
+	// The leader needs the change feed.
+	Follow string `yaml:"follow"`
+	// FollowKey is an admin API key or token of the leader, if it requires one.
+	FollowKey      string        `yaml:"follow_key"`
+	FollowInterval time.Duration `yaml:"follow_interval"`
+	// Cluster makes this instance a node of a Raft cluster replicating writes once its node ID is set. Its nodes are
+	// only read from the YAML file. It can't be combined with Follow.
+	Cluster internal.ClusterConfig `yaml:"cluster"`
+	// SecretsFile keeps the object store secrets across restarts, encrypted with SecretsKey, the base64 encoded AES
+	// key. Empty keeps them in memory only.
+	SecretsFile string `yaml:"secrets_file"`
+	SecretsKey  string `yaml:"secrets_key"`
+	// Webhooks are notified of the tables and columns ingestion creates and of the type conflicts it refuses. Their
+	// retries apply to the notifications of alerts too.
+	Webhooks internal.WebhookConfig `yaml:"webhooks"`
+	// Attachments are the external databases attached on startup. They are only read from the YAML file.
+	Attachments []internal.Attachment `yaml:"attachments"`
+	// APIKeys are required on every request once set, along with the keys created through the admin endpoints, which
+	// are kept in APIKeysFile. They are only read from the YAML file, AdminKey adds an admin key from a flag.
+	APIKeys     []internal.APIKey `yaml:"api_keys"`
+	APIKeysFile string            `yaml:"api_keys_file"`
+	AdminKey    string            `yaml:"admin_key"`
+	// Quotas limit the inserts of the tenants of API keys and tokens once one is set. They are only read from the YAML
+	// file.
+	Quotas internal.Quotas `yaml:"quotas"`
+	// TableACLs restrict tables to the roles of API keys and tokens. They are only read from the YAML file.
+	TableACLs []internal.TableACL `yaml:"table_acls"`
+	// RowLevelSecurity is the column, e.g. tenant_id, that isolates the rows of the tenants of API keys and tokens,
+	// empty to disable it.
+	RowLevelSecurity string `yaml:"row_level_security"`
+	// ColumnMasks redact columns in the query results of API keys and tokens. They are only read from the YAML file.
+	ColumnMasks []internal.ColumnMask `yaml:"column_masks"`
+	// SQLPolicy refuses statements, functions and cross-schema reads in the SQL of requests once it has a rule. It is
+	// only read from the YAML file.
+	SQLPolicy internal.SQLPolicy `yaml:"sql_policy"`
+	// ClientCerts map the client certificates verified against Server.TLS.ClientCAFile to principals, like API keys.
+	// They are only read from the YAML file.
+	ClientCerts []internal.ClientCert `yaml:"client_certs"`
+	// JWT accepts tokens of an identity provider besides API keys once the issuer is set.
+	JWT internal.JWTConfig `yaml:"jwt"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr"`
+	// Listeners replace Addr with several addresses or Unix domain sockets, each serving all of the API or only its
+	// admin or public surface.
+	Listeners []internal.Listener `yaml:"listeners"`
+	// ReadHeaderTimeout bounds reading the request headers. The remaining timeouts are disabled at zero.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	// WriteTimeout bounds answering a request, so it has to leave room for the query timeout, exports and backups.
+	// Streamed query results and WebSocket subscriptions are exempt.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes bounds the request headers, zero for the 1 MiB default of net/http.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// KeepAlive reuses connections for several requests, disabling it closes them after each response.
+	KeepAlive bool `yaml:"keep_alive"`
+	// HTTP2 negotiates HTTP/2 on the TLS listeners, plaintext listeners always speak HTTP/1.1.
+	HTTP2 bool `yaml:"http2"`
+	// ShutdownTimeout bounds draining the requests and jobs on SIGINT or SIGTERM before they are cancelled.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// MaxBodyBytes bounds the request bodies of uploads such as POST /data, zero to disable the bound.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// MaxQueuedWrites and MaxWriteWait bound the inserts waiting for the write path, see
+	// internal.WithWriteBackpressure.
+	MaxQueuedWrites int           `yaml:"max_queued_writes"`
+	MaxWriteWait    time.Duration `yaml:"max_write_wait"`
+	// CoalesceRows bounds the rows of concurrent inserts into a table committed as one statement, zero inserts them
+	// one by one, see internal.WithInsertCoalescing.
+	CoalesceRows int `yaml:"coalesce_rows"`
+	// AccessLog logs every request with its status, duration, size, caller and request id.
+	AccessLog bool `yaml:"access_log"`
+	// Debug exposes pprof, expvar and runtime stats on the admin endpoints under /admin/debug/.
+	Debug bool `yaml:"debug"`
+	// UI serves the admin web UI under /admin/ui/.
+	UI bool `yaml:"ui"`
+	// ClickHouseHTTP serves a subset of the ClickHouse HTTP interface at the root path.
+	ClickHouseHTTP bool `yaml:"clickhouse_http"`
+	// FlightSQLAddr serves Arrow Flight SQL over gRPC on the address, with the TLS settings and credentials of the
+	// API. Empty disables it.
+	FlightSQLAddr string `yaml:"flight_sql_addr"`
+	// CORS lets browsers call the API from other origins once an origin is allowed.
+	CORS internal.CORS `yaml:"cors"`
+	// TLS serves HTTPS instead of plaintext once the certificate file is set.
+	TLS internal.TLSConfig `yaml:"tls"`
+}
+
+type Query struct {
+	// MaxTimeout is the maximum execution time of a query and its default timeout.
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+	// CacheTTL is how long results of read-only queries are cached.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// MemoryLimit is the memory in bytes DuckDB uses for query execution, zero for DuckDB's default.
+	MemoryLimit   int64                 `yaml:"memory_limit"`
+	ResultLimits  internal.ResultLimits `yaml:"result_limits"`
+	MaxConcurrent int                   `yaml:"max_concurrent"`
+	MaxQueued     int                   `yaml:"max_queued"`
+	// TagConcurrency bounds the queries of a query tag executing at once, e.g. to keep a dashboard from crowding out
+	// the others. Each tag queues up to MaxQueued queries.
+	TagConcurrency map[string]int `yaml:"tag_concurrency"`
+	// History is how many executed queries GET /queries/history remembers, zero to keep none.
+	History int `yaml:"history"`
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:              ":8000",
+			ReadHeaderTimeout: 3 * time.Second,
+			WriteTimeout:      5 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			KeepAlive:         true,
+			HTTP2:             true,
+			ShutdownTimeout:   30 * time.Second,
+			MaxBodyBytes:      internal.DefaultMaxBodyBytes,
+			MaxQueuedWrites:   internal.DefaultMaxQueuedWrites,
+			MaxWriteWait:      internal.DefaultMaxWriteWait,
+			CoalesceRows:      internal.DefaultCoalesceRows,
+			AccessLog:         true,
+		},
+		Limits:            internal.DefaultLimits(),
+		TieringInterval:   time.Hour,
+		FollowInterval:    time.Second,
+		DownloadRetention: internal.DefaultDownloadRetention,
+		UploadRetention:   internal.DefaultUploadRetention,
+		Query: Query{
+			MaxTimeout:    internal.DefaultMaxQueryTimeout,
+			ResultLimits:  internal.DefaultResultLimits(),
+			MaxConcurrent: internal.DefaultMaxConcurrentQueries,
+			MaxQueued:     internal.DefaultMaxQueuedQueries,
+			History:       internal.DefaultQueryHistory,
+		},
+		MacrosFile: "macros.json",
+		Webhooks:   internal.DefaultWebhookConfig(),
+	}
+}
+
+// Load reads the configuration for the command line arguments, without the program name. The YAML file is given by
+// -config or SCRATCH_CONFIG.
+func Load(args []string) (Config, error) {
+	// The first pass only finds the file, the flags are parsed again on top of the file and the environment, which
+	// reports any error.
+	cfg := Default()
+	file := os.Getenv(EnvPrefix + "CONFIG")
+	fs := newFlagSet(&cfg, &file)
+	fs.SetOutput(io.Discard)
+	_ = fs.Parse(args)
+
+	cfg = Default()
+	if file != "" {
+		if err := readFile(file, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	fs = newFlagSet(&cfg, &file)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of scratch:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set by its environment variable, e.g. %s for -db-path.\n",
+			EnvName("db-path"))
+	}
+	if err := applyEnv(fs); err != nil {
+		return Config{}, err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if l, ok := f.Value.(listValue); ok {
+			l.newSource()
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func readFile(name string, cfg *Config) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	// Unknown keys are refused so a misspelled setting doesn't silently keep its default.
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("decoding config file %s: %w", name, err)
+	}
+	return nil
+}
+
+// deprecatedEnv are the environment variables of the flags before they took the EnvPrefix, by flag. They are read
+// when the current variable isn't set.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var deprecatedEnv = map[string]string{
+	"db-path":      "DUCKDB_PATH",
+	"db-read-only": "DUCKDB_READ_ONLY",
+	"db-threads":   "DUCKDB_THREADS",
+}
+
+// applyEnv sets every flag that has its environment variable set, so the environment is parsed like the flags.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		name := EnvName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if old := deprecatedEnv[f.Name]; !ok && old != "" {
+			if v, ok = os.LookupEnv(old); ok {
+				slog.Warn("deprecated environment variable", "name", old, "use", name)
+				name = old
+			}
+		}
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, v); setErr != nil {
+			err = fmt.Errorf("parsing %s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// EnvName returns the environment variable of the flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func newFlagSet(cfg *Config, file *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("scratch", flag.ContinueOnError)
+	fs.StringVar(file, "config", *file, "YAML file the configuration is read from, flags and environment override it")
+
+	fs.StringVar(&cfg.Server.Addr, "addr", cfg.Server.Addr, "address the server listens on")
+	fs.Var(&listenerFlag{list: &cfg.Server.Listeners}, "listen",
+		"address or unix:<socket path> to listen on instead of -addr, with an optional =admin or =public surface, "+
+			"repeatable")
+	fs.DurationVar(&cfg.Server.ReadHeaderTimeout, "read-header-timeout", cfg.Server.ReadHeaderTimeout,
+		"maximum time to read the request headers")
+	fs.DurationVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout,
+		"maximum time to read the whole request, 0 to disable")
+	fs.DurationVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout,
+		"maximum time to write the response, streamed query results excepted, 0 to disable")
+	fs.DurationVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout,
+		"maximum time an idle keep-alive connection is kept open, 0 to use the read timeout")
+	fs.IntVar(&cfg.Server.MaxHeaderBytes, "max-header-bytes", cfg.Server.MaxHeaderBytes,
+		"maximum size in bytes of the request headers, 0 for 1 MiB")
+	fs.BoolVar(&cfg.Server.KeepAlive, "keep-alive", cfg.Server.KeepAlive,
+		"reuse connections for several requests")
+	fs.BoolVar(&cfg.Server.HTTP2, "http2", cfg.Server.HTTP2, "negotiate HTTP/2 on TLS listeners")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout,
+		"maximum time to drain requests and jobs on shutdown before they are cancelled")
+	fs.Int64Var(&cfg.Server.MaxBodyBytes, "max-body-bytes", cfg.Server.MaxBodyBytes,
+		"maximum size in bytes of upload request bodies such as POST /data, 0 for no limit")
+	fs.IntVar(&cfg.Server.MaxQueuedWrites, "max-queued-writes", cfg.Server.MaxQueuedWrites,
+		"maximum inserts waiting for the write path before further ones are rejected with 429")
+	fs.DurationVar(&cfg.Server.MaxWriteWait, "max-write-wait", cfg.Server.MaxWriteWait,
+		"maximum time an insert waits for the write path before it is rejected with 503, 0 for no limit")
+	fs.IntVar(&cfg.Server.CoalesceRows, "coalesce-rows", cfg.Server.CoalesceRows,
+		"maximum rows of concurrent inserts into a table committed as one statement, 0 to disable")
+	fs.BoolVar(&cfg.Server.AccessLog, "access-log", cfg.Server.AccessLog, "log every request")
+	fs.BoolVar(&cfg.Server.UI, "ui", cfg.Server.UI, "serve the admin web UI under /admin/ui/")
+	fs.BoolVar(&cfg.Server.ClickHouseHTTP, "clickhouse-http", cfg.Server.ClickHouseHTTP,
+		"serve the ClickHouse HTTP interface at the root path")
+	fs.StringVar(&cfg.Server.FlightSQLAddr, "flight-sql-addr", cfg.Server.FlightSQLAddr,
+		"address to serve Arrow Flight SQL on over gRPC, empty to disable it")
+	fs.BoolVar(&cfg.Server.Debug, "debug-endpoints", cfg.Server.Debug,
+		"expose pprof, expvar and runtime stats under /admin/debug/, to admins if authentication is enabled")
+	fs.StringVar(&cfg.Server.TLS.CertFile, "tls-cert", cfg.Server.TLS.CertFile,
+		"PEM certificate file to serve HTTPS with, empty to serve plaintext")
+	fs.StringVar(&cfg.Server.TLS.KeyFile, "tls-key", cfg.Server.TLS.KeyFile, "PEM private key file of the certificate")
+	fs.StringVar(&cfg.Server.TLS.MinVersion, "tls-min-version", cfg.Server.TLS.MinVersion,
+		"minimum TLS version, 1.2 or 1.3")
+	fs.StringVar(&cfg.Server.TLS.RedirectAddr, "tls-redirect-addr", cfg.Server.TLS.RedirectAddr,
+		"address of a plaintext listener redirecting to HTTPS, e.g. :80, empty to refuse plaintext")
+	fs.StringVar(&cfg.Server.TLS.ClientCAFile, "tls-client-ca", cfg.Server.TLS.ClientCAFile,
+		"PEM file of the CAs client certificates are verified against, empty to not ask for them")
+	fs.BoolVar(&cfg.Server.TLS.RequireClientCert, "tls-require-client-cert", cfg.Server.TLS.RequireClientCert,
+		"refuse TLS handshakes without a client certificate")
+	fs.Var(&listFlag{list: &cfg.Server.CORS.AllowedOrigins}, "cors-origin",
+		"origin allowed to call the API from browsers, e.g. https://dash.example.com or * for any, repeatable")
+
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "minimum level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format: text or json")
+	fs.StringVar(&cfg.Database.Path, "db-path", cfg.Database.Path,
+		"DuckDB database file the data is kept in across restarts, empty to keep it in memory only")
+	fs.BoolVar(&cfg.Database.ReadOnly, "db-read-only", cfg.Database.ReadOnly,
+		"open the database file without write access")
+	fs.IntVar(&cfg.Database.Threads, "db-threads", cfg.Database.Threads,
+		"maximum number of threads DuckDB executes queries with, 0 for one per core")
+	fs.StringVar(&cfg.Database.TempDirectory, "db-temp-directory", cfg.Database.TempDirectory,
+		"directory DuckDB spills to when a query exceeds the memory limit, empty for DuckDB's default")
+	fs.StringVar(&cfg.Database.CheckpointThreshold, "db-checkpoint-threshold", cfg.Database.CheckpointThreshold,
+		"size of the write-ahead log at which DuckDB checkpoints, e.g. 16MB, empty for DuckDB's default")
+	fs.DurationVar(&cfg.Database.CheckpointInterval, "db-checkpoint-interval", cfg.Database.CheckpointInterval,
+		"how often VACUUM ANALYZE and CHECKPOINT reclaim the space of deleted rows, 0 for POST /admin/checkpoint only")
+	fs.Var((*settingsFlag)(&cfg.Database.Settings), "db-setting",
+		"further DuckDB setting as name=value, repeated or comma separated")
+	fs.IntVar(&cfg.Database.MaxOpenConns, "db-max-open-conns", cfg.Database.MaxOpenConns,
+		"maximum connections to DuckDB, counting the one reserved for inserts, 0 for no limit")
+	fs.IntVar(&cfg.Database.MaxIdleConns, "db-max-idle-conns", cfg.Database.MaxIdleConns,
+		"maximum idle connections kept in the pool, 0 for the default of database/sql")
+	fs.DurationVar(&cfg.Database.ConnMaxLifetime, "db-conn-max-lifetime", cfg.Database.ConnMaxLifetime,
+		"how long a pooled connection is reused before it is reopened, 0 for no limit")
+	fs.DurationVar(&cfg.Database.ConnMaxIdleTime, "db-conn-max-idle-time", cfg.Database.ConnMaxIdleTime,
+		"how long a pooled connection may stay idle before it is closed, 0 for no limit")
+	fs.Var(&listFlag{list: &cfg.Database.Extensions}, "db-extension",
+		"DuckDB extension installed and loaded on start, e.g. spatial for GEOMETRY columns, repeatable")
+
+	fs.IntVar(&cfg.Limits.MaxColumnsPerTable, "max-table-columns", cfg.Limits.MaxColumnsPerTable,
+		"maximum number of columns a table may grow to, 0 to disable")
+	fs.IntVar(&cfg.Limits.MaxNewColumnsPerRequest, "max-new-columns", cfg.Limits.MaxNewColumnsPerRequest,
+		"maximum number of columns a single request may add, 0 to disable")
+	fs.IntVar(&cfg.Limits.MaxCellBytes, "max-cell-bytes", cfg.Limits.MaxCellBytes,
+		"maximum size in bytes of a single string value, 0 to disable")
+	fs.IntVar(&cfg.Limits.MaxRowsPerStatement, "max-statement-rows", cfg.Limits.MaxRowsPerStatement,
+		"maximum number of rows in a single INSERT before a batch is chunked, 0 to disable")
+	fs.IntVar(&cfg.Limits.MaxParamsPerStatement, "max-statement-params", cfg.Limits.MaxParamsPerStatement,
+		"maximum number of bound parameters in a single INSERT before a batch is chunked, 0 to disable")
+
+	fs.Int64Var(&cfg.Query.MemoryLimit, "memory-limit", cfg.Query.MemoryLimit,
+		"maximum memory in bytes DuckDB uses for query execution, 0 for DuckDB's default")
+	fs.DurationVar(&cfg.Query.MaxTimeout, "max-query-timeout", cfg.Query.MaxTimeout,
+		"maximum execution time of a query and its default timeout, 0 to disable")
+	fs.DurationVar(&cfg.Query.CacheTTL, "query-cache-ttl", cfg.Query.CacheTTL,
+		"how long results of read-only queries are cached, 0 to disable")
+	fs.IntVar(&cfg.Query.ResultLimits.MaxRows, "max-result-rows", cfg.Query.ResultLimits.MaxRows,
+		"maximum number of rows a query returns, 0 to disable")
+	fs.IntVar(&cfg.Query.ResultLimits.MaxBytes, "max-response-bytes", cfg.Query.ResultLimits.MaxBytes,
+		"maximum size in bytes of an encoded query result, 0 to disable and stream uncached results")
+	fs.IntVar(&cfg.Query.MaxConcurrent, "max-concurrent-queries", cfg.Query.MaxConcurrent,
+		"maximum number of queries executing at once, 0 to disable")
+	fs.IntVar(&cfg.Query.MaxQueued, "max-queued-queries", cfg.Query.MaxQueued,
+		"maximum number of queries waiting for an execution slot before requests are rejected with 429")
+	fs.Var((*limitsFlag)(&cfg.Query.TagConcurrency), "query-tag-concurrency",
+		"maximum number of queries of a query tag executing at once as tag=n, repeated or comma separated")
+	fs.IntVar(&cfg.Query.History, "query-history", cfg.Query.History,
+		"number of executed queries GET /queries/history remembers, 0 to disable")
+
+	fs.StringVar(&cfg.MacrosFile, "macros-file", cfg.MacrosFile,
+		"file the user-defined macros are kept in across restarts, empty to keep them in memory only")
+	fs.StringVar(&cfg.Webhooks.File, "webhooks-file", cfg.Webhooks.File,
+		"file the schema change webhooks and their secrets are kept in across restarts, empty to keep them in memory only")
+	fs.IntVar(&cfg.Webhooks.MaxAttempts, "webhook-attempts", cfg.Webhooks.MaxAttempts,
+		"how often the delivery of a schema change or an alert to a webhook is tried before it is given up")
+	fs.DurationVar(&cfg.Webhooks.RetryBackoff, "webhook-retry-backoff", cfg.Webhooks.RetryBackoff,
+		"wait before the first retry of a webhook delivery, doubled for each further one")
+	fs.DurationVar(&cfg.Webhooks.Timeout, "webhook-timeout", cfg.Webhooks.Timeout,
+		"maximum time of a webhook delivery attempt, 0 to disable")
+	fs.StringVar(&cfg.ExportDir, "export-dir", cfg.ExportDir,
+		"directory exports to local paths are written to, empty to only allow exports to object stores")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir,
+		"directory backups are kept in, empty to only allow backups to object stores")
+	fs.StringVar(&cfg.DownloadDir, "download-dir", cfg.DownloadDir,
+		"directory the files of resumable downloads of query results are written to, empty to disable them")
+	fs.DurationVar(&cfg.DownloadRetention, "download-retention", cfg.DownloadRetention,
+		"how long a resumable download is kept before its file is removed")
+	fs.StringVar(&cfg.UploadDir, "upload-dir", cfg.UploadDir,
+		"directory the parts of upload sessions for bulk ingest are kept in until they are committed, empty to disable them")
+	fs.DurationVar(&cfg.UploadRetention, "upload-retention", cfg.UploadRetention,
+		"how long an upload session is kept before its parts are removed")
+	fs.DurationVar(&cfg.TieringInterval, "tiering-interval", cfg.TieringInterval,
+		"how often rows past the age of their table's tiering policy move to Parquet, 0 for on demand only")
+	fs.StringVar(&cfg.IngestLog, "ingest-log", cfg.IngestLog,
+		"file every insert is logged to before it is written, for restoring backups to a point in time, empty to disable")
+	fs.DurationVar(&cfg.ChangeFeedRetention, "change-feed-retention", cfg.ChangeFeedRetention,
+		"how long GET /tables/{table}/changes keeps inserts and schema changes, 0 to disable the change feed")
+	fs.DurationVar(&cfg.AuditRetention, "audit-retention", cfg.AuditRetention,
+		"how long the _audit table keeps the queries and ingests of the API, 0 to disable the audit log")
+	fs.StringVar(&cfg.APIKeysFile, "api-keys-file", cfg.APIKeysFile,
+		"file the API keys created through /admin/keys are kept in, hashed, setting it requires API keys")
+	fs.StringVar(&cfg.AdminKey, "admin-key", cfg.AdminKey,
+		"admin API key, setting it requires API keys on every request")
+	fs.StringVar(&cfg.JWT.Issuer, "jwt-issuer", cfg.JWT.Issuer,
+		"issuer of the JWTs accepted besides API keys, setting it requires a key or token on every request")
+	fs.StringVar(&cfg.JWT.JWKSURL, "jwt-jwks-url", cfg.JWT.JWKSURL, "URL of the JSON Web Key Set of the JWT issuer")
+	fs.StringVar(&cfg.JWT.Audience, "jwt-audience", cfg.JWT.Audience, "audience JWTs must be issued for, empty for any")
+	fs.StringVar(&cfg.JWT.ScopeClaim, "jwt-scope-claim", cfg.JWT.ScopeClaim,
+		"claim holding the ingest, query and admin scopes of a JWT, empty for scope")
+	fs.StringVar(&cfg.RowLevelSecurity, "row-level-security", cfg.RowLevelSecurity,
+		"column, e.g. tenant_id, stamped with the tenant of the API key or token on inserts and filtered by on queries")
+	fs.StringVar(&cfg.Follow, "follow", cfg.Follow,
+		"base URL of the leader to replicate as a read-only follower, empty to accept writes")
+	fs.StringVar(&cfg.FollowKey, "follow-key", cfg.FollowKey, "admin API key or token of the leader, if it requires one")
+	fs.DurationVar(&cfg.FollowInterval, "follow-interval", cfg.FollowInterval,
+		"how often a follower polls the change feed of its leader once it has caught up")
+	fs.StringVar(&cfg.Cluster.NodeID, "cluster-node-id", cfg.Cluster.NodeID,
+		"ID of this node among the cluster nodes of the config file, empty to run without a cluster")
+	fs.StringVar(&cfg.Cluster.Dir, "cluster-dir", cfg.Cluster.Dir, "directory the Raft log and snapshots are kept in")
+	fs.Uint64Var(&cfg.Cluster.SnapshotThreshold, "cluster-snapshot-threshold", cfg.Cluster.SnapshotThreshold,
+		"log entries after which a snapshot replaces them, 0 for the Raft default")
+	fs.DurationVar(&cfg.Cluster.SnapshotInterval, "cluster-snapshot-interval", cfg.Cluster.SnapshotInterval,
+		"how often the snapshot threshold is checked, 0 for the Raft default")
+	fs.StringVar(&cfg.SecretsFile, "secrets-file", cfg.SecretsFile,
+		"file the object store secrets are kept in encrypted across restarts, empty to keep them in memory only")
+	fs.StringVar(&cfg.SecretsKey, "secrets-key", cfg.SecretsKey,
+		"base64 encoded AES key of 16, 24 or 32 bytes encrypting the secrets file, prefer setting it by environment")
+	return fs
+}
+
+// settingsFlag collects name=value pairs into a map, from repeated flags or a comma separated list.
+type settingsFlag map[string]string
+
+func (f *settingsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*f))
+	for name, value := range *f {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *settingsFlag) Set(v string) error {
+	if *f == nil {
+		*f = make(settingsFlag)
+	}
+	for _, pair := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("setting must be name=value: %q", pair)
+		}
+		(*f)[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// limitsFlag collects name=n pairs of positive numbers into a map, from repeated flags or a comma separated list.
+type limitsFlag map[string]int
+
+func (f *limitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*f))
+	for name, n := range *f {
+		pairs = append(pairs, name+"="+strconv.Itoa(n))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *limitsFlag) Set(v string) error {
+	if *f == nil {
+		*f = make(limitsFlag)
+	}
+	for _, pair := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || name == "" || err != nil || n <= 0 {
+			return fmt.Errorf("limit must be name=n with a positive n: %q", pair)
+		}
+		(*f)[strings.TrimSpace(name)] = n
+	}
+	return nil
+}
+
+// listValue is a list setting collected from repeated flags. The first value of the environment or of the flags
+// replaces the list of the sources before rather than adding to it, Load calls newSource between them.
+type listValue interface {
+	newSource()
+}
+
+// listFlag collects values into a list, from repeated flags or a comma separated list, see listValue.
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f == nil || f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f *listFlag) Set(v string) error {
+	if !f.set {
+		*f.list, f.set = nil, true
+	}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+func (f *listFlag) newSource() {
+	f.set = false
+}
+
+// listenerFlag collects the listeners of comma separated address=surface items, see internal.ParseListener and
+// listValue.
+type listenerFlag struct {
+	list *[]internal.Listener
+	set  bool
+}
+
+func (f *listenerFlag) String() string {
+	if f == nil || f.list == nil {
+		return ""
+	}
+	items := make([]string, len(*f.list))
+	for i, l := range *f.list {
+		items[i] = l.Addr
+		if l.Surface != "" {
+			items[i] += "=" + string(l.Surface)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (f *listenerFlag) Set(v string) error {
+	if !f.set {
+		*f.list, f.set = nil, true
+	}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		l, err := internal.ParseListener(item)
+		if err != nil {
+			return err
+		}
+		*f.list = append(*f.list, l)
+	}
+	return nil
+}
+
+func (f *listenerFlag) newSource() {
+	f.set = false
+}
@@ -0,0 +1,93 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"scratch/internal"
+	"scratch/internal/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scratch.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+server:
+  addr: ":9000"
+  read_header_timeout: 5s
+database:
+  path: file.db
+  threads: 2
+limits:
+  max_cell_bytes: 10
+`), 0o600))
+	t.Setenv("SCRATCH_DB_THREADS", "4")
+	t.Setenv("SCRATCH_MAX_CELL_BYTES", "20")
+
+	cfg, err := config.Load([]string{"-config", file, "-max-cell-bytes", "30"})
+	require.NoError(t, err)
+	assert.Equal(t, ":9000", cfg.Server.Addr)
+	assert.Equal(t, 5*time.Second, cfg.Server.ReadHeaderTimeout)
+	assert.Equal(t, "file.db", cfg.Database.Path)
+	assert.Equal(t, 4, cfg.Database.Threads)
+	assert.Equal(t, 30, cfg.Limits.MaxCellBytes)
+	assert.Equal(t, config.Default().Limits.MaxColumnsPerTable, cfg.Limits.MaxColumnsPerTable)
+}
+
+func TestLoadDeprecatedEnv(t *testing.T) {
+	t.Setenv("DUCKDB_PATH", "old.db")
+	t.Setenv("DUCKDB_READ_ONLY", "true")
+	t.Setenv("DUCKDB_THREADS", "2")
+	t.Setenv("SCRATCH_DB_THREADS", "4")
+
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "old.db", cfg.Database.Path)
+	assert.True(t, cfg.Database.ReadOnly)
+	assert.Equal(t, 4, cfg.Database.Threads)
+}
+
+func TestLoadListPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scratch.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+server:
+  listeners:
+    - addr: ":9000"
+    - addr: ":9001"
+      surface: admin
+  cors:
+    allowed_origins: [https://old.example.com]
+database:
+  extensions: [spatial]
+`), 0o600))
+	t.Setenv("SCRATCH_CORS_ORIGIN", "https://a.example.com,https://b.example.com")
+	t.Setenv("SCRATCH_LISTEN", ":9100")
+
+	// The environment replaces the lists of the file and the flags replace those of the environment, repeated flags
+	// add to each other.
+	cfg, err := config.Load([]string{"-config", file, "-listen", ":9200=public", "-listen", ":9201=admin"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, cfg.Server.CORS.AllowedOrigins)
+	assert.Equal(t, []internal.Listener{
+		{Addr: ":9200", Surface: internal.SurfacePublic}, {Addr: ":9201", Surface: internal.SurfaceAdmin},
+	}, cfg.Server.Listeners)
+	assert.Equal(t, []string{"spatial"}, cfg.Database.Extensions)
+
+	t.Setenv("SCRATCH_CORS_ORIGIN", "")
+	cfg, err = config.Load([]string{"-config", file, "-db-extension", "json"})
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Server.CORS.AllowedOrigins)
+	assert.Equal(t, []internal.Listener{{Addr: ":9100"}}, cfg.Server.Listeners)
+	assert.Equal(t, []string{"json"}, cfg.Database.Extensions)
+}
+
+func TestLoadRefusesUnknownKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scratch.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("server:\n  adr: \":9000\"\n"), 0o600))
+
+	_, err := config.Load([]string{"-config", file})
+	require.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CopyTableRequest is the body of POST /tables/{table}/copy. Query, if set, is a single read statement whose result
+// is copied instead of the whole table.
+type CopyTableRequest struct {
+	Name   string `json:"name"`
+	Query  string `json:"query,omitempty"`
+	Params []any  `json:"params,omitempty"`
+}
+
+type CopyTableResponse struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// CopyTable creates the table named in the request from the rows of the table or the result of the query of the
+// request. The copy has the columns and types of its source but none of its constraints, defaults or indexes. The
+// source is read like a query of the caller, through its table access, row-level security, masks and the SQL policy.
+func (s *Store) CopyTable(ctx context.Context, table string, req CopyTableRequest) (*CopyTableResponse, error) {
+	if !tableNameRegex.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid table name %q: must match %s", req.Name, tableNameRegex)
+	}
+	if strings.EqualFold(req.Name, MigrationsTable) {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, req.Name)
+	}
+	stmt := &QueryStatement{Query: req.Query, Params: req.Params}
+	if req.Query == "" {
+		if _, err := s.existingColumns(ctx, table); err != nil {
+			return nil, err
+		}
+		stmt.Query = "SELECT * FROM " + quoteIdent(table)
+	}
+	if _, err := stmt.singleRead(); err != nil {
+		return nil, err
+	}
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	query, err := stmt.singleRead()
+	if err != nil {
+		return nil, err
+	}
+	cols, err := s.tableColumns(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, req.Name)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err = s.db.ExecContext(
+		ctx, fmt.Sprintf("CREATE TABLE %s AS\n%s", quoteIdent(req.Name), query), stmt.Params...,
+	); err != nil {
+		return nil, fmt.Errorf("copy table: %w", err)
+	}
+	out := &CopyTableResponse{Table: req.Name}
+	if err = s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteIdent(req.Name)).Scan(&out.Rows); err != nil {
+		return nil, fmt.Errorf("copy table: counting rows: %w", err)
+	}
+	return out, nil
+}
+
+// HandleCopyTable copies the table in the path, or the result of the query in the body, into a new table.
+func (s *Server) HandleCopyTable(w http.ResponseWriter, r *http.Request) {
+	var req CopyTableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle copy table: decoding request body", err)
+		return
+	}
+	res, err := s.store.CopyTable(r.Context(), r.PathValue("table"), req)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle copy table", err)
+	case errors.Is(err, ErrTableExists):
+		s.writeError(w, http.StatusConflict, "handle copy table", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusCreated, "handle copy table: writing response", res)
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browsers call the API from the pages of other origins, e.g. dashboards querying /query directly.
+type CORS struct {
+	// AllowedOrigins are the origins allowed, e.g. https://dash.example.com, or * for any. Empty disables CORS.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowedMethods default to GET, HEAD, POST, PUT and DELETE.
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// AllowedHeaders default to Authorization, Content-Type, Cache-Control, If-None-Match and the session header.
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// AllowCredentials lets requests carry cookies and TLS client certificates. A wildcard origin is answered with the
+	// origin of the request then, as browsers refuse credentials for *.
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAge is how long browsers cache the result of a preflight request, zero for their default.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+var (
+	defaultCORSMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete,
+	}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Cache-Control", "If-None-Match", SessionHeader}
+	// corsExposedHeaders are the response headers of the API scripts read.
+	corsExposedHeaders = []string{
+		"ETag", "Retry-After", CacheStatusHeader, ColumnTypesHeader, NextCursorHeader, RequestIDHeader,
+		SessionHeader, TruncatedHeader, WriteQueueDepthHeader,
+	}
+)
+
+// WithCORS answers the requests of the allowed origins with CORS headers and handles preflight requests.
+func WithCORS(cors CORS) ServerOption {
+	return func(s *Server) {
+		if len(cors.AllowedMethods) == 0 {
+			cors.AllowedMethods = defaultCORSMethods
+		}
+		if len(cors.AllowedHeaders) == 0 {
+			cors.AllowedHeaders = defaultCORSHeaders
+		}
+		s.cors = &cors
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for the origin, false if it isn't allowed.
+func (c *CORS) allowOrigin(origin string) (string, bool) {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		if c.AllowCredentials {
+			return origin, true
+		}
+		return "*", true
+	}
+	if slices.ContainsFunc(c.AllowedOrigins, func(allowed string) bool { return strings.EqualFold(allowed, origin) }) {
+		return origin, true
+	}
+	return "", false
+}
+
+// handleCORS wraps next with the CORS headers. Preflight requests are answered before authentication, as browsers
+// send them without credentials.
+func (s *Server) handleCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		allowed, ok := s.cors.allowOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if ok {
+			header.Set("Access-Control-Allow-Origin", allowed)
+			if s.cors.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !preflight {
+			if ok {
+				header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A refused preflight lacks the allow headers, which makes the browser refuse the request.
+		if ok {
+			header.Set("Access-Control-Allow-Methods", strings.Join(s.cors.AllowedMethods, ", "))
+			header.Set("Access-Control-Allow-Headers", strings.Join(s.cors.AllowedHeaders, ", "))
+			if s.cors.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
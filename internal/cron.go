@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// cronSearchYears bounds the search for the next run, so expressions that never match, e.g. 0 0 30 2 *, terminate.
+const cronSearchYears = 5
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of month, month and day of week. Fields
+// accept *, values, ranges a-b, lists a,b and steps */n or a-b/n. Day of week runs from 0 (Sunday) to 7 (Sunday). The
+// descriptors @hourly, @daily, @weekly, @monthly and @yearly are accepted as shorthands.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record an unrestricted day field. As in cron, a day matches either field when both are
+	// restricted.
+	domAny, dowAny bool
+}
+
+//nolint:gochecknoglobals // Read-only table of descriptors.
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	if desc, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = desc
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields, got %d: %q", ErrInvalidSchedule, len(fields), expr)
+	}
+	var (
+		c   CronSchedule
+		err error
+	)
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the set of matching values as a bitmask.
+func parseCronField(field string, low, high int) (uint64, error) {
+	var out uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if before, after, ok := strings.Cut(part, "/"); ok {
+			rng = before
+			var err error
+			if step, err = strconv.Atoi(after); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%w: step %q", ErrInvalidSchedule, part)
+			}
+		}
+		start, end := low, high
+		if rng != "*" {
+			var err error
+			first, last, isRange := strings.Cut(rng, "-")
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("%w: value %q", ErrInvalidSchedule, part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("%w: value %q", ErrInvalidSchedule, part)
+				}
+			} else if step > 1 {
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return 0, fmt.Errorf("%w: %q out of range %d-%d", ErrInvalidSchedule, part, low, high)
+		}
+		for v := start; v <= end; v += step {
+			out |= 1 << v
+		}
+	}
+	return out, nil
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first time after t that matches the schedule, or the zero time if there is none within the next
+// years.
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + cronSearchYears
+	for t.Year() <= limit {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,40 @@
+package internal_test
+
+import (
+	"scratch/internal"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC)
+	for _, test := range []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "* * * * *", want: time.Date(2024, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{expr: "0 * * * *", want: time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{expr: "@hourly", want: time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{expr: "*/15 * * * *", want: time.Date(2024, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{expr: "5,35 9-17 * * *", want: time.Date(2024, time.January, 31, 10, 35, 0, 0, time.UTC)},
+		{expr: "0 0 * * *", want: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 6 29 2 *", want: time.Date(2024, time.February, 29, 6, 0, 0, 0, time.UTC)},
+		{expr: "0 0 * * 0", want: time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 * * 7", want: time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1-5 * 1-5", want: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 15 * 6", want: time.Date(2024, time.February, 3, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 30 2 *", want: time.Time{}},
+	} {
+		c, err := internal.ParseCron(test.expr)
+		require.NoError(t, err, test.expr)
+		assert.Equal(t, test.want, c.Next(from), test.expr)
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		_, err := internal.ParseCron(expr)
+		assert.ErrorIs(t, err, internal.ErrInvalidSchedule, expr)
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// csvRows writes the rows with a header row. NULL is written as an empty field.
+type csvRows struct {
+	w      *csv.Writer
+	cols   []Column
+	record []string
+}
+
+func (c *csvRows) begin(cols []Column) error {
+	c.cols, c.record = cols, make([]string, len(cols))
+	for i, col := range cols {
+		c.record[i] = col.Name
+	}
+	if err := c.w.Write(c.record); err != nil {
+		return fmt.Errorf("writing csv header: %w", err)
+	}
+	return nil
+}
+
+func (c *csvRows) row(row map[string]any) error {
+	for i, col := range c.cols {
+		c.record[i] = formatCSVValue(row[col.Name])
+	}
+	if err := c.w.Write(c.record); err != nil {
+		return fmt.Errorf("writing csv record: %w", err)
+	}
+	return nil
+}
+
+func (c *csvRows) end(*QueryResult, int) error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return fmt.Errorf("flushing csv: %w", err)
+	}
+	return nil
+}
+
+func formatCSVValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'g', -1, 32)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case Decimal:
+		return val.String()
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// formatDecimal renders the decimal exactly, without the float conversion of Decimal.Float64.
+func formatDecimal(d duckdb.Decimal) string {
+	if d.Value == nil {
+		return ""
+	}
+	digits := new(big.Int).Abs(d.Value).String()
+	sign := ""
+	if d.Value.Sign() < 0 {
+		sign = "-"
+	}
+	if d.Scale == 0 {
+		return sign + digits
+	}
+	scale := int(d.Scale)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
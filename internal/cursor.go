@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// queryCursor is the decoded form of the opaque cursor handed to clients. The hash ties it to the query it was issued
+// for, so a cursor can't be replayed against a different statement.
+type queryCursor struct {
+	Offset int    `json:"o"`
+	Limit  int    `json:"l"`
+	Hash   string `json:"h"`
+}
+
+func (c *queryCursor) encode() string {
+	out, err := json.Marshal(c)
+	if err != nil {
+		// Only ints and strings, marshalling can't fail.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func decodeCursor(in string) (*queryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(in)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	var c queryCursor
+	if err = json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCursor, err)
+	}
+	if c.Offset < 0 || c.Limit <= 0 {
+		return nil, fmt.Errorf("%w: out of range", ErrInvalidCursor)
+	}
+	return &c, nil
+}
+
+// queryHash identifies the query and its parameters.
+func queryHash(query string, params []any) string {
+	h := sha256.New()
+	h.Write([]byte(query))
+	if len(params) > 0 {
+		p, err := json.Marshal(params)
+		if err == nil {
+			h.Write(p)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// page resolves the limit and offset of the statement from its Limit and Cursor and wraps the query accordingly. One
+// row beyond the limit is requested to detect whether there is a next page.
+func (s *QueryStatement) page() (string, []any, *queryCursor, error) {
+	if s.Limit <= 0 && s.Cursor == "" {
+		return s.Query, s.Params, nil, nil
+	}
+	hash := queryHash(s.Query, s.Params)
+	cursor := &queryCursor{Limit: s.Limit, Hash: hash}
+	if s.Cursor != "" {
+		decoded, err := decodeCursor(s.Cursor)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if decoded.Hash != hash {
+			return "", nil, nil, fmt.Errorf("%w: issued for a different query", ErrInvalidCursor)
+		}
+		cursor.Offset = decoded.Offset
+		if cursor.Limit <= 0 {
+			cursor.Limit = decoded.Limit
+		}
+	}
+
+	query, err := s.singleRead()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return fmt.Sprintf(
+		"SELECT * FROM (\n%s\n) LIMIT %d OFFSET %d",
+		query,
+		cursor.Limit+1,
+		cursor.Offset,
+	), s.Params, cursor, nil
+}
+
+// singleRead returns the text of the query if it consists of a single read statement, which is required wherever the
+// query is wrapped into another statement.
+func (s *QueryStatement) singleRead() (string, error) {
+	stmts, err := ClassifySQL(s.Query)
+	if err != nil {
+		return "", err
+	}
+	if len(stmts) != 1 || stmts[0].Class != StatementRead {
+		return "", errors.New("invalid QueryStatement: expected a single read statement")
+	}
+	return stmts[0].Text, nil
+}
+
+// limited returns the single read statement of the query wrapped with its Limit, for outputs that don't issue cursors.
+func (s *QueryStatement) limited() (string, error) {
+	if s.Cursor != "" {
+		return "", errors.New("invalid QueryStatement: cursor is not supported for this format")
+	}
+	query, err := s.singleRead()
+	if err != nil {
+		return "", err
+	}
+	if s.Limit > 0 {
+		query = fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d", query, s.Limit)
+	}
+	return query, nil
+}
+
+// cursorAfter returns the cursor that continues the statement after n rows of its current page.
+func (s *QueryStatement) cursorAfter(n int) (string, error) {
+	cursor := &queryCursor{Limit: s.Limit, Hash: queryHash(s.Query, s.Params)}
+	if s.Cursor != "" {
+		decoded, err := decodeCursor(s.Cursor)
+		if err != nil {
+			return "", err
+		}
+		cursor.Offset = decoded.Offset
+		if cursor.Limit <= 0 {
+			cursor.Limit = decoded.Limit
+		}
+	}
+	cursor.Offset += n
+	return cursor.encode(), nil
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// DatabaseConfig selects where DuckDB keeps its data. The zero value is an in-memory database, which is lost when the
+// process exits.
+type DatabaseConfig struct {
+	// Path is the DuckDB database file, created if it doesn't exist. Empty keeps the database in memory.
+	Path string `yaml:"path"`
+	// ReadOnly opens the file without write access, so several processes can share it. Every write fails.
+	ReadOnly bool `yaml:"read_only"`
+	// Threads caps the threads DuckDB uses for query execution, zero for DuckDB's default of one per core.
+	Threads int `yaml:"threads"`
+	// TempDirectory is where DuckDB spills to disk when a query exceeds the memory limit. Empty for DuckDB's default
+	// next to the database file, in-memory databases don't spill.
+	TempDirectory string `yaml:"temp_directory"`
+	// CheckpointThreshold is the size of the write-ahead log, e.g. 16MB, at which DuckDB checkpoints automatically.
+	CheckpointThreshold string `yaml:"checkpoint_threshold"`
+	// CheckpointInterval runs VACUUM ANALYZE and CHECKPOINT periodically, zero for on demand only.
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+	// Settings are further DuckDB settings by name, e.g. default_order: desc. They apply to every connection, a
+	// session can override them for its own connection with SET SESSION.
+	Settings map[string]string `yaml:"settings"`
+	// MaxOpenConns bounds the connections of the pool, counting the one reserved for inserts, zero for no bound. The
+	// remaining settings tune the pool like their database/sql counterparts, zero keeps the defaults of database/sql.
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// Extensions are installed and loaded on open, e.g. spatial for GEOMETRY columns. Installing needs network access
+	// unless the extension is present in the local extension directory already.
+	Extensions []string `yaml:"extensions"`
+}
+
+var settingNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// WithDatabase opens the database described by the config instead of an in-memory one.
+func WithDatabase(cfg DatabaseConfig) StoreOption {
+	return func(s *Store) {
+		s.database = cfg
+	}
+}
+
+func (c DatabaseConfig) valid() error {
+	if c.ReadOnly && c.Path == "" {
+		return errors.New("invalid database config: an in-memory database can't be read-only")
+	}
+	if c.Threads < 0 {
+		return fmt.Errorf("invalid database config: threads must not be negative: %d", c.Threads)
+	}
+	if c.MaxOpenConns == 1 || c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 ||
+		c.ConnMaxIdleTime < 0 {
+		return errors.New(
+			"invalid database config: the pool settings must not be negative and max_open_conns must leave a " +
+				"connection for queries besides the one for inserts")
+	}
+	for _, ext := range c.Extensions {
+		if !settingNameRegex.MatchString(ext) {
+			return fmt.Errorf("invalid database config: extension name: %q", ext)
+		}
+	}
+	for name := range c.Settings {
+		if !settingNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid database config: setting name: %q", name)
+		}
+		if name == "access_mode" {
+			return errors.New("invalid database config: access_mode is set by read_only")
+		}
+	}
+	return nil
+}
+
+// fileDatabase is the name a database file is attached as when its path can't be opened directly, see attached.
+const fileDatabase = "scratch"
+
+// memoryDatabase is the in-memory database attached next to a database file, holding the tables placed in memory.
+const memoryDatabase = "ephemeral"
+
+// ownCatalogs is the list of the databases of the store for catalog queries, which leaves out attached external
+// databases.
+const ownCatalogs = "(current_database(), '" + memoryDatabase + "')"
+
+// attached reports whether the database file is attached to an in-memory database rather than opened by the data
+// source name, which go-duckdb cuts at the first question mark of the path.
+func (c DatabaseConfig) attached() bool {
+	return strings.Contains(c.Path, "?")
+}
+
+// walPath returns the write-ahead log of the database file. DuckDB inserts the suffix before the first question mark
+// of the path, if any.
+func (c DatabaseConfig) walPath() string {
+	if i := strings.Index(c.Path, "?"); i >= 0 {
+		return c.Path[:i] + ".wal" + c.Path[i:]
+	}
+	return c.Path + ".wal"
+}
+
+// open returns the pool of the database. Every connection of the pool attaches the in-memory database next to a
+// writable database file and resolves table names in both, DuckDB refuses to attach it to a read-only one. A file
+// whose path doesn't fit in the data source name is attached to an in-memory database as well.
+func (c DatabaseConfig) open() (*sql.DB, error) {
+	var stmts []string
+	if c.attached() {
+		options := ""
+		if c.ReadOnly {
+			options = " (READ_ONLY)"
+		}
+		stmts = append(stmts,
+			fmt.Sprintf("ATTACH IF NOT EXISTS %s AS %s%s", quoteLiteral(c.Path), fileDatabase, options),
+			"USE "+fileDatabase,
+		)
+	}
+	if c.Path != "" && !c.ReadOnly {
+		stmts = append(stmts,
+			"ATTACH IF NOT EXISTS ':memory:' AS "+memoryDatabase,
+			"SET search_path = 'main,"+memoryDatabase+".main'",
+		)
+	}
+	if len(stmts) == 0 {
+		return sql.Open("duckdb", c.dsn())
+	}
+	connector, err := duckdb.NewConnector(c.dsn(), func(execer driver.ExecerContext) error {
+		for _, stmt := range stmts {
+			if _, err := execer.ExecContext(context.Background(), stmt, nil); err != nil {
+				return fmt.Errorf("initializing connection: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// loadExtensions installs and loads the extensions, which DuckDB then provides to every connection of the database.
+func (c DatabaseConfig) loadExtensions(ctx context.Context, db *sql.DB) error {
+	for _, ext := range c.Extensions {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("INSTALL %s; LOAD %s", ext, ext)); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrExtensionUnavailable, ext, err)
+		}
+	}
+	return nil
+}
+
+// tune applies the pool settings to the pool.
+func (c DatabaseConfig) tune(db *sql.DB) {
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+	if c.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
+}
+
+// dsn returns the data source name go-duckdb opens the database with. For an attached file it is the in-memory
+// database the file is attached to, spilling next to the file like DuckDB does for the files it opens.
+func (c DatabaseConfig) dsn() string {
+	params := url.Values{}
+	path := c.Path
+	switch {
+	case c.attached():
+		path = ""
+		params.Set("temp_directory", c.Path+".tmp")
+	case c.ReadOnly:
+		params.Set("access_mode", "READ_ONLY")
+	default:
+		params.Set("access_mode", "READ_WRITE")
+	}
+	for name, value := range c.Settings {
+		params.Set(name, value)
+	}
+	if c.Threads > 0 {
+		params.Set("threads", strconv.Itoa(c.Threads))
+	}
+	if c.TempDirectory != "" {
+		params.Set("temp_directory", c.TempDirectory)
+	}
+	if c.CheckpointThreshold != "" {
+		params.Set("checkpoint_threshold", c.CheckpointThreshold)
+	}
+	return path + "?" + params.Encode()
+}
+
+// Setting is a DuckDB setting as in effect for the connections of the pool.
+type Setting struct {
+	Name        string `json:"name"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+	InputType   string `json:"input_type"`
+}
+
+// Settings returns the effective DuckDB settings, sorted by name.
+func (s *Store) Settings(ctx context.Context) ([]Setting, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT name, value, description, input_type FROM duckdb_settings() ORDER BY name",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing settings: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var out []Setting
+	for rows.Next() {
+		var (
+			setting Setting
+			value   sql.NullString
+		)
+		if err = rows.Scan(&setting.Name, &value, &setting.Description, &setting.InputType); err != nil {
+			return nil, fmt.Errorf("scanning setting: %w", err)
+		}
+		setting.Value = value.String
+		out = append(out, setting)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing settings: %w", err)
+	}
+	return out, nil
+}
+
+// HandleListSettings responds with the effective DuckDB settings.
+func (s *Server) HandleListSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := s.store.Settings(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle list settings", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle list settings: writing response", settings)
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// startTime is when the process started, for the uptime of the runtime stats.
+//
+//nolint:gochecknoglobals // Set once on startup.
+var startTime = time.Now()
+
+// WithDebugEndpoints exposes net/http/pprof under /admin/debug/pprof/, the expvar variables under /admin/debug/vars
+// and RuntimeStats under /admin/debug/runtime. Like every admin endpoint they require an admin key or token, on
+// servers without authentication they are open to anyone reaching the server. CPU profiles and traces take their
+// seconds parameter to answer, which the write timeout of the server has to allow.
+func WithDebugEndpoints() ServerOption {
+	return func(s *Server) {
+		s.debug = true
+	}
+}
+
+// handleDebug registers the debug endpoints on the mux.
+func (s *Server) handleDebug(m *routeMux) {
+	// The pprof index resolves the profiles by their path below /debug/pprof/.
+	index := http.StripPrefix("/admin", http.HandlerFunc(pprof.Index))
+	m.Handle("GET /admin/debug/pprof/", index)
+	m.HandleFunc("GET /admin/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("GET /admin/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("GET /admin/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("POST /admin/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("GET /admin/debug/pprof/trace", pprof.Trace)
+	m.Handle("GET /admin/debug/vars", expvar.Handler())
+	m.HandleFunc("GET /admin/debug/runtime", s.HandleRuntimeStats)
+}
+
+// RuntimeStats is the body of GET /admin/debug/runtime.
+type RuntimeStats struct {
+	GoVersion  string `json:"go_version"`
+	UptimeMS   int64  `json:"uptime_ms"`
+	NumCPU     int    `json:"num_cpu"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	Goroutines int    `json:"goroutines"`
+	// HeapAlloc are the bytes of the live and not yet collected heap objects, HeapSys the heap memory obtained from the
+	// OS and Sys all memory obtained from it. DuckDB allocates outside the Go heap, see GET /admin/settings for its
+	// memory limit.
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapSys     uint64 `json:"heap_sys"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Sys         uint64 `json:"sys"`
+	NumGC       uint32 `json:"num_gc"`
+	// LastGC is zero before the first collection.
+	LastGC       time.Time `json:"last_gc"`
+	PauseTotalMS float64   `json:"gc_pause_total_ms"`
+}
+
+// HandleRuntimeStats reports the goroutines, heap and garbage collection of the process. Reading them briefly stops
+// the world.
+func (s *Server) HandleRuntimeStats(w http.ResponseWriter, _ *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		GoVersion:    runtime.Version(),
+		UptimeMS:     time.Since(startTime).Milliseconds(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapSys:      mem.HeapSys,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalMS: float64(mem.PauseTotalNs) / float64(time.Millisecond),
+	}
+	if mem.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC)).UTC()
+	}
+	s.writeJSON(w, http.StatusOK, "handle runtime stats: writing response", stats)
+}
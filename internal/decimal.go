@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// maxDecimalPrecision is the largest precision of a DuckDB DECIMAL.
+const maxDecimalPrecision = 38
+
+// decimalStringRegex matches the strings inferred as DECIMAL in tables with DecimalStrings, e.g. "-12.30". Strings
+// without a fraction, like zip codes, stay VARCHAR.
+var decimalStringRegex = regexp.MustCompile(`^-?(\d+)\.(\d+)$`)
+
+// Decimal is a scanned DECIMAL value. Unlike duckdb.Decimal, which marshals its fields, it marshals to JSON as the
+// exact number, so monetary values survive the round trip through the query endpoints.
+type Decimal duckdb.Decimal
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if d.Value == nil {
+		return []byte("null"), nil
+	}
+	return []byte(formatDecimal(duckdb.Decimal(d))), nil
+}
+
+func (d Decimal) String() string {
+	return formatDecimal(duckdb.Decimal(d))
+}
+
+// scannedValue returns the value scanned from the driver as the query results hold it.
+func scannedValue(v any) any {
+	if d, ok := v.(duckdb.Decimal); ok {
+		return Decimal(d)
+	}
+	return v
+}
+
+// isDecimalType reports whether the DuckDB type name is DECIMAL, bare or as DECIMAL(p,s) with a valid precision and
+// scale.
+func isDecimalType(name string) bool {
+	name = strings.ToUpper(strings.ReplaceAll(name, " ", ""))
+	if name == "DECIMAL" {
+		return true
+	}
+	m := decimalTypeRegex.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	precision, _ := strconv.Atoi(m[1])
+	scale, _ := strconv.Atoi(m[2])
+	return precision >= 1 && precision <= maxDecimalPrecision && scale <= precision
+}
+
+// decimalType returns the DECIMAL type holding every value of the column without rounding, false unless all of its
+// non-null values are decimal strings. The precision is 18, which DuckDB stores in 8 bytes, when it suffices.
+func (s *InsertStatement) decimalType(name string) (string, bool) {
+	var digits, scale int
+	for _, row := range s.rows() {
+		v, ok := row[name]
+		if !ok || v == nil {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			return "", false
+		}
+		m := decimalStringRegex.FindStringSubmatch(str)
+		if m == nil {
+			return "", false
+		}
+		digits, scale = max(digits, len(strings.TrimLeft(m[1], "0"))), max(scale, len(m[2]))
+	}
+	precision := digits + scale
+	switch {
+	case scale == 0, precision > maxDecimalPrecision:
+		return "", false
+	case precision <= 18:
+		precision = 18
+	default:
+		precision = maxDecimalPrecision
+	}
+	return fmt.Sprintf("DECIMAL(%d,%d)", precision, scale), true
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeltaMode is how a Delta export changes the Delta table.
+type DeltaMode string
+
+const (
+	// DeltaAppend adds the exported rows as a new version.
+	DeltaAppend DeltaMode = "append"
+	// DeltaOverwrite replaces the rows of the Delta table with the exported rows in a new version.
+	DeltaOverwrite DeltaMode = "overwrite"
+)
+
+// DeltaExportRequest is the body of POST /tables/{table}/export/delta.
+type DeltaExportRequest struct {
+	// URL is the directory of the Delta table, e.g. s3://lake/events. A path without scheme is relative to the export
+	// directory of the server.
+	URL string `json:"url"`
+	// Filters select the exported rows, in the form of the filter parameter of GET /tables/{table}/rows.
+	Filters []string  `json:"filters,omitempty"`
+	Mode    DeltaMode `json:"mode,omitempty"`
+}
+
+// DeltaCommit is the version of the Delta table an export committed.
+type DeltaCommit struct {
+	Table   string `json:"table"`
+	Version int64  `json:"version"`
+	Rows    int64  `json:"rows"`
+	// File is the data file of the version, relative to the Delta table.
+	File string `json:"file"`
+	// Removed are the data files the version removed from the Delta table on overwrite.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// deltaTypes maps the DuckDB types to the primitive types of the Delta schema. Other types can't be exported.
+var deltaTypes = map[string]string{
+	"VARCHAR":                  "string",
+	"BOOLEAN":                  "boolean",
+	"TINYINT":                  "byte",
+	"SMALLINT":                 "short",
+	"INTEGER":                  "integer",
+	"BIGINT":                   "long",
+	"FLOAT":                    "float",
+	"DOUBLE":                   "double",
+	"DATE":                     "date",
+	"TIMESTAMP":                "timestamp",
+	"TIMESTAMP WITH TIME ZONE": "timestamp",
+	"BLOB":                     "binary",
+}
+
+var decimalTypeRegex = regexp.MustCompile(`^DECIMAL\((\d+),(\d+)\)$`)
+
+var deltaLogFileRegex = regexp.MustCompile(`^(\d{20})\.json$`)
+
+// deltaSchema returns the schema string of the Delta metadata of the columns.
+func deltaSchema(cols []ColumnInfo) (string, error) {
+	type field struct {
+		Name     string         `json:"name"`
+		Type     string         `json:"type"`
+		Nullable bool           `json:"nullable"`
+		Metadata map[string]any `json:"metadata"`
+	}
+	fields := make([]field, 0, len(cols))
+	for _, col := range cols {
+		dataType, ok := deltaTypes[strings.ToUpper(col.Type)]
+		if m := decimalTypeRegex.FindStringSubmatch(col.Type); m != nil {
+			dataType, ok = fmt.Sprintf("decimal(%s,%s)", m[1], m[2]), true
+		}
+		if !ok {
+			return "", fmt.Errorf("%w: column %s has type %s, which Delta doesn't support", ErrInvalidExport,
+				col.Name, col.Type)
+		}
+		fields = append(fields, field{Name: col.Name, Type: dataType, Nullable: col.Nullable, Metadata: map[string]any{}})
+	}
+	out, err := json.Marshal(map[string]any{"type": "struct", "fields": fields})
+	if err != nil {
+		return "", fmt.Errorf("encoding delta schema: %w", err)
+	}
+	return string(out), nil
+}
+
+// deltaTableID derives the id of the Delta table from its location, so every version carries the same id without
+// storing it.
+func deltaTableID(dest string) string {
+	sum := sha256.Sum256([]byte(dest))
+	id := hex.EncodeToString(sum[:16])
+	return id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+}
+
+// ExportDelta exports the rows of the table matching the filters of the request as a new version of the Delta table
+// at the URL, creating the Delta table on first use. Every version carries the metadata with the current schema of
+// the table. The writes to a Delta table are not coordinated, only one server may export to it.
+func (s *Store) ExportDelta(ctx context.Context, table string, req DeltaExportRequest) (*DeltaCommit, error) {
+	if req.Mode == "" {
+		req.Mode = DeltaAppend
+	}
+	if req.Mode != DeltaAppend && req.Mode != DeltaOverwrite {
+		return nil, fmt.Errorf("%w: mode must be %s or %s", ErrInvalidExport, DeltaAppend, DeltaOverwrite)
+	}
+	schema, err := s.TableSchema(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	schemaString, err := deltaSchema(schema.Columns)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	where, params, err := whereClause(cols, req.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+	dest, local, err := s.exportDestination(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	dest = strings.TrimSuffix(dest, "/")
+
+	s.deltaLock.Lock()
+	defer s.deltaLock.Unlock()
+	logFiles, err := s.globFiles(ctx, dest+"/_delta_log/*.json")
+	if err != nil {
+		return nil, err
+	}
+	version := int64(0)
+	for _, f := range logFiles {
+		if m := deltaLogFileRegex.FindStringSubmatch(path.Base(filepath.ToSlash(f))); m != nil {
+			v, _ := strconv.ParseInt(m[1], 10, 64)
+			version = max(version, v+1)
+		}
+	}
+	var removed []string
+	if req.Mode == DeltaOverwrite && version > 0 {
+		// Every data file in the directory was added by an earlier version, removing one that a version before
+		// already removed is harmless.
+		files, globErr := s.globFiles(ctx, dest+"/*.parquet")
+		if globErr != nil {
+			return nil, globErr
+		}
+		for _, f := range files {
+			removed = append(removed, path.Base(filepath.ToSlash(f)))
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	file := "part-" + id + ".parquet"
+	manifest, err := s.copyToFiles(
+		ctx,
+		table,
+		fmt.Sprintf("SELECT * FROM %s%s", quoteIdent(table), where),
+		params,
+		exportTarget{dest: dest + "/" + file, local: local, options: "FORMAT PARQUET, COMPRESSION snappy"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if err = s.db.QueryRowContext(ctx, "SELECT size FROM read_blob(?)", dest+"/"+file).Scan(&size); err != nil {
+		return nil, fmt.Errorf("export: reading size of %s: %w", file, err)
+	}
+
+	now := time.Now().UnixMilli()
+	mode := map[DeltaMode]string{DeltaAppend: "Append", DeltaOverwrite: "Overwrite"}[req.Mode]
+	actions := []map[string]any{
+		{"commitInfo": map[string]any{
+			"timestamp":           now,
+			"operation":           "WRITE",
+			"operationParameters": map[string]any{"mode": mode},
+		}},
+	}
+	if version == 0 {
+		actions = append(actions, map[string]any{
+			"protocol": map[string]any{"minReaderVersion": 1, "minWriterVersion": 2},
+		})
+	}
+	actions = append(actions, map[string]any{"metaData": map[string]any{
+		"id":               deltaTableID(dest),
+		"format":           map[string]any{"provider": "parquet", "options": map[string]any{}},
+		"schemaString":     schemaString,
+		"partitionColumns": []string{},
+		"configuration":    map[string]any{},
+		"createdTime":      now,
+	}})
+	for _, f := range removed {
+		actions = append(actions, map[string]any{"remove": map[string]any{
+			"path":              f,
+			"deletionTimestamp": now,
+			"dataChange":        true,
+		}})
+	}
+	actions = append(actions, map[string]any{"add": map[string]any{
+		"path":             file,
+		"partitionValues":  map[string]any{},
+		"size":             size,
+		"modificationTime": now,
+		"dataChange":       true,
+		"stats":            fmt.Sprintf(`{"numRecords":%d}`, manifest.Rows),
+	}})
+	lines := make([]string, len(actions))
+	for i, action := range actions {
+		line, marshalErr := json.Marshal(action)
+		if marshalErr != nil {
+			return nil, fmt.Errorf("export: encoding delta log: %w", marshalErr)
+		}
+		lines[i] = string(line)
+	}
+	logFile := fmt.Sprintf("%s/_delta_log/%020d.json", dest, version)
+	if local {
+		if err = os.MkdirAll(filepath.Dir(logFile), 0o755); err != nil {
+			return nil, fmt.Errorf("export: creating delta log directory: %w", err)
+		}
+	}
+	if err = s.writeLines(ctx, logFile, lines); err != nil {
+		return nil, fmt.Errorf("export: committing delta version %d: %w", version, err)
+	}
+	return &DeltaCommit{Table: table, Version: version, Rows: manifest.Rows, File: file, Removed: removed}, nil
+}
+
+// writeLines writes the lines as a text file through DuckDB, so object stores are written with the secrets DuckDB has.
+// The CSV writer is set up with control characters as delimiter and quote, which leaves the lines as they are unless
+// they contain those.
+func (s *Store) writeLines(ctx context.Context, dest string, lines []string) error {
+	if len(lines) == 0 {
+		return errors.New("writing lines: no lines")
+	}
+	params := make([]any, len(lines))
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\x01\x02\n\r") {
+			return errors.New("writing lines: line contains a control character")
+		}
+		params[i] = line
+	}
+	query := fmt.Sprintf(
+		"COPY (SELECT line FROM (VALUES %s) AS t(line)) TO %s (FORMAT CSV, HEADER false, DELIMITER '\x01', "+
+			"QUOTE '\x02', ESCAPE '\x02')",
+		strings.TrimSuffix(strings.Repeat("(?), ", len(lines)), ", "),
+		quoteLiteral(dest),
+	)
+	if _, err := s.db.ExecContext(ctx, query, params...); err != nil {
+		return fmt.Errorf("writing lines: %w", err)
+	}
+	return nil
+}
+
+// HandleExportDelta exports the table in the path as a new version of a Delta table.
+func (s *Server) HandleExportDelta(w http.ResponseWriter, r *http.Request) {
+	var req DeltaExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle export delta: decoding request body", err)
+		return
+	}
+	res, err := s.store.ExportDelta(r.Context(), r.PathValue("table"), req)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle export delta", err)
+	case errors.Is(err, ErrInvalidExport):
+		s.writeError(w, http.StatusBadRequest, "handle export delta", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle export delta: writing response", res)
+	}
+}
@@ -0,0 +1,407 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDownloadRetention is how long a download is kept after it was created unless configured otherwise.
+	DefaultDownloadRetention = time.Hour
+	// DefaultDownloadPartSize is the size of the parts of a download unless the request asks for another.
+	DefaultDownloadPartSize = 64 << 20
+	// minDownloadPartSize keeps downloads from being split into a part per few rows.
+	minDownloadPartSize = 64 << 10
+)
+
+var (
+	ErrDownloadNotFound = errors.New("download not found")
+	ErrInvalidDownload  = errors.New("invalid download")
+)
+
+// downloadFileRegex matches the files of downloads in the download directory.
+var downloadFileRegex = regexp.MustCompile(`^[0-9a-f]{32}\.(parquet|csv|ndjson)$`)
+
+// downloadFormats are the formats of downloads with the options of the COPY writing them.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var downloadFormats = map[string]struct {
+	format  Format
+	options string
+}{
+	FormatParquet.Name: {FormatParquet, "FORMAT PARQUET, COMPRESSION zstd"},
+	FormatCSV.Name:     {FormatCSV, "FORMAT CSV, HEADER true"},
+	FormatNDJSON.Name:  {FormatNDJSON, "FORMAT JSON"},
+}
+
+// DownloadRequest creates a download of the result of a query or of a whole table.
+type DownloadRequest struct {
+	SQL    string `json:"sql,omitempty"`
+	Params []any  `json:"params,omitempty"`
+	// Table downloads every row of the table instead of the result of SQL.
+	Table string `json:"table,omitempty"`
+	// Format is parquet, the default, csv or ndjson.
+	Format string `json:"format,omitempty"`
+	// PartSize is the size in bytes of the parts the download is fetched in, 64 MiB by default.
+	PartSize int64 `json:"part_size,omitempty"`
+}
+
+// Download is a file written from a query result that is fetched in parts, or in ranges of the whole file, so an
+// interrupted transfer resumes where it stopped. The checksums let clients verify each part and the assembled file.
+type Download struct {
+	ID         string    `json:"id"`
+	Format     string    `json:"format"`
+	Rows       int64     `json:"rows"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	PartSize   int64     `json:"part_size"`
+	Parts      int       `json:"parts"`
+	PartSHA256 []string  `json:"part_sha256"`
+	Caller     string    `json:"caller"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Downloads keeps the files of the downloads in a directory until they are deleted or expire. The downloads
+// themselves live in memory, the files of an earlier run are removed when it is opened.
+type Downloads struct {
+	dir       string
+	retention time.Duration
+
+	mu   sync.Mutex
+	byID map[string]*Download
+}
+
+// NewDownloads opens the download directory, creating it if needed. Downloads expire after the retention, the default
+// if it is zero.
+func NewDownloads(dir string, retention time.Duration) (*Downloads, error) {
+	if retention <= 0 {
+		retention = DefaultDownloadRetention
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("downloads: creating directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("downloads: reading directory: %w", err)
+	}
+	for _, e := range entries {
+		if downloadFileRegex.MatchString(e.Name()) {
+			if err = os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return nil, fmt.Errorf("downloads: removing leftover file: %w", err)
+			}
+		}
+	}
+	return &Downloads{dir: dir, retention: retention, byID: make(map[string]*Download)}, nil
+}
+
+// WithDownloads serves the download endpoints. Without it, creating a download fails.
+func WithDownloads(downloads *Downloads) ServerOption {
+	return func(s *Server) {
+		s.downloads = downloads
+	}
+}
+
+func (ds *Downloads) path(d *Download) string {
+	return filepath.Join(ds.dir, d.ID+"."+d.Format)
+}
+
+func (ds *Downloads) add(d *Download) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.prune()
+	ds.byID[d.ID] = d
+}
+
+// get returns the download if the request may see it: admins and servers without authentication see all of them,
+// others those they created.
+func (ds *Downloads) get(r *http.Request, id string) (*Download, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.prune()
+	d, ok := ds.byID[id]
+	if !ok || !ownedBy(r, d.Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrDownloadNotFound, id)
+	}
+	return d, nil
+}
+
+func (ds *Downloads) list(r *http.Request) []Download {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.prune()
+	out := []Download{}
+	for _, d := range ds.byID {
+		if ownedBy(r, d.Caller) {
+			out = append(out, *d)
+		}
+	}
+	return out
+}
+
+// remove deletes the download and its file. Transfers already reading the file finish.
+func (ds *Downloads) remove(d *Download) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.byID, d.ID)
+	ds.removeFile(d)
+}
+
+// prune removes the expired downloads. The caller holds the lock.
+func (ds *Downloads) prune() {
+	now := time.Now()
+	for id, d := range ds.byID {
+		if now.After(d.ExpiresAt) {
+			delete(ds.byID, id)
+			ds.removeFile(d)
+		}
+	}
+}
+
+func (ds *Downloads) removeFile(d *Download) {
+	if err := os.Remove(ds.path(d)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("downloads: removing file", "id", d.ID, "err", err)
+	}
+}
+
+// ownedBy reports whether the request may see what the caller created.
+func ownedBy(r *http.Request, caller string) bool {
+	p, ok := requestPrincipal(r.Context())
+	return !ok || p.has(ScopeAdmin) || caller == p.Name
+}
+
+// statement returns the query of the request.
+func (req DownloadRequest) statement() (*QueryStatement, error) {
+	switch {
+	case req.SQL != "" && req.Table != "":
+		return nil, fmt.Errorf("%w: set either sql or table", ErrInvalidDownload)
+	case req.Table != "":
+		if !tableNameRegex.MatchString(req.Table) {
+			return nil, fmt.Errorf("%w: table must match %s", ErrInvalidDownload, tableNameRegex)
+		}
+		return &QueryStatement{Query: "SELECT * FROM " + quoteIdent(req.Table)}, nil
+	case req.SQL != "":
+		return &QueryStatement{Query: req.SQL, Params: req.Params}, nil
+	default:
+		return nil, fmt.Errorf("%w: missing sql or table", ErrInvalidDownload)
+	}
+}
+
+// copyToFile writes the result of the read-only statement to the file with the options of the COPY and returns the
+// number of rows written.
+func (s *Store) copyToFile(ctx context.Context, stmt *QueryStatement, path, options string) (int64, error) {
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return 0, err
+	}
+	return s.copyQuery(ctx, "\n"+stmt.Query+"\n", stmt.Params, exportTarget{dest: path, local: true, options: options})
+}
+
+// checksums returns the SHA-256 of the file and of each of its parts.
+func checksums(path string, partSize int64) (string, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("downloads: opening file: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("downloads: closing file", "err", closeErr)
+		}
+	}()
+	whole := sha256.New()
+	parts := []string{}
+	for {
+		part := sha256.New()
+		n, copyErr := io.Copy(io.MultiWriter(whole, part), io.LimitReader(f, partSize))
+		if copyErr != nil {
+			return "", nil, fmt.Errorf("downloads: reading file: %w", copyErr)
+		}
+		if n == 0 {
+			break
+		}
+		parts = append(parts, hex.EncodeToString(part.Sum(nil)))
+	}
+	return hex.EncodeToString(whole.Sum(nil)), parts, nil
+}
+
+// HandleCreateDownload writes the result of the query or table of a DownloadRequest to a file and responds with the
+// download. The query is checked like those of POST /query but not cut by the result limits.
+func (s *Server) HandleCreateDownload(w http.ResponseWriter, r *http.Request) {
+	var req DownloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create download: decoding request body", err)
+		return
+	}
+	if s.downloads == nil {
+		s.writeError(w, http.StatusBadRequest, "handle create download",
+			fmt.Errorf("%w: downloads are disabled", ErrInvalidDownload))
+		return
+	}
+	if req.Format == "" {
+		req.Format = FormatParquet.Name
+	}
+	format, ok := downloadFormats[req.Format]
+	if req.PartSize == 0 {
+		req.PartSize = DefaultDownloadPartSize
+	}
+	stmt, err := req.statement()
+	switch {
+	case err != nil:
+	case !ok:
+		err = fmt.Errorf("%w: unsupported format %q", ErrInvalidDownload, req.Format)
+	case req.PartSize < minDownloadPartSize:
+		err = fmt.Errorf("%w: part_size must be at least %d", ErrInvalidDownload, minDownloadPartSize)
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create download", err)
+		return
+	}
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+
+	id, err := newID()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle create download", err)
+		return
+	}
+	now := time.Now().UTC()
+	d := &Download{
+		ID:        id,
+		Format:    req.Format,
+		PartSize:  req.PartSize,
+		Caller:    caller(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.downloads.retention),
+	}
+	path := s.downloads.path(d)
+	started := time.Now()
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	d.Rows, err = s.store.copyToFile(ctx, stmt, path, format.options)
+	cancel()
+	if err == nil {
+		rows := int(d.Rows)
+		s.record(r, stmt, started, &rows, false, nil)
+		if d.SHA256, d.PartSHA256, err = checksums(path, d.PartSize); err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(path); err == nil {
+				d.Size, d.Parts = info.Size(), len(d.PartSHA256)
+			}
+		}
+	} else {
+		s.record(r, stmt, started, nil, false, err)
+	}
+	if err != nil {
+		s.downloads.removeFile(d)
+		s.writeQueryError(w, err)
+		return
+	}
+	markAuditRows(r.Context(), int(d.Rows))
+	s.downloads.add(d)
+	s.writeJSON(w, http.StatusCreated, "handle create download: writing response", d)
+}
+
+func (s *Server) HandleListDownloads(w http.ResponseWriter, r *http.Request) {
+	out := []Download{}
+	if s.downloads != nil {
+		out = s.downloads.list(r)
+	}
+	s.writeJSON(w, http.StatusOK, "handle list downloads: writing response", out)
+}
+
+// download returns the download named in the path, or writes the error and returns nil.
+func (s *Server) download(w http.ResponseWriter, r *http.Request, op string) *Download {
+	id := r.PathValue("id")
+	if s.downloads == nil {
+		s.writeError(w, http.StatusNotFound, op, fmt.Errorf("%w: %s", ErrDownloadNotFound, id))
+		return nil
+	}
+	d, err := s.downloads.get(r, id)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, op, err)
+		return nil
+	}
+	return d
+}
+
+func (s *Server) HandleGetDownload(w http.ResponseWriter, r *http.Request) {
+	if d := s.download(w, r, "handle get download"); d != nil {
+		s.writeJSON(w, http.StatusOK, "handle get download: writing response", d)
+	}
+}
+
+// HandleDeleteDownload completes a download, removing its file before it expires.
+func (s *Server) HandleDeleteDownload(w http.ResponseWriter, r *http.Request) {
+	if d := s.download(w, r, "handle delete download"); d != nil {
+		s.downloads.remove(d)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleDownloadData serves the whole file of the download. Range requests fetch the rest of an interrupted transfer,
+// If-Range with the ETag, the SHA-256 of the file, makes sure it is still the same file.
+func (s *Server) HandleDownloadData(w http.ResponseWriter, r *http.Request) {
+	d := s.download(w, r, "handle download data")
+	if d == nil {
+		return
+	}
+	s.serveDownload(w, r, d, d.ID+"."+d.Format, d.SHA256, 0, d.Size)
+}
+
+// HandleDownloadPart serves the part of the download numbered in the path, from 0, with the SHA-256 of the part as
+// its ETag. Parts take range requests too.
+func (s *Server) HandleDownloadPart(w http.ResponseWriter, r *http.Request) {
+	d := s.download(w, r, "handle download part")
+	if d == nil {
+		return
+	}
+	part, err := strconv.Atoi(r.PathValue("part"))
+	if err != nil || part < 0 || part >= d.Parts {
+		s.writeError(w, http.StatusNotFound, "handle download part",
+			fmt.Errorf("%w: %s has no part %s", ErrDownloadNotFound, d.ID, r.PathValue("part")))
+		return
+	}
+	offset := int64(part) * d.PartSize
+	name := fmt.Sprintf("%s.part%d.%s", d.ID, part, d.Format)
+	s.serveDownload(w, r, d, name, d.PartSHA256[part], offset, min(d.PartSize, d.Size-offset))
+}
+
+// serveDownload serves the section of the file of the download, answering range and conditional requests.
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, d *Download, name, sum string, offset,
+	size int64,
+) {
+	f, err := os.Open(s.downloads.path(d))
+	if errors.Is(err, os.ErrNotExist) {
+		s.writeError(w, http.StatusNotFound, "handle download", fmt.Errorf("%w: %s", ErrDownloadNotFound, d.ID))
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle download", err)
+		return
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("handle download: closing file", "err", closeErr)
+		}
+	}()
+	liftWriteTimeout(w)
+	w.Header().Set("Content-Type", downloadFormats[d.Format].format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("ETag", strconv.Quote(sum))
+	http.ServeContent(w, r, name, d.CreatedAt, io.NewSectionReader(f, offset, size))
+}
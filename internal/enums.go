@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// enumType returns the DuckDB ENUM type of the values.
+func enumType(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteLiteral(v)
+	}
+	return "ENUM(" + strings.Join(quoted, ", ") + ")"
+}
+
+// validateEnum checks the enum declaration of the column.
+func (c *ColumnConfig) validateEnum() error {
+	if len(c.Enum) == 0 {
+		if c.StrictEnum {
+			return fmt.Errorf("%w: column %s: strict_enum requires enum values", ErrInvalidTableConfig, c.Name)
+		}
+		return nil
+	}
+	if c.Type != "" || c.Generated != "" {
+		return fmt.Errorf("%w: column %s: enum columns can't declare a type or be generated", ErrInvalidTableConfig,
+			c.Name)
+	}
+	seen := make(map[string]bool, len(c.Enum))
+	for _, v := range c.Enum {
+		if seen[v] {
+			return fmt.Errorf("%w: column %s: repeated enum value %q", ErrInvalidTableConfig, c.Name, v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// newEnumValues returns the distinct values of the column in the statement missing from known, in the order they
+// first appear. Enum columns only take strings.
+func (s *InsertStatement) newEnumValues(name string, known []string) ([]string, error) {
+	seen := make(map[string]bool, len(known))
+	for _, v := range known {
+		seen[v] = true
+	}
+	var out []string
+	for _, row := range s.rows() {
+		for k, v := range row {
+			if v == nil || !strings.EqualFold(k, name) {
+				continue
+			}
+			str, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: enum column %s: %T value", ErrInvalidInsert, k, v)
+			}
+			if !seen[str] {
+				seen[str] = true
+				out = append(out, str)
+			}
+		}
+	}
+	return out, nil
+}
+
+// enumColumnType returns the type a declared enum column is created with: its declared values followed, unless it is
+// strict, by the new ones of the statement.
+func (s *InsertStatement) enumColumnType(c ColumnConfig) (string, error) {
+	values := c.Enum[:len(c.Enum):len(c.Enum)]
+	if !c.StrictEnum {
+		added, err := s.newEnumValues(c.Name, c.Enum)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, added...)
+	}
+	return enumType(values), nil
+}
+
+// syncEnums checks the values of the enum columns of the statement before it is written. Values new to a strict enum
+// fail the insert, those of the other enums are added to the type of the column, which DuckDB rewrites. Columns yet to
+// be created are created with them. The caller holds the write lock.
+func (s *Store) syncEnums(ctx context.Context, stmt *InsertStatement, cfg TableConfig) error {
+	changes, err := s.enumChanges(ctx, stmt, cfg)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if _, err = s.writer.ExecContext(ctx, c.query(stmt.Table)); err != nil {
+			return fmt.Errorf("adding enum values: %w", s.memoryError(err))
+		}
+		s.inserts.invalidate(stmt.Table)
+	}
+	return nil
+}
+
+// enumChange is the type an existing enum column is altered to for the values new to it.
+type enumChange struct {
+	column   string
+	dataType string
+}
+
+func (c enumChange) query(table string) string {
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DATA TYPE %s", quoteIdent(table), quoteIdent(c.column),
+		c.dataType)
+}
+
+// enumChanges checks the values of the enum columns of the statement and returns the changes of the existing enum
+// columns syncEnums applies.
+func (s *Store) enumChanges(ctx context.Context, stmt *InsertStatement, cfg TableConfig) ([]enumChange, error) {
+	var (
+		types   map[string]string
+		changes []enumChange
+	)
+	for _, c := range cfg.Columns {
+		if len(c.Enum) == 0 {
+			continue
+		}
+		if types == nil {
+			var err error
+			if types, err = s.columnTypes(ctx, stmt.Table); err != nil {
+				return nil, err
+			}
+		}
+		known := c.Enum
+		dataType, exists := types[strings.ToLower(c.Name)]
+		if exists {
+			if !strings.HasPrefix(dataType, "ENUM(") {
+				// The column existed before it was declared an enum.
+				continue
+			}
+			var err error
+			if known, err = s.enumRange(ctx, dataType); err != nil {
+				return nil, err
+			}
+		}
+		added, err := stmt.newEnumValues(c.Name, known)
+		switch {
+		case err != nil:
+			return nil, err
+		case len(added) == 0:
+		case c.StrictEnum:
+			return nil, fmt.Errorf("%w: column %s: %q is not a value of its enum", ErrInvalidInsert, c.Name, added[0])
+		case exists:
+			changes = append(changes, enumChange{column: c.Name, dataType: enumType(append(known, added...))})
+		}
+	}
+	return changes, nil
+}
+
+// enumRange returns the values of the ENUM type in their order.
+func (s *Store) enumRange(ctx context.Context, dataType string) ([]string, error) {
+	rows, err := s.writer.QueryContext(ctx, "SELECT unnest(enum_range(NULL::"+dataType+"))")
+	if err != nil {
+		return nil, fmt.Errorf("listing enum values: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var out []string
+	for rows.Next() {
+		var v string
+		if err = rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("scanning enum value: %w", err)
+		}
+		out = append(out, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing enum values: %w", err)
+	}
+	return out, nil
+}
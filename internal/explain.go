@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PlanNode is an operator of a query plan. Cardinality and TimingMS are only set for analyzed plans.
+type PlanNode struct {
+	Name                 string      `json:"name"`
+	ExtraInfo            []string    `json:"extra_info,omitempty"`
+	EstimatedCardinality *int64      `json:"estimated_cardinality,omitempty"`
+	Cardinality          *int64      `json:"cardinality,omitempty"`
+	TimingMS             *float64    `json:"timing_ms,omitempty"`
+	Children             []*PlanNode `json:"children"`
+}
+
+// QueryPlan holds the plans DuckDB reports for a query: the logical plan before and after optimization and the
+// physical plan, or with analyze the physical plan as executed.
+type QueryPlan struct {
+	Logical          *PlanNode `json:"logical,omitempty"`
+	LogicalOptimized *PlanNode `json:"logical_optimized,omitempty"`
+	Physical         *PlanNode `json:"physical,omitempty"`
+	Analyzed         *PlanNode `json:"analyzed,omitempty"`
+	TotalMS          float64   `json:"total_ms,omitempty"`
+}
+
+// Explain returns the plans of the single read statement of the query. With analyze the query is executed to collect
+// operator timings and cardinalities.
+func (s *Store) Explain(ctx context.Context, stmt *QueryStatement, analyze bool) (*QueryPlan, error) {
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	query, err := stmt.singleRead()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("explain: acquiring connection: %w", err)
+	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			slog.Error("explain: closing connection", "err", closeErr)
+		}
+	}()
+
+	// Profiling and explain settings are per connection, they are reset before it goes back to the pool.
+	setup, reset := "PRAGMA explain_output='all'", "PRAGMA explain_output='physical_only'"
+	if analyze {
+		setup, reset = "PRAGMA enable_profiling='json'", "PRAGMA disable_profiling"
+	}
+	if _, err = conn.ExecContext(ctx, setup); err != nil {
+		return nil, fmt.Errorf("explain: configuring connection: %w", err)
+	}
+	defer func() {
+		if _, resetErr := conn.ExecContext(context.Background(), reset); resetErr != nil {
+			slog.Error("explain: resetting connection", "err", resetErr)
+		}
+	}()
+
+	prefix := "EXPLAIN "
+	if analyze {
+		prefix = "EXPLAIN ANALYZE "
+	}
+	plans, err := explainRows(ctx, conn, prefix+query, stmt.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &QueryPlan{}
+	for key, value := range plans {
+		switch key {
+		case "logical_plan":
+			out.Logical, err = parsePlanTree(value)
+		case "logical_opt":
+			out.LogicalOptimized, err = parsePlanTree(value)
+		case "physical_plan":
+			out.Physical, err = parsePlanTree(value)
+		case "analyzed_plan":
+			out.Analyzed, out.TotalMS, err = parseProfile(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("explain: parsing %s: %w", key, err)
+		}
+	}
+	return out, nil
+}
+
+func explainRows(ctx context.Context, conn *sql.Conn, query string, params []any) (map[string]string, error) {
+	rows, err := conn.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("explain: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("explain: scanning plan: %w", err)
+		}
+		out[key] = value
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("explain: %w", err)
+	}
+	return out, nil
+}
+
+// planBox is an operator box of a rendered plan, located by its first line and column.
+type planBox struct {
+	line, col int
+	node      *PlanNode
+}
+
+// parsePlanTree parses the box drawing DuckDB renders plans as. Operators of one depth share the lines their boxes
+// start on. The first child sits below its parent, further children to the right, so the parent of a box is the
+// closest box of the depth above that starts at or left of it.
+func parsePlanTree(text string) (*PlanNode, error) {
+	lines := strings.Split(text, "\n")
+	grid := make([][]rune, len(lines))
+	for i, line := range lines {
+		grid[i] = []rune(line)
+	}
+
+	var levels [][]planBox
+	for i, line := range grid {
+		var level []planBox
+		for col, r := range line {
+			if r != '┌' {
+				continue
+			}
+			box, err := parsePlanBox(grid, i, col)
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, planBox{line: i, col: col, node: box})
+		}
+		if len(level) > 0 {
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) == 0 {
+		return nil, errors.New("no operators in plan")
+	}
+	for depth := 1; depth < len(levels); depth++ {
+		for _, child := range levels[depth] {
+			var parent *PlanNode
+			for _, candidate := range levels[depth-1] {
+				if candidate.col <= child.col {
+					parent = candidate.node
+				}
+			}
+			if parent == nil {
+				return nil, fmt.Errorf("operator %s has no parent", child.node.Name)
+			}
+			parent.Children = append(parent.Children, child.node)
+		}
+	}
+	if len(levels[0]) != 1 {
+		return nil, errors.New("plan has more than one root")
+	}
+	return levels[0][0].node, nil
+}
+
+// parsePlanBox reads the box with its top left corner at line, col. Sections of the box are divided by dashed lines,
+// the first holds the operator name.
+func parsePlanBox(grid [][]rune, line, col int) (*PlanNode, error) {
+	end := col + 1
+	for end < len(grid[line]) && grid[line][end] != '┐' {
+		end++
+	}
+	if end == len(grid[line]) {
+		return nil, fmt.Errorf("unterminated box at line %d", line)
+	}
+
+	node := &PlanNode{Children: []*PlanNode{}}
+	var info []string
+	for i := line + 1; i < len(grid); i++ {
+		if col >= len(grid[i]) {
+			return nil, fmt.Errorf("unterminated box at line %d", line)
+		}
+		if grid[i][col] == '└' {
+			break
+		}
+		content := strings.TrimSpace(string(grid[i][col+1 : min(end, len(grid[i]))]))
+		if strings.Trim(content, "─ ") == "" && content != "" {
+			continue
+		}
+		if content == "" {
+			continue
+		}
+		if node.Name == "" {
+			node.Name = content
+			continue
+		}
+		info = append(info, content)
+	}
+	node.ExtraInfo, node.EstimatedCardinality = splitEstimate(info)
+	return node, nil
+}
+
+// splitEstimate takes the estimated cardinality, rendered as EC: n, out of the extra info of an operator.
+func splitEstimate(info []string) ([]string, *int64) {
+	var (
+		out      []string
+		estimate *int64
+	)
+	for _, line := range info {
+		if v, ok := strings.CutPrefix(line, "EC: "); ok {
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				estimate = &n
+				continue
+			}
+		}
+		out = append(out, line)
+	}
+	return out, estimate
+}
+
+type profileNode struct {
+	Name        string         `json:"name"`
+	Timing      float64        `json:"timing"`
+	Cardinality int64          `json:"cardinality"`
+	ExtraInfo   string         `json:"extra_info"`
+	Children    []*profileNode `json:"children"`
+}
+
+// parseProfile parses a JSON profile of DuckDB and returns the executed plan without the wrapping query, result
+// collector and explain operators, along with the total time.
+func parseProfile(text string) (*PlanNode, float64, error) {
+	var root profileNode
+	if err := json.Unmarshal([]byte(text), &root); err != nil {
+		return nil, 0, err
+	}
+	total := root.Timing * 1000
+	node := &root
+	for len(node.Children) == 1 && (node.Name == "Query" ||
+		node.Name == "RESULT_COLLECTOR" ||
+		node.Name == "EXPLAIN_ANALYZE") {
+		node = node.Children[0]
+	}
+	return node.planNode(), total, nil
+}
+
+func (p *profileNode) planNode() *PlanNode {
+	var info []string
+	for _, line := range strings.Split(p.ExtraInfo, "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != "[INFOSEPARATOR]" {
+			info = append(info, line)
+		}
+	}
+	timing := p.Timing * 1000
+	cardinality := p.Cardinality
+	out := &PlanNode{
+		Name:        strings.TrimSpace(p.Name),
+		Cardinality: &cardinality,
+		TimingMS:    &timing,
+		Children:    make([]*PlanNode, 0, len(p.Children)),
+	}
+	out.ExtraInfo, out.EstimatedCardinality = splitEstimate(info)
+	for _, child := range p.Children {
+		out.Children = append(out.Children, child.planNode())
+	}
+	return out
+}
+
+// HandleExplain responds with the plans of the query in q, executing it to profile operators with analyze=true.
+func (s *Server) HandleExplain(w http.ResponseWriter, r *http.Request) {
+	stmt, err := queryStatementFromURL(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle explain: parsing parameters", err)
+		return
+	}
+	s.writeExplain(w, r, stmt)
+}
+
+// HandleExplainPost is HandleExplain with the query in a QueryRequest body.
+func (s *Server) HandleExplainPost(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle explain: decoding request body", err)
+		return
+	}
+	s.writeExplain(w, r, &QueryStatement{Query: req.SQL, Params: req.Params})
+}
+
+func (s *Server) writeExplain(w http.ResponseWriter, r *http.Request, stmt *QueryStatement) {
+	analyze := false
+	if v := r.URL.Query().Get("analyze"); v != "" {
+		var err error
+		if analyze, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle explain: parsing analyze", err)
+			return
+		}
+	}
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	plan, err := s.store.Explain(ctx, stmt, analyze)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle explain: writing response", plan)
+}
@@ -0,0 +1,486 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrInvalidExport = errors.New("invalid export")
+
+// exportSchemes are the object stores DuckDB writes to through httpfs.
+var exportSchemes = map[string]bool{"s3": true, "s3a": true, "s3n": true, "r2": true, "gcs": true, "gs": true}
+
+// exportCompressions are the Parquet compressions an export may ask for.
+var exportCompressions = map[string]bool{"snappy": true, "zstd": true, "gzip": true, "uncompressed": true}
+
+// WithExportDirectory allows exports to local paths, which are resolved within the directory. Without it only object
+// stores can be exported to.
+func WithExportDirectory(dir string) StoreOption {
+	return func(s *Store) {
+		s.exportDir = dir
+	}
+}
+
+// ExportRequest is the body of POST /tables/{table}/export. The credentials of an object store URL come from the
+// secret whose scope matches it.
+type ExportRequest struct {
+	// URL is the Parquet file, e.g. s3://bucket/events.parquet, or the directory of a partitioned export. A path
+	// without scheme is relative to the export directory of the server.
+	URL string `json:"url"`
+	// Filters select the exported rows, in the form of the filter parameter of GET /tables/{table}/rows.
+	Filters []string `json:"filters,omitempty"`
+	// PartitionBy writes a Hive partitioned layout of the columns, e.g. dt=2024-01-31/data_0.parquet.
+	PartitionBy []string `json:"partition_by,omitempty"`
+	// Compression is snappy, the default, zstd, gzip or uncompressed.
+	Compression string `json:"compression,omitempty"`
+	// Overwrite replaces the file, or the files of the same names in the directory of a partitioned export.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// ExportManifest lists the files an export wrote. A partitioned export lists every file in its directory, including
+// those of earlier exports.
+type ExportManifest struct {
+	// Table is unset for the exports of query results.
+	Table string   `json:"table,omitempty"`
+	Rows  int64    `json:"rows"`
+	Files []string `json:"files"`
+}
+
+// exportDestination returns the URL an export writes to and whether it is a local path.
+func (s *Store) exportDestination(dest string) (string, bool, error) {
+	if dest == "" {
+		return "", false, fmt.Errorf("%w: missing url", ErrInvalidExport)
+	}
+	if u, err := url.Parse(dest); err == nil && u.Scheme != "" {
+		if !exportSchemes[strings.ToLower(u.Scheme)] {
+			return "", false, fmt.Errorf("%w: unsupported url scheme %q", ErrInvalidExport, u.Scheme)
+		}
+		return dest, false, nil
+	}
+	if s.exportDir == "" {
+		return "", false, fmt.Errorf("%w: local exports are disabled", ErrInvalidExport)
+	}
+	clean := filepath.Clean(dest)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false, fmt.Errorf("%w: local path must be relative to the export directory", ErrInvalidExport)
+	}
+	return filepath.Join(s.exportDir, clean), true, nil
+}
+
+// exportOptions returns the options of the COPY statement of the request.
+func exportOptions(cols map[string]bool, req ExportRequest) (string, error) {
+	compression := strings.ToLower(req.Compression)
+	if compression == "" {
+		compression = "snappy"
+	}
+	if !exportCompressions[compression] {
+		return "", fmt.Errorf("%w: unsupported compression %q", ErrInvalidExport, req.Compression)
+	}
+	options := []string{"FORMAT PARQUET", "COMPRESSION " + compression}
+	if len(req.PartitionBy) > 0 {
+		partitions := make([]string, len(req.PartitionBy))
+		for i, name := range req.PartitionBy {
+			col, err := column(cols, name)
+			if err != nil {
+				return "", fmt.Errorf("%w: partition by: %w", ErrInvalidExport, err)
+			}
+			partitions[i] = col
+		}
+		options = append(options, "PARTITION_BY ("+strings.Join(partitions, ", ")+")")
+		if req.Overwrite {
+			options = append(options, "OVERWRITE_OR_IGNORE")
+		}
+	}
+	return strings.Join(options, ", "), nil
+}
+
+// Export copies the rows of the table matching the filters of the request to Parquet and lists the written files.
+func (s *Store) Export(ctx context.Context, table string, req ExportRequest) (*ExportManifest, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	dest, local, err := s.exportDestination(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	where, params, err := whereClause(cols, req.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+	options, err := exportOptions(cols, req)
+	if err != nil {
+		return nil, err
+	}
+	target := exportTarget{
+		dest:        dest,
+		local:       local,
+		partitioned: len(req.PartitionBy) > 0,
+		overwrite:   req.Overwrite,
+		options:     options,
+	}
+	return s.copyToFiles(ctx, table, fmt.Sprintf("SELECT * FROM %s%s", quoteIdent(table), where), params, target)
+}
+
+// QueryDestination writes the result of POST /query to files instead of the response. The credentials of an object
+// store URL come from the secret whose scope matches it.
+type QueryDestination struct {
+	// URL is the file, e.g. s3://bucket/result.parquet, or the directory of a partitioned export. A path without
+	// scheme is relative to the export directory of the server.
+	URL string `json:"url"`
+	// Format is parquet, the default, or csv.
+	Format string `json:"format,omitempty"`
+	// Compression is snappy, the default, zstd, gzip or uncompressed for Parquet, and gzip, zstd or uncompressed,
+	// the default, for CSV.
+	Compression string `json:"compression,omitempty"`
+	// PartitionBy writes a Hive partitioned layout of the result columns.
+	PartitionBy []string `json:"partition_by,omitempty"`
+	Overwrite   bool     `json:"overwrite,omitempty"`
+}
+
+// target returns where and how the result is written.
+func (d QueryDestination) target(s *Store) (exportTarget, error) {
+	dest, local, err := s.exportDestination(d.URL)
+	if err != nil {
+		return exportTarget{}, err
+	}
+	compression := strings.ToLower(d.Compression)
+	var options []string
+	pattern := ""
+	switch strings.ToLower(d.Format) {
+	case "", "parquet":
+		if compression == "" {
+			compression = "snappy"
+		}
+		if !exportCompressions[compression] {
+			return exportTarget{}, fmt.Errorf("%w: unsupported compression %q", ErrInvalidExport, d.Compression)
+		}
+		options = []string{"FORMAT PARQUET", "COMPRESSION " + compression}
+	case "csv":
+		switch compression {
+		case "", "uncompressed":
+			compression = "none"
+		case "gzip", "zstd":
+		default:
+			return exportTarget{}, fmt.Errorf("%w: unsupported compression %q", ErrInvalidExport, d.Compression)
+		}
+		options, pattern = []string{"FORMAT CSV", "HEADER", "COMPRESSION " + compression}, "*.csv*"
+	default:
+		return exportTarget{}, fmt.Errorf("%w: unsupported format %q, expected parquet or csv", ErrInvalidExport, d.Format)
+	}
+	if len(d.PartitionBy) > 0 {
+		partitions := make([]string, len(d.PartitionBy))
+		for i, name := range d.PartitionBy {
+			if !tableNameRegex.MatchString(name) {
+				return exportTarget{}, fmt.Errorf("%w: partition by: column must match %s", ErrInvalidExport, tableNameRegex)
+			}
+			partitions[i] = quoteIdent(name)
+		}
+		options = append(options, "PARTITION_BY ("+strings.Join(partitions, ", ")+")")
+		if d.Overwrite {
+			options = append(options, "OVERWRITE_OR_IGNORE")
+		}
+	}
+	return exportTarget{
+		dest:        dest,
+		local:       local,
+		partitioned: len(d.PartitionBy) > 0,
+		overwrite:   d.Overwrite,
+		options:     strings.Join(options, ", "),
+		pattern:     pattern,
+	}, nil
+}
+
+// ExportQuery copies the result of the read-only statement to the destination and lists the written files.
+func (s *Store) ExportQuery(ctx context.Context, stmt *QueryStatement, dest QueryDestination) (*ExportManifest, error) {
+	target, err := dest.target(s)
+	if err != nil {
+		return nil, err
+	}
+	if stmt, err = s.checkQuery(ctx, stmt); err != nil {
+		return nil, err
+	}
+	return s.copyToFiles(ctx, "", "\n"+stmt.Query+"\n", stmt.Params, target)
+}
+
+// exportTarget is where and how copyToFiles writes.
+type exportTarget struct {
+	dest        string
+	local       bool
+	partitioned bool
+	overwrite   bool
+	// options of the COPY statement.
+	options string
+	// pattern matches the files of a partitioned export in its directory, *.parquet if it is empty.
+	pattern string
+}
+
+// copyToFiles runs the COPY of the query to the target and lists the files at its destination.
+func (s *Store) copyToFiles(
+	ctx context.Context,
+	table string,
+	query string,
+	params []any,
+	target exportTarget,
+) (*ExportManifest, error) {
+	if target.local {
+		dir := target.dest
+		if !target.partitioned {
+			dir = filepath.Dir(target.dest)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("export: creating directory: %w", err)
+		}
+		if _, err := os.Stat(target.dest); err == nil && !target.partitioned && !target.overwrite {
+			return nil, fmt.Errorf("%w: %s exists, set overwrite to replace it", ErrInvalidExport, target.dest)
+		}
+	}
+
+	out := &ExportManifest{Table: table}
+	var err error
+	if out.Rows, err = s.copyQuery(ctx, query, params, target); err != nil {
+		return nil, err
+	}
+	if !target.partitioned {
+		out.Files = []string{target.dest}
+	} else {
+		pattern := target.pattern
+		if pattern == "" {
+			pattern = "*.parquet"
+		}
+		if out.Files, err = s.globFiles(ctx, strings.TrimSuffix(target.dest, "/")+"/**/"+pattern); err != nil {
+			return nil, err
+		}
+	}
+	if target.local {
+		for i, f := range out.Files {
+			if rel, relErr := filepath.Rel(s.exportDir, f); relErr == nil {
+				out.Files[i] = rel
+			}
+		}
+	}
+	return out, nil
+}
+
+// copyQuery runs the COPY of the query to the target and returns the number of rows written. DuckDB doesn't report
+// the rows of a partitioned COPY, they are counted in the transaction of the COPY so the count matches its snapshot.
+func (s *Store) copyQuery(ctx context.Context, query string, params []any, target exportTarget) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("export: beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back export", "err", rollbackErr)
+		}
+	}()
+	var rows int64
+	if target.partitioned {
+		if err = tx.QueryRowContext(ctx, "SELECT count(*) FROM ("+query+")", params...).Scan(&rows); err != nil {
+			return 0, fmt.Errorf("export: counting rows: %w", s.memoryError(err))
+		}
+	}
+	res, err := tx.ExecContext(
+		ctx, fmt.Sprintf("COPY (%s) TO %s (%s)", query, quoteLiteral(target.dest), target.options), params...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("export: %w", s.memoryError(err))
+	}
+	if !target.partitioned {
+		if rows, err = res.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("export: counting rows: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("export: committing: %w", err)
+	}
+	committed = true
+	return rows, nil
+}
+
+// ScheduledExport exports the rows of the table of a schedule whose Watermark column grew past the HighWaterMark of the
+// previous run, to a Hive partitioned layout by day, e.g. s3://bucket/events/dt=2024-01-31/data_<uuid>.parquet. The
+// day is taken from the dt column of the table if it has one, else from DateColumn.
+type ScheduledExport struct {
+	URL string `json:"url"`
+	// Watermark is an increasing column, e.g. a timestamp or sequence id.
+	Watermark string `json:"watermark"`
+	// DateColumn is a date, timestamp or ISO formatted column the dt partition is derived from, Watermark by default.
+	DateColumn  string `json:"date_column,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	// HighWaterMark is the greatest Watermark exported so far. Setting it on a new schedule skips the rows up to it.
+	HighWaterMark any `json:"high_water_mark,omitempty"`
+	// LastFiles is the manifest of the export directory after the last successful run.
+	LastFiles []string `json:"last_files,omitempty"`
+}
+
+func (e *ScheduledExport) Validate() error {
+	if e.URL == "" {
+		return fmt.Errorf("%w: missing url", ErrInvalidExport)
+	}
+	if !tableNameRegex.MatchString(e.Watermark) {
+		return fmt.Errorf("%w: watermark must match %s", ErrInvalidExport, tableNameRegex)
+	}
+	if e.DateColumn != "" && !tableNameRegex.MatchString(e.DateColumn) {
+		return fmt.Errorf("%w: date column must match %s", ErrInvalidExport, tableNameRegex)
+	}
+	return nil
+}
+
+// ExportSince exports the rows of the table past the high-water mark of the export and returns the manifest along with
+// the new high-water mark. Rows added while the export runs are left for the next run. Without new rows nothing is
+// written and the mark stays.
+func (s *Store) ExportSince(ctx context.Context, table string, export ScheduledExport) (*ExportManifest, any, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	watermark, err := column(cols, export.Watermark)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: watermark: %w", ErrInvalidExport, err)
+	}
+	selected := "*"
+	if !cols["dt"] {
+		dateColumn := watermark
+		if export.DateColumn != "" {
+			if dateColumn, err = column(cols, export.DateColumn); err != nil {
+				return nil, nil, fmt.Errorf("%w: date column: %w", ErrInvalidExport, err)
+			}
+		}
+		selected = "*, " + dayPartition(dateColumn) + " AS dt"
+	}
+	dest, local, err := s.exportDestination(export.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	options, err := exportOptions(cols, ExportRequest{Compression: export.Compression})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var high any
+	if err = s.db.QueryRowContext(
+		ctx, fmt.Sprintf("SELECT max(%s) FROM %s", watermark, quoteIdent(table)),
+	).Scan(&high); err != nil {
+		return nil, nil, fmt.Errorf("export: reading high-water mark: %w", err)
+	}
+	if high == nil {
+		return &ExportManifest{Table: table}, export.HighWaterMark, nil
+	}
+	where := fmt.Sprintf("%s <= ?", watermark)
+	params := []any{high}
+	if export.HighWaterMark != nil {
+		where = fmt.Sprintf("%s > ? AND %s <= ?", watermark, watermark)
+		params = []any{export.HighWaterMark, high}
+	}
+	var pending int64
+	if err = s.db.QueryRowContext(
+		ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", quoteIdent(table), where), params...,
+	).Scan(&pending); err != nil {
+		return nil, nil, fmt.Errorf("export: counting rows: %w", err)
+	}
+	if pending == 0 {
+		return &ExportManifest{Table: table}, export.HighWaterMark, nil
+	}
+
+	// Each run adds files of unique names to the partitions, so earlier runs are kept.
+	options += ", PARTITION_BY (dt), OVERWRITE_OR_IGNORE, FILENAME_PATTERN 'data_{uuid}'"
+	manifest, err := s.copyToFiles(
+		ctx,
+		table,
+		fmt.Sprintf("SELECT %s FROM %s WHERE %s", selected, quoteIdent(table), where),
+		params,
+		exportTarget{dest: dest, local: local, partitioned: true, options: options},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, high, nil
+}
+
+// globFiles lists the files matching the pattern, locally or on an object store.
+func (s *Store) globFiles(ctx context.Context, pattern string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT file FROM glob(?) ORDER BY file", pattern)
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var out []string
+	for rows.Next() {
+		var file sql.NullString
+		if err = rows.Scan(&file); err != nil {
+			return nil, fmt.Errorf("scanning file: %w", err)
+		}
+		out = append(out, file.String)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing files: %w", err)
+	}
+	return out, nil
+}
+
+// writeQueryExport answers a query with a destination: it copies the result there and responds with the manifest of
+// the written files instead of the rows.
+func (s *Server) writeQueryExport(w http.ResponseWriter, r *http.Request, stmt *QueryStatement, dest QueryDestination) {
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+	started := time.Now()
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	res, err := s.store.ExportQuery(ctx, stmt, dest)
+	if err != nil {
+		s.record(r, stmt, started, nil, false, err)
+		if errors.Is(err, ErrInvalidExport) {
+			s.writeError(w, http.StatusBadRequest, "handle query: exporting", err)
+			return
+		}
+		s.writeQueryError(w, err)
+		return
+	}
+	rows := int(res.Rows)
+	s.record(r, stmt, started, &rows, false, nil)
+	markAuditRows(r.Context(), rows)
+	s.writeJSON(w, http.StatusOK, "handle query: writing export response", res)
+}
+
+// HandleExport copies the table in the path to Parquet on an object store or the export directory and responds with
+// the manifest of the written files.
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	var req ExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle export: decoding request body", err)
+		return
+	}
+	res, err := s.store.Export(r.Context(), r.PathValue("table"), req)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle export", err)
+	case errors.Is(err, ErrInvalidExport):
+		s.writeError(w, http.StatusBadRequest, "handle export", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle export: writing response", res)
+	}
+}
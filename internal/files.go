@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at the path with the data, see copyFileAtomic.
+func writeFileAtomic(path string, data []byte) error {
+	_, err := copyFileAtomic(path, bytes.NewReader(data))
+	return err
+}
+
+// copyFileAtomic replaces the file at the path with the bytes of r through a temporary file synced before it is
+// renamed, so a failed write or a crash leaves the previous file, if any, in place rather than a partial or empty one.
+// The file is readable by its owner only.
+func copyFileAtomic(path string, r io.Reader) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return 0, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		if removeErr := os.Remove(f.Name()); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			slog.Error("removing temporary file", "path", f.Name(), "err", removeErr)
+		}
+	}()
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		return 0, fmt.Errorf("writing %s: %w", f.Name(), err)
+	}
+	if err = f.Close(); err != nil {
+		return 0, fmt.Errorf("closing %s: %w", f.Name(), err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return 0, fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+)
+
+// SQLPolicy is a firewall for the SQL submitted through the API, checked before it runs. It applies to every request
+// but those of admins, including requests of servers without authentication.
+type SQLPolicy struct {
+	// DenyStatements are the keywords of the statements refused, e.g. ATTACH, PRAGMA or COPY. COPY TO refuses only the
+	// COPY statements writing to a file.
+	DenyStatements []string `json:"deny_statements,omitempty" yaml:"deny_statements"`
+	// DenyFunctions are path.Match patterns of the names of the functions and table functions refused, e.g. read_*,
+	// duckdb_* or getenv.
+	DenyFunctions []string `json:"deny_functions,omitempty" yaml:"deny_functions"`
+	// DenyCrossSchema refuses names qualified by a schema or database other than the main schema of the databases of
+	// the store, e.g. information_schema.tables or an attached database.
+	DenyCrossSchema bool `json:"deny_cross_schema,omitempty" yaml:"deny_cross_schema"`
+}
+
+// SQLPolicyError is returned when a statement breaks the SQLPolicy.
+type SQLPolicyError struct {
+	// Rule is statement, function or schema.
+	Rule string
+	Name string
+}
+
+func (e *SQLPolicyError) Error() string {
+	return fmt.Sprintf("sql policy: %s %s is not allowed", e.Rule, e.Name)
+}
+
+// WithSQLPolicy checks the SQL of the requests against the policy.
+func WithSQLPolicy(policy SQLPolicy) StoreOption {
+	return func(s *Store) {
+		s.sqlPolicy = &policy
+	}
+}
+
+// ValidateSQLPolicy checks the function patterns of the policy.
+func ValidateSQLPolicy(policy SQLPolicy) error {
+	for _, pattern := range policy.DenyFunctions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("sql policy: function %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// denied reports whether the policy refuses the statement by its keyword.
+func (p *SQLPolicy) denied(stmt ClassifiedStatement) bool {
+	for _, keyword := range p.DenyStatements {
+		fields := strings.Fields(strings.ToUpper(keyword))
+		switch {
+		case len(fields) == 1 && fields[0] == stmt.Keyword:
+			return true
+		case len(fields) == 2 && fields[0] == "COPY" && fields[1] == "TO" && stmt.Keyword == "COPY":
+			if copiesTo(stmt.tokens) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copiesTo reports whether the COPY statement writes to a file, i.e. has a TO outside parentheses.
+func copiesTo(tokens []sqlToken) bool {
+	depth := 0
+	for _, t := range tokens {
+		switch {
+		case t.is(sqlPunct, "("):
+			depth++
+		case t.is(sqlPunct, ")"):
+			depth--
+		case depth == 0 && t.is(sqlWord, "TO"):
+			return true
+		}
+	}
+	return false
+}
+
+// deniedFunction returns the first function called by the statement whose name the policy refuses.
+func (p *SQLPolicy) deniedFunction(stmt ClassifiedStatement) (string, bool) {
+	for i, t := range stmt.tokens {
+		if t.kind != sqlWord && t.kind != sqlQuotedIdent || i+1 == len(stmt.tokens) || !stmt.tokens[i+1].is(sqlPunct, "(") {
+			continue
+		}
+		for _, pattern := range p.DenyFunctions {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(t.text)); ok {
+				return t.text, true
+			}
+		}
+	}
+	return "", false
+}
+
+// foreignSchemas returns the lower cased names of the schemas and databases outside the main schemas of the databases
+// of the store.
+func (s *Store) foreignSchemas(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT catalog_name, schema_name, catalog_name IN "+ownCatalogs+
+		" FROM information_schema.schemata")
+	if err != nil {
+		return nil, fmt.Errorf("listing schemas: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := map[string]bool{"information_schema": true, "pg_catalog": true, "system": true, "temp": true}
+	own := make(map[string]bool)
+	for rows.Next() {
+		var (
+			catalog, schema string
+			isOwn           bool
+		)
+		if err = rows.Scan(&catalog, &schema, &isOwn); err != nil {
+			return nil, fmt.Errorf("listing schemas: %w", err)
+		}
+		if isOwn {
+			own[strings.ToLower(catalog)] = true
+		} else {
+			out[strings.ToLower(catalog)] = true
+		}
+		if !strings.EqualFold(schema, "main") {
+			out[strings.ToLower(schema)] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing schemas: %w", err)
+	}
+	// A schema named like a database of the store still qualifies its tables.
+	for name := range own {
+		delete(out, name)
+	}
+	return out, nil
+}
+
+// checkSQLPolicy refuses the query with an SQLPolicyError if a statement breaks the policy of the store.
+func (s *Store) checkSQLPolicy(ctx context.Context, query string) error {
+	if s.sqlPolicy == nil {
+		return nil
+	}
+	if p, ok := requestPrincipal(ctx); ok && slices.Contains(p.Scopes, ScopeAdmin) {
+		return nil
+	}
+	stmts, err := ClassifySQL(query)
+	if err != nil {
+		return err
+	}
+	var foreign map[string]bool
+	if s.sqlPolicy.DenyCrossSchema {
+		if foreign, err = s.foreignSchemas(ctx); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range stmts {
+		if s.sqlPolicy.denied(stmt) {
+			return &SQLPolicyError{Rule: "statement", Name: stmt.Keyword}
+		}
+		if name, ok := s.sqlPolicy.deniedFunction(stmt); ok {
+			return &SQLPolicyError{Rule: "function", Name: name}
+		}
+		for i, t := range stmt.tokens {
+			if t.kind != sqlWord && t.kind != sqlQuotedIdent || !foreign[strings.ToLower(t.text)] {
+				continue
+			}
+			if i+1 < len(stmt.tokens) && stmt.tokens[i+1].is(sqlPunct, ".") {
+				return &SQLPolicyError{Rule: "schema", Name: t.text}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,706 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/flight"
+	"github.com/apache/arrow/go/v14/arrow/flight/flightsql"
+	"github.com/apache/arrow/go/v14/arrow/flight/flightsql/schema_ref"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// maxPreparedStatements bounds the prepared statements clients left open.
+const maxPreparedStatements = 4096
+
+// tableTypes are the table types of DuckDB's information_schema.tables.
+var tableTypes = []string{"BASE TABLE", "LOCAL TEMPORARY", "VIEW"}
+
+// FlightSQL serves the store over Arrow Flight SQL, so drivers such as ADBC and the Flight SQL JDBC driver read results
+// as Arrow record batches straight from DuckDB. Queries are checked like those of POST /query, statements that write
+// need the admin scope like POST /admin/query.
+type FlightSQL struct {
+	flightsql.BaseServer
+	server *Server
+
+	mu       sync.Mutex
+	prepared map[string]*preparedStatement
+}
+
+type preparedStatement struct {
+	query string
+	// caller is the principal that prepared the statement, the only one allowed to use it.
+	caller string
+	params []any
+}
+
+// NewFlightSQLServer returns a gRPC server serving Flight SQL, authenticating the calls with the API keys, tokens and
+// client certificates of the server. Pass grpc.Creds to serve TLS.
+func (s *Server) NewFlightSQLServer(opts ...grpc.ServerOption) (*grpc.Server, error) {
+	f := &FlightSQL{server: s, prepared: make(map[string]*preparedStatement)}
+	f.Alloc = memory.DefaultAllocator
+	for id, v := range map[flightsql.SqlInfo]any{
+		flightsql.SqlInfoFlightSqlServerName:        "scratch",
+		flightsql.SqlInfoFlightSqlServerReadOnly:    s.follower != nil,
+		flightsql.SqlInfoFlightSqlServerSql:         true,
+		flightsql.SqlInfoFlightSqlServerSubstrait:   false,
+		flightsql.SqlInfoFlightSqlServerTransaction: int32(flightsql.SqlTransactionNone),
+		flightsql.SqlInfoFlightSqlServerCancel:      false,
+	} {
+		if err := f.RegisterSqlInfo(id, v); err != nil {
+			return nil, fmt.Errorf("flight sql: %w", err)
+		}
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(func(
+			ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+		) (any, error) {
+			ctx, err := s.flightAuthenticate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(
+			srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler,
+		) error {
+			ctx, err := s.flightAuthenticate(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &flightStream{ServerStream: stream, ctx: ctx})
+		}),
+	)
+	g := grpc.NewServer(opts...)
+	flight.RegisterFlightServiceServer(g, flightsql.NewFlightServer(f))
+	return g, nil
+}
+
+// flightStream replaces the context of a stream with the authenticated one.
+type flightStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *flightStream) Context() context.Context {
+	return s.ctx
+}
+
+// flightAuthenticate adds the principal of the call to the context, from its client certificate or the bearer token
+// of its authorization metadata. Calls need no credentials when the HTTP API needs none.
+func (s *Server) flightAuthenticate(ctx context.Context) (context.Context, error) {
+	if s.apiKeys == nil && s.jwt == nil && len(s.clientCerts) == 0 {
+		return ctx, nil
+	}
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	p, err := s.authenticateCredentials(ctx, state, authorization)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !p.has(ScopeQuery) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s: %s", ErrScopeRequired, ScopeQuery)
+	}
+	return context.WithValue(ctx, principalContextKey{}, p), nil
+}
+
+// flightError returns the gRPC status of the error, with the codes matching the statuses of writeQueryError.
+func flightError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var (
+		readOnlyErr *ReadOnlyError
+		policyErr   *SQLPolicyError
+	)
+	switch {
+	case errors.As(err, &readOnlyErr), errors.As(err, &policyErr), errors.Is(err, ErrTableAccessDenied),
+		errors.Is(err, ErrScopeRequired):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrFollowerReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrNotLeader):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, ErrTooManyQueries):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrTableNotFound), missingTableRegex.MatchString(err.Error()):
+		return status.Error(codes.NotFound, err.Error())
+	case serverFaultRegex.MatchString(err.Error()):
+		return status.Error(codes.Internal, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+// flightCaller returns the name of the principal of the call, empty without authentication.
+func flightCaller(ctx context.Context) string {
+	p, _ := requestPrincipal(ctx)
+	return p.Name
+}
+
+// checkWrite refuses writes to followers and writes of callers without the admin scope.
+func (f *FlightSQL) checkWrite(ctx context.Context) error {
+	if f.server.follower != nil {
+		return flightError(fmt.Errorf("%w at %s", ErrFollowerReadOnly, f.server.follower.leader.Redacted()))
+	}
+	if p, ok := requestPrincipal(ctx); ok && !p.has(ScopeAdmin) {
+		return flightError(fmt.Errorf("%w: %s", ErrScopeRequired, ScopeAdmin))
+	}
+	return nil
+}
+
+// flightRequest returns the request the query paths of the HTTP API take for the call: it carries the context of the
+// call, the address of its peer and the query tag of its x-query-tag metadata, see QueryTagHeader.
+func flightRequest(ctx context.Context) *http.Request {
+	r := (&http.Request{Method: http.MethodPost, URL: &url.URL{}, Header: make(http.Header)}).WithContext(ctx)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(QueryTagHeader); len(values) > 0 {
+			r.Header.Set(QueryTagHeader, values[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// flightStatuses are the statuses of writeQueryError matching the gRPC codes of flightError, for the audit log.
+var flightStatuses = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.FailedPrecondition: http.StatusForbidden,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.NotFound:           http.StatusNotFound,
+	codes.Internal:           http.StatusInternalServerError,
+}
+
+// audit records the call in the audit log like auditRequests records the requests of the HTTP API. Rows are negative
+// when unknown.
+func (f *FlightSQL) audit(r *http.Request, stmt *QueryStatement, started time.Time, rows int64, err error) {
+	if f.server.store.audit == nil {
+		return
+	}
+	code, ok := flightStatuses[status.Code(flightError(err))]
+	if !ok {
+		code = http.StatusBadRequest
+	}
+	// Calls with an invalid tag are recorded without it.
+	tag, _ := queryTag(r)
+	if auditErr := f.server.store.recordAudit(context.WithoutCancel(r.Context()), AuditEntry{
+		Time:     started,
+		Caller:   caller(r),
+		Kind:     AuditQuery,
+		Target:   stmt.Query,
+		Rows:     rows,
+		Duration: time.Since(started),
+		Status:   code,
+		Tag:      tag,
+	}); auditErr != nil {
+		slog.Error("recording audit entry", "err", auditErr)
+	}
+}
+
+// stream runs the read-only query and streams its records. It returns once the schema is known or the query failed.
+// The query is bounded by the result limits and the timeout of the server and, like those of the HTTP API, listed
+// among the in-flight queries and recorded in the history and the audit log. The driver doesn't interrupt Arrow
+// queries, a query killed or timed out while DuckDB executes it fails once the execution finished.
+func (f *FlightSQL) stream(
+	ctx context.Context, query string, params []any,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	r := flightRequest(ctx)
+	stmt := &QueryStatement{Query: query, Params: params}
+	f.server.requestResultLimits(ctx).apply(stmt)
+	started := time.Now()
+	ctx, cancel, err := f.server.queryContext(r, stmt)
+	if err != nil {
+		f.audit(r, stmt, started, -1, err)
+		return nil, nil, flightError(err)
+	}
+	r = r.WithContext(ctx)
+	schemas := make(chan *arrow.Schema, 1)
+	failed := make(chan error, 1)
+	ch := make(chan flight.StreamChunk)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		streaming := false
+		rows := 0
+		err := f.server.store.queryArrow(ctx, stmt, func(reader array.RecordReader) error {
+			streaming = true
+			schemas <- reader.Schema()
+			for (stmt.MaxRows <= 0 || rows < stmt.MaxRows) && reader.Next() {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				rec := reader.Record()
+				if left := stmt.MaxRows - rows; stmt.MaxRows > 0 && rec.NumRows() > int64(left) {
+					rec = rec.NewSlice(0, int64(left))
+				} else {
+					rec.Retain()
+				}
+				rows += int(rec.NumRows())
+				select {
+				case ch <- flight.StreamChunk{Data: rec}:
+				case <-ctx.Done():
+					rec.Release()
+					return ctx.Err()
+				}
+			}
+			return reader.Err()
+		})
+		if err != nil {
+			f.server.record(r, stmt, started, nil, false, err)
+			f.audit(r, stmt, started, -1, err)
+		} else {
+			f.server.record(r, stmt, started, &rows, false, nil)
+			f.audit(r, stmt, started, int64(rows), nil)
+		}
+		if !streaming {
+			failed <- err
+			return
+		}
+		if err != nil {
+			select {
+			case ch <- flight.StreamChunk{Err: flightError(err)}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	select {
+	case schema := <-schemas:
+		return schema, ch, nil
+	case err := <-failed:
+		return nil, nil, flightError(err)
+	}
+}
+
+// update runs the statement and returns the number of rows it changed. It goes through the same timeout, concurrency
+// limit, in-flight list, history and audit log as the queries of stream.
+func (f *FlightSQL) update(ctx context.Context, query string, params []any) (int64, error) {
+	if err := f.checkWrite(ctx); err != nil {
+		return 0, err
+	}
+	r := flightRequest(ctx)
+	stmt := &QueryStatement{Query: query, Params: params, AllowWrites: true}
+	f.server.requestResultLimits(ctx).apply(stmt)
+	started := time.Now()
+	ctx, cancel, err := f.server.queryContext(r, stmt)
+	if err != nil {
+		f.audit(r, stmt, started, -1, err)
+		return 0, flightError(err)
+	}
+	defer cancel()
+	res, _, err := f.server.fetch(r.WithContext(ctx), stmt, nil)
+	if err != nil {
+		f.audit(r, stmt, started, -1, err)
+		return 0, flightError(err)
+	}
+	var n int64
+	// DuckDB answers inserts, updates and deletes with the number of changed rows in a Count column.
+	if len(res.Columns) == 1 && res.Columns[0].Name == "Count" && len(res.Rows) == 1 {
+		n, _ = res.Rows[0]["Count"].(int64)
+	}
+	f.audit(r, stmt, started, n, nil)
+	return n, nil
+}
+
+func (f *FlightSQL) flightInfo(desc *flight.FlightDescriptor, ticket []byte, schema *arrow.Schema) *flight.FlightInfo {
+	info := &flight.FlightInfo{
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: ticket}}},
+		FlightDescriptor: desc,
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}
+	if schema != nil {
+		info.Schema = flight.SerializeSchema(schema, f.Alloc)
+	}
+	return info
+}
+
+func (f *FlightSQL) GetFlightInfoStatement(
+	ctx context.Context, cmd flightsql.StatementQuery, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	if err := CheckReadOnly(cmd.GetQuery()); err != nil {
+		return nil, flightError(err)
+	}
+	ticket, err := flightsql.CreateStatementQueryTicket([]byte(cmd.GetQuery()))
+	if err != nil {
+		return nil, err
+	}
+	return f.flightInfo(desc, ticket, nil), nil
+}
+
+func (f *FlightSQL) DoGetStatement(
+	ctx context.Context, cmd flightsql.StatementQueryTicket,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	return f.stream(ctx, string(cmd.GetStatementHandle()), nil)
+}
+
+func (f *FlightSQL) DoPutCommandStatementUpdate(ctx context.Context, cmd flightsql.StatementUpdate) (int64, error) {
+	return f.update(ctx, cmd.GetQuery(), nil)
+}
+
+func (f *FlightSQL) CreatePreparedStatement(
+	ctx context.Context, req flightsql.ActionCreatePreparedStatementRequest,
+) (flightsql.ActionCreatePreparedStatementResult, error) {
+	var res flightsql.ActionCreatePreparedStatementResult
+	if CheckReadOnly(req.GetQuery()) != nil {
+		if err := f.checkWrite(ctx); err != nil {
+			return res, err
+		}
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return res, fmt.Errorf("generating handle: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.prepared) >= maxPreparedStatements {
+		return res, status.Errorf(codes.ResourceExhausted, "more than %d open prepared statements",
+			maxPreparedStatements)
+	}
+	handle := hex.EncodeToString(b)
+	f.prepared[handle] = &preparedStatement{query: req.GetQuery(), caller: flightCaller(ctx)}
+	res.Handle = []byte(handle)
+	return res, nil
+}
+
+// preparedStatement returns the prepared statement of the handle if the caller prepared it.
+func (f *FlightSQL) preparedStatement(ctx context.Context, handle []byte) (*preparedStatement, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stmt, ok := f.prepared[string(handle)]
+	if !ok || stmt.caller != flightCaller(ctx) {
+		return nil, status.Error(codes.NotFound, "prepared statement not found")
+	}
+	return stmt, nil
+}
+
+func (f *FlightSQL) ClosePreparedStatement(
+	ctx context.Context, req flightsql.ActionClosePreparedStatementRequest,
+) error {
+	if _, err := f.preparedStatement(ctx, req.GetPreparedStatementHandle()); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.prepared, string(req.GetPreparedStatementHandle()))
+	return nil
+}
+
+func (f *FlightSQL) GetFlightInfoPreparedStatement(
+	ctx context.Context, cmd flightsql.PreparedStatementQuery, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	if _, err := f.preparedStatement(ctx, cmd.GetPreparedStatementHandle()); err != nil {
+		return nil, err
+	}
+	return f.flightInfo(desc, desc.Cmd, nil), nil
+}
+
+func (f *FlightSQL) DoGetPreparedStatement(
+	ctx context.Context, cmd flightsql.PreparedStatementQuery,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	stmt, err := f.preparedStatement(ctx, cmd.GetPreparedStatementHandle())
+	if err != nil {
+		return nil, nil, err
+	}
+	f.mu.Lock()
+	params := stmt.params
+	f.mu.Unlock()
+	return f.stream(ctx, stmt.query, params)
+}
+
+// DoPutPreparedStatementQuery binds the parameters of a prepared query, a single row of them.
+func (f *FlightSQL) DoPutPreparedStatementQuery(
+	ctx context.Context, cmd flightsql.PreparedStatementQuery, reader flight.MessageReader, _ flight.MetadataWriter,
+) error {
+	stmt, err := f.preparedStatement(ctx, cmd.GetPreparedStatementHandle())
+	if err != nil {
+		return err
+	}
+	rows, err := readParams(reader)
+	if err != nil {
+		return err
+	}
+	if len(rows) > 1 {
+		return status.Error(codes.InvalidArgument, "queries bind a single row of parameters")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stmt.params = nil
+	if len(rows) == 1 {
+		stmt.params = rows[0]
+	}
+	return nil
+}
+
+// DoPutPreparedStatementUpdate runs a prepared statement once for every row of parameters, or once without any.
+func (f *FlightSQL) DoPutPreparedStatementUpdate(
+	ctx context.Context, cmd flightsql.PreparedStatementUpdate, reader flight.MessageReader,
+) (int64, error) {
+	stmt, err := f.preparedStatement(ctx, cmd.GetPreparedStatementHandle())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := readParams(reader)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return f.update(ctx, stmt.query, nil)
+	}
+	var total int64
+	for _, params := range rows {
+		n, updateErr := f.update(ctx, stmt.query, params)
+		if updateErr != nil {
+			return total, updateErr
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// readParams reads the rows of parameters a client binds to a prepared statement.
+func readParams(reader flight.MessageReader) ([][]any, error) {
+	var rows [][]any
+	for reader.Next() {
+		rec := reader.Record()
+		for i := 0; i < int(rec.NumRows()); i++ {
+			params := make([]any, rec.NumCols())
+			for j, col := range rec.Columns() {
+				params[j] = col.GetOneForMarshal(i)
+			}
+			rows = append(rows, params)
+		}
+	}
+	if err := reader.Err(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "reading parameters: %s", err)
+	}
+	return rows, nil
+}
+
+func (f *FlightSQL) GetFlightInfoCatalogs(
+	_ context.Context, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	return f.flightInfo(desc, desc.Cmd, schema_ref.Catalogs), nil
+}
+
+func (f *FlightSQL) DoGetCatalogs(ctx context.Context) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	rows, err := f.metadataRows(ctx,
+		"SELECT DISTINCT table_catalog FROM information_schema.tables WHERE table_catalog IN "+ownCatalogs+" ORDER BY 1")
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.metadataRecord(schema_ref.Catalogs, rows)
+}
+
+func (f *FlightSQL) GetFlightInfoSchemas(
+	_ context.Context, _ flightsql.GetDBSchemas, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	return f.flightInfo(desc, desc.Cmd, schema_ref.DBSchemas), nil
+}
+
+func (f *FlightSQL) DoGetDBSchemas(
+	ctx context.Context, cmd flightsql.GetDBSchemas,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	where, args := metadataFilters(cmd.GetCatalog(), cmd.GetDBSchemaFilterPattern(), nil, nil)
+	rows, err := f.metadataRows(ctx,
+		"SELECT DISTINCT table_catalog, table_schema FROM information_schema.tables WHERE "+where+" ORDER BY 1, 2",
+		args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.metadataRecord(schema_ref.DBSchemas, rows)
+}
+
+func (f *FlightSQL) GetFlightInfoTables(
+	_ context.Context, cmd flightsql.GetTables, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	schema := schema_ref.Tables
+	if cmd.GetIncludeSchema() {
+		schema = schema_ref.TablesWithIncludedSchema
+	}
+	return f.flightInfo(desc, desc.Cmd, schema), nil
+}
+
+// DoGetTables lists the tables the caller may read.
+func (f *FlightSQL) DoGetTables(
+	ctx context.Context, cmd flightsql.GetTables,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	where, args := metadataFilters(
+		cmd.GetCatalog(), cmd.GetDBSchemaFilterPattern(), cmd.GetTableNameFilterPattern(), cmd.GetTableTypes(),
+	)
+	rows, err := f.metadataRows(ctx, "SELECT table_catalog, table_schema, table_name, table_type "+
+		"FROM information_schema.tables WHERE "+where+" ORDER BY 1, 2, 3", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	readable := rows[:0]
+	for _, row := range rows {
+		if f.server.store.checkTableAccess(ctx, row[2], false) == nil {
+			readable = append(readable, row)
+		}
+	}
+	if !cmd.GetIncludeSchema() {
+		return f.metadataRecord(schema_ref.Tables, readable)
+	}
+	schemas := make([][]byte, len(readable))
+	for i, row := range readable {
+		if schemas[i], err = f.tableSchema(ctx, row[0], row[1], row[2]); err != nil {
+			return nil, nil, err
+		}
+	}
+	b := array.NewRecordBuilder(f.Alloc, schema_ref.TablesWithIncludedSchema)
+	defer b.Release()
+	for i, row := range readable {
+		for j, v := range row {
+			b.Field(j).(*array.StringBuilder).Append(v)
+		}
+		b.Field(len(row)).(*array.BinaryBuilder).Append(schemas[i])
+	}
+	return singleChunk(schema_ref.TablesWithIncludedSchema, b.NewRecord())
+}
+
+// tableSchema returns the serialized Arrow schema of the table as the principal of the call reads it, masked columns
+// included.
+func (f *FlightSQL) tableSchema(ctx context.Context, catalog, schema, table string) ([]byte, error) {
+	var out []byte
+	ref, err := f.server.store.tableRef(ctx, catalog, schema, table)
+	if err != nil {
+		return nil, flightError(err)
+	}
+	query := "SELECT * FROM " + ref + " LIMIT 0"
+	err = f.server.store.queryArrow(ctx, &QueryStatement{Query: query}, func(reader array.RecordReader) error {
+		out = flight.SerializeSchema(reader.Schema(), f.Alloc)
+		return nil
+	})
+	if err != nil {
+		return nil, flightError(err)
+	}
+	return out, nil
+}
+
+func (f *FlightSQL) GetFlightInfoTableTypes(
+	_ context.Context, desc *flight.FlightDescriptor,
+) (*flight.FlightInfo, error) {
+	return f.flightInfo(desc, desc.Cmd, schema_ref.TableTypes), nil
+}
+
+func (f *FlightSQL) DoGetTableTypes(context.Context) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	rows := make([][]string, len(tableTypes))
+	for i, t := range tableTypes {
+		rows[i] = []string{t}
+	}
+	return f.metadataRecord(schema_ref.TableTypes, rows)
+}
+
+// metadataFilters returns the conditions on information_schema.tables of the catalog, the LIKE patterns of the schema
+// and table names and the table types of a metadata command. Unset filters match everything in the own catalogs.
+func metadataFilters(catalog, schemaPattern, tablePattern *string, types []string) (string, []any) {
+	where := []string{"table_catalog IN " + ownCatalogs}
+	var args []any
+	if catalog != nil {
+		where, args = append(where, "table_catalog = ?"), append(args, *catalog)
+	}
+	if schemaPattern != nil && *schemaPattern != "" {
+		where, args = append(where, "table_schema LIKE ?"), append(args, *schemaPattern)
+	}
+	if tablePattern != nil && *tablePattern != "" {
+		where, args = append(where, "table_name LIKE ?"), append(args, *tablePattern)
+	}
+	if len(types) > 0 {
+		where = append(where, "table_type IN (?"+strings.Repeat(", ?", len(types)-1)+")")
+		for _, t := range types {
+			args = append(args, t)
+		}
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// metadataRows returns the rows of the catalog query, whose columns are all strings.
+func (f *FlightSQL) metadataRows(ctx context.Context, query string, args ...any) ([][]string, error) {
+	rows, err := f.server.store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, flightError(fmt.Errorf("reading catalog: %w", err))
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, flightError(fmt.Errorf("reading catalog: %w", err))
+	}
+	var out [][]string
+	for rows.Next() {
+		row := make([]string, len(cols))
+		dest := make([]any, len(cols))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, flightError(fmt.Errorf("reading catalog: %w", err))
+		}
+		out = append(out, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, flightError(fmt.Errorf("reading catalog: %w", err))
+	}
+	return out, nil
+}
+
+// metadataRecord returns the rows as a single record of the schema, whose fields are all strings.
+func (f *FlightSQL) metadataRecord(
+	schema *arrow.Schema, rows [][]string,
+) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	b := array.NewRecordBuilder(f.Alloc, schema)
+	defer b.Release()
+	for _, row := range rows {
+		for i, v := range row {
+			b.Field(i).(*array.StringBuilder).Append(v)
+		}
+	}
+	return singleChunk(schema, b.NewRecord())
+}
+
+func singleChunk(schema *arrow.Schema, rec arrow.Record) (*arrow.Schema, <-chan flight.StreamChunk, error) {
+	ch := make(chan flight.StreamChunk, 1)
+	ch <- flight.StreamChunk{Data: rec}
+	close(ch)
+	return schema, ch, nil
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GeometryParam names the GEOMETRY column of the geojson format, geometry by default.
+const GeometryParam = "geometry"
+
+// defaultGeometryColumn is the geometry column of the geojson format unless GeometryParam names another.
+const defaultGeometryColumn = "geometry"
+
+// geoJSONDepths is the nesting depth of the coordinates of the GeoJSON geometry types, 0 for a single position.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var geoJSONDepths = map[string]int{
+	"Point":           0,
+	"MultiPoint":      1,
+	"LineString":      1,
+	"MultiLineString": 2,
+	"Polygon":         2,
+	"MultiPolygon":    3,
+}
+
+// decodeGeometries replaces the values sent for the columns declared GEOMETRY in the table configuration by their
+// WKT, which DuckDB's spatial extension casts to the column type. Columns take WKT as is, GeoJSON geometries and
+// objects of lat and lon, or lng, which are stored as points.
+func (s *InsertStatement) decodeGeometries(cfg TableConfig) error {
+	geometries := make(map[string]bool)
+	for _, c := range cfg.Columns {
+		if ParseDataType(c.Type) == GEOMETRY {
+			geometries[strings.ToLower(c.Name)] = true
+		}
+	}
+	if len(geometries) == 0 {
+		return nil
+	}
+	for _, row := range s.rows() {
+		for k, v := range row {
+			if v == nil || !geometries[strings.ToLower(k)] {
+				continue
+			}
+			wkt, err := geometryWKT(v)
+			if err != nil {
+				return fmt.Errorf("%w: column %s: %w", ErrInvalidInsert, k, err)
+			}
+			row[k] = wkt
+		}
+	}
+	return nil
+}
+
+// geometryWKT returns the WKT of a value sent for a GEOMETRY column.
+func geometryWKT(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case map[string]any:
+		if _, ok := v["type"]; ok {
+			return geoJSONWKT(v)
+		}
+		lat, latOK := v["lat"].(float64)
+		lon, lonOK := v["lon"].(float64)
+		if !lonOK {
+			lon, lonOK = v["lng"].(float64)
+		}
+		if !latOK || !lonOK {
+			return "", errors.New("expected WKT, a GeoJSON geometry or an object of lat and lon")
+		}
+		return "POINT (" + formatCoordinate(lon) + " " + formatCoordinate(lat) + ")", nil
+	default:
+		return "", fmt.Errorf("%T value is no geometry", v)
+	}
+}
+
+// geoJSONWKT converts the GeoJSON geometry to WKT.
+func geoJSONWKT(geometry map[string]any) (string, error) {
+	kind, _ := geometry["type"].(string)
+	if kind == "GeometryCollection" {
+		members, ok := geometry["geometries"].([]any)
+		if !ok {
+			return "", errors.New("GeoJSON GeometryCollection without geometries")
+		}
+		if len(members) == 0 {
+			return "GEOMETRYCOLLECTION EMPTY", nil
+		}
+		wkts := make([]string, len(members))
+		for i, member := range members {
+			m, ok := member.(map[string]any)
+			if !ok {
+				return "", fmt.Errorf("GeoJSON GeometryCollection member %d is no geometry", i)
+			}
+			wkt, err := geoJSONWKT(m)
+			if err != nil {
+				return "", err
+			}
+			wkts[i] = wkt
+		}
+		return "GEOMETRYCOLLECTION (" + strings.Join(wkts, ", ") + ")", nil
+	}
+	depth, ok := geoJSONDepths[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown GeoJSON geometry type %q", kind)
+	}
+	items, ok := geometry["coordinates"].([]any)
+	if !ok {
+		return "", fmt.Errorf("GeoJSON %s without coordinates", kind)
+	}
+	if len(items) == 0 {
+		return strings.ToUpper(kind) + " EMPTY", nil
+	}
+	coords, err := wktCoordinates(items, depth)
+	if err != nil {
+		return "", fmt.Errorf("GeoJSON %s: %w", kind, err)
+	}
+	if depth == 0 {
+		coords = "(" + coords + ")"
+	}
+	return strings.ToUpper(kind) + " " + coords, nil
+}
+
+// wktCoordinates writes the GeoJSON coordinates of the depth as the WKT coordinate list, parenthesized unless it is a
+// single position.
+func wktCoordinates(v any, depth int) (string, error) {
+	items, ok := v.([]any)
+	if !ok {
+		return "", errors.New("coordinates must be arrays")
+	}
+	parts := make([]string, len(items))
+	if depth == 0 {
+		if len(items) < 2 {
+			return "", errors.New("positions need at least two coordinates")
+		}
+		for i, item := range items {
+			c, ok := item.(float64)
+			if !ok {
+				return "", fmt.Errorf("coordinate %v is no number", item)
+			}
+			parts[i] = formatCoordinate(c)
+		}
+		return strings.Join(parts, " "), nil
+	}
+	for i, item := range items {
+		part, err := wktCoordinates(item, depth-1)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = part
+	}
+	return "(" + strings.Join(parts, ", ") + ")", nil
+}
+
+func formatCoordinate(c float64) string {
+	return strconv.FormatFloat(c, 'f', -1, 64)
+}
+
+// withGeoJSON rewrites the query to return the GEOMETRY column as GeoJSON text, which the geojson format embeds as
+// the geometry of the features.
+func (s *QueryStatement) withGeoJSON(column string) error {
+	query, err := s.singleRead()
+	if err != nil {
+		return err
+	}
+	s.Query = fmt.Sprintf(
+		"SELECT * REPLACE (ST_AsGeoJSON(%s) AS %s) FROM (\n%s\n)",
+		quoteIdent(column), quoteIdent(column), query,
+	)
+	return nil
+}
+
+// geoJSONRows writes the rows as a GeoJSON FeatureCollection, each row a feature with the geometry column as its
+// geometry and the other columns as its properties.
+type geoJSONRows struct {
+	w        io.Writer
+	geometry string
+	bigints  bool
+	rows     int
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	Geometry   json.RawMessage `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+func (g *geoJSONRows) begin([]Column) error {
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJSONRows) row(row map[string]any) error {
+	feature := geoJSONFeature{Type: "Feature", Geometry: json.RawMessage("null")}
+	feature.Properties = make(map[string]any, len(row))
+	for k, v := range row {
+		if k != g.geometry {
+			feature.Properties[k] = v
+		} else if text, ok := v.(string); ok {
+			feature.Geometry = json.RawMessage(text)
+		}
+	}
+	if g.bigints {
+		feature.Properties = bigIntStrings(feature.Properties)
+	}
+	out, err := json.Marshal(feature)
+	if err != nil {
+		return fmt.Errorf("marshalling feature: %w", err)
+	}
+	sep := ","
+	if g.rows == 0 {
+		sep = ""
+	}
+	g.rows++
+	_, err = io.WriteString(g.w, sep+string(out))
+	return err
+}
+
+func (g *geoJSONRows) end(*QueryResult, int) error {
+	_, err := io.WriteString(g.w, "]}")
+	return err
+}
@@ -0,0 +1,1125 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// GraphQLPath serves the GraphQL API generated from the tables.
+const GraphQLPath = "/graphql"
+
+// ErrGraphQLInvalid is returned for GraphQL documents that don't fit the schema, e.g. unknown fields or arguments.
+var ErrGraphQLInvalid = errors.New("invalid graphql request")
+
+//nolint:gochecknoglobals // Compiled once.
+var gqlNameRegex = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// GraphQLRequest is the body of POST /graphql, or the parameters of GET /graphql with the variables as JSON.
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// GraphQLResponse holds the data of the root fields that ran, null for those that failed, and the errors.
+type GraphQLResponse struct {
+	Data   any            `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+type GraphQLError struct {
+	Message string `json:"message"`
+	// Path is the response key of the root field that failed, empty for errors of the whole request.
+	Path []any `json:"path,omitempty"`
+}
+
+// HandleGraphQL runs a GraphQL query against the schema generated from the tables the caller may read. Every table is
+// a root field taking where, order_by, limit and offset, and has a <table>_aggregate field with count, sum, avg, min
+// and max, grouped by the columns of group_by. The schema can be introspected.
+func (s *Server) HandleGraphQL(w http.ResponseWriter, r *http.Request) {
+	req := &GraphQLRequest{}
+	var err error
+	if r.Method == http.MethodGet {
+		params := r.URL.Query()
+		req.Query, req.OperationName = params.Get("query"), params.Get("operationName")
+		if v := params.Get("variables"); v != "" {
+			err = json.Unmarshal([]byte(v), &req.Variables)
+		}
+	} else {
+		s.limitBody(w, r)
+		var body bytes.Buffer
+		if _, err = body.ReadFrom(r.Body); err == nil {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+				req.Query = body.String()
+			} else {
+				err = json.Unmarshal(body.Bytes(), req)
+			}
+		}
+	}
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, "handle graphql: writing response", &GraphQLResponse{
+			Errors: []GraphQLError{{Message: "decoding request: " + err.Error()}},
+		})
+		return
+	}
+	res, code := s.graphQL(r, req)
+	s.writeJSON(w, code, "handle graphql: writing response", res)
+}
+
+// graphQL executes the request, answering 400 for documents that can't be executed at all.
+func (s *Server) graphQL(r *http.Request, req *GraphQLRequest) (*GraphQLResponse, int) {
+	fail := func(code int, err error) (*GraphQLResponse, int) {
+		if code >= http.StatusInternalServerError {
+			slog.Error("handle graphql", "err", err)
+		}
+		return &GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}, code
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return fail(http.StatusBadRequest, err)
+	}
+	schema, err := s.graphQLSchema(r.Context())
+	if err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	markAudit(r.Context(), AuditQuery, req.Query)
+	e := &gqlExecution{server: s, r: r, schema: schema, doc: doc, vars: make(map[string]any)}
+	for _, def := range op.variables {
+		v, ok := req.Variables[def.name]
+		if !ok && def.hasDefault {
+			v, _ = e.resolve(def.def)
+		}
+		e.vars[def.name] = v
+	}
+	data := e.execute(op)
+	markAuditRows(r.Context(), e.rows)
+	return &GraphQLResponse{Data: data, Errors: e.errors}, http.StatusOK
+}
+
+// operation returns the operation of the name, which may be empty if the document has only one.
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	var op *gqlOperation
+	switch {
+	case name != "":
+		for _, o := range d.operations {
+			if o.name == name {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, fmt.Errorf("%w: no operation %s", ErrGraphQLInvalid, name)
+		}
+	case len(d.operations) > 1:
+		return nil, fmt.Errorf("%w: operationName is required for documents with several operations", ErrGraphQLInvalid)
+	default:
+		op = d.operations[0]
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%w: only queries are supported, not %ss", ErrGraphQLInvalid, op.kind)
+	}
+	return op, nil
+}
+
+// gqlType is a type of the schema. Lists and non-null types wrap the type of ofType.
+type gqlType struct {
+	kind        string
+	name        string
+	description string
+	fields      []*gqlField
+	inputFields []*gqlField
+	enumValues  []string
+	ofType      *gqlType
+}
+
+// gqlField is a field of an object type, an argument or a field of an input type.
+type gqlField struct {
+	name        string
+	description string
+	args        []*gqlField
+	typ         *gqlType
+}
+
+func findGQLField(fields []*gqlField, name string) *gqlField {
+	for _, f := range fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func nonNull(t *gqlType) *gqlType {
+	return &gqlType{kind: "NON_NULL", ofType: t}
+}
+
+func listOf(t *gqlType) *gqlType {
+	return &gqlType{kind: "LIST", ofType: t}
+}
+
+// gqlRoot is a root field reading a table.
+type gqlRoot struct {
+	table string
+	// columns maps the columns with GraphQL names to their scalar type.
+	columns   map[string]string
+	aggregate bool
+}
+
+type gqlSchema struct {
+	types map[string]*gqlType
+	// names are the names of the types in the order they were added.
+	names []string
+	query *gqlType
+	roots map[string]*gqlRoot
+	// values are the introspection values of the named types, built on demand.
+	values map[string]map[string]any
+}
+
+// gqlColumnScalar returns the scalar of the DuckDB type. JSON covers lists, structs, maps and everything else without
+// a better fit, the date and time types are strings.
+func gqlColumnScalar(duckType string) string {
+	switch t := strings.ToUpper(duckType); {
+	case t == "BOOLEAN":
+		return "Boolean"
+	case t == "TINYINT" || t == "SMALLINT" || t == "INTEGER" || t == "UTINYINT" || t == "USMALLINT":
+		return "Int"
+	case t == "BIGINT" || t == "HUGEINT" || t == "UINTEGER" || t == "UBIGINT":
+		return "BigInt"
+	case t == "FLOAT" || t == "DOUBLE" || strings.HasPrefix(t, "DECIMAL"):
+		return "Float"
+	case t == "VARCHAR" || t == "UUID" || t == "DATE" || t == "INTERVAL" || strings.HasPrefix(t, "TIME"):
+		return "String"
+	default:
+		return "JSON"
+	}
+}
+
+// graphQLSchema generates the schema of the tables the caller may read. Columns whose names aren't GraphQL names are
+// left out, as are tables whose generated types collide with those of another.
+func (s *Server) graphQLSchema(ctx context.Context) (*gqlSchema, error) {
+	tables, err := s.store.readableTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc := newGQLSchema()
+	for _, t := range tables {
+		root := &gqlRoot{table: t.Table, columns: make(map[string]string)}
+		var columns []string
+		for _, col := range t.Columns {
+			if gqlNameRegex.MatchString(col.Name) && !strings.HasPrefix(col.Name, "__") && root.columns[col.Name] == "" {
+				root.columns[col.Name] = gqlColumnScalar(col.Type)
+				columns = append(columns, col.Name)
+			}
+		}
+		if !strings.HasPrefix(t.Table, "__") && len(columns) > 0 {
+			sc.addTable(root, columns)
+		}
+	}
+	sc.add(sc.query)
+	return sc, nil
+}
+
+// newGQLSchema returns the schema of the scalars and the introspection types, with a query type without fields.
+func newGQLSchema() *gqlSchema {
+	sc := &gqlSchema{
+		types:  make(map[string]*gqlType),
+		query:  &gqlType{kind: "OBJECT", name: "Query"},
+		roots:  make(map[string]*gqlRoot),
+		values: make(map[string]map[string]any),
+	}
+	for _, scalar := range [][2]string{
+		{"Int", "A signed 32 bit integer."},
+		{"Float", "A double precision number, also used for decimals."},
+		{"String", "A UTF-8 string, also used for dates, times and intervals."},
+		{"Boolean", ""},
+		{"BigInt", "An integer beyond 32 bits."},
+		{"JSON", "Lists, structs, maps and the other values without a better fit, as JSON."},
+	} {
+		sc.add(&gqlType{kind: "SCALAR", name: scalar[0], description: scalar[1]})
+	}
+	sc.add(&gqlType{kind: "ENUM", name: "order_by", enumValues: []string{"asc", "desc"}})
+	for _, scalar := range []string{"Int", "Float", "String", "Boolean", "BigInt"} {
+		t := sc.types[scalar]
+		exp := &gqlType{kind: "INPUT_OBJECT", name: scalar + "_comparison_exp"}
+		for _, op := range []string{"eq", "ne", "lt", "lte", "gt", "gte"} {
+			exp.inputFields = append(exp.inputFields, &gqlField{name: op, typ: t})
+		}
+		exp.inputFields = append(exp.inputFields,
+			&gqlField{name: "in", typ: listOf(nonNull(t))},
+			&gqlField{name: "is_null", typ: sc.types["Boolean"]})
+		if scalar == "String" {
+			exp.inputFields = append(exp.inputFields,
+				&gqlField{name: "like", typ: t}, &gqlField{name: "ilike", typ: t})
+		}
+		sc.add(exp)
+	}
+	sc.addIntrospectionTypes()
+	return sc
+}
+
+func (sc *gqlSchema) add(t *gqlType) *gqlType {
+	sc.types[t.name] = t
+	sc.names = append(sc.names, t.name)
+	return t
+}
+
+// addTable adds the types and root fields of the table with the columns in order, unless their names are taken.
+func (sc *gqlSchema) addTable(root *gqlRoot, columns []string) {
+	name := root.table
+	suffixes := []string{"", "_bool_exp", "_order_by", "_select_column", "_aggregate", "_sum_fields", "_avg_fields",
+		"_min_fields", "_max_fields"}
+	for _, suffix := range suffixes {
+		if sc.types[name+suffix] != nil || sc.roots[name+suffix] != nil {
+			return
+		}
+	}
+	obj := &gqlType{kind: "OBJECT", name: name, description: "A row of the table " + name + "."}
+	boolExp := &gqlType{kind: "INPUT_OBJECT", name: name + "_bool_exp"}
+	boolExp.inputFields = []*gqlField{
+		{name: "_and", typ: listOf(nonNull(boolExp))},
+		{name: "_or", typ: listOf(nonNull(boolExp))},
+		{name: "_not", typ: boolExp},
+	}
+	orderBy := &gqlType{kind: "INPUT_OBJECT", name: name + "_order_by"}
+	selectColumn := &gqlType{kind: "ENUM", name: name + "_select_column"}
+	sum := &gqlType{kind: "OBJECT", name: name + "_sum_fields"}
+	avg := &gqlType{kind: "OBJECT", name: name + "_avg_fields"}
+	minFields := &gqlType{kind: "OBJECT", name: name + "_min_fields"}
+	maxFields := &gqlType{kind: "OBJECT", name: name + "_max_fields"}
+	for _, col := range columns {
+		scalar := sc.types[root.columns[col]]
+		obj.fields = append(obj.fields, &gqlField{name: col, typ: scalar})
+		orderBy.inputFields = append(orderBy.inputFields, &gqlField{name: col, typ: sc.types["order_by"]})
+		if col != "true" && col != "false" && col != "null" {
+			selectColumn.enumValues = append(selectColumn.enumValues, col)
+		}
+		if scalar.name == "JSON" {
+			continue
+		}
+		boolExp.inputFields = append(boolExp.inputFields,
+			&gqlField{name: col, typ: sc.types[scalar.name+"_comparison_exp"]})
+		minFields.fields = append(minFields.fields, &gqlField{name: col, typ: scalar})
+		maxFields.fields = append(maxFields.fields, &gqlField{name: col, typ: scalar})
+		if scalar.name == "Int" || scalar.name == "BigInt" || scalar.name == "Float" {
+			sum.fields = append(sum.fields, &gqlField{name: col, typ: sc.types["Float"]})
+			avg.fields = append(avg.fields, &gqlField{name: col, typ: sc.types["Float"]})
+		}
+	}
+	sc.add(obj)
+	sc.add(boolExp)
+	sc.add(orderBy)
+	agg := sc.add(&gqlType{kind: "OBJECT", name: name + "_aggregate", fields: []*gqlField{
+		{name: "count", typ: nonNull(sc.types["BigInt"])},
+		{name: "group", typ: obj, description: "The values of the group_by columns."},
+	}})
+	// Object and enum types need at least one field or value.
+	for _, t := range []*gqlType{sum, avg, minFields, maxFields} {
+		if len(t.fields) > 0 {
+			fn := strings.TrimSuffix(strings.TrimPrefix(t.name, name+"_"), "_fields")
+			agg.fields = append(agg.fields, &gqlField{name: fn, typ: sc.add(t)})
+		}
+	}
+	where := &gqlField{name: "where", typ: boolExp}
+	sc.query.fields = append(sc.query.fields, &gqlField{
+		name: name, description: "Reads the rows of " + name + ".", typ: nonNull(listOf(nonNull(obj))),
+		args: []*gqlField{
+			where,
+			{name: "order_by", typ: listOf(nonNull(orderBy))},
+			{name: "limit", typ: sc.types["Int"]},
+			{name: "offset", typ: sc.types["Int"]},
+		},
+	})
+	sc.roots[name] = root
+	args := []*gqlField{where}
+	if len(selectColumn.enumValues) > 0 {
+		args = append(args, &gqlField{name: "group_by", typ: listOf(nonNull(sc.add(selectColumn)))})
+	}
+	sc.query.fields = append(sc.query.fields, &gqlField{
+		name: name + "_aggregate", description: "Aggregates the rows of " + name + ", one result per group.",
+		typ: nonNull(listOf(nonNull(agg))), args: args,
+	})
+	sc.roots[name+"_aggregate"] = &gqlRoot{table: name, columns: root.columns, aggregate: true}
+}
+
+// addIntrospectionTypes adds the types of the introspection fields __schema and __type.
+func (sc *gqlSchema) addIntrospectionTypes() {
+	str, boolean := sc.types["String"], sc.types["Boolean"]
+	f := func(name string, t *gqlType) *gqlField {
+		return &gqlField{name: name, typ: t}
+	}
+	kind := sc.add(&gqlType{kind: "ENUM", name: "__TypeKind", enumValues: []string{
+		"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL",
+	}})
+	location := sc.add(&gqlType{kind: "ENUM", name: "__DirectiveLocation", enumValues: []string{
+		"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT",
+		"VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION", "ARGUMENT_DEFINITION", "INTERFACE",
+		"UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT", "INPUT_FIELD_DEFINITION",
+	}})
+	typ := &gqlType{kind: "OBJECT", name: "__Type"}
+	inputValue := sc.add(&gqlType{kind: "OBJECT", name: "__InputValue", fields: []*gqlField{
+		f("name", nonNull(str)), f("description", str), f("type", nonNull(typ)), f("defaultValue", str),
+		f("isDeprecated", nonNull(boolean)), f("deprecationReason", str),
+	}})
+	deprecated := []*gqlField{f("includeDeprecated", boolean)}
+	field := sc.add(&gqlType{kind: "OBJECT", name: "__Field", fields: []*gqlField{
+		f("name", nonNull(str)), f("description", str),
+		{name: "args", typ: nonNull(listOf(nonNull(inputValue))), args: deprecated},
+		f("type", nonNull(typ)), f("isDeprecated", nonNull(boolean)), f("deprecationReason", str),
+	}})
+	enumValue := sc.add(&gqlType{kind: "OBJECT", name: "__EnumValue", fields: []*gqlField{
+		f("name", nonNull(str)), f("description", str), f("isDeprecated", nonNull(boolean)),
+		f("deprecationReason", str),
+	}})
+	typ.fields = []*gqlField{
+		f("kind", nonNull(kind)), f("name", str), f("description", str), f("specifiedByURL", str),
+		{name: "fields", typ: listOf(nonNull(field)), args: deprecated},
+		f("interfaces", listOf(nonNull(typ))), f("possibleTypes", listOf(nonNull(typ))),
+		{name: "enumValues", typ: listOf(nonNull(enumValue)), args: deprecated},
+		{name: "inputFields", typ: listOf(nonNull(inputValue)), args: deprecated},
+		f("ofType", typ), f("isOneOf", boolean),
+	}
+	sc.add(typ)
+	directive := sc.add(&gqlType{kind: "OBJECT", name: "__Directive", fields: []*gqlField{
+		f("name", nonNull(str)), f("description", str), f("locations", nonNull(listOf(nonNull(location)))),
+		{name: "args", typ: nonNull(listOf(nonNull(inputValue))), args: deprecated},
+		f("isRepeatable", nonNull(boolean)),
+	}})
+	sc.add(&gqlType{kind: "OBJECT", name: "__Schema", fields: []*gqlField{
+		f("description", str), f("types", nonNull(listOf(nonNull(typ)))), f("queryType", nonNull(typ)),
+		f("mutationType", typ), f("subscriptionType", typ), f("directives", nonNull(listOf(nonNull(directive)))),
+	}})
+}
+
+func nilIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// typeValue returns the introspection value of the type. The values of named types are shared, so the cycles of the
+// schema become cycles of values that are only followed as far as the query selects.
+func (sc *gqlSchema) typeValue(t *gqlType) map[string]any {
+	if t == nil {
+		return nil
+	}
+	if v, ok := sc.values[t.name]; ok && t.name != "" {
+		return v
+	}
+	v := map[string]any{
+		"kind": t.kind, "name": nilIfEmpty(t.name), "description": nilIfEmpty(t.description), "specifiedByURL": nil,
+		"fields": nil, "interfaces": nil, "possibleTypes": nil, "enumValues": nil, "inputFields": nil, "ofType": nil,
+		"isOneOf": nil,
+	}
+	if t.name != "" {
+		sc.values[t.name] = v
+	}
+	switch t.kind {
+	case "OBJECT":
+		fields := make([]any, len(t.fields))
+		for i, f := range t.fields {
+			fields[i] = map[string]any{
+				"name": f.name, "description": nilIfEmpty(f.description), "args": sc.inputValues(f.args),
+				"type": sc.typeValue(f.typ), "isDeprecated": false, "deprecationReason": nil,
+			}
+		}
+		v["fields"], v["interfaces"] = fields, []any{}
+	case "INPUT_OBJECT":
+		v["inputFields"], v["isOneOf"] = sc.inputValues(t.inputFields), false
+	case "ENUM":
+		values := make([]any, len(t.enumValues))
+		for i, name := range t.enumValues {
+			values[i] = map[string]any{"name": name, "description": nil, "isDeprecated": false, "deprecationReason": nil}
+		}
+		v["enumValues"] = values
+	case "LIST", "NON_NULL":
+		v["ofType"] = sc.typeValue(t.ofType)
+	}
+	return v
+}
+
+func (sc *gqlSchema) inputValues(fields []*gqlField) []any {
+	out := make([]any, len(fields))
+	for i, f := range fields {
+		out[i] = map[string]any{
+			"name": f.name, "description": nilIfEmpty(f.description), "type": sc.typeValue(f.typ),
+			"defaultValue": nil, "isDeprecated": false, "deprecationReason": nil,
+		}
+	}
+	return out
+}
+
+// schemaValue returns the introspection value of __schema.
+func (sc *gqlSchema) schemaValue() map[string]any {
+	types := make([]any, len(sc.names))
+	for i, name := range sc.names {
+		types[i] = sc.typeValue(sc.types[name])
+	}
+	ifArg := sc.inputValues([]*gqlField{{name: "if", typ: nonNull(sc.types["Boolean"])}})
+	locations := []any{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}
+	return map[string]any{
+		"description": nil, "types": types, "queryType": sc.typeValue(sc.query), "mutationType": nil,
+		"subscriptionType": nil,
+		"directives": []any{
+			map[string]any{
+				"name": "include", "description": "Includes the selection only if the argument is true.",
+				"locations": locations, "args": ifArg, "isRepeatable": false,
+			},
+			map[string]any{
+				"name": "skip", "description": "Skips the selection if the argument is true.",
+				"locations": locations, "args": ifArg, "isRepeatable": false,
+			},
+		},
+	}
+}
+
+// gqlObject is an object of the response, its keys in the order of the selection.
+type gqlObject struct {
+	keys   []string
+	values []any
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlExecution struct {
+	server *Server
+	r      *http.Request
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]any
+	errors []GraphQLError
+	// rows counts the rows read, truncated is set once a result was cut at the row limit.
+	rows      int
+	truncated bool
+}
+
+// gqlCollected are the fields of a response key.
+type gqlCollected struct {
+	key    string
+	fields []*gqlSelection
+}
+
+// execute runs the root fields in order. A failing field is null in the data and reported in the errors.
+func (e *gqlExecution) execute(op *gqlOperation) *gqlObject {
+	collected, err := e.collect(e.schema.query, op.selections)
+	if err != nil {
+		e.errors = append(e.errors, GraphQLError{Message: err.Error()})
+		return nil
+	}
+	data := &gqlObject{}
+	for _, c := range collected {
+		e.truncated = false
+		v, err := e.rootField(c.fields)
+		if err != nil {
+			e.errors = append(e.errors, GraphQLError{Message: err.Error(), Path: []any{c.key}})
+			v = nil
+		} else if e.truncated {
+			e.errors = append(e.errors, GraphQLError{
+				Message: fmt.Sprintf("%v: the result was truncated at %d rows", ErrResultTooLarge,
+					e.server.requestResultLimits(e.r.Context()).MaxRows),
+				Path: []any{c.key},
+			})
+		}
+		data.keys, data.values = append(data.keys, c.key), append(data.values, v)
+	}
+	return data
+}
+
+func (e *gqlExecution) rootField(fields []*gqlSelection) (any, error) {
+	sel := fields[0]
+	switch sel.name {
+	case "__typename":
+		return e.schema.query.name, nil
+	case "__schema":
+		return e.complete(nonNull(e.schema.types["__Schema"]), e.schema.schemaValue(), fields)
+	case "__type":
+		name, err := e.resolve(sel.args["name"])
+		if err != nil {
+			return nil, err
+		}
+		typeName, ok := name.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: __type takes the name of a type", ErrGraphQLInvalid)
+		}
+		var value any
+		if t := e.schema.types[typeName]; t != nil {
+			value = e.schema.typeValue(t)
+		}
+		return e.complete(e.schema.types["__Type"], value, fields)
+	}
+	def := findGQLField(e.schema.query.fields, sel.name)
+	if def == nil {
+		return nil, fmt.Errorf("%w: no field %s on %s", ErrGraphQLInvalid, sel.name, e.schema.query.name)
+	}
+	args := make(map[string]any, len(sel.args))
+	for name, v := range sel.args {
+		if findGQLField(def.args, name) == nil {
+			return nil, fmt.Errorf("%w: no argument %s on field %s", ErrGraphQLInvalid, name, sel.name)
+		}
+		var err error
+		if args[name], err = e.resolve(v); err != nil {
+			return nil, err
+		}
+	}
+	root := e.schema.roots[sel.name]
+	var rows []any
+	var err error
+	if root.aggregate {
+		rows, err = e.aggregate(root, args, fields)
+	} else {
+		rows, err = e.tableRows(root, args, fields)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.complete(def.typ, rows, fields)
+}
+
+// resolve replaces the variables of the value by their values and enum values by their names.
+func (e *gqlExecution) resolve(v any) (any, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		val, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("%w: variable $%s is not defined", ErrGraphQLInvalid, v)
+		}
+		return val, nil
+	case gqlEnum:
+		return string(v), nil
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if out[i], err = e.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			var err error
+			if out[k], err = e.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// included evaluates the skip and include directives of the selection.
+func (e *gqlExecution) included(sel *gqlSelection) (bool, error) {
+	for name, want := range map[string]bool{"skip": false, "include": true} {
+		args, ok := sel.directives[name]
+		if !ok {
+			continue
+		}
+		v, err := e.resolve(args["if"])
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("%w: @%s takes a boolean if argument", ErrGraphQLInvalid, name)
+		}
+		if b != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// collect groups the fields of the selections that apply to the object type by response key, in the order of the
+// selections, following the fragments.
+func (e *gqlExecution) collect(typ *gqlType, selections []*gqlSelection) ([]gqlCollected, error) {
+	var out []gqlCollected
+	index := make(map[string]int)
+	visited := make(map[string]bool)
+	var walk func(selections []*gqlSelection) error
+	walk = func(selections []*gqlSelection) error {
+		for _, sel := range selections {
+			ok, err := e.included(sel)
+			if err != nil {
+				return err
+			}
+			switch {
+			case !ok:
+			case sel.spread != "":
+				fragment := e.doc.fragments[sel.spread]
+				if fragment == nil {
+					return fmt.Errorf("%w: no fragment %s", ErrGraphQLInvalid, sel.spread)
+				}
+				if visited[sel.spread] || fragment.typeCondition != typ.name {
+					continue
+				}
+				visited[sel.spread] = true
+				if err = walk(fragment.selections); err != nil {
+					return err
+				}
+			case sel.inline:
+				if sel.typeCondition != "" && sel.typeCondition != typ.name {
+					continue
+				}
+				if err = walk(sel.selections); err != nil {
+					return err
+				}
+			default:
+				key := sel.responseKey()
+				i, ok := index[key]
+				if !ok {
+					index[key] = len(out)
+					out = append(out, gqlCollected{key: key, fields: []*gqlSelection{sel}})
+					continue
+				}
+				if out[i].fields[0].name != sel.name {
+					return fmt.Errorf("%w: %s selects both %s and %s", ErrGraphQLInvalid, key, out[i].fields[0].name,
+						sel.name)
+				}
+				out[i].fields = append(out[i].fields, sel)
+			}
+		}
+		return nil
+	}
+	return out, walk(selections)
+}
+
+func subSelections(fields []*gqlSelection) []*gqlSelection {
+	var out []*gqlSelection
+	for _, f := range fields {
+		out = append(out, f.selections...)
+	}
+	return out
+}
+
+// complete shapes the value of the fields by their type and selections.
+func (e *gqlExecution) complete(typ *gqlType, value any, fields []*gqlSelection) (any, error) {
+	if typ.kind == "NON_NULL" {
+		v, err := e.complete(typ.ofType, value, fields)
+		if err == nil && v == nil {
+			err = fmt.Errorf("%s is null but its type is non-null", fields[0].responseKey())
+		}
+		return v, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	switch typ.kind {
+	case "LIST":
+		list, ok := value.([]any)
+		if !ok {
+			list = []any{value}
+		}
+		out := make([]any, len(list))
+		for i, item := range list {
+			var err error
+			if out[i], err = e.complete(typ.ofType, item, fields); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case "OBJECT":
+		m, ok := value.(map[string]any)
+		if !ok || m == nil {
+			return nil, nil
+		}
+		selections := subSelections(fields)
+		if len(selections) == 0 {
+			return nil, fmt.Errorf("%w: %s of type %s needs a selection of its fields", ErrGraphQLInvalid,
+				fields[0].name, typ.name)
+		}
+		collected, err := e.collect(typ, selections)
+		if err != nil {
+			return nil, err
+		}
+		out := &gqlObject{}
+		for _, c := range collected {
+			var v any = typ.name
+			if name := c.fields[0].name; name != "__typename" {
+				def := findGQLField(typ.fields, name)
+				if def == nil {
+					return nil, fmt.Errorf("%w: no field %s on %s", ErrGraphQLInvalid, name, typ.name)
+				}
+				if v, err = e.complete(def.typ, m[name], c.fields); err != nil {
+					return nil, err
+				}
+			}
+			out.keys, out.values = append(out.keys, c.key), append(out.values, v)
+		}
+		return out, nil
+	default:
+		if len(subSelections(fields)) > 0 {
+			return nil, fmt.Errorf("%w: %s of type %s has no fields to select", ErrGraphQLInvalid, fields[0].name,
+				typ.name)
+		}
+		return value, nil
+	}
+}
+
+// fetch runs the statement like the query endpoints do, within the result limits.
+func (e *gqlExecution) fetch(stmt *QueryStatement) (*QueryResult, error) {
+	e.server.requestResultLimits(e.r.Context()).apply(stmt)
+	ctx, cancel, err := e.server.queryContext(e.r, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	res, _, err := e.server.fetch(e.r.WithContext(ctx), stmt, nil)
+	if err != nil {
+		return nil, err
+	}
+	e.rows += len(res.Rows)
+	e.truncated = e.truncated || res.Truncated
+	return res, nil
+}
+
+// tableRows reads the selected columns of the rows matching the arguments.
+func (e *gqlExecution) tableRows(root *gqlRoot, args map[string]any, fields []*gqlSelection) ([]any, error) {
+	collected, err := e.collect(e.schema.types[root.table], subSelections(fields))
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	for _, c := range collected {
+		if name := c.fields[0].name; root.columns[name] != "" && !slices.Contains(cols, quoteIdent(name)) {
+			cols = append(cols, quoteIdent(name))
+		}
+	}
+	selected := "1"
+	if len(cols) > 0 {
+		selected = strings.Join(cols, ", ")
+	}
+	stmt := &QueryStatement{Query: fmt.Sprintf("SELECT %s FROM %s", selected, quoteIdent(root.table))}
+	where, params, err := root.condition(args["where"])
+	if err != nil {
+		return nil, err
+	}
+	if where != "" {
+		stmt.Query += " WHERE " + where
+		stmt.Params = params
+	}
+	order, err := root.orderBy(args["order_by"])
+	if err != nil {
+		return nil, err
+	}
+	stmt.Query += order
+	for _, clause := range []string{"limit", "offset"} {
+		if v, ok := args[clause]; ok && v != nil {
+			n, ok := gqlInteger(v)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("%w: %s takes a non-negative integer", ErrGraphQLInvalid, clause)
+			}
+			stmt.Query += fmt.Sprintf(" %s %d", strings.ToUpper(clause), n)
+		}
+	}
+	res, err := e.fetch(stmt)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]any, len(res.Rows))
+	for i, row := range res.Rows {
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// aggregate computes the selected metrics of the rows matching the where argument, per group of the group_by columns.
+func (e *gqlExecution) aggregate(root *gqlRoot, args map[string]any, fields []*gqlSelection) ([]any, error) {
+	aggType := e.schema.types[root.table+"_aggregate"]
+	collected, err := e.collect(aggType, subSelections(fields))
+	if err != nil {
+		return nil, err
+	}
+	type target struct{ field, column string }
+	var (
+		exprs, groups []string
+		targets       []target
+	)
+	add := func(t target, expr string) {
+		if !slices.Contains(targets, t) {
+			targets, exprs = append(targets, t), append(exprs, expr)
+		}
+	}
+	for _, v := range asGQLList(args["group_by"]) {
+		name, _ := v.(string)
+		if root.columns[name] == "" {
+			return nil, fmt.Errorf("%w: unknown group_by column %v", ErrGraphQLInvalid, v)
+		}
+		groups = append(groups, quoteIdent(name))
+		add(target{"group", name}, quoteIdent(name))
+	}
+	for _, c := range collected {
+		switch name := c.fields[0].name; name {
+		case "count":
+			add(target{field: "count"}, "count(*)")
+		case "group":
+			sub, err := e.collect(e.schema.types[root.table], subSelections(c.fields))
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				if col := s.fields[0].name; root.columns[col] != "" && !slices.Contains(targets, target{"group", col}) {
+					return nil, fmt.Errorf("%w: group selects %s, which is not in group_by", ErrGraphQLInvalid, col)
+				}
+			}
+		case "sum", "avg", "min", "max":
+			metrics := findGQLField(aggType.fields, name).typ
+			sub, err := e.collect(metrics, subSelections(c.fields))
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				if col := s.fields[0].name; findGQLField(metrics.fields, col) != nil {
+					add(target{name, col}, fmt.Sprintf("%s(%s)", name, quoteIdent(col)))
+				}
+			}
+		}
+	}
+	if len(exprs) == 0 {
+		add(target{field: "count"}, "count(*)")
+	}
+	for i, expr := range exprs {
+		exprs[i] = fmt.Sprintf("%s AS a%d", expr, i)
+	}
+	stmt := &QueryStatement{
+		Query: fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), quoteIdent(root.table)),
+	}
+	where, params, err := root.condition(args["where"])
+	if err != nil {
+		return nil, err
+	}
+	if where != "" {
+		stmt.Query += " WHERE " + where
+		stmt.Params = params
+	}
+	if len(groups) > 0 {
+		stmt.Query += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	}
+	res, err := e.fetch(stmt)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]any, len(res.Rows))
+	for i, row := range res.Rows {
+		v := make(map[string]any)
+		for j, t := range targets {
+			value := row[fmt.Sprintf("a%d", j)]
+			if t.column == "" {
+				v[t.field] = value
+				continue
+			}
+			sub, ok := v[t.field].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				v[t.field] = sub
+			}
+			sub[t.column] = value
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// asGQLList coerces a single value to a list of it, as GraphQL does for list arguments.
+func asGQLList(v any) []any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	default:
+		return []any{v}
+	}
+}
+
+// gqlInteger returns the integer of a literal or of a JSON number of a variable.
+func gqlInteger(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), v == math.Trunc(v) && math.Abs(v) < 1<<53
+	default:
+		return 0, false
+	}
+}
+
+// condition builds the SQL condition of a where argument, binding the values. Its fields must all match.
+func (t *gqlRoot) condition(where any) (string, []any, error) {
+	if where == nil {
+		return "", nil, nil
+	}
+	m, ok := where.(map[string]any)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: where takes an object", ErrGraphQLInvalid)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var (
+		conditions []string
+		params     []any
+	)
+	for _, key := range keys {
+		switch key {
+		case "_and", "_or":
+			var parts []string
+			for _, item := range asGQLList(m[key]) {
+				c, p, err := t.condition(item)
+				if err != nil {
+					return "", nil, err
+				}
+				if c == "" {
+					c = "TRUE"
+				}
+				parts, params = append(parts, c), append(params, p...)
+			}
+			switch {
+			case len(parts) > 0 && key == "_and":
+				conditions = append(conditions, "("+strings.Join(parts, " AND ")+")")
+			case len(parts) > 0:
+				conditions = append(conditions, "("+strings.Join(parts, " OR ")+")")
+			case key == "_or":
+				conditions = append(conditions, "FALSE")
+			}
+		case "_not":
+			c, p, err := t.condition(m[key])
+			if err != nil {
+				return "", nil, err
+			}
+			if c == "" {
+				c = "TRUE"
+			}
+			conditions, params = append(conditions, "NOT ("+c+")"), append(params, p...)
+		default:
+			c, p, err := t.comparison(key, m[key])
+			if err != nil {
+				return "", nil, err
+			}
+			conditions, params = append(conditions, c...), append(params, p...)
+		}
+	}
+	return strings.Join(conditions, " AND "), params, nil
+}
+
+// comparison builds the conditions of the comparison expression of the column.
+func (t *gqlRoot) comparison(name string, exp any) ([]string, []any, error) {
+	if scalar := t.columns[name]; scalar == "" || scalar == "JSON" {
+		return nil, nil, fmt.Errorf("%w: %s can't be filtered on", ErrGraphQLInvalid, name)
+	}
+	ops, ok := exp.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: the filter of %s takes an object of operators", ErrGraphQLInvalid, name)
+	}
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	col := quoteIdent(name)
+	var (
+		conditions []string
+		params     []any
+	)
+	for _, op := range names {
+		v := ops[op]
+		switch op {
+		case "in":
+			values := asGQLList(v)
+			if len(values) == 0 {
+				conditions = append(conditions, "FALSE")
+				continue
+			}
+			conditions = append(conditions,
+				fmt.Sprintf("%s IN (%s)", col, strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")))
+			params = append(params, values...)
+		case "is_null":
+			isNull, ok := v.(bool)
+			if !ok {
+				return nil, nil, fmt.Errorf("%w: is_null takes a boolean", ErrGraphQLInvalid)
+			}
+			if isNull {
+				conditions = append(conditions, col+" IS NULL")
+			} else {
+				conditions = append(conditions, col+" IS NOT NULL")
+			}
+		default:
+			sqlOp, ok := filterOps[op]
+			if !ok || ((op == "like" || op == "ilike") && t.columns[name] != "String") {
+				return nil, nil, fmt.Errorf("%w: unknown operator %s on %s", ErrGraphQLInvalid, op, name)
+			}
+			if v == nil {
+				return nil, nil, fmt.Errorf("%w: %s compares with null, use is_null", ErrGraphQLInvalid, op)
+			}
+			conditions, params = append(conditions, fmt.Sprintf("%s %s ?", col, sqlOp)), append(params, v)
+		}
+	}
+	return conditions, params, nil
+}
+
+// orderBy builds the ORDER BY clause of an order_by argument, a list of objects of one column each.
+func (t *gqlRoot) orderBy(v any) (string, error) {
+	var terms []string
+	for _, item := range asGQLList(v) {
+		m, ok := item.(map[string]any)
+		if !ok || len(m) != 1 {
+			return "", fmt.Errorf("%w: order_by takes objects of one column each, in a list for several",
+				ErrGraphQLInvalid)
+		}
+		for name, dir := range m {
+			if t.columns[name] == "" {
+				return "", fmt.Errorf("%w: unknown order_by column %s", ErrGraphQLInvalid, name)
+			}
+			switch dir {
+			case "asc":
+				terms = append(terms, quoteIdent(name))
+			case "desc":
+				terms = append(terms, quoteIdent(name)+" DESC")
+			default:
+				return "", fmt.Errorf("%w: order_by takes asc or desc, not %v", ErrGraphQLInvalid, dir)
+			}
+		}
+	}
+	if len(terms) == 0 {
+		return "", nil
+	}
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
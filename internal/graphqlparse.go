@@ -0,0 +1,495 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrGraphQLSyntax is returned for documents that aren't valid GraphQL.
+var ErrGraphQLSyntax = errors.New("graphql syntax error")
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+	gqlPunct
+)
+
+type gqlToken struct {
+	kind gqlTokenKind
+	// text is the value of strings and the source of the other tokens.
+	text string
+	pos  int
+}
+
+// lexGraphQL splits the document into tokens, dropping whitespace, commas and comments.
+//
+//nolint:gocognit,cyclop // A flat scanner is easier to follow than one split across functions.
+func lexGraphQL(doc string) ([]gqlToken, error) {
+	var out []gqlToken
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(doc[i:], "\uFEFF"):
+			// A byte order mark is ignored like whitespace.
+			i += len("\uFEFF")
+		case c == '#':
+			end := strings.IndexByte(doc[i:], '\n')
+			if end < 0 {
+				i = len(doc)
+				continue
+			}
+			i += end + 1
+		case strings.HasPrefix(doc[i:], "..."):
+			out = append(out, gqlToken{kind: gqlPunct, text: "...", pos: i})
+			i += 3
+		case strings.ContainsRune("!$&()/:=@[]{}|", rune(c)):
+			out = append(out, gqlToken{kind: gqlPunct, text: string(c), pos: i})
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i + 1
+			for j < len(doc) && (isWordByte(doc[j]) && doc[j] < 0x80) {
+				j++
+			}
+			out = append(out, gqlToken{kind: gqlName, text: doc[i:j], pos: i})
+			i = j
+		case c == '-' || isDigit(c):
+			j, kind := i+1, gqlInt
+			for j < len(doc) && (isDigit(doc[j]) || strings.IndexByte(".eE+-", doc[j]) >= 0) {
+				if strings.IndexByte(".eE", doc[j]) >= 0 {
+					kind = gqlFloat
+				}
+				j++
+			}
+			out = append(out, gqlToken{kind: kind, text: doc[i:j], pos: i})
+			i = j
+		case strings.HasPrefix(doc[i:], `"""`):
+			end := strings.Index(doc[i+3:], `"""`)
+			for end >= 0 && doc[i+3+end-1] == '\\' {
+				next := strings.Index(doc[i+3+end+3:], `"""`)
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += 3 + next
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated block string at %d", ErrGraphQLSyntax, i)
+			}
+			text := strings.ReplaceAll(doc[i+3:i+3+end], `\"""`, `"""`)
+			out = append(out, gqlToken{kind: gqlString, text: strings.TrimSpace(text), pos: i})
+			i += 3 + end + 3
+		case c == '"':
+			j := i + 1
+			for j < len(doc) && doc[j] != '"' && doc[j] != '\n' {
+				if doc[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(doc) || doc[j] != '"' {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrGraphQLSyntax, i)
+			}
+			// The escapes of GraphQL strings are those of JSON.
+			var text string
+			if err := json.Unmarshal([]byte(doc[i:j+1]), &text); err != nil {
+				return nil, fmt.Errorf("%w: invalid string at %d", ErrGraphQLSyntax, i)
+			}
+			out = append(out, gqlToken{kind: gqlString, text: text, pos: i})
+			i = j + 1
+		default:
+			return nil, fmt.Errorf("%w: unexpected character %q at %d", ErrGraphQLSyntax, c, i)
+		}
+	}
+	return append(out, gqlToken{kind: gqlEOF, pos: len(doc)}), nil
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	// kind is query, mutation or subscription.
+	kind       string
+	name       string
+	variables  []gqlVariableDef
+	selections []*gqlSelection
+}
+
+type gqlVariableDef struct {
+	name       string
+	def        any
+	hasDefault bool
+}
+
+type gqlFragment struct {
+	typeCondition string
+	selections    []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment.
+type gqlSelection struct {
+	alias, name string
+	args        map[string]any
+	directives  map[string]map[string]any
+	selections  []*gqlSelection
+	// spread names the fragment of a spread.
+	spread string
+	// inline marks inline fragments, whose type condition may be empty.
+	inline        bool
+	typeCondition string
+}
+
+// responseKey is the key of the field in the response.
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// gqlVariable is a reference to a variable in a value, gqlEnum an enum value.
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+type gqlParser struct {
+	tokens []gqlToken
+	i      int
+}
+
+// parseGraphQL parses the executable definitions of the document.
+func parseGraphQL(doc string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(doc)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	out := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != gqlEOF {
+		tok := p.peek()
+		switch {
+		case tok.kind == gqlPunct && tok.text == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			out.operations = append(out.operations, &gqlOperation{kind: "query", selections: selections})
+		case tok.kind == gqlName && (tok.text == "query" || tok.text == "mutation" || tok.text == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			out.operations = append(out.operations, op)
+		case tok.kind == gqlName && tok.text == "fragment":
+			name, fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if out.fragments[name] != nil {
+				return nil, fmt.Errorf("%w: fragment %s is defined twice", ErrGraphQLSyntax, name)
+			}
+			out.fragments[name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(out.operations) == 0 {
+		return nil, fmt.Errorf("%w: no operation", ErrGraphQLSyntax)
+	}
+	return out, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	tok := p.tokens[p.i]
+	if tok.kind != gqlEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *gqlParser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == gqlEOF {
+		return fmt.Errorf("%w: unexpected end of document", ErrGraphQLSyntax)
+	}
+	return fmt.Errorf("%w: unexpected %q at %d", ErrGraphQLSyntax, tok.text, tok.pos)
+}
+
+// skip consumes the punctuator if it is next.
+func (p *gqlParser) skip(punct string) bool {
+	if tok := p.peek(); tok.kind == gqlPunct && tok.text == punct {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.skip(punct) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != gqlName {
+		return "", p.unexpected()
+	}
+	return p.next().text, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.next().text}
+	if p.peek().kind == gqlName {
+		op.name = p.next().text
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			def := gqlVariableDef{name: name}
+			if def.hasDefault = p.skip("="); def.hasDefault {
+				if def.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			if _, err = p.directives(); err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef skips a type reference, variables are coerced by where they are used.
+func (p *gqlParser) typeRef() error {
+	if p.skip("[") {
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	p.skip("!")
+	return nil
+}
+
+func (p *gqlParser) fragment() (string, *gqlFragment, error) {
+	p.next()
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if on, err := p.name(); err != nil || on != "on" {
+		return "", nil, fmt.Errorf("%w: fragment %s lacks a type condition", ErrGraphQLSyntax, name)
+	}
+	fragment := &gqlFragment{}
+	if fragment.typeCondition, err = p.name(); err != nil {
+		return "", nil, err
+	}
+	if _, err = p.directives(); err != nil {
+		return "", nil, err
+	}
+	fragment.selections, err = p.selectionSet()
+	return name, fragment, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var out []*gqlSelection
+	for !p.skip("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sel)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: empty selection set", ErrGraphQLSyntax)
+	}
+	return out, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{}
+	var err error
+	if p.skip("...") {
+		if tok := p.peek(); tok.kind == gqlName && tok.text != "on" {
+			sel.spread = p.next().text
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.inline = true
+		if tok := p.peek(); tok.kind == gqlName && tok.text == "on" {
+			p.next()
+			if sel.typeCondition, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.skip(":") {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind == gqlPunct && tok.text == "{" {
+		sel.selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]any, error) {
+	if !p.skip("(") {
+		return nil, nil
+	}
+	args := make(map[string]any)
+	for !p.skip(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() (map[string]map[string]any, error) {
+	var out map[string]map[string]any
+	for p.skip("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = make(map[string]map[string]any)
+		}
+		out[name] = args
+	}
+	return out, nil
+}
+
+// value parses a value into nil, bool, int64, float64, string, gqlEnum, gqlVariable, []any or map[string]any.
+// Constant values, such as the defaults of variables, may not reference variables.
+func (p *gqlParser) value(constant bool) (any, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == gqlPunct && tok.text == "$" && !constant:
+		name, err := p.name()
+		return gqlVariable(name), err
+	case tok.kind == gqlInt:
+		v, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid int %s", ErrGraphQLSyntax, tok.text)
+		}
+		return v, nil
+	case tok.kind == gqlFloat:
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid float %s", ErrGraphQLSyntax, tok.text)
+		}
+		return v, nil
+	case tok.kind == gqlString:
+		return tok.text, nil
+	case tok.kind == gqlName:
+		switch tok.text {
+		case "true", "false":
+			return tok.text == "true", nil
+		case "null":
+			return nil, nil
+		default:
+			return gqlEnum(tok.text), nil
+		}
+	case tok.kind == gqlPunct && tok.text == "[":
+		out := []any{}
+		for !p.skip("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case tok.kind == gqlPunct && tok.text == "{":
+		out := make(map[string]any)
+		for !p.skip("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if out[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		if tok.kind != gqlEOF {
+			p.i--
+		}
+		return nil, p.unexpected()
+	}
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQueryHistory is how many executed queries the server remembers unless configured otherwise.
+const DefaultQueryHistory = 1000
+
+// defaultHistoryLimit is how many entries GET /queries/history returns without a limit parameter.
+const defaultHistoryLimit = 100
+
+// QueryHistoryEntry is an executed query. Rows is unset for results streamed as Arrow or Parquet, which aren't
+// counted.
+type QueryHistoryEntry struct {
+	ID         string    `json:"id"`
+	SQL        string    `json:"sql"`
+	Params     []any     `json:"params,omitempty"`
+	Caller     string    `json:"caller"`
+	Tag        string    `json:"tag,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS float64   `json:"duration_ms"`
+	Rows       *int      `json:"rows,omitempty"`
+	Cached     bool      `json:"cached,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// queryHistory keeps the last executed queries in a ring, apart from the audit log.
+type queryHistory struct {
+	mu      sync.Mutex
+	entries []QueryHistoryEntry
+	// next is where the next entry goes, the oldest entry once the ring is full.
+	next int
+	size int
+}
+
+func newQueryHistory(size int) *queryHistory {
+	return &queryHistory{size: size}
+}
+
+// WithQueryHistory sets how many executed queries GET /queries/history remembers. Zero disables the history.
+func WithQueryHistory(size int) ServerOption {
+	return func(s *Server) {
+		s.history = nil
+		if size > 0 {
+			s.history = newQueryHistory(size)
+		}
+	}
+}
+
+func (h *queryHistory) add(e QueryHistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % h.size
+}
+
+// list returns the entries matching keep, newest first.
+func (h *queryHistory) list(keep func(QueryHistoryEntry) bool, limit int) []QueryHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []QueryHistoryEntry{}
+	for i := 0; i < len(h.entries) && len(out) < limit; i++ {
+		e := h.entries[(h.next-1-i+2*len(h.entries))%len(h.entries)]
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// record adds the statement the request ran to the history, if it is kept, and to the stats of its tag.
+func (s *Server) record(r *http.Request, stmt *QueryStatement, started time.Time, rows *int, cached bool, err error) {
+	duration := time.Since(started)
+	// Requests with an invalid tag are refused before their query runs.
+	tag, _ := queryTag(r)
+	s.tagStats.add(tag, duration, rows, cached, err != nil)
+	if s.history == nil {
+		return
+	}
+	id, idErr := newID()
+	if idErr != nil {
+		return
+	}
+	e := QueryHistoryEntry{
+		ID:         id,
+		SQL:        stmt.Query,
+		Params:     stmt.Params,
+		Caller:     caller(r),
+		Tag:        tag,
+		StartedAt:  started.UTC(),
+		DurationMS: float64(duration.Microseconds()) / 1000,
+		Rows:       rows,
+		Cached:     cached,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.history.add(e)
+}
+
+// historyVisible reports whether the request may see the entry: admins and servers without authentication see all of
+// them, others the queries they ran.
+func historyVisible(r *http.Request, e QueryHistoryEntry) bool {
+	p, ok := requestPrincipal(r.Context())
+	return !ok || p.has(ScopeAdmin) || e.Caller == p.Name
+}
+
+// HandleQueryHistory lists the executed queries the caller may see, newest first. The parameters caller, contains (a
+// case-insensitive part of the SQL), tag, since (RFC 3339 or a duration before now), min_duration (a Go duration),
+// status (ok or error) and limit, 100 by default, filter them.
+func (s *Server) HandleQueryHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var (
+		since       time.Time
+		minDuration time.Duration
+		err         error
+	)
+	limit := defaultHistoryLimit
+	if v := params.Get("since"); v != "" {
+		since, err = parseSince(v, time.Now())
+	}
+	if v := params.Get("min_duration"); v != "" && err == nil {
+		minDuration, err = time.ParseDuration(v)
+	}
+	if v := params.Get("limit"); v != "" && err == nil {
+		if limit, err = strconv.Atoi(v); err == nil && limit <= 0 {
+			err = fmt.Errorf("invalid limit %d", limit)
+		}
+	}
+	status := params.Get("status")
+	if status != "" && status != "ok" && status != "error" && err == nil {
+		err = fmt.Errorf("invalid status %q: expected ok or error", status)
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle query history", err)
+		return
+	}
+	if s.history == nil {
+		s.writeJSON(w, http.StatusOK, "handle query history: writing response", []QueryHistoryEntry{})
+		return
+	}
+	callerName, contains, tag := params.Get("caller"), strings.ToLower(params.Get("contains")), params.Get("tag")
+	entries := s.history.list(func(e QueryHistoryEntry) bool {
+		return historyVisible(r, e) &&
+			(callerName == "" || e.Caller == callerName) &&
+			(tag == "" || e.Tag == tag) &&
+			(contains == "" || strings.Contains(strings.ToLower(e.SQL), contains)) &&
+			!e.StartedAt.Before(since) &&
+			e.DurationMS >= float64(minDuration.Microseconds())/1000 &&
+			(status == "" || (status == "error") == (e.Error != ""))
+	}, limit)
+	s.writeJSON(w, http.StatusOK, "handle query history: writing response", entries)
+}
+
+// HandleRerunQuery runs a query of the history again with its parameters, answered like POST /query. The caller must
+// be able to see the entry.
+func (s *Server) HandleRerunQuery(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var entries []QueryHistoryEntry
+	if s.history != nil {
+		entries = s.history.list(func(e QueryHistoryEntry) bool {
+			return e.ID == id && historyVisible(r, e)
+		}, 1)
+	}
+	if len(entries) == 0 {
+		s.writeError(w, http.StatusNotFound, "handle rerun query", fmt.Errorf("%w: %s", ErrQueryNotFound, id))
+		return
+	}
+	s.writeQuery(w, r, &QueryStatement{Query: entries[0].SQL, Params: entries[0].Params})
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ImportJobKind is what an import job loads.
+type ImportJobKind string
+
+const (
+	ImportJobURL    ImportJobKind = "import"
+	ImportJobUpload ImportJobKind = "upload"
+)
+
+var ErrImportJobNotFound = errors.New("import job not found")
+
+// ImportJob is an import, or the commit of an upload session, running in the background because its request set
+// async. Jobs are kept in memory until JobRetention after they finished.
+type ImportJob struct {
+	ID    string        `json:"id"`
+	Kind  ImportJobKind `json:"kind"`
+	Table string        `json:"table"`
+	// Source is the URL of an import or the ID of an upload session.
+	Source string    `json:"source"`
+	Status JobStatus `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	// Rows are the rows loaded. Files are loaded in one statement, their rows count once it committed.
+	Rows int64 `json:"rows"`
+	// BytesRead counts the bytes of the parts of an upload session assembled so far out of BytesTotal. URL imports are
+	// read by DuckDB, which doesn't report them.
+	BytesRead  int64 `json:"bytes_read"`
+	BytesTotal int64 `json:"bytes_total,omitempty"`
+	// Rejected samples the lines skipped for CSVOptions.IgnoreErrors.
+	Rejected   []RejectedRow `json:"rejected,omitempty"`
+	Caller     string        `json:"caller"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+type importJob struct {
+	mu     sync.Mutex
+	status ImportJob
+	cancel context.CancelFunc
+}
+
+func (j *importJob) snapshot() ImportJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := j.status
+	out.Rejected = slices.Clone(j.status.Rejected)
+	return out
+}
+
+// Write counts the bytes read for the job, it is the progress of assembling an upload session.
+func (j *importJob) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.BytesRead += int64(len(p))
+	return len(p), nil
+}
+
+func (j *importJob) finish(res *ImportResponse, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status != JobRunning {
+		return
+	}
+	now := time.Now().UTC()
+	j.status.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.status.Status = JobCancelled
+	case err != nil:
+		j.status.Status = JobFailed
+		j.status.Error = err.Error()
+	default:
+		j.status.Status = JobSucceeded
+		j.status.Rows = res.Rows
+		j.status.Rejected = res.Rejected
+	}
+}
+
+// importJobs keeps the import jobs of a server in memory. Finished jobs are pruned after JobRetention.
+type importJobs struct {
+	mu   sync.Mutex
+	byID map[string]*importJob
+	// running counts the jobs whose load hasn't returned yet.
+	running sync.WaitGroup
+}
+
+func newImportJobs() *importJobs {
+	return &importJobs{byID: make(map[string]*importJob)}
+}
+
+// start runs load in the background as the job of the caller of the request. The load is detached from the request
+// but keeps its principal, and is cancelled through the job.
+func (js *importJobs) start(
+	r *http.Request, status ImportJob, load func(ctx context.Context, j *importJob) (*ImportResponse, error),
+) (ImportJob, error) {
+	id, err := newID()
+	if err != nil {
+		return ImportJob{}, err
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	status.ID = id
+	status.Status = JobRunning
+	status.Caller = caller(r)
+	status.CreatedAt = time.Now().UTC()
+	j := &importJob{status: status, cancel: cancel}
+	js.mu.Lock()
+	js.prune()
+	js.byID[id] = j
+	js.mu.Unlock()
+
+	js.running.Add(1)
+	go func() {
+		defer js.running.Done()
+		defer cancel()
+		res, loadErr := load(ctx, j)
+		j.finish(res, loadErr)
+	}()
+	return j.snapshot(), nil
+}
+
+// get returns the job if the request may see it, see ownedBy.
+func (js *importJobs) get(r *http.Request, id string) (*importJob, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.prune()
+	j, ok := js.byID[id]
+	if !ok || !ownedBy(r, j.snapshot().Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrImportJobNotFound, id)
+	}
+	return j, nil
+}
+
+// list returns the jobs the request may see, the latest first.
+func (js *importJobs) list(r *http.Request) []ImportJob {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.prune()
+	out := make([]ImportJob, 0, len(js.byID))
+	for _, j := range js.byID {
+		if status := j.snapshot(); ownedBy(r, status.Caller) {
+			out = append(out, status)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool {
+		return out[i].CreatedAt.After(out[k].CreatedAt)
+	})
+	return out
+}
+
+// prune drops the jobs that finished more than JobRetention ago. The caller holds the lock.
+func (js *importJobs) prune() {
+	for id, j := range js.byID {
+		if status := j.snapshot(); status.FinishedAt != nil && time.Since(*status.FinishedAt) > JobRetention {
+			delete(js.byID, id)
+		}
+	}
+}
+
+// cancelRunning cancels the loads of the jobs that are still running.
+func (js *importJobs) cancelRunning() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.byID {
+		j.cancel()
+	}
+}
+
+// HandleListImportJobs lists the import jobs of the caller, all of them for admins.
+func (s *Server) HandleListImportJobs(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list import jobs: writing response", s.importJobs.list(r))
+}
+
+func (s *Server) HandleGetImportJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.importJobs.get(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get import job", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get import job: writing response", j.snapshot())
+}
+
+// HandleCancelImportJob interrupts the load of a running import job, which rolls it back, and responds with the job.
+// The job turns cancelled once the load stopped, or succeeded if it committed first. Cancelling a finished job leaves
+// it as is.
+func (s *Server) HandleCancelImportJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.importJobs.get(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle cancel import job", err)
+		return
+	}
+	j.cancel()
+	s.writeJSON(w, http.StatusAccepted, "handle cancel import job: writing response", j.snapshot())
+}
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// importSchemes are the URL schemes DuckDB reads remotely through httpfs or the azure extension. Local paths are
+// refused, an import must not read the files of the server.
+var importSchemes = map[string]bool{
+	"https": true, "http": true,
+	"s3": true, "s3a": true, "s3n": true, "r2": true,
+	"gcs": true, "gs": true,
+	"az": true, "azure": true, "abfss": true,
+}
+
+// importReaders are the DuckDB table functions reading each import format.
+var importReaders = map[string]string{
+	"parquet": "read_parquet",
+	"csv":     "read_csv_auto",
+	"json":    "read_json_auto",
+}
+
+// ImportRequest is the body of POST /tables/{table}/import. The credentials of an object store URL come from the
+// secret whose scope matches it.
+type ImportRequest struct {
+	// URL may contain globs, e.g. s3://bucket/events/*.parquet.
+	URL string `json:"url"`
+	// Format is parquet, csv or json. Empty infers it from the extension of the URL.
+	Format string `json:"format,omitempty"`
+	// Append inserts into an existing table, matching columns by name. Otherwise the table is created and must not
+	// exist yet.
+	Append bool `json:"append,omitempty"`
+	// CSV sets the dialect of CSV files.
+	CSV *CSVOptions `json:"csv,omitempty"`
+	// Async runs the import in the background as an ImportJob, which the response is then.
+	Async bool `json:"async,omitempty"`
+}
+
+// CSVOptions sets the dialect of CSV files where auto-detection guesses wrong. Unset fields are still detected.
+type CSVOptions struct {
+	// Delimiter separates the fields, e.g. ";" or "\t".
+	Delimiter string `json:"delimiter,omitempty"`
+	// Quote encloses the fields containing the delimiter.
+	Quote string `json:"quote,omitempty"`
+	// Header tells whether the first line names the columns.
+	Header *bool `json:"header,omitempty"`
+	// Null is the field read as NULL, e.g. "NA" or "-", instead of the empty field.
+	Null string `json:"null,omitempty"`
+	// DecimalSeparator is "," for numbers written like 1234,5.
+	DecimalSeparator string `json:"decimal_separator,omitempty"`
+	// Types overrides the detected types of the columns by name, e.g. {"zip": "VARCHAR"}.
+	Types map[string]string `json:"types,omitempty"`
+	// IgnoreErrors skips the lines that don't parse or convert to the types of their columns instead of failing the
+	// import. Samples of the skipped lines are returned as RejectedRow.
+	IgnoreErrors bool `json:"ignore_errors,omitempty"`
+}
+
+const (
+	// rejectsTable is the temporary table DuckDB records the lines skipped by CSVOptions.IgnoreErrors in.
+	rejectsTable = "scratch_import_rejects"
+	// maxRejectedRows bounds the skipped lines recorded for each file.
+	maxRejectedRows = 10
+)
+
+// RejectedRow is a line of a CSV file skipped by CSVOptions.IgnoreErrors.
+type RejectedRow struct {
+	File string `json:"file"`
+	Line int64  `json:"line"`
+	// Column is the column whose value didn't convert, empty if the line didn't parse.
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error"`
+}
+
+// options returns the read_csv options of the dialect, each preceded by a comma.
+func (o *CSVOptions) options() (string, error) {
+	if o == nil {
+		return "", nil
+	}
+	var sb strings.Builder
+	for _, opt := range []struct{ name, value string }{
+		{"delim", o.Delimiter}, {"quote", o.Quote}, {"decimal_separator", o.DecimalSeparator},
+	} {
+		switch {
+		case opt.value == "":
+		case utf8.RuneCountInString(opt.value) != 1:
+			return "", fmt.Errorf("%w: csv %s must be a single character", ErrInvalidImport, opt.name)
+		default:
+			sb.WriteString(", " + opt.name + "=" + quoteLiteral(opt.value))
+		}
+	}
+	if o.Header != nil {
+		sb.WriteString(", header=" + strconv.FormatBool(*o.Header))
+	}
+	if o.Null != "" {
+		sb.WriteString(", nullstr=" + quoteLiteral(o.Null))
+	}
+	if len(o.Types) > 0 {
+		names := make([]string, 0, len(o.Types))
+		for name := range o.Types {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		types := make([]string, len(names))
+		for i, name := range names {
+			types[i] = quoteLiteral(name) + ": " + quoteLiteral(o.Types[name])
+		}
+		sb.WriteString(", types={" + strings.Join(types, ", ") + "}")
+	}
+	if o.IgnoreErrors {
+		sb.WriteString(fmt.Sprintf(", ignore_errors=true, rejects_table=%s, rejects_limit=%d",
+			quoteLiteral(rejectsTable), maxRejectedRows))
+	}
+	return sb.String(), nil
+}
+
+// importReader returns the table function call reading the file of the format at the path or URL.
+func importReader(format, file string, csv *CSVOptions) (string, error) {
+	fn, ok := importReaders[format]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported format %q, use parquet, csv or json", ErrInvalidImport, format)
+	}
+	if csv == nil {
+		return fmt.Sprintf("%s(%s)", fn, quoteLiteral(file)), nil
+	}
+	if format != "csv" {
+		return "", fmt.Errorf("%w: csv options only apply to csv files", ErrInvalidImport)
+	}
+	options, err := csv.options()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s(%s%s)", fn, quoteLiteral(file), options), nil
+}
+
+type ImportResponse struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	// Rejected samples the lines skipped for CSVOptions.IgnoreErrors.
+	Rejected []RejectedRow `json:"rejected,omitempty"`
+}
+
+// reader returns the table function call reading the URL.
+func (req *ImportRequest) reader() (string, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return "", fmt.Errorf("%w: url: %w", ErrInvalidImport, err)
+	}
+	if !importSchemes[strings.ToLower(u.Scheme)] {
+		return "", fmt.Errorf("%w: unsupported url scheme %q", ErrInvalidImport, u.Scheme)
+	}
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		ext := strings.TrimPrefix(path.Ext(strings.TrimSuffix(u.Path, ".gz")), ".")
+		format = map[string]string{"ndjson": "json", "jsonl": "json"}[ext]
+		if format == "" {
+			format = ext
+		}
+	}
+	return importReader(format, req.URL, req.CSV)
+}
+
+// Import reads the file at the URL of the request into the table on the server, without passing the data through the
+// API. Column limits don't apply to imports.
+func (s *Store) Import(ctx context.Context, table string, req ImportRequest) (*ImportResponse, error) {
+	reader, err := s.prepareImport(ctx, table, req)
+	if err != nil {
+		return nil, err
+	}
+	return s.load(ctx, table, reader, req.Append)
+}
+
+// prepareImport checks the table and the request of an import and returns the table function call reading the URL.
+func (s *Store) prepareImport(ctx context.Context, table string, req ImportRequest) (string, error) {
+	if err := s.checkImportTable(ctx, table, req.Append); err != nil {
+		return "", err
+	}
+	return req.reader()
+}
+
+// checkImportTable refuses invalid table names, and tables that don't exist to append to or exist already otherwise.
+func (s *Store) checkImportTable(ctx context.Context, table string, appendRows bool) error {
+	if !tableNameRegex.MatchString(table) {
+		return fmt.Errorf("%w: table name must match %s", ErrInvalidImport, tableNameRegex)
+	}
+	if strings.EqualFold(table, MigrationsTable) {
+		return fmt.Errorf("%w: %s", ErrTableExists, table)
+	}
+	cols, err := s.tableColumns(ctx, table)
+	switch {
+	case err != nil:
+		return err
+	case appendRows && len(cols) == 0:
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	case !appendRows && len(cols) > 0:
+		return fmt.Errorf("%w: %s", ErrTableExists, table)
+	}
+	return nil
+}
+
+// load creates the table from the rows of the table function call reader, or appends them to it, in one statement.
+// The caller checked the table with checkImportTable.
+func (s *Store) load(ctx context.Context, table, reader string, appendRows bool) (*ImportResponse, error) {
+	query := fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s", quoteIdent(table), reader)
+	if appendRows {
+		query = fmt.Sprintf("INSERT INTO %s BY NAME SELECT * FROM %s", quoteIdent(table), reader)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	// The rejected lines are kept in a temporary table of the connection of the statement.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("import: %w", err)
+	}
+	defer func() {
+		if _, dropErr := conn.ExecContext(context.WithoutCancel(ctx),
+			"DROP TABLE IF EXISTS temp."+quoteIdent(rejectsTable)); dropErr != nil {
+			slog.Error("import: dropping rejected lines", "err", dropErr)
+		}
+		if closeErr := conn.Close(); closeErr != nil {
+			slog.Error("import: closing connection", "err", closeErr)
+		}
+	}()
+	res, err := conn.ExecContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("import: %w", s.memoryError(err))
+	}
+	out := &ImportResponse{Table: table}
+	if appendRows {
+		out.Rows, err = res.RowsAffected()
+	} else {
+		err = conn.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteIdent(table)).Scan(&out.Rows)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("import: counting rows: %w", err)
+	}
+	if out.Rejected, err = rejectedRows(ctx, conn); err != nil {
+		return nil, err
+	}
+	s.written(table)
+	return out, nil
+}
+
+// rejectedRows returns the lines recorded in the rejects table of the connection, none if the import didn't create
+// it.
+func rejectedRows(ctx context.Context, conn *sql.Conn) ([]RejectedRow, error) {
+	var exists bool
+	if err := conn.QueryRowContext(ctx,
+		"SELECT count(*) > 0 FROM duckdb_tables() WHERE temporary AND table_name = ?", rejectsTable,
+	).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("import: looking up rejected lines: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(
+		`SELECT file, line, column_name, parsed_value, error FROM temp.%s ORDER BY file, line LIMIT %d`,
+		quoteIdent(rejectsTable), maxRejectedRows,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("import: listing rejected lines: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var out []RejectedRow
+	for rows.Next() {
+		var (
+			row           RejectedRow
+			column, value sql.NullString
+		)
+		if err = rows.Scan(&row.File, &row.Line, &column, &value, &row.Error); err != nil {
+			return nil, fmt.Errorf("import: scanning rejected line: %w", err)
+		}
+		row.Column, row.Value = strings.Trim(column.String, `"`), value.String
+		out = append(out, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("import: flushing rejected lines: %w", err)
+	}
+	return out, nil
+}
+
+// HandleImport reads a remote file into the table in the path, or starts an import job doing so.
+func (s *Server) HandleImport(w http.ResponseWriter, r *http.Request) {
+	markAudit(r.Context(), AuditIngest, r.PathValue("table"))
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle import: decoding request body", err)
+		return
+	}
+	if req.Async {
+		s.startImport(w, r, req)
+		return
+	}
+	res, err := s.store.Import(r.Context(), r.PathValue("table"), req)
+	if err != nil {
+		s.writeImportError(w, "handle import", err)
+		return
+	}
+	code := http.StatusCreated
+	if req.Append {
+		code = http.StatusOK
+	}
+	s.writeJSON(w, code, "handle import: writing response", res)
+}
+
+// startImport checks the import and runs it in the background, responding with its job.
+func (s *Server) startImport(w http.ResponseWriter, r *http.Request, req ImportRequest) {
+	table := r.PathValue("table")
+	reader, err := s.store.prepareImport(r.Context(), table, req)
+	if err != nil {
+		s.writeImportError(w, "handle import", err)
+		return
+	}
+	job, err := s.importJobs.start(r, ImportJob{Kind: ImportJobURL, Table: table, Source: req.URL},
+		func(ctx context.Context, _ *importJob) (*ImportResponse, error) {
+			return s.store.load(ctx, table, reader, req.Append)
+		})
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle import", err)
+		return
+	}
+	s.writeImportJob(w, "handle import: writing response", job)
+}
+
+// writeImportJob answers 202 with the started job, located at GET /jobs/{id}.
+func (s *Server) writeImportJob(w http.ResponseWriter, msg string, job ImportJob) {
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	s.writeJSON(w, http.StatusAccepted, msg, job)
+}
+
+func (s *Server) writeImportError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, op, err)
+	case errors.Is(err, ErrTableExists):
+		s.writeError(w, http.StatusConflict, op, err)
+	case errors.Is(err, ErrInvalidImport):
+		s.writeError(w, http.StatusBadRequest, op, err)
+	default:
+		s.writeQueryError(w, err)
+	}
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var ErrIndexNotFound = errors.New("index not found")
+
+// IndexRequest is the body of PUT /tables/{table}/indexes/{name}.
+type IndexRequest struct {
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique,omitempty"`
+}
+
+// IndexInfo describes an index of a table. SQL is the statement the index was created with, which also covers
+// indexes on expressions created through SQL.
+type IndexInfo struct {
+	Name   string `json:"name"`
+	Table  string `json:"table"`
+	Unique bool   `json:"unique"`
+	SQL    string `json:"sql"`
+}
+
+// Indexes lists the indexes of the table. The indexes DuckDB maintains for primary keys and unique constraints are not
+// part of the catalog and not listed.
+func (s *Store) Indexes(ctx context.Context, table string) ([]IndexInfo, error) {
+	if _, err := s.existingColumns(ctx, table); err != nil {
+		return nil, err
+	}
+	return s.indexes(ctx, table, "")
+}
+
+// indexes lists the indexes of the table, only the one with the name unless it is empty.
+func (s *Store) indexes(ctx context.Context, table, name string) ([]IndexInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT index_name, table_name, is_unique, coalesce(sql, '')
+		FROM duckdb_indexes()
+		WHERE database_name IN `+ownCatalogs+` AND lower(table_name) = lower(?)
+			AND (? = '' OR lower(index_name) = lower(?))
+		ORDER BY index_name`, table, name, name)
+	if err != nil {
+		return nil, fmt.Errorf("listing indexes: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := []IndexInfo{}
+	for rows.Next() {
+		var idx IndexInfo
+		if err = rows.Scan(&idx.Name, &idx.Table, &idx.Unique, &idx.SQL); err != nil {
+			return nil, fmt.Errorf("scanning index: %w", err)
+		}
+		idx.SQL = strings.TrimSpace(idx.SQL)
+		out = append(out, idx)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing indexes: %w", err)
+	}
+	return out, nil
+}
+
+// PutIndex creates an ART index on the columns of the table, replacing an index of the same name on that table. It
+// reports whether the index is new. Creating a unique index fails if the table holds duplicates.
+func (s *Store) PutIndex(ctx context.Context, table, name string, req IndexRequest) (*IndexInfo, bool, error) {
+	if !tableNameRegex.MatchString(name) {
+		return nil, false, fmt.Errorf("invalid index name %q: must match %s", name, tableNameRegex)
+	}
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(req.Columns) == 0 {
+		return nil, false, errors.New("invalid index: no columns")
+	}
+	quoted := make([]string, len(req.Columns))
+	for i, c := range req.Columns {
+		if quoted[i], err = column(cols, c); err != nil {
+			return nil, false, fmt.Errorf("invalid index: %w", err)
+		}
+	}
+	existing, err := s.indexes(ctx, table, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back index creation", "err", rollbackErr)
+		}
+	}()
+	if len(existing) > 0 {
+		if _, err = tx.ExecContext(ctx, "DROP INDEX "+quoteIdent(name)); err != nil {
+			return nil, false, fmt.Errorf("drop index: %w", err)
+		}
+	}
+	unique := ""
+	if req.Unique {
+		unique = "UNIQUE "
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"CREATE %sINDEX %s ON %s (%s)", unique, quoteIdent(name), quoteIdent(table), strings.Join(quoted, ", "),
+	)); err != nil {
+		return nil, false, fmt.Errorf("create index: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("committing index: %w", err)
+	}
+	committed = true
+
+	created, err := s.indexes(ctx, table, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(created) == 0 {
+		return nil, false, fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+	return &created[0], len(existing) == 0, nil
+}
+
+// DropIndex removes the index of the table.
+func (s *Store) DropIndex(ctx context.Context, table, name string) error {
+	existing, err := s.indexes(ctx, table, name)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("%w: %s on %s", ErrIndexNotFound, name, table)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err = s.db.ExecContext(ctx, "DROP INDEX "+quoteIdent(existing[0].Name)); err != nil {
+		return fmt.Errorf("drop index: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) HandleListIndexes(w http.ResponseWriter, r *http.Request) {
+	indexes, err := s.store.Indexes(r.Context(), r.PathValue("table"))
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle list indexes", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle list indexes", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle list indexes: writing response", indexes)
+}
+
+// HandlePutIndex creates the index named in the path on the table in the path, replacing an existing one.
+func (s *Server) HandlePutIndex(w http.ResponseWriter, r *http.Request) {
+	var req IndexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put index: decoding request body", err)
+		return
+	}
+	idx, created, err := s.store.PutIndex(r.Context(), r.PathValue("table"), r.PathValue("name"), req)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle put index", err)
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle put index", err)
+	case created:
+		s.writeJSON(w, http.StatusCreated, "handle put index: writing response", idx)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle put index: writing response", idx)
+	}
+}
+
+func (s *Server) HandleDropIndex(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DropIndex(r.Context(), r.PathValue("table"), r.PathValue("name"))
+	if errors.Is(err, ErrIndexNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle drop index", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle drop index", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrQueryNotFound = errors.New("query not found")
+
+// InFlightQuery is a query that is currently executing.
+type InFlightQuery struct {
+	ID        string    `json:"id"`
+	SQL       string    `json:"sql"`
+	Caller    string    `json:"caller"`
+	Tag       string    `json:"tag,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+}
+
+type inFlightEntry struct {
+	query  InFlightQuery
+	cancel context.CancelFunc
+}
+
+// inFlight tracks the executing queries of a server so they can be listed and cancelled.
+type inFlight struct {
+	mu   sync.Mutex
+	byID map[string]*inFlightEntry
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{byID: make(map[string]*inFlightEntry)}
+}
+
+// register adds the query and returns a function that removes it again. cancel is called when the query is killed.
+func (f *inFlight) register(sql, caller, tag string, cancel context.CancelFunc) (func(), error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byID[id] = &inFlightEntry{
+		query:  InFlightQuery{ID: id, SQL: sql, Caller: caller, Tag: tag, StartedAt: time.Now()},
+		cancel: cancel,
+	}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.byID, id)
+	}, nil
+}
+
+// list returns the executing queries, oldest first.
+func (f *inFlight) list() []InFlightQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]InFlightQuery, 0, len(f.byID))
+	for _, e := range f.byID {
+		q := e.query
+		q.ElapsedMS = time.Since(q.StartedAt).Milliseconds()
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt.Before(out[j].StartedAt)
+	})
+	return out
+}
+
+func (f *inFlight) kill(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.byID[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrQueryNotFound, id)
+	}
+	e.cancel()
+	return nil
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// caller identifies who issued the request, by its API key or token if it has one.
+func caller(r *http.Request) string {
+	if p, ok := requestPrincipal(r.Context()); ok {
+		return p.Name
+	}
+	return r.RemoteAddr
+}
+
+func (s *Server) HandleListQueries(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list queries: writing response", s.inFlight.list())
+}
+
+// HandleKillQuery cancels the context of an executing query, which interrupts it in DuckDB.
+func (s *Server) HandleKillQuery(w http.ResponseWriter, r *http.Request) {
+	if err := s.inFlight.kill(r.PathValue("id")); err != nil {
+		s.writeError(w, http.StatusNotFound, "handle kill query", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
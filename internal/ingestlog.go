@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithIngestLog appends every insert to the file at path before writing it, so a backup can be restored to a point in
+// time after it was taken. Only inserts are logged, other writes such as deletes and DDL are lost on replay. The file
+// grows until it is removed, which is safe once a newer backup exists.
+func WithIngestLog(path string) StoreOption {
+	return func(s *Store) {
+		s.ingestLog = nil
+		if path != "" {
+			s.ingestLog = &ingestLog{path: path}
+		}
+	}
+}
+
+// ingestEntry is a line of the ingest log.
+type ingestEntry struct {
+	Time    time.Time        `json:"time"`
+	Table   string           `json:"table"`
+	Columns map[string]any   `json:"columns,omitempty"`
+	Rows    []map[string]any `json:"rows,omitempty"`
+}
+
+// ingestLog is a file of JSON lines, one per insert, synced before the insert runs.
+type ingestLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (l *ingestLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("ingest log: opening %s: %w", l.path, err)
+	}
+	l.file = f
+	return nil
+}
+
+func (l *ingestLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("ingest log: closing %s: %w", l.path, err)
+	}
+	l.file = nil
+	return nil
+}
+
+func (l *ingestLog) append(stmt *InsertStatement) error {
+	line, err := json.Marshal(ingestEntry{
+		Time:    time.Now().UTC(),
+		Table:   stmt.Table,
+		Columns: stmt.Columns,
+		Rows:    stmt.Rows,
+	})
+	if err != nil {
+		return fmt.Errorf("ingest log: encoding insert: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("ingest log: closed")
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("ingest log: writing: %w", err)
+	}
+	if err = l.file.Sync(); err != nil {
+		return fmt.Errorf("ingest log: syncing: %w", err)
+	}
+	return nil
+}
+
+// replayIngestLog inserts the logged statements after from and up to until again, without logging them twice. An
+// insert that fails is skipped, it failed the same way when it was logged. It returns the numbers of replayed and
+// skipped statements. The caller holds the write lock.
+func (s *Store) replayIngestLog(ctx context.Context, from, until time.Time) (int, int, error) {
+	if s.ingestLog == nil {
+		return 0, 0, fmt.Errorf("%w: the ingest log is disabled", ErrInvalidBackup)
+	}
+	f, err := os.Open(s.ingestLog.path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("replay: opening ingest log: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("replay: closing ingest log", "err", closeErr)
+		}
+	}()
+
+	var replayed, skipped int
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	for {
+		var entry ingestEntry
+		err = dec.Decode(&entry)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// A crash while appending leaves a partial last line, its insert never ran.
+			return replayed, skipped, nil
+		}
+		if err != nil {
+			return replayed, skipped, fmt.Errorf("replay: decoding ingest log: %w", err)
+		}
+		if !entry.Time.After(from) {
+			continue
+		}
+		if entry.Time.After(until) {
+			return replayed, skipped, nil
+		}
+		stmt := &InsertStatement{Table: entry.Table, Columns: entry.Columns, Rows: entry.Rows}
+		if err = exactRows(stmt.rows()...); err != nil {
+			return replayed, skipped, fmt.Errorf("replay: decoding ingest log: %w", err)
+		}
+		if err = s.insert(ctx, stmt, nil, nil); err != nil {
+			if ctx.Err() != nil {
+				return replayed, skipped, fmt.Errorf("replay: %w", ctx.Err())
+			}
+			slog.Warn("replay: skipping insert", "time", entry.Time, "table", entry.Table, "err", err)
+			skipped++
+			continue
+		}
+		replayed++
+	}
+}
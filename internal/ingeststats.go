@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ingestRateWindow is the window the rows and bytes per second of a table are averaged over.
+const ingestRateWindow = 60 * time.Second
+
+// ingestLatencyBuckets are the upper bounds in seconds of the buckets of the insert latency histograms.
+//
+//nolint:gochecknoglobals // Read-only list.
+var ingestLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// IngestStats is the body of GET /tables/{table}/stats/ingest. The counters count the inserts into the table since
+// the server started, imports aren't counted. Bytes are measured like Quota.MaxBytes, as the JSON encoding of the
+// rows.
+type IngestStats struct {
+	Table string `json:"table"`
+	// Inserts are the insert statements, Failures those that failed.
+	Inserts  int64 `json:"inserts"`
+	Failures int64 `json:"failures"`
+	Rows     int64 `json:"rows"`
+	Bytes    int64 `json:"bytes"`
+	// SchemaSyncRetries counts the inserts retried after ingestion created the table or added columns to it.
+	SchemaSyncRetries int64 `json:"schema_sync_retries"`
+	// RowsPerSecond and BytesPerSecond are averaged over the last minute.
+	RowsPerSecond  float64          `json:"rows_per_second"`
+	BytesPerSecond float64          `json:"bytes_per_second"`
+	Latency        LatencyHistogram `json:"latency"`
+	LastInsert     *time.Time       `json:"last_insert,omitempty"`
+}
+
+// LatencyHistogram counts the durations of the inserts holding the write path.
+type LatencyHistogram struct {
+	// Buckets count the inserts that took up to LE seconds, including those of the smaller buckets.
+	Buckets    []HistogramBucket `json:"buckets"`
+	Count      int64             `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+}
+
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// ingestSample is what an insert wrote.
+type ingestSample struct {
+	rows    int
+	bytes   int
+	retries int
+}
+
+// ingestSecond are the rows and bytes written in a second of the rate window.
+type ingestSecond struct {
+	unix  int64
+	rows  int64
+	bytes int64
+}
+
+type tableIngest struct {
+	stats IngestStats
+	// latency are the counts of the latency buckets, not cumulative, with the inserts beyond the last bucket last.
+	latency []int64
+	seconds [int(ingestRateWindow / time.Second)]ingestSecond
+}
+
+func newTableIngest(table string) *tableIngest {
+	return &tableIngest{stats: IngestStats{Table: table}, latency: make([]int64, len(ingestLatencyBuckets)+1)}
+}
+
+// ingestStats keeps the IngestStats of the tables.
+type ingestStats struct {
+	mu      sync.Mutex
+	byTable map[string]*tableIngest
+}
+
+func newIngestStats() *ingestStats {
+	return &ingestStats{byTable: make(map[string]*tableIngest)}
+}
+
+// record accounts the insert into the table that took the duration.
+func (st *ingestStats) record(table string, sample ingestSample, duration time.Duration, failed bool) {
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.byTable[strings.ToLower(table)]
+	if !ok {
+		t = newTableIngest(table)
+		st.byTable[strings.ToLower(table)] = t
+	}
+	t.stats.Inserts++
+	if failed {
+		t.stats.Failures++
+	}
+	t.stats.Rows += int64(sample.rows)
+	t.stats.Bytes += int64(sample.bytes)
+	t.stats.SchemaSyncRetries += int64(sample.retries)
+	t.stats.LastInsert = &now
+	seconds := duration.Seconds()
+	t.latency[sort.SearchFloat64s(ingestLatencyBuckets, seconds)]++
+	t.stats.Latency.Count++
+	t.stats.Latency.SumSeconds += seconds
+	sec := &t.seconds[now.Unix()%int64(len(t.seconds))]
+	if sec.unix != now.Unix() {
+		*sec = ingestSecond{unix: now.Unix()}
+	}
+	sec.rows += int64(sample.rows)
+	sec.bytes += int64(sample.bytes)
+}
+
+// get returns the stats of the table, false if nothing was inserted into it.
+func (st *ingestStats) get(table string) (IngestStats, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.byTable[strings.ToLower(table)]
+	if !ok {
+		return IngestStats{}, false
+	}
+	return t.snapshot(time.Now()), true
+}
+
+// list returns the stats of the tables sorted by table.
+func (st *ingestStats) list() []IngestStats {
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]IngestStats, 0, len(st.byTable))
+	for _, t := range st.byTable {
+		out = append(out, t.snapshot(now))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Table < out[j].Table
+	})
+	return out
+}
+
+func (st *ingestStats) remove(table string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.byTable, strings.ToLower(table))
+}
+
+func (st *ingestStats) renamed(from, to string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.byTable[strings.ToLower(from)]
+	if !ok {
+		return
+	}
+	delete(st.byTable, strings.ToLower(from))
+	t.stats.Table = to
+	st.byTable[strings.ToLower(to)] = t
+}
+
+// snapshot returns the stats with the rates of the window ending now and the cumulative buckets of the histogram.
+func (t *tableIngest) snapshot(now time.Time) IngestStats {
+	out := t.stats
+	var rows, bytes int64
+	for _, sec := range t.seconds {
+		if now.Unix()-sec.unix < int64(len(t.seconds)) {
+			rows += sec.rows
+			bytes += sec.bytes
+		}
+	}
+	out.RowsPerSecond = float64(rows) / ingestRateWindow.Seconds()
+	out.BytesPerSecond = float64(bytes) / ingestRateWindow.Seconds()
+	out.Latency.Buckets = make([]HistogramBucket, len(ingestLatencyBuckets))
+	var count int64
+	for i, le := range ingestLatencyBuckets {
+		count += t.latency[i]
+		out.Latency.Buckets[i] = HistogramBucket{LE: le, Count: count}
+	}
+	return out
+}
+
+// IngestStats returns the ingest stats of the table. Tables without inserts since the server started have zero stats.
+func (s *Store) IngestStats(table string) IngestStats {
+	if stats, ok := s.ingest.get(table); ok {
+		return stats
+	}
+	return newTableIngest(table).snapshot(time.Now())
+}
+
+// HandleIngestStats responds with the ingest stats of the table in the path.
+func (s *Server) HandleIngestStats(w http.ResponseWriter, r *http.Request) {
+	table := r.PathValue("table")
+	if _, err := s.store.existingColumns(r.Context(), table); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrTableNotFound) {
+			code = http.StatusNotFound
+		}
+		s.writeError(w, code, "handle ingest stats", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle ingest stats: writing response", s.store.IngestStats(table))
+}
+
+// MetricsContentType is the content type of the Prometheus text format of GET /metrics.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// HandleMetrics writes the ingest stats of the tables in the Prometheus text format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	bw := bufio.NewWriter(w)
+	writeIngestMetrics(bw, s.store.ingest.list())
+	if err := bw.Flush(); err != nil {
+		slog.Error("handle metrics: writing response", "err", err)
+	}
+}
+
+// writeIngestMetrics writes the stats as metric families labeled with the table. Table names need no escaping.
+func writeIngestMetrics(w *bufio.Writer, stats []IngestStats) {
+	family := func(name, typ, help string, value func(IngestStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, st := range stats {
+			fmt.Fprintf(w, "%s{table=%q} %s\n", name, st.Table, formatMetric(value(st)))
+		}
+	}
+	family("scratch_ingest_inserts_total", "counter", "Insert statements per table.", func(st IngestStats) float64 {
+		return float64(st.Inserts)
+	})
+	family("scratch_ingest_failures_total", "counter", "Failed insert statements per table.",
+		func(st IngestStats) float64 {
+			return float64(st.Failures)
+		})
+	family("scratch_ingest_rows_total", "counter", "Inserted rows per table.", func(st IngestStats) float64 {
+		return float64(st.Rows)
+	})
+	family("scratch_ingest_bytes_total", "counter", "Inserted bytes of JSON per table.", func(st IngestStats) float64 {
+		return float64(st.Bytes)
+	})
+	family("scratch_ingest_schema_sync_retries_total", "counter",
+		"Inserts retried after creating or altering the table.", func(st IngestStats) float64 {
+			return float64(st.SchemaSyncRetries)
+		})
+	family("scratch_ingest_rows_per_second", "gauge", "Inserted rows per second over the last minute.",
+		func(st IngestStats) float64 {
+			return st.RowsPerSecond
+		})
+	family("scratch_ingest_bytes_per_second", "gauge", "Inserted bytes per second over the last minute.",
+		func(st IngestStats) float64 {
+			return st.BytesPerSecond
+		})
+
+	const latency = "scratch_ingest_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the inserts per table.\n# TYPE %s histogram\n", latency, latency)
+	for _, st := range stats {
+		for _, b := range st.Latency.Buckets {
+			fmt.Fprintf(w, "%s_bucket{table=%q,le=%q} %d\n", latency, st.Table, formatMetric(b.LE), b.Count)
+		}
+		fmt.Fprintf(w, "%s_bucket{table=%q,le=\"+Inf\"} %d\n", latency, st.Table, st.Latency.Count)
+		fmt.Fprintf(w, "%s_sum{table=%q} %s\n", latency, st.Table, formatMetric(st.Latency.SumSeconds))
+		fmt.Fprintf(w, "%s_count{table=%q} %d\n", latency, st.Table, st.Latency.Count)
+	}
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
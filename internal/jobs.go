@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobRetention is how long the results of a finished job are kept.
+const JobRetention = 10 * time.Minute
+
+// JobStatus is the state of an asynchronous query.
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// Job is the status of an asynchronous query as returned by the jobs endpoints.
+type Job struct {
+	ID         string     `json:"id"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	RowCount   int        `json:"row_count"`
+	Caller     string     `json:"caller"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type job struct {
+	mu     sync.Mutex
+	status Job
+	result *QueryResult
+	cancel context.CancelFunc
+}
+
+func (j *job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+func (j *job) finish(status JobStatus, res *QueryResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status != JobRunning {
+		return
+	}
+	now := time.Now()
+	j.status.Status = status
+	j.status.FinishedAt = &now
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+	if res != nil {
+		j.result = res
+		j.status.RowCount = len(res.Rows)
+	}
+}
+
+// jobs keeps the asynchronous queries of a server in memory. Finished jobs are pruned after JobRetention.
+type jobs struct {
+	mu   sync.Mutex
+	byID map[string]*job
+	// running counts the jobs whose query hasn't returned yet.
+	running sync.WaitGroup
+}
+
+func newJobs() *jobs {
+	return &jobs{byID: make(map[string]*job)}
+}
+
+// add registers a running job of the caller of the request.
+func (js *jobs) add(r *http.Request, cancel context.CancelFunc) (*job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		status: Job{ID: id, Status: JobRunning, Caller: caller(r), CreatedAt: time.Now()},
+		cancel: cancel,
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.prune()
+	js.byID[j.status.ID] = j
+	return j, nil
+}
+
+// get returns the job if the request may see it, see ownedBy.
+func (js *jobs) get(r *http.Request, id string) (*job, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.prune()
+	j, ok := js.byID[id]
+	if !ok || !ownedBy(r, j.snapshot().Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return j, nil
+}
+
+// prune drops the jobs that finished more than JobRetention ago. The caller holds the lock.
+func (js *jobs) prune() {
+	for id, j := range js.byID {
+		if status := j.snapshot(); status.FinishedAt != nil && time.Since(*status.FinishedAt) > JobRetention {
+			delete(js.byID, id)
+		}
+	}
+}
+
+// cancelRunning cancels the queries of the jobs that are still running.
+func (js *jobs) cancelRunning() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.byID {
+		if j.snapshot().Status == JobRunning {
+			j.cancel()
+		}
+	}
+}
+
+// Shutdown waits for the running query and import jobs to finish. Once ctx is done the remaining jobs are cancelled
+// and their queries waited for, so the store can be closed after Shutdown returns.
+func (s *Server) Shutdown(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		s.jobs.running.Wait()
+		s.importJobs.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+	s.jobs.cancelRunning()
+	s.importJobs.cancelRunning()
+	<-finished
+	return fmt.Errorf("waiting for jobs: %w", ctx.Err())
+}
+
+// HandleCreateJob starts the query of a QueryRequest in the background and responds with the job. The query is bound
+// by the server maximum timeout rather than the lifetime of the request.
+func (s *Server) HandleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create job: decoding request body", err)
+		return
+	}
+	markAudit(r.Context(), AuditQuery, req.SQL)
+	if req.Cursor != "" {
+		s.writeError(w, http.StatusBadRequest, "handle create job", errors.New("cursor is not supported for jobs"))
+		return
+	}
+	tag, err := queryTag(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create job", err)
+		return
+	}
+	// The job runs detached from the request, its access is checked and its rows are secured now.
+	stmt, err := s.store.checkQuery(r.Context(), &QueryStatement{Query: req.SQL, Params: req.Params, Limit: req.Limit})
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if s.maxQueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), s.maxQueryTimeout)
+	}
+	j, err := s.jobs.add(r, cancel)
+	if err != nil {
+		cancel()
+		s.writeError(w, http.StatusInternalServerError, "handle create job", err)
+		return
+	}
+	done, err := s.inFlight.register(req.SQL, caller(r), tag, cancel)
+	if err != nil {
+		cancel()
+		j.finish(JobFailed, nil, err)
+		s.writeError(w, http.StatusInternalServerError, "handle create job", err)
+		return
+	}
+	s.jobs.running.Add(1)
+	go func() {
+		defer s.jobs.running.Done()
+		defer done()
+		defer cancel()
+		res, fetchErr := s.fetchJob(ctx, stmt, tag)
+		switch {
+		case fetchErr == nil:
+			j.finish(JobSucceeded, res, nil)
+		case errors.Is(fetchErr, context.Canceled):
+			j.finish(JobCancelled, nil, nil)
+		default:
+			j.finish(JobFailed, nil, fetchErr)
+		}
+	}()
+	s.writeJSON(w, http.StatusAccepted, "handle create job: writing response", j.snapshot())
+}
+
+// fetchJob runs the statement of a job once it got an execution slot. Jobs wait for a slot like other queries of
+// their tag and fail if the queue is full.
+func (s *Server) fetchJob(ctx context.Context, stmt *QueryStatement, tag string) (*QueryResult, error) {
+	release, err := s.acquireQuery(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.store.Fetch(ctx, stmt)
+}
+
+func (s *Server) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.get(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get job", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get job: writing response", j.snapshot())
+}
+
+// HandleCancelJob cancels a running job. Cancelling a finished job leaves it as is.
+func (s *Server) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.get(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle cancel job", err)
+		return
+	}
+	j.finish(JobCancelled, nil, nil)
+	j.cancel()
+	s.writeJSON(w, http.StatusOK, "handle cancel job: writing response", j.snapshot())
+}
+
+//nolint:gochecknoglobals // Read-only list of the formats offered for job results.
+var jobResultFormats = []Format{FormatJSON, FormatNDJSON, FormatCSV, FormatMsgPack, FormatColumnar}
+
+// HandleJobResults writes a page of the result of a succeeded job. Pages are selected with the limit and cursor
+// parameters like on the query endpoints; without a limit the whole result is returned.
+func (s *Server) HandleJobResults(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.get(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle job results", err)
+		return
+	}
+	format, err := Negotiate(r, jobResultFormats)
+	if err != nil {
+		s.writeError(w, http.StatusNotAcceptable, "handle job results: negotiating format", err)
+		return
+	}
+	opts, err := parseEncodeOptions(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle job results", err)
+		return
+	}
+	j.mu.Lock()
+	status, full := j.status, j.result
+	j.mu.Unlock()
+	if status.Status != JobSucceeded {
+		s.writeJSON(w, http.StatusConflict, "handle job results: writing status", status)
+		return
+	}
+	res, err := jobPage(r, status.ID, full)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle job results: parsing parameters", err)
+		return
+	}
+
+	if res.NextCursor != "" {
+		w.Header().Set(NextCursorHeader, res.NextCursor)
+	}
+	w.Header().Set(ColumnTypesHeader, FormatColumnTypes(res.Columns))
+	var buf bytes.Buffer
+	if err = encodeResult(&buf, format, res, opts); err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle job results: encoding response", err)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err = buf.WriteTo(w); err != nil {
+		slog.Error("handle job results: writing response", "err", err)
+	}
+}
+
+// jobPage slices the page selected by the limit and cursor parameters out of the job result. Cursors are tied to the
+// job ID.
+func jobPage(r *http.Request, id string, full *QueryResult) (*QueryResult, error) {
+	cursor := &queryCursor{Hash: id}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if cursor.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("parsing limit: %w", err)
+		}
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		decoded, err := decodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		if decoded.Hash != id {
+			return nil, fmt.Errorf("%w: issued for a different job", ErrInvalidCursor)
+		}
+		cursor.Offset = decoded.Offset
+		if cursor.Limit <= 0 {
+			cursor.Limit = decoded.Limit
+		}
+	}
+	res := &QueryResult{Columns: full.Columns, Rows: full.Rows, Elapsed: full.Elapsed}
+	if cursor.Limit <= 0 {
+		return res, nil
+	}
+	start := min(cursor.Offset, len(full.Rows))
+	end := min(start+cursor.Limit, len(full.Rows))
+	res.Rows = full.Rows[start:end]
+	if end < len(full.Rows) {
+		cursor.Offset = end
+		res.NextCursor = cursor.encode()
+	}
+	return res, nil
+}
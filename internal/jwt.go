@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned for JWTs that are malformed, not signed by the issuer, or expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+const (
+	// jwksTTL is how long the keys of the issuer are used before they are fetched again.
+	jwksTTL = time.Hour
+	// jwksMinRefresh bounds how often tokens with an unknown key ID fetch the keys again, after the issuer rotated them.
+	jwksMinRefresh = time.Minute
+	// jwtLeeway is the clock skew tolerated on the exp and nbf claims.
+	jwtLeeway = time.Minute
+	// maxJWKSBytes bounds the response of the JWKS URL.
+	maxJWKSBytes = 1 << 20
+)
+
+// JWTConfig configures the verification of JWTs issued by an identity provider.
+type JWTConfig struct {
+	// Issuer must equal the iss claim of the tokens.
+	Issuer string `yaml:"issuer"`
+	// JWKSURL serves the public keys of the issuer as a JSON Web Key Set, e.g. <issuer>/.well-known/jwks.json.
+	JWKSURL string `yaml:"jwks_url"`
+	// Audience must be one of the aud claim of the tokens if set.
+	Audience string `yaml:"audience"`
+	// ScopeClaim is the claim holding the scopes of a token, a space separated string or an array of strings. It
+	// defaults to scope.
+	ScopeClaim string `yaml:"scope_claim"`
+	// Scopes maps values of the scope claim to scopes, e.g. "analytics:read": query. The values ingest, query and admin
+	// map to themselves, other values are ignored.
+	Scopes map[string]Scope `yaml:"scopes"`
+	// TenantClaim is the claim naming the tenant the inserts of a token are accounted to, see Quotas. Empty for none.
+	TenantClaim string `yaml:"tenant_claim"`
+	// RolesClaim is the claim holding the roles TableACL grants access to, like the scope claim. Empty for none.
+	RolesClaim string `yaml:"roles_claim"`
+}
+
+// JWTVerifier verifies the JWTs of an issuer with the keys of its JWKS URL. It supports the RS, PS and ES algorithms
+// and EdDSA.
+type JWTVerifier struct {
+	config JWTConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWTVerifier returns a verifier for the configuration. The keys are fetched with the first token.
+func NewJWTVerifier(config JWTConfig) (*JWTVerifier, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("jwt: missing issuer")
+	}
+	u, err := url.Parse(config.JWKSURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("jwt: jwks url must be an http or https URL: %q", config.JWKSURL)
+	}
+	if config.ScopeClaim == "" {
+		config.ScopeClaim = "scope"
+	}
+	for value, scope := range config.Scopes {
+		if scope != ScopeIngest && scope != ScopeQuery && scope != ScopeAdmin {
+			return nil, fmt.Errorf("jwt: %q maps to unknown scope %q", value, scope)
+		}
+	}
+	return &JWTVerifier{config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// WithJWT accepts JWTs verified by the verifier besides API keys, and requires one of them on every request.
+func WithJWT(verifier *JWTVerifier) ServerOption {
+	return func(s *Server) {
+		s.jwt = verifier
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, a string or an array of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*a = jwtAudience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Verify checks the signature and claims of the token and returns its subject and scopes.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, fmt.Errorf("%w: expected three parts", ErrInvalidToken)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Principal{}, fmt.Errorf("%w: header: %w", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: signature: %w", ErrInvalidToken, err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return Principal{}, err
+	}
+	if err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return Principal{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	var claims jwtClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, fmt.Errorf("%w: claims: %w", ErrInvalidToken, err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.config.Issuer:
+		return Principal{}, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	case claims.Expires == nil:
+		return Principal{}, fmt.Errorf("%w: missing exp", ErrInvalidToken)
+	case now.Add(-jwtLeeway).After(time.Unix(int64(*claims.Expires), 0)):
+		return Principal{}, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return Principal{}, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case v.config.Audience != "" && !slices.Contains(claims.Audience, v.config.Audience):
+		return Principal{}, fmt.Errorf("%w: audience is not %q", ErrInvalidToken, v.config.Audience)
+	}
+
+	var all map[string]any
+	if err = decodeJWTPart(parts[1], &all); err != nil {
+		return Principal{}, fmt.Errorf("%w: claims: %w", ErrInvalidToken, err)
+	}
+	p := Principal{Name: "jwt:" + claims.Subject, Scopes: v.scopes(all[v.config.ScopeClaim])}
+	if v.config.TenantClaim != "" {
+		p.Tenant, _ = all[v.config.TenantClaim].(string)
+	}
+	if v.config.RolesClaim != "" {
+		p.Roles = claimStrings(all[v.config.RolesClaim])
+	}
+	return p, nil
+}
+
+// claimStrings returns the values of a claim that is a space separated string or an array of strings.
+func claimStrings(claim any) []string {
+	var values []string
+	switch c := claim.(type) {
+	case string:
+		values = strings.Fields(c)
+	case []any:
+		for _, value := range c {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// scopes maps the values of the scope claim to scopes.
+func (v *JWTVerifier) scopes(claim any) []Scope {
+	var out []Scope
+	for _, value := range claimStrings(claim) {
+		scope, ok := v.config.Scopes[value]
+		if !ok {
+			scope = Scope(value)
+		}
+		if scope == ScopeIngest || scope == ScopeQuery || scope == ScopeAdmin {
+			out = append(out, scope)
+		}
+	}
+	return out
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWTSignature checks the signature of the signing input with the key for the algorithm of the header. The
+// algorithm has to suit the type of the key, so a token can't pick a weaker check.
+func verifyJWTSignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, input, signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var (
+		h        hash.Hash
+		hashFunc crypto.Hash
+		// curveBits is the size of the curve of the ES algorithm.
+		curveBits int
+	)
+	switch alg[2:] {
+	case "256":
+		h, hashFunc, curveBits = sha256.New(), crypto.SHA256, 256
+	case "384":
+		h, hashFunc, curveBits = sha512.New384(), crypto.SHA384, 384
+	case "512":
+		h, hashFunc, curveBits = sha512.New(), crypto.SHA512, 521
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(pub, hashFunc, digest, signature) != nil {
+				return errors.New("bad signature")
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(pub, hashFunc, digest, signature, nil) != nil {
+				return errors.New("bad signature")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" && pub.Curve.Params().BitSize == curveBits {
+			size := (curveBits + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("bad signature")
+			}
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(pub, digest, r, s) {
+				return errors.New("bad signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %q doesn't suit the key", alg)
+}
+
+// key returns the key with the ID from the JWKS of the issuer, or its only key if the ID is empty. Unknown IDs fetch
+// the keys again, at most every jwksMinRefresh.
+func (v *JWTVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	find := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k, true
+			}
+		}
+		k, ok := v.keys[kid]
+		return k, ok
+	}
+	age := time.Since(v.fetched)
+	if k, ok := find(); ok && age < jwksTTL {
+		return k, nil
+	}
+	if v.keys == nil || age >= jwksMinRefresh {
+		keys, err := v.fetch(ctx)
+		if err != nil {
+			// Keys past their TTL are still good while the issuer is unreachable.
+			if k, ok := find(); ok {
+				slog.Warn("jwt: refreshing keys", "err", err)
+				return k, nil
+			}
+			return nil, err
+		}
+		v.keys, v.fetched = keys, time.Now()
+	}
+	if k, ok := find(); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// jwk is a key of a JSON Web Key Set, see RFC 7517 and RFC 7518.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch reads the signing keys of the JWKS URL by ID. Keys of unsupported types are skipped.
+func (v *JWTVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.config.JWKSURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: fetching keys: %w", err)
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			slog.Error("jwt: closing response", "err", closeErr)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: fetching keys: %s", res.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwt: decoding keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, keyErr := k.publicKey()
+		if keyErr != nil {
+			slog.Warn("jwt: skipping key", "kid", k.Kid, "err", keyErr)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("modulus: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		size := (c.curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid point")
+		}
+		// The uncompressed encoding is checked to be on the curve.
+		if _, err = c.ecdh.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("invalid point: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
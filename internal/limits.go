@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Limits bounds how far a single request can grow the catalog. A zero value for any field disables that check.
+type Limits struct {
+	MaxColumnsPerTable      int `json:"max_columns_per_table" yaml:"max_columns_per_table"`
+	MaxNewColumnsPerRequest int `json:"max_new_columns_per_request" yaml:"max_new_columns_per_request"`
+	MaxCellBytes            int `json:"max_cell_bytes" yaml:"max_cell_bytes"`
+	MaxRowsPerStatement     int `json:"max_rows_per_statement" yaml:"max_rows_per_statement"`
+	MaxParamsPerStatement   int `json:"max_params_per_statement" yaml:"max_params_per_statement"`
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxColumnsPerTable:      256,
+		MaxNewColumnsPerRequest: 32,
+		MaxCellBytes:            1 << 20,
+		MaxRowsPerStatement:     1000,
+		MaxParamsPerStatement:   32767,
+	}
+}
+
+type LimitCode string
+
+const (
+	LimitTableColumns LimitCode = "table_columns_exceeded"
+	LimitNewColumns   LimitCode = "new_columns_exceeded"
+	LimitCellBytes    LimitCode = "cell_size_exceeded"
+	// LimitStatementParams is returned when a single row has more values than a statement can bind.
+	LimitStatementParams LimitCode = "statement_params_exceeded"
+	// LimitQueryMemory is returned when a query runs out of the memory DuckDB is limited to.
+	LimitQueryMemory LimitCode = "memory_limit_exceeded"
+	// The tenant limits are returned when an insert would exceed the Quota of its tenant, the field is the tenant.
+	LimitTenantTables    LimitCode = "tenant_tables_exceeded"
+	LimitTenantBytes     LimitCode = "tenant_bytes_exceeded"
+	LimitTenantDailyRows LimitCode = "tenant_daily_rows_exceeded"
+)
+
+// LimitError is returned when a request would exceed one of the configured Limits. It is meant to be surfaced to the
+// client as is, so the producer can tell which field tripped which limit.
+type LimitError struct {
+	Code  LimitCode `json:"code"`
+	Field string    `json:"field"`
+	Limit int       `json:"limit"`
+	Value int       `json:"value"`
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("limit exceeded (%s) on field %s: %d > %d", e.Code, e.Field, e.Value, e.Limit)
+}
+
+// CheckCells validates the size of each value in the statement.
+func (l Limits) CheckCells(stmt *InsertStatement) error {
+	if l.MaxCellBytes <= 0 {
+		return nil
+	}
+	for _, row := range stmt.rows() {
+		for k, v := range row {
+			str, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if len(str) > l.MaxCellBytes {
+				return &LimitError{Code: LimitCellBytes, Field: k, Limit: l.MaxCellBytes, Value: len(str)}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckNewColumns validates that adding the missing columns to a table with the existing count stays in bounds.
+func (l Limits) CheckNewColumns(table string, existing int, missing []string) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	if l.MaxNewColumnsPerRequest > 0 && len(missing) > l.MaxNewColumnsPerRequest {
+		return &LimitError{
+			Code:  LimitNewColumns,
+			Field: missing[l.MaxNewColumnsPerRequest],
+			Limit: l.MaxNewColumnsPerRequest,
+			Value: len(missing),
+		}
+	}
+	return l.CheckTableColumns(table, existing, missing)
+}
+
+// CheckTableColumns validates that the table stays within the column limit once the missing columns are added. It
+// applies to table creation as well, where every column is new.
+func (l Limits) CheckTableColumns(table string, existing int, missing []string) error {
+	if l.MaxColumnsPerTable > 0 && existing+len(missing) > l.MaxColumnsPerTable {
+		field := table
+		if idx := l.MaxColumnsPerTable - existing; idx >= 0 && idx < len(missing) {
+			field = missing[idx]
+		}
+		return &LimitError{
+			Code:  LimitTableColumns,
+			Field: field,
+			Limit: l.MaxColumnsPerTable,
+			Value: existing + len(missing),
+		}
+	}
+	return nil
+}
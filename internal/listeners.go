@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UnixPrefix marks the address of a Listener as the path of a Unix domain socket, e.g. unix:/run/scratch.sock.
+const UnixPrefix = "unix:"
+
+// Surface is the part of the API a listener serves.
+type Surface string
+
+const (
+	// SurfaceAll serves every route, the default.
+	SurfaceAll Surface = "all"
+	// SurfaceAdmin serves only the admin routes below /admin/, e.g. on a port bound to localhost.
+	SurfaceAdmin Surface = "admin"
+	// SurfacePublic serves every route but the admin routes, e.g. ingest and queries on a public port.
+	SurfacePublic Surface = "public"
+)
+
+// Listener is an address the server accepts requests on, with the surface of the API it serves there.
+type Listener struct {
+	// Addr is a TCP address such as :8000 or 127.0.0.1:9000, or a Unix domain socket prefixed with UnixPrefix.
+	Addr string `yaml:"addr"`
+	// Surface defaults to SurfaceAll.
+	Surface Surface `yaml:"surface"`
+}
+
+// ParseListener parses an address with an optional surface, e.g. 127.0.0.1:9000=admin.
+func ParseListener(s string) (Listener, error) {
+	addr, surface, _ := strings.Cut(s, "=")
+	l := Listener{Addr: addr, Surface: Surface(surface)}
+	return l, ValidateListeners([]Listener{l})
+}
+
+// ValidateListeners checks the addresses and surfaces of the listeners.
+func ValidateListeners(listeners []Listener) error {
+	for i, l := range listeners {
+		if l.Addr == "" || l.Addr == UnixPrefix {
+			return fmt.Errorf("listener %d: missing address", i)
+		}
+		switch l.Surface {
+		case "", SurfaceAll, SurfaceAdmin, SurfacePublic:
+		default:
+			return fmt.Errorf("listener %d: unknown surface %q, expected all, admin or public", i, l.Surface)
+		}
+	}
+	return nil
+}
+
+// Unix reports whether the listener is a Unix domain socket.
+func (l Listener) Unix() bool {
+	return strings.HasPrefix(l.Addr, UnixPrefix)
+}
+
+// Listen opens the listener. A socket file left behind by a previous run is removed first, other files at the path
+// are refused.
+func (l Listener) Listen() (net.Listener, error) {
+	if !l.Unix() {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s: %w", l.Addr, err)
+		}
+		return ln, nil
+	}
+	path := strings.TrimPrefix(l.Addr, UnixPrefix)
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("listening on %s: %s exists and is not a socket", l.Addr, path)
+	case err == nil:
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listening on %s: removing stale socket: %w", l.Addr, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("listening on %s: %w", l.Addr, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", l.Addr, err)
+	}
+	return ln, nil
+}
+
+// serves reports whether the surface includes the route pattern.
+func (surface Surface) serves(pattern string) bool {
+	switch surface {
+	case SurfaceAdmin:
+		return isAdminPattern(pattern)
+	case SurfacePublic:
+		return !isAdminPattern(pattern)
+	default:
+		return true
+	}
+}
+
+// restrictSurface answers the requests to routes outside the surface with 404, as if they didn't exist.
+func (s *Server) restrictSurface(mux *http.ServeMux, next http.Handler, surface Surface) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" && !surface.serves(pattern) {
+			s.writeError(w, http.StatusNotFound, "handle request", fmt.Errorf("%s is not served here", r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidLogConfig = errors.New("invalid log config")
+
+// LogConfig selects the handler and the minimum level of the logger of the server.
+type LogConfig struct {
+	// Level is debug, info, warn or error, empty for info. WithLogLevel lets admins change it at runtime.
+	Level string `json:"level" yaml:"level"`
+	// Format is text or json, empty for text.
+	Format string `json:"format" yaml:"format"`
+}
+
+// parseLogLevel parses a level name, ignoring case.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("%w: level %q, expected debug, info, warn or error", ErrInvalidLogConfig, name)
+	}
+	return level, nil
+}
+
+// NewLogger returns a logger writing to w as configured, and the variable holding its level.
+func NewLogger(cfg LogConfig, w io.Writer) (*slog.Logger, *slog.LevelVar, error) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levelVar := new(slog.LevelVar)
+	levelVar.Set(level)
+	opts := &slog.HandlerOptions{Level: levelVar}
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), levelVar, nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), levelVar, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: format %q, expected text or json", ErrInvalidLogConfig, cfg.Format)
+	}
+}
+
+// WithLogLevel exposes the level of the logger on the admin endpoints, so it can be raised to debug without a
+// restart.
+func WithLogLevel(level *slog.LevelVar) ServerOption {
+	return func(s *Server) {
+		s.logLevel = level
+	}
+}
+
+// LogLevel is the body of the log level endpoints.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) HandleGetLogLevel(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle get log level: writing response",
+		LogLevel{Level: strings.ToLower(s.logLevel.Level().String())})
+}
+
+// HandlePutLogLevel changes the level of the logger until the next restart.
+func (s *Server) HandlePutLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req LogLevel
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put log level: decoding request body", err)
+		return
+	}
+	if req.Level == "" {
+		s.writeError(w, http.StatusBadRequest, "handle put log level",
+			fmt.Errorf("%w: missing level", ErrInvalidLogConfig))
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put log level", err)
+		return
+	}
+	previous := s.logLevel.Level()
+	s.logLevel.Set(level)
+	slog.Info("changed log level", "from", previous, "to", level)
+	s.writeJSON(w, http.StatusOK, "handle put log level: writing response",
+		LogLevel{Level: strings.ToLower(level.String())})
+}
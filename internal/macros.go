@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrMacroNotFound = errors.New("macro not found")
+	ErrInvalidMacro  = errors.New("invalid macro")
+)
+
+// Macro is a DuckDB macro. A scalar macro expands Body as an expression, e.g. parse_sku(x) with the body
+// split_part(x, '-', 1). A table macro expands Body as a query and is used in FROM clauses.
+type Macro struct {
+	Name        string   `json:"name"`
+	Params      []string `json:"params,omitempty"`
+	Body        string   `json:"body"`
+	Table       bool     `json:"table,omitempty"`
+	Description string   `json:"description,omitempty"`
+	// Error is set when the macro failed to register on startup, e.g. because a function it uses is gone.
+	Error string `json:"error,omitempty"`
+}
+
+func (m *Macro) Validate() error {
+	if !tableNameRegex.MatchString(m.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidMacro, tableNameRegex)
+	}
+	seen := make(map[string]bool, len(m.Params))
+	for _, p := range m.Params {
+		if !tableNameRegex.MatchString(p) {
+			return fmt.Errorf("%w: parameter %q must match %s", ErrInvalidMacro, p, tableNameRegex)
+		}
+		if seen[strings.ToLower(p)] {
+			return fmt.Errorf("%w: duplicate parameter %q", ErrInvalidMacro, p)
+		}
+		seen[strings.ToLower(p)] = true
+	}
+	// The body is embedded into a CREATE MACRO statement, it must not end that statement.
+	query := m.Body
+	if !m.Table {
+		query = "SELECT " + m.Body
+	}
+	if _, err := (&QueryStatement{Query: query}).singleRead(); err != nil {
+		return fmt.Errorf("%w: body must be a single read-only %s: %w", ErrInvalidMacro, m.kind(), err)
+	}
+	return nil
+}
+
+func (m *Macro) kind() string {
+	if m.Table {
+		return "query"
+	}
+	return "expression"
+}
+
+func (m *Macro) create() string {
+	body := m.Body
+	if m.Table {
+		body = "TABLE " + body
+	}
+	return fmt.Sprintf("CREATE OR REPLACE MACRO %s(%s) AS %s", m.Name, strings.Join(m.Params, ", "), body)
+}
+
+func (m *Macro) drop() string {
+	if m.Table {
+		return "DROP MACRO TABLE IF EXISTS " + m.Name
+	}
+	return "DROP MACRO IF EXISTS " + m.Name
+}
+
+// CreateMacro registers the macro in DuckDB, replacing a macro of the same name.
+func (s *Store) CreateMacro(ctx context.Context, m *Macro) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err := s.db.ExecContext(ctx, m.create()); err != nil {
+		return fmt.Errorf("create macro: %w", err)
+	}
+	return nil
+}
+
+// DropMacro removes the macro from DuckDB if it exists.
+func (s *Store) DropMacro(ctx context.Context, m *Macro) error {
+	if !tableNameRegex.MatchString(m.Name) {
+		return fmt.Errorf("drop macro: invalid name %q", m.Name)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err := s.db.ExecContext(ctx, m.drop()); err != nil {
+		return fmt.Errorf("drop macro: %w", err)
+	}
+	return nil
+}
+
+// Macros manages the user-defined macros of a store. With a path, the definitions are kept in that file and
+// registered again by NewMacros, so they survive restarts.
+type Macros struct {
+	store *Store
+	path  string
+
+	mu sync.Mutex
+	// byName holds the macros in the order they were first defined, which is the order they are registered in on
+	// startup so macros can use the ones defined before them.
+	byName map[string]*Macro
+	order  []string
+}
+
+// NewMacros loads the macros in the file at path, if it exists, and registers them. Macros that fail to register are
+// kept with their Error set. An empty path keeps the macros in memory only.
+func NewMacros(ctx context.Context, store *Store, path string) (*Macros, error) {
+	ms := &Macros{store: store, path: path, byName: make(map[string]*Macro)}
+	if path == "" {
+		return ms, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ms, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("macros: reading %s: %w", path, err)
+	}
+	var macros []Macro
+	if err = json.Unmarshal(data, &macros); err != nil {
+		return nil, fmt.Errorf("macros: parsing %s: %w", path, err)
+	}
+	for i := range macros {
+		m := &macros[i]
+		m.Error = ""
+		if createErr := store.CreateMacro(ctx, m); createErr != nil {
+			slog.Error("macros: registering macro", "name", m.Name, "err", createErr)
+			m.Error = createErr.Error()
+		}
+		ms.byName[m.Name] = m
+		ms.order = append(ms.order, m.Name)
+	}
+	return ms, nil
+}
+
+// Put registers the macro and persists it. It reports whether the macro is new.
+func (ms *Macros) Put(ctx context.Context, m Macro) (Macro, bool, error) {
+	m.Error = ""
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	prev, exists := ms.byName[m.Name]
+	if exists && prev.Table != m.Table {
+		// Scalar and table macros are replaced separately, the other kind would linger otherwise.
+		if err := ms.store.DropMacro(ctx, prev); err != nil {
+			return Macro{}, false, err
+		}
+	}
+	if err := ms.store.CreateMacro(ctx, &m); err != nil {
+		return Macro{}, false, err
+	}
+	ms.byName[m.Name] = &m
+	if !exists {
+		ms.order = append(ms.order, m.Name)
+	}
+	if err := ms.save(); err != nil {
+		return Macro{}, false, err
+	}
+	return m, !exists, nil
+}
+
+func (ms *Macros) Get(name string) (Macro, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m, ok := ms.byName[name]
+	if !ok {
+		return Macro{}, fmt.Errorf("%w: %s", ErrMacroNotFound, name)
+	}
+	return *m, nil
+}
+
+func (ms *Macros) List() []Macro {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	out := make([]Macro, 0, len(ms.byName))
+	for _, m := range ms.byName {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete drops the macro and removes it from the file.
+func (ms *Macros) Delete(ctx context.Context, name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m, ok := ms.byName[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMacroNotFound, name)
+	}
+	if err := ms.store.DropMacro(ctx, m); err != nil {
+		return err
+	}
+	delete(ms.byName, name)
+	for i, n := range ms.order {
+		if n == name {
+			ms.order = append(ms.order[:i], ms.order[i+1:]...)
+			break
+		}
+	}
+	return ms.save()
+}
+
+// save writes the macros to the file, replacing it atomically. The caller holds the lock.
+func (ms *Macros) save() error {
+	if ms.path == "" {
+		return nil
+	}
+	macros := make([]Macro, 0, len(ms.order))
+	for _, name := range ms.order {
+		m := *ms.byName[name]
+		m.Error = ""
+		macros = append(macros, m)
+	}
+	data, err := json.MarshalIndent(macros, "", "  ")
+	if err != nil {
+		return fmt.Errorf("macros: encoding: %w", err)
+	}
+	if err = writeFileAtomic(ms.path, data); err != nil {
+		return fmt.Errorf("macros: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) HandleListMacros(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list macros: writing response", s.macros.List())
+}
+
+// HandlePutMacro registers the macro named in the path, replacing an existing one.
+func (s *Server) HandlePutMacro(w http.ResponseWriter, r *http.Request) {
+	var m Macro
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put macro: decoding request body", err)
+		return
+	}
+	m.Name = r.PathValue("name")
+	m, created, err := s.macros.Put(r.Context(), m)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put macro: writing response", m)
+}
+
+func (s *Server) HandleGetMacro(w http.ResponseWriter, r *http.Request) {
+	m, err := s.macros.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get macro", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get macro: writing response", m)
+}
+
+func (s *Server) HandleDeleteMacro(w http.ResponseWriter, r *http.Request) {
+	err := s.macros.Delete(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrMacroNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete macro", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete macro", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
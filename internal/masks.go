@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MaskMode is how a ColumnMask redacts the values of a column.
+type MaskMode string
+
+const (
+	// MaskHash replaces values by the MD5 hash of their text, which keeps them comparable and countable.
+	MaskHash MaskMode = "hash"
+	// MaskPartial keeps the first character and the domain of email addresses, e.g. j***@example.com, and the last four
+	// characters of other values.
+	MaskPartial MaskMode = "partial"
+	// MaskNull replaces values by NULL.
+	MaskNull MaskMode = "null"
+)
+
+// ColumnMask redacts the columns matching Column of the tables matching Table, both path.Match patterns such as
+// *email*, in the query results of API keys and tokens other than admins and the grantees of Unmasked. Grantees are
+// roles or a key or token itself, like for TableACL. The first mask matching a column applies. Masked tables can only
+// be read through queries, by their unqualified name, like the tables of WithRowLevelSecurity.
+type ColumnMask struct {
+	Table  string   `json:"table" yaml:"table"`
+	Column string   `json:"column" yaml:"column"`
+	Mode   MaskMode `json:"mode" yaml:"mode"`
+	// Unmasked are the grantees reading the values as stored.
+	Unmasked []string `json:"unmasked,omitempty" yaml:"unmasked"`
+}
+
+// WithColumnMasks redacts columns in the query results of API keys and tokens, see ColumnMask.
+func WithColumnMasks(masks []ColumnMask) StoreOption {
+	return func(s *Store) {
+		s.masks = masks
+	}
+}
+
+// ValidateColumnMasks checks the patterns and modes of the masks.
+func ValidateColumnMasks(masks []ColumnMask) error {
+	for i, mask := range masks {
+		if mask.Table == "" || mask.Column == "" {
+			return fmt.Errorf("column mask %d: missing table or column", i)
+		}
+		for _, pattern := range []string{mask.Table, mask.Column} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("column mask %d: %q: %w", i, pattern, err)
+			}
+		}
+		switch mask.Mode {
+		case MaskHash, MaskPartial, MaskNull:
+		default:
+			return fmt.Errorf("column mask %d: unknown mode %q, expected hash, partial or null", i, mask.Mode)
+		}
+	}
+	return nil
+}
+
+// maskFor returns the mode of the first mask matching the column of the table the principal isn't granted unmasked
+// reads of, ignoring case like the catalog.
+func (s *Store) maskFor(p Principal, table, column string) (MaskMode, bool) {
+	for _, mask := range s.masks {
+		tableOK, _ := path.Match(strings.ToLower(mask.Table), strings.ToLower(table))
+		columnOK, _ := path.Match(strings.ToLower(mask.Column), strings.ToLower(column))
+		if tableOK && columnOK {
+			return mask.Mode, !p.granted(mask.Unmasked)
+		}
+	}
+	return "", false
+}
+
+// maskExpr returns the expression redacting the column of the type by the mode.
+func maskExpr(mode MaskMode, column, dataType string) string {
+	text := fmt.Sprintf("CAST(%s AS VARCHAR)", quoteIdent(column))
+	switch mode {
+	case MaskHash:
+		return fmt.Sprintf("md5(%s)", text)
+	case MaskPartial:
+		return fmt.Sprintf(`CASE WHEN contains(%[1]s, '@')
+			THEN substr(%[1]s, 1, 1) || '***' || substr(%[1]s, instr(%[1]s, '@'))
+			ELSE repeat('*', greatest(length(%[1]s) - 4, 0)) || substr(%[1]s, greatest(length(%[1]s) - 3, 1)) END`, text)
+	default:
+		return fmt.Sprintf("CAST(NULL AS %s)", dataType)
+	}
+}
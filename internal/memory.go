@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// WithMemoryLimit caps the memory DuckDB uses for query execution, in bytes. DuckDB only supports the limit for the
+// database as a whole, so it bounds all queries running at once, and a query that trips it fails with a LimitError
+// of code LimitQueryMemory. Zero keeps DuckDB's default of 80% of the system memory.
+func WithMemoryLimit(bytes int64) StoreOption {
+	return func(s *Store) {
+		s.memoryLimit = bytes
+	}
+}
+
+func (s *Store) applyMemoryLimit(ctx context.Context) error {
+	if s.memoryLimit <= 0 {
+		return nil
+	}
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("SET memory_limit='%dB'", s.memoryLimit)); err != nil {
+		return fmt.Errorf("setting memory limit: %w", err)
+	}
+	return nil
+}
+
+// memoryError turns the out of memory errors of DuckDB into a LimitError and returns other errors as is.
+func (s *Store) memoryError(err error) error {
+	if err == nil || !strings.Contains(err.Error(), "Out of Memory Error") {
+		return err
+	}
+	return &LimitError{Code: LimitQueryMemory, Field: "memory_limit", Limit: int(s.memoryLimit)}
+}
@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MigrationsTable records the migrations applied to each table. It is created with the first migration.
+const MigrationsTable = "_migrations"
+
+var (
+	ErrInvalidMigration  = errors.New("invalid migration")
+	ErrMigrationConflict = errors.New("migration version conflict")
+)
+
+// Migration is a numbered set of DDL statements changing the schema of one table. The versions of a table start at 1
+// and increase by one, so a migration written against an older schema is refused instead of applied out of order.
+type Migration struct {
+	Version    int        `json:"version"`
+	Name       string     `json:"name"`
+	Operations []string   `json:"operations"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+}
+
+// MigrationHistory lists the migrations applied to a table, Version is zero before the first one.
+type MigrationHistory struct {
+	Table      string      `json:"table"`
+	Version    int         `json:"version"`
+	Migrations []Migration `json:"migrations"`
+}
+
+// Validate checks that each operation is a single DDL statement on the table.
+func (m *Migration) Validate(table string) error {
+	if !tableNameRegex.MatchString(table) {
+		return fmt.Errorf("%w: table must match %s", ErrInvalidMigration, tableNameRegex)
+	}
+	if strings.EqualFold(table, MigrationsTable) {
+		return fmt.Errorf("%w: %s can't be migrated", ErrInvalidMigration, MigrationsTable)
+	}
+	if m.Version < 1 {
+		return fmt.Errorf("%w: version must be positive", ErrInvalidMigration)
+	}
+	if len(m.Operations) == 0 {
+		return fmt.Errorf("%w: no operations", ErrInvalidMigration)
+	}
+	for i, op := range m.Operations {
+		stmts, err := ClassifySQL(op)
+		if err != nil {
+			return &StatementError{Index: i, Err: err}
+		}
+		if len(stmts) != 1 || stmts[0].Class != StatementDDL {
+			return &StatementError{
+				Index: i,
+				Err:   fmt.Errorf("%w: operation must be a single DDL statement", ErrInvalidMigration),
+			}
+		}
+		target, err := ddlTarget(stmts[0].tokens)
+		if err != nil {
+			return &StatementError{Index: i, Err: err}
+		}
+		if !strings.EqualFold(target, table) {
+			return &StatementError{
+				Index: i,
+				Err:   fmt.Errorf("%w: operation changes %s instead of %s", ErrInvalidMigration, target, table),
+			}
+		}
+	}
+	return nil
+}
+
+// ddlTarget returns the table changed by ALTER TABLE, CREATE TABLE, CREATE INDEX and COMMENT ON statements. Other
+// statements are refused, their effect on a table isn't apparent from the statement.
+//
+//nolint:cyclop // One branch per statement form.
+func ddlTarget(tokens []sqlToken) (string, error) {
+	i := 0
+	skip := func(words ...string) bool {
+		if i+len(words) > len(tokens) {
+			return false
+		}
+		for j, word := range words {
+			if !tokens[i+j].is(sqlWord, word) {
+				return false
+			}
+		}
+		i += len(words)
+		return true
+	}
+	name := func() (string, error) {
+		if i >= len(tokens) || (tokens[i].kind != sqlWord && tokens[i].kind != sqlQuotedIdent) {
+			return "", fmt.Errorf("%w: missing table name", ErrInvalidMigration)
+		}
+		if i+1 < len(tokens) && tokens[i+1].is(sqlPunct, ".") {
+			return "", fmt.Errorf("%w: qualified table names are not supported", ErrInvalidMigration)
+		}
+		return tokens[i].text, nil
+	}
+	switch {
+	case skip("ALTER", "TABLE"):
+		skip("IF", "EXISTS")
+		return name()
+	case skip("CREATE"):
+		skip("OR", "REPLACE")
+		if skip("TABLE") {
+			skip("IF", "NOT", "EXISTS")
+			return name()
+		}
+		skip("UNIQUE")
+		if skip("INDEX") {
+			for ; i < len(tokens); i++ {
+				if tokens[i].is(sqlWord, "ON") {
+					i++
+					return name()
+				}
+			}
+		}
+	case skip("COMMENT", "ON", "TABLE"):
+		return name()
+	case skip("COMMENT", "ON", "COLUMN"):
+		if i >= len(tokens) {
+			break
+		}
+		return tokens[i].text, nil
+	}
+	return "", fmt.Errorf(
+		"%w: operations must be ALTER TABLE, CREATE TABLE, CREATE INDEX or COMMENT ON statements", ErrInvalidMigration,
+	)
+}
+
+// ApplyMigration runs the operations of the migration and records it in one transaction, so either all of them take
+// effect or none. The version must follow the current version of the table.
+func (s *Store) ApplyMigration(ctx context.Context, table string, m Migration) (*Migration, error) {
+	if err := m.Validate(table); err != nil {
+		return nil, err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back migration", "err", rollbackErr)
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name VARCHAR NOT NULL,
+		version INTEGER NOT NULL,
+		name VARCHAR NOT NULL,
+		operations VARCHAR NOT NULL,
+		applied_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (table_name, version)
+	)`, MigrationsTable)); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", MigrationsTable, err)
+	}
+	var current int
+	if err = tx.QueryRowContext(
+		ctx, fmt.Sprintf("SELECT coalesce(max(version), 0) FROM %s WHERE table_name = ?", MigrationsTable),
+		strings.ToLower(table),
+	).Scan(&current); err != nil {
+		return nil, fmt.Errorf("reading schema version: %w", err)
+	}
+	if m.Version != current+1 {
+		return nil, fmt.Errorf("%w: %s is at version %d, expected migration %d", ErrMigrationConflict, table, current,
+			current+1)
+	}
+
+	for i, op := range m.Operations {
+		if _, err = tx.ExecContext(ctx, op); err != nil {
+			return nil, &StatementError{Index: i, Err: err}
+		}
+	}
+	ops, err := json.Marshal(m.Operations)
+	if err != nil {
+		return nil, fmt.Errorf("encoding operations: %w", err)
+	}
+	appliedAt := time.Now().UTC()
+	if _, err = tx.ExecContext(
+		ctx, fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?)", MigrationsTable),
+		strings.ToLower(table), m.Version, m.Name, string(ops), appliedAt,
+	); err != nil {
+		return nil, fmt.Errorf("recording migration: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing migration: %w", err)
+	}
+	committed = true
+	m.AppliedAt = &appliedAt
+	return &m, nil
+}
+
+// Migrations returns the migrations applied to the table in order.
+func (s *Store) Migrations(ctx context.Context, table string) (*MigrationHistory, error) {
+	out := &MigrationHistory{Table: table, Migrations: []Migration{}}
+	cols, err := s.tableColumns(ctx, MigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return out, nil
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version, name, operations, applied_at FROM %s WHERE table_name = ? ORDER BY version", MigrationsTable,
+	), strings.ToLower(table))
+	if err != nil {
+		return nil, fmt.Errorf("listing migrations: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	for rows.Next() {
+		var m Migration
+		var ops string
+		var appliedAt time.Time
+		if err = rows.Scan(&m.Version, &m.Name, &ops, &appliedAt); err != nil {
+			return nil, fmt.Errorf("scanning migration: %w", err)
+		}
+		if err = json.Unmarshal([]byte(ops), &m.Operations); err != nil {
+			return nil, fmt.Errorf("decoding operations of migration %d: %w", m.Version, err)
+		}
+		m.AppliedAt = &appliedAt
+		out.Migrations = append(out.Migrations, m)
+		out.Version = m.Version
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing migrations: %w", err)
+	}
+	return out, nil
+}
+
+func (s *Server) HandleListMigrations(w http.ResponseWriter, r *http.Request) {
+	history, err := s.store.Migrations(r.Context(), r.PathValue("table"))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle list migrations", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle list migrations: writing response", history)
+}
+
+// HandleApplyMigration applies the Migration in the body to the table in the path.
+func (s *Server) HandleApplyMigration(w http.ResponseWriter, r *http.Request) {
+	var m Migration
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle apply migration: decoding request body", err)
+		return
+	}
+	applied, err := s.store.ApplyMigration(r.Context(), r.PathValue("table"), m)
+	if errors.Is(err, ErrMigrationConflict) {
+		s.writeError(w, http.StatusConflict, "handle apply migration", err)
+		return
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, "handle apply migration: writing response", applied)
+}
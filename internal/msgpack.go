@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"time"
+)
+
+// msgpackEncoder encodes the value types returned by the store to MessagePack. Types without a MessagePack
+// counterpart, such as decimals or timestamps, are written as strings.
+type msgpackEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newMsgpackEncoder(w io.Writer) *msgpackEncoder {
+	return &msgpackEncoder{w: w, buf: make([]byte, 0, 64)}
+}
+
+// writeMsgPack writes the result rows as an array of maps.
+func writeMsgPack(w io.Writer, res *QueryResult) error {
+	e := newMsgpackEncoder(w)
+	e.arrayHeader(len(res.Rows))
+	for _, row := range res.Rows {
+		e.mapHeader(len(res.Columns))
+		for _, col := range res.Columns {
+			e.str(col.Name)
+			e.encode(row[col.Name])
+		}
+	}
+	return e.flush()
+}
+
+func (e *msgpackEncoder) flush() error {
+	if _, err := e.w.Write(e.buf); err != nil {
+		return fmt.Errorf("writing msgpack: %w", err)
+	}
+	e.buf = e.buf[:0]
+	return nil
+}
+
+//nolint:cyclop // One case per supported type.
+func (e *msgpackEncoder) encode(v any) {
+	switch val := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if val {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case int8:
+		e.int(int64(val))
+	case int16:
+		e.int(int64(val))
+	case int32:
+		e.int(int64(val))
+	case int64:
+		e.int(val)
+	case int:
+		e.int(int64(val))
+	case uint8:
+		e.uint(uint64(val))
+	case uint16:
+		e.uint(uint64(val))
+	case uint32:
+		e.uint(uint64(val))
+	case uint64:
+		e.uint(val)
+	case float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(val))
+	case float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(val))
+	case string:
+		e.str(val)
+	case []byte:
+		e.bin(val)
+	case time.Time:
+		e.str(val.Format(time.RFC3339Nano))
+	case Decimal:
+		e.str(val.String())
+	case *big.Int:
+		e.str(val.String())
+	case []any:
+		e.arrayHeader(len(val))
+		for _, item := range val {
+			e.encode(item)
+		}
+	case map[string]any:
+		e.mapHeader(len(val))
+		for k, item := range val {
+			e.str(k)
+			e.encode(item)
+		}
+	default:
+		e.str(fmt.Sprint(val))
+	}
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0:
+		e.uint(uint64(v))
+	case v >= -32:
+		e.buf = append(e.buf, byte(v))
+	case v >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+	case v >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+	}
+}
+
+func (e *msgpackEncoder) uint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.buf = append(e.buf, byte(v))
+	case v <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+	case v <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+	}
+}
+
+func (e *msgpackEncoder) str(v string) {
+	switch n := len(v); {
+	case n <= 31:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, v...)
+}
+
+func (e *msgpackEncoder) bin(v []byte) {
+	switch n := len(v); {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, v...)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xdc)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdd)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xde)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdf)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
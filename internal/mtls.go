@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path"
+)
+
+// ClientCert maps the verified client certificates whose identity matches to a principal, like an APIKey. See
+// TLSConfig.ClientCAFile for verifying them.
+type ClientCert struct {
+	// Identity is a path.Match pattern of the common name or a DNS or URI name of the certificate, e.g. ingest-* or
+	// spiffe://prod/ns/etl/*.
+	Identity string   `yaml:"identity"`
+	Admin    bool     `yaml:"admin"`
+	Tenant   string   `yaml:"tenant"`
+	Roles    []string `yaml:"roles"`
+}
+
+// WithClientCerts authenticates requests by their verified client certificate, besides API keys and tokens with
+// WithAPIKeys and WithJWT. A request with a certificate no ClientCert matches needs a key or token.
+func WithClientCerts(certs []ClientCert) ServerOption {
+	return func(s *Server) {
+		s.clientCerts = certs
+	}
+}
+
+// ValidateClientCerts checks the identity patterns.
+func ValidateClientCerts(certs []ClientCert) error {
+	for i, c := range certs {
+		if c.Identity == "" {
+			return fmt.Errorf("client cert %d: missing identity", i)
+		}
+		if _, err := path.Match(c.Identity, ""); err != nil {
+			return fmt.Errorf("client cert %d: identity %q: %w", i, c.Identity, err)
+		}
+	}
+	return nil
+}
+
+// certIdentities returns the common name and the DNS and URI names of the certificate.
+func certIdentities(cert *x509.Certificate) []string {
+	out := make([]string, 0, 1+len(cert.DNSNames)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		out = append(out, cert.Subject.CommonName)
+	}
+	out = append(out, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		out = append(out, u.String())
+	}
+	return out
+}
+
+// certPrincipal returns the principal of the first ClientCert matching an identity of the verified client certificate
+// of the connection.
+func (s *Server) certPrincipal(state *tls.ConnectionState) (Principal, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return Principal{}, false
+	}
+	identities := certIdentities(state.VerifiedChains[0][0])
+	for _, c := range s.clientCerts {
+		for _, identity := range identities {
+			if ok, _ := path.Match(c.Identity, identity); !ok {
+				continue
+			}
+			p := Principal{Name: "cert:" + identity, Tenant: c.Tenant, Roles: c.Roles}
+			p.Scopes = []Scope{ScopeIngest, ScopeQuery}
+			if c.Admin {
+				p.Scopes = []Scope{ScopeAdmin}
+			}
+			return p, true
+		}
+	}
+	return Principal{}, false
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format is an output encoding a handler can offer.
+type Format struct {
+	Name        string
+	ContentType string
+}
+
+//nolint:gochecknoglobals // Read-only format descriptors.
+var (
+	FormatJSON    = Format{Name: "json", ContentType: "application/json"}
+	FormatNDJSON  = Format{Name: "ndjson", ContentType: "application/x-ndjson"}
+	FormatCSV     = Format{Name: "csv", ContentType: "text/csv; charset=utf-8"}
+	FormatParquet = Format{Name: "parquet", ContentType: "application/vnd.apache.parquet"}
+	FormatArrow   = Format{Name: "arrow", ContentType: "application/vnd.apache.arrow.stream"}
+	FormatMsgPack = Format{Name: "msgpack", ContentType: "application/vnd.msgpack"}
+	// FormatColumnar is JSON with an array of values per column. It shares the media type of FormatJSON, which
+	// Accept headers select, so only the format parameter asks for it.
+	FormatColumnar = Format{Name: "columnar", ContentType: "application/json"}
+	// FormatGeoJSON is a GeoJSON FeatureCollection of the rows, see GeometryParam.
+	FormatGeoJSON = Format{Name: "geojson", ContentType: "application/geo+json"}
+)
+
+var ErrNotAcceptable = errors.New("not acceptable")
+
+// FormatParam overrides the Accept header with a format name, e.g. ?format=csv.
+const FormatParam = "format"
+
+// Negotiate picks one of the offered formats for the request. The format parameter takes precedence over the Accept
+// header. Without either, or when the Accept header allows anything, the first offered format is used.
+func Negotiate(r *http.Request, offered []Format) (Format, error) {
+	if name := r.URL.Query().Get(FormatParam); name != "" {
+		for _, f := range offered {
+			if f.Name == name {
+				return f, nil
+			}
+		}
+		return Format{}, fmt.Errorf("%w: format %s", ErrNotAcceptable, name)
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offered[0], nil
+	}
+	for _, rng := range parseAccept(accept) {
+		for _, f := range offered {
+			if rng.matches(f) {
+				return f, nil
+			}
+		}
+	}
+	return Format{}, fmt.Errorf("%w: %s", ErrNotAcceptable, accept)
+}
+
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+func (m mediaRange) matches(f Format) bool {
+	mediaType, _, err := mime.ParseMediaType(f.ContentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case m.mediaType == "*/*", m.mediaType == mediaType:
+		return true
+	case strings.HasSuffix(m.mediaType, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(m.mediaType, "*"))
+	default:
+		return false
+	}
+}
+
+// parseAccept returns the acceptable media ranges ordered by preference, dropping those with q=0.
+func parseAccept(accept string) []mediaRange {
+	var out []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		out = append(out, mediaRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].q > out[j].q
+	})
+	return out
+}
@@ -0,0 +1,53 @@
+package internal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"scratch/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	offered := []internal.Format{internal.FormatJSON, internal.FormatCSV, internal.FormatArrow}
+	for _, tc := range []struct {
+		target   string
+		accept   string
+		expected internal.Format
+	}{
+		{target: "/", expected: internal.FormatJSON},
+		{target: "/", accept: "*/*", expected: internal.FormatJSON},
+		{target: "/", accept: "text/csv", expected: internal.FormatCSV},
+		{target: "/", accept: "text/*", expected: internal.FormatCSV},
+		{target: "/", accept: "application/json;q=0.5, text/csv", expected: internal.FormatCSV},
+		{target: "/", accept: "text/csv;q=0, */*;q=0.1", expected: internal.FormatJSON},
+		{target: "/", accept: "application/vnd.apache.arrow.stream", expected: internal.FormatArrow},
+		{target: "/?format=csv", accept: "application/json", expected: internal.FormatCSV},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		format, err := internal.Negotiate(r, offered)
+		require.NoError(t, err, tc.accept)
+		assert.Equal(t, tc.expected, format, tc.accept)
+	}
+
+	for _, tc := range []struct {
+		target string
+		accept string
+	}{
+		{target: "/?format=xml"},
+		{target: "/", accept: "application/xml"},
+		{target: "/", accept: "text/csv;q=0"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		_, err := internal.Negotiate(r, offered)
+		require.ErrorIs(t, err, internal.ErrNotAcceptable)
+	}
+}
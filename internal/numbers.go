@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxSafeInteger is 2^53, the integers beyond it have no exact float64 and are rounded by the JSON decoders that
+// decode every number as a double, including json.Unmarshal into any and JavaScript.
+const maxSafeInteger = 1 << 53
+
+// maxHugeIntBits is the bit length of the largest HUGEINT magnitude.
+const maxHugeIntBits = 127
+
+// decodeRows decodes the JSON of a row, or an array of rows, into v like json.Unmarshal, except that integers beyond
+// 2^53 keep their precision, see exactRows.
+func decodeRows(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("invalid data after top-level value")
+	}
+	switch v := v.(type) {
+	case *map[string]any:
+		return exactRows(*v)
+	case *[]map[string]any:
+		return exactRows(*v...)
+	}
+	return nil
+}
+
+// exactRows replaces the json.Number values the rows were decoded with by float64, as json.Unmarshal would, except
+// for integers beyond 2^53: they become int64, or *big.Int past its range, and create BIGINT and HUGEINT columns.
+func exactRows(rows ...map[string]any) error {
+	for _, row := range rows {
+		if _, err := exactNumbers(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exactNumbers replaces the json.Number values in the decoded JSON value, in place for objects and arrays.
+func exactNumbers(v any) (any, error) {
+	var err error
+	switch v := v.(type) {
+	case json.Number:
+		return exactNumber(v)
+	case map[string]any:
+		for k, e := range v {
+			if v[k], err = exactNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	case []any:
+		for i, e := range v {
+			if v[i], err = exactNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func exactNumber(n json.Number) (any, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if i > maxSafeInteger || i < -maxSafeInteger {
+				return i, nil
+			}
+			return float64(i), nil
+		}
+		if b, ok := new(big.Int).SetString(s, 10); ok && b.BitLen() <= maxHugeIntBits {
+			return b, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("number %s out of range", s)
+	}
+	return f, nil
+}
+
+// BigIntParam selects how integers beyond 2^53 are written in JSON results: number, the default, writes them as
+// numbers, which clients decoding numbers as doubles round, string as decimal strings.
+const BigIntParam = "bigint"
+
+const (
+	bigintNumber = "number"
+	bigintString = "string"
+)
+
+func parseBigInt(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get(BigIntParam); v {
+	case "", bigintNumber:
+		return false, nil
+	case bigintString:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s: %s", BigIntParam, v)
+	}
+}
+
+// bigIntStrings returns the row with the integer values beyond 2^53 replaced by their decimal strings. Rows without
+// any are returned as they are, the others are copied since fetched rows may be shared with the result cache.
+func bigIntStrings(row map[string]any) map[string]any {
+	var out map[string]any
+	for k, v := range row {
+		s, ok := bigIntString(v)
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]any, len(row))
+			for k, v := range row {
+				out[k] = v
+			}
+		}
+		out[k] = s
+	}
+	if out == nil {
+		return row
+	}
+	return out
+}
+
+// bigIntString returns the decimal string of the value if it is an integer beyond 2^53.
+func bigIntString(v any) (string, bool) {
+	switch n := v.(type) {
+	case int64:
+		if n > maxSafeInteger || n < -maxSafeInteger {
+			return strconv.FormatInt(n, 10), true
+		}
+	case uint64:
+		if n > maxSafeInteger {
+			return strconv.FormatUint(n, 10), true
+		}
+	case *big.Int:
+		if n != nil && n.CmpAbs(big.NewInt(maxSafeInteger)) > 0 {
+			return n.String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,540 @@
+package internal
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ODataPath is the root of the OData v4 service, whose entity sets are the tables.
+const ODataPath = "/odata/"
+
+// ErrODataQuery is returned for system query options of OData the service can't parse or doesn't support.
+var ErrODataQuery = errors.New("invalid odata query")
+
+// odataNamespace is the namespace of the entity types in the metadata document.
+const odataNamespace = "Scratch"
+
+// ODataServiceDocument lists the entity sets of the service.
+type ODataServiceDocument struct {
+	Context string             `json:"@odata.context"`
+	Value   []ODataServiceItem `json:"value"`
+}
+
+type ODataServiceItem struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+// ODataCollection is a page of the rows of an entity set. Count is set when $count=true was asked for and counts all
+// rows matching $filter.
+type ODataCollection struct {
+	Context string           `json:"@odata.context"`
+	Count   *int64           `json:"@odata.count,omitempty"`
+	Value   []map[string]any `json:"value"`
+}
+
+// odataBaseURL returns the absolute URL of the service root, as the context URLs need.
+func odataBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + ODataPath
+}
+
+// HandleODataService responds with the service document listing the tables the caller may read.
+func (s *Server) HandleODataService(w http.ResponseWriter, r *http.Request) {
+	tables, err := s.store.readableTables(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle odata service", err)
+		return
+	}
+	doc := ODataServiceDocument{Context: odataBaseURL(r) + "$metadata", Value: []ODataServiceItem{}}
+	for _, t := range tables {
+		doc.Value = append(doc.Value, ODataServiceItem{Name: t.Table, Kind: "EntitySet", URL: t.Table})
+	}
+	w.Header().Set("OData-Version", "4.0")
+	s.writeJSON(w, http.StatusOK, "handle odata service: writing response", doc)
+}
+
+type edmx struct {
+	XMLName xml.Name `xml:"edmx:Edmx"`
+	Xmlns   string   `xml:"xmlns:edmx,attr"`
+	Version string   `xml:"Version,attr"`
+	Schema  struct {
+		Xmlns       string          `xml:"xmlns,attr"`
+		Namespace   string          `xml:"Namespace,attr"`
+		EntityTypes []edmEntityType `xml:"EntityType"`
+		Container   struct {
+			Name       string         `xml:"Name,attr"`
+			EntitySets []edmEntitySet `xml:"EntitySet"`
+		} `xml:"EntityContainer"`
+	} `xml:"edmx:DataServices>Schema"`
+}
+
+type edmEntityType struct {
+	Name       string        `xml:"Name,attr"`
+	Properties []edmProperty `xml:"Property"`
+}
+
+type edmProperty struct {
+	Name     string `xml:"Name,attr"`
+	Type     string `xml:"Type,attr"`
+	Nullable bool   `xml:"Nullable,attr"`
+}
+
+type edmEntitySet struct {
+	Name       string `xml:"Name,attr"`
+	EntityType string `xml:"EntityType,attr"`
+}
+
+// edmType returns the EDM primitive type of the DuckDB type. Dates are served as timestamps, as they are encoded, and
+// the types without an EDM counterpart as strings.
+func edmType(duckType string) string {
+	switch t := strings.ToUpper(duckType); {
+	case t == "BOOLEAN":
+		return "Edm.Boolean"
+	case t == "TINYINT":
+		return "Edm.SByte"
+	case t == "UTINYINT":
+		return "Edm.Byte"
+	case t == "SMALLINT":
+		return "Edm.Int16"
+	case t == "INTEGER" || t == "USMALLINT":
+		return "Edm.Int32"
+	case t == "BIGINT" || t == "UINTEGER":
+		return "Edm.Int64"
+	case t == "FLOAT":
+		return "Edm.Single"
+	case t == "DOUBLE":
+		return "Edm.Double"
+	case strings.HasPrefix(t, "DECIMAL"):
+		return "Edm.Decimal"
+	case t == "DATE" || strings.HasPrefix(t, "TIMESTAMP"):
+		return "Edm.DateTimeOffset"
+	case t == "UUID":
+		return "Edm.Guid"
+	case t == "BLOB":
+		return "Edm.Binary"
+	default:
+		return "Edm.String"
+	}
+}
+
+// HandleODataMetadata responds with the CSDL metadata document describing the tables the caller may read as entity
+// types. The tables have no keys, so the entity types declare none and single entities can't be addressed.
+func (s *Server) HandleODataMetadata(w http.ResponseWriter, r *http.Request) {
+	tables, err := s.store.readableTables(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle odata metadata", err)
+		return
+	}
+	doc := edmx{Xmlns: "http://docs.oasis-open.org/odata/ns/edmx", Version: "4.0"}
+	doc.Schema.Xmlns, doc.Schema.Namespace = "http://docs.oasis-open.org/odata/ns/edm", odataNamespace
+	doc.Schema.Container.Name = "Container"
+	for _, t := range tables {
+		entity := edmEntityType{Name: t.Table}
+		for _, col := range t.Columns {
+			entity.Properties = append(entity.Properties,
+				edmProperty{Name: col.Name, Type: edmType(col.Type), Nullable: col.Nullable})
+		}
+		doc.Schema.EntityTypes = append(doc.Schema.EntityTypes, entity)
+		doc.Schema.Container.EntitySets = append(doc.Schema.Container.EntitySets,
+			edmEntitySet{Name: t.Table, EntityType: odataNamespace + "." + t.Table})
+	}
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle odata metadata", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("OData-Version", "4.0")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(append([]byte(xml.Header), out...)); err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle odata metadata: writing response", err)
+	}
+}
+
+// HandleODataEntitySet responds with the rows of the table in the path, selected by the system query options
+// $filter, $select, $orderby, $top and $skip. $count=true adds the count of the rows matching $filter.
+func (s *Server) HandleODataEntitySet(w http.ResponseWriter, r *http.Request) {
+	table := r.PathValue("table")
+	stmt, countStmt, err := s.store.odataStatements(r.Context(), table, r.URL.Query())
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle odata entity set", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle odata entity set", err)
+		return
+	}
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+	s.requestResultLimits(r.Context()).apply(stmt)
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	res, _, err := s.fetch(r.WithContext(ctx), stmt, nil)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	markAuditRows(r.Context(), len(res.Rows))
+	out := ODataCollection{Context: odataBaseURL(r) + "$metadata#" + table, Value: res.Rows}
+	if out.Value == nil {
+		out.Value = []map[string]any{}
+	}
+	if countStmt != nil {
+		counted, _, err := s.fetch(r.WithContext(ctx), countStmt, nil)
+		if err != nil {
+			s.writeQueryError(w, err)
+			return
+		}
+		n, _ := counted.Rows[0]["n"].(int64)
+		out.Count = &n
+	}
+	if res.Truncated {
+		w.Header().Set(TruncatedHeader, "true")
+	}
+	w.Header().Set("OData-Version", "4.0")
+	s.writeJSON(w, http.StatusOK, "handle odata entity set: writing response", out)
+}
+
+// odataStatements builds the SELECT of the rows of an entity set and, for $count=true, the one counting them.
+func (s *Store) odataStatements(ctx context.Context, table string, params url.Values) (*QueryStatement,
+	*QueryStatement, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	selected := "*"
+	if v := strings.TrimSpace(params.Get("$select")); v != "" && v != "*" {
+		names := strings.Split(v, ",")
+		for i, name := range names {
+			if names[i], err = column(cols, strings.TrimSpace(name)); err != nil {
+				return nil, nil, fmt.Errorf("%w: $select: %w", ErrODataQuery, err)
+			}
+		}
+		selected = strings.Join(names, ", ")
+	}
+	where, values := "", []any(nil)
+	if v := params.Get("$filter"); v != "" {
+		p := &odataFilterParser{cols: cols}
+		if p.tokens, err = lexODataFilter(v); err != nil {
+			return nil, nil, err
+		}
+		condition, err := p.parse()
+		if err != nil {
+			return nil, nil, err
+		}
+		where, values = " WHERE "+condition, p.params
+	}
+	order, err := odataOrderBy(cols, params.Get("$orderby"))
+	if err != nil {
+		return nil, nil, err
+	}
+	stmt := &QueryStatement{
+		Query:  fmt.Sprintf("SELECT %s FROM %s%s%s", selected, quoteIdent(table), where, order),
+		Params: values,
+	}
+	for _, option := range []string{"$top", "$skip"} {
+		if v := params.Get(option); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, nil, fmt.Errorf("%w: %s takes a non-negative integer", ErrODataQuery, option)
+			}
+			clause := " LIMIT %d"
+			if option == "$skip" {
+				clause = " OFFSET %d"
+			}
+			stmt.Query += fmt.Sprintf(clause, n)
+		}
+	}
+	var countStmt *QueryStatement
+	switch v := params.Get("$count"); v {
+	case "", "false":
+	case "true":
+		countStmt = &QueryStatement{
+			Query:  fmt.Sprintf("SELECT count(*) AS n FROM %s%s", quoteIdent(table), where),
+			Params: values,
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w: $count takes true or false", ErrODataQuery)
+	}
+	return stmt, countStmt, nil
+}
+
+// odataOrderBy builds the ORDER BY clause of $orderby, comma separated columns each followed by asc or desc.
+func odataOrderBy(cols map[string]bool, orderBy string) (string, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		return "", nil
+	}
+	var terms []string
+	for _, term := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(term)
+		if len(fields) == 0 || len(fields) > 2 {
+			return "", fmt.Errorf("%w: $orderby term %q", ErrODataQuery, term)
+		}
+		col, err := column(cols, fields[0])
+		if err != nil {
+			return "", fmt.Errorf("%w: $orderby: %w", ErrODataQuery, err)
+		}
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "asc":
+			case "desc":
+				col += " DESC"
+			default:
+				return "", fmt.Errorf("%w: $orderby direction %q", ErrODataQuery, fields[1])
+			}
+		}
+		terms = append(terms, col)
+	}
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// odataComparisons maps the comparison operators of $filter to SQL.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var odataComparisons = map[string]string{"eq": "=", "ne": "<>", "lt": "<", "le": "<=", "gt": ">", "ge": ">="}
+
+// odataFunctions maps the string functions of $filter to their DuckDB counterparts.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var odataFunctions = map[string]string{"contains": "contains", "startswith": "starts_with", "endswith": "suffix"}
+
+type odataTokenKind int
+
+const (
+	odataEOF odataTokenKind = iota
+	odataName
+	odataString
+	// odataLiteral are the unquoted literals: numbers, dates and times.
+	odataLiteral
+	odataPunct
+)
+
+type odataToken struct {
+	kind odataTokenKind
+	text string
+}
+
+// lexODataFilter splits a $filter expression into tokens. Strings are single-quoted with doubled quotes escaping.
+func lexODataFilter(filter string) ([]odataToken, error) {
+	var tokens []odataToken
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, odataToken{odataPunct, string(c)})
+			i++
+		case c == '\'':
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(filter) {
+					return nil, fmt.Errorf("%w: unterminated string in $filter", ErrODataQuery)
+				}
+				if filter[i] == '\'' {
+					if i+1 < len(filter) && filter[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				sb.WriteByte(filter[i])
+			}
+			tokens = append(tokens, odataToken{odataString, sb.String()})
+			i++
+		case isDigit(c) || (c == '-' && i+1 < len(filter) && isDigit(filter[i+1])):
+			start := i
+			i++
+			for i < len(filter) && (isWordByte(filter[i]) || strings.IndexByte(".:+-", filter[i]) >= 0) {
+				i++
+			}
+			tokens = append(tokens, odataToken{odataLiteral, filter[start:i]})
+		case isWordByte(c):
+			start := i
+			for i < len(filter) && isWordByte(filter[i]) {
+				i++
+			}
+			tokens = append(tokens, odataToken{odataName, filter[start:i]})
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q in $filter", ErrODataQuery, c)
+		}
+	}
+	return append(tokens, odataToken{kind: odataEOF}), nil
+}
+
+// odataFilterParser translates $filter into a SQL condition, binding the literals as parameters:
+//
+//	or      = and {"or" and}
+//	and     = not {"and" not}
+//	not     = "not" not | "(" or ")" | function "(" column "," string ")" | operand comparison operand
+//	operand = column | literal
+type odataFilterParser struct {
+	cols   map[string]bool
+	tokens []odataToken
+	i      int
+	params []any
+}
+
+func (p *odataFilterParser) next() odataToken {
+	tok := p.tokens[p.i]
+	if tok.kind != odataEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *odataFilterParser) peekName(name string) bool {
+	tok := p.tokens[p.i]
+	return tok.kind == odataName && tok.text == name
+}
+
+func (p *odataFilterParser) expect(punct string) error {
+	if tok := p.next(); tok.kind != odataPunct || tok.text != punct {
+		return fmt.Errorf("%w: expected %q in $filter", ErrODataQuery, punct)
+	}
+	return nil
+}
+
+func (p *odataFilterParser) parse() (string, error) {
+	condition, err := p.or()
+	if err != nil {
+		return "", err
+	}
+	if tok := p.next(); tok.kind != odataEOF {
+		return "", fmt.Errorf("%w: unexpected %q in $filter", ErrODataQuery, tok.text)
+	}
+	return condition, nil
+}
+
+func (p *odataFilterParser) or() (string, error) {
+	return p.binary("or", p.and)
+}
+
+func (p *odataFilterParser) and() (string, error) {
+	return p.binary("and", p.not)
+}
+
+func (p *odataFilterParser) binary(op string, operand func() (string, error)) (string, error) {
+	left, err := operand()
+	if err != nil {
+		return "", err
+	}
+	for p.peekName(op) {
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return "", err
+		}
+		left = fmt.Sprintf("(%s %s %s)", left, strings.ToUpper(op), right)
+	}
+	return left, nil
+}
+
+func (p *odataFilterParser) not() (string, error) {
+	tok := p.tokens[p.i]
+	switch {
+	case tok.kind == odataName && tok.text == "not":
+		p.next()
+		condition, err := p.not()
+		return "NOT " + condition, err
+	case tok.kind == odataPunct && tok.text == "(":
+		p.next()
+		condition, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		return "(" + condition + ")", p.expect(")")
+	case tok.kind == odataName && odataFunctions[tok.text] != "" && p.tokens[p.i+1].text == "(":
+		p.next()
+		p.next()
+		col, err := column(p.cols, p.next().text)
+		if err != nil {
+			return "", fmt.Errorf("%w: $filter: %w", ErrODataQuery, err)
+		}
+		if err = p.expect(","); err != nil {
+			return "", err
+		}
+		arg := p.next()
+		if arg.kind != odataString {
+			return "", fmt.Errorf("%w: %s takes a string", ErrODataQuery, tok.text)
+		}
+		p.params = append(p.params, arg.text)
+		return fmt.Sprintf("%s(%s, ?)", odataFunctions[tok.text], col), p.expect(")")
+	}
+	left, leftNull, err := p.operand()
+	if err != nil {
+		return "", err
+	}
+	op := p.next()
+	sqlOp, ok := odataComparisons[op.text]
+	if op.kind != odataName || !ok {
+		return "", fmt.Errorf("%w: expected a comparison operator in $filter, got %q", ErrODataQuery, op.text)
+	}
+	right, rightNull, err := p.operand()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case leftNull && rightNull:
+		return "", fmt.Errorf("%w: null compared with null in $filter", ErrODataQuery)
+	case leftNull || rightNull:
+		if op.text != "eq" && op.text != "ne" {
+			return "", fmt.Errorf("%w: null can only be compared with eq or ne", ErrODataQuery)
+		}
+		if leftNull {
+			right, left = left, right
+		}
+		if op.text == "eq" {
+			return left + " IS NULL", nil
+		}
+		return left + " IS NOT NULL", nil
+	}
+	return fmt.Sprintf("%s %s %s", left, sqlOp, right), nil
+}
+
+// operand returns the SQL of a column or a bound literal, or isNull for the null literal.
+func (p *odataFilterParser) operand() (sql string, isNull bool, err error) {
+	tok := p.next()
+	switch tok.kind {
+	case odataString:
+		p.params = append(p.params, tok.text)
+	case odataLiteral:
+		if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			p.params = append(p.params, n)
+		} else if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			p.params = append(p.params, f)
+		} else {
+			p.params = append(p.params, tok.text)
+		}
+	case odataName:
+		switch tok.text {
+		case "null":
+			return "", true, nil
+		case "true", "false":
+			p.params = append(p.params, tok.text == "true")
+		default:
+			col, err := column(p.cols, tok.text)
+			if err != nil {
+				return "", false, fmt.Errorf("%w: $filter: %w", ErrODataQuery, err)
+			}
+			return col, false, nil
+		}
+	default:
+		return "", false, fmt.Errorf("%w: expected a column or a literal in $filter, got %q", ErrODataQuery, tok.text)
+	}
+	return "?", false, nil
+}
@@ -0,0 +1,686 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAPIPath serves the OpenAPI document of the routes of the server.
+const OpenAPIPath = "/openapi.json"
+
+// OpenAPI is an OpenAPI 3.1 document. Schemas are JSON Schema objects.
+type OpenAPI struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       OpenAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components OpenAPIComponents               `json:"components"`
+	Security   []map[string][]string           `json:"security,omitempty"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]map[string]any `json:"schemas"`
+	SecuritySchemes map[string]map[string]any `json:"securitySchemes,omitempty"`
+}
+
+type Operation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Tags        []string                   `json:"tags"`
+	Parameters  []Parameter                `json:"parameters,omitempty"`
+	RequestBody *RequestBody               `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      map[string]any `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                      `json:"required"`
+	Content  map[string]map[string]any `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                    `json:"description"`
+	Content     map[string]map[string]any `json:"content,omitempty"`
+}
+
+// routeDoc describes a route beyond its pattern. Routes without one are documented with their path parameters only.
+type routeDoc struct {
+	summary string
+	// params are the query parameters, described by queryParamDocs.
+	params []string
+	// request and response are values of the types of the JSON bodies, nil if there is none.
+	request  any
+	response any
+	// status is the status of success, 200 if unset.
+	status int
+	// result marks the routes answering with query results, negotiated between queryFormats.
+	result bool
+	// contentType is the type of responses other than JSON.
+	contentType string
+	// tag overrides the tag derived from the path.
+	tag string
+}
+
+// resultParams are the query parameters of every route answering with query results.
+//
+//nolint:gochecknoglobals // Read-only list.
+var resultParams = []string{
+	FormatParam, EnvelopeParam, ProfileParam, TimeoutParam, OverflowParam, BigIntParam, GeometryParam, QueryTagParam,
+}
+
+//nolint:gochecknoglobals // Read-only descriptions.
+var queryParamDocs = map[string]string{
+	"q":              "The SQL of the query, or the keywords of a search.",
+	"limit":          "Maximum number of rows or entries returned.",
+	"tag":            "The query tag attributing the query to a workload, like the X-Query-Tag header.",
+	"cursor":         "Continues a paginated result after the page that returned it.",
+	"chunk":          "Rows per rows event.",
+	"analyze":        "Runs the query to report the actual operator timings.",
+	"filter":         "column:op:value, repeatable. op is eq, ne, lt, lte, gt, gte, like, ilike, in or null.",
+	"sort":           "Comma separated columns, descending when prefixed with a minus.",
+	"columns":        "Comma separated columns to select.",
+	"group_by":       "Comma separated columns to group by.",
+	"metrics":        "Comma separated metrics, e.g. count or sum(amount).",
+	"time_column":    "The column since and until apply to.",
+	"since":          "Lower bound: an RFC 3339 time or a duration before now, or the sequence number of a change.",
+	"until":          "Upper bound: an RFC 3339 time or a duration before now.",
+	"fields":         "Comma separated indexed columns to match.",
+	"all":            "Deletes every row when no filter is given.",
+	"full":           "Recomputes the whole rollup instead of the new rows.",
+	"url":            "Object store URL to list the backups of.",
+	"table":          "Only the changes of this table.",
+	"Table":          "The table the rows are inserted into, created on the first insert.",
+	"query":          "The SQL of the statement, followed by the body if there is one, or the GraphQL document.",
+	"operationName":  "The operation of the GraphQL document to run, needed if it has several.",
+	"variables":      "The variables of the GraphQL operation as a JSON object.",
+	"$filter":        "OData filter expression, e.g. amount gt 5 and contains(name,'a').",
+	"$select":        "Comma separated columns to return.",
+	"$orderby":       "Comma separated columns, each optionally followed by asc or desc.",
+	"$top":           "Maximum number of rows to return.",
+	"$skip":          "Number of rows to skip.",
+	"$count":         "Adds the count of the rows matching $filter when true.",
+	"caller":         "Only the entries of the API key, token or address.",
+	"contains":       "Only the queries whose SQL contains the text, ignoring case.",
+	"min_duration":   "Only the queries that ran at least as long, as a Go duration.",
+	"status":         "Only the queries that succeeded, ok, or failed, error.",
+	"n":              "Rows of the sample, 100 by default and at most 10000.",
+	"method":         "Sampling method: reservoir, the default, bernoulli or system.",
+	"seed":           "Seed making the sample repeatable.",
+	"default_format": "Output format of statements without a FORMAT clause, TabSeparated by default.",
+	FormatParam:      "Format overriding the Accept: json, ndjson, csv, msgpack, arrow, parquet, columnar or geojson.",
+	EnvelopeParam:    "Wraps JSON results in an Envelope with the column types.",
+	ProfileParam:     "Profiles the query and returns the operator timings in the Envelope.",
+	TimeoutParam:     "Deadline of the query as a Go duration, capped at the server maximum.",
+	OverflowParam:    "What happens to results exceeding the result limits: error or truncate.",
+	BigIntParam:      "JSON rendering of integers beyond 2^53: number, the default, or string for clients using doubles.",
+	GeometryParam:    "The GEOMETRY column of the geojson format, geometry by default.",
+}
+
+//nolint:gochecknoglobals // Read-only descriptions of the routes.
+var routeDocs = map[string]routeDoc{
+	"GET /query": {summary: "Runs a read-only query.", params: []string{"q", "limit", "cursor"}, result: true},
+	"POST /query": {
+		summary: "Runs a read-only query with parameters, or writes its result to the files of the destination.",
+		request: QueryRequest{}, result: true,
+	},
+	"POST /admin/query": {
+		summary: "Runs any statement, including DDL and writes.", request: QueryRequest{}, result: true,
+	},
+	"GET /query/stream": {
+		summary: "Streams a query as Server-Sent Events.", params: []string{"q", "chunk"},
+		contentType: "text/event-stream",
+	},
+	"GET /query/explain": {summary: "Explains a query.", params: []string{"q", "analyze"}, response: QueryPlan{}},
+	"POST /query/explain": {
+		summary: "Explains a query with parameters.", request: QueryRequest{}, response: QueryPlan{},
+	},
+	"GET /admin/queries":         {summary: "Lists the executing queries.", response: []InFlightQuery{}},
+	"GET /admin/queries/tags":    {summary: "Sums up the executed queries per query tag.", response: []QueryTagStats{}},
+	"DELETE /admin/queries/{id}": {summary: "Interrupts an executing query.", status: http.StatusNoContent},
+	"GET /admin/settings":        {summary: "Lists the DuckDB settings.", response: []Setting{}},
+	"GET /admin/backups":         {summary: "Lists the backups.", params: []string{"url"}, response: []Backup{}},
+	"POST /admin/backup": {
+		summary: "Backs up the database.", request: BackupRequest{}, response: Backup{}, status: http.StatusCreated,
+	},
+	"POST /admin/restore": {summary: "Restores a backup.", request: BackupRequest{}, response: RestoreResult{}},
+	"POST /queries": {
+		summary: "Runs a query in the background.", params: []string{"tag"}, request: QueryRequest{}, response: Job{},
+		status: http.StatusAccepted,
+	},
+	"GET /queries/{id}":    {summary: "Reports a background query.", response: Job{}},
+	"DELETE /queries/{id}": {summary: "Cancels a background query.", response: Job{}},
+	"GET /queries/{id}/{sub}": {
+		summary: "Returns the results of a background query, or the saved query named sub if id is saved.",
+		result:  true,
+	},
+	"GET /queries/saved":           {summary: "Lists the saved queries.", response: []SavedQuery{}},
+	"PUT /queries/saved/{name}":    {summary: "Saves a query.", request: SavedQuery{}, response: SavedQuery{}},
+	"DELETE /queries/saved/{name}": {summary: "Deletes a saved query.", status: http.StatusNoContent},
+	"POST /queries/saved/{name}": {
+		summary: "Runs a saved query.", request: RunSavedQueryRequest{}, result: true,
+	},
+	"GET /queries/history": {
+		summary:  "Lists the recently executed queries, newest first.",
+		params:   []string{"caller", "contains", "tag", "since", "min_duration", "status", "limit"},
+		response: []QueryHistoryEntry{},
+	},
+	"POST /queries/history/{id}": {summary: "Runs a query of the history again.", result: true},
+	"GET /downloads":             {summary: "Lists the resumable downloads.", response: []Download{}},
+	"POST /downloads": {
+		summary: "Writes a query result or a table to a file fetched in parts or ranges.", request: DownloadRequest{},
+		response: Download{}, status: http.StatusCreated,
+	},
+	"GET /downloads/{id}":    {summary: "Reports a download.", response: Download{}},
+	"DELETE /downloads/{id}": {summary: "Completes a download, removing its file.", status: http.StatusNoContent},
+	"GET /downloads/{id}/data": {
+		summary: "Returns the file of a download, taking range requests.", contentType: "application/octet-stream",
+	},
+	"GET /downloads/{id}/parts/{part}": {
+		summary: "Returns a part of the file of a download, numbered from 0.", contentType: "application/octet-stream",
+	},
+	"POST /data": {
+		summary: "Inserts a row or an array of rows, adding the missing columns.", params: []string{"Table"},
+		request: []map[string]any{},
+	},
+	"POST /data/preview": {
+		summary: "Previews the DDL and column types of inserting a row or an array of rows, without writing.",
+		params:  []string{"Table"}, request: []map[string]any{}, response: InsertPreview{},
+	},
+	"GET /types":                 {summary: "Describes the column types and coercions.", response: TypeCatalog{}},
+	"GET /tables":                {summary: "Lists the tables.", response: []TableInfo{}},
+	"GET /tables/{table}/schema": {summary: "Describes the columns of a table.", response: TableSchema{}},
+	"GET /tables/{table}/schema/history": {
+		summary: "Lists the schema changes of a table since the start.", response: []SchemaChange{},
+	},
+	"GET /tables/{table}/changes": {
+		summary: "Polls the change feed of a table.", params: []string{"since", "limit"}, response: ChangesResponse{},
+	},
+	"GET /tables/{table}/tail": {
+		summary: "Streams the inserts into a table over a WebSocket.", params: []string{"filter"},
+		status: http.StatusSwitchingProtocols,
+	},
+	"GET /admin/replication/changes": {
+		summary: "Polls the change feed of all tables.", params: []string{"since", "limit"},
+		response: ChangesResponse{},
+	},
+	"GET /tables/{table}/config": {summary: "Returns the configuration of a table.", response: TableConfig{}},
+	"PUT /tables/{table}/config": {
+		summary: "Configures a table.", request: TableConfig{}, response: TableConfig{},
+	},
+	"GET /tables/{table}/stats/ingest": {
+		summary:  "Reports the inserted rows and bytes, their rates and the insert latencies of a table.",
+		response: IngestStats{},
+	},
+	"GET /metrics": {
+		summary: "Exposes the ingest stats of the tables in the Prometheus text format.", contentType: "text/plain",
+	},
+	"GET /tables/{table}/quality": {
+		summary: "Returns the quality checks of a table and their last results.", response: TableQuality{},
+	},
+	"GET /tables/{table}/indexes": {summary: "Lists the indexes of a table.", response: []IndexInfo{}},
+	"PUT /tables/{table}/indexes/{name}": {
+		summary: "Creates an index.", request: IndexRequest{}, response: IndexInfo{}, status: http.StatusCreated,
+	},
+	"DELETE /tables/{table}/indexes/{name}": {summary: "Drops an index.", status: http.StatusNoContent},
+	"GET /tables/{table}/rows": {
+		summary: "Reads the rows of a table without SQL.",
+		params:  []string{"filter", "sort", "columns", "limit", "cursor"}, result: true,
+	},
+	"GET /tables/{table}/sample": {
+		summary: "Reads a random sample of the rows of a table.", params: []string{"n", "method", "seed", "columns"},
+		result: true,
+	},
+	"DELETE /tables/{table}/rows": {
+		summary: "Deletes the rows matching the filters.", params: []string{"filter", "all"},
+		response: DeleteRowsResponse{},
+	},
+	"POST /tables/{table}/rename": {
+		summary: "Renames a table.", request: RenameRequest{}, response: RenameTableResponse{},
+	},
+	"POST /tables/{table}/copy": {
+		summary: "Copies a table.", request: CopyTableRequest{}, response: CopyTableResponse{},
+		status: http.StatusCreated,
+	},
+	"POST /tables/{table}/import": {
+		summary: "Imports files into a table, or starts an import job with async.", request: ImportRequest{},
+		response: ImportResponse{}, status: http.StatusCreated,
+	},
+	"POST /tables/{table}/uploads": {
+		summary: "Starts an upload session of a file sent in parts.", request: UploadRequest{}, response: Upload{},
+		status: http.StatusCreated,
+	},
+	"GET /tables/{table}/uploads/{id}":    {summary: "Reports an upload session.", response: Upload{}},
+	"DELETE /tables/{table}/uploads/{id}": {summary: "Aborts an upload session.", status: http.StatusNoContent},
+	"PUT /tables/{table}/uploads/{id}/parts/{part}": {
+		summary: "Uploads a part of a file, numbered from 0.", response: UploadPart{},
+	},
+	"POST /tables/{table}/uploads/{id}/commit": {
+		summary: "Loads the uploaded parts into the table in one statement, in an import job with async.",
+		request: CommitUploadRequest{}, response: ImportResponse{}, status: http.StatusCreated,
+	},
+	"GET /jobs":      {summary: "Lists the import jobs of the caller.", response: []ImportJob{}},
+	"GET /jobs/{id}": {summary: "Reports the progress of an import job.", response: ImportJob{}},
+	"DELETE /jobs/{id}": {
+		summary: "Cancels an import job, rolling back its load.", response: ImportJob{}, status: http.StatusAccepted,
+	},
+	"POST /tables/{table}/export": {
+		summary: "Exports a table to Parquet.", request: ExportRequest{}, response: ExportManifest{},
+	},
+	"POST /tables/{table}/export/delta": {
+		summary: "Exports a table to a Delta Lake table.", request: DeltaExportRequest{}, response: DeltaCommit{},
+	},
+	"GET /tables/{table}/snapshots": {summary: "Lists the snapshots of a table.", response: []Snapshot{}},
+	"POST /tables/{table}/snapshots": {
+		summary: "Snapshots a table.", request: SnapshotRequest{}, response: Snapshot{}, status: http.StatusCreated,
+	},
+	"DELETE /tables/{table}/snapshots/{snapshot}": {summary: "Deletes a snapshot.", status: http.StatusNoContent},
+	"POST /tables/{table}/columns/{column}/rename": {
+		summary: "Renames a column.", request: RenameRequest{}, response: TableSchema{},
+	},
+	"DELETE /tables/{table}/columns/{column}": {summary: "Drops a column.", response: TableSchema{}},
+	"GET /tables/{table}/migrations": {
+		summary: "Lists the migrations applied to a table.", response: MigrationHistory{},
+	},
+	"POST /tables/{table}/migrations": {
+		summary: "Applies a migration.", request: Migration{}, response: Migration{}, status: http.StatusCreated,
+	},
+	"GET /tables/{table}/aggregate": {
+		summary: "Aggregates a table without SQL.",
+		params:  []string{"group_by", "metrics", "time_column", "since", "until", "filter", "limit", "cursor"},
+		result:  true,
+	},
+	"GET /tables/{table}/search": {
+		summary: "Searches the full-text index of a table.", params: []string{"q", "fields", "limit", "cursor"},
+		result: true,
+	},
+	"PUT /admin/tables/{table}/search-index": {
+		summary: "Creates or rebuilds the full-text index of a table.", request: SearchIndex{},
+		response: SearchIndex{},
+	},
+	"DELETE /admin/tables/{table}/search-index": {
+		summary: "Drops the full-text index of a table.", status: http.StatusNoContent,
+	},
+	"POST /admin/tables/{table}/tier": {summary: "Runs the tiering policy of a table.", response: TierResult{}},
+	"POST /sessions": {
+		summary: "Opens a session for temporary tables and settings.", response: SessionInfo{},
+		status: http.StatusCreated,
+	},
+	"DELETE /sessions/{id}":            {summary: "Closes a session.", status: http.StatusNoContent},
+	"GET /admin/schedules":             {summary: "Lists the scheduled queries.", response: []Schedule{}},
+	"GET /admin/schedules/{name}":      {summary: "Returns a scheduled query.", response: Schedule{}},
+	"PUT /admin/schedules/{name}":      {summary: "Schedules a query.", request: Schedule{}, response: Schedule{}},
+	"DELETE /admin/schedules/{name}":   {summary: "Deletes a scheduled query.", status: http.StatusNoContent},
+	"POST /admin/schedules/{name}/run": {summary: "Runs a scheduled query now.", response: Schedule{}},
+	"GET /admin/views":                 {summary: "Lists the materialized views.", response: []MaterializedView{}},
+	"GET /admin/views/{name}":          {summary: "Returns a materialized view.", response: MaterializedView{}},
+	"PUT /admin/views/{name}": {
+		summary: "Creates or replaces a materialized view.", request: MaterializedView{}, response: MaterializedView{},
+	},
+	"DELETE /admin/views/{name}":       {summary: "Drops a materialized view.", status: http.StatusNoContent},
+	"POST /admin/views/{name}/refresh": {summary: "Refreshes a materialized view.", response: MaterializedView{}},
+	"GET /admin/rollups":               {summary: "Lists the rollups.", response: []Rollup{}},
+	"GET /admin/rollups/{name}":        {summary: "Returns a rollup.", response: Rollup{}},
+	"PUT /admin/rollups/{name}":        {summary: "Creates or replaces a rollup.", request: Rollup{}, response: Rollup{}},
+	"DELETE /admin/rollups/{name}":     {summary: "Drops a rollup.", status: http.StatusNoContent},
+	"POST /admin/rollups/{name}/refresh": {
+		summary: "Refreshes a rollup.", params: []string{"full"}, response: Rollup{},
+	},
+	"GET /admin/alerts":           {summary: "Lists the alerting rules.", response: []Alert{}},
+	"GET /admin/alerts/{name}":    {summary: "Returns an alerting rule.", response: Alert{}},
+	"PUT /admin/alerts/{name}":    {summary: "Creates or replaces an alert.", request: Alert{}, response: Alert{}},
+	"DELETE /admin/alerts/{name}": {summary: "Deletes an alerting rule.", status: http.StatusNoContent},
+	"POST /admin/alerts/{name}/evaluate": {
+		summary: "Evaluates an alerting rule and notifies its target of a state change.", response: Alert{},
+	},
+	"GET /admin/quality":            {summary: "Lists the quality checks of the tables.", response: []TableQuality{}},
+	"GET /admin/quality/{table}":    {summary: "Returns the quality checks of a table.", response: TableQuality{}},
+	"DELETE /admin/quality/{table}": {summary: "Deletes the quality checks of a table.", status: http.StatusNoContent},
+	"PUT /admin/quality/{table}": {
+		summary: "Creates or replaces the quality checks of a table.", request: TableQuality{}, response: TableQuality{},
+	},
+	"POST /admin/quality/{table}/evaluate": {
+		summary:  "Evaluates the quality checks of a table and notifies their target of a state change.",
+		response: TableQuality{},
+	},
+	"GET /admin/macros":             {summary: "Lists the SQL macros.", response: []Macro{}},
+	"GET /admin/macros/{name}":      {summary: "Returns a SQL macro.", response: Macro{}},
+	"PUT /admin/macros/{name}":      {summary: "Creates or replaces a SQL macro.", request: Macro{}, response: Macro{}},
+	"DELETE /admin/macros/{name}":   {summary: "Drops a SQL macro.", status: http.StatusNoContent},
+	"GET /admin/secrets":            {summary: "Lists the object store secrets.", response: []Secret{}},
+	"GET /admin/secrets/{name}":     {summary: "Returns an object store secret.", response: Secret{}},
+	"PUT /admin/secrets/{name}":     {summary: "Creates or replaces a secret.", request: Secret{}, response: Secret{}},
+	"DELETE /admin/secrets/{name}":  {summary: "Drops an object store secret.", status: http.StatusNoContent},
+	"GET /admin/webhooks":           {summary: "Lists the schema change webhooks.", response: []Webhook{}},
+	"GET /admin/webhooks/{name}":    {summary: "Returns a schema change webhook.", response: Webhook{}},
+	"PUT /admin/webhooks/{name}":    {summary: "Registers a webhook.", request: Webhook{}, response: Webhook{}},
+	"DELETE /admin/webhooks/{name}": {summary: "Removes a schema change webhook.", status: http.StatusNoContent},
+	"GET /admin/attachments":        {summary: "Lists the attached databases.", response: []Attachment{}},
+	"GET /admin/attachments/{name}": {summary: "Returns an attached database.", response: Attachment{}},
+	"PUT /admin/attachments/{name}": {
+		summary: "Attaches an external database.", request: Attachment{}, response: Attachment{},
+	},
+	"DELETE /admin/attachments/{name}": {summary: "Detaches an external database.", status: http.StatusNoContent},
+	"GET /admin/replication": {
+		summary: "Reports the replication of a follower.", response: ReplicationStatus{},
+	},
+	"GET /usage":         {summary: "Reports the usage and quota of the caller's tenant.", response: TenantUsage{}},
+	"GET /admin/tenants": {summary: "Reports the usage and quotas of the tenants.", response: []TenantUsage{}},
+	"GET /admin/keys":    {summary: "Lists the API keys.", response: []APIKey{}},
+	"POST /admin/keys": {
+		summary: "Creates an API key.", request: CreateAPIKeyRequest{}, response: APIKey{},
+		status: http.StatusCreated,
+	},
+	"DELETE /admin/keys/{id}":        {summary: "Revokes an API key.", status: http.StatusNoContent},
+	"GET /admin/checkpoint":          {summary: "Reports the checkpoints.", response: CheckpointStats{}},
+	"POST /admin/checkpoint":         {summary: "Checkpoints the database now.", response: CheckpointRun{}},
+	"GET /admin/log-level":           {summary: "Returns the log level.", response: LogLevel{}},
+	"PUT /admin/log-level":           {summary: "Changes the log level.", request: LogLevel{}, response: LogLevel{}},
+	"GET /admin/debug/runtime":       {summary: "Reports the goroutines, heap and GC.", response: RuntimeStats{}},
+	"GET /admin/debug/vars":          {summary: "Lists the expvar variables.", response: map[string]any{}},
+	"GET /admin/debug/pprof/":        {summary: "Serves the pprof profiles below the path.", contentType: "text/html"},
+	"GET /admin/debug/pprof/cmdline": {summary: "Returns the command line of the process.", contentType: "text/plain"},
+	"GET /admin/debug/pprof/profile": {
+		summary: "Profiles the CPU for the seconds parameter.", contentType: "application/octet-stream",
+	},
+	"GET /admin/debug/pprof/symbol":  {summary: "Looks up program counters.", contentType: "text/plain"},
+	"POST /admin/debug/pprof/symbol": {summary: "Looks up program counters.", contentType: "text/plain"},
+	"GET /admin/debug/pprof/trace": {
+		summary: "Traces the execution for the seconds parameter.", contentType: "application/octet-stream",
+	},
+	"GET /admin/ui":      {summary: "Redirects to the admin web UI.", status: http.StatusMovedPermanently},
+	"GET /admin/ui/":     {summary: "Serves the admin web UI below the path.", contentType: "text/html"},
+	"GET " + OpenAPIPath: {summary: "Describes the API.", response: OpenAPI{}},
+	"GET " + GraphQLPath: {
+		summary: "Runs a GraphQL query over the tables.", params: []string{"query", "operationName", "variables"},
+		response: GraphQLResponse{},
+	},
+	"POST " + GraphQLPath: {
+		summary: "Runs a GraphQL query over the tables.", request: GraphQLRequest{}, response: GraphQLResponse{},
+	},
+	"GET " + ODataPath + "{$}": {summary: "Lists the tables as OData entity sets.", response: ODataServiceDocument{}},
+	"GET " + ODataPath + "$metadata": {
+		summary: "Describes the tables as OData entity types.", contentType: "application/xml",
+	},
+	"GET " + ODataPath + "{table}": {
+		summary: "Reads the rows of the table as an OData entity set.",
+		params:  []string{"$filter", "$select", "$orderby", "$top", "$skip", "$count"}, response: ODataCollection{},
+	},
+	"POST " + SegmentPath + "track": {
+		summary: "Inserts a Segment track call into the events table.", response: SegmentResponse{}, tag: "segment",
+	},
+	"POST " + SegmentPath + "identify": {
+		summary: "Inserts a Segment identify call into the identities table.", response: SegmentResponse{},
+		tag: "segment",
+	},
+	"POST " + SegmentPath + "batch": {
+		summary: "Inserts the track and identify calls of a Segment batch.", request: SegmentBatch{},
+		response: SegmentResponse{}, tag: "segment",
+	},
+	"GET /{$}": {
+		summary: "Runs a query of the ClickHouse HTTP interface.", params: []string{"query", "default_format"},
+		contentType: "text/tab-separated-values", tag: "clickhouse",
+	},
+	"POST /{$}": {
+		summary: "Runs a query or a JSONEachRow insert of the ClickHouse HTTP interface.",
+		params:  []string{"query", "default_format"}, contentType: "text/tab-separated-values", tag: "clickhouse",
+	},
+	"GET /ping": {
+		summary: "Answers the health checks of ClickHouse clients.", contentType: "text/plain", tag: "clickhouse",
+	},
+}
+
+// routeMux is a ServeMux recording the registered patterns for the OpenAPI document.
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *routeMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, handler)
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
+// handleOpenAPI registers the OpenAPI document of the routes of the mux. It is built on the first request, once
+// every route is registered.
+func (s *Server) handleOpenAPI(m *routeMux) {
+	doc := sync.OnceValue(func() *OpenAPI {
+		return s.openAPI(m.patterns)
+	})
+	m.HandleFunc("GET "+OpenAPIPath, func(w http.ResponseWriter, _ *http.Request) {
+		s.writeJSON(w, http.StatusOK, "handle openapi: writing response", doc())
+	})
+}
+
+// openAPI documents the routes of the patterns.
+func (s *Server) openAPI(patterns []string) *OpenAPI {
+	schemas := &schemaBuilder{schemas: make(map[string]map[string]any)}
+	doc := &OpenAPI{
+		OpenAPI:    "3.1.0",
+		Info:       OpenAPIInfo{Title: "scratch", Version: "1"},
+		Paths:      make(map[string]map[string]Operation),
+		Components: OpenAPIComponents{Schemas: schemas.schemas},
+	}
+	errorResponse := OpenAPIResponse{
+		Description: "The error.",
+		Content:     map[string]map[string]any{FormatJSON.ContentType: {"schema": schemas.of(ErrorResponse{})}},
+	}
+	for _, pattern := range patterns {
+		method, path, _ := strings.Cut(pattern, " ")
+		route := routeDocs[pattern]
+		// {$} anchors the pattern at the end of the path, it is no parameter.
+		path = strings.TrimSuffix(path, "{$}")
+		tag := route.tag
+		if tag == "" {
+			tag = routeTag(path)
+		}
+		op := Operation{
+			OperationID: operationID(method, path),
+			Summary:     route.summary,
+			Tags:        []string{tag},
+			Responses:   map[string]OpenAPIResponse{"default": errorResponse},
+		}
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			name, ok := strings.CutPrefix(segment, "{")
+			if !ok {
+				continue
+			}
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "}"), "...")
+			segments[i] = "{" + name + "}"
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: name, In: "path", Required: true, Schema: map[string]any{"type": "string"},
+			})
+		}
+		params := route.params
+		if route.result {
+			params = append(params[:len(params):len(params)], resultParams...)
+		}
+		for _, name := range params {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: name, In: "query", Description: queryParamDocs[name], Schema: map[string]any{"type": "string"},
+			})
+		}
+		if route.request != nil {
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content:  map[string]map[string]any{FormatJSON.ContentType: {"schema": schemas.of(route.request)}},
+			}
+		}
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		res := OpenAPIResponse{Description: http.StatusText(status)}
+		switch {
+		case route.result:
+			res.Content = make(map[string]map[string]any, len(queryFormats))
+			for _, f := range queryFormats {
+				res.Content[f.ContentType] = map[string]any{}
+			}
+			res.Content[FormatJSON.ContentType] = map[string]any{"schema": map[string]any{"oneOf": []any{
+				map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
+				schemas.of(Envelope{}),
+				map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "array"}},
+			}}}
+		case route.response != nil:
+			res.Content = map[string]map[string]any{FormatJSON.ContentType: {"schema": schemas.of(route.response)}}
+		case route.contentType != "":
+			res.Content = map[string]map[string]any{route.contentType: {}}
+		}
+		op.Responses[fmt.Sprint(status)] = res
+		path = strings.Join(segments, "/")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]Operation)
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+	if s.apiKeys != nil || s.jwt != nil || len(s.clientCerts) > 0 {
+		doc.Components.SecuritySchemes = map[string]map[string]any{
+			"bearer": {"type": "http", "scheme": "bearer", "description": "An API key or a JWT."},
+		}
+		doc.Security = []map[string][]string{{"bearer": {}}}
+		if len(s.clientCerts) > 0 {
+			doc.Components.SecuritySchemes["clientCert"] = map[string]any{"type": "mutualTLS"}
+			doc.Security = append(doc.Security, map[string][]string{"clientCert": {}})
+		}
+	}
+	return doc
+}
+
+// operationID names the route after its method and path, e.g. get_tables_table_schema.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, segment := range strings.Split(path, "/") {
+		segment = strings.Trim(segment, "{}.")
+		if segment != "" {
+			id += "_" + strings.ReplaceAll(segment, "-", "_")
+		}
+	}
+	if path == "/" {
+		id += "_root"
+	}
+	return id
+}
+
+// routeTag groups the routes by their first path segment, the admin routes by the segment after admin.
+func routeTag(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if segments[0] == "admin" && len(segments) > 1 {
+		return "admin " + segments[1]
+	}
+	return strings.TrimSuffix(segments[0], ".json")
+}
+
+// schemaBuilder derives JSON Schemas from Go types by their JSON encoding. Named structs become components.
+type schemaBuilder struct {
+	schemas map[string]map[string]any
+}
+
+//nolint:gochecknoglobals // Read-only types.
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// of returns the schema of the type of v.
+func (b *schemaBuilder) of(v any) map[string]any {
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// Registered before the fields, so recursive types refer to themselves.
+			b.schemas[t.Name()] = map[string]any{}
+			b.schemas[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object returns the schema of the JSON object of the struct type, with the fields of embedded structs inlined.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	b.fields(t, properties)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.fields(embedded, properties)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+	}
+}
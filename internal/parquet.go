@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CopyParquet runs the statement through DuckDB's COPY into a temporary Parquet file and writes the file to w. A Limit
+// on the statement is applied, cursors are not supported.
+func (s *Store) CopyParquet(ctx context.Context, stmt *QueryStatement, w io.Writer) error {
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	query, err := stmt.limited()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "scratch-parquet-")
+	if err != nil {
+		return fmt.Errorf("creating parquet directory: %w", err)
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			slog.Error("removing parquet directory", "err", removeErr)
+		}
+	}()
+	path := filepath.Join(dir, "result.parquet")
+	copyQuery := fmt.Sprintf("COPY (\n%s\n) TO %s (FORMAT PARQUET)", query, quoteLiteral(path))
+	if _, err = s.db.ExecContext(ctx, copyQuery, stmt.Params...); err != nil {
+		return fmt.Errorf("copying to parquet: %w", s.memoryError(err))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening parquet file: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("closing parquet file", "err", closeErr)
+		}
+	}()
+	if _, err = io.Copy(w, f); err != nil {
+		return fmt.Errorf("writing parquet file: %w", err)
+	}
+	return nil
+}
+
+// quoteLiteral quotes the value as a SQL string literal.
+func quoteLiteral(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
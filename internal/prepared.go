@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// maxPreparedInserts bounds the INSERT statements kept prepared, past it new statements are executed unprepared.
+const maxPreparedInserts = 256
+
+// preparedInserts caches the prepared INSERT statements of the tables by their SQL, which the table, the column set
+// and the shape of the rows determine, so hot tables skip parsing and planning. The statements of a table are closed
+// when the store changes its schema, and a statement is dropped when it fails, e.g. after DDL of the admin endpoints.
+type preparedInserts struct {
+	mu      sync.Mutex
+	byTable map[string]map[string]*sql.Stmt
+	size    int
+}
+
+func newPreparedInserts() *preparedInserts {
+	return &preparedInserts{byTable: make(map[string]map[string]*sql.Stmt)}
+}
+
+// exec runs the INSERT of the table with the values, preparing it on first use.
+func (p *preparedInserts) exec(ctx context.Context, conn *sql.Conn, table, query string, values []any) error {
+	key := strings.ToLower(table)
+	p.mu.Lock()
+	stmt := p.byTable[key][query]
+	full := p.size >= maxPreparedInserts
+	p.mu.Unlock()
+	if stmt == nil {
+		if full {
+			_, err := conn.ExecContext(ctx, query, values...)
+			return err
+		}
+		prepared, err := conn.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		stmt = p.put(key, query, prepared)
+	}
+	if _, err := stmt.ExecContext(ctx, values...); err != nil {
+		p.drop(key, query, stmt)
+		return err
+	}
+	return nil
+}
+
+// put caches the statement unless another was cached for the query meanwhile, which is returned instead.
+func (p *preparedInserts) put(table, query string, stmt *sql.Stmt) *sql.Stmt {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cached := p.byTable[table][query]; cached != nil {
+		closeStmt(stmt)
+		return cached
+	}
+	if p.byTable[table] == nil {
+		p.byTable[table] = make(map[string]*sql.Stmt)
+	}
+	p.byTable[table][query] = stmt
+	p.size++
+	return stmt
+}
+
+// drop closes the statement of the query if it is still cached.
+func (p *preparedInserts) drop(table, query string, stmt *sql.Stmt) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byTable[table][query] != stmt {
+		return
+	}
+	delete(p.byTable[table], query)
+	p.size--
+	closeStmt(stmt)
+}
+
+// invalidate closes the statements of the table. Executions in flight finish first.
+func (p *preparedInserts) invalidate(table string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := strings.ToLower(table)
+	for _, stmt := range p.byTable[key] {
+		closeStmt(stmt)
+	}
+	p.size -= len(p.byTable[key])
+	delete(p.byTable, key)
+}
+
+// close closes every statement.
+func (p *preparedInserts) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, stmts := range p.byTable {
+		for _, stmt := range stmts {
+			closeStmt(stmt)
+		}
+	}
+	p.byTable, p.size = make(map[string]map[string]*sql.Stmt), 0
+}
+
+func closeStmt(stmt *sql.Stmt) {
+	if err := stmt.Close(); err != nil {
+		slog.Error("closing prepared insert", "err", err)
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// InsertPreview is the body of POST /data/preview: what inserting the rows would do to the table, without doing it.
+type InsertPreview struct {
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+	// Exists is false if the insert would create the table.
+	Exists bool `json:"exists"`
+	// DDL are the statements the insert would execute before inserting the rows, in order, empty if the table takes
+	// the rows as it is.
+	DDL     []string        `json:"ddl"`
+	Columns []PreviewColumn `json:"columns"`
+}
+
+// PreviewColumn is a column the rows are inserted into, or which is created with the table.
+type PreviewColumn struct {
+	Name string `json:"name"`
+	// Type is the type of the column after the insert, the inferred or declared type of a new column.
+	Type string `json:"type"`
+	New  bool   `json:"new"`
+	// Converted marks the existing columns that are given values of other types, which the insert converts to Type,
+	// failing for those that don't convert.
+	Converted bool `json:"converted,omitempty"`
+}
+
+// PreviewInsert runs the checks and the type inference of Insert on the statement and returns the DDL it would
+// execute, without writing anything. Quotas aren't checked, they depend on the inserts until the actual one. The
+// preview doesn't hold the write path, an insert running meanwhile may change the table it previewed.
+func (s *Store) PreviewInsert(ctx context.Context, stmt *InsertStatement) (*InsertPreview, error) {
+	stmt, cfg, _, err := s.prepareInsert(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	types, err := s.columnTypes(ctx, stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return s.previewCreate(stmt, cfg)
+	}
+	return s.previewAlter(ctx, stmt, cfg, types)
+}
+
+// previewCreate previews the insert creating the table.
+func (s *Store) previewCreate(stmt *InsertStatement, cfg TableConfig) (*InsertPreview, error) {
+	names := stmt.tableColumnNames(cfg)
+	if err := s.limits.CheckTableColumns(stmt.Table, 0, names); err != nil {
+		return nil, err
+	}
+	query, err := stmt.createTableQuery(cfg, s.tablePrefix(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInsert, err)
+	}
+	out := &InsertPreview{
+		Table: stmt.Table,
+		Rows:  len(stmt.rows()),
+		DDL:   append(stmt.sequenceQueries(cfg, s.tablePrefix(cfg)), query),
+	}
+	for _, name := range names {
+		dataType, _ := stmt.columnType(name, cfg)
+		out.Columns = append(out.Columns, PreviewColumn{Name: name, Type: dataType, New: true})
+	}
+	return out, nil
+}
+
+// previewAlter previews the insert into the existing table with the column types.
+func (s *Store) previewAlter(
+	ctx context.Context, stmt *InsertStatement, cfg TableConfig, types map[string]string,
+) (*InsertPreview, error) {
+	out := &InsertPreview{Table: stmt.Table, Rows: len(stmt.rows()), Exists: true, DDL: []string{}}
+	enums, err := s.enumChanges(ctx, stmt, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range enums {
+		out.DDL = append(out.DDL, c.query(stmt.Table))
+		types[strings.ToLower(c.column)] = c.dataType
+	}
+	var missing []string
+	for _, name := range stmt.columnNames() {
+		dataType, ok := types[strings.ToLower(name)]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		col := PreviewColumn{Name: name, Type: dataType}
+		for _, row := range stmt.rows() {
+			if v := row[name]; v != nil && !matchesType(dataType, v) {
+				col.Converted = true
+				break
+			}
+		}
+		out.Columns = append(out.Columns, col)
+	}
+	if err = s.limits.CheckNewColumns(stmt.Table, len(types), missing); err != nil {
+		return nil, err
+	}
+	for _, name := range missing {
+		query, queryErr := stmt.AddColumnQueryString(name, cfg)
+		if errors.Is(queryErr, ErrConstrainedColumn) {
+			return nil, queryErr
+		}
+		if queryErr != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidInsert, queryErr)
+		}
+		out.DDL = append(out.DDL, query)
+		dataType, _ := stmt.columnType(name, cfg)
+		out.Columns = append(out.Columns, PreviewColumn{Name: name, Type: dataType, New: true})
+	}
+	return out, nil
+}
+
+// HandlePreviewData decodes the body like POST /data and responds with the InsertPreview of inserting it.
+func (s *Server) HandlePreviewData(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	stmt, ok := s.decodeData(w, r, "handle preview data")
+	if !ok {
+		return
+	}
+	preview, err := s.store.PreviewInsert(r.Context(), stmt)
+	switch {
+	case errors.Is(err, ErrInvalidInsert), errors.Is(err, ErrGeneratedColumn):
+		s.writeError(w, http.StatusUnprocessableEntity, "handle preview data", err)
+	case errors.Is(err, ErrConstrainedColumn):
+		s.writeError(w, http.StatusConflict, "handle preview data", err)
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, "handle preview data", err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle preview data: writing response", preview)
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// QueryProfile is the executed plan of a statement with the time and cardinality of each operator.
+type QueryProfile struct {
+	TotalMS float64   `json:"total_ms"`
+	Plan    *PlanNode `json:"plan"`
+}
+
+// fetchProfiled runs Fetch on a dedicated connection with DuckDB profiling enabled. The profile is written to a
+// temporary file rather than stdout and profiling is disabled before the connection goes back to the pool.
+func (s *Store) fetchProfiled(ctx context.Context, stmt *QueryStatement) (*QueryResult, error) {
+	dir, err := os.MkdirTemp("", "scratch-profile-")
+	if err != nil {
+		return nil, fmt.Errorf("profile: creating temporary directory: %w", err)
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(dir); removeErr != nil {
+			slog.Error("profile: removing temporary directory", "err", removeErr)
+		}
+	}()
+	path := filepath.Join(dir, "profile.json")
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("profile: acquiring connection: %w", err)
+	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			slog.Error("profile: closing connection", "err", closeErr)
+		}
+	}()
+	for _, pragma := range []string{
+		"PRAGMA enable_profiling='json'",
+		"PRAGMA profiling_output=" + quoteLiteral(path),
+	} {
+		if _, err = conn.ExecContext(ctx, pragma); err != nil {
+			return nil, fmt.Errorf("profile: configuring connection: %w", err)
+		}
+	}
+	res, err := s.fetch(ctx, conn, stmt)
+	if _, resetErr := conn.ExecContext(context.Background(), "PRAGMA disable_profiling"); resetErr != nil {
+		slog.Error("profile: resetting connection", "err", resetErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("profile: reading profile: %w", err)
+	}
+	plan, total, err := parseProfile(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("profile: parsing profile: %w", err)
+	}
+	res.Profile = &QueryProfile{TotalMS: total, Plan: plan}
+	return res, nil
+}
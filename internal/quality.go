@@ -0,0 +1,547 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQualityNotFound = errors.New("quality checks not found")
+	ErrInvalidQuality  = errors.New("invalid quality checks")
+	ErrQualityRunning  = errors.New("quality checks are being evaluated")
+)
+
+// The types of quality checks.
+const (
+	// QualityNullRate fails when the share of NULL values of the column exceeds MaxRate.
+	QualityNullRate = "null_rate"
+	// QualityRange fails when values of the column fall below Min or above Max.
+	QualityRange = "range"
+	// QualityUnique fails when values of the column repeat. NULL values don't count.
+	QualityUnique = "unique"
+	// QualityFreshness fails when the newest timestamp of the column is older than MaxAge, or the table is empty.
+	QualityFreshness = "freshness"
+)
+
+// QualityState is the outcome of the last evaluation of the checks of a table.
+type QualityState string
+
+const (
+	QualityPassing QualityState = "passing"
+	// QualityFailing is the state of tables with a failed check, including checks whose query failed.
+	QualityFailing QualityState = "failing"
+)
+
+// QualityCheck is an expectation on the rows of a table.
+type QualityCheck struct {
+	// Name identifies the check in the results, <type>_<column> by default.
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type"`
+	Column string `json:"column"`
+	// MaxRate is the largest share of NULL values, from 0 to 1, that null_rate checks accept.
+	MaxRate float64 `json:"max_rate,omitempty"`
+	// Min and Max bound the values of range checks, either may be unset.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// MaxAge is how old the newest value of freshness checks may be, as a Go duration.
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// QualityResult is the outcome of a check.
+type QualityResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Observed is the share of NULL values, the number of values out of range or repeated, or the age in seconds of
+	// the newest value, depending on the type of the check.
+	Observed *float64 `json:"observed,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// TableQuality holds the quality checks of a table. They are evaluated every Interval, if set, after the inserts and
+// imports into the table if OnIngest is set, and on demand. The target is notified when the table starts failing a
+// check and when all checks pass again.
+type TableQuality struct {
+	Table    string         `json:"table"`
+	Checks   []QualityCheck `json:"checks"`
+	Interval string         `json:"interval,omitempty"`
+	OnIngest bool           `json:"on_ingest,omitempty"`
+	Target   *AlertTarget   `json:"target,omitempty"`
+
+	// State is unset until the first evaluation. Since is when the table entered it.
+	State            QualityState    `json:"state,omitempty"`
+	Since            *time.Time      `json:"since,omitempty"`
+	LastEvaluation   *time.Time      `json:"last_evaluation,omitempty"`
+	NextEvaluation   *time.Time      `json:"next_evaluation,omitempty"`
+	Results          []QualityResult `json:"results,omitempty"`
+	LastNotification *time.Time      `json:"last_notification,omitempty"`
+	NotifyError      string          `json:"notify_error,omitempty"`
+}
+
+// QualityNotification is the body posted to webhook targets when the state of a table changes.
+type QualityNotification struct {
+	Table    string       `json:"table"`
+	State    QualityState `json:"state"`
+	Previous QualityState `json:"previous,omitempty"`
+	// Failed are the results of the failed checks.
+	Failed []QualityResult `json:"failed,omitempty"`
+	At     time.Time       `json:"at"`
+}
+
+// Validate checks the table, checks and target, names the checks without a name and returns the interval, zero if
+// it is unset.
+func (q *TableQuality) Validate() (time.Duration, error) {
+	if !tableNameRegex.MatchString(q.Table) {
+		return 0, fmt.Errorf("%w: table must match %s", ErrInvalidQuality, tableNameRegex)
+	}
+	if len(q.Checks) == 0 {
+		return 0, fmt.Errorf("%w: no checks", ErrInvalidQuality)
+	}
+	names := make(map[string]bool, len(q.Checks))
+	for i := range q.Checks {
+		c := &q.Checks[i]
+		if err := c.validate(); err != nil {
+			return 0, fmt.Errorf("%w: check %d: %w", ErrInvalidQuality, i, err)
+		}
+		if c.Name == "" {
+			c.Name = c.Type + "_" + c.Column
+		}
+		if names[c.Name] {
+			return 0, fmt.Errorf("%w: repeated check name %q", ErrInvalidQuality, c.Name)
+		}
+		names[c.Name] = true
+	}
+	var interval time.Duration
+	if q.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(q.Interval); err != nil {
+			return 0, fmt.Errorf("%w: parsing interval: %w", ErrInvalidQuality, err)
+		}
+		if interval < time.Second {
+			return 0, fmt.Errorf("%w: interval must be at least 1s", ErrInvalidQuality)
+		}
+	}
+	if q.Target != nil {
+		if err := q.Target.validate(); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrInvalidQuality, err)
+		}
+	}
+	return interval, nil
+}
+
+func (c *QualityCheck) validate() error {
+	if !tableNameRegex.MatchString(c.Column) {
+		return fmt.Errorf("column must match %s", tableNameRegex)
+	}
+	switch c.Type {
+	case QualityNullRate:
+		if c.MaxRate < 0 || c.MaxRate > 1 {
+			return errors.New("max_rate must be from 0 to 1")
+		}
+	case QualityRange:
+		if c.Min == nil && c.Max == nil {
+			return errors.New("range checks need min or max")
+		}
+		if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+			return errors.New("min must not exceed max")
+		}
+	case QualityUnique:
+	case QualityFreshness:
+		maxAge, err := time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return fmt.Errorf("parsing max_age: %w", err)
+		}
+		if maxAge <= 0 {
+			return errors.New("max_age must be positive")
+		}
+	default:
+		return fmt.Errorf("type must be %s, %s, %s or %s", QualityNullRate, QualityRange, QualityUnique, QualityFreshness)
+	}
+	return nil
+}
+
+// redact returns the checks with the secret of their target replaced.
+func (q TableQuality) redact() TableQuality {
+	if q.Target != nil && q.Target.Secret != "" {
+		target := *q.Target
+		target.Secret = redacted
+		q.Target = &target
+	}
+	return q
+}
+
+// evaluate runs the query of the check on the table.
+func (c QualityCheck) evaluate(ctx context.Context, db *sql.DB, table string) QualityResult {
+	res := QualityResult{Check: c.Name}
+	from := " FROM " + quoteIdent(table)
+	col := quoteIdent(c.Column)
+	var observed float64
+	var err error
+	switch c.Type {
+	case QualityNullRate:
+		var total, nulls int64
+		err = db.QueryRowContext(ctx, "SELECT count(*), count(*) FILTER (WHERE "+col+" IS NULL)"+from).
+			Scan(&total, &nulls)
+		if total > 0 {
+			observed = float64(nulls) / float64(total)
+		}
+		res.Passed = observed <= c.MaxRate
+	case QualityRange:
+		var conds []string
+		var params []any
+		if c.Min != nil {
+			conds, params = append(conds, col+" < ?"), append(params, *c.Min)
+		}
+		if c.Max != nil {
+			conds, params = append(conds, col+" > ?"), append(params, *c.Max)
+		}
+		var outside int64
+		err = db.QueryRowContext(ctx, "SELECT count(*) FILTER (WHERE "+strings.Join(conds, " OR ")+")"+from,
+			params...).Scan(&outside)
+		observed, res.Passed = float64(outside), outside == 0
+	case QualityUnique:
+		var repeated int64
+		err = db.QueryRowContext(ctx, "SELECT count("+col+") - count(DISTINCT "+col+")"+from).Scan(&repeated)
+		observed, res.Passed = float64(repeated), repeated == 0
+	case QualityFreshness:
+		var newest sql.NullTime
+		err = db.QueryRowContext(ctx, "SELECT max(CAST("+col+" AS TIMESTAMP))"+from).Scan(&newest)
+		if err == nil && !newest.Valid {
+			res.Error = "no values"
+			return res
+		}
+		maxAge, _ := time.ParseDuration(c.MaxAge)
+		age := time.Since(newest.Time)
+		observed, res.Passed = age.Seconds(), age <= maxAge
+	}
+	if err != nil {
+		return QualityResult{Check: c.Name, Error: err.Error()}
+	}
+	res.Observed = &observed
+	return res
+}
+
+type qualityEntry struct {
+	quality    TableQuality
+	interval   time.Duration
+	evaluating bool
+}
+
+// Quality evaluates the quality checks of the tables once Run is called and notifies their targets of state changes.
+type Quality struct {
+	store   *Store
+	timeout time.Duration
+	client  *webhookClient
+
+	mu      sync.Mutex
+	entries map[string]*qualityEntry
+	wake    chan struct{}
+}
+
+// NewQuality returns a quality check manager whose evaluations are bound by timeout, zero for no bound.
+// Notifications are retried like the deliveries of the webhook configuration. It is notified of the inserts and
+// imports of the store, so it must be created before the store is written to concurrently.
+func NewQuality(store *Store, timeout time.Duration, cfg WebhookConfig) *Quality {
+	qs := &Quality{
+		store:   store,
+		timeout: timeout,
+		client:  newWebhookClient(cfg),
+		entries: make(map[string]*qualityEntry),
+		wake:    make(chan struct{}, 1),
+	}
+	store.onWrite(qs.written)
+	return qs
+}
+
+// written schedules the checks of the table that are evaluated on ingest.
+func (qs *Quality) written(table string) {
+	qs.mu.Lock()
+	e, ok := qs.entries[strings.ToLower(table)]
+	if ok && e.quality.OnIngest {
+		now := time.Now().UTC()
+		e.quality.NextEvaluation = &now
+	}
+	qs.mu.Unlock()
+	if ok {
+		select {
+		case qs.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Put registers or replaces the checks of a table, which start over without a state, and reports whether they are
+// new. It returns them redacted.
+func (qs *Quality) Put(q TableQuality) (TableQuality, bool, error) {
+	interval, err := q.Validate()
+	if err != nil {
+		return TableQuality{}, false, err
+	}
+	q.State, q.Since, q.LastEvaluation, q.NextEvaluation, q.Results = "", nil, nil, nil, nil
+	q.LastNotification, q.NotifyError = nil, ""
+	if interval > 0 {
+		next := time.Now().UTC()
+		q.NextEvaluation = &next
+	}
+	qs.mu.Lock()
+	_, exists := qs.entries[strings.ToLower(q.Table)]
+	qs.entries[strings.ToLower(q.Table)] = &qualityEntry{quality: q, interval: interval}
+	qs.mu.Unlock()
+	select {
+	case qs.wake <- struct{}{}:
+	default:
+	}
+	return q.redact(), !exists, nil
+}
+
+// Get returns the checks of the table redacted.
+func (qs *Quality) Get(table string) (TableQuality, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	e, ok := qs.entries[strings.ToLower(table)]
+	if !ok {
+		return TableQuality{}, fmt.Errorf("%w: %s", ErrQualityNotFound, table)
+	}
+	return e.quality.redact(), nil
+}
+
+// List returns the checks of all tables redacted.
+func (qs *Quality) List() []TableQuality {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	out := make([]TableQuality, 0, len(qs.entries))
+	for _, e := range qs.entries {
+		out = append(out, e.quality.redact())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Table < out[j].Table
+	})
+	return out
+}
+
+func (qs *Quality) Delete(table string) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if _, ok := qs.entries[strings.ToLower(table)]; !ok {
+		return fmt.Errorf("%w: %s", ErrQualityNotFound, table)
+	}
+	delete(qs.entries, strings.ToLower(table))
+	return nil
+}
+
+// Run evaluates the checks that are due until ctx is done. Checks still being evaluated when they come due again are
+// evaluated once they finish.
+func (qs *Quality) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-qs.wake:
+		case <-timer.C:
+		}
+		next := qs.evaluateDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// evaluateDue starts the evaluations that are due and returns the time until the next one.
+func (qs *Quality) evaluateDue(ctx context.Context) time.Duration {
+	now := time.Now().UTC()
+	wait := time.Minute
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for _, e := range qs.entries {
+		if e.quality.NextEvaluation == nil {
+			continue
+		}
+		if !e.quality.NextEvaluation.After(now) && !e.evaluating {
+			e.quality.NextEvaluation = nil
+			if e.interval > 0 {
+				next := now.Add(e.interval)
+				e.quality.NextEvaluation = &next
+			}
+			e.evaluating = true
+			go qs.evaluate(ctx, e)
+		}
+		if e.quality.NextEvaluation != nil {
+			wait = min(wait, max(e.quality.NextEvaluation.Sub(now), 0))
+		}
+	}
+	return wait
+}
+
+// EvaluateNow evaluates the checks of the table immediately, notifying their target of a state change, and waits for
+// them to finish.
+func (qs *Quality) EvaluateNow(ctx context.Context, table string) (TableQuality, error) {
+	qs.mu.Lock()
+	e, ok := qs.entries[strings.ToLower(table)]
+	if !ok {
+		qs.mu.Unlock()
+		return TableQuality{}, fmt.Errorf("%w: %s", ErrQualityNotFound, table)
+	}
+	if e.evaluating {
+		qs.mu.Unlock()
+		return TableQuality{}, fmt.Errorf("%w: %s", ErrQualityRunning, table)
+	}
+	e.evaluating = true
+	qs.mu.Unlock()
+	qs.evaluate(ctx, e)
+	return qs.Get(table)
+}
+
+// evaluate runs the checks of the table, records their results and notifies the target if the state changed, except
+// for a first evaluation that finds the table passing.
+func (qs *Quality) evaluate(ctx context.Context, e *qualityEntry) {
+	qs.mu.Lock()
+	q := e.quality
+	qs.mu.Unlock()
+	if qs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, qs.timeout)
+		defer cancel()
+	}
+	now := time.Now().UTC()
+	n := QualityNotification{Table: q.Table, State: QualityPassing, Previous: q.State, At: now}
+	results := make([]QualityResult, len(q.Checks))
+	for i, c := range q.Checks {
+		results[i] = c.evaluate(ctx, qs.store.db, q.Table)
+		if !results[i].Passed {
+			n.State, n.Failed = QualityFailing, append(n.Failed, results[i])
+		}
+	}
+
+	qs.mu.Lock()
+	e.evaluating = false
+	e.quality.LastEvaluation, e.quality.Results = &now, results
+	changed := n.State != e.quality.State
+	if changed {
+		e.quality.State, e.quality.Since = n.State, &now
+	}
+	qs.mu.Unlock()
+	if !changed || q.Target == nil || (n.Previous == "" && n.State == QualityPassing) {
+		return
+	}
+
+	notifyErr := qs.notify(ctx, *q.Target, n)
+	if notifyErr != nil {
+		slog.Error("quality: notifying target", "table", q.Table, "state", n.State, "err", notifyErr)
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	// The outcome is dropped if the checks were replaced or deleted meanwhile.
+	if qs.entries[strings.ToLower(q.Table)] != e {
+		return
+	}
+	e.quality.NotifyError = ""
+	if notifyErr != nil {
+		e.quality.NotifyError = notifyErr.Error()
+		return
+	}
+	notified := time.Now().UTC()
+	e.quality.LastNotification = &notified
+}
+
+// notify posts the notification to the target, as a message for Slack.
+func (qs *Quality) notify(ctx context.Context, target AlertTarget, n QualityNotification) error {
+	var payload any = n
+	if target.Type == AlertTargetSlack {
+		payload = map[string]string{"text": slackQualityText(n)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding notification: %w", err)
+	}
+	return qs.client.post(ctx, target.URL, target.Secret, "quality_"+string(n.State), body)
+}
+
+// slackQualityText formats the notification as a Slack message listing the failed checks.
+func slackQualityText(n QualityNotification) string {
+	if n.State == QualityPassing {
+		return fmt.Sprintf(":white_check_mark: The quality checks of *%s* pass again", n.Table)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ":rotating_light: Quality checks of *%s* failed:", n.Table)
+	for _, r := range n.Failed {
+		switch {
+		case r.Error != "":
+			fmt.Fprintf(&sb, "\n• %s: %s", r.Check, r.Error)
+		case r.Observed != nil:
+			fmt.Fprintf(&sb, "\n• %s: observed %g", r.Check, *r.Observed)
+		}
+	}
+	return sb.String()
+}
+
+func (s *Server) HandleListQuality(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list quality: writing response", s.quality.List())
+}
+
+// HandlePutQuality creates or replaces the quality checks of the table in the path.
+func (s *Server) HandlePutQuality(w http.ResponseWriter, r *http.Request) {
+	var q TableQuality
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put quality: decoding request body", err)
+		return
+	}
+	q.Table = r.PathValue("table")
+	q, created, err := s.quality.Put(q)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put quality", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put quality: writing response", q)
+}
+
+// HandleGetQuality responds with the quality checks of the table in the path and their last results. It serves both
+// the admin endpoint and the table route readers of the table use.
+func (s *Server) HandleGetQuality(w http.ResponseWriter, r *http.Request) {
+	q, err := s.quality.Get(r.PathValue("table"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get quality", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get quality: writing response", q)
+}
+
+func (s *Server) HandleDeleteQuality(w http.ResponseWriter, r *http.Request) {
+	if err := s.quality.Delete(r.PathValue("table")); err != nil {
+		s.writeError(w, http.StatusNotFound, "handle delete quality", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEvaluateQuality evaluates the quality checks of the table in the path outside of their schedule and responds
+// with their results.
+func (s *Server) HandleEvaluateQuality(w http.ResponseWriter, r *http.Request) {
+	q, err := s.quality.EvaluateNow(r.Context(), r.PathValue("table"))
+	if errors.Is(err, ErrQualityRunning) {
+		s.writeError(w, http.StatusConflict, "handle evaluate quality", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle evaluate quality", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle evaluate quality: writing response", q)
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrInvalidQueryTag = errors.New("invalid query tag")
+
+const (
+	// QueryTagHeader attributes the queries of a request to a workload, e.g. a dashboard or a team, in the query
+	// history, the audit log and the per-tag stats, and subjects them to the concurrency limit of the tag.
+	QueryTagHeader = "X-Query-Tag"
+	// QueryTagParam sets the tag like QueryTagHeader, which it takes precedence over, e.g. ?tag=sales-dashboard.
+	QueryTagParam = "tag"
+	// maxQueryTags bounds the tags counted apart. The queries of further tags are counted under otherQueryTag.
+	maxQueryTags  = 1000
+	otherQueryTag = "_other"
+)
+
+// queryTagRegex matches the tags queries can be attributed to.
+var queryTagRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]{0,63}$`)
+
+// queryTag returns the tag the request attributes its queries to, empty if it has none.
+func queryTag(r *http.Request) (string, error) {
+	tag := r.URL.Query().Get(QueryTagParam)
+	if tag == "" {
+		tag = r.Header.Get(QueryTagHeader)
+	}
+	if tag != "" && !queryTagRegex.MatchString(tag) {
+		return "", fmt.Errorf("%w: %q must match %s", ErrInvalidQueryTag, tag, queryTagRegex)
+	}
+	return tag, nil
+}
+
+// QueryTagStats sums up the queries of a tag since the server started. Rows count the rows of the results that
+// aren't streamed as Arrow or Parquet.
+type QueryTagStats struct {
+	Tag     string  `json:"tag"`
+	Queries int64   `json:"queries"`
+	Errors  int64   `json:"errors"`
+	Cached  int64   `json:"cached"`
+	Rows    int64   `json:"rows"`
+	TotalMS float64 `json:"total_ms"`
+	MaxMS   float64 `json:"max_ms"`
+}
+
+// queryTagStats counts the executed queries per tag. Untagged queries aren't counted.
+type queryTagStats struct {
+	mu    sync.Mutex
+	byTag map[string]*QueryTagStats
+}
+
+func newQueryTagStats() *queryTagStats {
+	return &queryTagStats{byTag: make(map[string]*QueryTagStats)}
+}
+
+func (t *queryTagStats) add(tag string, duration time.Duration, rows *int, cached, failed bool) {
+	if tag == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.byTag[tag]
+	if !ok && len(t.byTag) >= maxQueryTags {
+		tag = otherQueryTag
+		st, ok = t.byTag[tag]
+	}
+	if !ok {
+		st = &QueryTagStats{Tag: tag}
+		t.byTag[tag] = st
+	}
+	ms := float64(duration.Microseconds()) / 1000
+	st.Queries++
+	st.TotalMS += ms
+	st.MaxMS = max(st.MaxMS, ms)
+	if failed {
+		st.Errors++
+	}
+	if cached {
+		st.Cached++
+	}
+	if rows != nil {
+		st.Rows += int64(*rows)
+	}
+}
+
+// list returns the stats of the tags sorted by tag.
+func (t *queryTagStats) list() []QueryTagStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]QueryTagStats, 0, len(t.byTag))
+	for _, st := range t.byTag {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Tag < out[j].Tag
+	})
+	return out
+}
+
+// WithQueryTagConcurrency bounds the queries of each tag of limits executing at once, with a queue of maxQueued queries
+// waiting for a slot of the tag. The queries of a tag hold its slot while they wait for a slot of the server, so a
+// busy tag can't take over the slots of the server. Queries beyond both are rejected with 429.
+func WithQueryTagConcurrency(limits map[string]int, maxQueued int) ServerOption {
+	return func(s *Server) {
+		s.tagSlots = make(map[string]*querySlots, len(limits))
+		for tag, n := range limits {
+			if slots := newQuerySlots(n, maxQueued); slots != nil {
+				s.tagSlots[tag] = slots
+			}
+		}
+	}
+}
+
+// acquireQuery waits for an execution slot of the tag, if it is limited, and then of the server, and returns the
+// function releasing both.
+func (s *Server) acquireQuery(ctx context.Context, tag string) (func(), error) {
+	releaseTag, err := s.tagSlots[tag].acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	release, err := s.slots.acquire(ctx)
+	if err != nil {
+		releaseTag()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseTag()
+	}, nil
+}
+
+// HandleQueryTagStats lists the executed queries, errors, rows and durations per query tag.
+func (s *Server) HandleQueryTagStats(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle query tag stats: writing response", s.tagStats.list())
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TenantUsageTable accounts the inserts of the tenants per table and day. It is created with the first insert of a
+// tenant.
+const TenantUsageTable = "_tenant_usage"
+
+var (
+	// ErrQuotasDisabled is returned when reading the usage of a store without quotas.
+	ErrQuotasDisabled = errors.New("quotas are disabled")
+	// ErrNoTenant is returned when reading the usage of a request without a tenant.
+	ErrNoTenant = errors.New("the api key or token has no tenant")
+)
+
+// Quota limits what a tenant stores. Zero disables a limit.
+type Quota struct {
+	// MaxTables bounds the existing tables the tenant inserted into.
+	MaxTables int `json:"max_tables,omitempty" yaml:"max_tables"`
+	// MaxBytes bounds the size of the rows the tenant inserted into its existing tables, by their JSON encoding.
+	// Deleting rows doesn't release it, dropping the table does.
+	MaxBytes int `json:"max_bytes,omitempty" yaml:"max_bytes"`
+	// MaxDailyRows bounds the rows the tenant inserts per day, from midnight UTC.
+	MaxDailyRows int `json:"max_daily_rows,omitempty" yaml:"max_daily_rows"`
+}
+
+// Quotas are the quotas of the tenants of API keys and tokens, see Principal.Tenant. Requests without a tenant have
+// none. Only inserts through the API are accounted, imports and writes through SQL are not.
+type Quotas struct {
+	// Default applies to the tenants without a quota of their own.
+	Default Quota            `yaml:"default"`
+	Tenants map[string]Quota `yaml:"tenants"`
+}
+
+func (q Quotas) of(tenant string) Quota {
+	if quota, ok := q.Tenants[tenant]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+// WithQuotas accounts the inserts of the tenants and refuses those exceeding their quota with a LimitError.
+func WithQuotas(quotas Quotas) StoreOption {
+	return func(s *Store) {
+		s.quotas = &quotas
+	}
+}
+
+// quotaSettings returns the quotas of a store with quotas as of the last Reload.
+func (s *Store) quotaSettings() Quotas {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return *s.quotas
+}
+
+// TenantUsage is what a tenant stores, measured like its Quota.
+type TenantUsage struct {
+	Tenant    string `json:"tenant"`
+	Tables    int    `json:"tables"`
+	Bytes     int    `json:"bytes"`
+	RowsToday int    `json:"rows_today"`
+	Quota     Quota  `json:"quota"`
+	// tables are the lower cased names of the existing tables of the tenant.
+	tables map[string]bool
+}
+
+// requestTenant returns the tenant of the principal the context carries, empty if there is none.
+func requestTenant(ctx context.Context) string {
+	p, _ := requestPrincipal(ctx)
+	return p.Tenant
+}
+
+// rowBytes returns the size of the JSON encoding of the rows, the measure of Quota.MaxBytes.
+func rowBytes(rows []map[string]any) (int, error) {
+	n := 0
+	for _, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return 0, fmt.Errorf("quotas: measuring row: %w", err)
+		}
+		n += len(data)
+	}
+	return n, nil
+}
+
+// checkQuota refuses the statement if it would exceed the quota of the tenant of the context. The caller holds the
+// write lock.
+func (s *Store) checkQuota(ctx context.Context, stmt *InsertStatement) error {
+	tenant := requestTenant(ctx)
+	if s.quotas == nil || tenant == "" {
+		return nil
+	}
+	quota := s.quotas.of(tenant)
+	if quota == (Quota{}) {
+		return nil
+	}
+	usage, err := s.TenantUsage(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	if quota.MaxTables > 0 && !usage.tables[strings.ToLower(stmt.Table)] && usage.Tables >= quota.MaxTables {
+		return &LimitError{Code: LimitTenantTables, Field: tenant, Limit: quota.MaxTables, Value: usage.Tables + 1}
+	}
+	rows := stmt.rows()
+	if quota.MaxDailyRows > 0 && usage.RowsToday+len(rows) > quota.MaxDailyRows {
+		return &LimitError{
+			Code: LimitTenantDailyRows, Field: tenant, Limit: quota.MaxDailyRows, Value: usage.RowsToday + len(rows),
+		}
+	}
+	if quota.MaxBytes > 0 {
+		n, bytesErr := rowBytes(rows)
+		if bytesErr != nil {
+			return bytesErr
+		}
+		if usage.Bytes+n > quota.MaxBytes {
+			return &LimitError{Code: LimitTenantBytes, Field: tenant, Limit: quota.MaxBytes, Value: usage.Bytes + n}
+		}
+	}
+	return nil
+}
+
+// recordUsage accounts the written chunk to the tenant of the context. The caller holds the write lock.
+func (s *Store) recordUsage(ctx context.Context, chunk *InsertStatement) error {
+	tenant := requestTenant(ctx)
+	if s.quotas == nil || tenant == "" {
+		return nil
+	}
+	if !s.quotaReady {
+		if _, err := s.writer.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			tenant VARCHAR NOT NULL,
+			table_name VARCHAR NOT NULL,
+			day DATE NOT NULL,
+			row_count BIGINT NOT NULL,
+			byte_count BIGINT NOT NULL,
+			PRIMARY KEY (tenant, table_name, day)
+		)`, TenantUsageTable)); err != nil {
+			return fmt.Errorf("quotas: creating %s: %w", TenantUsageTable, err)
+		}
+		s.quotaReady = true
+	}
+	rows := chunk.rows()
+	n, err := rowBytes(rows)
+	if err != nil {
+		return err
+	}
+	if _, err = s.writer.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s VALUES (?, ?, ?::DATE, ?, ?)
+		ON CONFLICT DO UPDATE SET
+			row_count = row_count + excluded.row_count,
+			byte_count = byte_count + excluded.byte_count`, TenantUsageTable),
+		tenant, strings.ToLower(chunk.Table), usageDay(time.Now()), len(rows), n,
+	); err != nil {
+		return fmt.Errorf("quotas: recording usage: %w", err)
+	}
+	return nil
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// TenantUsage returns the usage of the tenant.
+func (s *Store) TenantUsage(ctx context.Context, tenant string) (TenantUsage, error) {
+	if s.quotas == nil {
+		return TenantUsage{}, ErrQuotasDisabled
+	}
+	usages, err := s.tenantUsages(ctx, tenant)
+	if err != nil {
+		return TenantUsage{}, err
+	}
+	if usage, ok := usages[tenant]; ok {
+		return *usage, nil
+	}
+	return TenantUsage{Tenant: tenant, Quota: s.quotaSettings().of(tenant)}, nil
+}
+
+// TenantUsages returns the usage of the tenants that inserted rows or have a quota of their own, by name.
+func (s *Store) TenantUsages(ctx context.Context) ([]TenantUsage, error) {
+	if s.quotas == nil {
+		return nil, ErrQuotasDisabled
+	}
+	usages, err := s.tenantUsages(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for tenant, quota := range s.quotaSettings().Tenants {
+		if _, ok := usages[tenant]; !ok {
+			usages[tenant] = &TenantUsage{Tenant: tenant, Quota: quota}
+		}
+	}
+	out := make([]TenantUsage, 0, len(usages))
+	for _, usage := range usages {
+		out = append(out, *usage)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Tenant < out[j].Tenant
+	})
+	return out, nil
+}
+
+// tenantUsages sums TenantUsageTable for the tenant, or for all tenants if it is empty. Tables that no longer exist
+// count towards the rows of the day only.
+func (s *Store) tenantUsages(ctx context.Context, tenant string) (map[string]*TenantUsage, error) {
+	out := make(map[string]*TenantUsage)
+	quotas := s.quotaSettings()
+	cols, err := s.tableColumns(ctx, TenantUsageTable)
+	if err != nil || len(cols) == 0 {
+		return out, err
+	}
+	where, params := "", []any{usageDay(time.Now())}
+	if tenant != "" {
+		where, params = "WHERE u.tenant = ?", append(params, tenant)
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT
+			u.tenant,
+			u.table_name,
+			sum(u.byte_count)::BIGINT,
+			coalesce(sum(u.row_count) FILTER (WHERE u.day = ?::DATE), 0)::BIGINT,
+			t.name IS NOT NULL
+		FROM %s u
+		LEFT JOIN (
+			SELECT DISTINCT lower(table_name) AS name FROM information_schema.tables WHERE table_catalog IN %s
+		) t ON u.table_name = t.name
+		%s
+		GROUP BY ALL`, TenantUsageTable, ownCatalogs, where), params...)
+	if err != nil {
+		return nil, fmt.Errorf("reading tenant usage: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	for rows.Next() {
+		var (
+			name, table     string
+			bytes, rowCount int64
+			present         bool
+		)
+		if err = rows.Scan(&name, &table, &bytes, &rowCount, &present); err != nil {
+			return nil, fmt.Errorf("reading tenant usage: %w", err)
+		}
+		usage, ok := out[name]
+		if !ok {
+			usage = &TenantUsage{Tenant: name, Quota: quotas.of(name), tables: make(map[string]bool)}
+			out[name] = usage
+		}
+		usage.RowsToday += int(rowCount)
+		if present {
+			usage.Tables++
+			usage.Bytes += int(bytes)
+			usage.tables[table] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading tenant usage: %w", err)
+	}
+	return out, nil
+}
+
+// HandleListTenantUsage lists the usage and quota of every tenant.
+func (s *Server) HandleListTenantUsage(w http.ResponseWriter, r *http.Request) {
+	usages, err := s.store.TenantUsages(r.Context())
+	switch {
+	case errors.Is(err, ErrQuotasDisabled):
+		s.writeError(w, http.StatusNotFound, "handle list tenant usage", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle list tenant usage: writing response", usages)
+	}
+}
+
+// HandleUsage reports the usage and quota of the tenant of the request's API key or token.
+func (s *Server) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	var (
+		usage TenantUsage
+		err   = ErrNoTenant
+	)
+	if tenant := requestTenant(r.Context()); tenant != "" {
+		usage, err = s.store.TenantUsage(r.Context(), tenant)
+	}
+	switch {
+	case errors.Is(err, ErrQuotasDisabled), errors.Is(err, ErrNoTenant):
+		s.writeError(w, http.StatusNotFound, "handle usage", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle usage: writing response", usage)
+	}
+}
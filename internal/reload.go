@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRestartRequired is returned when a reload would turn on or off a feature that is only set up on startup.
+var ErrRestartRequired = errors.New("restart required")
+
+// Settings are the settings of the store that change without a restart, see Store.Reload.
+type Settings struct {
+	Limits Limits
+	// Quotas apply to stores set up with WithQuotas, empty quotas no longer refuse inserts but still account them.
+	Quotas              Quotas
+	ChangeFeedRetention time.Duration
+	AuditRetention      time.Duration
+}
+
+// Reload applies the settings once the running inserts are done, the inserts after it are checked against the new
+// limits and quotas. Quotas and the audit log can't be turned on or off without a restart, the change feed can.
+func (s *Store) Reload(settings Settings) error {
+	quotas := settings.Quotas.Default != (Quota{}) || len(settings.Quotas.Tenants) > 0
+	switch {
+	case s.quotas == nil && quotas:
+		return fmt.Errorf("%w: quotas were disabled on startup", ErrRestartRequired)
+	case (s.audit == nil) != (settings.AuditRetention <= 0):
+		return fmt.Errorf("%w: the audit log can't be turned on or off at runtime", ErrRestartRequired)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	s.limits = settings.Limits
+	if s.quotas != nil {
+		*s.quotas = settings.Quotas
+	}
+	s.changeFeed.retention = settings.ChangeFeedRetention
+	if s.audit != nil {
+		s.audit.mu.Lock()
+		s.audit.retention = settings.AuditRetention
+		s.audit.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrTableExists    = errors.New("table exists")
+	ErrTableInUse     = errors.New("table in use")
+	ErrColumnNotFound = errors.New("column not found")
+	ErrColumnExists   = errors.New("column exists")
+)
+
+// fromClauseEnd lists the keywords that end the table list of a FROM clause.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var fromClauseEnd = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "QUALIFY": true, "WINDOW": true, "ORDER": true, "LIMIT": true,
+	"OFFSET": true, "UNION": true, "EXCEPT": true, "INTERSECT": true, "SELECT": true,
+}
+
+// renameTableRefs points the references to the table from in the query to the table to: names following FROM, JOIN
+// or a comma in a FROM clause, optionally qualified by a schema, and names qualifying a column. The replacement is as
+// precise as the lexer, a common table expression named like the table is renamed along with it.
+func renameTableRefs(query, from, to string) (string, bool) {
+	tokens, err := lexSQL(query)
+	if err != nil {
+		return query, false
+	}
+	isFrom := func(t sqlToken) bool {
+		return (t.kind == sqlWord || t.kind == sqlQuotedIdent) && strings.EqualFold(t.text, from)
+	}
+	var out strings.Builder
+	last, changed := 0, false
+	// fromDepth holds the parenthesis depth of the FROM clauses that are open.
+	depth, fromDepth := 0, []int{}
+	inFrom := func() bool {
+		return len(fromDepth) > 0 && fromDepth[len(fromDepth)-1] == depth
+	}
+	for i, t := range tokens {
+		switch {
+		case t.is(sqlPunct, "("):
+			depth++
+			continue
+		case t.is(sqlPunct, ")"):
+			if inFrom() {
+				fromDepth = fromDepth[:len(fromDepth)-1]
+			}
+			depth--
+			continue
+		case t.is(sqlWord, "FROM"):
+			if !inFrom() {
+				fromDepth = append(fromDepth, depth)
+			}
+			continue
+		case t.kind == sqlWord && fromClauseEnd[t.upper()] && inFrom():
+			fromDepth = fromDepth[:len(fromDepth)-1]
+		}
+		if !isFrom(t) {
+			continue
+		}
+		// Skip the schema of a qualified name to find the token introducing it.
+		j := i
+		if j >= 2 && tokens[j-1].is(sqlPunct, ".") && tokens[j-2].kind == sqlWord {
+			j -= 2
+		}
+		introduced := j > 0 && (tokens[j-1].is(sqlWord, "FROM") || tokens[j-1].is(sqlWord, "JOIN") ||
+			(tokens[j-1].is(sqlPunct, ",") && inFrom()))
+		qualifier := i+1 < len(tokens) && tokens[i+1].is(sqlPunct, ".")
+		if !introduced && !qualifier {
+			continue
+		}
+		out.WriteString(query[last:t.start])
+		if t.kind == sqlQuotedIdent {
+			out.WriteString(quoteIdent(to))
+		} else {
+			out.WriteString(to)
+		}
+		last, changed = t.end, true
+	}
+	out.WriteString(query[last:])
+	return out.String(), changed
+}
+
+// RenameTable renames the table in DuckDB along with its migrations, snapshots, configuration and column history.
+// Tables with a search index can't be renamed, the index refers to the table by name.
+func (s *Store) RenameTable(ctx context.Context, from, to string) error {
+	if !tableNameRegex.MatchString(to) {
+		return fmt.Errorf("invalid table name %q: must match %s", to, tableNameRegex)
+	}
+	if _, err := s.existingColumns(ctx, from); err != nil {
+		return err
+	}
+	cols, err := s.tableColumns(ctx, to)
+	if err != nil {
+		return err
+	}
+	if len(cols) > 0 && !strings.EqualFold(from, to) {
+		return fmt.Errorf("%w: %s", ErrTableExists, to)
+	}
+	s.search.mu.Lock()
+	_, indexed := s.search.byTable[from]
+	s.search.mu.Unlock()
+	if indexed {
+		return fmt.Errorf("%w: %s has a search index, drop it first", ErrTableInUse, from)
+	}
+
+	migrated, err := s.tableColumns(ctx, MigrationsTable)
+	if err != nil {
+		return err
+	}
+	snapshotted, err := s.tableColumns(ctx, SnapshotsTable)
+	if err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back table rename", "err", rollbackErr)
+		}
+	}()
+	query := fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdent(from), quoteIdent(to))
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("rename table: %w", err)
+	}
+	// The migrations of the table carry over to the new name.
+	if len(migrated) > 0 {
+		if _, err = tx.ExecContext(
+			ctx, fmt.Sprintf("UPDATE %s SET table_name = ? WHERE table_name = ?", MigrationsTable),
+			strings.ToLower(to), strings.ToLower(from),
+		); err != nil {
+			return fmt.Errorf("rename table: updating migrations: %w", err)
+		}
+	}
+	// The snapshots keep their copies, only the table they belong to is renamed.
+	if len(snapshotted) > 0 {
+		if _, err = tx.ExecContext(
+			ctx, fmt.Sprintf("UPDATE %s SET table_name = ? WHERE table_name = ?", SnapshotsTable),
+			strings.ToLower(to), strings.ToLower(from),
+		); err != nil {
+			return fmt.Errorf("rename table: updating snapshots: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing table rename: %w", err)
+	}
+	committed = true
+	s.columns.renamed(from, to)
+	s.configs.renamed(from, to)
+	s.ingest.renamed(from, to)
+	s.inserts.invalidate(from)
+	s.inserts.invalidate(to)
+	return nil
+}
+
+func (h *columnHistory) renamed(from, to string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	added, ok := h.byTable[strings.ToLower(from)]
+	delete(h.byTable, strings.ToLower(from))
+	if ok {
+		h.byTable[strings.ToLower(to)] = added
+	}
+	changes, ok := h.changes[strings.ToLower(from)]
+	delete(h.changes, strings.ToLower(from))
+	if ok {
+		h.changes[strings.ToLower(to)] = changes
+	}
+}
+
+// RenameColumn renames the column of the table along with its column history.
+func (s *Store) RenameColumn(ctx context.Context, table, from, to string) error {
+	if !tableNameRegex.MatchString(to) {
+		return fmt.Errorf("invalid column name %q: must match %s", to, tableNameRegex)
+	}
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+	if !cols[strings.ToLower(from)] {
+		return fmt.Errorf("%w: %s.%s", ErrColumnNotFound, table, from)
+	}
+	if cols[strings.ToLower(to)] && !strings.EqualFold(from, to) {
+		return fmt.Errorf("%w: %s.%s", ErrColumnExists, table, to)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	query := fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", quoteIdent(table), quoteIdent(from), quoteIdent(to))
+	if _, err = s.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("rename column: %w", err)
+	}
+	s.columns.columnRenamed(table, from, to)
+	s.inserts.invalidate(table)
+	return nil
+}
+
+func (h *columnHistory) columnRenamed(table, from, to string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	added := h.byTable[strings.ToLower(table)]
+	at, ok := added[strings.ToLower(from)]
+	delete(added, strings.ToLower(from))
+	if ok {
+		added[strings.ToLower(to)] = at
+	}
+}
+
+// renameTable calls rename and, if it succeeds, updates the saved queries referring to the renamed table. The lock is
+// held throughout so the queries never refer to a table that doesn't exist.
+func (sq *savedQueries) renameTable(from, to string, rename func() error) ([]string, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if err := rename(); err != nil {
+		return nil, err
+	}
+	var updated []string
+	for name, q := range sq.byName {
+		if query, ok := renameTableRefs(q.SQL, from, to); ok {
+			q.SQL = query
+			sq.byName[name] = q
+			updated = append(updated, name)
+		}
+	}
+	sort.Strings(updated)
+	return updated, nil
+}
+
+// renameTable calls rename and, if it succeeds, updates the queries and destinations of the schedules referring to
+// the renamed table. Runs that already started still write to the old name.
+func (sc *Scheduler) renameTable(from, to string, rename func() error) ([]string, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if err := rename(); err != nil {
+		return nil, err
+	}
+	var updated []string
+	for name, e := range sc.entries {
+		query, ok := renameTableRefs(e.schedule.SQL, from, to)
+		if strings.EqualFold(e.schedule.Table, from) {
+			e.schedule.Table, ok = to, true
+		}
+		if ok {
+			e.schedule.SQL = query
+			updated = append(updated, name)
+		}
+	}
+	sort.Strings(updated)
+	return updated, nil
+}
+
+// renameTable calls rename and, if it succeeds, updates the queries of the views reading the renamed table. The
+// table of a view is owned by the view and can't be renamed.
+func (vs *Views) renameTable(from, to string, rename func() error) ([]string, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name := range vs.entries {
+		if strings.EqualFold(name, from) || strings.EqualFold(name, to) {
+			return nil, fmt.Errorf("%w: %s is a materialized view", ErrTableInUse, name)
+		}
+	}
+	if err := rename(); err != nil {
+		return nil, err
+	}
+	var updated []string
+	for name, e := range vs.entries {
+		if query, ok := renameTableRefs(e.view.SQL, from, to); ok {
+			e.view.SQL = query
+			updated = append(updated, name)
+		}
+	}
+	sort.Strings(updated)
+	return updated, nil
+}
+
+// RenameRequest is the body of the table and column rename endpoints.
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// RenameTableResponse lists the server-side definitions that were updated to refer to the new name.
+type RenameTableResponse struct {
+	Table        string   `json:"table"`
+	SavedQueries []string `json:"saved_queries,omitempty"`
+	Schedules    []string `json:"schedules,omitempty"`
+	Views        []string `json:"views,omitempty"`
+}
+
+// HandleRenameTable renames the table in the path to the name in the body. The references to the table in saved
+// queries, schedules and materialized views are updated along with it while their definitions are locked.
+func (s *Server) HandleRenameTable(w http.ResponseWriter, r *http.Request) {
+	var req RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle rename table: decoding request body", err)
+		return
+	}
+	from := r.PathValue("table")
+	res := RenameTableResponse{Table: req.Name}
+	rename := func() error {
+		return s.store.RenameTable(r.Context(), from, req.Name)
+	}
+	if s.views != nil {
+		next := rename
+		rename = func() error {
+			var err error
+			res.Views, err = s.views.renameTable(from, req.Name, next)
+			return err
+		}
+	}
+	if s.scheduler != nil {
+		next := rename
+		rename = func() error {
+			var err error
+			res.Schedules, err = s.scheduler.renameTable(from, req.Name, next)
+			return err
+		}
+	}
+	var err error
+	res.SavedQueries, err = s.saved.renameTable(from, req.Name, rename)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle rename table", err)
+	case errors.Is(err, ErrTableExists), errors.Is(err, ErrTableInUse):
+		s.writeError(w, http.StatusConflict, "handle rename table", err)
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle rename table", err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle rename table: writing response", res)
+	}
+}
+
+// HandleRenameColumn renames the column in the path to the name in the body. Saved definitions referring to the
+// column are left as they are.
+func (s *Server) HandleRenameColumn(w http.ResponseWriter, r *http.Request) {
+	var req RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle rename column: decoding request body", err)
+		return
+	}
+	err := s.store.RenameColumn(r.Context(), r.PathValue("table"), r.PathValue("column"), req.Name)
+	switch {
+	case errors.Is(err, ErrTableNotFound), errors.Is(err, ErrColumnNotFound):
+		s.writeError(w, http.StatusNotFound, "handle rename column", err)
+	case errors.Is(err, ErrColumnExists):
+		s.writeError(w, http.StatusConflict, "handle rename column", err)
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle rename column", err)
+	default:
+		schema, schemaErr := s.store.TableSchema(r.Context(), r.PathValue("table"))
+		if schemaErr != nil {
+			s.writeError(w, http.StatusInternalServerError, "handle rename column", schemaErr)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, "handle rename column: writing response", schema)
+	}
+}
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationTable records the position of a follower in the change feed of its leader.
+const ReplicationTable = "_replication"
+
+var (
+	// ErrChangesPruned is returned when the changes after a position were pruned from the change feed.
+	ErrChangesPruned = errors.New("changes were pruned")
+	// ErrFollowerReadOnly is returned for writes to a follower.
+	ErrFollowerReadOnly = errors.New("follower is read-only, write to the leader")
+)
+
+// readRoutes are the patterns besides GET and HEAD that don't write replicated data. They are the only writes a
+// follower serves, see followerGuard, and require the query scope, see routeScope.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var readRoutes = map[string]bool{
+	"POST /query":                        true,
+	"POST /{$}":                          true,
+	"POST /graphql":                      true,
+	"POST /query/explain":                true,
+	"POST /queries":                      true,
+	"DELETE /queries/{id}":               true,
+	"POST /queries/saved/{name}":         true,
+	"POST /queries/history/{id}":         true,
+	"POST /downloads":                    true,
+	"DELETE /downloads/{id}":             true,
+	"DELETE /admin/queries/{id}":         true,
+	"POST /tables/{table}/export":        true,
+	"POST /tables/{table}/export/delta":  true,
+	"POST /sessions":                     true,
+	"DELETE /sessions/{id}":              true,
+	"POST /admin/backup":                 true,
+	"POST /admin/checkpoint":             true,
+	"POST /admin/views/{name}/refresh":   true,
+	"POST /admin/rollups/{name}/refresh": true,
+	"PUT /admin/log-level":               true,
+	"POST /admin/debug/pprof/symbol":     true,
+}
+
+// oldestChange returns the first sequence number still in the change feed, zero if it is empty.
+func (s *Store) oldestChange(ctx context.Context) (int64, error) {
+	cols, err := s.tableColumns(ctx, ChangesTable)
+	if err != nil || len(cols) == 0 {
+		return 0, err
+	}
+	var oldest sql.NullInt64
+	if err = s.db.QueryRowContext(ctx, "SELECT min(seq) FROM "+ChangesTable).Scan(&oldest); err != nil {
+		return 0, fmt.Errorf("reading oldest change: %w", err)
+	}
+	return oldest.Int64, nil
+}
+
+// replicationPosition returns the last change of the leader applied to the store, creating ReplicationTable on first
+// use.
+func (s *Store) replicationPosition(ctx context.Context) (int64, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER PRIMARY KEY,
+		position BIGINT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`, ReplicationTable)); err != nil {
+		return 0, fmt.Errorf("creating %s: %w", ReplicationTable, err)
+	}
+	var position int64
+	err := s.db.QueryRowContext(ctx, "SELECT position FROM "+ReplicationTable+" WHERE id = 1").Scan(&position)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("reading replication position: %w", err)
+	}
+	return position, nil
+}
+
+// applyChanges writes the changes of the leader and the new position in one transaction, so each change is applied
+// exactly once. Schema changes create the columns with the type of the leader before the rows that need them.
+func (s *Store) applyChanges(ctx context.Context, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("replication: beginning transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("replication: rolling back", "err", rollbackErr)
+		}
+	}()
+
+	for _, c := range changes {
+		if !tableNameRegex.MatchString(c.Table) {
+			return fmt.Errorf("replication: change %d: invalid table name %q", c.Seq, c.Table)
+		}
+		switch c.Kind {
+		case ChangeSchema:
+			if c.Schema == nil {
+				return fmt.Errorf("replication: change %d: missing schema", c.Seq)
+			}
+			col := quoteIdent(c.Schema.Column) + " " + c.Schema.Type
+			if _, err = tx.ExecContext(ctx, fmt.Sprintf(
+				"CREATE TABLE IF NOT EXISTS %s (%s); ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
+				quoteIdent(c.Table), col, quoteIdent(c.Table), col,
+			)); err != nil {
+				return fmt.Errorf("replication: change %d: creating column: %w", c.Seq, err)
+			}
+		case ChangeInsert:
+			query, values, queryErr := (&InsertStatement{Table: c.Table, Rows: c.Rows}).Query()
+			if queryErr != nil {
+				return fmt.Errorf("replication: change %d: %w", c.Seq, queryErr)
+			}
+			if _, err = tx.ExecContext(ctx, query, values...); err != nil {
+				return fmt.Errorf("replication: change %d: inserting rows: %w", c.Seq, s.memoryError(err))
+			}
+		default:
+			return fmt.Errorf("replication: change %d: unknown kind %q", c.Seq, c.Kind)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s VALUES (1, ?, ?)", ReplicationTable,
+	), changes[len(changes)-1].Seq, time.Now().UTC()); err != nil {
+		return fmt.Errorf("replication: recording position: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("replication: committing: %w", err)
+	}
+
+	for _, c := range changes {
+		if c.Kind == ChangeInsert {
+			s.tails.publish(c.Table, c.Rows)
+			s.written(c.Table)
+		}
+	}
+	return nil
+}
+
+// ReplicationStatus describes a follower.
+type ReplicationStatus struct {
+	Leader string `json:"leader"`
+	// Position is the sequence number of the last change of the leader applied.
+	Position int64 `json:"position"`
+	// Applied counts the changes applied since the server started.
+	Applied int64 `json:"applied"`
+	// LastChange is when the leader recorded the last change applied.
+	LastChange *time.Time `json:"last_change,omitempty"`
+	LastPoll   *time.Time `json:"last_poll,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// Follower replicates the inserts of a leader into the store by polling the change feed of the leader. The server
+// serves reads only, see Server.Handler. Only inserts through the API of the leader and the columns they create are
+// replicated, the leader's other writes such as deletes, DDL through SQL and imports are not.
+type Follower struct {
+	store    *Store
+	leader   *url.URL
+	key      string
+	interval time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+// NewFollower returns a follower of the leader at the base URL, polling it every interval once Run is called. It
+// resumes from the position recorded in the store. The key is an admin API key or token of the leader, empty if the
+// leader doesn't require one.
+func NewFollower(ctx context.Context, store *Store, leader, key string, interval time.Duration) (*Follower, error) {
+	u, err := url.Parse(strings.TrimSuffix(leader, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("replication: leader must be an http or https URL: %q", leader)
+	}
+	if interval <= 0 {
+		return nil, errors.New("replication: interval must be positive")
+	}
+	position, err := store.replicationPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Follower{
+		store:    store,
+		leader:   u,
+		key:      key,
+		interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+		status:   ReplicationStatus{Leader: u.Redacted(), Position: position},
+	}, nil
+}
+
+func (f *Follower) Status() ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Run polls the leader until the context is done. It reads the changes in batches until it has caught up and then waits
+// for the interval.
+func (f *Follower) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		wait := f.interval
+		n, err := f.poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("replication: polling leader", "leader", f.leader.Redacted(), "err", err)
+		}
+		if err == nil && n == maxChangeLimit {
+			wait = 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// poll applies the next batch of changes of the leader and returns their number.
+func (f *Follower) poll(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	position := f.status.Position
+	f.mu.Unlock()
+	changes, err := f.fetch(ctx, position)
+	if err == nil {
+		err = f.store.applyChanges(ctx, changes)
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.LastPoll = &now
+	if err != nil {
+		f.status.LastError = err.Error()
+		return 0, err
+	}
+	f.status.LastError = ""
+	if len(changes) > 0 {
+		last := changes[len(changes)-1]
+		f.status.Position, f.status.LastChange = last.Seq, &last.Time
+		f.status.Applied += int64(len(changes))
+	}
+	return len(changes), nil
+}
+
+func (f *Follower) fetch(ctx context.Context, since int64) ([]Change, error) {
+	u := *f.leader
+	u.Path += "/admin/replication/changes"
+	u.RawQuery = url.Values{
+		"since": {strconv.FormatInt(since, 10)},
+		"limit": {strconv.Itoa(maxChangeLimit)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("replication: %w", err)
+	}
+	if f.key != "" {
+		req.Header.Set("Authorization", "Bearer "+f.key)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("replication: %w", err)
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			slog.Error("replication: closing response", "err", closeErr)
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		var apiErr ErrorResponse
+		_ = json.NewDecoder(io.LimitReader(res.Body, 1<<10)).Decode(&apiErr)
+		return nil, fmt.Errorf("replication: leader responded %s: %s", res.Status, apiErr.Message)
+	}
+	var out ChangesResponse
+	dec := json.NewDecoder(res.Body)
+	dec.UseNumber()
+	if err = dec.Decode(&out); err != nil {
+		return nil, fmt.Errorf("replication: decoding changes: %w", err)
+	}
+	for _, c := range out.Changes {
+		if err = exactRows(c.Rows...); err != nil {
+			return nil, fmt.Errorf("replication: decoding changes: %w", err)
+		}
+	}
+	return out.Changes, nil
+}
+
+// WithFollower makes the server a read-only follower and exposes the replication status on the admin endpoints. The
+// caller runs the follower.
+func WithFollower(follower *Follower) ServerOption {
+	return func(s *Server) {
+		s.follower = follower
+	}
+}
+
+// followerGuard refuses the writes of other routes than readRoutes.
+func (s *Server) followerGuard(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if _, pattern := mux.Handler(r); pattern != "" && !readRoutes[pattern] {
+				s.writeError(w, http.StatusForbidden, "handle request", fmt.Errorf(
+					"%w at %s", ErrFollowerReadOnly, s.follower.leader.Redacted(),
+				))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleReplicationChanges lists the changes of all tables after the since parameter for followers. It responds with
+// 410 Gone when changes after since were pruned, the follower then has to be restored from a backup.
+func (s *Server) HandleReplicationChanges(w http.ResponseWriter, r *http.Request) {
+	since, limit, ok := s.changesParams(w, r)
+	if !ok {
+		return
+	}
+	oldest, err := s.store.oldestChange(r.Context())
+	if err == nil && oldest > since+1 {
+		err = fmt.Errorf("%w: the oldest change is %d", ErrChangesPruned, oldest)
+	}
+	var res *ChangesResponse
+	if err == nil {
+		res, err = s.store.Changes(r.Context(), "", since, limit)
+	}
+	switch {
+	case errors.Is(err, ErrChangeFeedDisabled):
+		s.writeError(w, http.StatusNotFound, "handle replication changes", err)
+	case errors.Is(err, ErrChangesPruned):
+		s.writeError(w, http.StatusGone, "handle replication changes", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle replication changes: writing response", res)
+	}
+}
+
+func (s *Server) HandleReplicationStatus(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle replication status: writing response", s.follower.Status())
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ResultLimits bound the results of the query endpoints. Zero disables a bound.
+type ResultLimits struct {
+	MaxRows  int `json:"max_rows" yaml:"max_rows"`
+	MaxBytes int `json:"max_bytes" yaml:"max_bytes"`
+}
+
+func DefaultResultLimits() ResultLimits {
+	return ResultLimits{
+		MaxRows:  100_000,
+		MaxBytes: 64 << 20,
+	}
+}
+
+var ErrResultTooLarge = errors.New("result too large")
+
+// override returns the limits with the non-zero fields of the override.
+func (l ResultLimits) override(o *ResultLimits) ResultLimits {
+	if o == nil {
+		return l
+	}
+	if o.MaxRows > 0 {
+		l.MaxRows = o.MaxRows
+	}
+	if o.MaxBytes > 0 {
+		l.MaxBytes = o.MaxBytes
+	}
+	return l
+}
+
+// requestResultLimits returns the result limits of the request: those of the server, overridden by those of the API
+// key it was authenticated with.
+func (s *Server) requestResultLimits(ctx context.Context) ResultLimits {
+	p, _ := requestPrincipal(ctx)
+	return s.resultLimits.override(p.ResultLimits)
+}
+
+// TruncatedHeader is set on responses whose result was cut to the result limits. Streamed results send it as a
+// trailer.
+const TruncatedHeader = "X-Truncated"
+
+// OverflowParam selects what happens when a result exceeds the limits: truncate, the default, returns the rows that
+// fit and marks the response truncated, error fails with 413.
+const OverflowParam = "overflow"
+
+const (
+	overflowTruncate = "truncate"
+	overflowError    = "error"
+)
+
+func parseOverflow(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get(OverflowParam); v {
+	case "", overflowTruncate:
+		return false, nil
+	case overflowError:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s: %s", OverflowParam, v)
+	}
+}
+
+// apply bounds the statement by the row limit. Paginated statements get their page size capped, so the cursor stays
+// consistent, the others stop reading after MaxRows.
+func (l ResultLimits) apply(stmt *QueryStatement) {
+	if l.MaxRows <= 0 {
+		return
+	}
+	if stmt.Limit > 0 || stmt.Cursor != "" {
+		stmt.Limit = min(stmt.Limit, l.MaxRows)
+		return
+	}
+	stmt.MaxRows = l.MaxRows
+}
+
+// errBoundReached is returned by boundedWriter once its limit is exceeded.
+var errBoundReached = errors.New("bound reached")
+
+type boundedWriter struct {
+	w    io.Writer
+	left int
+}
+
+func (b *boundedWriter) Write(p []byte) (int, error) {
+	if len(p) > b.left {
+		return 0, errBoundReached
+	}
+	b.left -= len(p)
+	return b.w.Write(p)
+}
+
+// encodeBounded encodes the result within MaxBytes. When it doesn't fit and failFast is unset, the rows are halved
+// until they do. A paginated statement continues after the rows kept, otherwise the result is marked truncated.
+func (l ResultLimits) encodeBounded(
+	format Format,
+	res *QueryResult,
+	stmt *QueryStatement,
+	opts encodeOptions,
+	failFast bool,
+) (*bytes.Buffer, *QueryResult, error) {
+	for {
+		var buf bytes.Buffer
+		var w io.Writer = &buf
+		if l.MaxBytes > 0 {
+			w = &boundedWriter{w: &buf, left: l.MaxBytes}
+		}
+		err := encodeResult(w, format, res, opts)
+		if !errors.Is(err, errBoundReached) {
+			return &buf, res, err
+		}
+		if failFast || len(res.Rows) == 0 {
+			return nil, nil, fmt.Errorf("%w: response exceeds %d bytes", ErrResultTooLarge, l.MaxBytes)
+		}
+
+		kept := *res
+		kept.Rows = res.Rows[:len(res.Rows)/2]
+		if stmt.Limit > 0 || stmt.Cursor != "" {
+			if kept.NextCursor, err = stmt.cursorAfter(len(kept.Rows)); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			kept.Truncated = true
+		}
+		res = &kept
+	}
+}
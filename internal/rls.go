@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// WithRowLevelSecurity isolates the tenants of API keys and tokens, see Principal.Tenant, by the column. Inserts with a
+// tenant set the column of every row to it, overwriting any value sent. Queries of a tenant read the tables that have
+// the column filtered to its rows. Requests of other keys and tokens can't read those tables, admins read all rows.
+// Tables and views derived from the tables, e.g. by WithViews or WithRollups, aren't filtered.
+func WithRowLevelSecurity(column string) StoreOption {
+	return func(s *Store) {
+		s.tenantColumn = column
+	}
+}
+
+// stampTenant returns the statement with the column of every row set to the tenant of the context, or the statement
+// itself without row-level security or a tenant.
+func (s *Store) stampTenant(ctx context.Context, stmt *InsertStatement) *InsertStatement {
+	tenant := requestTenant(ctx)
+	if s.tenantColumn == "" || tenant == "" {
+		return stmt
+	}
+	stamp := func(row map[string]any) map[string]any {
+		out := make(map[string]any, len(row)+1)
+		for k, v := range row {
+			// A differently cased key would be a second value for the column.
+			if !strings.EqualFold(k, s.tenantColumn) {
+				out[k] = v
+			}
+		}
+		out[s.tenantColumn] = tenant
+		return out
+	}
+	stamped := *stmt
+	if len(stmt.Rows) > 0 {
+		stamped.Rows = make([]map[string]any, len(stmt.Rows))
+		for i, row := range stmt.Rows {
+			stamped.Rows[i] = stamp(row)
+		}
+	} else {
+		stamped.Columns = stamp(stmt.Columns)
+	}
+	return &stamped
+}
+
+// tableGuard is how the queries of a principal read a table guarded by row-level security or column masks.
+type tableGuard struct {
+	// from is the qualified name of the table.
+	from string
+	// tenant is set for tables with the tenant column.
+	tenant bool
+	// masks are the REPLACE expressions of the masked columns.
+	masks []string
+}
+
+// tableGuards returns the guards of the tables by their lower cased name for the principal, which is neither an
+// admin nor without row-level security and masks.
+func (s *Store) tableGuards(ctx context.Context, p Principal) (map[string]*tableGuard, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT table_catalog, table_schema, table_name, column_name, data_type"+
+		" FROM information_schema.columns WHERE table_catalog IN "+ownCatalogs)
+	if err != nil {
+		return nil, fmt.Errorf("listing guarded tables: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := make(map[string]*tableGuard)
+	for rows.Next() {
+		var catalog, schema, table, column, dataType string
+		if err = rows.Scan(&catalog, &schema, &table, &column, &dataType); err != nil {
+			return nil, fmt.Errorf("listing guarded tables: %w", err)
+		}
+		tenant := s.tenantColumn != "" && strings.EqualFold(column, s.tenantColumn)
+		mode, masked := s.maskFor(p, table, column)
+		if !tenant && !masked {
+			continue
+		}
+		guard, ok := out[strings.ToLower(table)]
+		if !ok {
+			guard = &tableGuard{from: quoteIdent(catalog) + "." + quoteIdent(schema) + "." + quoteIdent(table)}
+			out[strings.ToLower(table)] = guard
+		}
+		guard.tenant = guard.tenant || tenant
+		if masked {
+			guard.masks = append(guard.masks, maskExpr(mode, column, dataType)+" AS "+quoteIdent(column))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing guarded tables: %w", err)
+	}
+	return out, nil
+}
+
+// guarded returns the principal of the context if row-level security or column masks apply to it.
+func (s *Store) guarded(ctx context.Context) (Principal, bool) {
+	p, ok := requestPrincipal(ctx)
+	return p, ok && (s.tenantColumn != "" || len(s.masks) > 0) && !slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+// tableRef returns the reference to the table in the queries of the principal of the context: its unqualified name
+// if the table is guarded, so secureQuery reads it through its guard, its qualified name otherwise.
+func (s *Store) tableRef(ctx context.Context, catalog, schema, table string) (string, error) {
+	qualified := quoteIdent(catalog) + "." + quoteIdent(schema) + "." + quoteIdent(table)
+	p, ok := s.guarded(ctx)
+	if !ok {
+		return qualified, nil
+	}
+	guards, err := s.tableGuards(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	if guards[strings.ToLower(table)] != nil {
+		return quoteIdent(table), nil
+	}
+	return qualified, nil
+}
+
+// guardedRoutes are the table routes that don't expose the rows of guarded tables.
+var guardedRoutes = []string{
+	"POST /data", "POST /data/preview", "GET /tables/{table}/schema", "GET /tables/{table}/schema/history",
+}
+
+// checkGuardedRoute refuses the requests of keys and tokens other than admins to the table route if the table is
+// guarded by row-level security or column masks, unless the route is one of guardedRoutes. Inserts into tables with
+// the tenant column need a tenant to stamp.
+func (s *Store) checkGuardedRoute(ctx context.Context, pattern, table string) error {
+	p, ok := s.guarded(ctx)
+	if !ok {
+		return nil
+	}
+	guards, err := s.tableGuards(ctx, p)
+	if err != nil {
+		return err
+	}
+	guard, ok := guards[strings.ToLower(table)]
+	if !ok {
+		return nil
+	}
+	inserts := pattern == "POST /data" || pattern == "POST /data/preview"
+	if slices.Contains(guardedRoutes, pattern) && (!inserts || !guard.tenant || p.Tenant != "") {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is guarded by row-level security or column masks, %s can't use %s on it",
+		ErrTableAccessDenied, table, p.Name, pattern)
+}
+
+// secureQuery rewrites each statement of the query that references a guarded table to read it through a common table
+// expression of the same name that filters it to the tenant of the context and masks its columns. Only SELECT, FROM,
+// VALUES and TABLE statements can reference such tables, and only by their unqualified name.
+func (s *Store) secureQuery(ctx context.Context, query string) (string, error) {
+	p, ok := s.guarded(ctx)
+	if !ok {
+		return query, nil
+	}
+	stmts, err := ClassifySQL(query)
+	if err != nil {
+		return "", err
+	}
+	guards, err := s.tableGuards(ctx, p)
+	if err != nil || len(guards) == 0 {
+		return query, err
+	}
+
+	out := make([]string, 0, len(stmts))
+	rewritten := false
+	for _, stmt := range stmts {
+		referenced := make(map[string]bool)
+		for i, t := range stmt.tokens {
+			name := strings.ToLower(t.text)
+			if (t.kind != sqlWord && t.kind != sqlQuotedIdent) || guards[name] == nil {
+				continue
+			}
+			if i > 0 && stmt.tokens[i-1].is(sqlPunct, ".") {
+				return "", fmt.Errorf("%w: %s is guarded and can only be referenced by its unqualified name",
+					ErrTableAccessDenied, t.text)
+			}
+			if guards[name].tenant && p.Tenant == "" {
+				return "", fmt.Errorf("%w: %s is row-level secured and %s has no tenant", ErrTableAccessDenied, t.text,
+					p.Name)
+			}
+			referenced[name] = true
+		}
+		if len(referenced) == 0 {
+			out = append(out, stmt.Text)
+			continue
+		}
+		switch stmt.Keyword {
+		case "SELECT", "FROM", "VALUES", "TABLE":
+		default:
+			return "", fmt.Errorf("%w: %s statements can't read guarded tables", ErrTableAccessDenied, stmt.Keyword)
+		}
+
+		names := make([]string, 0, len(referenced))
+		for name := range referenced {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ctes := make([]string, 0, len(names))
+		for _, name := range names {
+			guard := guards[name]
+			selected := "*"
+			if len(guard.masks) > 0 {
+				selected = "* REPLACE (" + strings.Join(guard.masks, ", ") + ")"
+			}
+			cte := fmt.Sprintf("%s AS (SELECT %s FROM %s", quoteIdent(name), selected, guard.from)
+			if guard.tenant {
+				cte += fmt.Sprintf(" WHERE %s = %s", quoteIdent(s.tenantColumn), quoteLiteral(p.Tenant))
+			}
+			ctes = append(ctes, cte+")")
+		}
+		// The expressions go first, so the statement's own can read them.
+		text := "WITH " + strings.Join(ctes, ", ") + " " + stmt.Text
+		if tokens := stmt.tokens; tokens[0].is(sqlWord, "WITH") {
+			rest := tokens[1]
+			prefix := "WITH "
+			if rest.is(sqlWord, "RECURSIVE") {
+				rest, prefix = tokens[2], "WITH RECURSIVE "
+			}
+			text = prefix + strings.Join(ctes, ", ") + ", " + query[rest.start:tokens[len(tokens)-1].end]
+		}
+		out = append(out, text)
+		rewritten = true
+	}
+	if !rewritten {
+		return query, nil
+	}
+	return strings.Join(out, ";\n"), nil
+}
@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRollupNotFound = errors.New("rollup not found")
+	ErrInvalidRollup  = errors.New("invalid rollup")
+)
+
+// rollupDelay is the least time between two refreshes of a rollup, inserts arriving in between are folded into the
+// next refresh.
+const rollupDelay = time.Second
+
+// Rollup is a table of aggregates of a source table per time bucket, e.g. the clicks per minute and kind, kept up to
+// date as rows are inserted into the source table. A refresh only recomputes the buckets from the watermark on, rows
+// inserted later with an older time are picked up by a full refresh.
+type Rollup struct {
+	Name string `json:"name"`
+	// Table is the source table.
+	Table string `json:"table"`
+	// TimeColumn is the date or timestamp column the rows are bucketed by, into the bucket column of the rollup.
+	TimeColumn string `json:"time_column"`
+	// Bucket is the width of the buckets in whole seconds, e.g. 1m, 1h or 24h.
+	Bucket  string   `json:"bucket"`
+	GroupBy []string `json:"group_by,omitempty"`
+	// Metrics are as on GET /tables/{table}/aggregate, e.g. count or avg(latency_ms). They default to count.
+	Metrics []string `json:"metrics,omitempty"`
+
+	// Watermark is the start of the latest bucket, the buckets before it are final.
+	Watermark   *time.Time `json:"watermark,omitempty"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	LastRows    int64      `json:"last_rows"`
+	RefreshMS   int64      `json:"refresh_ms"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Validate checks the names and returns the bucket width.
+func (r *Rollup) Validate() (time.Duration, error) {
+	if !tableNameRegex.MatchString(r.Name) {
+		return 0, fmt.Errorf("%w: name must match %s", ErrInvalidRollup, tableNameRegex)
+	}
+	if !tableNameRegex.MatchString(r.Table) || strings.EqualFold(r.Table, r.Name) {
+		return 0, fmt.Errorf("%w: table must match %s and differ from the name", ErrInvalidRollup, tableNameRegex)
+	}
+	if r.TimeColumn == "" {
+		return 0, fmt.Errorf("%w: missing time column", ErrInvalidRollup)
+	}
+	bucket, err := time.ParseDuration(r.Bucket)
+	if err != nil {
+		return 0, fmt.Errorf("%w: parsing bucket: %w", ErrInvalidRollup, err)
+	}
+	if bucket < time.Second || bucket%time.Second != 0 {
+		return 0, fmt.Errorf("%w: bucket must be whole seconds", ErrInvalidRollup)
+	}
+	return bucket, nil
+}
+
+// rollupQuery builds the aggregation of the source table into the buckets of the rollup, of the rows from the
+// watermark on when it is set.
+func (s *Store) rollupQuery(ctx context.Context, r *Rollup, bucket time.Duration, watermark *time.Time) (
+	string, []any, error,
+) {
+	cols, err := s.existingColumns(ctx, r.Table)
+	if err != nil {
+		return "", nil, err
+	}
+	timeColumn, err := column(cols, r.TimeColumn)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: time column: %w", ErrInvalidRollup, err)
+	}
+	ts := timestampExpr(timeColumn)
+	exprs := []string{fmt.Sprintf("time_bucket(INTERVAL '%d seconds', %s) AS bucket", int64(bucket.Seconds()), ts)}
+	for _, name := range r.GroupBy {
+		col, colErr := column(cols, name)
+		if colErr != nil {
+			return "", nil, fmt.Errorf("%w: group by: %w", ErrInvalidRollup, colErr)
+		}
+		exprs = append(exprs, col)
+	}
+	metrics := r.Metrics
+	if len(metrics) == 0 {
+		metrics = []string{"count"}
+	}
+	for _, metric := range metrics {
+		expr, metricErr := metricExpr(cols, metric)
+		if metricErr != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrInvalidRollup, metricErr)
+		}
+		exprs = append(exprs, expr)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NOT NULL", strings.Join(exprs, ", "), quoteIdent(r.Table), ts)
+	var params []any
+	if watermark != nil {
+		query += fmt.Sprintf(" AND %s >= ?", ts)
+		params = append(params, *watermark)
+	}
+	return query + " GROUP BY ALL", params, nil
+}
+
+// refreshRollup recomputes the buckets of the rollup from the watermark on, or the whole table without one, and returns
+// the new watermark and the number of rows written. The buckets from the watermark on are replaced in a transaction,
+// so readers never see them missing.
+func (s *Store) refreshRollup(ctx context.Context, r *Rollup, bucket time.Duration, watermark *time.Time) (
+	*time.Time, int64, error,
+) {
+	query, params, err := s.rollupQuery(ctx, r, bucket, watermark)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+
+	var rows int64
+	if watermark == nil {
+		if _, err = s.db.ExecContext(
+			ctx, fmt.Sprintf("CREATE OR REPLACE TABLE %s AS %s", quoteIdent(r.Name), query), params...,
+		); err != nil {
+			return nil, 0, fmt.Errorf("rollup: creating table: %w", s.memoryError(err))
+		}
+		if err = s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteIdent(r.Name)).Scan(&rows); err != nil {
+			return nil, 0, fmt.Errorf("rollup: counting rows: %w", err)
+		}
+	} else {
+		if rows, err = s.replaceBuckets(ctx, r.Name, query, params, *watermark); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var latest sql.NullTime
+	if err = s.db.QueryRowContext(ctx, "SELECT max(bucket) FROM "+quoteIdent(r.Name)).Scan(&latest); err != nil {
+		return nil, 0, fmt.Errorf("rollup: reading watermark: %w", err)
+	}
+	if !latest.Valid {
+		return watermark, rows, nil
+	}
+	next := latest.Time.UTC()
+	return &next, rows, nil
+}
+
+// replaceBuckets deletes the buckets of the rollup table from the watermark on and inserts them from the query.
+func (s *Store) replaceBuckets(ctx context.Context, table, query string, params []any, watermark time.Time) (
+	int64, error,
+) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("rollup: beginning transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rollup: rolling back", "err", rollbackErr)
+		}
+	}()
+	if _, err = tx.ExecContext(
+		ctx, fmt.Sprintf("DELETE FROM %s WHERE bucket >= ?", quoteIdent(table)), watermark,
+	); err != nil {
+		return 0, fmt.Errorf("rollup: deleting buckets: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s BY NAME %s", quoteIdent(table), query), params...)
+	if err != nil {
+		return 0, fmt.Errorf("rollup: inserting buckets: %w", s.memoryError(err))
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("rollup: counting rows: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("rollup: committing: %w", err)
+	}
+	return rows, nil
+}
+
+type rollupEntry struct {
+	rollup     Rollup
+	bucket     time.Duration
+	refreshing sync.Mutex
+	// dirty is set when rows were written to the source table since the last refresh.
+	dirty bool
+	// deleted stops refreshes that were started before the rollup was deleted from recreating its table.
+	deleted bool
+}
+
+// Rollups manages the rollups of a store and refreshes those whose source table was written to once Run is called.
+type Rollups struct {
+	store   *Store
+	timeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*rollupEntry
+	wake    chan struct{}
+}
+
+// NewRollups returns a rollup manager whose refreshes are bound by timeout, zero for no bound. It is notified of the
+// inserts and imports of the store, so it must be created before the store is written to concurrently.
+func NewRollups(store *Store, timeout time.Duration) *Rollups {
+	rs := &Rollups{
+		store:   store,
+		timeout: timeout,
+		entries: make(map[string]*rollupEntry),
+		wake:    make(chan struct{}, 1),
+	}
+	store.onWrite(rs.written)
+	return rs
+}
+
+// Put creates or redefines a rollup and computes it in full before returning. A rollup can't take over an existing
+// table.
+func (rs *Rollups) Put(ctx context.Context, r Rollup) (Rollup, bool, error) {
+	bucket, err := r.Validate()
+	if err != nil {
+		return Rollup{}, false, err
+	}
+	rs.mu.Lock()
+	_, exists := rs.entries[r.Name]
+	rs.mu.Unlock()
+	if !exists {
+		cols, colsErr := rs.store.tableColumns(ctx, r.Name)
+		if colsErr != nil {
+			return Rollup{}, false, colsErr
+		}
+		if len(cols) > 0 {
+			return Rollup{}, false, fmt.Errorf("%w: %s", ErrTableExists, r.Name)
+		}
+	}
+
+	e := &rollupEntry{rollup: r, bucket: bucket}
+	e.rollup.Watermark, e.rollup.LastRefresh, e.rollup.LastRows, e.rollup.RefreshMS, e.rollup.LastError =
+		nil, nil, 0, 0, ""
+	if err = rs.refresh(ctx, e, true); err != nil {
+		return Rollup{}, false, err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if old, ok := rs.entries[r.Name]; ok {
+		old.deleted = true
+	}
+	rs.entries[r.Name] = e
+	return e.rollup, !exists, nil
+}
+
+func (rs *Rollups) Get(name string) (Rollup, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	e, ok := rs.entries[name]
+	if !ok {
+		return Rollup{}, fmt.Errorf("%w: %s", ErrRollupNotFound, name)
+	}
+	return e.rollup, nil
+}
+
+func (rs *Rollups) List() []Rollup {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	out := make([]Rollup, 0, len(rs.entries))
+	for _, e := range rs.entries {
+		out = append(out, e.rollup)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete drops the rollup and its table.
+func (rs *Rollups) Delete(ctx context.Context, name string) error {
+	rs.mu.Lock()
+	e, ok := rs.entries[name]
+	if ok {
+		e.deleted = true
+		delete(rs.entries, name)
+	}
+	rs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRollupNotFound, name)
+	}
+	e.refreshing.Lock()
+	defer e.refreshing.Unlock()
+	return rs.store.DropTable(ctx, name)
+}
+
+// Refresh recomputes the rollup from its watermark on now, or in full, and returns its state.
+func (rs *Rollups) Refresh(ctx context.Context, name string, full bool) (Rollup, error) {
+	rs.mu.Lock()
+	e, ok := rs.entries[name]
+	rs.mu.Unlock()
+	if !ok {
+		return Rollup{}, fmt.Errorf("%w: %s", ErrRollupNotFound, name)
+	}
+	err := rs.refresh(ctx, e, full)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return e.rollup, err
+}
+
+// refresh recomputes the rollup. Refreshes of the same rollup are serialized, a failed refresh keeps the table and
+// the watermark.
+func (rs *Rollups) refresh(ctx context.Context, e *rollupEntry, full bool) error {
+	e.refreshing.Lock()
+	defer e.refreshing.Unlock()
+	if rs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rs.timeout)
+		defer cancel()
+	}
+
+	rs.mu.Lock()
+	r, deleted := e.rollup, e.deleted
+	e.dirty = false
+	rs.mu.Unlock()
+	if deleted {
+		return fmt.Errorf("%w: %s", ErrRollupNotFound, r.Name)
+	}
+	watermark := r.Watermark
+	if full {
+		watermark = nil
+	}
+	start := time.Now()
+	next, rows, err := rs.store.refreshRollup(ctx, &r, e.bucket, watermark)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	e.rollup.LastRefresh = &start
+	e.rollup.RefreshMS = time.Since(start).Milliseconds()
+	e.rollup.LastError = ""
+	if err != nil {
+		e.rollup.LastError = err.Error()
+		return err
+	}
+	e.rollup.LastRows, e.rollup.Watermark = rows, next
+	return nil
+}
+
+// written marks the rollups of the table for a refresh. The store calls it with its write lock held.
+func (rs *Rollups) written(table string) {
+	rs.mu.Lock()
+	marked := false
+	for _, e := range rs.entries {
+		if strings.EqualFold(e.rollup.Table, table) {
+			e.dirty = true
+			marked = true
+		}
+	}
+	rs.mu.Unlock()
+	if marked {
+		select {
+		case rs.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run refreshes the rollups whose source table was written to until ctx is done, each at most once per rollupDelay.
+func (rs *Rollups) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rs.wake:
+		}
+		rs.mu.Lock()
+		var dirty []*rollupEntry
+		for _, e := range rs.entries {
+			if e.dirty {
+				dirty = append(dirty, e)
+			}
+		}
+		rs.mu.Unlock()
+		for _, e := range dirty {
+			if err := rs.refresh(ctx, e, false); err != nil && !errors.Is(err, ErrRollupNotFound) {
+				slog.Error("rollups: refreshing rollup", "name", e.rollup.Name, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rollupDelay):
+		}
+	}
+}
+
+func (s *Server) HandleListRollups(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list rollups: writing response", s.rollups.List())
+}
+
+// HandlePutRollup creates or redefines the rollup named in the path and computes it.
+func (s *Server) HandlePutRollup(w http.ResponseWriter, r *http.Request) {
+	var rollup Rollup
+	if err := json.NewDecoder(r.Body).Decode(&rollup); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put rollup: decoding request body", err)
+		return
+	}
+	rollup.Name = r.PathValue("name")
+	rollup, created, err := s.rollups.Put(r.Context(), rollup)
+	switch {
+	case errors.Is(err, ErrInvalidRollup):
+		s.writeError(w, http.StatusBadRequest, "handle put rollup", err)
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusUnprocessableEntity, "handle put rollup", err)
+	case errors.Is(err, ErrTableExists):
+		s.writeError(w, http.StatusConflict, "handle put rollup", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	case created:
+		s.writeJSON(w, http.StatusCreated, "handle put rollup: writing response", rollup)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle put rollup: writing response", rollup)
+	}
+}
+
+func (s *Server) HandleGetRollup(w http.ResponseWriter, r *http.Request) {
+	rollup, err := s.rollups.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get rollup", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get rollup: writing response", rollup)
+}
+
+func (s *Server) HandleDeleteRollup(w http.ResponseWriter, r *http.Request) {
+	err := s.rollups.Delete(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrRollupNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete rollup", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete rollup", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRefreshRollup refreshes the rollup named in the path from its watermark on, or in full with full=true to pick
+// up rows inserted late, and responds with its state.
+func (s *Server) HandleRefreshRollup(w http.ResponseWriter, r *http.Request) {
+	full := false
+	if v := r.URL.Query().Get("full"); v != "" {
+		var err error
+		if full, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle refresh rollup: parsing full", err)
+			return
+		}
+	}
+	rollup, err := s.rollups.Refresh(r.Context(), r.PathValue("name"), full)
+	switch {
+	case errors.Is(err, ErrRollupNotFound):
+		s.writeError(w, http.StatusNotFound, "handle refresh rollup", err)
+	case errors.Is(err, ErrInvalidRollup):
+		s.writeError(w, http.StatusBadRequest, "handle refresh rollup", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle refresh rollup: writing response", rollup)
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrSavedQueryNotFound = errors.New("saved query not found")
+	ErrInvalidSavedQuery  = errors.New("invalid saved query")
+)
+
+var savedQueryNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// SavedQuery is a named read-only query. Params names the positional placeholders $1, $2, ... of SQL in order, so
+// callers bind them by name when running the query.
+type SavedQuery struct {
+	Name        string   `json:"name"`
+	SQL         string   `json:"sql"`
+	Params      []string `json:"params,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// Validate checks the name and parameters and that the SQL is a read-only statement.
+func (q *SavedQuery) Validate() error {
+	if !savedQueryNameRegex.MatchString(q.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidSavedQuery, savedQueryNameRegex)
+	}
+	seen := make(map[string]bool, len(q.Params))
+	for _, p := range q.Params {
+		if p == "" || seen[p] {
+			return fmt.Errorf("%w: parameter names must be unique and not empty", ErrInvalidSavedQuery)
+		}
+		seen[p] = true
+	}
+	return CheckReadOnly(q.SQL)
+}
+
+// bind orders the named parameters by their position in the query.
+func (q *SavedQuery) bind(params map[string]any) ([]any, error) {
+	out := make([]any, len(q.Params))
+	for i, name := range q.Params {
+		v, ok := params[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing parameter %s", ErrInvalidSavedQuery, name)
+		}
+		out[i] = v
+	}
+	if len(params) > len(q.Params) {
+		for name := range params {
+			if !q.hasParam(name) {
+				return nil, fmt.Errorf("%w: unknown parameter %s", ErrInvalidSavedQuery, name)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (q *SavedQuery) hasParam(name string) bool {
+	for _, p := range q.Params {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+type savedQueries struct {
+	mu     sync.RWMutex
+	byName map[string]SavedQuery
+}
+
+func newSavedQueries() *savedQueries {
+	return &savedQueries{byName: make(map[string]SavedQuery)}
+}
+
+// put stores the query and reports whether it is new.
+func (sq *savedQueries) put(q SavedQuery) bool {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	_, exists := sq.byName[q.Name]
+	sq.byName[q.Name] = q
+	return !exists
+}
+
+func (sq *savedQueries) get(name string) (SavedQuery, error) {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	q, ok := sq.byName[name]
+	if !ok {
+		return SavedQuery{}, fmt.Errorf("%w: %s", ErrSavedQueryNotFound, name)
+	}
+	return q, nil
+}
+
+func (sq *savedQueries) delete(name string) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if _, ok := sq.byName[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrSavedQueryNotFound, name)
+	}
+	delete(sq.byName, name)
+	return nil
+}
+
+func (sq *savedQueries) list() []SavedQuery {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+	out := make([]SavedQuery, 0, len(sq.byName))
+	for _, q := range sq.byName {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (s *Server) HandleListSavedQueries(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list saved queries: writing response", s.saved.list())
+}
+
+// HandlePutSavedQuery creates or replaces the saved query named in the path.
+func (s *Server) HandlePutSavedQuery(w http.ResponseWriter, r *http.Request) {
+	var q SavedQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put saved query: decoding request body", err)
+		return
+	}
+	q.Name = r.PathValue("name")
+	if err := q.Validate(); err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	code := http.StatusOK
+	if s.saved.put(q) {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put saved query: writing response", q)
+}
+
+func (s *Server) HandleGetSavedQuery(w http.ResponseWriter, r *http.Request) {
+	q, err := s.saved.get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get saved query", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get saved query: writing response", q)
+}
+
+func (s *Server) HandleDeleteSavedQuery(w http.ResponseWriter, r *http.Request) {
+	if err := s.saved.delete(r.PathValue("name")); err != nil {
+		s.writeError(w, http.StatusNotFound, "handle delete saved query", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunSavedQueryRequest is the body of POST /queries/saved/{name}. Params are bound by name.
+type RunSavedQueryRequest struct {
+	Params map[string]any `json:"params"`
+	Limit  int            `json:"limit"`
+	Cursor string         `json:"cursor"`
+}
+
+// HandleRunSavedQuery runs the saved query named in the path. The response is negotiated like on the query endpoints.
+func (s *Server) HandleRunSavedQuery(w http.ResponseWriter, r *http.Request) {
+	q, err := s.saved.get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle run saved query", err)
+		return
+	}
+	var req RunSavedQueryRequest
+	if r.ContentLength != 0 {
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle run saved query: decoding request body", err)
+			return
+		}
+	}
+	params, err := q.bind(req.Params)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle run saved query: binding parameters", err)
+		return
+	}
+	s.writeQuery(w, r, &QueryStatement{
+		Query:  q.SQL,
+		Params: params,
+		Limit:  req.Limit,
+		Cursor: req.Cursor,
+	})
+}
+
+// handleQueriesSubresource serves GET /queries/{id}/{sub}. The saved query and job result routes overlap on
+// /queries/saved/results, which the mux refuses to register separately.
+func (s *Server) handleQueriesSubresource(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.PathValue("id") == "saved":
+		r.SetPathValue("name", r.PathValue("sub"))
+		s.HandleGetSavedQuery(w, r)
+	case r.PathValue("sub") == "results":
+		s.HandleJobResults(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WriteMode is how a scheduled query writes its result to the destination table.
+type WriteMode string
+
+const (
+	WriteAppend  WriteMode = "append"
+	WriteReplace WriteMode = "replace"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleRunning  = errors.New("schedule is running")
+)
+
+var tableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Materialize writes the result of the single read statement of the query into table. Replace recreates the table
+// from the result, append creates it on first use and inserts the result by column name.
+func (s *Store) Materialize(ctx context.Context, stmt *QueryStatement, table string, mode WriteMode) (int64, error) {
+	if !tableNameRegex.MatchString(table) {
+		return 0, fmt.Errorf("materialize: invalid table name %q", table)
+	}
+	query, err := stmt.singleRead()
+	if err != nil {
+		return 0, err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+
+	switch mode {
+	case WriteReplace:
+		if _, err = s.db.ExecContext(
+			ctx, fmt.Sprintf("CREATE OR REPLACE TABLE %s AS\n%s", table, query), stmt.Params...,
+		); err != nil {
+			return 0, fmt.Errorf("materialize: replacing table: %w", err)
+		}
+		var count int64
+		if err = s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&count); err != nil {
+			return 0, fmt.Errorf("materialize: counting rows: %w", err)
+		}
+		return count, nil
+	case WriteAppend:
+		create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS SELECT * FROM (\n%s\n) LIMIT 0", table, query)
+		if _, err = s.db.ExecContext(ctx, create, stmt.Params...); err != nil {
+			return 0, fmt.Errorf("materialize: creating table: %w", err)
+		}
+		res, execErr := s.db.ExecContext(
+			ctx, fmt.Sprintf("INSERT INTO %s BY NAME SELECT * FROM (\n%s\n)", table, query), stmt.Params...,
+		)
+		if execErr != nil {
+			return 0, fmt.Errorf("materialize: appending rows: %w", execErr)
+		}
+		return res.RowsAffected()
+	default:
+		return 0, fmt.Errorf("materialize: invalid mode %q", mode)
+	}
+}
+
+// Schedule runs SQL on a cron expression and writes the result to Table. With Export set, it exports the rows added
+// to Table since the previous run instead.
+type Schedule struct {
+	Name     string           `json:"name"`
+	Cron     string           `json:"cron"`
+	SQL      string           `json:"sql,omitempty"`
+	Params   []any            `json:"params,omitempty"`
+	Table    string           `json:"table"`
+	Mode     WriteMode        `json:"mode,omitempty"`
+	Export   *ScheduledExport `json:"export,omitempty"`
+	Disabled bool             `json:"disabled,omitempty"`
+
+	NextRun   *time.Time `json:"next_run,omitempty"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastRows  int64      `json:"last_rows"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// Validate parses the cron expression and checks the query, destination and mode.
+func (sch *Schedule) Validate() (*CronSchedule, error) {
+	if !savedQueryNameRegex.MatchString(sch.Name) {
+		return nil, fmt.Errorf("invalid schedule: name must match %s", savedQueryNameRegex)
+	}
+	if !tableNameRegex.MatchString(sch.Table) {
+		return nil, fmt.Errorf("invalid schedule: table must match %s", tableNameRegex)
+	}
+	if sch.Export != nil {
+		if sch.SQL != "" {
+			return nil, errors.New("invalid schedule: an export takes no sql")
+		}
+		if err := sch.Export.Validate(); err != nil {
+			return nil, err
+		}
+		return ParseCron(sch.Cron)
+	}
+	if sch.Mode == "" {
+		sch.Mode = WriteAppend
+	}
+	if sch.Mode != WriteAppend && sch.Mode != WriteReplace {
+		return nil, fmt.Errorf("invalid schedule: mode must be %s or %s", WriteAppend, WriteReplace)
+	}
+	if _, err := (&QueryStatement{Query: sch.SQL}).singleRead(); err != nil {
+		return nil, err
+	}
+	return ParseCron(sch.Cron)
+}
+
+type scheduleEntry struct {
+	schedule Schedule
+	cron     *CronSchedule
+	running  bool
+}
+
+// Scheduler runs the registered schedules in UTC once Run is called.
+type Scheduler struct {
+	store   *Store
+	timeout time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+	wake    chan struct{}
+}
+
+// NewScheduler returns a scheduler whose runs are bound by timeout, zero for no bound.
+func NewScheduler(store *Store, timeout time.Duration) *Scheduler {
+	return &Scheduler{
+		store:   store,
+		timeout: timeout,
+		now:     func() time.Time { return time.Now().UTC() },
+		entries: make(map[string]*scheduleEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Put registers or replaces a schedule and reports whether it is new.
+func (sc *Scheduler) Put(sch Schedule) (bool, error) {
+	cron, err := sch.Validate()
+	if err != nil {
+		return false, err
+	}
+	sch.NextRun, sch.LastRun, sch.LastRows, sch.LastError = nil, nil, 0, ""
+	if sch.Export != nil {
+		export := *sch.Export
+		export.LastFiles = nil
+		sch.Export = &export
+	}
+	if next := cron.Next(sc.now()); !sch.Disabled && !next.IsZero() {
+		sch.NextRun = &next
+	}
+
+	sc.mu.Lock()
+	_, exists := sc.entries[sch.Name]
+	sc.entries[sch.Name] = &scheduleEntry{schedule: sch, cron: cron}
+	sc.mu.Unlock()
+	sc.notify()
+	return !exists, nil
+}
+
+func (sc *Scheduler) Get(name string) (Schedule, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[name]
+	if !ok {
+		return Schedule{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	return e.schedule, nil
+}
+
+func (sc *Scheduler) Delete(name string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.entries[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	delete(sc.entries, name)
+	return nil
+}
+
+func (sc *Scheduler) List() []Schedule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	out := make([]Schedule, 0, len(sc.entries))
+	for _, e := range sc.entries {
+		out = append(out, e.schedule)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (sc *Scheduler) notify() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the due schedules until ctx is done. A schedule that is still running when it comes due again is
+// skipped for that run.
+func (sc *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.wake:
+		case <-timer.C:
+		}
+		next := sc.startDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// startDue starts the schedules that are due and returns the time until the next one.
+func (sc *Scheduler) startDue(ctx context.Context) time.Duration {
+	now := sc.now()
+	wait := time.Minute
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for name, e := range sc.entries {
+		if e.schedule.NextRun == nil {
+			continue
+		}
+		if !e.schedule.NextRun.After(now) {
+			next := e.cron.Next(now)
+			e.schedule.NextRun = &next
+			if next.IsZero() {
+				e.schedule.NextRun = nil
+			}
+			if !e.running {
+				e.running = true
+				go sc.run(ctx, name, e.schedule)
+			}
+		}
+		if e.schedule.NextRun != nil {
+			wait = min(wait, e.schedule.NextRun.Sub(now))
+		}
+	}
+	return wait
+}
+
+// RunNow runs the schedule immediately and waits for it to finish.
+func (sc *Scheduler) RunNow(ctx context.Context, name string) (Schedule, error) {
+	sc.mu.Lock()
+	e, ok := sc.entries[name]
+	if !ok {
+		sc.mu.Unlock()
+		return Schedule{}, fmt.Errorf("%w: %s", ErrScheduleNotFound, name)
+	}
+	if e.running {
+		sc.mu.Unlock()
+		return Schedule{}, fmt.Errorf("%w: %s", ErrScheduleRunning, name)
+	}
+	e.running = true
+	sch := e.schedule
+	sc.mu.Unlock()
+	sc.run(ctx, name, sch)
+	return sc.Get(name)
+}
+
+func (sc *Scheduler) run(ctx context.Context, name string, sch Schedule) {
+	if sc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sc.timeout)
+		defer cancel()
+	}
+	started := sc.now()
+	var (
+		rows     int64
+		err      error
+		manifest *ExportManifest
+		mark     any
+	)
+	if sch.Export != nil {
+		manifest, mark, err = sc.store.ExportSince(ctx, sch.Table, *sch.Export)
+		if manifest != nil {
+			rows = manifest.Rows
+		}
+	} else {
+		rows, err = sc.store.Materialize(ctx, &QueryStatement{Query: sch.SQL, Params: sch.Params}, sch.Table, sch.Mode)
+	}
+	if err != nil {
+		slog.Error("scheduler: running schedule", "name", name, "err", err)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[name]
+	if !ok {
+		return
+	}
+	e.running = false
+	e.schedule.LastRun = &started
+	e.schedule.LastRows = rows
+	e.schedule.LastError = ""
+	if err != nil {
+		e.schedule.LastError = err.Error()
+	}
+	if e.schedule.Export != nil && err == nil {
+		// Schedules returned before share the export, it is replaced rather than modified.
+		export := *e.schedule.Export
+		export.HighWaterMark = mark
+		export.LastFiles = manifest.Files
+		e.schedule.Export = &export
+	}
+}
+
+func (s *Server) HandleListSchedules(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list schedules: writing response", s.scheduler.List())
+}
+
+// HandlePutSchedule creates or replaces the schedule named in the path.
+func (s *Server) HandlePutSchedule(w http.ResponseWriter, r *http.Request) {
+	var sch Schedule
+	if err := json.NewDecoder(r.Body).Decode(&sch); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put schedule: decoding request body", err)
+		return
+	}
+	sch.Name = r.PathValue("name")
+	created, err := s.scheduler.Put(sch)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put schedule", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	sch, err = s.scheduler.Get(sch.Name)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle put schedule", err)
+		return
+	}
+	s.writeJSON(w, code, "handle put schedule: writing response", sch)
+}
+
+func (s *Server) HandleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	sch, err := s.scheduler.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get schedule", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get schedule: writing response", sch)
+}
+
+func (s *Server) HandleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if err := s.scheduler.Delete(r.PathValue("name")); err != nil {
+		s.writeError(w, http.StatusNotFound, "handle delete schedule", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRunSchedule runs the schedule named in the path outside of its cron expression and responds with its state.
+func (s *Server) HandleRunSchedule(w http.ResponseWriter, r *http.Request) {
+	sch, err := s.scheduler.RunNow(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrScheduleRunning) {
+		s.writeError(w, http.StatusConflict, "handle run schedule", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle run schedule", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle run schedule: writing response", sch)
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ColumnInfo describes a column as listed by GET /tables/{table}/schema.
+type ColumnInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	// Default is the expression stored for rows lacking the column, unset if there is none.
+	Default *string `json:"default,omitempty"`
+	// Generated is the expression computing the column as declared in the table configuration. DuckDB doesn't list
+	// generated columns apart from defaults.
+	Generated string `json:"generated,omitempty"`
+	// AddedAt is when ingestion created the column. It is unset for columns created through SQL and for columns
+	// created before the server started, DuckDB doesn't record it.
+	AddedAt *time.Time `json:"added_at,omitempty"`
+}
+
+type TableSchema struct {
+	Table string `json:"table"`
+	// Version is the version of the last migration applied to the table, zero if none was.
+	Version int          `json:"version"`
+	Columns []ColumnInfo `json:"columns"`
+}
+
+// SchemaChangeKind is the DDL the store performed on ingestion.
+type SchemaChangeKind string
+
+const (
+	SchemaCreateTable SchemaChangeKind = "create_table"
+	SchemaAddColumn   SchemaChangeKind = "add_column"
+)
+
+// SchemaChange records a column the store created because an insert carried it, either along with its table or
+// added to an existing one.
+type SchemaChange struct {
+	Kind   SchemaChangeKind `json:"kind"`
+	Table  string           `json:"table"`
+	Column string           `json:"column"`
+	// Type is the type declared in the table configuration or else inferred from the value of the column.
+	Type      string    `json:"type"`
+	RequestID string    `json:"request_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// SchemaEventKind is what a SchemaEvent reports.
+type SchemaEventKind string
+
+const (
+	SchemaEventTableCreated SchemaEventKind = "table_created"
+	SchemaEventColumnsAdded SchemaEventKind = "columns_added"
+	// SchemaEventTypeConflict reports an insert refused because a value doesn't convert to the type of its column.
+	SchemaEventTypeConflict SchemaEventKind = "type_conflict"
+)
+
+// SchemaEvent is a schema change made by an insert or a type conflict that refused one, as sent to webhooks.
+type SchemaEvent struct {
+	// ID identifies the event across the retries of its delivery.
+	ID    string          `json:"id"`
+	Kind  SchemaEventKind `json:"kind"`
+	Table string          `json:"table"`
+	// Columns are the columns created by the table_created and columns_added events.
+	Columns []SchemaChange `json:"columns,omitempty"`
+	// Error is the error of the insert refused by a type_conflict event.
+	Error     string    `json:"error,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// columnHistory records when ingestion created tables and columns, keyed by lower cased table and column name.
+type columnHistory struct {
+	mu      sync.Mutex
+	byTable map[string]map[string]time.Time
+	// changes holds the schema changes of each table in the order they were made. It survives the table being
+	// dropped and created again.
+	changes map[string][]SchemaChange
+}
+
+func newColumnHistory() columnHistory {
+	return columnHistory{
+		byTable: make(map[string]map[string]time.Time),
+		changes: make(map[string][]SchemaChange),
+	}
+}
+
+// created forgets the columns recorded for an earlier table of the same name and records the columns of the new one.
+func (h *columnHistory) created(table string, changes []SchemaChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	added := make(map[string]time.Time, len(changes))
+	for _, c := range changes {
+		added[strings.ToLower(c.Column)] = c.At
+	}
+	h.byTable[strings.ToLower(table)] = added
+	h.changes[strings.ToLower(table)] = append(h.changes[strings.ToLower(table)], changes...)
+}
+
+func (h *columnHistory) added(change SchemaChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	table := strings.ToLower(change.Table)
+	added, ok := h.byTable[table]
+	if !ok {
+		added = make(map[string]time.Time)
+		h.byTable[table] = added
+	}
+	added[strings.ToLower(change.Column)] = change.At
+	h.changes[table] = append(h.changes[table], change)
+}
+
+func (h *columnHistory) history(table string) []SchemaChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]SchemaChange{}, h.changes[strings.ToLower(table)]...)
+}
+
+func (h *columnHistory) addedAt(table, column string) *time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	at, ok := h.byTable[strings.ToLower(table)][strings.ToLower(column)]
+	if !ok {
+		return nil
+	}
+	return &at
+}
+
+func (h *columnHistory) dropped(table, column string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.byTable[strings.ToLower(table)], strings.ToLower(column))
+}
+
+// DropColumn removes the column and its data from the table. DuckDB refuses to drop the last column of a table and
+// columns other columns depend on.
+func (s *Store) DropColumn(ctx context.Context, table, column string) error {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+	if !cols[strings.ToLower(column)] {
+		return fmt.Errorf("%w: %s.%s", ErrColumnNotFound, table, column)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err = s.db.ExecContext(
+		ctx, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdent(table), quoteIdent(column)),
+	); err != nil {
+		return fmt.Errorf("drop column: %w", err)
+	}
+	s.columns.dropped(table, column)
+	s.inserts.invalidate(table)
+	return nil
+}
+
+// SchemaHistory returns the schema changes ingestion made to the table since the server started.
+func (s *Store) SchemaHistory(table string) []SchemaChange {
+	return s.columns.history(table)
+}
+
+// TableSchema returns the columns of the table in their declared order, or ErrTableNotFound if it doesn't exist.
+func (s *Store) TableSchema(ctx context.Context, table string) (*TableSchema, error) {
+	if !tableNameRegex.MatchString(table) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT column_name, data_type, is_nullable = 'YES', column_default
+		FROM information_schema.columns
+		WHERE table_catalog IN `+ownCatalogs+` AND table_name = ?
+		ORDER BY ordinal_position`, table)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := &TableSchema{Table: table, Columns: []ColumnInfo{}}
+	cfg := s.configs.get(table)
+	for rows.Next() {
+		var col ColumnInfo
+		var def sql.NullString
+		if err = rows.Scan(&col.Name, &col.Type, &col.Nullable, &def); err != nil {
+			return nil, fmt.Errorf("scanning column: %w", err)
+		}
+		if c, ok := cfg.column(col.Name); ok && c.Generated != "" {
+			col.Generated = c.Generated
+		} else if def.Valid {
+			col.Default = &def.String
+		}
+		col.AddedAt = s.columns.addedAt(table, col.Name)
+		out.Columns = append(out.Columns, col)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing columns: %w", err)
+	}
+	if len(out.Columns) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	history, err := s.Migrations(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = history.Version
+	return out, nil
+}
+
+func (s *Server) HandleTableSchema(w http.ResponseWriter, r *http.Request) {
+	schema, err := s.store.TableSchema(r.Context(), r.PathValue("table"))
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle table schema", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle table schema", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle table schema: writing response", schema)
+}
+
+// HandleDropColumn drops the column in the path and responds with the remaining schema of the table.
+func (s *Server) HandleDropColumn(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DropColumn(r.Context(), r.PathValue("table"), r.PathValue("column"))
+	switch {
+	case errors.Is(err, ErrTableNotFound), errors.Is(err, ErrColumnNotFound):
+		s.writeError(w, http.StatusNotFound, "handle drop column", err)
+		return
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle drop column", err)
+		return
+	}
+	schema, err := s.store.TableSchema(r.Context(), r.PathValue("table"))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle drop column", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle drop column: writing response", schema)
+}
+
+// HandleSchemaHistory lists the tables and columns ingestion created for the table in the path, oldest first, with
+// the request that caused each of them.
+func (s *Server) HandleSchemaHistory(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle schema history: writing response", s.store.SchemaHistory(r.PathValue("table")))
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrSearchIndexNotFound  = errors.New("search index not found")
+	ErrExtensionUnavailable = errors.New("extension unavailable")
+)
+
+// SearchScoreColumn holds the BM25 score of the rows returned by a search, higher is more relevant.
+const SearchScoreColumn = "_score"
+
+// SearchIndex is a full-text index of DuckDB's fts extension over VARCHAR columns of a table. IDColumn identifies the
+// rows and must be unique. The index is a snapshot, rows written afterwards are found once it is created again.
+type SearchIndex struct {
+	Table    string   `json:"table"`
+	IDColumn string   `json:"id_column"`
+	Columns  []string `json:"columns"`
+	// Stemmer is one of the stemmers of the fts extension, porter by default, or none.
+	Stemmer string `json:"stemmer,omitempty"`
+}
+
+// searchIndexes tracks the indexes created through the store, the fts extension doesn't expose their id column.
+type searchIndexes struct {
+	mu      sync.Mutex
+	byTable map[string]SearchIndex
+	loaded  bool
+}
+
+// loadFTS installs and loads the fts extension once. Installing needs network access unless the extension is present
+// in the local extension directory already.
+func (s *Store) loadFTS(ctx context.Context) error {
+	s.search.mu.Lock()
+	defer s.search.mu.Unlock()
+	if s.search.loaded {
+		return nil
+	}
+	for _, stmt := range []string{"INSTALL fts", "LOAD fts"} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%w: fts: %w", ErrExtensionUnavailable, err)
+		}
+	}
+	s.search.loaded = true
+	return nil
+}
+
+// CreateSearchIndex builds the index, replacing an existing index of the table.
+func (s *Store) CreateSearchIndex(ctx context.Context, idx SearchIndex) error {
+	cols, err := s.existingColumns(ctx, idx.Table)
+	if err != nil {
+		return err
+	}
+	if len(idx.Columns) == 0 {
+		return errors.New("invalid search index: no columns")
+	}
+	args := []string{quoteLiteral(idx.Table), quoteLiteral(idx.IDColumn)}
+	for _, name := range append([]string{idx.IDColumn}, idx.Columns...) {
+		if _, err = column(cols, name); err != nil {
+			return fmt.Errorf("invalid search index: %w", err)
+		}
+	}
+	for _, name := range idx.Columns {
+		args = append(args, quoteLiteral(name))
+	}
+	if idx.Stemmer != "" {
+		args = append(args, "stemmer="+quoteLiteral(idx.Stemmer))
+	}
+	args = append(args, "overwrite=1")
+
+	if err = s.loadFTS(ctx); err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err = s.db.ExecContext(ctx, fmt.Sprintf("PRAGMA create_fts_index(%s)", strings.Join(args, ", "))); err != nil {
+		return fmt.Errorf("create search index: %w", err)
+	}
+	s.search.mu.Lock()
+	defer s.search.mu.Unlock()
+	s.search.byTable[idx.Table] = idx
+	return nil
+}
+
+// DropSearchIndex removes the index of the table.
+func (s *Store) DropSearchIndex(ctx context.Context, table string) error {
+	s.search.mu.Lock()
+	_, ok := s.search.byTable[table]
+	s.search.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSearchIndexNotFound, table)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("PRAGMA drop_fts_index(%s)", quoteLiteral(table))); err != nil {
+		return fmt.Errorf("drop search index: %w", err)
+	}
+	s.search.mu.Lock()
+	defer s.search.mu.Unlock()
+	delete(s.search.byTable, table)
+	return nil
+}
+
+// searchStatement ranks the rows of the table matching the keywords by BM25, optionally only in some of the indexed
+// fields. Rows that don't match are left out.
+func (s *Store) searchStatement(table, keywords string, fields []string) (*QueryStatement, error) {
+	s.search.mu.Lock()
+	idx, ok := s.search.byTable[table]
+	s.search.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSearchIndexNotFound, table)
+	}
+	if strings.TrimSpace(keywords) == "" {
+		return nil, errors.New("invalid search: q is empty")
+	}
+	indexed := make(map[string]bool, len(idx.Columns))
+	for _, name := range idx.Columns {
+		indexed[strings.ToLower(name)] = true
+	}
+	match := fmt.Sprintf("%s.match_bm25(%s, ?", quoteIdent("fts_main_"+table), quoteIdent(idx.IDColumn))
+	if len(fields) > 0 {
+		for _, name := range fields {
+			if !indexed[strings.ToLower(name)] {
+				return nil, fmt.Errorf("invalid search: %q is not an indexed column", name)
+			}
+		}
+		match += ", fields := " + quoteLiteral(strings.Join(fields, ","))
+	}
+	match += ")"
+	return &QueryStatement{
+		Query: fmt.Sprintf(
+			"SELECT * FROM (SELECT *, %s AS %s FROM %s) WHERE %s IS NOT NULL ORDER BY %s DESC",
+			match, SearchScoreColumn, quoteIdent(table), SearchScoreColumn, SearchScoreColumn,
+		),
+		Params: []any{keywords},
+	}, nil
+}
+
+// HandlePutSearchIndex builds the search index of the table in the path from a SearchIndex body.
+func (s *Server) HandlePutSearchIndex(w http.ResponseWriter, r *http.Request) {
+	var idx SearchIndex
+	if err := json.NewDecoder(r.Body).Decode(&idx); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put search index: decoding request body", err)
+		return
+	}
+	idx.Table = r.PathValue("table")
+	err := s.store.CreateSearchIndex(r.Context(), idx)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle put search index", err)
+	case errors.Is(err, ErrExtensionUnavailable):
+		s.writeError(w, http.StatusServiceUnavailable, "handle put search index", err)
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle put search index", err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle put search index: writing response", idx)
+	}
+}
+
+func (s *Server) HandleDeleteSearchIndex(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DropSearchIndex(r.Context(), r.PathValue("table"))
+	if errors.Is(err, ErrSearchIndexNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete search index", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete search index", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSearch responds with the rows of the table in the path matching the keywords in q, most relevant first, with
+// their score in SearchScoreColumn. fields=a,b restricts the match to some of the indexed columns. The response is
+// negotiated and paginated like the query endpoints.
+func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	var fields []string
+	if v := r.URL.Query().Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+	}
+	stmt, err := s.store.searchStatement(r.PathValue("table"), r.URL.Query().Get("q"), fields)
+	if errors.Is(err, ErrSearchIndexNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle search", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle search", err)
+		return
+	}
+	stmt.Cursor = r.URL.Query().Get("cursor")
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if stmt.Limit, err = strconv.Atoi(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle search: parsing limit", err)
+			return
+		}
+	}
+	s.writeQuery(w, r, stmt)
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrSecretNotFound = errors.New("secret not found")
+	ErrInvalidSecret  = errors.New("invalid secret")
+)
+
+// secretTypes are the DuckDB secret types of the object stores that imports and exports can read from and write to.
+var secretTypes = map[string]bool{"s3": true, "gcs": true, "r2": true, "azure": true}
+
+var secretOptionRegex = regexp.MustCompile(`^[a-z_]+$`)
+
+// redacted replaces the option values of a secret in responses.
+const redacted = "********"
+
+// Secret is a DuckDB secret with the credentials of an object store, e.g. the type S3 with the options key_id, secret
+// and region. DuckDB picks the secret whose scope is the longest prefix of the URL a query reads or writes. The option
+// values are write-only, responses only carry them redacted.
+type Secret struct {
+	Name string `json:"name"`
+	// Type is one of S3, GCS, R2 or AZURE.
+	Type string `json:"type"`
+	// Scope limits the secret to URLs starting with it, e.g. s3://bucket/prefix. Empty applies it to every URL of its
+	// type.
+	Scope   string            `json:"scope,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	// Error is set when the secret failed to register on startup, e.g. because its extension couldn't be loaded.
+	Error string `json:"error,omitempty"`
+}
+
+func (sec *Secret) Validate() error {
+	if !tableNameRegex.MatchString(sec.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidSecret, tableNameRegex)
+	}
+	if !secretTypes[strings.ToLower(sec.Type)] {
+		return fmt.Errorf("%w: unsupported type %q", ErrInvalidSecret, sec.Type)
+	}
+	for name := range sec.Options {
+		if !secretOptionRegex.MatchString(name) {
+			return fmt.Errorf("%w: option name must match %s: %q", ErrInvalidSecret, secretOptionRegex, name)
+		}
+		if name == "type" || name == "scope" {
+			return fmt.Errorf("%w: %s is not an option", ErrInvalidSecret, name)
+		}
+	}
+	return nil
+}
+
+// redact returns the secret with the option values replaced.
+func (sec Secret) redact() Secret {
+	options := make(map[string]string, len(sec.Options))
+	for name := range sec.Options {
+		options[name] = redacted
+	}
+	sec.Options = options
+	return sec
+}
+
+// create returns the statement registering the secret. It is a temporary secret, DuckDB keeps persistent secrets in
+// plain text, the encrypted file of Secrets registers it again on startup instead.
+func (sec *Secret) create() string {
+	params := []string{"TYPE " + strings.ToLower(sec.Type)}
+	if sec.Scope != "" {
+		params = append(params, "SCOPE "+quoteLiteral(sec.Scope))
+	}
+	names := make([]string, 0, len(sec.Options))
+	for name := range sec.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params = append(params, strings.ToUpper(name)+" "+quoteLiteral(sec.Options[name]))
+	}
+	return fmt.Sprintf("CREATE OR REPLACE TEMPORARY SECRET %s (%s)", sec.Name, strings.Join(params, ", "))
+}
+
+// CreateSecret registers the secret in DuckDB, replacing a secret of the same name. Errors are returned without the
+// statement, which carries the credentials.
+func (s *Store) CreateSecret(ctx context.Context, sec *Secret) error {
+	if err := sec.Validate(); err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.db.ExecContext(ctx, sec.create()); err != nil {
+		return fmt.Errorf("create secret: %w", err)
+	}
+	return nil
+}
+
+// DropSecret removes the secret from DuckDB if it exists.
+func (s *Store) DropSecret(ctx context.Context, name string) error {
+	if !tableNameRegex.MatchString(name) {
+		return fmt.Errorf("drop secret: invalid name %q", name)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if _, err := s.db.ExecContext(ctx, "DROP TEMPORARY SECRET IF EXISTS "+name); err != nil {
+		return fmt.Errorf("drop secret: %w", err)
+	}
+	return nil
+}
+
+// Secrets manages the object store secrets of a store. With a path, the secrets are kept in that file encrypted with
+// AES-GCM and registered again by NewSecrets.
+type Secrets struct {
+	store *Store
+	path  string
+	aead  cipher.AEAD
+
+	mu     sync.Mutex
+	byName map[string]*Secret
+}
+
+// NewSecrets loads the secrets in the file at path, if it exists, and registers them. The key is the base64 encoded
+// AES key of 16, 24 or 32 bytes and is required with a path. An empty path keeps the secrets in memory only.
+func NewSecrets(ctx context.Context, store *Store, path, key string) (*Secrets, error) {
+	ss := &Secrets{store: store, path: path, byName: make(map[string]*Secret)}
+	if path == "" {
+		return ss, nil
+	}
+	if key == "" {
+		return nil, errors.New("secrets: a key is required to keep secrets in a file")
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: decoding key: %w", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: key: %w", err)
+	}
+	if ss.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, fmt.Errorf("secrets: key: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ss, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secrets: reading %s: %w", path, err)
+	}
+	size := ss.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("secrets: %s is truncated", path)
+	}
+	plain, err := ss.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: decrypting %s, is the key right?: %w", path, err)
+	}
+	var secrets []Secret
+	if err = json.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("secrets: parsing %s: %w", path, err)
+	}
+	for i := range secrets {
+		sec := &secrets[i]
+		sec.Error = ""
+		if createErr := store.CreateSecret(ctx, sec); createErr != nil {
+			slog.Error("secrets: registering secret", "name", sec.Name, "err", createErr)
+			sec.Error = createErr.Error()
+		}
+		ss.byName[sec.Name] = sec
+	}
+	return ss, nil
+}
+
+// Put registers the secret and persists it. It returns the secret redacted and reports whether it is new.
+func (ss *Secrets) Put(ctx context.Context, sec Secret) (Secret, bool, error) {
+	sec.Error = ""
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err := ss.store.CreateSecret(ctx, &sec); err != nil {
+		return Secret{}, false, err
+	}
+	_, exists := ss.byName[sec.Name]
+	ss.byName[sec.Name] = &sec
+	if err := ss.save(); err != nil {
+		return Secret{}, false, err
+	}
+	return sec.redact(), !exists, nil
+}
+
+// Get returns the secret redacted.
+func (ss *Secrets) Get(name string) (Secret, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sec, ok := ss.byName[name]
+	if !ok {
+		return Secret{}, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return sec.redact(), nil
+}
+
+// List returns the secrets redacted.
+func (ss *Secrets) List() []Secret {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	out := make([]Secret, 0, len(ss.byName))
+	for _, sec := range ss.byName {
+		out = append(out, sec.redact())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete drops the secret and removes it from the file.
+func (ss *Secrets) Delete(ctx context.Context, name string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.byName[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	if err := ss.store.DropSecret(ctx, name); err != nil {
+		return err
+	}
+	delete(ss.byName, name)
+	return ss.save()
+}
+
+// save encrypts the secrets to the file, replacing it atomically. The caller holds the lock.
+func (ss *Secrets) save() error {
+	if ss.path == "" {
+		return nil
+	}
+	secrets := make([]Secret, 0, len(ss.byName))
+	for _, sec := range ss.byName {
+		s := *sec
+		s.Error = ""
+		secrets = append(secrets, s)
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return fmt.Errorf("secrets: encoding: %w", err)
+	}
+	nonce := make([]byte, ss.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("secrets: generating nonce: %w", err)
+	}
+	data := ss.aead.Seal(nonce, nonce, plain, nil)
+
+	if err = writeFileAtomic(ss.path, data); err != nil {
+		return fmt.Errorf("secrets: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) HandleListSecrets(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list secrets: writing response", s.secrets.List())
+}
+
+// HandlePutSecret registers the secret named in the path, replacing an existing one.
+func (s *Server) HandlePutSecret(w http.ResponseWriter, r *http.Request) {
+	var sec Secret
+	if err := json.NewDecoder(r.Body).Decode(&sec); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put secret: decoding request body", err)
+		return
+	}
+	sec.Name = r.PathValue("name")
+	sec, created, err := s.secrets.Put(r.Context(), sec)
+	if errors.Is(err, ErrInvalidSecret) {
+		s.writeError(w, http.StatusBadRequest, "handle put secret", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle put secret", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put secret: writing response", sec)
+}
+
+func (s *Server) HandleGetSecret(w http.ResponseWriter, r *http.Request) {
+	sec, err := s.secrets.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get secret", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get secret: writing response", sec)
+}
+
+func (s *Server) HandleDeleteSecret(w http.ResponseWriter, r *http.Request) {
+	err := s.secrets.Delete(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrSecretNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete secret", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete secret", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SegmentPath is the prefix of the endpoints of the Segment HTTP tracking API.
+const SegmentPath = "/v1/"
+
+// The tables the Segment endpoints insert the track and identify calls into.
+const (
+	SegmentEventsTable     = "events"
+	SegmentIdentitiesTable = "identities"
+)
+
+// ErrSegmentInvalid is returned for Segment calls missing required fields or of types the endpoints don't take.
+var ErrSegmentInvalid = errors.New("invalid segment call")
+
+// SegmentResponse is the answer Segment libraries expect from a successful call.
+type SegmentResponse struct {
+	Success bool `json:"success"`
+}
+
+// SegmentBatch is the body of POST /v1/batch. Its context and sentAt apply to the calls lacking them.
+type SegmentBatch struct {
+	Batch   []map[string]any `json:"batch"`
+	Context map[string]any   `json:"context,omitempty"`
+	SentAt  string           `json:"sentAt,omitempty"`
+}
+
+// segmentKey returns the write key the Segment libraries send as the user name of basic authentication, which
+// authenticates the requests to the Segment endpoints like an API key.
+func segmentKey(r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.URL.Path, SegmentPath) {
+		return "", false
+	}
+	if key, _, ok := r.BasicAuth(); ok && key != "" {
+		return key, true
+	}
+	return "", false
+}
+
+// HandleSegmentTrack inserts a track call of the Segment HTTP API into SegmentEventsTable.
+func (s *Server) HandleSegmentTrack(w http.ResponseWriter, r *http.Request) {
+	s.handleSegment(w, r, "track")
+}
+
+// HandleSegmentIdentify inserts an identify call of the Segment HTTP API into SegmentIdentitiesTable.
+func (s *Server) HandleSegmentIdentify(w http.ResponseWriter, r *http.Request) {
+	s.handleSegment(w, r, "identify")
+}
+
+// HandleSegmentBatch inserts the track and identify calls of a Segment batch, as the server-side libraries send them.
+func (s *Server) HandleSegmentBatch(w http.ResponseWriter, r *http.Request) {
+	s.handleSegment(w, r, "batch")
+}
+
+// handleSegment decodes the calls of the body, of the type of the endpoint, flattens them into rows and inserts them
+// with the checks of POST /data.
+func (s *Server) handleSegment(w http.ResponseWriter, r *http.Request, endpoint string) {
+	s.limitBody(w, r)
+	var batch SegmentBatch
+	var err error
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if endpoint == "batch" {
+		if err = dec.Decode(&batch); err == nil {
+			err = exactRows(batch.Batch...)
+		}
+		if err == nil {
+			err = exactRows(batch.Context)
+		}
+	} else {
+		var msg map[string]any
+		if err = dec.Decode(&msg); err == nil {
+			err = exactRows(msg)
+		}
+		if msg != nil {
+			if _, ok := msg["type"]; !ok {
+				msg["type"] = endpoint
+			}
+			batch.Batch = []map[string]any{msg}
+		}
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle segment: decoding request body", err)
+		return
+	}
+	receivedAt, id := time.Now().UTC().Format(time.RFC3339Nano), requestID(w, r)
+	stmts := map[string]*InsertStatement{}
+	for i, msg := range batch.Batch {
+		switch {
+		case msg == nil:
+			err = fmt.Errorf("%w: null call", ErrSegmentInvalid)
+		case endpoint != "batch" && msg["type"] != endpoint:
+			err = fmt.Errorf("%w: %v call sent to the %s endpoint", ErrSegmentInvalid, msg["type"], endpoint)
+		default:
+			if _, ok := msg["context"]; !ok && batch.Context != nil {
+				msg["context"] = batch.Context
+			}
+			if _, ok := msg["sentAt"]; !ok && batch.SentAt != "" {
+				msg["sentAt"] = batch.SentAt
+			}
+			var table string
+			var row map[string]any
+			if table, row, err = segmentRow(msg, receivedAt); err == nil {
+				if stmts[table] == nil {
+					stmts[table] = &InsertStatement{Table: table, RequestID: id}
+				}
+				stmts[table].Rows = append(stmts[table].Rows, row)
+			}
+		}
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle segment", fmt.Errorf("call %d: %w", i, err))
+			return
+		}
+	}
+	for _, table := range []string{SegmentEventsTable, SegmentIdentitiesTable} {
+		if stmts[table] == nil {
+			continue
+		}
+		markAudit(r.Context(), AuditIngest, table)
+		err = s.store.checkAuditRoute(r.Context(), table, true)
+		if err == nil {
+			err = s.store.checkTableAccess(r.Context(), table, true)
+		}
+		if err == nil {
+			err = s.store.checkGuardedRoute(r.Context(), "POST /data", table)
+		}
+		if err != nil {
+			s.writeQueryError(w, err)
+			return
+		}
+	}
+	release, ok := s.acquireWrite(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	rows := 0
+	for _, table := range []string{SegmentEventsTable, SegmentIdentitiesTable} {
+		if stmts[table] == nil {
+			continue
+		}
+		err = s.store.Insert(r.Context(), stmts[table])
+		switch {
+		case errors.Is(err, ErrInvalidInsert), errors.Is(err, ErrConstraintViolation), errors.Is(err, ErrGeneratedColumn):
+			s.writeError(w, http.StatusUnprocessableEntity, "handle segment", err)
+			return
+		case errors.Is(err, ErrTypeConflict), errors.Is(err, ErrConstrainedColumn):
+			s.writeError(w, http.StatusConflict, "handle segment", err)
+			return
+		case err != nil:
+			s.writeError(w, http.StatusInternalServerError, "handle segment", err)
+			return
+		}
+		rows += len(stmts[table].Rows)
+	}
+	markAuditRows(r.Context(), rows)
+	s.writeJSON(w, http.StatusOK, "handle segment: writing response", SegmentResponse{Success: true})
+}
+
+// segmentRow flattens a track or identify call into a row of its table. The common fields get snake_case names, the
+// properties of tracks, the traits of identifies and the context are prefixed with properties_, traits_ and context_,
+// nested objects joined with underscores like Segment's warehouses do. Timestamps stay RFC 3339 strings, the table
+// configuration can declare the columns as timestamps.
+func segmentRow(msg map[string]any, receivedAt string) (string, map[string]any, error) {
+	table, nested := SegmentEventsTable, "properties"
+	switch msg["type"] {
+	case "track":
+		if event, _ := msg["event"].(string); event == "" {
+			return "", nil, fmt.Errorf("%w: track without event", ErrSegmentInvalid)
+		}
+	case "identify":
+		table, nested = SegmentIdentitiesTable, "traits"
+	default:
+		return "", nil, fmt.Errorf("%w: type %v, only track and identify are supported", ErrSegmentInvalid,
+			msg["type"])
+	}
+	row := map[string]any{"received_at": receivedAt}
+	for _, field := range []string{"messageId", "userId", "anonymousId", "timestamp", "sentAt", "originalTimestamp"} {
+		switch v := msg[field].(type) {
+		case nil:
+		case string:
+			row[segmentColumn(field)] = v
+		default:
+			// Some libraries send numeric user ids.
+			row[segmentColumn(field)] = fmt.Sprint(v)
+		}
+	}
+	if row["user_id"] == nil && row["anonymous_id"] == nil {
+		return "", nil, fmt.Errorf("%w: %s without userId or anonymousId", ErrSegmentInvalid, msg["type"])
+	}
+	if row["message_id"] == nil {
+		id, err := newID()
+		if err != nil {
+			return "", nil, err
+		}
+		row["message_id"] = id
+	}
+	if row["timestamp"] == nil {
+		row["timestamp"] = receivedAt
+	}
+	if event, ok := msg["event"].(string); ok {
+		row["event"] = event
+	}
+	for _, prefix := range []string{nested, "context"} {
+		if v, ok := msg[prefix].(map[string]any); ok {
+			flattenSegment(row, prefix, v)
+		}
+	}
+	return table, row, nil
+}
+
+// flattenSegment adds the values of the object to the row under the prefix joined to their snake_case keys with
+// underscores, recursing into nested objects. Lists are kept whole.
+func flattenSegment(row map[string]any, prefix string, object map[string]any) {
+	for k, v := range object {
+		name := prefix + "_" + segmentColumn(k)
+		if nested, ok := v.(map[string]any); ok {
+			flattenSegment(row, name, nested)
+			continue
+		}
+		row[name] = v
+	}
+}
+
+// segmentColumn converts a key to a column name: camelCase becomes snake_case and the characters column names can't
+// have become underscores.
+func segmentColumn(key string) string {
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'A' && c <= 'Z':
+			if i > 0 && (isDigit(key[i-1]) || key[i-1] >= 'a' && key[i-1] <= 'z') {
+				sb.WriteByte('_')
+			}
+			sb.WriteByte(c + 'a' - 'A')
+		case c == '_' || isDigit(c) || c >= 'a' && c <= 'z':
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
@@ -1,71 +1,1004 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DefaultMaxQueryTimeout bounds the execution time of queries unless the server is configured otherwise.
+const DefaultMaxQueryTimeout = 30 * time.Second
+
+// DefaultMaxBodyBytes bounds the request bodies of uploads such as POST /data unless the server is configured
+// otherwise.
+const DefaultMaxBodyBytes = 32 << 20
+
 type Server struct {
-	store *Store
+	store           *Store
+	jobs            *jobs
+	importJobs      *importJobs
+	inFlight        *inFlight
+	saved           *savedQueries
+	sessions        *sessions
+	scheduler       *Scheduler
+	views           *Views
+	rollups         *Rollups
+	alerts          *Alerts
+	quality         *Quality
+	macros          *Macros
+	secrets         *Secrets
+	webhooks        *Webhooks
+	checkpointer    *Checkpointer
+	attachments     *Attachments
+	downloads       *Downloads
+	uploads         *Uploads
+	follower        *Follower
+	cluster         *Cluster
+	apiKeys         *APIKeys
+	jwt             *JWTVerifier
+	clientCerts     []ClientCert
+	cors            *CORS
+	cache           *queryCache
+	history         *queryHistory
+	slots           *querySlots
+	writeSlots      *querySlots
+	tagSlots        map[string]*querySlots
+	tagStats        *queryTagStats
+	maxWriteWait    time.Duration
+	coalescer       *insertCoalescer
+	maxQueryTimeout time.Duration
+	resultLimits    ResultLimits
+	maxBodyBytes    int64
+	accessLog       *slog.Logger
+	logLevel        *slog.LevelVar
+	debug           bool
+	ui              bool
+	clickHouse      bool
+}
+
+type ServerOption func(*Server)
+
+// WithMaxQueryTimeout sets the longest a query may run, both as the default and as the upper bound of the timeout
+// parameter. Zero disables the bound.
+func WithMaxQueryTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.maxQueryTimeout = d
+	}
+}
+
+// WithScheduler exposes the schedules of the scheduler on the admin endpoints. The caller runs the scheduler.
+func WithScheduler(scheduler *Scheduler) ServerOption {
+	return func(s *Server) {
+		s.scheduler = scheduler
+	}
+}
+
+// WithViews exposes the materialized views on the admin endpoints. The caller runs the view refreshes.
+func WithViews(views *Views) ServerOption {
+	return func(s *Server) {
+		s.views = views
+	}
+}
+
+// WithRollups exposes the rollups on the admin endpoints. The caller runs the rollup refreshes.
+func WithRollups(rollups *Rollups) ServerOption {
+	return func(s *Server) {
+		s.rollups = rollups
+	}
+}
+
+// WithAlerts exposes the alerting rules on the admin endpoints. The caller runs the evaluations.
+func WithAlerts(alerts *Alerts) ServerOption {
+	return func(s *Server) {
+		s.alerts = alerts
+	}
+}
+
+// WithQuality exposes the quality checks of the tables on the admin endpoints and their results on the table routes.
+// The caller runs the evaluations.
+func WithQuality(quality *Quality) ServerOption {
+	return func(s *Server) {
+		s.quality = quality
+	}
+}
+
+// WithMacros exposes the user-defined macros on the admin endpoints.
+func WithMacros(macros *Macros) ServerOption {
+	return func(s *Server) {
+		s.macros = macros
+	}
+}
+
+// WithWebhooks exposes the webhooks notified of schema changes on the admin endpoints. The caller runs the deliveries.
+func WithWebhooks(webhooks *Webhooks) ServerOption {
+	return func(s *Server) {
+		s.webhooks = webhooks
+	}
+}
+
+// WithSecrets exposes the object store secrets on the admin endpoints.
+func WithSecrets(secrets *Secrets) ServerOption {
+	return func(s *Server) {
+		s.secrets = secrets
+	}
+}
+
+// WithAttachments exposes the attached external databases on the admin endpoints.
+func WithAttachments(attachments *Attachments) ServerOption {
+	return func(s *Server) {
+		s.attachments = attachments
+	}
+}
+
+// WithCheckpointer exposes checkpoints of the database on the admin endpoints. The caller runs the scheduled ones.
+func WithCheckpointer(checkpointer *Checkpointer) ServerOption {
+	return func(s *Server) {
+		s.checkpointer = checkpointer
+	}
+}
+
+// WithQueryCacheTTL caches the results of read-only queries for the TTL. Zero, the default, disables the cache.
+func WithQueryCacheTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.cache = nil
+		if ttl > 0 {
+			s.cache = newQueryCache(ttl)
+		}
+	}
+}
+
+// WithQueryConcurrency bounds the queries executing at once and the queries waiting for a slot. Queries beyond both
+// are rejected with 429. A maxConcurrent of zero disables the bound.
+func WithQueryConcurrency(maxConcurrent, maxQueued int) ServerOption {
+	return func(s *Server) {
+		s.slots = newQuerySlots(maxConcurrent, maxQueued)
+	}
+}
+
+// WithResultLimits bounds the rows and encoded size of query results. API keys may override them, see
+// APIKey.ResultLimits.
+func WithResultLimits(limits ResultLimits) ServerOption {
+	return func(s *Server) {
+		s.resultLimits = limits
+	}
+}
+
+// WithMaxBodyBytes bounds the request bodies of uploads, larger ones are refused with 413. Zero disables the bound.
+func WithMaxBodyBytes(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxBodyBytes = n
+	}
+}
+
+// limitBody bounds reading the request body by the upload limit, see WithMaxBodyBytes. Reading past it fails with an
+// *http.MaxBytesError, which writeError answers with 413.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+}
+
+func NewServer(store *Store, opts ...ServerOption) *Server {
+	s := &Server{
+		store:           store,
+		jobs:            newJobs(),
+		importJobs:      newImportJobs(),
+		inFlight:        newInFlight(),
+		saved:           newSavedQueries(),
+		sessions:        newSessions(),
+		slots:           newQuerySlots(DefaultMaxConcurrentQueries, DefaultMaxQueuedQueries),
+		writeSlots:      newWriteSlots(DefaultMaxQueuedWrites),
+		maxWriteWait:    DefaultMaxWriteWait,
+		maxQueryTimeout: DefaultMaxQueryTimeout,
+		resultLimits:    DefaultResultLimits(),
+		maxBodyBytes:    DefaultMaxBodyBytes,
+		history:         newQueryHistory(DefaultQueryHistory),
+		tagStats:        newQueryTagStats(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// TimeoutParam sets the deadline of a query as a Go duration, e.g. ?timeout=5s. It is capped at the server maximum.
+const TimeoutParam = "timeout"
+
+// queryContext returns the request context with the deadline of the query once it got an execution slot, and
+// registers the query as in flight until the returned cancel function is called. The deadline includes the wait for a
+// slot. DuckDB interrupts the query once the context is done.
+func (s *Server) queryContext(r *http.Request, stmt *QueryStatement) (context.Context, context.CancelFunc, error) {
+	timeout := s.maxQueryTimeout
+	if v := r.URL.Query().Get(TimeoutParam); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing timeout: %w", err)
+		}
+		if d <= 0 {
+			return nil, nil, fmt.Errorf("invalid timeout: %s", v)
+		}
+		if timeout <= 0 || d < timeout {
+			timeout = d
+		}
+	}
+	tag, err := queryTag(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	release, err := s.acquireQuery(ctx, tag)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	done, err := s.inFlight.register(stmt.Query, caller(r), tag, cancel)
+	if err != nil {
+		release()
+		cancel()
+		return nil, nil, err
+	}
+	return ctx, func() {
+		done()
+		cancel()
+		release()
+	}, nil
+}
+
+// Handler returns the routes of NewServeMux behind the API key and token check and, on a follower, the refusal of
+// writes or, on a cluster node, their forwarding to the leader, wrapped by CORS and the access log if configured. The
+// audit log records the requests that passed them.
+func (s *Server) Handler() http.Handler {
+	return s.SurfaceHandler(SurfaceAll)
 }
 
-func NewServer(store *Store) *Server {
-	return &Server{store: store}
+// SurfaceHandler returns Handler serving only the routes of the surface, see Listener.
+func (s *Server) SurfaceHandler(surface Surface) http.Handler {
+	mux := s.NewServeMux()
+	var h http.Handler = mux
+	if s.store.audit != nil {
+		h = s.auditRequests(h)
+	}
+	if s.follower != nil {
+		h = s.followerGuard(mux, h)
+	}
+	if s.cluster != nil {
+		h = s.clusterGuard(mux, h)
+	}
+	if s.apiKeys != nil || s.jwt != nil || len(s.clientCerts) > 0 {
+		h = s.requireAuth(mux, h)
+	}
+	if surface != "" && surface != SurfaceAll {
+		h = s.restrictSurface(mux, h, surface)
+	}
+	if s.cors != nil {
+		h = s.handleCORS(h)
+	}
+	if s.accessLog != nil {
+		h = s.logAccess(h)
+	}
+	return h
 }
 
 func (s *Server) NewServeMux() *http.ServeMux {
-	m := http.NewServeMux()
+	m := &routeMux{ServeMux: http.NewServeMux()}
 	m.HandleFunc("GET /query", s.HandleQuery)
+	m.HandleFunc("POST /query", s.HandleQueryPost)
+	m.HandleFunc("POST /admin/query", s.HandleAdminQuery)
+	m.HandleFunc("GET /admin/queries", s.HandleListQueries)
+	m.HandleFunc("GET /admin/queries/tags", s.HandleQueryTagStats)
+	m.HandleFunc("GET /metrics", s.HandleMetrics)
+	m.HandleFunc("DELETE /admin/queries/{id}", s.HandleKillQuery)
+	m.HandleFunc("GET /admin/settings", s.HandleListSettings)
+	m.HandleFunc("GET /admin/backups", s.HandleListBackups)
+	m.HandleFunc("POST /admin/backup", s.HandleCreateBackup)
+	m.HandleFunc("POST /admin/restore", s.HandleRestoreBackup)
+	m.HandleFunc("GET /query/stream", s.HandleQueryStream)
+	m.HandleFunc("GET /query/explain", s.HandleExplain)
+	m.HandleFunc("POST /query/explain", s.HandleExplainPost)
+	m.HandleFunc("POST /queries", s.HandleCreateJob)
+	m.HandleFunc("GET /queries/{id}", s.HandleGetJob)
+	m.HandleFunc("DELETE /queries/{id}", s.HandleCancelJob)
+	m.HandleFunc("GET /queries/{id}/{sub}", s.handleQueriesSubresource)
+	m.HandleFunc("GET /queries/saved", s.HandleListSavedQueries)
+	m.HandleFunc("GET /downloads", s.HandleListDownloads)
+	m.HandleFunc("POST /downloads", s.HandleCreateDownload)
+	m.HandleFunc("GET /downloads/{id}", s.HandleGetDownload)
+	m.HandleFunc("DELETE /downloads/{id}", s.HandleDeleteDownload)
+	m.HandleFunc("GET /downloads/{id}/data", s.HandleDownloadData)
+	m.HandleFunc("GET /downloads/{id}/parts/{part}", s.HandleDownloadPart)
+	m.HandleFunc("GET /queries/history", s.HandleQueryHistory)
+	m.HandleFunc("POST /queries/history/{id}", s.HandleRerunQuery)
+	m.HandleFunc("PUT /queries/saved/{name}", s.HandlePutSavedQuery)
+	m.HandleFunc("DELETE /queries/saved/{name}", s.HandleDeleteSavedQuery)
+	m.HandleFunc("POST /queries/saved/{name}", s.HandleRunSavedQuery)
 	m.HandleFunc("POST /data", s.HandleData)
-	return m
+	m.HandleFunc("POST /data/preview", s.HandlePreviewData)
+	m.HandleFunc("GET /types", s.HandleTypes)
+	m.HandleFunc("GET "+GraphQLPath, s.HandleGraphQL)
+	m.HandleFunc("POST "+GraphQLPath, s.HandleGraphQL)
+	m.HandleFunc("GET "+ODataPath+"{$}", s.HandleODataService)
+	m.HandleFunc("GET "+ODataPath+"$metadata", s.HandleODataMetadata)
+	m.HandleFunc("GET "+ODataPath+"{table}", s.HandleODataEntitySet)
+	m.HandleFunc("POST "+SegmentPath+"track", s.HandleSegmentTrack)
+	m.HandleFunc("POST "+SegmentPath+"identify", s.HandleSegmentIdentify)
+	m.HandleFunc("POST "+SegmentPath+"batch", s.HandleSegmentBatch)
+	m.HandleFunc("GET /tables", s.HandleListTables)
+	m.HandleFunc("GET /tables/{table}/schema", s.HandleTableSchema)
+	m.HandleFunc("GET /tables/{table}/schema/history", s.HandleSchemaHistory)
+	m.HandleFunc("GET /tables/{table}/changes", s.HandleChanges)
+	m.HandleFunc("GET /tables/{table}/tail", s.HandleTail)
+	m.HandleFunc("GET /admin/replication/changes", s.HandleReplicationChanges)
+	m.HandleFunc("GET /tables/{table}/config", s.HandleGetTableConfig)
+	m.HandleFunc("PUT /tables/{table}/config", s.HandlePutTableConfig)
+	m.HandleFunc("GET /tables/{table}/stats/ingest", s.HandleIngestStats)
+	m.HandleFunc("GET /tables/{table}/indexes", s.HandleListIndexes)
+	m.HandleFunc("PUT /tables/{table}/indexes/{name}", s.HandlePutIndex)
+	m.HandleFunc("DELETE /tables/{table}/indexes/{name}", s.HandleDropIndex)
+	m.HandleFunc("GET /tables/{table}/rows", s.HandleTableRows)
+	m.HandleFunc("DELETE /tables/{table}/rows", s.HandleDeleteRows)
+	m.HandleFunc("GET /tables/{table}/sample", s.HandleTableSample)
+	m.HandleFunc("POST /tables/{table}/rename", s.HandleRenameTable)
+	m.HandleFunc("POST /tables/{table}/copy", s.HandleCopyTable)
+	m.HandleFunc("POST /tables/{table}/import", s.HandleImport)
+	m.HandleFunc("POST /tables/{table}/uploads", s.HandleCreateUpload)
+	m.HandleFunc("GET /tables/{table}/uploads/{id}", s.HandleGetUpload)
+	m.HandleFunc("DELETE /tables/{table}/uploads/{id}", s.HandleAbortUpload)
+	m.HandleFunc("PUT /tables/{table}/uploads/{id}/parts/{part}", s.HandlePutUploadPart)
+	m.HandleFunc("POST /tables/{table}/uploads/{id}/commit", s.HandleCommitUpload)
+	m.HandleFunc("GET /jobs", s.HandleListImportJobs)
+	m.HandleFunc("GET /jobs/{id}", s.HandleGetImportJob)
+	m.HandleFunc("DELETE /jobs/{id}", s.HandleCancelImportJob)
+	m.HandleFunc("POST /tables/{table}/export", s.HandleExport)
+	m.HandleFunc("POST /tables/{table}/export/delta", s.HandleExportDelta)
+	m.HandleFunc("GET /tables/{table}/snapshots", s.HandleListSnapshots)
+	m.HandleFunc("POST /tables/{table}/snapshots", s.HandleCreateSnapshot)
+	m.HandleFunc("DELETE /tables/{table}/snapshots/{snapshot}", s.HandleDeleteSnapshot)
+	m.HandleFunc("POST /tables/{table}/columns/{column}/rename", s.HandleRenameColumn)
+	m.HandleFunc("DELETE /tables/{table}/columns/{column}", s.HandleDropColumn)
+	m.HandleFunc("GET /tables/{table}/migrations", s.HandleListMigrations)
+	m.HandleFunc("POST /tables/{table}/migrations", s.HandleApplyMigration)
+	m.HandleFunc("GET /tables/{table}/aggregate", s.HandleTableAggregate)
+	m.HandleFunc("GET /tables/{table}/search", s.HandleSearch)
+	m.HandleFunc("PUT /admin/tables/{table}/search-index", s.HandlePutSearchIndex)
+	m.HandleFunc("DELETE /admin/tables/{table}/search-index", s.HandleDeleteSearchIndex)
+	m.HandleFunc("POST /admin/tables/{table}/tier", s.HandleTier)
+	m.HandleFunc("POST /sessions", s.HandleCreateSession)
+	m.HandleFunc("DELETE /sessions/{id}", s.HandleDeleteSession)
+	if s.scheduler != nil {
+		m.HandleFunc("GET /admin/schedules", s.HandleListSchedules)
+		m.HandleFunc("GET /admin/schedules/{name}", s.HandleGetSchedule)
+		m.HandleFunc("PUT /admin/schedules/{name}", s.HandlePutSchedule)
+		m.HandleFunc("DELETE /admin/schedules/{name}", s.HandleDeleteSchedule)
+		m.HandleFunc("POST /admin/schedules/{name}/run", s.HandleRunSchedule)
+	}
+	if s.views != nil {
+		m.HandleFunc("GET /admin/views", s.HandleListViews)
+		m.HandleFunc("GET /admin/views/{name}", s.HandleGetView)
+		m.HandleFunc("PUT /admin/views/{name}", s.HandlePutView)
+		m.HandleFunc("DELETE /admin/views/{name}", s.HandleDeleteView)
+		m.HandleFunc("POST /admin/views/{name}/refresh", s.HandleRefreshView)
+	}
+	if s.rollups != nil {
+		m.HandleFunc("GET /admin/rollups", s.HandleListRollups)
+		m.HandleFunc("GET /admin/rollups/{name}", s.HandleGetRollup)
+		m.HandleFunc("PUT /admin/rollups/{name}", s.HandlePutRollup)
+		m.HandleFunc("DELETE /admin/rollups/{name}", s.HandleDeleteRollup)
+		m.HandleFunc("POST /admin/rollups/{name}/refresh", s.HandleRefreshRollup)
+	}
+	if s.alerts != nil {
+		m.HandleFunc("GET /admin/alerts", s.HandleListAlerts)
+		m.HandleFunc("GET /admin/alerts/{name}", s.HandleGetAlert)
+		m.HandleFunc("PUT /admin/alerts/{name}", s.HandlePutAlert)
+		m.HandleFunc("DELETE /admin/alerts/{name}", s.HandleDeleteAlert)
+		m.HandleFunc("POST /admin/alerts/{name}/evaluate", s.HandleEvaluateAlert)
+	}
+	if s.quality != nil {
+		m.HandleFunc("GET /admin/quality", s.HandleListQuality)
+		m.HandleFunc("GET /admin/quality/{table}", s.HandleGetQuality)
+		m.HandleFunc("PUT /admin/quality/{table}", s.HandlePutQuality)
+		m.HandleFunc("DELETE /admin/quality/{table}", s.HandleDeleteQuality)
+		m.HandleFunc("POST /admin/quality/{table}/evaluate", s.HandleEvaluateQuality)
+		m.HandleFunc("GET /tables/{table}/quality", s.HandleGetQuality)
+	}
+	if s.macros != nil {
+		m.HandleFunc("GET /admin/macros", s.HandleListMacros)
+		m.HandleFunc("GET /admin/macros/{name}", s.HandleGetMacro)
+		m.HandleFunc("PUT /admin/macros/{name}", s.HandlePutMacro)
+		m.HandleFunc("DELETE /admin/macros/{name}", s.HandleDeleteMacro)
+	}
+	if s.secrets != nil {
+		m.HandleFunc("GET /admin/secrets", s.HandleListSecrets)
+		m.HandleFunc("GET /admin/secrets/{name}", s.HandleGetSecret)
+		m.HandleFunc("PUT /admin/secrets/{name}", s.HandlePutSecret)
+		m.HandleFunc("DELETE /admin/secrets/{name}", s.HandleDeleteSecret)
+	}
+	if s.webhooks != nil {
+		m.HandleFunc("GET /admin/webhooks", s.HandleListWebhooks)
+		m.HandleFunc("GET /admin/webhooks/{name}", s.HandleGetWebhook)
+		m.HandleFunc("PUT /admin/webhooks/{name}", s.HandlePutWebhook)
+		m.HandleFunc("DELETE /admin/webhooks/{name}", s.HandleDeleteWebhook)
+	}
+	if s.attachments != nil {
+		m.HandleFunc("GET /admin/attachments", s.HandleListAttachments)
+		m.HandleFunc("GET /admin/attachments/{name}", s.HandleGetAttachment)
+		m.HandleFunc("PUT /admin/attachments/{name}", s.HandlePutAttachment)
+		m.HandleFunc("DELETE /admin/attachments/{name}", s.HandleDeleteAttachment)
+	}
+	if s.follower != nil {
+		m.HandleFunc("GET /admin/replication", s.HandleReplicationStatus)
+	}
+	if s.cluster != nil {
+		m.HandleFunc("GET /admin/cluster", s.HandleClusterStatus)
+	}
+	m.HandleFunc("GET /usage", s.HandleUsage)
+	m.HandleFunc("GET /admin/tenants", s.HandleListTenantUsage)
+	if s.apiKeys != nil {
+		m.HandleFunc("GET /admin/keys", s.HandleListAPIKeys)
+		m.HandleFunc("POST /admin/keys", s.HandleCreateAPIKey)
+		m.HandleFunc("DELETE /admin/keys/{id}", s.HandleRevokeAPIKey)
+	}
+	if s.checkpointer != nil {
+		m.HandleFunc("GET /admin/checkpoint", s.HandleCheckpointStats)
+		m.HandleFunc("POST /admin/checkpoint", s.HandleCheckpoint)
+	}
+	if s.logLevel != nil {
+		m.HandleFunc("GET /admin/log-level", s.HandleGetLogLevel)
+		m.HandleFunc("PUT /admin/log-level", s.HandlePutLogLevel)
+	}
+	if s.debug {
+		s.handleDebug(m)
+	}
+	if s.ui {
+		s.handleUI(m)
+	}
+	if s.clickHouse {
+		s.handleClickHouse(m)
+	}
+	s.handleOpenAPI(m)
+	return m.ServeMux
 }
 
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	// Code names the error for clients: the LimitCode of a LimitError, schema_policy_violation for a
+	// SchemaPolicyError and else the status, e.g. not_found or internal_server_error.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details is the LimitError or SchemaPolicyError, empty for other errors.
+	Details any `json:"details,omitempty"`
+}
+
+// writeError responds with the ErrorResponse of the error. LimitError and SchemaPolicyError respond with 422 whatever
+// the code, server faults are logged with the message.
 func (s *Server) writeError(w http.ResponseWriter, code int, msg string, err error) {
+	res := ErrorResponse{Message: err.Error()}
+	var (
+		limitErr  *LimitError
+		policyErr *SchemaPolicyError
+		bodyErr   *http.MaxBytesError
+	)
+	switch {
+	case errors.As(err, &bodyErr):
+		code, res.Code = http.StatusRequestEntityTooLarge, "body_too_large"
+		res.Message = fmt.Sprintf("request body exceeds %d bytes", bodyErr.Limit)
+	case errors.As(err, &limitErr):
+		code, res.Code, res.Details = http.StatusUnprocessableEntity, string(limitErr.Code), limitErr
+	case errors.As(err, &policyErr):
+		code, res.Code, res.Details = http.StatusUnprocessableEntity, "schema_policy_violation", policyErr
+	default:
+		res.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(code)), " ", "_")
+	}
+	if code >= http.StatusInternalServerError {
+		slog.Error(msg, "err", err)
+	}
+	s.writeJSON(w, code, msg, res)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, msg string, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		slog.Error(msg, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	if _, err = w.Write([]byte(err.Error())); err != nil {
-		slog.Error("%s: %w", msg, err)
+	if _, err = w.Write(out); err != nil {
+		slog.Error(msg, "err", err)
 	}
 }
 
 func (s *Server) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	res, err := s.store.Query(r.Context(), &QueryStatement{
-		Query: r.URL.Query().Get("q"),
+	stmt, err := queryStatementFromURL(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle Query: parsing parameters", err)
+		return
+	}
+	s.writeQuery(w, r, stmt)
+}
+
+// queryStatementFromURL reads the statement of the GET query endpoints from the URL parameters.
+func queryStatementFromURL(r *http.Request) (*QueryStatement, error) {
+	stmt := &QueryStatement{
+		Query:  r.URL.Query().Get("q"),
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if stmt.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("parsing limit: %w", err)
+		}
+	}
+	return stmt, nil
+}
+
+// QueryRequest is the body of POST /query. Params are bound to the placeholders in SQL. Statements instead of SQL runs
+// several statements in one transaction and responds with a BatchResponse. AsOf reads the tables it names from the
+// snapshot with the given id or name instead, see Store.AsOf.
+type QueryRequest struct {
+	SQL        string            `json:"sql"`
+	Params     []any             `json:"params"`
+	Limit      int               `json:"limit"`
+	Cursor     string            `json:"cursor"`
+	Statements []BatchStatement  `json:"statements,omitempty"`
+	AsOf       map[string]string `json:"as_of,omitempty"`
+	// Destination writes the result to files, e.g. on an object store, and answers with their manifest.
+	Destination *QueryDestination `json:"destination,omitempty"`
+}
+
+func (s *Server) HandleQueryPost(w http.ResponseWriter, r *http.Request) {
+	s.handleQueryRequest(w, r, false)
+}
+
+// HandleAdminQuery is the opt-in path for statements that modify the database, e.g. DDL or DROP TABLE.
+func (s *Server) HandleAdminQuery(w http.ResponseWriter, r *http.Request) {
+	s.handleQueryRequest(w, r, true)
+}
+
+func (s *Server) handleQueryRequest(w http.ResponseWriter, r *http.Request, allowWrites bool) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle query: decoding request body", err)
+		return
+	}
+	if req.Destination != nil && (len(req.Statements) > 0 || req.Limit != 0 || req.Cursor != "") {
+		s.writeError(w, http.StatusBadRequest, "handle query",
+			fmt.Errorf("%w: statements, limit and cursor are not supported with a destination", ErrInvalidExport))
+		return
+	}
+	if len(req.Statements) > 0 {
+		s.writeBatch(w, r, &req, allowWrites)
+		return
+	}
+	query, err := s.store.AsOf(r.Context(), req.SQL, req.AsOf)
+	if errors.Is(err, ErrSnapshotNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle query: reading snapshots", err)
+		return
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	if req.Destination != nil {
+		s.writeQueryExport(w, r, &QueryStatement{Query: query, Params: req.Params}, *req.Destination)
+		return
+	}
+	s.writeQuery(w, r, &QueryStatement{
+		Query:       query,
+		Params:      req.Params,
+		AllowWrites: allowWrites,
+		Limit:       req.Limit,
+		Cursor:      req.Cursor,
 	})
+}
+
+// NextCursorHeader carries the cursor of the next page of a paginated query.
+const NextCursorHeader = "X-Next-Cursor"
+
+//nolint:gochecknoglobals // Read-only list of the formats offered by the query endpoints.
+var queryFormats = []Format{
+	FormatJSON, FormatNDJSON, FormatCSV, FormatMsgPack, FormatArrow, FormatParquet, FormatColumnar, FormatGeoJSON,
+}
+
+func (s *Server) writeQuery(w http.ResponseWriter, r *http.Request, stmt *QueryStatement) {
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+	format, err := Negotiate(r, queryFormats)
 	if err != nil {
-		// TODO: Setting standard error for now but should increase the resolution of error response codes.
-		s.writeError(w, http.StatusBadRequest, "handle Query: writing error response", err)
+		s.writeError(w, http.StatusNotAcceptable, "handle Query: negotiating format", err)
 		return
 	}
-	out, err := json.Marshal(res)
+	opts, err := parseEncodeOptions(r)
 	if err != nil {
-		s.writeError(w, http.StatusInternalServerError, "handle Query: writing json marshal error response", err)
+		s.writeError(w, http.StatusBadRequest, "handle Query", err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	if v := r.URL.Query().Get(ProfileParam); v != "" {
+		if stmt.Profile, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle Query: parsing profile", err)
+			return
+		}
+	}
+	if stmt.Profile {
+		if format != FormatJSON {
+			s.writeError(w, http.StatusBadRequest, "handle Query: parsing profile",
+				fmt.Errorf("profile is only supported for the %s format", FormatJSON.Name))
+			return
+		}
+		opts.envelope = true
+	}
+	session, err := s.requestSession(r)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle Query: resolving session", err)
+		return
+	}
+	if session != nil && (stmt.Profile || format == FormatParquet || format == FormatArrow) {
+		s.writeError(w, http.StatusBadRequest, "handle Query: resolving session",
+			errors.New("profiling and the parquet and arrow formats are not supported in sessions"))
+		return
+	}
+	failFast, err := parseOverflow(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle Query: parsing overflow", err)
+		return
+	}
+	if format == FormatGeoJSON {
+		if err = stmt.withGeoJSON(opts.geometry); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle Query: rewriting for geojson", err)
+			return
+		}
+	}
+	limits := s.requestResultLimits(r.Context())
+	limits.apply(stmt)
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+	switch format {
+	case FormatParquet:
+		s.writeCopy(w, r, stmt, format.ContentType, s.store.CopyParquet)
+		return
+	case FormatArrow:
+		s.writeCopy(w, r, stmt, format.ContentType, s.store.CopyArrow)
+		return
+	}
+	if s.streamable(r, stmt, format, session, failFast) {
+		s.writeStream(w, r, stmt, format, opts)
+		return
+	}
+	res, hit, err := s.fetch(r, stmt, session)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	markAuditRows(r.Context(), len(res.Rows))
+	if res.Truncated && failFast {
+		s.writeError(w, http.StatusRequestEntityTooLarge, "handle Query: limiting result",
+			fmt.Errorf("%w: more than %d rows", ErrResultTooLarge, limits.MaxRows))
+		return
+	}
+	buf, res, err := limits.encodeBounded(format, res, stmt, opts, failFast)
+	if errors.Is(err, ErrResultTooLarge) {
+		s.writeError(w, http.StatusRequestEntityTooLarge, "handle Query: limiting result", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle Query: encoding response", err)
+		return
+	}
+	if res.Truncated {
+		w.Header().Set(TruncatedHeader, "true")
+	}
+	if res.NextCursor != "" {
+		w.Header().Set(NextCursorHeader, res.NextCursor)
+	}
+	w.Header().Set(ColumnTypesHeader, FormatColumnTypes(res.Columns))
+	if s.cache != nil {
+		status := "miss"
+		if hit {
+			status = "hit"
+		}
+		w.Header().Set(CacheStatusHeader, status)
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	tag := etag(buf.Bytes())
+	enc := responseEncoding(r, buf.Len())
+	if enc != nil {
+		// The encoded body is a representation of its own, caches must not serve one for the other.
+		tag = strings.TrimSuffix(tag, `"`) + "-" + enc.name + `"`
+		w.Header().Set("Content-Encoding", enc.name)
+	}
+	w.Header().Set("ETag", tag)
+	if etagMatches(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	body := buf.Bytes()
+	if enc != nil {
+		if body, err = enc.compress(body); err != nil {
+			w.Header().Del("Content-Encoding")
+			s.writeError(w, http.StatusInternalServerError, "handle Query: compressing response", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", format.ContentType)
 	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write(out); err != nil {
-		slog.Error("handle Query: writing response: %w", err)
+	if _, err = w.Write(body); err != nil {
+		slog.Error("handle Query: writing response", "err", err)
 	}
 }
 
+// ColumnTypesHeader carries the DuckDB type of each result column for the formats that don't include it in the body.
+const ColumnTypesHeader = "X-Column-Types"
+
+// FormatColumnTypes encodes the columns as comma separated name=type pairs in column order, with names and types
+// query escaped.
+func FormatColumnTypes(cols []Column) string {
+	pairs := make([]string, len(cols))
+	for i, col := range cols {
+		pairs[i] = url.QueryEscape(col.Name) + "=" + url.QueryEscape(col.Type)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ProfileParam enables DuckDB profiling for the statement. The operator timings are returned in the profile of the
+// Envelope, so it implies the envelope parameter.
+const ProfileParam = "profile"
+
+// EnvelopeParam switches JSON responses from a bare array of rows to an Envelope.
+const EnvelopeParam = "envelope"
+
+// Envelope is the JSON response of the query endpoints when requested with the envelope parameter. Unlike the bare
+// array, it carries the column types and is never null for an empty result.
+type Envelope struct {
+	Columns    []Column         `json:"columns"`
+	Rows       []map[string]any `json:"rows"`
+	RowCount   int              `json:"row_count"`
+	ElapsedMS  int64            `json:"elapsed_ms"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	Profile    *QueryProfile    `json:"profile,omitempty"`
+	Truncated  bool             `json:"truncated,omitempty"`
+}
+
+func NewEnvelope(res *QueryResult) *Envelope {
+	e := &Envelope{
+		Columns:    res.Columns,
+		Rows:       res.Rows,
+		RowCount:   len(res.Rows),
+		ElapsedMS:  res.Elapsed.Milliseconds(),
+		NextCursor: res.NextCursor,
+		Profile:    res.Profile,
+		Truncated:  res.Truncated,
+	}
+	if e.Columns == nil {
+		e.Columns = []Column{}
+	}
+	if e.Rows == nil {
+		e.Rows = []map[string]any{}
+	}
+	return e
+}
+
+// encodeOptions are the options of the JSON encodings selected by the query parameters.
+type encodeOptions struct {
+	// envelope wraps the rows in an Envelope, see EnvelopeParam.
+	envelope bool
+	// bigintStrings writes the integers beyond 2^53 as strings, see BigIntParam.
+	bigintStrings bool
+	// geometry is the GEOMETRY column of the geojson format, see GeometryParam.
+	geometry string
+}
+
+// parseEncodeOptions parses the envelope, bigint and geometry parameters.
+func parseEncodeOptions(r *http.Request) (encodeOptions, error) {
+	opts := encodeOptions{geometry: defaultGeometryColumn}
+	if v := r.URL.Query().Get(GeometryParam); v != "" {
+		opts.geometry = v
+	}
+	var err error
+	if v := r.URL.Query().Get(EnvelopeParam); v != "" {
+		if opts.envelope, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("parsing %s: %w", EnvelopeParam, err)
+		}
+	}
+	if opts.bigintStrings, err = parseBigInt(r); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// encodeResult writes the result in one of the formats that are encoded from scanned rows.
+func encodeResult(w io.Writer, format Format, res *QueryResult, opts encodeOptions) error {
+	if format == FormatMsgPack {
+		return writeMsgPack(w, res)
+	}
+	return writeRows(newRowWriter(w, format, opts), res)
+}
+
+// writeNDJSON writes one JSON object per row and line.
+func writeNDJSON(w io.Writer, res *QueryResult) error {
+	return writeRows(newRowWriter(w, FormatNDJSON, encodeOptions{}), res)
+}
+
+func (s *Server) writeQueryError(w http.ResponseWriter, err error) {
+	var readOnlyErr *ReadOnlyError
+	if errors.As(err, &readOnlyErr) && readOnlyErr.unknown() {
+		s.writeError(w, http.StatusBadRequest, "handle Query: writing syntax error response", err)
+		return
+	}
+	if errors.As(err, &readOnlyErr) {
+		s.writeError(w, http.StatusForbidden, "handle Query: writing read-only error response", err)
+		return
+	}
+	var policyErr *SQLPolicyError
+	if errors.Is(err, ErrTableAccessDenied) || errors.As(err, &policyErr) {
+		s.writeError(w, http.StatusForbidden, "handle Query: writing access error response", err)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.writeError(w, http.StatusGatewayTimeout, "handle Query: writing timeout error response", err)
+		return
+	}
+	if errors.Is(err, ErrNotLeader) {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, "handle Query: writing cluster error response", err)
+		return
+	}
+	if errors.Is(err, ErrTooManyQueries) {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusTooManyRequests, "handle Query: writing concurrency error response", err)
+		return
+	}
+	if errors.Is(err, ErrTableNotFound) || missingTableRegex.MatchString(err.Error()) {
+		s.writeError(w, http.StatusNotFound, "handle Query: writing not found error response", err)
+		return
+	}
+	if serverFaultRegex.MatchString(err.Error()) {
+		s.writeError(w, http.StatusInternalServerError, "handle Query", err)
+		return
+	}
+	// The remaining errors are those of the statement, e.g. its syntax or unknown columns.
+	s.writeError(w, http.StatusBadRequest, "handle Query: writing error response", err)
+}
+
+// serverFaultRegex matches the DuckDB errors that aren't caused by the statement.
+var serverFaultRegex = regexp.MustCompile(`(^|: )(IO|Out of Memory|INTERNAL|FATAL) Error: `)
+
+// writeCopy writes formats that the store encodes itself straight to the response.
+func (s *Server) writeCopy(
+	w http.ResponseWriter,
+	r *http.Request,
+	stmt *QueryStatement,
+	contentType string,
+	copyFn func(context.Context, *QueryStatement, io.Writer) error,
+) {
+	dw := &deferredHeaderWriter{w: w, contentType: contentType}
+	started := time.Now()
+	err := copyFn(r.Context(), stmt, dw)
+	s.record(r, stmt, started, nil, false, err)
+	if err != nil {
+		if dw.written {
+			slog.Error("handle Query: writing response", "err", err, "content_type", contentType)
+			return
+		}
+		s.writeQueryError(w, err)
+	}
+}
+
+// deferredHeaderWriter writes the success headers on the first write, so an error before any output can still be
+// reported with a proper status.
+type deferredHeaderWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	written     bool
+}
+
+func (d *deferredHeaderWriter) Write(p []byte) (int, error) {
+	if !d.written {
+		d.written = true
+		d.w.Header().Set("Content-Type", d.contentType)
+		d.w.WriteHeader(http.StatusOK)
+	}
+	return d.w.Write(p)
+}
+
+// RequestIDHeader carries the id of a write request. The server generates one if the client sends none, and
+// responds with it either way.
+const RequestIDHeader = "X-Request-ID"
+
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		var err error
+		if id, err = newID(); err != nil {
+			slog.Error("generating request id", "err", err)
+			return ""
+		}
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// HandleData accepts either a single JSON object or an array of objects to be inserted as a batch.
 func (s *Server) HandleData(w http.ResponseWriter, r *http.Request) {
-	var columns map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&columns); err != nil {
-		s.writeError(w, http.StatusBadRequest, "handle data: decoding request body", err)
+	s.limitBody(w, r)
+	markAudit(r.Context(), AuditIngest, r.URL.Query().Get("Table"))
+	stmt, ok := s.decodeData(w, r, "handle data")
+	if !ok {
 		return
 	}
+	var err error
+	if s.coalescer != nil {
+		err = s.coalescedInsert(r.Context(), stmt)
+	} else {
+		release, ok := s.acquireWrite(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+		err = s.store.Insert(r.Context(), stmt)
+	}
+	switch {
+	case errors.Is(err, ErrTooManyWrites), errors.Is(err, ErrWritePathBusy), errors.Is(err, ErrNotLeader):
+		s.rejectWrite(w, err)
+	case errors.Is(err, ErrInvalidInsert), errors.Is(err, ErrConstraintViolation), errors.Is(err, ErrGeneratedColumn):
+		s.writeError(w, http.StatusUnprocessableEntity, "handle data", err)
+	case errors.Is(err, ErrTypeConflict), errors.Is(err, ErrConstrainedColumn):
+		s.writeError(w, http.StatusConflict, "handle data", err)
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, "handle data", err)
+	default:
+		markAuditRows(r.Context(), len(stmt.rows()))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// decodeData decodes the row or the array of rows of the body into a valid statement for the table of the Table
+// parameter, writing the error response and returning false otherwise.
+func (s *Server) decodeData(w http.ResponseWriter, r *http.Request, msg string) (*InsertStatement, bool) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, http.StatusBadRequest, msg+": decoding request body", err)
+		return nil, false
+	}
 	stmt := &InsertStatement{
-		Table:   r.URL.Query().Get("Table"),
-		Columns: columns,
+		Table:     r.URL.Query().Get("Table"),
+		RequestID: requestID(w, r),
 	}
-	if err := stmt.Validate(); err != nil {
-		s.writeError(w, http.StatusBadRequest, "handle data: validating insert statement", err)
+	target := any(&stmt.Columns)
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		target = &stmt.Rows
 	}
-	if err := s.store.Insert(r.Context(), stmt); err != nil {
-		// TODO: Setting standard error for now but should increase the resolution of error response codes.
-		s.writeError(w, http.StatusInternalServerError, "writing error response", err)
-		return
+	if err := decodeRows(body, target); err != nil {
+		s.writeError(w, http.StatusBadRequest, msg+": decoding request body", err)
+		return nil, false
 	}
-	w.WriteHeader(http.StatusOK)
+	if err := stmt.Validate(); err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, msg+": validating insert statement", err)
+		return nil, false
+	}
+	return stmt, true
+}
+
+// HandleTypes describes the supported column types and the coercion rules applied by this server.
+func (s *Server) HandleTypes(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle types: writing response", NewTypeCatalog(s.store.Limits()))
 }
@@ -1,20 +1,56 @@
 package internal_test
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"scratch/internal"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/flight"
+	"github.com/apache/arrow/go/v14/arrow/flight/flightsql"
+	"github.com/apache/arrow/go/v14/arrow/ipc"
+	"github.com/apache/arrow/go/v14/arrow/memory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestServerBasicOperations(t *testing.T) {
@@ -53,6 +89,109 @@ func TestServerBasicOperations(t *testing.T) {
 	assert.Len(t, data[0], 2)
 }
 
+func TestServerInsertIdentifiers(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	post := func(table, body string) int {
+		res, postErr := http.Post(server.URL+"/data?Table="+url.QueryEscape(table), "application/json",
+			bytes.NewBufferString(body))
+		require.NoError(t, postErr)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	// Reserved words are quoted.
+	require.Equal(t, http.StatusOK, post("order", `{"select": 1, "from": "a"}`))
+	require.Equal(t, http.StatusOK, post("order", `{"select": 2, "group": true}`))
+	res, err := store.Fetch(context.Background(), &internal.QueryStatement{
+		Query: `SELECT "select", "group" FROM "order" ORDER BY "select"`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"select": 1.0, "group": nil}, {"select": 2.0, "group": true}}, res.Rows)
+
+	for table, body := range map[string]string{
+		"x; DROP TABLE y": `{"a": 1}`,
+		"bad name":        `{"a": 1}`,
+		"events":          `{"a) VALUES (1); DROP TABLE y; --": 1}`,
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, post(table, body), table)
+	}
+}
+
+func TestServerErrorResponses(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	post := func(path, body string) (int, internal.ErrorResponse) {
+		res, postErr := http.Post(server.URL+path, "application/json", bytes.NewBufferString(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.ErrorResponse
+		if res.StatusCode != http.StatusOK {
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	status, _ := post("/data?Table=events", `{"n": 1}`)
+	require.Equal(t, http.StatusOK, status)
+
+	for _, tc := range []struct {
+		path, body string
+		status     int
+		code       string
+	}{
+		{"/query", `{"sql": "select * from missing"}`, http.StatusNotFound, "not_found"},
+		{"/query", `{"sql": "selec 1"}`, http.StatusBadRequest, "bad_request"},
+		{"/query", `{"sql": "select nope from events"}`, http.StatusBadRequest, "bad_request"},
+		{"/data?Table=events", `{"n": "one"}`, http.StatusConflict, "conflict"},
+		{"/data?Table=events", `{}`, http.StatusUnprocessableEntity, "unprocessable_entity"},
+		{"/data?Table=events", `{"n": `, http.StatusBadRequest, "bad_request"},
+	} {
+		status, res := post(tc.path, tc.body)
+		assert.Equal(t, tc.status, status, tc.body)
+		assert.Equal(t, tc.code, res.Code, tc.body)
+		assert.NotEmpty(t, res.Message, tc.body)
+	}
+}
+
+func TestServerBodyLimit(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithMaxBodyBytes(64)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	res, err := http.Post(server.URL+"/data?Table=events", "application/json", bytes.NewBufferString(`{"n": 1}`))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	body := `{"s": "` + strings.Repeat("x", 64) + `"}`
+	res, err = http.Post(server.URL+"/data?Table=events", "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	var out internal.ErrorResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(t, "body_too_large", out.Code)
+	assert.Equal(t, "request body exceeds 64 bytes", out.Message)
+}
+
 func BenchmarkServerWrites(b *testing.B) {
 	store, err := internal.NewDuckDBStore()
 	require.NoError(b, err)
@@ -81,6 +220,7022 @@ func BenchmarkServerWrites(b *testing.B) {
 	}
 }
 
+func BenchmarkServerQuery(b *testing.B) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		assert.NoError(b, store.Close())
+	})
+	query := url.QueryEscape("select range as id, 'user-' || range as name, range * 1.5 as value from range(10000)")
+
+	for _, bc := range []struct {
+		name   string
+		limits internal.ResultLimits
+	}{
+		{name: "buffered", limits: internal.ResultLimits{MaxBytes: 64 << 20}},
+		{name: "streamed"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server := httptest.NewServer(internal.NewServer(store, internal.WithResultLimits(bc.limits)).NewServeMux())
+			b.Cleanup(server.Close)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				res, getErr := http.Get(fmt.Sprintf("%s/query?format=ndjson&q=%s", server.URL, query))
+				require.NoError(b, getErr)
+				_, copyErr := io.Copy(io.Discard, res.Body)
+				require.NoError(b, copyErr)
+				_ = res.Body.Close()
+				require.Equal(b, http.StatusOK, res.StatusCode)
+			}
+		})
+	}
+}
+
 func randStr() string {
 	return fmt.Sprintf("%x", rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
 }
+
+func TestServerTypes(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	res, err := http.Get(fmt.Sprintf("%s/types", server.URL))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var catalog internal.TypeCatalog
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&catalog))
+	require.Len(t, catalog.Types, 10)
+	assert.Equal(t, "VARCHAR", catalog.Types[0].Name)
+	assert.Equal(t, []internal.JSONKind{internal.JSONString}, catalog.Types[0].InferredFrom)
+	assert.Equal(t, "ENUM", catalog.Types[8].Name)
+	assert.Empty(t, catalog.Types[8].InferredFrom)
+	assert.Equal(t, []internal.Coercion{{
+		From: internal.JSONString, Rule: internal.CoercionParse,
+		Note: "new values are added to the type unless it is strict",
+	}}, catalog.Types[8].Coercions)
+}
+
+func TestServerQueryParams(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	postRes, err := http.Post(
+		fmt.Sprintf("%s/data?Table=http_test_table", server.URL),
+		"application/json",
+		bytes.NewBufferString(`[{"column_a": "a", "column_b": 1}, {"column_a": "b", "column_b": 2}]`),
+	)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, postRes.StatusCode)
+
+	queryRes, err := http.Post(
+		fmt.Sprintf("%s/query", server.URL),
+		"application/json",
+		bytes.NewBufferString(`{
+			"sql": "select * from http_test_table where column_a = ? and column_b = ?",
+			"params": ["b", 2]
+		}`),
+	)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, queryRes.StatusCode)
+	defer func() {
+		_ = queryRes.Body.Close()
+	}()
+
+	var data []map[string]any
+	require.NoError(t, json.NewDecoder(queryRes.Body).Decode(&data))
+	require.Len(t, data, 1)
+	assert.Equal(t, "b", data[0]["column_a"])
+}
+
+func TestServerReadOnlyQuery(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	getRes, err := http.Get(fmt.Sprintf("%s/query?q=%s", server.URL, url.QueryEscape("create table t (a int)")))
+	require.NoError(t, err)
+	_ = getRes.Body.Close()
+	assert.Equal(t, http.StatusForbidden, getRes.StatusCode)
+
+	postRes, err := http.Post(
+		fmt.Sprintf("%s/query", server.URL),
+		"application/json",
+		bytes.NewBufferString(`{"sql": "create table t (a int)"}`),
+	)
+	require.NoError(t, err)
+	_ = postRes.Body.Close()
+	assert.Equal(t, http.StatusForbidden, postRes.StatusCode)
+
+	adminRes, err := http.Post(
+		fmt.Sprintf("%s/admin/query", server.URL),
+		"application/json",
+		bytes.NewBufferString(`{"sql": "create table t (a int)"}`),
+	)
+	require.NoError(t, err)
+	_ = adminRes.Body.Close()
+	assert.Equal(t, http.StatusOK, adminRes.StatusCode)
+}
+
+func TestServerQueryStream(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	res, err := http.Get(fmt.Sprintf(
+		"%s/query/stream?chunk=2&q=%s",
+		server.URL,
+		url.QueryEscape("select * from range(5)"),
+	))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	var events []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if event, ok := strings.CutPrefix(line, "event: "); ok && event != internal.EventProgress {
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, []string{
+		internal.EventStart,
+		internal.EventColumns,
+		internal.EventRows,
+		internal.EventRows,
+		internal.EventRows,
+		internal.EventDone,
+	}, events)
+}
+
+func TestServerQueryCSV(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	query := url.QueryEscape(`select 'a,b' as "x", 1.5 as y, null as z union all select 'say "hi"', 2, true`)
+	res, err := http.Get(fmt.Sprintf("%s/query?format=csv&q=%s", server.URL, query))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "x=VARCHAR,y=DECIMAL%2811%2C1%29,z=BOOLEAN", res.Header.Get(internal.ColumnTypesHeader))
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "x,y,z\n\"a,b\",1.5,\n\"say \"\"hi\"\"\",2.0,true\n", string(body))
+}
+
+func TestServerQueryParquet(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	query := url.QueryEscape("select range as a, 'x' as b from range(10)")
+	res, err := http.Get(fmt.Sprintf("%s/query?format=parquet&limit=4&q=%s", server.URL, query))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(body, []byte("PAR1")))
+
+	path := filepath.Join(t.TempDir(), "result.parquet")
+	require.NoError(t, os.WriteFile(path, body, 0o600))
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: fmt.Sprintf("select * from read_parquet('%s')", path),
+	})
+	require.NoError(t, err)
+	assert.Len(t, rows, 4)
+
+	errRes, err := http.Get(fmt.Sprintf("%s/query?format=parquet&q=%s", server.URL, url.QueryEscape("drop table x")))
+	require.NoError(t, err)
+	_ = errRes.Body.Close()
+	assert.Equal(t, http.StatusForbidden, errRes.StatusCode)
+}
+
+func TestServerQueryArrow(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	req, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("%s/query?q=%s", server.URL, url.QueryEscape("select 9007199254740993::BIGINT as a, 'x' as b")),
+		nil,
+	)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/vnd.apache.arrow.stream")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	reader, err := ipc.NewReader(res.Body)
+	require.NoError(t, err)
+	defer reader.Release()
+	assert.Equal(t, arrow.PrimitiveTypes.Int64, reader.Schema().Field(0).Type)
+	require.True(t, reader.Next())
+	record := reader.Record()
+	require.EqualValues(t, 1, record.NumRows())
+	column, ok := record.Column(0).(*array.Int64)
+	require.True(t, ok)
+	assert.Equal(t, int64(9007199254740993), column.Value(0))
+}
+
+func TestServerQueryFormats(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	for _, tc := range []struct {
+		format      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			format:      "ndjson",
+			status:      http.StatusOK,
+			contentType: "application/x-ndjson",
+			body:        "{\"a\":1}\n{\"a\":2}\n",
+		},
+		{
+			format:      "msgpack",
+			status:      http.StatusOK,
+			contentType: "application/vnd.msgpack",
+			body:        "\x92\x81\xa1a\x01\x81\xa1a\x02",
+		},
+		{
+			format:      "columnar",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"a":[1,2]}`,
+		},
+		{format: "xml", status: http.StatusNotAcceptable},
+	} {
+		res, getErr := http.Get(fmt.Sprintf(
+			"%s/query?format=%s&q=%s",
+			server.URL,
+			tc.format,
+			url.QueryEscape("select 1 as a union all select 2 order by a"),
+		))
+		require.NoError(t, getErr)
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		require.Equal(t, tc.status, res.StatusCode, tc.format)
+		if tc.status == http.StatusOK {
+			assert.Equal(t, tc.contentType, res.Header.Get("Content-Type"))
+			assert.Equal(t, tc.body, string(body))
+		}
+	}
+}
+
+func TestServerQueryColumnar(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	for query, body := range map[string]string{
+		"select 'x' as z, range as a, null as n from range(3)": `{"z":["x","x","x"],"a":[0,1,2],"n":[null,null,null]}`,
+		"select 1 as b, 2 as a from range(0)":                  `{"b":[],"a":[]}`,
+	} {
+		res, getErr := http.Get(fmt.Sprintf("%s/query?format=columnar&q=%s", server.URL, url.QueryEscape(query)))
+		require.NoError(t, getErr)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode, query)
+		assert.Equal(t, body, string(out), query)
+	}
+}
+
+func TestServerBigIntegers(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	const huge = "170141183460469231731687303715884105727"
+	res, err := http.Post(server.URL+"/data?Table=big", "application/json",
+		strings.NewReader(`[{"id": 9007199254740993, "huge": `+huge+`, "n": 1}, {"id": -9007199254740993, "n": 2.5}]`))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	query := url.QueryEscape("select id, huge, n from big order by n")
+	for params, body := range map[string]string{
+		"": `[{"huge":` + huge + `,"id":9007199254740993,"n":1},{"huge":null,"id":-9007199254740993,"n":2.5}]`,
+		"&bigint=string": `[{"huge":"` + huge + `","id":"9007199254740993","n":1},` +
+			`{"huge":null,"id":"-9007199254740993","n":2.5}]`,
+		"&bigint=string&format=columnar": `{"id":["9007199254740993","-9007199254740993"],"huge":["` + huge +
+			`",null],"n":[1,2.5]}`,
+	} {
+		res, err = http.Get(server.URL + "/query?q=" + query + params)
+		require.NoError(t, err)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode, params)
+		assert.Equal(t, "id=BIGINT,huge=HUGEINT,n=DOUBLE", res.Header.Get(internal.ColumnTypesHeader), params)
+		assert.Equal(t, body, string(out), params)
+	}
+
+	res, err = http.Get(server.URL + "/query?bigint=text&q=" + query)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServerDecimals(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		return res, string(out)
+	}
+
+	res, _ := do(http.MethodPut, "/tables/payments/config",
+		`{"decimal_strings": true, "columns": [{"name": "fee", "type": "DECIMAL(10,2)"}]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, _ = do(http.MethodPut, "/tables/invalid/config", `{"columns": [{"name": "fee", "type": "DECIMAL(40,2)"}]}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body := do(http.MethodPost, "/data?Table=payments",
+		`[{"amount": "12.30", "fee": 0.1, "note": "1.5"}, {"amount": "-0.05", "fee": "1.25", "note": "n/a"}]`)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	schema, err := store.TableSchema(context.Background(), "payments")
+	require.NoError(t, err)
+	types := map[string]string{}
+	for _, col := range schema.Columns {
+		types[col.Name] = col.Type
+	}
+	assert.Equal(t, map[string]string{"amount": "DECIMAL(18,2)", "fee": "DECIMAL(10,2)", "note": "VARCHAR"}, types)
+
+	query := url.QueryEscape("select amount, fee from payments order by amount")
+	for params, want := range map[string]string{
+		"":                 `[{"amount":-0.05,"fee":1.25},{"amount":12.30,"fee":0.10}]`,
+		"&format=ndjson":   "{\"amount\":-0.05,\"fee\":1.25}\n{\"amount\":12.30,\"fee\":0.10}\n",
+		"&format=csv":      "amount,fee\n-0.05,1.25\n12.30,0.10\n",
+		"&format=columnar": `{"amount":[-0.05,12.30],"fee":[1.25,0.10]}`,
+	} {
+		res, body = do(http.MethodGet, "/query?q="+query+params, "")
+		require.Equal(t, http.StatusOK, res.StatusCode, params)
+		assert.Equal(t, want, body, params)
+	}
+}
+
+func TestServerBlobs(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		return res, string(out)
+	}
+
+	res, _ := do(http.MethodPut, "/tables/traces/config", `{"columns": [{"name": "trace", "type": "BLOB"}]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, body := do(http.MethodPost, "/data?Table=traces", `{"name": "a", "trace": "AAFiaW5hcnk="}`)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	res, _ = do(http.MethodPost, "/data?Table=traces", `{"name": "b", "trace": "not base64"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	query := url.QueryEscape("select name, trace, octet_length(trace) as n from traces")
+	res, body = do(http.MethodGet, "/query?q="+query, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `[{"n":8,"name":"a","trace":"AAFiaW5hcnk="}]`, body)
+}
+
+func TestServerEnums(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		return res, string(out)
+	}
+	types := func() map[string]string {
+		schema, schemaErr := store.TableSchema(context.Background(), "orders")
+		require.NoError(t, schemaErr)
+		out := map[string]string{}
+		for _, col := range schema.Columns {
+			out[col.Name] = col.Type
+		}
+		return out
+	}
+
+	for _, body := range []string{
+		`{"columns": [{"name": "status", "type": "VARCHAR", "enum": ["new"]}]}`,
+		`{"columns": [{"name": "status", "enum": ["new", "new"]}]}`,
+		`{"columns": [{"name": "status", "strict_enum": true}]}`,
+	} {
+		res, _ := do(http.MethodPut, "/tables/orders/config", body)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+	}
+	res, _ := do(http.MethodPut, "/tables/orders/config", `{"columns": [
+		{"name": "status", "enum": ["new", "paid"]},
+		{"name": "kind", "enum": ["a"], "strict_enum": true}
+	]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, body := do(http.MethodPost, "/data?Table=orders", `{"status": "new", "kind": "a"}`)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, map[string]string{"status": "ENUM('new', 'paid')", "kind": "ENUM('a')"}, types())
+
+	res, body = do(http.MethodPost, "/data?Table=orders", `[{"status": "shipped", "kind": "a"}, {"status": "new"}]`)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, "ENUM('new', 'paid', 'shipped')", types()["status"])
+
+	res, _ = do(http.MethodPost, "/data?Table=orders", `{"status": "new", "kind": "b"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	query := url.QueryEscape("select status, count(*)::INTEGER as n from orders group by status order by status")
+	res, body = do(http.MethodGet, "/query?q="+query, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `[{"n":2,"status":"new"},{"n":1,"status":"shipped"}]`, body)
+}
+
+func TestServerGeometry(t *testing.T) {
+	_, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{Extensions: []string{"no such"}}))
+	require.Error(t, err)
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{Extensions: []string{"spatial"}}))
+	if errors.Is(err, internal.ErrExtensionUnavailable) {
+		t.Skipf("the spatial extension is not available: %v", err)
+	}
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		_ = res.Body.Close()
+		return res, string(out)
+	}
+
+	res, _ := do(http.MethodPut, "/tables/places/config", `{"columns": [{"name": "geometry", "type": "GEOMETRY"}]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, body := do(http.MethodPost, "/data?Table=places", `[
+		{"name": "a", "geometry": "POINT (1 2)"},
+		{"name": "b", "geometry": {"lat": 52.5, "lon": 13.4}},
+		{"name": "c", "geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}}
+	]`)
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	res, _ = do(http.MethodPost, "/data?Table=places", `{"name": "d", "geometry": {"type": "Circle"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	query := url.QueryEscape("select name from places where " +
+		"ST_Intersects(geometry, ST_GeomFromText('POLYGON ((0 0, 0 3, 3 3, 3 0, 0 0))')) order by name")
+	res, body = do(http.MethodGet, "/query?q="+query, "")
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, `[{"name":"a"},{"name":"c"}]`, body)
+
+	query = url.QueryEscape("select name, geometry from places where name = 'a'")
+	res, body = do(http.MethodGet, "/query?format=geojson&q="+query, "")
+	require.Equal(t, http.StatusOK, res.StatusCode, body)
+	assert.Equal(t, "application/geo+json", res.Header.Get("Content-Type"))
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &collection))
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	require.Len(t, collection.Features, 1)
+	assert.Equal(t, "Point", collection.Features[0].Geometry.Type)
+	assert.Equal(t, []float64{1, 2}, collection.Features[0].Geometry.Coordinates)
+	assert.Equal(t, map[string]any{"name": "a"}, collection.Features[0].Properties)
+}
+
+func TestServerQueryEnvelope(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	for query, rowCount := range map[string]int{
+		"select 1::BIGINT as a, 'x' as b":                   1,
+		"select 1::BIGINT as a, 'x' as b from range(0)":     0,
+		"select range::BIGINT as a, 'x' as b from range(3)": 3,
+	} {
+		res, getErr := http.Get(fmt.Sprintf("%s/query?envelope=true&q=%s", server.URL, url.QueryEscape(query)))
+		require.NoError(t, getErr)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var envelope internal.Envelope
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&envelope))
+		_ = res.Body.Close()
+
+		assert.Equal(t, []internal.Column{{Name: "a", Type: "BIGINT"}, {Name: "b", Type: "VARCHAR"}}, envelope.Columns)
+		assert.Equal(t, rowCount, envelope.RowCount)
+		assert.Len(t, envelope.Rows, rowCount)
+		assert.NotNil(t, envelope.Rows)
+	}
+}
+
+func TestServerQueryTimeout(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithMaxQueryTimeout(time.Minute)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	slow := url.QueryEscape("select sum(a.range * b.range) from range(100000000) a, range(1000) b")
+	for _, test := range []struct {
+		params string
+		status int
+	}{
+		{params: "timeout=50ms&q=" + slow, status: http.StatusGatewayTimeout},
+		{params: "timeout=5s&q=" + url.QueryEscape("select 1"), status: http.StatusOK},
+		{params: "timeout=1h&q=" + url.QueryEscape("select 1"), status: http.StatusOK},
+		{params: "timeout=soon&q=" + url.QueryEscape("select 1"), status: http.StatusBadRequest},
+		{params: "timeout=-1s&q=" + url.QueryEscape("select 1"), status: http.StatusBadRequest},
+	} {
+		start := time.Now()
+		res, getErr := http.Get(fmt.Sprintf("%s/query?%s", server.URL, test.params))
+		require.NoError(t, getErr)
+		_ = res.Body.Close()
+		assert.Equal(t, test.status, res.StatusCode, test.params)
+		assert.Less(t, time.Since(start), 10*time.Second, test.params)
+	}
+}
+
+func TestServerQueryJobs(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	create := func(sql string) (int, internal.Job) {
+		body, marshalErr := json.Marshal(internal.QueryRequest{SQL: sql})
+		require.NoError(t, marshalErr)
+		res, postErr := http.Post(server.URL+"/queries", "application/json", bytes.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var job internal.Job
+		if res.StatusCode == http.StatusAccepted {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+		}
+		return res.StatusCode, job
+	}
+	get := func(id string) internal.Job {
+		res, getErr := http.Get(server.URL + "/queries/" + id)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var job internal.Job
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+		return job
+	}
+
+	status, job := create("select range as n from range(5)")
+	require.Equal(t, http.StatusAccepted, status)
+	require.Eventually(t, func() bool {
+		return get(job.ID).Status == internal.JobSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 5, get(job.ID).RowCount)
+
+	var pages [][]map[string]any
+	next := server.URL + "/queries/" + job.ID + "/results?limit=2"
+	for next != "" {
+		res, getErr := http.Get(next)
+		require.NoError(t, getErr)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var page []map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+		_ = res.Body.Close()
+		pages = append(pages, page)
+		next = ""
+		if cursor := res.Header.Get(internal.NextCursorHeader); cursor != "" {
+			next = server.URL + "/queries/" + job.ID + "/results?cursor=" + cursor
+		}
+	}
+	require.Len(t, pages, 3)
+	assert.Len(t, pages[2], 1)
+
+	status, job = create("select sum(a.range * b.range) from range(100000000) a, range(1000) b")
+	require.Equal(t, http.StatusAccepted, status)
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/queries/"+job.ID, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, internal.JobCancelled, get(job.ID).Status)
+	res, err = http.Get(server.URL + "/queries/" + job.ID + "/results")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	status, _ = create("drop table t")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	res, err = http.Get(server.URL + "/queries/unknown")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServerQueryJobOwners(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "alice", Key: "alice-key"},
+		{Name: "bob", Key: "bob-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, key, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res
+	}
+
+	res := do(http.MethodPost, "/queries", "alice-key", `{"sql": "select 42 as n"}`)
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	var job internal.Job
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+	assert.Equal(t, "key:alice", job.Caller)
+	require.Eventually(t, func() bool {
+		var status internal.Job
+		require.NoError(t, json.NewDecoder(do(http.MethodGet, "/queries/"+job.ID, "alice-key", "").Body).Decode(&status))
+		return status.Status == internal.JobSucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Other keys can't tell the job exists.
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queries/"+job.ID, "bob-key", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queries/"+job.ID+"/results", "bob-key", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/queries/"+job.ID, "bob-key", "").StatusCode)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/queries/"+job.ID+"/results", "alice-key", "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/queries/"+job.ID+"/results", "root-key", "").StatusCode)
+}
+
+func TestServerKillQuery(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	slow := "select sum(a.range * b.range) from range(100000000) a, range(1000) b"
+	status := make(chan int, 1)
+	go func() {
+		res, getErr := http.Get(fmt.Sprintf("%s/query?q=%s", server.URL, url.QueryEscape(slow)))
+		if getErr != nil {
+			status <- 0
+			return
+		}
+		_ = res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	var queries []internal.InFlightQuery
+	require.Eventually(t, func() bool {
+		res, getErr := http.Get(server.URL + "/admin/queries")
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&queries))
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, slow, queries[0].SQL)
+	assert.NotEmpty(t, queries[0].Caller)
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/queries/"+queries[0].ID, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	select {
+	case code := <-status:
+		assert.NotEqual(t, http.StatusOK, code)
+	case <-time.After(10 * time.Second):
+		t.Fatal("query was not interrupted")
+	}
+
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServerSavedQueries(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	saved := internal.SavedQuery{
+		SQL:    "select range as n from range(10) where range < $1 and range >= $2",
+		Params: []string{"upto", "from"},
+	}
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/queries/saved/numbers", saved).StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/queries/saved/numbers", saved).StatusCode)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/queries/saved/drop", internal.SavedQuery{
+		SQL: "drop table t",
+	}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/queries/saved/bad%20name", saved).StatusCode)
+
+	res := do(http.MethodGet, "/queries/saved/numbers", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var got internal.SavedQuery
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	assert.Equal(t, "numbers", got.Name)
+	assert.Equal(t, saved.Params, got.Params)
+
+	res = do(http.MethodGet, "/queries/saved", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var list []internal.SavedQuery
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	assert.Len(t, list, 1)
+
+	res = do(http.MethodPost, "/queries/saved/numbers", internal.RunSavedQueryRequest{
+		Params: map[string]any{"upto": 5, "from": 3},
+	})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var rows []map[string]any
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&rows))
+	assert.Equal(t, []map[string]any{{"n": float64(3)}, {"n": float64(4)}}, rows)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queries/saved/numbers", internal.RunSavedQueryRequest{
+		Params: map[string]any{"upto": 5},
+	}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queries/saved/numbers", internal.RunSavedQueryRequest{
+		Params: map[string]any{"upto": 5, "from": 3, "other": 1},
+	}).StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/queries/saved/numbers", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queries/saved/numbers", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/queries/saved/numbers", nil).StatusCode)
+}
+
+func TestServerSchedules(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	scheduler := internal.NewScheduler(store, time.Minute)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithScheduler(scheduler)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	run := func(name string) internal.Schedule {
+		res := do(http.MethodPost, "/admin/schedules/"+name+"/run", nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var sch internal.Schedule
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&sch))
+		return sch
+	}
+	count := func(table string) float64 {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "select count(*)::DOUBLE as n from " + table,
+		})
+		require.NoError(t, queryErr)
+		return rows[0]["n"].(float64)
+	}
+
+	res := do(http.MethodPut, "/admin/schedules/rollup", internal.Schedule{
+		Cron:  "@hourly",
+		SQL:   "select range as n, 'x' as label from range(3)",
+		Table: "rollup",
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var sch internal.Schedule
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&sch))
+	assert.Equal(t, internal.WriteAppend, sch.Mode)
+	require.NotNil(t, sch.NextRun)
+	assert.Zero(t, sch.NextRun.Minute())
+
+	assert.EqualValues(t, 3, run("rollup").LastRows)
+	assert.EqualValues(t, 3, run("rollup").LastRows)
+	assert.InDelta(t, 6, count("rollup"), 0)
+
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/admin/schedules/rollup", internal.Schedule{
+		Cron:  "0 0 * * *",
+		SQL:   "select range as n from range(2)",
+		Table: "rollup",
+		Mode:  internal.WriteReplace,
+	}).StatusCode)
+	sch = run("rollup")
+	assert.Empty(t, sch.LastError)
+	assert.EqualValues(t, 2, sch.LastRows)
+	assert.InDelta(t, 2, count("rollup"), 0)
+
+	for _, invalid := range []internal.Schedule{
+		{Cron: "61 * * * *", SQL: "select 1", Table: "t"},
+		{Cron: "@daily", SQL: "drop table rollup", Table: "t"},
+		{Cron: "@daily", SQL: "select 1", Table: "bad name"},
+		{Cron: "@daily", SQL: "select 1", Table: "t", Mode: "upsert"},
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/schedules/invalid", invalid).StatusCode)
+	}
+
+	res = do(http.MethodGet, "/admin/schedules", nil)
+	var list []internal.Schedule
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	assert.Len(t, list, 1)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/schedules/rollup", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/schedules/rollup", nil).StatusCode)
+}
+
+func TestServerMaterializedViews(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	views := internal.NewViews(store, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	go views.Run(ctx)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithViews(views)).NewServeMux())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(n int) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "events",
+			Columns: map[string]any{"kind": "click", "n": n},
+		}))
+	}
+	total := func() any {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{Query: "select total from totals"})
+		require.NoError(t, queryErr)
+		return rows[0]["total"]
+	}
+
+	insert(1)
+	insert(2)
+	res := do(http.MethodPut, "/admin/views/totals", internal.MaterializedView{
+		SQL: "select sum(n)::BIGINT as total from events",
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var view internal.MaterializedView
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&view))
+	assert.EqualValues(t, 1, view.LastRows)
+	assert.Nil(t, view.NextRefresh)
+	assert.EqualValues(t, 3, total())
+
+	insert(3)
+	assert.EqualValues(t, 3, total())
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/views/totals/refresh", nil).StatusCode)
+	assert.EqualValues(t, 6, total())
+
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/admin/views/totals", internal.MaterializedView{
+		SQL:             "select sum(n)::BIGINT as total from events",
+		RefreshInterval: "1s",
+	}).StatusCode)
+	insert(4)
+	assert.Eventually(t, func() bool {
+		return total() == int64(10)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, http.StatusConflict, do(http.MethodPut, "/admin/views/events", internal.MaterializedView{
+		SQL: "select 1",
+	}).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/admin/views/broken", internal.MaterializedView{
+		SQL: "select * from missing",
+	}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/views/fast", internal.MaterializedView{
+		SQL:             "select 1",
+		RefreshInterval: "10ms",
+	}).StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/views/totals", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/views/totals", nil).StatusCode)
+	_, err = store.Query(context.Background(), &internal.QueryStatement{Query: "select * from totals"})
+	assert.Error(t, err)
+}
+
+func TestServerExplain(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	explain := func(params string) (int, internal.QueryPlan) {
+		res, getErr := http.Get(server.URL + "/query/explain?" + params)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var plan internal.QueryPlan
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&plan))
+		}
+		return res.StatusCode, plan
+	}
+	names := func(node *internal.PlanNode) []string {
+		var out []string
+		var walk func(*internal.PlanNode)
+		walk = func(n *internal.PlanNode) {
+			out = append(out, n.Name)
+			for _, child := range n.Children {
+				walk(child)
+			}
+		}
+		walk(node)
+		return out
+	}
+
+	query := url.QueryEscape(
+		"select a.range, count(*) from range(10) a join range(5) b on a.range = b.range group by 1",
+	)
+	status, plan := explain("q=" + query)
+	require.Equal(t, http.StatusOK, status)
+	require.NotNil(t, plan.Logical)
+	require.NotNil(t, plan.LogicalOptimized)
+	require.NotNil(t, plan.Physical)
+	assert.Nil(t, plan.Analyzed)
+	assert.Equal(t, []string{"HASH_GROUP_BY", "PROJECTION", "HASH_JOIN", "RANGE", "RANGE"}, names(plan.Physical))
+	join := plan.Physical.Children[0].Children[0]
+	require.Len(t, join.Children, 2)
+	assert.Contains(t, join.ExtraInfo, "INNER")
+	require.NotNil(t, join.Children[1].EstimatedCardinality)
+	assert.EqualValues(t, 5, *join.Children[1].EstimatedCardinality)
+
+	status, plan = explain("analyze=true&q=" + query)
+	require.Equal(t, http.StatusOK, status)
+	require.NotNil(t, plan.Analyzed)
+	assert.Nil(t, plan.Physical)
+	assert.Equal(t, []string{"HASH_GROUP_BY", "PROJECTION", "HASH_JOIN", "RANGE", "RANGE"}, names(plan.Analyzed))
+	require.NotNil(t, plan.Analyzed.Cardinality)
+	assert.EqualValues(t, 5, *plan.Analyzed.Cardinality)
+	assert.NotNil(t, plan.Analyzed.TimingMS)
+
+	status, _ = explain("q=" + url.QueryEscape("drop table t"))
+	assert.Equal(t, http.StatusForbidden, status)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select current_setting('explain_output') as explain_output",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "physical_only", rows[0]["explain_output"])
+}
+
+func TestServerQueryProfile(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	query := url.QueryEscape("select range % 3 as k, count(*) as n from range(100) group by 1 order by 1")
+	res, err := http.Get(fmt.Sprintf("%s/query?profile=true&q=%s", server.URL, query))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var envelope internal.Envelope
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&envelope))
+	_ = res.Body.Close()
+	assert.Equal(t, 3, envelope.RowCount)
+	require.NotNil(t, envelope.Profile)
+	require.NotNil(t, envelope.Profile.Plan)
+	assert.Equal(t, "ORDER_BY", envelope.Profile.Plan.Name)
+	require.NotNil(t, envelope.Profile.Plan.Cardinality)
+	assert.EqualValues(t, 3, *envelope.Profile.Plan.Cardinality)
+
+	res, err = http.Get(fmt.Sprintf("%s/query?q=%s", server.URL, query))
+	require.NoError(t, err)
+	var rows []map[string]any
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&rows))
+	_ = res.Body.Close()
+	assert.Len(t, rows, 3)
+
+	res, err = http.Get(fmt.Sprintf("%s/query?profile=true&format=csv&q=%s", server.URL, query))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServerQueryCache(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithQueryCacheTTL(time.Minute)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	get := func(params string, header http.Header) (*http.Response, string) {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/query?"+params, nil)
+		require.NoError(t, reqErr)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, string(body)
+	}
+	insert := func(n int) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "counts",
+			Columns: map[string]any{"n": n},
+		}))
+	}
+
+	insert(1)
+	query := "q=" + url.QueryEscape("select sum(n)::BIGINT as total from counts")
+	res, body := get(query, nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "miss", res.Header.Get(internal.CacheStatusHeader))
+	tag := res.Header.Get("ETag")
+	require.NotEmpty(t, tag)
+
+	res, cached := get(query, nil)
+	assert.Equal(t, "hit", res.Header.Get(internal.CacheStatusHeader))
+	assert.Equal(t, body, cached)
+	assert.Equal(t, tag, res.Header.Get("ETag"))
+
+	res, body = get(query, http.Header{"If-None-Match": {`"other", ` + tag}})
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Empty(t, body)
+
+	res, _ = get(query, http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "miss", res.Header.Get(internal.CacheStatusHeader))
+
+	insert(2)
+	res, body = get(query, http.Header{"If-None-Match": {tag}})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "miss", res.Header.Get(internal.CacheStatusHeader))
+	assert.NotEqual(t, tag, res.Header.Get("ETag"))
+	assert.JSONEq(t, `[{"total": 3}]`, body)
+}
+
+func TestServerQueryCompression(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	get := func(sql, acceptEncoding string) (*http.Response, []byte) {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/query?q="+url.QueryEscape(sql), nil)
+		require.NoError(t, reqErr)
+		// Setting the header keeps the transport from decompressing the body itself.
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, getErr := http.DefaultClient.Do(req)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return res, body
+	}
+	large := "select i, 'row ' || i as label from range(1000) t(i)"
+
+	res, plain := get(large, "identity")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Contains(t, res.Header.Values("Vary"), "Accept-Encoding")
+	plainTag := res.Header.Get("ETag")
+
+	res, compressed := get(large, "br;q=1, gzip;q=0.5")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Less(t, len(compressed)*5, len(plain))
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, plain, decompressed)
+	assert.NotEqual(t, plainTag, res.Header.Get("ETag"))
+
+	res, _ = get(large, "*, gzip;q=0")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	res, _ = get("select 1 as n", "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+}
+
+func TestServerWriteBackpressure(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	// Both servers share the write lock of the store, but each has a write path queue of its own.
+	waiting := httptest.NewServer(
+		internal.NewServer(store, internal.WithWriteBackpressure(1, 200*time.Millisecond)).NewServeMux())
+	queueless := httptest.NewServer(
+		internal.NewServer(store, internal.WithWriteBackpressure(0, time.Minute)).NewServeMux())
+	t.Cleanup(func() {
+		waiting.Close()
+		queueless.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	// A slow write through the admin query path holds the write lock, so the first insert holds the write path.
+	slowStatus := make(chan int, 1)
+	go func() {
+		res, postErr := http.Post(waiting.URL+"/admin/query", "application/json", strings.NewReader(`{"statements": [
+			{"sql": "create table slow as select sum(a.range * b.range) as s from range(100000000) a, range(1000) b"}
+		]}`))
+		if postErr != nil {
+			slowStatus <- 0
+			return
+		}
+		_ = res.Body.Close()
+		slowStatus <- res.StatusCode
+	}()
+	var queries []internal.InFlightQuery
+	require.Eventually(t, func() bool {
+		res, getErr := http.Get(waiting.URL + "/admin/queries")
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&queries))
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// An insert that gets the write path blocks on the lock until its client gives up, the following ones are refused.
+	client := &http.Client{Timeout: time.Second}
+	insert := func(server *httptest.Server, code int) func() bool {
+		return func() bool {
+			res, postErr := client.Post(server.URL+"/data?Table=events", "application/json", strings.NewReader(`{"n": 1}`))
+			if postErr != nil {
+				return false
+			}
+			defer func() {
+				_ = res.Body.Close()
+			}()
+			if res.StatusCode != code {
+				return false
+			}
+			assert.Equal(t, "1", res.Header.Get("Retry-After"))
+			assert.Equal(t, "1", res.Header.Get(internal.WriteQueueDepthHeader))
+			var body internal.ErrorResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			assert.NotEmpty(t, body.Message)
+			return true
+		}
+	}
+	require.Eventually(t, insert(waiting, http.StatusServiceUnavailable), 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, insert(queueless, http.StatusTooManyRequests), 10*time.Second, 10*time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodDelete, waiting.URL+"/admin/queries/"+queries[0].ID, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	select {
+	case <-slowStatus:
+	case <-time.After(10 * time.Second):
+		t.Fatal("slow write did not finish")
+	}
+	res, err = http.Post(waiting.URL+"/data?Table=events", "application/json", strings.NewReader(`{"n": 2}`))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestServerInsertCoalescing(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithInsertCoalescing(10)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	post := func(body string) int {
+		res, postErr := http.Post(server.URL+"/data?Table=events", "application/json", strings.NewReader(body))
+		if postErr != nil {
+			return 0
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, post(`{"n": 0}`))
+
+	// Concurrent inserts share statements, the one with a type conflict fails on its own.
+	statuses := make([]int, 40)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`[{"n": %d}, {"n": %d, "tag": "x"}]`, i, i)
+			if i == 7 {
+				body = `{"n": "seven"}`
+			}
+			statuses[i] = post(body)
+		}(i)
+	}
+	wg.Wait()
+	for i, status := range statuses {
+		want := http.StatusOK
+		if i == 7 {
+			want = http.StatusConflict
+		}
+		assert.Equal(t, want, status, i)
+	}
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select count(*) as n, count(tag) as tagged from events",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": int64(79), "tagged": int64(39)}}, rows)
+}
+
+func TestServerQueryResultLimits(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithResultLimits(internal.ResultLimits{
+		MaxRows:  10,
+		MaxBytes: 200,
+	})).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	get := func(params string) (*http.Response, string) {
+		res, getErr := http.Get(server.URL + "/query?" + params)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, string(body)
+	}
+
+	rows := "q=" + url.QueryEscape("select range as n from range(100)")
+	res, body := get(rows + "&envelope=true")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get(internal.TruncatedHeader))
+	var envelope internal.Envelope
+	require.NoError(t, json.Unmarshal([]byte(body), &envelope))
+	assert.True(t, envelope.Truncated)
+	assert.Equal(t, 10, envelope.RowCount)
+
+	res, _ = get(rows + "&overflow=error")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	res, _ = get(rows + "&overflow=maybe")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	wide := "q=" + url.QueryEscape("select repeat('x', 50) as s, range as n from range(8) order by n")
+	res, body = get(wide)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get(internal.TruncatedHeader))
+	assert.LessOrEqual(t, len(body), 200)
+
+	res, _ = get(wide + "&overflow=error")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	var seen []map[string]any
+	next := wide + "&limit=8"
+	for next != "" {
+		res, body = get(next)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Empty(t, res.Header.Get(internal.TruncatedHeader))
+		var page []map[string]any
+		require.NoError(t, json.Unmarshal([]byte(body), &page))
+		require.NotEmpty(t, page)
+		seen = append(seen, page...)
+		next = ""
+		if cursor := res.Header.Get(internal.NextCursorHeader); cursor != "" {
+			next = wide + "&cursor=" + url.QueryEscape(cursor)
+		}
+	}
+	require.Len(t, seen, 8)
+	for i, row := range seen {
+		assert.InDelta(t, i, row["n"], 0)
+	}
+}
+
+func TestServerKeyResultLimits(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "dashboard", Key: "dashboard-key", ResultLimits: &internal.ResultLimits{MaxRows: 3}},
+		{Name: "etl", Key: "etl-key", ResultLimits: &internal.ResultLimits{MaxRows: 50}},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store,
+		internal.WithAPIKeys(keys),
+		internal.WithResultLimits(internal.ResultLimits{MaxRows: 10, MaxBytes: 1 << 20}),
+		internal.WithQueryCacheTTL(time.Minute),
+	).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	rowCount := func(key string) int {
+		req, reqErr := http.NewRequest(http.MethodGet,
+			server.URL+"/query?envelope=true&q="+url.QueryEscape("select range as n from range(100)"), nil)
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var envelope internal.Envelope
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&envelope))
+		assert.True(t, envelope.Truncated)
+		return envelope.RowCount
+	}
+
+	// The same query is cached apart for each cap.
+	assert.Equal(t, 3, rowCount("dashboard-key"))
+	assert.Equal(t, 50, rowCount("etl-key"))
+	assert.Equal(t, 10, rowCount("root-key"))
+	assert.Equal(t, 3, rowCount("dashboard-key"))
+}
+
+func TestServerQueryStreaming(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithResultLimits(internal.ResultLimits{
+		MaxRows: 10,
+	})).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	get := func(query, accept string, header ...string) (*http.Response, string) {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/query?q="+url.QueryEscape(query), nil)
+		require.NoError(t, reqErr)
+		req.Header.Set("Accept", accept)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, getErr := http.DefaultClient.Do(req)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, string(body)
+	}
+
+	rows := "select range as n, 'r' || range as s from range(100)"
+	for _, accept := range []string{"application/json", "application/x-ndjson", "text/csv"} {
+		// A conditional request is answered from the fetched result, which the stream must match.
+		buffered, want := get(rows, accept, "If-None-Match", `"none"`)
+		require.Equal(t, http.StatusOK, buffered.StatusCode, accept)
+		assert.NotEmpty(t, buffered.Header.Get("ETag"), accept)
+
+		res, body := get(rows, accept)
+		require.Equal(t, http.StatusOK, res.StatusCode, accept)
+		assert.Equal(t, want, body, accept)
+		assert.Empty(t, res.Header.Get("ETag"), accept)
+		assert.Empty(t, res.Header.Get(internal.TruncatedHeader), accept)
+		assert.Equal(t, "true", res.Trailer.Get(internal.TruncatedHeader), accept)
+		assert.Equal(t, buffered.Header.Get(internal.ColumnTypesHeader), res.Header.Get(internal.ColumnTypesHeader))
+	}
+
+	res, body := get("select 1 as n where false", "application/json")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "null", body)
+	assert.Empty(t, res.Trailer.Get(internal.TruncatedHeader))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/query?envelope=true&q="+url.QueryEscape(rows), nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var envelope internal.Envelope
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&envelope))
+	_ = res.Body.Close()
+	assert.Equal(t, 10, envelope.RowCount)
+	assert.Len(t, envelope.Rows, 10)
+	assert.True(t, envelope.Truncated)
+	assert.Len(t, envelope.Columns, 2)
+
+	res, _ = get("select nope", "application/json")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServerQueryConcurrency(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithQueryConcurrency(1, 1)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	run := func(query string, status chan<- int) {
+		res, getErr := http.Get(fmt.Sprintf("%s/query?q=%s", server.URL, url.QueryEscape(query)))
+		if getErr != nil {
+			status <- 0
+			return
+		}
+		_ = res.Body.Close()
+		status <- res.StatusCode
+	}
+	slow := "select sum(a.range * b.range) from range(100000000) a, range(1000) b"
+	slowStatus, queuedStatus := make(chan int, 1), make(chan int, 1)
+	go run(slow, slowStatus)
+
+	var queries []internal.InFlightQuery
+	require.Eventually(t, func() bool {
+		res, getErr := http.Get(server.URL + "/admin/queries")
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&queries))
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	go run("select 1 as x", queuedStatus)
+	// Once the queued query waits for the slot, further queries are rejected instead of waiting for their timeout.
+	require.Eventually(t, func() bool {
+		res, getErr := http.Get(server.URL + "/query?timeout=50ms&q=" + url.QueryEscape("select 2 as x"))
+		require.NoError(t, getErr)
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusTooManyRequests {
+			return false
+		}
+		assert.NotEmpty(t, res.Header.Get("Retry-After"))
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/queries/"+queries[0].ID, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	for _, status := range []chan int{slowStatus, queuedStatus} {
+		select {
+		case code := <-status:
+			if status == queuedStatus {
+				assert.Equal(t, http.StatusOK, code)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("query did not finish")
+		}
+	}
+}
+
+func TestServerQueryTags(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store,
+		internal.WithQueryTagConcurrency(map[string]int{"reports": 1}, 0)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	query := func(target, tag string) int {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+target, nil)
+		require.NoError(t, reqErr)
+		if tag != "" {
+			req.Header.Set(internal.QueryTagHeader, tag)
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	get := func(path string, v any) {
+		res, getErr := http.Get(server.URL + path)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.NoError(t, json.NewDecoder(res.Body).Decode(v))
+	}
+
+	require.Equal(t, http.StatusOK, query("/query?q="+url.QueryEscape("select * from range(3)"), "sales-dashboard"))
+	require.Equal(t, http.StatusBadRequest, query("/query?q="+url.QueryEscape("select nope"), "sales-dashboard"))
+	// The parameter takes precedence over the header.
+	require.Equal(t, http.StatusOK, query("/query?tag=team:data&q="+url.QueryEscape("select 1 as x"), "ignored"))
+	require.Equal(t, http.StatusOK, query("/query?q="+url.QueryEscape("select 2 as x"), ""))
+	assert.Equal(t, http.StatusBadRequest, query("/query?q="+url.QueryEscape("select 3 as x"), "no spaces"))
+
+	var stats []internal.QueryTagStats
+	get("/admin/queries/tags", &stats)
+	require.Len(t, stats, 2)
+	assert.Equal(t, "sales-dashboard", stats[0].Tag)
+	assert.Equal(t, int64(2), stats[0].Queries)
+	assert.Equal(t, int64(1), stats[0].Errors)
+	assert.Equal(t, int64(3), stats[0].Rows)
+	assert.GreaterOrEqual(t, stats[0].TotalMS, stats[0].MaxMS)
+	assert.Equal(t, "team:data", stats[1].Tag)
+	assert.Equal(t, int64(1), stats[1].Queries)
+
+	var history []internal.QueryHistoryEntry
+	get("/queries/history?tag=sales-dashboard", &history)
+	require.Len(t, history, 2)
+	assert.Equal(t, "select nope", history[0].SQL)
+	assert.Equal(t, "sales-dashboard", history[0].Tag)
+
+	// A tag at its concurrency limit turns its queries away while untagged queries still run.
+	slow := make(chan int, 1)
+	go func() {
+		slow <- query("/query?q="+url.QueryEscape("select sum(a.range * b.range) from range(100000000) a, range(1000) b"),
+			"reports")
+	}()
+	var queries []internal.InFlightQuery
+	require.Eventually(t, func() bool {
+		get("/admin/queries", &queries)
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "reports", queries[0].Tag)
+	assert.Equal(t, http.StatusTooManyRequests, query("/query?q="+url.QueryEscape("select 1 as x"), "reports"))
+	assert.Equal(t, http.StatusOK, query("/query?q="+url.QueryEscape("select 1 as x"), "other"))
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/queries/"+queries[0].ID, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	select {
+	case <-slow:
+	case <-time.After(10 * time.Second):
+		t.Fatal("query did not finish")
+	}
+	assert.Equal(t, http.StatusOK, query("/query?q="+url.QueryEscape("select 1 as x"), "reports"))
+}
+
+func TestServerPreviewData(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string) (int, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, out
+	}
+	preview := func(body string) internal.InsertPreview {
+		code, out := do(http.MethodPost, "/data/preview?Table=orders", body)
+		require.Equal(t, http.StatusOK, code, string(out))
+		var p internal.InsertPreview
+		require.NoError(t, json.Unmarshal(out, &p))
+		return p
+	}
+	code, _ := do(http.MethodPut, "/tables/orders/config", `{"columns": [{"name": "status", "enum": ["new"]}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Equal(t, internal.InsertPreview{
+		Table: "orders",
+		Rows:  2,
+		DDL:   []string{`CREATE TABLE IF NOT EXISTS "orders"("id" DOUBLE, "status" ENUM('new', 'paid'))`},
+		Columns: []internal.PreviewColumn{
+			{Name: "id", Type: "DOUBLE", New: true},
+			{Name: "status", Type: "ENUM('new', 'paid')", New: true},
+		},
+	}, preview(`[{"id": 1, "status": "paid"}, {"id": 2}]`))
+	_, err = store.TableSchema(context.Background(), "orders")
+	require.ErrorIs(t, err, internal.ErrTableNotFound)
+
+	code, _ = do(http.MethodPost, "/data?Table=orders", `{"id": 1, "status": "new"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.InsertPreview{
+		Table:  "orders",
+		Rows:   1,
+		Exists: true,
+		DDL: []string{
+			`ALTER TABLE "orders" ALTER COLUMN "status" SET DATA TYPE ENUM('new', 'paid')`,
+			`ALTER TABLE "orders" ADD COLUMN "note" VARCHAR`,
+		},
+		Columns: []internal.PreviewColumn{
+			{Name: "id", Type: "DOUBLE", Converted: true},
+			{Name: "status", Type: "ENUM('new', 'paid')"},
+			{Name: "note", Type: "VARCHAR", New: true},
+		},
+	}, preview(`{"id": "2", "status": "paid", "note": "late"}`))
+	assert.Equal(t, internal.InsertPreview{
+		Table:   "orders",
+		Rows:    1,
+		Exists:  true,
+		DDL:     []string{},
+		Columns: []internal.PreviewColumn{{Name: "id", Type: "DOUBLE"}},
+	}, preview(`{"id": 2}`))
+	schema, err := store.TableSchema(context.Background(), "orders")
+	require.NoError(t, err)
+	assert.Len(t, schema.Columns, 2)
+
+	code, _ = do(http.MethodPost, "/data/preview?Table=orders", `{"id": `)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPost, "/data/preview?Table=orders", `{"nested": {"a": 1}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _ = do(http.MethodPost, "/data/preview?Table=bad-name", `{"id": 1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// The preview refuses the rows the insert refuses, with the same status.
+	code, _ = do(http.MethodPut, "/tables/invoices/config",
+		`{"columns": [{"name": "total", "type": "DOUBLE", "generated": "amount * 2"}, {"name": "pdf", "type": "BLOB"}]}`)
+	require.Equal(t, http.StatusOK, code)
+	for _, body := range []string{`{"amount": 1, "total": 2}`, `{"amount": 1, "pdf": "not base64"}`} {
+		previewCode, _ := do(http.MethodPost, "/data/preview?Table=invoices", body)
+		insertCode, _ := do(http.MethodPost, "/data?Table=invoices", body)
+		assert.Equal(t, http.StatusUnprocessableEntity, insertCode, body)
+		assert.Equal(t, insertCode, previewCode, body)
+	}
+	_, err = store.TableSchema(context.Background(), "invoices")
+	assert.ErrorIs(t, err, internal.ErrTableNotFound)
+}
+
+func TestServerIngestStats(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	insert := func(body string) int {
+		res, postErr := http.Post(server.URL+"/data?Table=events", "application/json", strings.NewReader(body))
+		require.NoError(t, postErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	get := func(path string) (*http.Response, []byte) {
+		res, getErr := http.Get(server.URL + path)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, body
+	}
+
+	res, _ := get("/tables/events/stats/ingest")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	// Creating the table and adding a column each retry the insert.
+	require.Equal(t, http.StatusOK, insert(`[{"n": 1}, {"n": 2}]`))
+	require.Equal(t, http.StatusOK, insert(`{"n": 3, "name": "c"}`))
+	require.Equal(t, http.StatusConflict, insert(`{"n": "three"}`))
+
+	res, body := get("/tables/events/stats/ingest")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var stats internal.IngestStats
+	require.NoError(t, json.Unmarshal(body, &stats))
+	assert.Equal(t, "events", stats.Table)
+	assert.Equal(t, int64(3), stats.Inserts)
+	assert.Equal(t, int64(1), stats.Failures)
+	assert.Equal(t, int64(3), stats.Rows)
+	assert.Equal(t, int64(len(`{"n":1}{"n":2}{"n":3,"name":"c"}`)), stats.Bytes)
+	assert.Equal(t, int64(2), stats.SchemaSyncRetries)
+	assert.InDelta(t, 3.0/60, stats.RowsPerSecond, 0.0001)
+	assert.InDelta(t, float64(stats.Bytes)/60, stats.BytesPerSecond, 0.0001)
+	assert.Equal(t, int64(3), stats.Latency.Count)
+	assert.Positive(t, stats.Latency.SumSeconds)
+	require.NotEmpty(t, stats.Latency.Buckets)
+	assert.LessOrEqual(t, stats.Latency.Buckets[0].Count, stats.Latency.Buckets[len(stats.Latency.Buckets)-1].Count)
+	assert.NotNil(t, stats.LastInsert)
+
+	res, body = get("/metrics")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, internal.MetricsContentType, res.Header.Get("Content-Type"))
+	assert.Contains(t, string(body),
+		"# TYPE scratch_ingest_rows_total counter\nscratch_ingest_rows_total{table=\"events\"} 3\n")
+	assert.Contains(t, string(body), `scratch_ingest_schema_sync_retries_total{table="events"} 2`)
+	assert.Contains(t, string(body), `scratch_ingest_latency_seconds_bucket{table="events",le="+Inf"} 3`)
+	assert.Contains(t, string(body), `scratch_ingest_latency_seconds_count{table="events"} 3`)
+
+	require.NoError(t, store.DropTable(context.Background(), "events"))
+	_, body = get("/metrics")
+	assert.NotContains(t, string(body), "events")
+}
+
+func TestServerQueryBatch(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	post := func(path, body string) (*http.Response, []byte) {
+		res, postErr := http.Post(server.URL+path, "application/json", bytes.NewBufferString(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, out
+	}
+
+	res, body := post("/admin/query", `{"statements": [
+		{"sql": "create table accounts (id int, balance int)"},
+		{"sql": "insert into accounts values (1, 10), (2, 20)"},
+		{"sql": "select sum(balance)::INT as total from accounts where id >= ?", "params": [1]}
+	]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	var batch internal.BatchResponse
+	require.NoError(t, json.Unmarshal(body, &batch))
+	require.Len(t, batch.Results, 3)
+	assert.Equal(t, []map[string]any{{"total": float64(30)}}, batch.Results[2].Rows)
+
+	res, body = post("/admin/query", `{"statements": [
+		{"sql": "update accounts set balance = balance - 5 where id = 1"},
+		{"sql": "select * from missing_table"}
+	]}`)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Contains(t, string(body), "statement 1")
+
+	res, _ = post("/query", `{"statements": [
+		{"sql": "select balance from accounts where id = 1"},
+		{"sql": "delete from accounts"}
+	]}`)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, body = post("/query", `{"statements": [
+		{"sql": "select balance from accounts where id = 1"},
+		{"sql": "select count(*)::INT as n from accounts"}
+	]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	var reads internal.BatchResponse
+	require.NoError(t, json.Unmarshal(body, &reads))
+	require.Len(t, reads.Results, 2)
+	assert.Equal(t, []map[string]any{{"balance": float64(10)}}, reads.Results[0].Rows)
+	assert.Equal(t, []map[string]any{{"n": float64(2)}}, reads.Results[1].Rows)
+
+	res, _ = post("/query", `{"sql": "select 1", "statements": [{"sql": "select 2"}]}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServerSessions(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"n": 1},
+	}))
+	open := func() string {
+		res, postErr := http.Post(server.URL+"/sessions", "application/json", nil)
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+		var info internal.SessionInfo
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&info))
+		require.NotEmpty(t, info.ID)
+		return info.ID
+	}
+	query := func(session, sql string) (int, string) {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/query?q="+url.QueryEscape(sql), nil)
+		require.NoError(t, reqErr)
+		if session != "" {
+			req.Header.Set(internal.SessionHeader, session)
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(body)
+	}
+
+	session := open()
+	for _, sql := range []string{
+		"create temp table scratch as select n * 10 as v from events",
+		"insert into scratch values (20); insert into scratch values (30)",
+		"set session explain_output = 'all'",
+	} {
+		code, body := query(session, sql)
+		require.Equal(t, http.StatusOK, code, body)
+	}
+	code, body := query(session, "select v::INT as v from scratch order by v")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"v": 10}, {"v": 20}, {"v": 30}]`, body)
+
+	code, _ = query("", "select * from scratch")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = query(open(), "select * from scratch")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for _, sql := range []string{
+		"insert into events values (2)",
+		"drop table events",
+		"create table persistent as select 1",
+		"set session search_path = 'main'",
+		"set memory_limit = '1GB'",
+	} {
+		code, _ = query(session, sql)
+		assert.Equal(t, http.StatusForbidden, code, sql)
+	}
+
+	code, body = query(session, "drop table scratch")
+	require.Equal(t, http.StatusOK, code, body)
+	code, _ = query(session, "insert into scratch values (1)")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/sessions/"+session, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	code, _ = query(session, "select 1")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestServerSessionOwners(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "alice", Key: "alice-key"},
+		{Name: "bob", Key: "bob-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, key, session string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		if session != "" {
+			req.Header.Set(internal.SessionHeader, session)
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res
+	}
+	query := func(key, session, sql string) int {
+		return do(http.MethodGet, "/query?q="+url.QueryEscape(sql), key, session).StatusCode
+	}
+
+	res := do(http.MethodPost, "/sessions", "alice-key", "")
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var info internal.SessionInfo
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&info))
+	assert.Equal(t, "key:alice", info.Caller)
+	require.Equal(t, http.StatusOK, query("alice-key", info.ID, "create temp table secrets as select 42 as n"))
+
+	// The session of another key isn't found, neither for queries nor to be closed.
+	assert.Equal(t, http.StatusNotFound, query("bob-key", info.ID, "select * from secrets"))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/sessions/"+info.ID, "bob-key", "").StatusCode)
+	assert.Equal(t, http.StatusOK, query("alice-key", info.ID, "select * from secrets"))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/sessions/"+info.ID, "alice-key", "").StatusCode)
+}
+
+func TestServerMacros(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "macros.json")
+	macros, err := internal.NewMacros(context.Background(), store, path)
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithMacros(macros)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	put := func(name, body string) int {
+		req, reqErr := http.NewRequest(http.MethodPut, server.URL+"/admin/macros/"+name, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusCreated, put("parse_sku", `{"params": ["x"], "body": "split_part(x, '-', 1)"}`))
+	assert.Equal(t, http.StatusOK, put("parse_sku", `{"params": ["sku"], "body": "upper(split_part(sku, '-', 1))"}`))
+	assert.Equal(t, http.StatusCreated, put("evens",
+		`{"params": ["n"], "body": "select range as v from range(0, n, 2)", "table": true}`))
+	assert.Equal(t, http.StatusBadRequest, put("bad", `{"params": ["x"], "body": "x; drop table t"}`))
+	assert.Equal(t, http.StatusBadRequest, put("bad", `{"params": ["x", "x"], "body": "x"}`))
+	assert.Equal(t, http.StatusBadRequest, put("bad", `{"body": "nosuchfn(1)"}`))
+
+	query := func(store *internal.Store, sql string) []map[string]any {
+		res, fetchErr := store.Fetch(context.Background(), &internal.QueryStatement{Query: sql})
+		require.NoError(t, fetchErr)
+		return res.Rows
+	}
+	assert.Equal(t, []map[string]any{{"s": "AB"}}, query(store, "select parse_sku('ab-12') as s"))
+	assert.Len(t, query(store, "select * from evens(6)"), 3)
+
+	// A new store with the same file gets the macros registered again, as after a restart.
+	restarted, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, restarted.Close())
+	})
+	reloaded, err := internal.NewMacros(context.Background(), restarted, path)
+	require.NoError(t, err)
+	assert.Len(t, reloaded.List(), 2)
+	assert.Equal(t, []map[string]any{{"s": "AB"}}, query(restarted, "select parse_sku('ab-12') as s"))
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/admin/macros/evens", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{Query: "select * from evens(6)"})
+	require.Error(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "evens")
+}
+
+func TestServerTableRows(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "orders",
+		Rows: []map[string]any{
+			{"id": 1, "status": "paid", "amount": 10.5},
+			{"id": 2, "status": "open", "amount": 3.0},
+			{"id": 3, "status": "paid", "amount": 7.25},
+			{"id": 4, "status": "refunded"},
+		},
+	}))
+	get := func(params string) (int, string) {
+		res, getErr := http.Get(server.URL + "/tables/orders/rows?" + params)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(body)
+	}
+
+	code, body := get("filter=status:eq:paid&filter=amount:gt:5&sort=-amount&columns=id")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"id": 1}, {"id": 3}]`, body)
+
+	code, body = get("filter=status:in:open,refunded&filter=amount:null:false&columns=id")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"id": 2}]`, body)
+
+	code, body = get("sort=id&limit=3&columns=id,status")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"id": 1, "status": "paid"}, {"id": 2, "status": "open"}, {"id": 3, "status": "paid"}]`, body)
+
+	for _, params := range []string{
+		"filter=status:eq",
+		"filter=status:regex:x",
+		"filter=missing:eq:1",
+		"sort=" + url.QueryEscape("amount;drop table orders"),
+		"columns=" + url.QueryEscape("id,status from orders; --"),
+	} {
+		code, _ = get(params)
+		assert.Equal(t, http.StatusBadRequest, code, params)
+	}
+
+	res, err := http.Get(server.URL + "/tables/missing/rows")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServerTableSample(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	rows := make([]map[string]any, 5000)
+	for i := range rows {
+		rows[i] = map[string]any{"id": i, "name": fmt.Sprintf("row %d", i)}
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{Table: "events", Rows: rows}))
+	getTable := func(table, params string) (int, []map[string]any) {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/tables/"+table+"/sample?"+params, nil)
+		require.NoError(t, reqErr)
+		req.Header.Set("Cache-Control", "no-cache")
+		res, getErr := http.DefaultClient.Do(req)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out []map[string]any
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	get := func(params string) (int, []map[string]any) {
+		return getTable("events", params)
+	}
+
+	code, sample := get("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, sample, 100)
+
+	code, sample = get("n=10&columns=id")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, sample, 10)
+	assert.Len(t, sample[0], 1)
+	assert.Contains(t, sample[0], "id")
+
+	code, sample = get("n=200&method=bernoulli")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, sample)
+	assert.LessOrEqual(t, len(sample), 200)
+
+	code, sample = get("n=200&method=system")
+	require.Equal(t, http.StatusOK, code)
+	assert.LessOrEqual(t, len(sample), 200)
+
+	_, first := get("n=20&seed=42")
+	_, second := get("n=20&seed=42")
+	assert.Equal(t, first, second)
+
+	// The estimate behind the percentage ignores the case of the table name, as DuckDB does.
+	_, lower := get("n=200&method=bernoulli&seed=7")
+	code, upper := getTable("EVENTS", "n=200&method=bernoulli&seed=7")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, lower, upper)
+
+	for _, params := range []string{"n=0", "n=10001", "n=x", "method=cluster", "seed=-1", "columns=missing"} {
+		code, _ = get(params)
+		assert.Equal(t, http.StatusBadRequest, code, params)
+	}
+
+	res, err := http.Get(server.URL + "/tables/missing/sample")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestServerTableAggregate(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+		Query: `create table sales as select * from (values
+			('eu', 10, now()::TIMESTAMP - interval 1 hour),
+			('eu', 20, now()::TIMESTAMP - interval 2 hour),
+			('us', 5, now()::TIMESTAMP - interval 3 day)
+		) t(region, amount, ts)`,
+		AllowWrites: true,
+	})
+	require.NoError(t, err)
+	get := func(params string) (int, string) {
+		res, getErr := http.Get(server.URL + "/tables/sales/aggregate?" + params)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(body)
+	}
+
+	code, body := get("group_by=region&metrics=" + url.QueryEscape("count,sum(amount),max(amount)"))
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[
+		{"region": "eu", "count": 2, "sum_amount": 30, "max_amount": 20},
+		{"region": "us", "count": 1, "sum_amount": 5, "max_amount": 5}
+	]`, body)
+
+	code, body = get("metrics=count&since=24h&time_column=ts")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"count": 2}]`, body)
+
+	code, body = get("filter=region:eq:us")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `[{"count": 1}]`, body)
+
+	for _, params := range []string{
+		"metrics=" + url.QueryEscape("sum(missing)"),
+		"metrics=" + url.QueryEscape("median(amount)"),
+		"metrics=sum",
+		"since=24h",
+		"group_by=" + url.QueryEscape("region; drop table sales"),
+	} {
+		code, _ = get(params)
+		assert.Equal(t, http.StatusBadRequest, code, params)
+	}
+}
+
+func TestServerSearch(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "logs",
+		Rows: []map[string]any{
+			{"id": 1, "service": "api", "message": "connection refused by upstream"},
+			{"id": 2, "service": "worker", "message": "job finished"},
+			{"id": 3, "service": "api", "message": "upstream connection reset, connection retried"},
+		},
+	}))
+	put := func(table, body string) int {
+		req, reqErr := http.NewRequest(
+			http.MethodPut,
+			server.URL+"/admin/tables/"+table+"/search-index",
+			strings.NewReader(body),
+		)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	search := func(params string) (int, string) {
+		res, getErr := http.Get(server.URL + "/tables/logs/search?" + params)
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		body, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(body)
+	}
+
+	code, _ := search("q=connection")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, http.StatusNotFound, put("missing", `{"id_column": "id", "columns": ["message"]}`))
+	assert.Equal(t, http.StatusBadRequest, put("logs", `{"id_column": "id", "columns": ["nope"]}`))
+
+	code = put("logs", `{"id_column": "id", "columns": ["service", "message"]}`)
+	if code == http.StatusServiceUnavailable {
+		t.Skip("the fts extension is not available")
+	}
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := search("q=connection&fields=message")
+	require.Equal(t, http.StatusOK, code, body)
+	var rows []map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &rows))
+	require.Len(t, rows, 2)
+	assert.InDelta(t, 3, rows[0]["id"], 0)
+	assert.Contains(t, rows[0], internal.SearchScoreColumn)
+
+	code, _ = search("q=connection&fields=id")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = search("q=")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestServerListTables(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+		Query:       "create table numbers as select range as n, range::INTEGER as i, 'x' as s from range(100)",
+		AllowWrites: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"name": "signup"},
+	}))
+
+	res, err := http.Get(server.URL + "/tables")
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var tables []internal.TableInfo
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&tables))
+	assert.Equal(t, []internal.TableInfo{
+		{Schema: "main", Name: "events", Columns: 1, Rows: 1, ApproxBytes: 16},
+		{Schema: "main", Name: "numbers", Columns: 3, Rows: 100, ApproxBytes: 100 * (8 + 4 + 16)},
+	}, tables)
+}
+
+func TestServerTableSchema(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	before := time.Now()
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"name": "signup"},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"name": "purchase", "amount": 9.5},
+	}))
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+		Query:       "create table accounts (id INTEGER NOT NULL, email VARCHAR)",
+		AllowWrites: true,
+	})
+	require.NoError(t, err)
+
+	get := func(t *testing.T, table string) (int, *internal.TableSchema) {
+		t.Helper()
+		res, getErr := http.Get(server.URL + "/tables/" + table + "/schema")
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+		var schema internal.TableSchema
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&schema))
+		return res.StatusCode, &schema
+	}
+
+	t.Run("ingested", func(t *testing.T) {
+		code, schema := get(t, "events")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, schema.Columns, 2)
+		assert.Equal(t, "name", schema.Columns[0].Name)
+		assert.Equal(t, "VARCHAR", schema.Columns[0].Type)
+		assert.True(t, schema.Columns[0].Nullable)
+		assert.Equal(t, "amount", schema.Columns[1].Name)
+		assert.Equal(t, "DOUBLE", schema.Columns[1].Type)
+		for _, col := range schema.Columns {
+			require.NotNil(t, col.AddedAt, col.Name)
+			assert.False(t, col.AddedAt.Before(before.Truncate(time.Second)), col.Name)
+		}
+		assert.False(t, schema.Columns[1].AddedAt.Before(*schema.Columns[0].AddedAt))
+	})
+
+	t.Run("created through sql", func(t *testing.T) {
+		code, schema := get(t, "accounts")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []internal.ColumnInfo{
+			{Name: "id", Type: "INTEGER", Nullable: false},
+			{Name: "email", Type: "VARCHAR", Nullable: true},
+		}, schema.Columns)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		code, _ := get(t, "nope")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
+
+func TestServerRenameTable(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	scheduler := internal.NewScheduler(store, time.Minute)
+	views := internal.NewViews(store, time.Minute)
+	server := httptest.NewServer(internal.NewServer(
+		store, internal.WithScheduler(scheduler), internal.WithViews(views),
+	).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "click", "n": 1.0},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "other",
+		Columns: map[string]any{"events": "x"},
+	}))
+	saved := map[string]string{
+		"count":     "select count(*) from events",
+		"qualified": `select events.kind from main."events" join other o on true, events e2`,
+		"untouched": "select 'events' as events from other",
+	}
+	for name, sql := range saved {
+		require.Equal(t, http.StatusCreated, do(http.MethodPut, "/queries/saved/"+name, internal.SavedQuery{
+			SQL: sql,
+		}).StatusCode)
+	}
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/admin/schedules/copy", internal.Schedule{
+		Cron:  "@hourly",
+		SQL:   "select * from other",
+		Table: "events",
+	}).StatusCode)
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/admin/views/totals", internal.MaterializedView{
+		SQL: "select sum(n) as total from events",
+	}).StatusCode)
+
+	t.Run("conflicts", func(t *testing.T) {
+		for path, expected := range map[string]int{
+			"/tables/events/rename":  http.StatusConflict,
+			"/tables/totals/rename":  http.StatusConflict,
+			"/tables/missing/rename": http.StatusNotFound,
+		} {
+			assert.Equal(t, expected, do(http.MethodPost, path, internal.RenameRequest{Name: "other"}).StatusCode, path)
+		}
+		res := do(http.MethodPost, "/tables/events/rename", internal.RenameRequest{Name: "bad name"})
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	res := do(http.MethodPost, "/tables/events/rename", internal.RenameRequest{Name: "clicks"})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var renamed internal.RenameTableResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&renamed))
+	assert.Equal(t, internal.RenameTableResponse{
+		Table:        "clicks",
+		SavedQueries: []string{"count", "qualified"},
+		Schedules:    []string{"copy"},
+		Views:        []string{"totals"},
+	}, renamed)
+
+	for name, expected := range map[string]string{
+		"count":     "select count(*) from clicks",
+		"qualified": `select clicks.kind from main."clicks" join other o on true, clicks e2`,
+		"untouched": "select 'events' as events from other",
+	} {
+		var q internal.SavedQuery
+		require.NoError(t, json.NewDecoder(do(http.MethodGet, "/queries/saved/"+name, nil).Body).Decode(&q))
+		assert.Equal(t, expected, q.SQL, name)
+	}
+	sch, err := scheduler.Get("copy")
+	require.NoError(t, err)
+	assert.Equal(t, "clicks", sch.Table)
+	view, err := views.Get("totals")
+	require.NoError(t, err)
+	assert.Equal(t, "select sum(n) as total from clicks", view.SQL)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{Query: "select kind from clicks"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"kind": "click"}}, rows)
+	schema, err := store.TableSchema(context.Background(), "clicks")
+	require.NoError(t, err)
+	assert.NotNil(t, schema.Columns[0].AddedAt)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/tables/events/schema", nil).StatusCode)
+}
+
+func TestServerRenameColumn(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	rename := func(path, name string) *http.Response {
+		body, marshalErr := json.Marshal(internal.RenameRequest{Name: name})
+		require.NoError(t, marshalErr)
+		res, postErr := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, postErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "users",
+		Columns: map[string]any{"usr_Nm": "ada", "age": 36.0},
+	}))
+
+	res := rename("/tables/users/columns/usr_Nm/rename", "user_name")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var schema internal.TableSchema
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&schema))
+	names := make([]string, 0, len(schema.Columns))
+	for _, col := range schema.Columns {
+		names = append(names, col.Name)
+		assert.NotNil(t, col.AddedAt, col.Name)
+	}
+	assert.Equal(t, []string{"age", "user_name"}, names)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{Query: "select user_name from users"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"user_name": "ada"}}, rows)
+
+	assert.Equal(t, http.StatusConflict, rename("/tables/users/columns/age/rename", "USER_NAME").StatusCode)
+	assert.Equal(t, http.StatusNotFound, rename("/tables/users/columns/usr_Nm/rename", "x").StatusCode)
+	assert.Equal(t, http.StatusNotFound, rename("/tables/missing/columns/age/rename", "x").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, rename("/tables/users/columns/age/rename", "bad name").StatusCode)
+}
+
+func TestServerDropColumn(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	drop := func(path string) *http.Response {
+		req, reqErr := http.NewRequest(http.MethodDelete, server.URL+path, nil)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "click", "oops": "x"},
+	}))
+
+	res := drop("/tables/events/columns/oops")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var schema internal.TableSchema
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&schema))
+	require.Len(t, schema.Columns, 1)
+	assert.Equal(t, "kind", schema.Columns[0].Name)
+
+	assert.Equal(t, http.StatusNotFound, drop("/tables/events/columns/oops").StatusCode)
+	assert.Equal(t, http.StatusNotFound, drop("/tables/missing/columns/kind").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, drop("/tables/events/columns/kind").StatusCode)
+
+	// A column dropped by mistake comes back on the next insert carrying it.
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "view", "oops": "y"},
+	}))
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select oops from events order by kind",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"oops": nil}, {"oops": "y"}}, rows)
+}
+
+func TestServerMigrations(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	migrate := func(table string, m internal.Migration) *http.Response {
+		body, marshalErr := json.Marshal(m)
+		require.NoError(t, marshalErr)
+		res, postErr := http.Post(server.URL+"/tables/"+table+"/migrations", "application/json", bytes.NewReader(body))
+		require.NoError(t, postErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	history := func(table string) internal.MigrationHistory {
+		res, getErr := http.Get(server.URL + "/tables/" + table + "/migrations")
+		require.NoError(t, getErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var out internal.MigrationHistory
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return out
+	}
+
+	assert.Equal(t, internal.MigrationHistory{Table: "orders", Migrations: []internal.Migration{}}, history("orders"))
+
+	res := migrate("orders", internal.Migration{
+		Version:    1,
+		Name:       "create orders",
+		Operations: []string{"CREATE TABLE orders (id INTEGER PRIMARY KEY, total DOUBLE)"},
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var applied internal.Migration
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&applied))
+	assert.NotNil(t, applied.AppliedAt)
+
+	require.Equal(t, http.StatusCreated, migrate("orders", internal.Migration{
+		Version: 2,
+		Name:    "add currency",
+		Operations: []string{
+			"ALTER TABLE orders ADD COLUMN currency VARCHAR DEFAULT 'EUR'",
+			"COMMENT ON COLUMN orders.currency IS 'ISO 4217'",
+		},
+	}).StatusCode)
+
+	t.Run("refused", func(t *testing.T) {
+		for name, m := range map[string]internal.Migration{
+			"stale version":   {Version: 2, Operations: []string{"ALTER TABLE orders ADD COLUMN a INTEGER"}},
+			"skipped version": {Version: 4, Operations: []string{"ALTER TABLE orders ADD COLUMN a INTEGER"}},
+		} {
+			assert.Equal(t, http.StatusConflict, migrate("orders", m).StatusCode, name)
+		}
+		for name, m := range map[string]internal.Migration{
+			"no operations": {Version: 3},
+			"other table":   {Version: 3, Operations: []string{"ALTER TABLE other ADD COLUMN a INTEGER"}},
+			"not ddl":       {Version: 3, Operations: []string{"DELETE FROM orders"}},
+			"two statements": {Version: 3, Operations: []string{
+				"ALTER TABLE orders ADD COLUMN a INTEGER; DROP TABLE other",
+			}},
+			"drop table": {Version: 3, Operations: []string{"DROP TABLE orders"}},
+			"failing op": {Version: 3, Operations: []string{
+				"ALTER TABLE orders ADD COLUMN a INTEGER",
+				"ALTER TABLE orders DROP COLUMN nope",
+			}},
+		} {
+			assert.Equal(t, http.StatusBadRequest, migrate("orders", m).StatusCode, name)
+		}
+		assert.Equal(t, http.StatusBadRequest, migrate("_migrations", internal.Migration{
+			Version: 1, Operations: []string{"ALTER TABLE _migrations ADD COLUMN a INTEGER"},
+		}).StatusCode)
+	})
+
+	h := history("orders")
+	assert.Equal(t, 2, h.Version)
+	require.Len(t, h.Migrations, 2)
+	assert.Equal(t, "add currency", h.Migrations[1].Name)
+	assert.Len(t, h.Migrations[1].Operations, 2)
+
+	// The failed migration was rolled back as a whole.
+	schema, err := store.TableSchema(context.Background(), "orders")
+	require.NoError(t, err)
+	assert.Equal(t, 2, schema.Version)
+	names := make([]string, 0, len(schema.Columns))
+	for _, col := range schema.Columns {
+		names = append(names, col.Name)
+	}
+	assert.Equal(t, []string{"id", "total", "currency"}, names)
+
+	require.NoError(t, store.RenameTable(context.Background(), "orders", "purchases"))
+	assert.Equal(t, 2, history("purchases").Version)
+	assert.Equal(t, 0, history("orders").Version)
+}
+
+func TestServerSchemaHistory(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	post := func(requestID, body string) string {
+		req, reqErr := http.NewRequest(http.MethodPost, server.URL+"/data?Table=events", strings.NewReader(body))
+		require.NoError(t, reqErr)
+		if requestID != "" {
+			req.Header.Set(internal.RequestIDHeader, requestID)
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		return res.Header.Get(internal.RequestIDHeader)
+	}
+
+	assert.Equal(t, "first", post("first", `{"name": "signup"}`))
+	generated := post("", `{"name": "purchase", "amount": 9.5, "paid": true}`)
+	assert.NotEmpty(t, generated)
+	post("third", `{"name": "refund", "amount": 1}`)
+
+	res, err := http.Get(server.URL + "/tables/events/schema/history")
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var changes []internal.SchemaChange
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&changes))
+	for i := range changes {
+		assert.False(t, changes[i].At.IsZero())
+		changes[i].At = time.Time{}
+	}
+	assert.Equal(t, []internal.SchemaChange{
+		{Kind: internal.SchemaCreateTable, Table: "events", Column: "name", Type: "VARCHAR", RequestID: "first"},
+		{Kind: internal.SchemaAddColumn, Table: "events", Column: "amount", Type: "DOUBLE", RequestID: generated},
+		{Kind: internal.SchemaAddColumn, Table: "events", Column: "paid", Type: "BOOLEAN", RequestID: generated},
+	}, changes)
+
+	res, err = http.Get(server.URL + "/tables/missing/schema/history")
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&changes))
+	assert.Empty(t, changes)
+}
+
+func TestServerSchemaPolicy(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(table, body string) *http.Response {
+		return do(http.MethodPost, "/data?Table="+table, body)
+	}
+	policyError := func(res *http.Response) internal.SchemaPolicyError {
+		require.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+		var out internal.SchemaPolicyError
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&internal.ErrorResponse{Details: &out}))
+		return out
+	}
+	columns := func(table string) int {
+		schema, schemaErr := store.TableSchema(context.Background(), table)
+		require.NoError(t, schemaErr)
+		return len(schema.Columns)
+	}
+
+	res := do(http.MethodGet, "/tables/events/config", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var cfg internal.TableConfig
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&cfg))
+	assert.Equal(t, internal.SchemaPolicyAuto, cfg.SchemaPolicy)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/events/config",
+		`{"schema_policy": "sometimes"}`).StatusCode)
+
+	t.Run("locked", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/locked_events/config",
+			`{"schema_policy": "locked"}`).StatusCode)
+		assert.Equal(t, "table doesn't exist", policyError(insert("locked_events", `{"name": "a"}`)).Reason)
+
+		_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+			Query:       "create table locked_events (name VARCHAR)",
+			AllowWrites: true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, insert("locked_events", `{"name": "a"}`).StatusCode)
+		assert.Equal(t, "extra", policyError(insert("locked_events", `[{"name": "b"}, {"extra": 1}]`)).Column)
+		assert.Equal(t, 1, columns("locked_events"))
+	})
+
+	t.Run("additive only", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/additive/config",
+			`{"schema_policy": "additive-only"}`).StatusCode)
+		assert.Equal(t, http.StatusOK, insert("additive", `{"name": "a", "amount": 1.5}`).StatusCode)
+		assert.Equal(t, http.StatusOK, insert("additive", `{"name": "b", "amount": 2, "paid": true}`).StatusCode)
+		assert.Equal(t, 3, columns("additive"))
+
+		perr := policyError(insert("additive", `{"name": 3, "note": "x"}`))
+		assert.Equal(t, "name", perr.Column)
+		assert.Equal(t, internal.SchemaPolicyAdditiveOnly, perr.Policy)
+		// The new column of the refused insert wasn't added.
+		assert.Equal(t, 3, columns("additive"))
+		assert.Equal(t, http.StatusUnprocessableEntity, insert("additive", `{"paid": "yes"}`).StatusCode)
+	})
+
+	t.Run("auto", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, insert("events", `{"name": "a"}`).StatusCode)
+		assert.Equal(t, http.StatusOK, insert("events", `{"name": 3, "extra": true}`).StatusCode)
+		assert.Equal(t, 2, columns("events"))
+	})
+}
+
+func TestServerIndexes(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	list := func() []internal.IndexInfo {
+		res := do(http.MethodGet, "/tables/events/indexes", nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var out []internal.IndexInfo
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return out
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows: []map[string]any{
+			{"user_id": "a", "kind": "click"},
+			{"user_id": "a", "kind": "view"},
+		},
+	}))
+	assert.Empty(t, list())
+
+	res := do(http.MethodPut, "/tables/events/indexes/events_user", internal.IndexRequest{Columns: []string{"user_id"}})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var idx internal.IndexInfo
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&idx))
+	assert.Equal(t, "events_user", idx.Name)
+	assert.False(t, idx.Unique)
+	assert.Contains(t, idx.SQL, "user_id")
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/events/indexes/events_user", internal.IndexRequest{
+		Columns: []string{"user_id", "kind"},
+	}).StatusCode)
+	indexes := list()
+	require.Len(t, indexes, 1)
+	assert.Contains(t, indexes[0].SQL, "kind")
+
+	for name, req := range map[string]internal.IndexRequest{
+		"unknown column": {Columns: []string{"nope"}},
+		"no columns":     {},
+		"duplicates":     {Columns: []string{"user_id"}, Unique: true},
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/events/indexes/other", req).StatusCode, name)
+	}
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/tables/missing/indexes/other", internal.IndexRequest{
+		Columns: []string{"a"},
+	}).StatusCode)
+	assert.Len(t, list(), 1)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/tables/events/indexes/events_user", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/tables/events/indexes/events_user", nil).StatusCode)
+	assert.Empty(t, list())
+}
+
+func TestServerColumnConstraints(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(body string) int {
+		return do(http.MethodPost, "/data?Table=orders", body).StatusCode
+	}
+
+	for name, body := range map[string]string{
+		"unknown type":    `{"columns": [{"name": "id", "type": "UUID"}]}`,
+		"invalid name":    `{"columns": [{"name": "a b"}]}`,
+		"duplicate":       `{"columns": [{"name": "id"}, {"name": "ID"}]}`,
+		"statement check": `{"columns": [{"name": "id", "check": "id > 0); DROP TABLE orders; --"}]}`,
+		"unbalanced":      `{"columns": [{"name": "id", "check": "id > 0), CHECK (true"}]}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/orders/config", body).StatusCode, name)
+	}
+	res := do(http.MethodPut, "/tables/orders/config", `{"columns": [
+		{"name": "id", "type": "integer", "not_null": true, "unique": true},
+		{"name": "amount", "type": "DOUBLE", "check": "amount >= 0"},
+		{"name": "note", "not_null": true}
+	]}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var cfg internal.TableConfig
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&cfg))
+	assert.Equal(t, "INTEGER", cfg.Columns[0].Type)
+
+	// Declared columns are created with the table, the others as inserts carry them.
+	require.Equal(t, http.StatusOK, insert(`{"id": 1}`))
+	schema, err := store.TableSchema(context.Background(), "orders")
+	require.NoError(t, err)
+	require.Len(t, schema.Columns, 2)
+	assert.False(t, schema.Columns[0].Nullable)
+	assert.Equal(t, "amount", schema.Columns[1].Name)
+	assert.Equal(t, "DOUBLE", schema.Columns[1].Type)
+
+	assert.Equal(t, http.StatusOK, insert(`{"id": 2, "amount": 1.5}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, insert(`{"id": 1, "amount": 3}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, insert(`{"id": null, "amount": 3}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, insert(`{"id": 3, "amount": -1}`))
+	// A constrained column can't be added to an existing table.
+	assert.Equal(t, http.StatusConflict, insert(`{"id": 3, "note": "a"}`))
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select count(*)::DOUBLE as n from orders",
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 2, rows[0]["n"], 0)
+}
+
+func TestServerColumnDefaults(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(body string) int {
+		return do(http.MethodPost, "/data?Table=tickets", body).StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/tickets/config",
+		`{"columns": [{"name": "status", "default": "'a'; DROP TABLE tickets"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/tickets/config", `{"columns": [
+		{"name": "status", "type": "VARCHAR", "default": "'unknown'"},
+		{"name": "priority", "default": "3"}
+	]}`).StatusCode)
+
+	require.Equal(t, http.StatusOK, insert(`{"id": 1}`))
+	require.Equal(t, http.StatusOK, insert(`[{"id": 2, "status": "open"}, {"id": 3}, {"id": 4, "status": null}]`))
+	// The column is added with its default, which also fills the rows stored before.
+	require.Equal(t, http.StatusOK, insert(`[{"id": 5, "priority": 1}, {"id": 6}]`))
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select id::INT as id, status, priority from tickets order by id",
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 6)
+	assert.Equal(t, []any{"unknown", "open", "unknown", nil, "unknown", "unknown"}, []any{
+		rows[0]["status"], rows[1]["status"], rows[2]["status"], rows[3]["status"], rows[4]["status"], rows[5]["status"],
+	})
+	assert.InDelta(t, 3, rows[0]["priority"], 0)
+	assert.InDelta(t, 1, rows[4]["priority"], 0)
+	assert.InDelta(t, 3, rows[5]["priority"], 0)
+
+	schema, err := store.TableSchema(context.Background(), "tickets")
+	require.NoError(t, err)
+	for _, col := range schema.Columns {
+		if col.Name == "status" {
+			require.NotNil(t, col.Default)
+			assert.Equal(t, "'unknown'", *col.Default)
+		}
+		if col.Name == "id" {
+			assert.Nil(t, col.Default)
+		}
+	}
+}
+
+func TestServerGeneratedColumns(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(body string) int {
+		return do(http.MethodPost, "/data?Table=visits", body).StatusCode
+	}
+
+	for name, body := range map[string]string{
+		"not null": `{"columns": [{"name": "day", "generated": "1", "not_null": true}]}`,
+		"default":  `{"columns": [{"name": "day", "generated": "1", "default": "2"}]}`,
+		"invalid":  `{"columns": [{"name": "day", "generated": "1); DROP TABLE visits; --"}]}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/visits/config", body).StatusCode, name)
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/visits/config", `{"columns": [
+		{"name": "ts", "type": "VARCHAR"},
+		{"name": "day", "generated": "date_trunc('day', ts::TIMESTAMP)"},
+		{"name": "cents", "type": "INTEGER", "generated": "(amount * 100)::INTEGER"}
+	]}`).StatusCode)
+
+	require.Equal(t, http.StatusOK, insert(`{"ts": "2024-03-01 12:30:00", "amount": 1.25}`))
+	require.Equal(t, http.StatusOK, insert(`{"ts": "2024-03-02 08:00:00", "amount": 2}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, insert(`{"ts": "2024-03-03 08:00:00", "day": "2024-03-03"}`))
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select day::VARCHAR as day, cents from visits where day = '2024-03-01' order by ts",
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "2024-03-01", rows[0]["day"])
+	assert.EqualValues(t, 125, rows[0]["cents"])
+
+	schema, err := store.TableSchema(context.Background(), "visits")
+	require.NoError(t, err)
+	generated := map[string]string{}
+	for _, col := range schema.Columns {
+		generated[col.Name] = col.Generated
+		assert.Nil(t, col.Default, col.Name)
+	}
+	assert.Equal(t, "date_trunc('day', ts::TIMESTAMP)", generated["day"])
+	assert.Empty(t, generated["ts"])
+}
+
+func TestServerAutoIncrement(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithLimits(internal.Limits{MaxRowsPerStatement: 2}))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(body string) int {
+		return do(http.MethodPost, "/data?Table=orders", body).StatusCode
+	}
+	ids := func() []map[string]any {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "select id::DOUBLE as id, item from orders order by id",
+		})
+		require.NoError(t, queryErr)
+		return rows
+	}
+
+	for name, body := range map[string]string{
+		"type":      `{"columns": [{"name": "id", "type": "VARCHAR", "auto_increment": true}]}`,
+		"unknown":   `{"columns": [{"name": "id", "type": "SERIAL", "auto_increment": true}]}`,
+		"default":   `{"columns": [{"name": "id", "default": "1", "auto_increment": true}]}`,
+		"generated": `{"columns": [{"name": "id", "generated": "1", "auto_increment": true}]}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/orders/config", body).StatusCode, name)
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/orders/config",
+		`{"columns": [{"name": "id", "auto_increment": true, "not_null": true, "unique": true}]}`).StatusCode)
+
+	require.Equal(t, http.StatusOK, insert(`{"item": "a"}`))
+	require.Equal(t, http.StatusOK, insert(`[{"item": "b"}, {"item": "c"}, {"item": "d"}]`))
+	assert.Equal(t, http.StatusUnprocessableEntity, insert(`{"id": 10, "item": "e"}`))
+	assert.Equal(t, []map[string]any{
+		{"id": 1.0, "item": "a"}, {"id": 2.0, "item": "b"}, {"id": 3.0, "item": "c"}, {"id": 4.0, "item": "d"},
+	}, ids())
+	schema, err := store.TableSchema(context.Background(), "orders")
+	require.NoError(t, err)
+	types := map[string]string{}
+	for _, col := range schema.Columns {
+		types[col.Name] = col.Type
+	}
+	assert.Equal(t, map[string]string{"id": "BIGINT", "item": "VARCHAR"}, types)
+
+	// The sequence outlives the table, the IDs of a table created again don't repeat.
+	require.NoError(t, store.DropTable(context.Background(), "orders"))
+	require.Equal(t, http.StatusOK, insert(`{"item": "f"}`))
+	assert.Equal(t, []map[string]any{{"id": 5.0, "item": "f"}}, ids())
+
+	// The sequences of a_b.c and a.b_c are different.
+	for table, column := range map[string]string{"a_b": "c", "a": "b_c"} {
+		require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/"+table+"/config",
+			`{"columns": [{"name": "`+column+`", "auto_increment": true}]}`).StatusCode)
+		require.Equal(t, http.StatusOK, do(http.MethodPost, "/data?Table="+table, `{"item": "g"}`).StatusCode)
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "select " + column + "::DOUBLE as id from " + table,
+		})
+		require.NoError(t, queryErr)
+		assert.Equal(t, []map[string]any{{"id": 1.0}}, rows, table)
+	}
+}
+
+func TestServerCopyTable(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	copyTable := func(table string, req internal.CopyTableRequest) *http.Response {
+		out, marshalErr := json.Marshal(req)
+		require.NoError(t, marshalErr)
+		res, postErr := http.Post(server.URL+"/tables/"+table+"/copy", "application/json", bytes.NewReader(out))
+		require.NoError(t, postErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"kind": "click", "n": 1.0}, {"kind": "view", "n": 2.0}, {"kind": "click", "n": 3.0}},
+	}))
+
+	res := copyTable("events", internal.CopyTableRequest{Name: "events_backup"})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var out internal.CopyTableResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	assert.Equal(t, internal.CopyTableResponse{Table: "events_backup", Rows: 3}, out)
+
+	// The copy doesn't follow later writes to its source.
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "click", "n": 4.0},
+	}))
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select count(*)::DOUBLE as n from events_backup",
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 3, rows[0]["n"], 0)
+
+	res = copyTable("events", internal.CopyTableRequest{
+		Name:   "clicks",
+		Query:  "select n from events where kind = ?",
+		Params: []any{"click"},
+	})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	assert.EqualValues(t, 3, out.Rows)
+
+	assert.Equal(t, http.StatusConflict, copyTable("events", internal.CopyTableRequest{Name: "clicks"}).StatusCode)
+	assert.Equal(t, http.StatusNotFound, copyTable("missing", internal.CopyTableRequest{Name: "x"}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, copyTable("events", internal.CopyTableRequest{Name: "a b"}).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, copyTable("events", internal.CopyTableRequest{
+		Name:  "dropped",
+		Query: "drop table events",
+	}).StatusCode)
+}
+
+func TestServerSnapshots(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	do := func(method, path string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			out, marshalErr := json.Marshal(body)
+			require.NoError(t, marshalErr)
+			reader = bytes.NewReader(out)
+		}
+		req, reqErr := http.NewRequest(method, server.URL+path, reader)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(amount float64) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "sales",
+			Columns: map[string]any{"amount": amount},
+		}))
+	}
+	total := func(asOf map[string]string) float64 {
+		res := do(http.MethodPost, "/query", internal.QueryRequest{
+			SQL:  "select sum(s.amount) as total from sales s",
+			AsOf: asOf,
+		})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var rows []map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&rows))
+		return rows[0]["total"].(float64)
+	}
+
+	insert(1)
+	insert(2)
+	res := do(http.MethodPost, "/tables/sales/snapshots", internal.SnapshotRequest{Name: "week-10"})
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var snap internal.Snapshot
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&snap))
+	assert.Equal(t, "week-10", snap.Name)
+	assert.EqualValues(t, 2, snap.Rows)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/tables/sales/snapshots",
+		internal.SnapshotRequest{Name: "week-10"}).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/tables/missing/snapshots", nil).StatusCode)
+
+	insert(4)
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/tables/sales/snapshots", nil).StatusCode)
+	insert(8)
+
+	assert.InDelta(t, 15, total(nil), 0)
+	assert.InDelta(t, 3, total(map[string]string{"sales": "week-10"}), 0)
+	assert.InDelta(t, 3, total(map[string]string{"sales": snap.ID}), 0)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/query", internal.QueryRequest{
+		SQL:  "select * from sales",
+		AsOf: map[string]string{"sales": "week-11"},
+	}).StatusCode)
+
+	// The copy can be queried directly as well.
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select count(*)::DOUBLE as n from " + snap.Relation,
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 2, rows[0]["n"], 0)
+
+	// Snapshots follow their table when it is renamed.
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/tables/sales/rename",
+		internal.RenameRequest{Name: "orders"}).StatusCode)
+	res = do(http.MethodGet, "/tables/orders/snapshots", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var snaps []internal.Snapshot
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&snaps))
+	require.Len(t, snaps, 2)
+	assert.Equal(t, snap.ID, snaps[0].ID)
+	assert.EqualValues(t, 3, snaps[1].Rows)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/tables/orders/snapshots/week-10", nil).StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/tables/orders/snapshots/week-10", nil).StatusCode)
+	_, err = store.Query(context.Background(), &internal.QueryStatement{Query: "select * from " + snap.Relation})
+	require.Error(t, err)
+}
+
+func TestServerDeleteRows(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows: []map[string]any{
+			{"user_id": "u1", "kind": "click"},
+			{"user_id": "u2", "kind": "click"},
+			{"user_id": "u1", "kind": "view"},
+			{"user_id": "u3", "kind": "view"},
+		},
+	}))
+	del := func(table, params string) (int, internal.DeleteRowsResponse) {
+		req, reqErr := http.NewRequest(http.MethodDelete, server.URL+"/tables/"+table+"/rows?"+params, nil)
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.DeleteRowsResponse
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	count := func() float64 {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "select count(*)::DOUBLE as n from events",
+		})
+		require.NoError(t, queryErr)
+		return rows[0]["n"].(float64)
+	}
+
+	code, _ := del("events", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = del("events", "filter=nope:eq:1")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = del("missing", "filter=user_id:eq:u1")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.InDelta(t, 4, count(), 0)
+
+	code, out := del("events", "filter=user_id:eq:u1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.DeleteRowsResponse{Table: "events", Deleted: 2}, out)
+	code, out = del("events", "filter=user_id:in:u2,u3&filter=kind:eq:view")
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, out.Deleted)
+	assert.InDelta(t, 1, count(), 0)
+
+	code, out = del("events", "all=true")
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, out.Deleted)
+	assert.InDelta(t, 0, count(), 0)
+}
+
+func TestServerSettings(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{
+		Threads:  2,
+		Settings: map[string]string{"default_order": "desc"},
+	}))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	res, err := http.Get(server.URL + "/admin/settings")
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var settings []internal.Setting
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&settings))
+	values := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		values[setting.Name] = setting.Value
+	}
+	assert.Equal(t, "2", values["threads"])
+	assert.Equal(t, "desc", values["default_order"])
+
+	_, err = internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{
+		Settings: map[string]string{"threads; DROP": "1"},
+	}))
+	require.Error(t, err)
+}
+
+func TestServerSecrets(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "secrets.bin")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	secrets, err := internal.NewSecrets(context.Background(), store, path, key)
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithSecrets(secrets)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	put := func(name, body string) (int, string) {
+		req, reqErr := http.NewRequest(http.MethodPut, server.URL+"/admin/secrets/"+name, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(out)
+	}
+	code, _ := put("bad", `{"type": "ftp"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = put("bad", `{"type": "s3", "options": {"key_id) ; --": "x"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body := put("lake", `{"type": "S3", "scope": "s3://lake", "options": {"key_id": "AKIA", "secret": "s3cr3t"}}`)
+	if code == http.StatusInternalServerError {
+		t.Skipf("creating an S3 secret needs the httpfs extension: %s", body)
+	}
+	require.Equal(t, http.StatusCreated, code, body)
+	assert.NotContains(t, body, "s3cr3t")
+
+	res, err := http.Get(server.URL + "/admin/secrets/lake")
+	require.NoError(t, err)
+	var sec internal.Secret
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&sec))
+	_ = res.Body.Close()
+	assert.Equal(t, "s3://lake", sec.Scope)
+	assert.NotEqual(t, "s3cr3t", sec.Options["secret"])
+	assert.Contains(t, sec.Options, "key_id")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "s3cr3t")
+
+	restarted, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, restarted.Close())
+	})
+	reloaded, err := internal.NewSecrets(context.Background(), restarted, path, key)
+	require.NoError(t, err)
+	require.Len(t, reloaded.List(), 1)
+	assert.Empty(t, reloaded.List()[0].Error)
+	_, err = internal.NewSecrets(context.Background(), restarted, path,
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	require.Error(t, err)
+}
+
+func TestServerImport(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("id,name\n1,a\n2,b\n"))
+	}))
+	t.Cleanup(func() {
+		files.Close()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	post := func(table, body string) (int, string) {
+		res, postErr := http.Post(server.URL+"/tables/"+table+"/import", "application/json", strings.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(out)
+	}
+	code, _ := post("users", `{"url": "/etc/passwd", "format": "csv"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("users", `{"url": "file:///etc/passwd", "format": "csv"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("users", `{"url": "s3://bucket/users.xml"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("users", `{"url": "s3://bucket/users.csv", "append": true}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body := post("users", fmt.Sprintf(`{"url": %q}`, files.URL+"/users.csv"))
+	if code != http.StatusCreated && strings.Contains(body, "httpfs") {
+		t.Skipf("importing over http needs the httpfs extension: %s", body)
+	}
+	require.Equal(t, http.StatusCreated, code, body)
+	assert.JSONEq(t, `{"table": "users", "rows": 2}`, body)
+	code, _ = post("users", fmt.Sprintf(`{"url": %q}`, files.URL+"/users.csv"))
+	assert.Equal(t, http.StatusConflict, code)
+	code, body = post("users", fmt.Sprintf(`{"url": %q, "append": true}`, files.URL+"/users.csv"))
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"table": "users", "rows": 2}`, body)
+}
+
+func TestServerExport(t *testing.T) {
+	dir := t.TempDir()
+	store, err := internal.NewDuckDBStore(internal.WithExportDirectory(dir))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows: []map[string]any{
+			{"dt": "2024-01-01", "kind": "click"},
+			{"dt": "2024-01-01", "kind": "view"},
+			{"dt": "2024-01-02", "kind": "click"},
+		},
+	}))
+
+	post := func(table, body string) (int, internal.ExportManifest) {
+		res, postErr := http.Post(server.URL+"/tables/"+table+"/export", "application/json", strings.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.ExportManifest
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	code, _ := post("events", `{"url": "../escape.parquet"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("events", `{"url": "https://example.com/events.parquet"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("events", `{"url": "events.parquet", "filters": ["nope:eq:1"]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post("missing", `{"url": "missing.parquet"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, out := post("events", `{"url": "out/clicks.parquet", "filters": ["kind:eq:click"], "compression": "zstd"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.ExportManifest{Table: "events", Rows: 2, Files: []string{"out/clicks.parquet"}}, out)
+	code, _ = post("events", `{"url": "out/clicks.parquet"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, out = post("events", `{"url": "partitioned", "partition_by": ["dt"]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, out.Rows)
+	require.Len(t, out.Files, 2)
+	assert.True(t, strings.HasPrefix(out.Files[0], filepath.Join("partitioned", "dt=2024-01-01")), out.Files[0])
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: fmt.Sprintf("select count(*)::DOUBLE as n from read_parquet('%s')", filepath.Join(dir, "out/clicks.parquet")),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": 2.0}}, rows)
+}
+
+func TestServerQueryDestination(t *testing.T) {
+	dir := t.TempDir()
+	store, err := internal.NewDuckDBStore(internal.WithExportDirectory(dir))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows: []map[string]any{
+			{"dt": "2024-01-01", "kind": "click"},
+			{"dt": "2024-01-01", "kind": "view"},
+			{"dt": "2024-01-02", "kind": "click"},
+		},
+	}))
+
+	post := func(body string) (int, internal.ExportManifest) {
+		res, postErr := http.Post(server.URL+"/query", "application/json", strings.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.ExportManifest
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	for _, body := range []string{
+		`{"sql": "select * from events", "destination": {"url": "../escape.parquet"}}`,
+		`{"sql": "select * from events", "destination": {"url": "https://example.com/out.parquet"}}`,
+		`{"sql": "select * from events", "destination": {"url": "out.json", "format": "json"}}`,
+		`{"sql": "select * from events", "destination": {"url": "out.csv", "format": "csv", "compression": "snappy"}}`,
+		`{"sql": "select * from events", "limit": 1, "destination": {"url": "out.parquet"}}`,
+	} {
+		code, _ := post(body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	code, out := post(`{"sql": "delete from events", "destination": {"url": "out.parquet"}}`)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, out = post(`{"sql": "select kind from events where kind = ?", "params": ["click"],
+		"destination": {"url": "out/clicks.parquet"}}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.ExportManifest{Rows: 2, Files: []string{filepath.Join("out", "clicks.parquet")}}, out)
+	code, _ = post(`{"sql": "select 1 as x", "destination": {"url": "out/clicks.parquet"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, out = post(`{"sql": "select * from events",
+		"destination": {"url": "by_day", "format": "csv", "partition_by": ["dt"]}}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 3, out.Rows)
+	require.Len(t, out.Files, 2)
+	assert.True(t, strings.HasPrefix(out.Files[0], filepath.Join("by_day", "dt=2024-01-01")), out.Files[0])
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: fmt.Sprintf("select count(*)::DOUBLE as n from read_parquet('%s') where kind = 'click'",
+			filepath.Join(dir, "out", "clicks.parquet")),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": 2.0}}, rows)
+	rows, err = store.Query(context.Background(), &internal.QueryStatement{
+		Query: fmt.Sprintf("select count(*)::DOUBLE as n from read_csv('%s/**/*.csv', hive_partitioning = true)",
+			filepath.Join(dir, "by_day")),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": 3.0}}, rows)
+}
+
+func TestServerScheduledExport(t *testing.T) {
+	dir := t.TempDir()
+	store, err := internal.NewDuckDBStore(internal.WithExportDirectory(dir))
+	require.NoError(t, err)
+	scheduler := internal.NewScheduler(store, time.Minute)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithScheduler(scheduler)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	insert := func(rows ...map[string]any) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{Table: "events", Rows: rows}))
+	}
+	insert(map[string]any{"id": 1, "at": "2024-01-01 10:00:00"}, map[string]any{"id": 2, "at": "2024-01-02 11:00:00"})
+
+	put := func(body string) int {
+		req, reqErr := http.NewRequest(http.MethodPut, server.URL+"/admin/schedules/events_export",
+			strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, put(`{"cron": "@daily", "table": "events", "sql": "select 1",
+		"export": {"url": "events", "watermark": "id"}}`))
+	assert.Equal(t, http.StatusBadRequest, put(`{"cron": "@daily", "table": "events", "export": {"url": "events"}}`))
+	require.Equal(t, http.StatusCreated, put(`{"cron": "@daily", "table": "events",
+		"export": {"url": "events", "watermark": "id", "date_column": "at"}}`))
+
+	run := func() internal.Schedule {
+		res, postErr := http.Post(server.URL+"/admin/schedules/events_export/run", "application/json", nil)
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var sch internal.Schedule
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&sch))
+		require.Empty(t, sch.LastError)
+		return sch
+	}
+	sch := run()
+	assert.EqualValues(t, 2, sch.LastRows)
+	assert.EqualValues(t, 2, sch.Export.HighWaterMark)
+	assert.Len(t, sch.Export.LastFiles, 2)
+
+	sch = run()
+	assert.EqualValues(t, 0, sch.LastRows)
+
+	insert(map[string]any{"id": 3, "at": "2024-01-02 12:00:00"})
+	sch = run()
+	assert.EqualValues(t, 1, sch.LastRows)
+	assert.EqualValues(t, 3, sch.Export.HighWaterMark)
+	assert.Len(t, sch.Export.LastFiles, 3)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: fmt.Sprintf(
+			"select dt::VARCHAR as dt, count(*)::DOUBLE as n "+
+				"from read_parquet('%s/**/*.parquet', hive_partitioning = true) group by dt order by dt",
+			filepath.Join(dir, "events"),
+		),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"dt": "2024-01-01", "n": 1.0}, {"dt": "2024-01-02", "n": 2.0}}, rows)
+}
+
+func TestServerExportDelta(t *testing.T) {
+	dir := t.TempDir()
+	store, err := internal.NewDuckDBStore(internal.WithExportDirectory(dir))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"id": 1, "kind": "click"}, {"id": 2, "kind": "view"}},
+	}))
+
+	post := func(body string) (int, internal.DeltaCommit) {
+		res, postErr := http.Post(server.URL+"/tables/events/export/delta", "application/json",
+			strings.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.DeltaCommit
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	code, _ := post(`{"url": "lake/events", "mode": "merge"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, first := post(`{"url": "lake/events"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 0, first.Version)
+	assert.EqualValues(t, 2, first.Rows)
+	code, second := post(`{"url": "lake/events", "filters": ["kind:eq:click"]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, second.Version)
+	assert.EqualValues(t, 1, second.Rows)
+	code, third := post(`{"url": "lake/events", "mode": "overwrite"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 2, third.Version)
+	assert.ElementsMatch(t, []string{first.File, second.File}, third.Removed)
+
+	actions := func(version int) []map[string]json.RawMessage {
+		data, readErr := os.ReadFile(filepath.Join(dir, "lake/events/_delta_log", fmt.Sprintf("%020d.json", version)))
+		require.NoError(t, readErr)
+		var out []map[string]json.RawMessage
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var action map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal([]byte(line), &action), line)
+			out = append(out, action)
+		}
+		return out
+	}
+	kinds := func(version int) []string {
+		var out []string
+		for _, action := range actions(version) {
+			for kind := range action {
+				out = append(out, kind)
+			}
+		}
+		return out
+	}
+	assert.Equal(t, []string{"commitInfo", "protocol", "metaData", "add"}, kinds(0))
+	assert.Equal(t, []string{"commitInfo", "metaData", "add"}, kinds(1))
+	assert.Equal(t, []string{"commitInfo", "metaData", "remove", "remove", "add"}, kinds(2))
+	// The metadata only differs in createdTime, the time of the metadata action.
+	metaData := func(version, i int) map[string]any {
+		var out map[string]any
+		require.NoError(t, json.Unmarshal(actions(version)[i]["metaData"], &out))
+		delete(out, "createdTime")
+		return out
+	}
+	assert.Equal(t, metaData(0, 2), metaData(1, 1))
+}
+
+func TestServerBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	newServer := func() (*internal.Store, *httptest.Server) {
+		store, err := internal.NewDuckDBStore(internal.WithBackupDirectory(dir))
+		require.NoError(t, err)
+		server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+		t.Cleanup(func() {
+			server.Close()
+			assert.NoError(t, store.Close())
+		})
+		return store, server
+	}
+	post := func(server *httptest.Server, path, body string) (int, internal.Backup) {
+		res, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.Backup
+		if res.StatusCode < 300 {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+
+	source, sourceServer := newServer()
+	require.NoError(t, source.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"id": 1, "kind": "click"}, {"id": 2, "kind": "view"}},
+	}))
+	code, backup := post(sourceServer, "/admin/backup", "")
+	require.Equal(t, http.StatusCreated, code)
+	assert.False(t, backup.Created.IsZero())
+	code, _ = post(sourceServer, "/admin/backup", `{"url": "file:///tmp/backups"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	res, err := http.Get(sourceServer.URL + "/admin/backups")
+	require.NoError(t, err)
+	var backups []internal.Backup
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&backups))
+	require.NoError(t, res.Body.Close())
+	require.Len(t, backups, 1)
+	assert.Equal(t, backup.Name, backups[0].Name)
+
+	code, _ = post(sourceServer, "/admin/restore", fmt.Sprintf(`{"name": %q}`, backup.Name))
+	assert.Equal(t, http.StatusConflict, code)
+
+	target, targetServer := newServer()
+	code, _ = post(targetServer, "/admin/restore", `{"name": "../etc"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(targetServer, "/admin/restore", `{"name": "20000101T000000.000000000Z"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, restored := post(targetServer, "/admin/restore", fmt.Sprintf(`{"name": %q}`, backup.Name))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, backup.Name, restored.Name)
+	rows, err := target.Query(context.Background(), &internal.QueryStatement{
+		Query: "SELECT id, kind FROM events ORDER BY id",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"id": int32(1), "kind": "click"}, {"id": int32(2), "kind": "view"}}, rows)
+}
+
+func TestServerPointInTimeRestore(t *testing.T) {
+	dir := t.TempDir()
+	newServer := func(opts ...internal.StoreOption) (*internal.Store, *httptest.Server) {
+		store, err := internal.NewDuckDBStore(append([]internal.StoreOption{internal.WithBackupDirectory(dir)}, opts...)...)
+		require.NoError(t, err)
+		server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+		t.Cleanup(func() {
+			server.Close()
+			assert.NoError(t, store.Close())
+		})
+		return store, server
+	}
+	post := func(server *httptest.Server, path, body string) (int, internal.RestoreResult) {
+		res, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.RestoreResult
+		if res.StatusCode < 300 {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	insert := func(store *internal.Store, id int) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "events",
+			Columns: map[string]any{"id": id},
+		}))
+	}
+
+	log := filepath.Join(dir, "ingest.log")
+	source, sourceServer := newServer(internal.WithIngestLog(log))
+	insert(source, 1)
+	code, backup := post(sourceServer, "/admin/backup", "")
+	require.Equal(t, http.StatusCreated, code)
+	insert(source, 2)
+	until := time.Now().UTC()
+	time.Sleep(time.Millisecond)
+	insert(source, 3)
+
+	_, withoutLog := newServer()
+	code, _ = post(withoutLog, "/admin/restore", fmt.Sprintf(`{"name": %q, "until": %q}`,
+		backup.Name, until.Format(time.RFC3339Nano)))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	target, targetServer := newServer(internal.WithIngestLog(log))
+	code, restored := post(targetServer, "/admin/restore", fmt.Sprintf(`{"name": %q, "until": %q}`,
+		backup.Name, until.Format(time.RFC3339Nano)))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, restored.Replayed)
+	assert.Zero(t, restored.Skipped)
+	rows, err := target.Query(context.Background(), &internal.QueryStatement{Query: "SELECT id FROM events ORDER BY id"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"id": int32(1)}, {"id": int32(2)}}, rows)
+}
+
+func TestServerCheckpoint(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{
+		Path: filepath.Join(t.TempDir(), "scratch.db"),
+	}))
+	require.NoError(t, err)
+	checkpointer := internal.NewCheckpointer(store, 0)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithCheckpointer(checkpointer)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	rows := make([]map[string]any, 1000)
+	for i := range rows {
+		rows[i] = map[string]any{"id": i, "payload": strings.Repeat("x", 100)}
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{Table: "events", Rows: rows}))
+
+	res, err := http.Post(server.URL+"/admin/checkpoint", "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var run internal.CheckpointRun
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&run))
+	require.NoError(t, res.Body.Close())
+	assert.Positive(t, run.BytesAfter)
+	assert.Equal(t, max(run.BytesBefore-run.BytesAfter, 0), run.ReclaimedBytes)
+
+	res, err = http.Get(server.URL + "/admin/checkpoint")
+	require.NoError(t, err)
+	var stats internal.CheckpointStats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+	require.NoError(t, res.Body.Close())
+	assert.EqualValues(t, 1, stats.Runs)
+	assert.Equal(t, run.ReclaimedBytes, stats.ReclaimedBytes)
+	assert.Nil(t, stats.NextRun)
+}
+
+func TestServerTiering(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithExportDirectory(t.TempDir()))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	count := func(relation string) int64 {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "SELECT count(*) AS n FROM " + relation,
+		})
+		require.NoError(t, queryErr)
+		return rows[0]["n"].(int64)
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows: []map[string]any{
+			{"ts": "2020-01-01T10:00:00", "kind": "click"},
+			{"ts": "2020-01-02T10:00:00", "kind": "view"},
+			{"ts": time.Now().UTC().Format(time.RFC3339), "kind": "click"},
+		},
+	}))
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/tables/events/tier", "").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/events/config",
+		`{"tiering": {"url": "../cold", "time_column": "ts", "after_days": 30}}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/tables/events/config",
+		`{"tiering": {"url": "cold/events", "time_column": "ts", "after_days": 0}}`).StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/tables/events/config",
+		`{"tiering": {"url": "cold/events", "time_column": "ts", "after_days": 30}}`).StatusCode)
+
+	res := do(http.MethodPost, "/admin/tables/events/tier", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var tier internal.TierResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&tier))
+	assert.Equal(t, "events_all", tier.View)
+	assert.EqualValues(t, 2, tier.Rows)
+	assert.Len(t, tier.Files, 2)
+	assert.EqualValues(t, 1, count("events"))
+	assert.EqualValues(t, 3, count("events_all"))
+
+	res = do(http.MethodPost, "/admin/tables/events/tier", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&tier))
+	assert.Zero(t, tier.Rows)
+	assert.EqualValues(t, 3, count("events_all"))
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "SELECT kind FROM events_all WHERE ts < '2021' ORDER BY ts",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"kind": "click"}, {"kind": "view"}}, rows)
+}
+
+func TestServerAttachments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reference.db")
+	reference, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{Path: path}))
+	require.NoError(t, err)
+	require.NoError(t, reference.Insert(context.Background(), &internal.InsertStatement{
+		Table: "countries",
+		Rows:  []map[string]any{{"code": "de", "name": "Germany"}, {"code": "fr", "name": "France"}},
+	}))
+	require.NoError(t, reference.Close())
+
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	attachments := internal.NewAttachments(context.Background(), store, []internal.Attachment{
+		{Name: "missing", Type: "duckdb", Path: filepath.Join(t.TempDir(), "missing", "x.db"), ReadOnly: true},
+		{Name: "pg", Type: "postgres", Path: "host=127.0.0.1 port=1 password=hunter2 dbname=reference"},
+	})
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAttachments(attachments)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"country": "de"}, {"country": "fr"}, {"country": "de"}},
+	}))
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+
+	missing, err := attachments.Get("missing")
+	require.NoError(t, err)
+	assert.NotEmpty(t, missing.Error)
+	pg, err := attachments.Get("pg")
+	require.NoError(t, err)
+	assert.Equal(t, "host=127.0.0.1 port=1 password=******** dbname=reference", pg.Path)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/attachments/temp",
+		`{"type": "duckdb", "path": "x.db"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/attachments/ref",
+		`{"type": "mysql", "path": "x"}`).StatusCode)
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/admin/attachments/ref",
+		fmt.Sprintf(`{"type": "duckdb", "path": %q, "read_only": true}`, path)).StatusCode)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: `SELECT c.name, count(*) AS n FROM events e JOIN ref.main.countries c ON c.code = e.country
+			GROUP BY c.name ORDER BY c.name`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"name": "France", "n": int64(1)}, {"name": "Germany", "n": int64(2)}}, rows)
+	tables, err := store.Tables(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "events", tables[0].Name)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/attachments/ref", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/attachments/ref", "").StatusCode)
+	_, err = store.Query(context.Background(), &internal.QueryStatement{Query: "SELECT * FROM ref.main.countries"})
+	assert.Error(t, err)
+}
+
+func TestServerRollups(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	rollups := internal.NewRollups(store, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	go rollups.Run(ctx)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithRollups(rollups)).NewServeMux())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() {
+			_ = res.Body.Close()
+		})
+		return res
+	}
+	insert := func(rows ...map[string]any) {
+		require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{Table: "events", Rows: rows}))
+	}
+	buckets := func() []map[string]any {
+		rows, queryErr := store.Query(context.Background(), &internal.QueryStatement{
+			Query: "SELECT strftime(bucket, '%H:%M') AS minute, kind, count, sum_n::DOUBLE AS sum_n FROM per_minute " +
+				"ORDER BY ALL",
+		})
+		require.NoError(t, queryErr)
+		return rows
+	}
+
+	insert(
+		map[string]any{"ts": "2024-01-01T10:00:05", "kind": "click", "n": 1},
+		map[string]any{"ts": "2024-01-01T10:00:50", "kind": "click", "n": 2},
+		map[string]any{"ts": "2024-01-01T10:01:10", "kind": "view", "n": 3},
+	)
+	rollup := `{"table": "events", "time_column": "ts", "bucket": "1m", "group_by": ["kind"], ` +
+		`"metrics": ["count", "sum(n)"]}`
+	res := do(http.MethodPut, "/admin/rollups/per_minute", rollup)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var got internal.Rollup
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	assert.EqualValues(t, 2, got.LastRows)
+	require.NotNil(t, got.Watermark)
+	assert.Equal(t, time.Date(2024, 1, 1, 10, 1, 0, 0, time.UTC), *got.Watermark)
+	assert.Equal(t, []map[string]any{
+		{"minute": "10:00", "kind": "click", "count": int64(2), "sum_n": float64(3)},
+		{"minute": "10:01", "kind": "view", "count": int64(1), "sum_n": float64(3)},
+	}, buckets())
+
+	insert(
+		map[string]any{"ts": "2024-01-01T10:01:20", "kind": "view", "n": 4},
+		map[string]any{"ts": "2024-01-01T10:02:00", "kind": "click", "n": 5},
+	)
+	assert.Eventually(t, func() bool {
+		return len(buckets()) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []map[string]any{
+		{"minute": "10:00", "kind": "click", "count": int64(2), "sum_n": float64(3)},
+		{"minute": "10:01", "kind": "view", "count": int64(2), "sum_n": float64(7)},
+		{"minute": "10:02", "kind": "click", "count": int64(1), "sum_n": float64(5)},
+	}, buckets())
+
+	// Rows older than the watermark are only picked up by a full refresh.
+	insert(map[string]any{"ts": "2024-01-01T10:00:30", "kind": "click", "n": 10})
+	res = do(http.MethodPost, "/admin/rollups/per_minute/refresh", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.EqualValues(t, 2, buckets()[0]["count"])
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/rollups/per_minute/refresh?full=true", "").StatusCode)
+	assert.EqualValues(t, 3, buckets()[0]["count"])
+
+	assert.Equal(t, http.StatusConflict, do(http.MethodPut, "/admin/rollups/events",
+		`{"table": "other", "time_column": "ts", "bucket": "1m"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/rollups/fast",
+		`{"table": "events", "time_column": "ts", "bucket": "10ms"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/rollups/broken",
+		`{"table": "events", "time_column": "missing", "bucket": "1m"}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPut, "/admin/rollups/orphan",
+		`{"table": "missing", "time_column": "ts", "bucket": "1m"}`).StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/rollups/per_minute", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/rollups/per_minute", "").StatusCode)
+	_, err = store.Query(context.Background(), &internal.QueryStatement{Query: "SELECT * FROM per_minute"})
+	assert.Error(t, err)
+}
+
+func TestServerChangeFeed(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithChangeFeed(time.Hour))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	changes := func(query string) internal.ChangesResponse {
+		res, getErr := http.Get(server.URL + "/tables/events/changes" + query)
+		require.NoError(t, getErr)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var out internal.ChangesResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return out
+	}
+
+	assert.Equal(t, internal.ChangesResponse{Changes: []internal.Change{}}, changes(""))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"kind": "click"}, {"kind": "view"}},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "other",
+		Columns: map[string]any{"kind": "click"},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "click", "n": 1},
+	}))
+
+	res := changes("")
+	require.Len(t, res.Changes, 4)
+	assert.Equal(t, internal.ChangeSchema, res.Changes[0].Kind)
+	assert.Equal(t, internal.SchemaCreateTable, res.Changes[0].Schema.Kind)
+	assert.Equal(t, "kind", res.Changes[0].Schema.Column)
+	assert.Equal(t, internal.ChangeInsert, res.Changes[1].Kind)
+	assert.Equal(t, []map[string]any{{"kind": "click"}, {"kind": "view"}}, res.Changes[1].Rows)
+	assert.Equal(t, internal.SchemaAddColumn, res.Changes[2].Schema.Kind)
+	assert.Equal(t, "n", res.Changes[2].Schema.Column)
+	assert.Equal(t, []map[string]any{{"kind": "click", "n": float64(1)}}, res.Changes[3].Rows)
+	assert.Equal(t, res.Changes[3].Seq, res.Next)
+	for i := 1; i < len(res.Changes); i++ {
+		assert.Greater(t, res.Changes[i].Seq, res.Changes[i-1].Seq)
+	}
+
+	page := changes(fmt.Sprintf("?since=%d&limit=1", res.Changes[1].Seq))
+	assert.Equal(t, []internal.Change{res.Changes[2]}, page.Changes)
+	assert.Equal(t, res.Changes[2].Seq, page.Next)
+	assert.Empty(t, changes(fmt.Sprintf("?since=%d", res.Next)).Changes)
+
+	res2, err := http.Get(server.URL + "/tables/events/changes?since=x")
+	require.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res2.StatusCode)
+}
+
+func TestServerTail(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	dial := func(query string) (net.Conn, *bufio.Reader) {
+		conn, dialErr := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, dialErr)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_, dialErr = fmt.Fprintf(conn, "GET /tables/events/tail%s HTTP/1.1\r\nHost: scratch\r\nUpgrade: websocket\r\n"+
+			"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", query)
+		require.NoError(t, dialErr)
+		reader := bufio.NewReader(conn)
+		res, dialErr := http.ReadResponse(reader, nil)
+		require.NoError(t, dialErr)
+		require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+		assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+		return conn, reader
+	}
+	next := func(conn net.Conn, reader *bufio.Reader) internal.TailEvent {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		header := make([]byte, 2)
+		_, readErr := io.ReadFull(reader, header)
+		require.NoError(t, readErr)
+		require.Equal(t, byte(0x81), header[0])
+		n := int(header[1])
+		if n == 126 {
+			ext := make([]byte, 2)
+			_, readErr = io.ReadFull(reader, ext)
+			require.NoError(t, readErr)
+			n = int(ext[0])<<8 | int(ext[1])
+		}
+		payload := make([]byte, n)
+		_, readErr = io.ReadFull(reader, payload)
+		require.NoError(t, readErr)
+		var event internal.TailEvent
+		require.NoError(t, json.Unmarshal(payload, &event))
+		return event
+	}
+
+	res, err := http.Get(server.URL + "/tables/events/tail")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, err = http.Get(server.URL + "/tables/events/tail?filter=kind:like:c%25")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Browser pages of other origins can't open a stream, those of the server and of the CORS origins can.
+	handshake := func(server *httptest.Server, origin string) int {
+		req, reqErr := http.NewRequest(http.MethodGet, server.URL+"/tables/events/tail", nil)
+		require.NoError(t, reqErr)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Origin", origin)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusForbidden, handshake(server, "https://evil.example"))
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake(server, server.URL))
+	corsServer := httptest.NewServer(internal.NewServer(store, internal.WithCORS(internal.CORS{
+		AllowedOrigins: []string{"https://dash.example"},
+	})).NewServeMux())
+	t.Cleanup(corsServer.Close)
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake(corsServer, "https://dash.example"))
+	assert.Equal(t, http.StatusForbidden, handshake(corsServer, "https://evil.example"))
+
+	all, allReader := dial("")
+	clicks, clicksReader := dial("?filter=kind:eq:click&filter=n:gt:1")
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"kind": "click", "n": 1}, {"kind": "view", "n": 2}},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "other",
+		Rows:  []map[string]any{{"kind": "click", "n": 5}},
+	}))
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"kind": "click", "n": 3}},
+	}))
+
+	event := next(all, allReader)
+	assert.Equal(t, "events", event.Table)
+	assert.Equal(t, []map[string]any{{"kind": "click", "n": float64(1)}, {"kind": "view", "n": float64(2)}}, event.Rows)
+	assert.Equal(t, []map[string]any{{"kind": "click", "n": float64(3)}}, next(all, allReader).Rows)
+	assert.Equal(t, []map[string]any{{"kind": "click", "n": float64(3)}}, next(clicks, clicksReader).Rows)
+}
+
+func TestServerReplication(t *testing.T) {
+	leaderStore, err := internal.NewDuckDBStore(internal.WithChangeFeed(time.Hour))
+	require.NoError(t, err)
+	leader := httptest.NewServer(internal.NewServer(leaderStore).Handler())
+	followerStore, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	follower, err := internal.NewFollower(ctx, followerStore, leader.URL, "", 10*time.Millisecond)
+	require.NoError(t, err)
+	go follower.Run(ctx)
+	server := httptest.NewServer(internal.NewServer(followerStore, internal.WithFollower(follower)).Handler())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		leader.Close()
+		assert.NoError(t, followerStore.Close())
+		assert.NoError(t, leaderStore.Close())
+	})
+	query := func(sql string) []map[string]any {
+		rows, queryErr := followerStore.Query(context.Background(), &internal.QueryStatement{Query: sql})
+		if queryErr != nil {
+			return nil
+		}
+		return rows
+	}
+
+	require.NoError(t, leaderStore.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"kind": "click", "n": 1}, {"kind": "view", "n": 2}},
+	}))
+	require.NoError(t, leaderStore.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "events",
+		Columns: map[string]any{"kind": "click", "n": 3, "extra": true},
+	}))
+	assert.Eventually(t, func() bool {
+		return len(query("SELECT * FROM events")) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []map[string]any{
+		{"kind": "click", "n": int32(1), "extra": nil},
+		{"kind": "view", "n": int32(2), "extra": nil},
+		{"kind": "click", "n": int32(3), "extra": true},
+	}, query("SELECT kind, n, extra FROM events ORDER BY n"))
+
+	res, err := http.Get(server.URL + "/admin/replication")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var status internal.ReplicationStatus
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.EqualValues(t, 5, status.Position)
+	assert.Empty(t, status.LastError)
+
+	insert, err := http.Post(server.URL+"/data?Table=events", "application/json", strings.NewReader(`{"kind": "x"}`))
+	require.NoError(t, err)
+	require.NoError(t, insert.Body.Close())
+	assert.Equal(t, http.StatusForbidden, insert.StatusCode)
+	read, err := http.Post(server.URL+"/query", "application/json",
+		strings.NewReader(`{"sql": "SELECT count(*) AS n FROM events"}`))
+	require.NoError(t, err)
+	require.NoError(t, read.Body.Close())
+	assert.Equal(t, http.StatusOK, read.StatusCode)
+
+	// A second follower resumes from the position recorded in its store.
+	resumed, err := internal.NewFollower(context.Background(), followerStore, leader.URL, "", time.Second)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, resumed.Status().Position)
+}
+
+// testClusterNode is a node of a cluster started by startClusterNode.
+type testClusterNode struct {
+	store   *internal.Store
+	cluster *internal.Cluster
+	server  *httptest.Server
+	stop    func()
+}
+
+// testClusterNodes returns n nodes on free local ports and the unstarted servers of their APIs.
+func testClusterNodes(t *testing.T, n int) ([]internal.ClusterNode, []*httptest.Server) {
+	nodes := make([]internal.ClusterNode, n)
+	servers := make([]*httptest.Server, n)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, ln.Close())
+		servers[i] = httptest.NewUnstartedServer(nil)
+		nodes[i] = internal.ClusterNode{
+			ID:   fmt.Sprintf("node%d", i+1),
+			Raft: ln.Addr().String(),
+			API:  "http://" + servers[i].Listener.Addr().String(),
+		}
+	}
+	return nodes, servers
+}
+
+// startClusterNode starts the node of the configuration on the store, a new one if nil, and serves its API.
+func startClusterNode(
+	t *testing.T, store *internal.Store, cfg internal.ClusterConfig, server *httptest.Server,
+) *testClusterNode {
+	if store == nil {
+		var err error
+		store, err = internal.NewDuckDBStore()
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, store.Close())
+		})
+	}
+	cluster, err := internal.NewCluster(store, cfg)
+	require.NoError(t, err)
+	server.Config.Handler = internal.NewServer(store, internal.WithCluster(cluster)).Handler()
+	server.Start()
+	node := &testClusterNode{store: store, cluster: cluster, server: server}
+	var once sync.Once
+	node.stop = func() {
+		once.Do(func() {
+			server.Close()
+			assert.NoError(t, cluster.Close())
+		})
+	}
+	t.Cleanup(node.stop)
+	return node
+}
+
+// clusterLeader waits for one of the nodes to lead and returns its index.
+func clusterLeader(t *testing.T, nodes ...*testClusterNode) int {
+	leader := -1
+	require.Eventually(t, func() bool {
+		for i, n := range nodes {
+			if n != nil && n.cluster.Status().State == "Leader" {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 20*time.Millisecond)
+	return leader
+}
+
+// clusterCount returns the rows of the table on the node, -1 if it doesn't exist.
+func clusterCount(node *testClusterNode, table string) int {
+	rows, err := node.store.Query(context.Background(), &internal.QueryStatement{
+		Query: "SELECT count(*) AS n FROM " + table,
+	})
+	if err != nil {
+		return -1
+	}
+	return int(rows[0]["n"].(int64))
+}
+
+func TestServerCluster(t *testing.T) {
+	configs, servers := testClusterNodes(t, 3)
+	nodes := make([]*testClusterNode, len(configs))
+	for i, c := range configs {
+		nodes[i] = startClusterNode(t, nil, internal.ClusterConfig{NodeID: c.ID, Dir: t.TempDir(), Nodes: configs},
+			servers[i])
+	}
+	leader := clusterLeader(t, nodes...)
+	follower := nodes[(leader+1)%len(nodes)]
+	post := func(node *testClusterNode, path, body string) int {
+		res, err := http.Post(node.server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	// The insert is forwarded to the leader, which answers once it applied it, and replicated to every node.
+	assert.Equal(t, http.StatusOK, post(follower, "/data?Table=events", `{"n": 1, "big": 9007199254740993}`))
+	assert.Equal(t, 1, clusterCount(nodes[leader], "events"))
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			return clusterCount(n, "events") == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	rows, err := follower.store.Query(context.Background(), &internal.QueryStatement{Query: "SELECT big FROM events"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"big": int64(9007199254740993)}}, rows)
+	// The errors of the leader are answered as they would be without a cluster.
+	assert.Equal(t, http.StatusConflict, post(follower, "/data?Table=events", `{"n": "one"}`))
+
+	assert.Equal(t, http.StatusOK, post(follower, "/admin/query", `{"sql": "CREATE TABLE totals AS SELECT 42 AS n"}`))
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			return clusterCount(n, "totals") == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	// Reads are served by the node itself.
+	assert.Equal(t, http.StatusOK, post(follower, "/admin/query", `{"sql": "SELECT * FROM totals"}`))
+
+	res, err := http.Get(follower.server.URL + "/admin/cluster")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var status internal.ClusterStatus
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.Equal(t, "Follower", status.State)
+	assert.Equal(t, configs[leader].ID, status.Leader)
+	assert.Len(t, status.Nodes, 3)
+
+	// Another node takes over once the leader is gone.
+	nodes[leader].stop()
+	remaining := slices.Delete(slices.Clone(nodes), leader, leader+1)
+	next := remaining[clusterLeader(t, remaining...)]
+	for _, n := range remaining {
+		assert.Equal(t, http.StatusOK, post(n, "/data?Table=events", `{"n": 2}`))
+	}
+	for _, n := range remaining {
+		assert.Eventually(t, func() bool {
+			return clusterCount(n, "events") == 3
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	assert.Equal(t, "Leader", next.cluster.Status().State)
+}
+
+func TestServerClusterSnapshot(t *testing.T) {
+	configs, servers := testClusterNodes(t, 3)
+	dir := t.TempDir()
+	cfg := func(i int) internal.ClusterConfig {
+		return internal.ClusterConfig{
+			NodeID:            configs[i].ID,
+			Dir:               filepath.Join(dir, configs[i].ID),
+			Nodes:             configs,
+			SnapshotThreshold: 4,
+			SnapshotInterval:  50 * time.Millisecond,
+		}
+	}
+	nodes := []*testClusterNode{startClusterNode(t, nil, cfg(0), servers[0]), startClusterNode(t, nil, cfg(1), servers[1])}
+	leader := nodes[clusterLeader(t, nodes...)]
+	_, err := leader.store.Fetch(context.Background(), &internal.QueryStatement{
+		Query:       "CREATE TYPE mood AS ENUM ('sad', 'happy'); CREATE TABLE moods (m mood)",
+		AllowWrites: true,
+	})
+	require.NoError(t, err)
+	for i := range 10 {
+		require.NoError(t, leader.store.Insert(context.Background(), &internal.InsertStatement{
+			Table: "events", Columns: map[string]any{"n": i},
+		}))
+	}
+	// The log up to the snapshot is compacted but for as many trailing entries as the threshold, so the start of the log
+	// is gone once the snapshot is past them.
+	require.Eventually(t, func() bool {
+		return leader.cluster.Status().LastSnapshot > cfg(0).SnapshotThreshold
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// The third node starts after the log was compacted, it is sent the snapshot, which replaces its tables.
+	late, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, late.Close())
+	})
+	_, err = late.Fetch(context.Background(), &internal.QueryStatement{
+		Query:       "CREATE TABLE stale (n INT)",
+		AllowWrites: true,
+	})
+	require.NoError(t, err)
+	third := startClusterNode(t, late, cfg(2), servers[2])
+	assert.Eventually(t, func() bool {
+		return clusterCount(third, "events") == 10
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.Equal(t, -1, clusterCount(third, "stale"))
+	rows, err := late.Query(context.Background(), &internal.QueryStatement{
+		Query: "SELECT enum_range(NULL::mood) AS moods",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"moods": []any{"sad", "happy"}}}, rows)
+
+	// A restarted node skips the entries of its log its store applied.
+	insert := func(n int) {
+		require.NoError(t, leader.store.Insert(context.Background(), &internal.InsertStatement{
+			Table: "events", Columns: map[string]any{"n": n},
+		}))
+		applied := leader.cluster.Status().Applied
+		assert.Eventually(t, func() bool {
+			return third.cluster.Status().Applied >= applied
+		}, 10*time.Second, 20*time.Millisecond)
+	}
+	insert(10)
+	third.stop()
+	server := httptest.NewUnstartedServer(nil)
+	require.NoError(t, server.Listener.Close())
+	server.Listener, err = net.Listen("tcp", strings.TrimPrefix(configs[2].API, "http://"))
+	require.NoError(t, err)
+	third = startClusterNode(t, late, cfg(2), server)
+	insert(11)
+	assert.Equal(t, 12, clusterCount(third, "events"))
+}
+
+func TestServerAccessLog(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key"},
+	})
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys),
+		internal.WithAccessLog(slog.New(slog.NewJSONHandler(&logs, nil)))).Handler()
+	serve := func(req *http.Request) (*httptest.ResponseRecorder, map[string]any) {
+		logs.Reset()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+		return rec, entry
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/data?Table=events", strings.NewReader(`{"n": 1}`))
+	req.Header.Set("Authorization", "Bearer etl-key")
+	req.Header.Set(internal.RequestIDHeader, "req-1")
+	rec, entry := serve(req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "req-1", rec.Header().Get(internal.RequestIDHeader))
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, "/data", entry["path"])
+	assert.Equal(t, 200.0, entry["status"])
+	assert.Equal(t, "key:etl", entry["caller"])
+	assert.Equal(t, "req-1", entry["request_id"])
+	assert.Contains(t, entry, "duration")
+
+	req = httptest.NewRequest(http.MethodGet, "/query?q=select+1", nil)
+	rec, entry = serve(req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, 401.0, entry["status"])
+	assert.Equal(t, float64(rec.Body.Len()), entry["bytes"])
+	assert.Equal(t, req.RemoteAddr, entry["caller"])
+	assert.NotEmpty(t, rec.Header().Get(internal.RequestIDHeader))
+	assert.Equal(t, rec.Header().Get(internal.RequestIDHeader), entry["request_id"])
+}
+
+func TestServerLogLevel(t *testing.T) {
+	_, _, err := internal.NewLogger(internal.LogConfig{Format: "xml"}, io.Discard)
+	assert.ErrorIs(t, err, internal.ErrInvalidLogConfig)
+	_, _, err = internal.NewLogger(internal.LogConfig{Level: "loud"}, io.Discard)
+	assert.ErrorIs(t, err, internal.ErrInvalidLogConfig)
+
+	var logs bytes.Buffer
+	logger, level, err := internal.NewLogger(internal.LogConfig{Level: "WARN", Format: "json"}, &logs)
+	require.NoError(t, err)
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithLogLevel(level)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	logger.Info("hidden")
+	assert.Empty(t, logs.String())
+
+	do := func(method, body string) (int, internal.LogLevel) {
+		req, reqErr := http.NewRequest(method, server.URL+"/admin/log-level", strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var out internal.LogLevel
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		}
+		return res.StatusCode, out
+	}
+	status, got := do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "warn", got.Level)
+
+	status, got = do(http.MethodPut, `{"level": "debug"}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "debug", got.Level)
+	logger.Debug("shown")
+	assert.Contains(t, logs.String(), `"msg":"shown"`)
+
+	status, _ = do(http.MethodPut, `{"level": "loud"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = do(http.MethodPut, `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, got = do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "debug", got.Level)
+}
+
+func TestServerAuditLog(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithAuditLog(time.Hour))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key"},
+	})
+	require.NoError(t, err)
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys)).Handler()
+	do := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	query := func(key, sql string) *httptest.ResponseRecorder {
+		return do(http.MethodGet, "/query?q="+url.QueryEscape(sql), key, "")
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/data?Table=events", "etl-key", `[{"n": 1}, {"n": 2}]`).Code)
+	require.Equal(t, http.StatusOK,
+		do(http.MethodGet, "/query?tag=etl-report&q="+url.QueryEscape("select n from events"), "etl-key", "").Code)
+	require.Equal(t, http.StatusBadRequest, query("etl-key", "select nope from events").Code)
+	assert.Equal(t, http.StatusForbidden, query("etl-key", "select * from _audit").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/data?Table=_audit", "etl-key", `{"n": 1}`).Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/tables/_audit/rows", "etl-key", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/data?Table=_audit", "root-key", `{"n": 1}`).Code)
+
+	rec := query("root-key", `select caller, kind, target, row_count, status, request_id is not null as has_id, tag
+		from _audit where caller = 'key:etl' order by created_at`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `[
+		{"caller": "key:etl", "kind": "ingest", "target": "events", "row_count": 2, "status": 200, "has_id": true,
+			"tag": null},
+		{"caller": "key:etl", "kind": "query", "target": "select n from events", "row_count": 2, "status": 200,
+			"has_id": false, "tag": "etl-report"},
+		{"caller": "key:etl", "kind": "query", "target": "select nope from events", "row_count": null, "status": 400,
+			"has_id": false, "tag": null},
+		{"caller": "key:etl", "kind": "query", "target": "select * from _audit", "row_count": null, "status": 403,
+			"has_id": false, "tag": null}
+	]`, rec.Body.String())
+}
+
+func TestServerDebugEndpoints(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key"},
+	})
+	require.NoError(t, err)
+	get := func(handler http.Handler, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound,
+		get(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler(), "/admin/debug/runtime", "root-key").Code)
+
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys), internal.WithDebugEndpoints()).Handler()
+	assert.Equal(t, http.StatusForbidden, get(handler, "/admin/debug/runtime", "etl-key").Code)
+
+	rec := get(handler, "/admin/debug/runtime", "root-key")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats internal.RuntimeStats
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Positive(t, stats.Goroutines)
+	assert.Positive(t, stats.HeapAlloc)
+	assert.NotEmpty(t, stats.GoVersion)
+
+	rec = get(handler, "/admin/debug/pprof/", "root-key")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine")
+	rec = get(handler, "/admin/debug/pprof/goroutine?debug=1", "root-key")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine profile:")
+
+	rec = get(handler, "/admin/debug/vars", "root-key")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var vars map[string]any
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&vars))
+	assert.Contains(t, vars, "memstats")
+}
+
+func TestServerAPIKeys(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	configured := []internal.APIKey{{Name: "root", Key: "root-key", Admin: true}}
+	keys, err := internal.NewAPIKeys(path, configured)
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, key, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	res := do(http.MethodGet, "/tables", "", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/tables", "wrong", "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/tables", "root-key", "").StatusCode)
+
+	res = do(http.MethodPost, "/admin/keys", "root-key", `{"name": "app"}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var app internal.APIKey
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&app))
+	assert.True(t, strings.HasPrefix(app.Key, "scratch_"))
+	assert.False(t, app.Admin)
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/keys", app.Key, "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/data?Table=events", app.Key, `{"n": 1}`).StatusCode)
+
+	res = do(http.MethodGet, "/admin/keys", "root-key", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var listed []internal.APIKey
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&listed))
+	require.Len(t, listed, 2)
+	for _, k := range listed {
+		assert.Empty(t, k.Key)
+	}
+	var root internal.APIKey
+	for _, k := range listed {
+		if k.Configured {
+			root = k
+		}
+	}
+	assert.Equal(t, "root", root.Name)
+	assert.NotNil(t, root.LastUsed)
+
+	assert.Equal(t, http.StatusConflict, do(http.MethodDelete, "/admin/keys/"+root.ID, "root-key", "").StatusCode)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/keys/"+app.ID, "root-key", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/tables", app.Key, "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/keys/"+app.ID, "root-key", "").StatusCode)
+
+	// Created keys are kept in the file, revoked ones are not.
+	res = do(http.MethodPost, "/admin/keys", "root-key", `{"name": "ops", "admin": true}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	reloaded, err := internal.NewAPIKeys(path, configured)
+	require.NoError(t, err)
+	names := []string{}
+	for _, k := range reloaded.List() {
+		names = append(names, k.Name)
+	}
+	assert.ElementsMatch(t, []string{"root", "ops"}, names)
+
+	_, err = internal.NewAPIKeys("", nil)
+	assert.Error(t, err)
+}
+
+func TestServerJWT(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": base64.RawURLEncoding.EncodeToString(pub),
+		}}})
+	}))
+	verifier, err := internal.NewJWTVerifier(internal.JWTConfig{
+		Issuer:   "https://issuer.example",
+		JWKSURL:  jwks.URL,
+		Audience: "scratch",
+		Scopes:   map[string]internal.Scope{"dashboards": internal.ScopeQuery},
+	})
+	require.NoError(t, err)
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithJWT(verifier)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		jwks.Close()
+		assert.NoError(t, store.Close())
+	})
+	sign := func(claims map[string]any) string {
+		encode := func(v any) string {
+			data, encodeErr := json.Marshal(v)
+			require.NoError(t, encodeErr)
+			return base64.RawURLEncoding.EncodeToString(data)
+		}
+		input := encode(map[string]string{"alg": "EdDSA", "kid": "k1"}) + "." + encode(claims)
+		return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, []byte(input)))
+	}
+	token := func(scope any) string {
+		return sign(map[string]any{
+			"iss": "https://issuer.example", "aud": []string{"scratch"}, "sub": "agent",
+			"exp": time.Now().Add(time.Hour).Unix(), "scope": scope,
+		})
+	}
+	status := func(method, path, token, body string) int {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	ingest, dashboard, admin := token("ingest"), token([]string{"dashboards"}), token("query admin")
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/data?Table=events", ingest, `{"n": 1}`))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/tables", ingest, ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/tables", dashboard, ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/query", dashboard, `{"sql": "SELECT 1"}`))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/data?Table=events", dashboard, `{"n": 2}`))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/admin/settings", dashboard, ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/admin/settings", admin, ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/data?Table=events", admin, `{"n": 3}`))
+
+	expired := sign(map[string]any{
+		"iss": "https://issuer.example", "aud": "scratch", "exp": time.Now().Add(-time.Hour).Unix(), "scope": "query",
+	})
+	otherIssuer := sign(map[string]any{
+		"iss": "https://other.example", "aud": "scratch", "exp": time.Now().Add(time.Hour).Unix(), "scope": "query",
+	})
+	tampered := dashboard[:strings.LastIndex(dashboard, ".")] + "." + strings.Repeat("A", 86)
+	for _, token := range []string{expired, otherIssuer, tampered, "not-a-token"} {
+		assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/tables", token, ""), token)
+	}
+}
+
+func TestServerQuotas(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithQuotas(internal.Quotas{
+		Default: internal.Quota{MaxBytes: 20},
+		Tenants: map[string]internal.Quota{"acme": {MaxTables: 1, MaxDailyRows: 3}},
+	}))
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "acme", Key: "acme-key", Tenant: "acme"},
+		{Name: "beta", Key: "beta-key", Tenant: "beta"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, key, body string) (int, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer res.Body.Close()
+		data, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, data
+	}
+
+	status, _ := do(http.MethodPost, "/data?Table=events", "acme-key", `[{"n": 1}, {"n": 2}]`)
+	require.Equal(t, http.StatusOK, status)
+	status, body := do(http.MethodPost, "/data?Table=other", "acme-key", `{"n": 1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, string(body), "tenant_tables_exceeded")
+	status, body = do(http.MethodPost, "/data?Table=events", "acme-key", `[{"n": 3}, {"n": 4}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, string(body), "tenant_daily_rows_exceeded")
+	status, _ = do(http.MethodPost, "/data?Table=events", "acme-key", `{"n": 3}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body = do(http.MethodPost, "/data?Table=notes", "beta-key", `{"text": "longer than twenty bytes"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, string(body), "tenant_bytes_exceeded")
+	// Requests without a tenant have no quota.
+	status, _ = do(http.MethodPost, "/data?Table=notes", "root-key", `{"text": "longer than twenty bytes"}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body = do(http.MethodGet, "/usage", "acme-key", "")
+	require.Equal(t, http.StatusOK, status)
+	var usage internal.TenantUsage
+	require.NoError(t, json.Unmarshal(body, &usage))
+	assert.Equal(t, "acme", usage.Tenant)
+	assert.Equal(t, 1, usage.Tables)
+	assert.Equal(t, 3, usage.RowsToday)
+	assert.Equal(t, len(`{"n":1}{"n":2}{"n":3}`), usage.Bytes)
+	assert.Equal(t, 3, usage.Quota.MaxDailyRows)
+	status, _ = do(http.MethodGet, "/usage", "root-key", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = do(http.MethodGet, "/admin/tenants", "root-key", "")
+	require.Equal(t, http.StatusOK, status)
+	var usages []internal.TenantUsage
+	require.NoError(t, json.Unmarshal(body, &usages))
+	require.Len(t, usages, 1)
+	assert.Equal(t, usage, usages[0])
+}
+
+func TestServerTableACLs(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithTableACLs([]internal.TableACL{
+		{Table: "finance_*", Read: []string{"finance"}, Write: []string{"key:agent"}},
+	}))
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "analyst", Key: "analyst-key", Roles: []string{"finance"}},
+		{Name: "agent", Key: "agent-key"},
+		{Name: "dashboard", Key: "dashboard-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	status := func(method, path, key, body string) int {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	query := func(key, sql string) int {
+		body, marshalErr := json.Marshal(map[string]string{"sql": sql})
+		require.NoError(t, marshalErr)
+		return status(http.MethodPost, "/query", key, string(body))
+	}
+
+	require.Equal(t, http.StatusOK, status(http.MethodPost, "/data?Table=finance_ledger", "agent-key", `{"amount": 1}`))
+	assert.Equal(t, http.StatusForbidden,
+		status(http.MethodPost, "/data?Table=finance_ledger", "dashboard-key", `{"amount": 2}`))
+	require.Equal(t, http.StatusOK, status(http.MethodPost, "/data?Table=events", "dashboard-key", `{"n": 1}`))
+
+	assert.Equal(t, http.StatusOK, query("analyst-key", "SELECT sum(amount) FROM finance_ledger"))
+	assert.Equal(t, http.StatusOK, query("root-key", "SELECT sum(amount) FROM finance_ledger"))
+	assert.Equal(t, http.StatusOK, query("dashboard-key", "SELECT count(*) FROM events"))
+	for _, sql := range []string{
+		"SELECT sum(amount) FROM finance_ledger",
+		`SELECT * FROM events, main."FINANCE_LEDGER"`,
+		"WITH t AS (SELECT * FROM Finance_Ledger) SELECT * FROM t",
+	} {
+		assert.Equal(t, http.StatusForbidden, query("dashboard-key", sql), sql)
+	}
+	// Writing doesn't imply reading.
+	assert.Equal(t, http.StatusForbidden, query("agent-key", "SELECT * FROM finance_ledger"))
+
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/tables/finance_ledger/schema", "dashboard-key", ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/tables/finance_ledger/schema", "analyst-key", ""))
+
+	// Copies read their source like queries.
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/tables/events/copy", "dashboard-key",
+		`{"name": "leak", "query": "SELECT * FROM finance_ledger"}`))
+	assert.Equal(t, http.StatusNotFound, status(http.MethodGet, "/tables/leak/schema", "root-key", ""))
+	assert.Equal(t, http.StatusCreated, status(http.MethodPost, "/tables/events/copy", "analyst-key",
+		`{"name": "ledger_copy", "query": "SELECT * FROM finance_ledger"}`))
+}
+
+func TestServerRowLevelSecurity(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithRowLevelSecurity("tenant_id"))
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "acme", Key: "acme-key", Tenant: "acme"},
+		{Name: "globex", Key: "globex-key", Tenant: "globex"},
+		{Name: "dashboard", Key: "dashboard-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, key, body string) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res
+	}
+	query := func(key, sql string) (int, []map[string]any) {
+		body, marshalErr := json.Marshal(map[string]string{"sql": sql})
+		require.NoError(t, marshalErr)
+		res := do(http.MethodPost, "/query", key, string(body))
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+		var rows []map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&rows))
+		return res.StatusCode, rows
+	}
+
+	// The tenant sent is overwritten.
+	require.Equal(t, http.StatusOK,
+		do(http.MethodPost, "/data?Table=events", "acme-key", `[{"n": 1}, {"n": 2, "tenant_id": "globex"}]`).StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/data?Table=events", "globex-key", `{"n": 3}`).StatusCode)
+
+	status, rows := query("acme-key", "SELECT n, tenant_id FROM events ORDER BY n")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{{"n": 1.0, "tenant_id": "acme"}, {"n": 2.0, "tenant_id": "acme"}}, rows)
+	status, rows = query("globex-key", "WITH e AS (SELECT * FROM events) SELECT sum(n) AS total FROM e")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{{"total": 3.0}}, rows)
+	status, rows = query("root-key", "SELECT count(*) AS count FROM events")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{{"count": 3.0}}, rows)
+
+	for _, sql := range []string{"SELECT * FROM main.events", "DESCRIBE events"} {
+		status, _ = query("acme-key", sql)
+		assert.Equal(t, http.StatusForbidden, status, sql)
+	}
+	status, _ = query("dashboard-key", "SELECT count(*) FROM events")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/tables/events/rows", "acme-key", "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/tables/events/schema", "acme-key", "").StatusCode)
+}
+
+func TestServerColumnMasks(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithColumnMasks([]internal.ColumnMask{
+		{Table: "users", Column: "*email*", Mode: internal.MaskPartial, Unmasked: []string{"support"}},
+		{Table: "users", Column: "phone", Mode: internal.MaskHash},
+		{Table: "users", Column: "age", Mode: internal.MaskNull},
+	}))
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "support", Key: "support-key", Roles: []string{"support"}},
+		{Name: "dashboard", Key: "dashboard-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "users",
+		Columns: map[string]any{"name": "Jane", "email": "jane@example.com", "phone": "5550100", "age": 41},
+	}))
+	query := func(key, sql string) (int, []map[string]any) {
+		body, marshalErr := json.Marshal(map[string]string{"sql": sql})
+		require.NoError(t, marshalErr)
+		req, reqErr := http.NewRequest(http.MethodPost, server.URL+"/query", bytes.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() { _ = res.Body.Close() }()
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+		var rows []map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&rows))
+		return res.StatusCode, rows
+	}
+	sum := md5.Sum([]byte("5550100"))
+
+	status, rows := query("dashboard-key", "SELECT name, email, phone, age FROM users")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{
+		{"name": "Jane", "email": "j***@example.com", "phone": hex.EncodeToString(sum[:]), "age": nil},
+	}, rows)
+	status, rows = query("support-key", "SELECT email, age FROM users")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{{"email": "jane@example.com", "age": nil}}, rows)
+	status, rows = query("root-key", "SELECT email, age FROM users")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []map[string]any{{"email": "jane@example.com", "age": 41.0}}, rows)
+
+	status, _ = query("dashboard-key", `SELECT email FROM main."users"`)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestServerSQLPolicy(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithSQLPolicy(internal.SQLPolicy{
+		DenyStatements:  []string{"ATTACH", "copy to"},
+		DenyFunctions:   []string{"read_*", "duckdb_*"},
+		DenyCrossSchema: true,
+	}))
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	post := func(path, sql string) (int, string) {
+		body, marshalErr := json.Marshal(map[string]string{"sql": sql})
+		require.NoError(t, marshalErr)
+		res, postErr := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, postErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(out)
+	}
+
+	status, _ := post("/admin/query", "CREATE TABLE events AS SELECT 1 AS n")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = post("/query", `SELECT * FROM "main".events`)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = post("/admin/query", "COPY events FROM 'missing.csv'")
+	assert.NotEqual(t, http.StatusForbidden, status)
+
+	for _, sql := range []string{
+		"ATTACH ':memory:' AS other",
+		"COPY (SELECT 1) TO 'out.csv'",
+		"SELECT * FROM read_csv_auto('data.csv')",
+		"SELECT * FROM DuckDB_Settings()",
+		"SELECT * FROM information_schema.tables",
+		"SELECT * FROM system.main.duckdb_tables",
+	} {
+		status, body := post("/admin/query", sql)
+		assert.Equal(t, http.StatusForbidden, status, sql)
+		assert.Contains(t, body, "sql policy", sql)
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "dashboard", Key: "dashboard-key"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store,
+		internal.WithAPIKeys(keys),
+		internal.WithCORS(internal.CORS{AllowedOrigins: []string{"https://dash.example.com"}, MaxAge: time.Hour}),
+	).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, origin string, header http.Header) *http.Response {
+		req, reqErr := http.NewRequest(method, server.URL+"/query", strings.NewReader(`{"sql": "SELECT 1"}`))
+		require.NoError(t, reqErr)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Origin", origin)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+	preflight := http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"authorization,content-type"},
+	}
+
+	// Preflight requests carry no credentials.
+	res := do(http.MethodOptions, "https://dash.example.com", preflight)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "https://dash.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, res.Header.Get("Access-Control-Allow-Methods"), "POST")
+	assert.Contains(t, res.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+	assert.Equal(t, "3600", res.Header.Get("Access-Control-Max-Age"))
+
+	res = do(http.MethodPost, "https://dash.example.com", http.Header{"Authorization": {"Bearer dashboard-key"}})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "https://dash.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, res.Header.Get("Access-Control-Expose-Headers"), internal.RequestIDHeader)
+
+	res = do(http.MethodOptions, "https://evil.example.com", preflight)
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Methods"))
+	res = do(http.MethodPost, "https://evil.example.com", http.Header{"Authorization": {"Bearer dashboard-key"}})
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestServerTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "scratch"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	_, err = internal.NewTLSConfig(internal.TLSConfig{CertFile: certFile})
+	assert.Error(t, err)
+	_, err = internal.NewTLSConfig(internal.TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.0"})
+	assert.Error(t, err)
+	tlsConfig, err := internal.NewTLSConfig(internal.TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	require.NoError(t, err)
+
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	server := &http.Server{Handler: internal.NewServer(store).Handler(), ReadHeaderTimeout: time.Second}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		assert.NoError(t, server.Close())
+		assert.NoError(t, store.Close())
+	})
+	roots := x509.NewCertPool()
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res, err := client.Get("https://" + ln.Addr().String() + "/query?q=" + url.QueryEscape("select 1"))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	redirect := httptest.NewServer(internal.RedirectHTTPS(":8443"))
+	t.Cleanup(redirect.Close)
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err = noFollow.Get(redirect.URL + "/query?q=1")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusPermanentRedirect, res.StatusCode)
+	assert.Equal(t, "https://127.0.0.1:8443/query?q=1", res.Header.Get("Location"))
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scratch ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	issue := func(serial int64, template *x509.Certificate) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		require.NoError(t, err)
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(crand.Reader, template, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	serverCert := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "scratch"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	etlCert := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "etl-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	otherCert := issue(4, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "other"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600))
+	keyDER, err := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	_, err = internal.NewTLSConfig(internal.TLSConfig{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true})
+	assert.Error(t, err)
+	assert.Error(t, internal.ValidateClientCerts([]internal.ClientCert{{Identity: "etl-["}}))
+	tlsConfig, err := internal.NewTLSConfig(internal.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	require.NoError(t, err)
+
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	certs := []internal.ClientCert{{Identity: "etl-*"}}
+	require.NoError(t, internal.ValidateClientCerts(certs))
+	handler := internal.NewServer(store, internal.WithClientCerts(certs)).Handler()
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: time.Second}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		assert.NoError(t, server.Close())
+		assert.NoError(t, store.Close())
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certs ...tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		res, err := client.Get("https://" + ln.Addr().String() + "/query?q=" + url.QueryEscape("select 1"))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get(etlCert))
+	assert.Equal(t, http.StatusUnauthorized, get(otherCert))
+	assert.Equal(t, http.StatusUnauthorized, get())
+}
+
+func TestServerListeners(t *testing.T) {
+	l, err := internal.ParseListener("127.0.0.1:9000=admin")
+	require.NoError(t, err)
+	assert.Equal(t, internal.Listener{Addr: "127.0.0.1:9000", Surface: internal.SurfaceAdmin}, l)
+	l, err = internal.ParseListener("unix:/run/scratch.sock")
+	require.NoError(t, err)
+	assert.True(t, l.Unix())
+	_, err = internal.ParseListener(":8000=ingest")
+	require.Error(t, err)
+	_, err = internal.ParseListener("=admin")
+	require.Error(t, err)
+
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	srv := internal.NewServer(store)
+	get := func(handler http.Handler, target string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+	admin := srv.SurfaceHandler(internal.SurfaceAdmin)
+	assert.Equal(t, http.StatusNotFound, get(admin, "/tables"))
+	assert.Equal(t, http.StatusOK, get(admin, "/admin/queries"))
+	public := srv.SurfaceHandler(internal.SurfacePublic)
+	assert.Equal(t, http.StatusOK, get(public, "/tables"))
+	assert.Equal(t, http.StatusNotFound, get(public, "/admin/queries"))
+	assert.Equal(t, http.StatusOK, get(srv.Handler(), "/admin/queries"))
+
+	path := filepath.Join(t.TempDir(), "scratch.sock")
+	socket := internal.Listener{Addr: internal.UnixPrefix + path, Surface: internal.SurfaceAdmin}
+	ln, err := socket.Listen()
+	require.NoError(t, err)
+	server := &http.Server{Handler: srv.SurfaceHandler(socket.Surface), ReadHeaderTimeout: time.Second}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		assert.NoError(t, server.Close())
+	})
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://scratch/admin/queries")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = client.Get("http://scratch/tables")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Files other than sockets are never replaced.
+	file := filepath.Join(t.TempDir(), "data.csv")
+	require.NoError(t, os.WriteFile(file, []byte("id\n1\n"), 0o600))
+	_, err = internal.Listener{Addr: internal.UnixPrefix + file}.Listen()
+	require.Error(t, err)
+}
+
+func TestServerStreamWriteTimeout(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(internal.NewServer(store).Handler())
+	server.Config.WriteTimeout = 300 * time.Millisecond
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	// The progress event after a second is written long past the write timeout.
+	slow := url.QueryEscape("select sum(a.range * b.range) from range(100000000) a, range(1000) b")
+	res, err := http.Get(fmt.Sprintf("%s/query/stream?timeout=1500ms&q=%s", server.URL, slow))
+	require.NoError(t, err)
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "event: "+internal.EventProgress)
+}
+
+func TestServerReload(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithQuotas(internal.Quotas{
+		Tenants: map[string]internal.Quota{"acme": {MaxDailyRows: 1}},
+	}))
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "acme", Key: "acme-key", Tenant: "acme"},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAPIKeys(keys)).Handler())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	post := func(key, body string) int {
+		req, reqErr := http.NewRequest(http.MethodPost, server.URL+"/data?Table=events", strings.NewReader(body))
+		require.NoError(t, reqErr)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, post("acme-key", `{"n": 1}`))
+	require.Equal(t, http.StatusUnprocessableEntity, post("acme-key", `{"n": 2}`))
+	require.Equal(t, http.StatusUnauthorized, post("beta-key", `{"n": 1}`))
+
+	limits := internal.DefaultLimits()
+	limits.MaxCellBytes = 4
+	require.NoError(t, store.Reload(internal.Settings{
+		Limits: limits,
+		Quotas: internal.Quotas{Tenants: map[string]internal.Quota{"acme": {MaxDailyRows: 10}}},
+	}))
+	require.NoError(t, keys.Reload([]internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "beta", Key: "beta-key"},
+	}))
+	assert.Equal(t, http.StatusUnauthorized, post("acme-key", `{"n": 2}`))
+	assert.Equal(t, http.StatusOK, post("beta-key", `{"n": 2}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, post("beta-key", `{"text": "too long"}`))
+	assert.Equal(t, 4, store.Limits().MaxCellBytes)
+
+	// Refused settings leave the previous ones in place.
+	require.ErrorIs(t, keys.Reload([]internal.APIKey{{Name: "beta", Key: "beta-key"}}), internal.ErrInvalidAPIKey)
+	assert.Equal(t, http.StatusOK, post("beta-key", `{"n": 3}`))
+	require.ErrorIs(t, store.Reload(internal.Settings{Limits: limits, AuditRetention: time.Hour}),
+		internal.ErrRestartRequired)
+}
+
+func TestServerUI(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{{Name: "root", Key: "root-key", Admin: true}})
+	require.NoError(t, err)
+	get := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, get(internal.NewServer(store).Handler(), "/admin/ui/").Code)
+
+	srv := internal.NewServer(store, internal.WithAPIKeys(keys), internal.WithUI())
+	// The files are served without the key, the API still requires it.
+	rec := get(srv.Handler(), "/admin/ui/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Header().Get("Content-Security-Policy"), "default-src 'self'")
+	assert.Contains(t, rec.Body.String(), `<script src="app.js" defer></script>`)
+	rec = get(srv.Handler(), "/admin/ui/app.js")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "javascript")
+	assert.Equal(t, http.StatusMovedPermanently, get(srv.Handler(), "/admin/ui").Code)
+	assert.Equal(t, http.StatusNotFound, get(srv.Handler(), "/admin/ui/missing.js").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(srv.Handler(), "/tables").Code)
+
+	assert.Equal(t, http.StatusNotFound, get(srv.SurfaceHandler(internal.SurfacePublic), "/admin/ui/").Code)
+}
+
+func TestServerOpenAPI(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	rec := httptest.NewRecorder()
+	internal.NewServer(store, internal.WithDebugEndpoints(), internal.WithUI()).Handler().
+		ServeHTTP(rec, httptest.NewRequest(http.MethodGet, internal.OpenAPIPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var doc internal.OpenAPI
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+
+	// Every registered route is documented.
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			assert.NotEmpty(t, op.Summary, "%s %s", method, path)
+		}
+	}
+	schema := doc.Paths["/tables/{table}/schema"]["get"]
+	require.Len(t, schema.Parameters, 1)
+	assert.Equal(t, internal.Parameter{
+		Name: "table", In: "path", Required: true, Schema: map[string]any{"type": "string"},
+	}, schema.Parameters[0])
+	assert.Equal(t, map[string]any{"$ref": "#/components/schemas/TableSchema"},
+		schema.Responses["200"].Content["application/json"]["schema"])
+	assert.Contains(t, doc.Components.Schemas, "ColumnInfo")
+	assert.Contains(t, doc.Components.Schemas["ColumnInfo"]["properties"], "added_at")
+
+	query := doc.Paths["/query"]["get"]
+	var params []string
+	for _, p := range query.Parameters {
+		params = append(params, p.Name)
+	}
+	assert.Subset(t, params, []string{"q", "limit", internal.FormatParam, internal.EnvelopeParam})
+	assert.Contains(t, query.Responses["200"].Content, "text/csv; charset=utf-8")
+	assert.Contains(t, doc.Paths, "/tables/{table}/indexes/{name}")
+	assert.Contains(t, doc.Paths, "/admin/debug/runtime")
+	assert.Equal(t, "get_admin_debug_runtime", doc.Paths["/admin/debug/runtime"]["get"].OperationID)
+	assert.NotContains(t, doc.Paths, "/admin/keys")
+	assert.Empty(t, doc.Security)
+}
+
+func TestServerFlightSQL(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	client := flightSQLClient(t, internal.NewServer(store, internal.WithAPIKeys(keys)))
+	read := func(ctx context.Context, info *flight.FlightInfo, err error) string {
+		return flightSQLRead(t, client, ctx, info, err)
+	}
+	root, etl := flightSQLAs("root-key"), flightSQLAs("etl-key")
+
+	_, err = client.Execute(context.Background(), "select 1")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ExecuteUpdate(etl, "create table events (id BIGINT, name VARCHAR)")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.ExecuteUpdate(root, "create table events (id BIGINT, name VARCHAR)")
+	require.NoError(t, err)
+	n, err := client.ExecuteUpdate(root, "insert into events values (1, 'a'), (2, 'b')")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+
+	info, err := client.Execute(etl, "select id, name from events order by id")
+	assert.Equal(t, "{\"id\":1,\"name\":\"a\"}\n{\"id\":2,\"name\":\"b\"}\n", read(etl, info, err))
+	_, err = client.Execute(etl, "delete from events")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	info, err = client.Execute(etl, "select nope")
+	require.NoError(t, err)
+	_, err = client.DoGet(etl, info.Endpoint[0].Ticket)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stmt, err := client.Prepare(etl, "select name from events where id = ?")
+	require.NoError(t, err)
+	b := array.NewRecordBuilder(memory.DefaultAllocator,
+		arrow.NewSchema([]arrow.Field{{Name: "id", Type: arrow.PrimitiveTypes.Int64}}, nil))
+	b.Field(0).(*array.Int64Builder).Append(2)
+	params := b.NewRecord()
+	b.Release()
+	stmt.SetParameters(params)
+	params.Release()
+	info, err = stmt.Execute(etl)
+	assert.Equal(t, "{\"name\":\"b\"}\n", read(etl, info, err))
+	require.NoError(t, stmt.Close(etl))
+
+	info, err = client.GetTables(etl, &flightsql.GetTablesOpts{})
+	assert.Contains(t, read(etl, info, err), `"table_name":"events"`)
+}
+
+func TestServerFlightSQLQueries(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithAuditLog(time.Hour))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key", ResultLimits: &internal.ResultLimits{MaxRows: 3}},
+	})
+	require.NoError(t, err)
+	server := internal.NewServer(store, internal.WithAPIKeys(keys), internal.WithQueryHistory(10))
+	client := flightSQLClient(t, server)
+	handler := server.Handler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer root-key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	etl := metadata.AppendToOutgoingContext(flightSQLAs("etl-key"), "x-query-tag", "bi")
+
+	info, err := client.Execute(etl, "select range as n from range(10)")
+	assert.Equal(t, "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n", flightSQLRead(t, client, etl, info, err))
+
+	slow := "select sum(a.range * b.range) from range(2000000) a, range(100) b"
+	info, err = client.Execute(etl, slow)
+	require.NoError(t, err)
+	failed := make(chan error, 1)
+	go func() {
+		reader, getErr := client.DoGet(etl, info.Endpoint[0].Ticket)
+		if getErr == nil {
+			for reader.Next() {
+			}
+			getErr = reader.Err()
+			reader.Release()
+		}
+		failed <- getErr
+	}()
+	var queries []internal.InFlightQuery
+	require.Eventually(t, func() bool {
+		rec := do(http.MethodGet, "/admin/queries")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queries))
+		return len(queries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, slow, queries[0].SQL)
+	assert.Equal(t, "key:etl", queries[0].Caller)
+	assert.Equal(t, "bi", queries[0].Tag)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/queries/"+queries[0].ID).Code)
+	select {
+	case err = <-failed:
+		assert.Equal(t, codes.Canceled, status.Code(err))
+	case <-time.After(10 * time.Second):
+		t.Fatal("query was not interrupted")
+	}
+
+	_, err = client.ExecuteUpdate(flightSQLAs("root-key"), "create table events (id BIGINT)")
+	require.NoError(t, err)
+	rec := do(http.MethodGet, "/query?q="+url.QueryEscape(`select caller, target, row_count, status, tag
+		from _audit where target not like '%_audit%' order by created_at`))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `[
+		{"caller": "key:etl", "target": "select range as n from range(10)", "row_count": 3, "status": 200, "tag": "bi"},
+		{"caller": "key:etl", "target": "`+slow+`", "row_count": null, "status": 400, "tag": "bi"},
+		{"caller": "key:root", "target": "create table events (id BIGINT)", "row_count": 0, "status": 200, "tag": null}
+	]`, rec.Body.String())
+	rec = do(http.MethodGet, "/queries/history")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var history []internal.QueryHistoryEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &history))
+	require.Len(t, history, 4)
+}
+
+func TestServerFlightSQLRowLevelSecurity(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithRowLevelSecurity("tenant_id"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "acme", Key: "acme-key", Tenant: "acme"},
+	})
+	require.NoError(t, err)
+	client := flightSQLClient(t, internal.NewServer(store, internal.WithAPIKeys(keys)))
+	root, acme := flightSQLAs("root-key"), flightSQLAs("acme-key")
+	_, err = client.ExecuteUpdate(root, "create table events (id BIGINT, tenant_id VARCHAR)")
+	require.NoError(t, err)
+	_, err = client.ExecuteUpdate(root, "insert into events values (1, 'acme'), (2, 'globex')")
+	require.NoError(t, err)
+
+	info, err := client.Execute(acme, "select id from events")
+	assert.Equal(t, "{\"id\":1}\n", flightSQLRead(t, client, acme, info, err))
+	info, err = client.GetTables(acme, &flightsql.GetTablesOpts{IncludeSchema: true})
+	require.NoError(t, err)
+	reader, err := client.DoGet(acme, info.Endpoint[0].Ticket)
+	require.NoError(t, err)
+	defer reader.Release()
+	require.True(t, reader.Next(), reader.Err())
+	rec := reader.Record()
+	require.EqualValues(t, 1, rec.NumRows())
+	assert.Equal(t, "events", rec.Column(2).(*array.String).Value(0))
+	schema, err := flight.DeserializeSchema(rec.Column(4).(*array.Binary).Value(0), memory.DefaultAllocator)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id", "tenant_id"}, []string{schema.Field(0).Name, schema.Field(1).Name})
+}
+
+// flightSQLClient serves Flight SQL for the server and returns a client of it.
+func flightSQLClient(t *testing.T, server *internal.Server) *flightsql.Client {
+	grpcServer, err := server.NewFlightSQLServer()
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = grpcServer.Serve(ln) }()
+	client, err := flightsql.NewClient(ln.Addr().String(), nil, nil,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, client.Close())
+		grpcServer.Stop()
+	})
+	return client
+}
+
+// flightSQLAs returns a context authenticating Flight SQL calls with the API key.
+func flightSQLAs(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key)
+}
+
+// flightSQLRead returns the records of the first endpoint of the flight as JSON lines.
+func flightSQLRead(
+	t *testing.T, client *flightsql.Client, ctx context.Context, info *flight.FlightInfo, err error,
+) string {
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Endpoint)
+	reader, err := client.DoGet(ctx, info.Endpoint[0].Ticket)
+	require.NoError(t, err)
+	defer reader.Release()
+	var out bytes.Buffer
+	for reader.Next() {
+		require.NoError(t, array.RecordToJSON(reader.Record(), &out))
+	}
+	require.NoError(t, reader.Err())
+	return out.String()
+}
+
+func TestServerClickHouse(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "etl", Key: "etl-key"},
+	})
+	require.NoError(t, err)
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys), internal.WithClickHouseHTTP()).Handler()
+	do := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-ClickHouse-User", "default")
+			req.Header.Set("X-ClickHouse-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/ping", "etl-key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Ok.\n", rec.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/?query=select+1", "", "").Code)
+
+	insert := "INSERT INTO events FORMAT JSONEachRow\n{\"id\": 1, \"name\": \"a\\tb\"}\n{\"id\": 2, \"name\": null}\n"
+	rec = do(http.MethodPost, "/", "etl-key", insert)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(http.MethodPost, "/?query="+url.QueryEscape("INSERT INTO events FORMAT JSONEachRow"), "etl-key",
+		`{"id": 3, "name": "c"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = do(http.MethodPost, "/", "etl-key", "INSERT INTO events VALUES (4, 'd')")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(http.MethodPost, "/", "etl-key", "SELECT id, name FROM events ORDER BY id")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "TabSeparated", rec.Header().Get("X-ClickHouse-Format"))
+	assert.Equal(t, "1\ta\\tb\n2\t\\N\n3\tc\n", rec.Body.String())
+	rec = do(http.MethodGet, "/?query="+url.QueryEscape("SELECT id FROM events WHERE id = 1 FORMAT TSVWithNames"),
+		"etl-key", "")
+	assert.Equal(t, "id\n1\n", rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodPost, "/?default_format=JSON",
+		strings.NewReader("SELECT count(*)::BIGINT AS n FROM events"))
+	req.SetBasicAuth("default", "etl-key")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var res internal.ClickHouseResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, []internal.ClickHouseColumn{{Name: "n", Type: "Nullable(Int64)"}}, res.Meta)
+	assert.Equal(t, []map[string]any{{"n": float64(3)}}, res.Data)
+	assert.Equal(t, 1, res.Rows)
+
+	rec = do(http.MethodPost, "/", "etl-key", "SELECT id FROM events WHERE id < 3 ORDER BY id FORMAT JSONEachRow")
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n", rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/", "etl-key", "SELECT 1 FORMAT Pretty").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/", "etl-key", "DELETE FROM events").Code)
+}
+
+func TestServerGraphQL(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	handler := internal.NewServer(store).Handler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/data?Table=orders", strings.NewReader(
+		`[{"id": 1, "customer": "a", "amount": 10}, {"id": 2, "customer": "b", "amount": 5},
+		{"id": 3, "customer": "a", "amount": 7}]`)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	graphQL := func(query string, variables map[string]any) *httptest.ResponseRecorder {
+		body, err := json.Marshal(internal.GraphQLRequest{Query: query, Variables: variables})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, internal.GraphQLPath, bytes.NewReader(body)))
+		return rec
+	}
+
+	rec = graphQL(`query Top($min: Float) {
+		orders(where: {amount: {gte: $min}}, order_by: {amount: desc}, limit: 2) { id customer ...Kind }
+	}
+	fragment Kind on orders { __typename }`, map[string]any{"min": 6})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, `{"data":{"orders":[{"id":1,"customer":"a","__typename":"orders"},`+
+		`{"id":3,"customer":"a","__typename":"orders"}]}}`, strings.TrimSpace(rec.Body.String()))
+
+	rec = graphQL(`{
+		some: orders(where: {_or: [{customer: {eq: "b"}}, {id: {in: [1]}}]}, order_by: [{id: asc}]) { id }
+		orders_aggregate(group_by: [customer]) { group { customer } count sum { amount } }
+	}`, nil)
+	assert.Equal(t, `{"data":{"some":[{"id":1},{"id":2}],"orders_aggregate":[`+
+		`{"group":{"customer":"a"},"count":2,"sum":{"amount":17}},`+
+		`{"group":{"customer":"b"},"count":1,"sum":{"amount":5}}]}}`, strings.TrimSpace(rec.Body.String()))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, internal.GraphQLPath+"?query="+url.QueryEscape(
+		`{ __schema { queryType { name } } __type(name: "orders") { fields { name type { name } } } }`), nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, `{"data":{"__schema":{"queryType":{"name":"Query"}},"__type":{"fields":[`+
+		`{"name":"amount","type":{"name":"Float"}},{"name":"customer","type":{"name":"String"}},`+
+		`{"name":"id","type":{"name":"Float"}}]}}}`, strings.TrimSpace(rec.Body.String()))
+
+	rec = graphQL(`{ orders { nope } n: orders_aggregate { count } }`, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res internal.GraphQLResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, map[string]any{"orders": nil, "n": []any{map[string]any{"count": 3.0}}}, res.Data)
+	require.Len(t, res.Errors, 1)
+	assert.Contains(t, res.Errors[0].Message, "no field nope on orders")
+	assert.Equal(t, []any{"orders"}, res.Errors[0].Path)
+
+	assert.Equal(t, http.StatusBadRequest, graphQL(`{ orders { id }`, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, graphQL(`mutation { orders { id } }`, nil).Code)
+}
+
+func TestServerOData(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	handler := internal.NewServer(store).Handler()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/data?Table=orders", strings.NewReader(
+		`[{"id": 1, "customer": "ann", "amount": 10}, {"id": 2, "customer": "bob", "amount": 5},
+		{"id": 3, "customer": "o'neil", "amount": 7}]`)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = get(internal.ODataPath)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "4.0", rec.Header().Get("OData-Version"))
+	assert.JSONEq(t, `{"@odata.context": "http://example.com/odata/$metadata",
+		"value": [{"name": "orders", "kind": "EntitySet", "url": "orders"}]}`, rec.Body.String())
+
+	rec = get(internal.ODataPath + "$metadata")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `<Property Name="customer" Type="Edm.String" Nullable="true"></Property>`)
+	assert.Contains(t, rec.Body.String(), `<EntitySet Name="orders" EntityType="Scratch.orders"></EntitySet>`)
+
+	query := url.Values{
+		"$filter":  {"amount ge 6 and (customer eq 'o''neil' or startswith(customer,'a')) and customer ne null"},
+		"$select":  {"id, customer"},
+		"$orderby": {"amount desc"},
+		"$top":     {"5"},
+		"$count":   {"true"},
+	}
+	rec = get(internal.ODataPath + "orders?" + query.Encode())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"@odata.context": "http://example.com/odata/$metadata#orders", "@odata.count": 2,
+		"value": [{"id": 1, "customer": "ann"}, {"id": 3, "customer": "o'neil"}]}`, rec.Body.String())
+	rec = get(internal.ODataPath + "orders?" + url.Values{"$skip": {"2"}, "$orderby": {"id"}}.Encode())
+	assert.JSONEq(t, `{"@odata.context": "http://example.com/odata/$metadata#orders",
+		"value": [{"id": 3, "customer": "o'neil", "amount": 7}]}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, get(internal.ODataPath+"orders?"+url.Values{
+		"$filter": {"nope eq 1"}}.Encode()).Code)
+	assert.Equal(t, http.StatusBadRequest, get(internal.ODataPath+"orders?"+url.Values{
+		"$filter": {"amount gt"}}.Encode()).Code)
+	assert.Equal(t, http.StatusNotFound, get(internal.ODataPath+"nope").Code)
+}
+
+func TestServerSegment(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "web", Key: "write-key"},
+	})
+	require.NoError(t, err)
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys)).Handler()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		// The Segment libraries send the write key as the user name.
+		req.SetBasicAuth("write-key", "")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(internal.SegmentPath+"track", `{"userId": "u1", "event": "Order Completed", "messageId": "m1",
+		"timestamp": "2024-05-01T10:00:00Z", "properties": {"orderId": "o1", "total": 12.5, "cart": {"items": 2}},
+		"context": {"library": {"name": "analytics-node"}}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"success": true}`, rec.Body.String())
+	rec = post(internal.SegmentPath+"identify", `{"anonymousId": "a1", "traits": {"firstName": "Ann"}}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = post(internal.SegmentPath+"batch", `{"context": {"ip": "10.0.0.1"}, "batch": [
+		{"type": "track", "userId": 42, "event": "Signed Up", "messageId": "m2"},
+		{"type": "identify", "userId": "u1", "traits": {"firstName": "Bob"}}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	query := func(sql string) []map[string]any {
+		rows, err := store.Query(context.Background(), &internal.QueryStatement{Query: sql})
+		require.NoError(t, err)
+		return rows
+	}
+	assert.Equal(t, []map[string]any{
+		{"message_id": "m1", "user_id": "u1", "event": "Order Completed", "timestamp": "2024-05-01T10:00:00Z",
+			"properties_order_id": "o1", "properties_total": 12.5, "properties_cart_items": 2.0,
+			"context_library_name": "analytics-node", "context_ip": nil},
+		{"message_id": "m2", "user_id": "42", "event": "Signed Up", "timestamp": nil, "properties_order_id": nil,
+			"properties_total": nil, "properties_cart_items": nil, "context_library_name": nil, "context_ip": "10.0.0.1"},
+	}, query(`SELECT message_id, user_id, event, if(message_id = 'm1', timestamp, NULL) AS timestamp,
+		properties_order_id, properties_total, properties_cart_items, context_library_name, context_ip
+		FROM events ORDER BY message_id`))
+	assert.Equal(t, []map[string]any{
+		{"user_id": nil, "anonymous_id": "a1", "traits_first_name": "Ann"},
+		{"user_id": "u1", "anonymous_id": nil, "traits_first_name": "Bob"},
+	}, query("SELECT user_id, anonymous_id, traits_first_name FROM identities ORDER BY traits_first_name"))
+
+	assert.Equal(t, http.StatusBadRequest, post(internal.SegmentPath+"track", `{"userId": "u1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(internal.SegmentPath+"track", `{"event": "Anonymous"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(internal.SegmentPath+"batch",
+		`{"batch": [{"type": "page", "userId": "u1"}]}`).Code)
+	req := httptest.NewRequest(http.MethodPost, internal.SegmentPath+"track", strings.NewReader(`{}`))
+	req.SetBasicAuth("wrong-key", "")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestServerQueryHistory(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	keys, err := internal.NewAPIKeys("", []internal.APIKey{
+		{Name: "root", Key: "root-key", Admin: true},
+		{Name: "ann", Key: "ann-key"},
+		{Name: "bob", Key: "bob-key"},
+	})
+	require.NoError(t, err)
+	handler := internal.NewServer(store, internal.WithAPIKeys(keys), internal.WithQueryHistory(3)).Handler()
+	do := func(method, target, key string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			b, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(b)
+		}
+		req := httptest.NewRequest(method, target, reader)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	history := func(key, params string) []internal.QueryHistoryEntry {
+		rec := do(http.MethodGet, "/queries/history?"+params, key, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var entries []internal.QueryHistoryEntry
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+		return entries
+	}
+	sqls := func(entries []internal.QueryHistoryEntry) []string {
+		out := make([]string, len(entries))
+		for i, e := range entries {
+			out[i] = e.SQL
+		}
+		return out
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/query", "ann-key",
+		internal.QueryRequest{SQL: "select 1 as a"}).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/query", "bob-key",
+		internal.QueryRequest{SQL: "select ? as b", Params: []any{2}}).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/query", "ann-key",
+		internal.QueryRequest{SQL: "select nope"}).Code)
+
+	assert.Equal(t, []string{"select nope", "select ? as b", "select 1 as a"}, sqls(history("root-key", "")))
+	entries := history("ann-key", "")
+	assert.Equal(t, []string{"select nope", "select 1 as a"}, sqls(entries))
+	assert.NotEmpty(t, entries[0].Error)
+	assert.Equal(t, "key:ann", entries[1].Caller)
+	require.NotNil(t, entries[1].Rows)
+	assert.Equal(t, 1, *entries[1].Rows)
+	assert.Equal(t, []string{"select 1 as a"}, sqls(history("ann-key", "status=ok")))
+	assert.Equal(t, []string{"select ? as b"}, sqls(history("root-key", "caller=key:bob&contains=AS+B")))
+	assert.Equal(t, []string{"select nope"}, sqls(history("root-key", "limit=1")))
+	assert.Empty(t, history("root-key", "since=2000-01-01T00:00:00Z&min_duration=1h"))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/queries/history?status=maybe", "root-key", nil).Code)
+
+	bobs := history("bob-key", "")
+	require.Len(t, bobs, 1)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/queries/history/"+bobs[0].ID, "ann-key", nil).Code)
+	rec := do(http.MethodPost, "/queries/history/"+bobs[0].ID, "bob-key", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `[{"b": 2}]`, rec.Body.String())
+	// The rerun is recorded too and the oldest entry dropped from the bounded history.
+	assert.Equal(t, []string{"select ? as b", "select nope", "select ? as b"}, sqls(history("root-key", "")))
+}
+
+func TestServerWebhooks(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	webhooks, err := internal.NewWebhooks(store, internal.WebhookConfig{
+		File: path, MaxAttempts: 3, RetryBackoff: 10 * time.Millisecond, Timeout: time.Second,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go webhooks.Run(ctx)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithWebhooks(webhooks)).NewServeMux())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	// The receiver fails the first attempt of every event, the retry delivers it.
+	events := make(chan internal.SchemaEvent, 10)
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, readErr := io.ReadAll(r.Body)
+		assert.NoError(t, readErr)
+		assert.Equal(t, internal.WebhookSignature("s3cret", r.Header.Get(internal.WebhookTimestampHeader), body),
+			r.Header.Get(internal.WebhookSignatureHeader))
+		var e internal.SchemaEvent
+		assert.NoError(t, json.Unmarshal(body, &e))
+		assert.Equal(t, string(e.Kind), r.Header.Get(internal.WebhookEventHeader))
+		mu.Lock()
+		attempts[e.ID]++
+		first := attempts[e.ID] == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		events <- e
+	}))
+	t.Cleanup(receiver.Close)
+	next := func() internal.SchemaEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no webhook delivery")
+			return internal.SchemaEvent{}
+		}
+	}
+
+	do := func(method, path, body string) (int, string) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, string(out)
+	}
+	code, _ := do(http.MethodPut, "/admin/webhooks/drift", `{"url": "ftp://example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/admin/webhooks/drift", `{"url": "http://example.com", "events": ["dropped"]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body := do(http.MethodPut, "/admin/webhooks/drift", `{"url": "`+receiver.URL+`", "secret": "s3cret"}`)
+	require.Equal(t, http.StatusCreated, code, body)
+	assert.NotContains(t, body, "s3cret")
+	code, _ = do(http.MethodPut, "/admin/webhooks/conflicts",
+		`{"url": "http://127.0.0.1:1", "events": ["type_conflict"]}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body = do(http.MethodPost, "/data?Table=drift", `{"n": 1}`)
+	require.Equal(t, http.StatusOK, code, body)
+	e := next()
+	assert.Equal(t, internal.SchemaEventTableCreated, e.Kind)
+	assert.Equal(t, "drift", e.Table)
+	require.Len(t, e.Columns, 1)
+	assert.Equal(t, "DOUBLE", e.Columns[0].Type)
+	assert.NotEmpty(t, e.RequestID)
+
+	code, _ = do(http.MethodPost, "/data?Table=drift", `[{"n": 2, "label": "a", "ok": true}]`)
+	require.Equal(t, http.StatusOK, code)
+	e = next()
+	assert.Equal(t, internal.SchemaEventColumnsAdded, e.Kind)
+	require.Len(t, e.Columns, 2)
+	assert.Equal(t, "label", e.Columns[0].Column)
+	assert.Equal(t, "ok", e.Columns[1].Column)
+
+	code, _ = do(http.MethodPost, "/data?Table=drift", `{"n": "three"}`)
+	require.Equal(t, http.StatusConflict, code)
+	e = next()
+	assert.Equal(t, internal.SchemaEventTypeConflict, e.Kind)
+	assert.NotEmpty(t, e.Error)
+	mu.Lock()
+	assert.Equal(t, 2, attempts[e.ID])
+	mu.Unlock()
+
+	// The webhook that can't be reached is given up on after its attempts.
+	require.Eventually(t, func() bool {
+		wh, getErr := webhooks.Get("conflicts")
+		return getErr == nil && wh.LastError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	code, body = do(http.MethodGet, "/admin/webhooks/drift", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"last_delivery"`)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "s3cret")
+	code, _ = do(http.MethodDelete, "/admin/webhooks/conflicts", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	reloaded, err := internal.NewWebhooks(store, internal.WebhookConfig{File: path})
+	require.NoError(t, err)
+	assert.Len(t, reloaded.List(), 1)
+}
+
+func TestServerAlerts(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	alerts := internal.NewAlerts(store, time.Minute, internal.WebhookConfig{
+		MaxAttempts: 2, RetryBackoff: 10 * time.Millisecond, Timeout: time.Second,
+	})
+	server := httptest.NewServer(internal.NewServer(store, internal.WithAlerts(alerts)).NewServeMux())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	notifications := make(chan internal.AlertNotification, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, readErr := io.ReadAll(r.Body)
+		assert.NoError(t, readErr)
+		assert.Equal(t, internal.WebhookSignature("pager", r.Header.Get(internal.WebhookTimestampHeader), body),
+			r.Header.Get(internal.WebhookSignatureHeader))
+		var n internal.AlertNotification
+		assert.NoError(t, json.Unmarshal(body, &n))
+		notifications <- n
+	}))
+	slack := make(chan map[string]string, 10)
+	slackReceiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		slack <- msg
+	}))
+	t.Cleanup(func() {
+		receiver.Close()
+		slackReceiver.Close()
+	})
+
+	do := func(method, path, body string) (int, internal.Alert) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var a internal.Alert
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&a))
+		}
+		return res.StatusCode, a
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "app_errors",
+		Rows:  []map[string]any{{"level": "error"}, {"level": "error"}},
+	}))
+
+	code, _ := do(http.MethodPut, "/admin/alerts/errors", `{"sql": "delete from app_errors", "interval": "1m",
+		"target": {"type": "webhook", "url": "`+receiver.URL+`"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/admin/alerts/errors", `{"sql": "select 1", "interval": "1m",
+		"target": {"type": "pagerduty", "url": "`+receiver.URL+`"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, a := do(http.MethodPut, "/admin/alerts/errors", `{
+		"sql": "select count(*) as errors from app_errors where level = ? having count(*) > 1",
+		"params": ["error"], "interval": "1h", "disabled": true,
+		"target": {"type": "webhook", "url": "`+receiver.URL+`", "secret": "pager"}}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "********", a.Target.Secret)
+	assert.Empty(t, a.State)
+
+	code, a = do(http.MethodPost, "/admin/alerts/errors/evaluate", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.AlertFiring, a.State)
+	assert.NotNil(t, a.LastNotification)
+	n := <-notifications
+	assert.Equal(t, internal.AlertFiring, n.State)
+	assert.Empty(t, n.Previous)
+	assert.Equal(t, []map[string]any{{"errors": float64(2)}}, n.Rows)
+
+	// A firing alert that still fires notifies nobody.
+	code, a = do(http.MethodPost, "/admin/alerts/errors/evaluate", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.AlertFiring, a.State)
+	assert.Empty(t, notifications)
+
+	res, err := http.Post(server.URL+"/admin/query", "application/json",
+		strings.NewReader(`{"sql": "delete from app_errors"}`))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	code, a = do(http.MethodPost, "/admin/alerts/errors/evaluate", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.AlertOK, a.State)
+	n = <-notifications
+	assert.Equal(t, internal.AlertOK, n.State)
+	assert.Equal(t, internal.AlertFiring, n.Previous)
+
+	// The background evaluation posts a failing query to Slack.
+	go alerts.Run(ctx)
+	code, _ = do(http.MethodPut, "/admin/alerts/broken", `{"sql": "select * from missing", "interval": "1h",
+		"target": {"type": "slack", "url": "`+slackReceiver.URL+`"}}`)
+	require.Equal(t, http.StatusCreated, code)
+	select {
+	case msg := <-slack:
+		assert.Contains(t, msg["text"], "*broken* failed to evaluate")
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no slack message")
+	}
+	code, a = do(http.MethodGet, "/admin/alerts/broken", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.AlertError, a.State)
+	assert.NotEmpty(t, a.LastError)
+
+	code, _ = do(http.MethodDelete, "/admin/alerts/broken", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do(http.MethodGet, "/admin/alerts/broken", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestServerQuality(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	quality := internal.NewQuality(store, time.Minute, internal.WebhookConfig{
+		MaxAttempts: 2, RetryBackoff: 10 * time.Millisecond, Timeout: time.Second,
+	})
+	server := httptest.NewServer(internal.NewServer(store, internal.WithQuality(quality)).NewServeMux())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+
+	notifications := make(chan internal.QualityNotification, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n internal.QualityNotification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		notifications <- n
+	}))
+	t.Cleanup(receiver.Close)
+
+	do := func(method, path, body string) (int, internal.TableQuality) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		var q internal.TableQuality
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&q))
+		}
+		return res.StatusCode, q
+	}
+	now := time.Now().UTC()
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "orders",
+		Rows: []map[string]any{
+			{"id": 1, "amount": 10, "email": "a@example.com", "at": now.Add(-time.Hour).Format(time.DateTime)},
+			{"id": 2, "amount": 20, "email": "b@example.com", "at": now.Add(-time.Minute).Format(time.DateTime)},
+			{"id": 3, "amount": 30, "at": now.Add(-2 * time.Hour).Format(time.DateTime)},
+		},
+	}))
+
+	code, _ := do(http.MethodPut, "/admin/quality/orders", `{"checks": []}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/admin/quality/orders", `{"checks": [{"type": "range", "column": "amount"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/admin/quality/orders", `{"checks": [{"type": "median", "column": "amount"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/admin/quality/orders", `{"checks": [{"type": "freshness", "column": "at"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, q := do(http.MethodPut, "/admin/quality/orders", `{"on_ingest": true, "checks": [
+		{"type": "null_rate", "column": "email", "max_rate": 0.5},
+		{"type": "range", "column": "amount", "min": 0, "max": 100},
+		{"name": "unique_ids", "type": "unique", "column": "id"},
+		{"type": "freshness", "column": "at", "max_age": "10m"}],
+		"target": {"type": "webhook", "url": "`+receiver.URL+`", "secret": "s3cret"}}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "********", q.Target.Secret)
+	assert.Equal(t, "null_rate_email", q.Checks[0].Name)
+	assert.Empty(t, q.State)
+
+	code, q = do(http.MethodPost, "/admin/quality/orders/evaluate", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.QualityPassing, q.State)
+	require.Len(t, q.Results, 4)
+	for _, r := range q.Results {
+		assert.True(t, r.Passed, r.Check)
+	}
+	assert.InDelta(t, 1.0/3, *q.Results[0].Observed, 0.001)
+	// A first evaluation that passes notifies nobody.
+	assert.Empty(t, notifications)
+
+	// Ingesting bad rows fails the checks evaluated on ingest and notifies the target.
+	go quality.Run(ctx)
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "orders",
+		Rows:  []map[string]any{{"id": 2, "amount": 500}, {"id": 4, "amount": -1}},
+	}))
+	var n internal.QualityNotification
+	select {
+	case n = <-notifications:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no notification")
+	}
+	assert.Equal(t, internal.QualityFailing, n.State)
+	assert.Equal(t, internal.QualityPassing, n.Previous)
+	var failed []string
+	for _, r := range n.Failed {
+		failed = append(failed, r.Check)
+	}
+	assert.Equal(t, []string{"null_rate_email", "range_amount", "unique_ids"}, failed)
+
+	code, q = do(http.MethodGet, "/tables/orders/quality", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.QualityFailing, q.State)
+	assert.InDelta(t, 2, *q.Results[1].Observed, 0)
+
+	// Checks whose query fails count as failed.
+	code, _ = do(http.MethodPut, "/admin/quality/orders", `{"checks": [{"type": "unique", "column": "missing"}]}`)
+	require.Equal(t, http.StatusOK, code)
+	code, q = do(http.MethodPost, "/admin/quality/orders/evaluate", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, internal.QualityFailing, q.State)
+	assert.False(t, q.Results[0].Passed)
+	assert.NotEmpty(t, q.Results[0].Error)
+
+	code, _ = do(http.MethodDelete, "/admin/quality/orders", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do(http.MethodGet, "/admin/quality/orders", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do(http.MethodPost, "/admin/quality/orders/evaluate", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestServerDownloads(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "0123456789abcdef0123456789abcdef.csv")
+	require.NoError(t, os.WriteFile(leftover, []byte("old"), 0o600))
+	downloads, err := internal.NewDownloads(dir, time.Hour)
+	require.NoError(t, err)
+	assert.NoFileExists(t, leftover)
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithDownloads(downloads)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string, header http.Header) (*http.Response, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, out
+	}
+	create := func(body string) (int, internal.Download) {
+		res, out := do(http.MethodPost, "/downloads", body, nil)
+		var d internal.Download
+		if res.StatusCode == http.StatusCreated {
+			require.NoError(t, json.Unmarshal(out, &d))
+		}
+		return res.StatusCode, d
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "events",
+		Rows:  []map[string]any{{"id": 1, "kind": "click"}, {"id": 2, "kind": "view"}},
+	}))
+
+	for _, body := range []string{
+		`{}`,
+		`{"sql": "select 1", "table": "events"}`,
+		`{"sql": "select 1", "format": "xlsx"}`,
+		`{"sql": "select 1", "part_size": 1024}`,
+		`{"table": "events; drop table events"}`,
+		`{"sql": "delete from events"}`,
+	} {
+		code, _ := create(body)
+		assert.NotEqual(t, http.StatusCreated, code, body)
+	}
+	code, _ := create(`{"table": "missing"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, d := create(`{"sql": "select i, 'row-' || i as s from range(30000) t(i) where i < ? order by i",
+		"params": [20000], "format": "csv", "part_size": 65536}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, int64(20000), d.Rows)
+	assert.Greater(t, d.Parts, 1)
+	assert.Len(t, d.PartSHA256, d.Parts)
+	assert.Equal(t, (d.Size+d.PartSize-1)/d.PartSize, int64(d.Parts))
+
+	res, whole := do(http.MethodGet, "/downloads/"+d.ID+"/data", "", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	assert.Len(t, whole, int(d.Size))
+	sum := sha256.Sum256(whole)
+	assert.Equal(t, d.SHA256, hex.EncodeToString(sum[:]))
+	assert.True(t, strings.HasPrefix(string(whole), "i,s\n0,row-0\n1,row-1\n"))
+
+	// A transfer interrupted after 1000 bytes resumes with a range request.
+	res, rest := do(http.MethodGet, "/downloads/"+d.ID+"/data", "", http.Header{
+		"Range": {"bytes=1000-"}, "If-Range": {res.Header.Get("ETag")},
+	})
+	require.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, whole[1000:], rest)
+	res, _ = do(http.MethodGet, "/downloads/"+d.ID+"/data", "", http.Header{
+		"Range": {"bytes=1000-"}, "If-Range": {`"stale"`},
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var assembled []byte
+	for i := range d.Parts {
+		res, part := do(http.MethodGet, fmt.Sprintf("/downloads/%s/parts/%d", d.ID, i), "", nil)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		partSum := sha256.Sum256(part)
+		assert.Equal(t, d.PartSHA256[i], hex.EncodeToString(partSum[:]))
+		assembled = append(assembled, part...)
+	}
+	assert.Equal(t, whole, assembled)
+	res, _ = do(http.MethodGet, fmt.Sprintf("/downloads/%s/parts/%d", d.ID, d.Parts), "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	code, table := create(`{"table": "events"}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "parquet", table.Format)
+	assert.Equal(t, int64(2), table.Rows)
+	assert.Equal(t, 1, table.Parts)
+	res, out := do(http.MethodGet, "/downloads", "", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var list []internal.Download
+	require.NoError(t, json.Unmarshal(out, &list))
+	assert.Len(t, list, 2)
+
+	res, _ = do(http.MethodDelete, "/downloads/"+d.ID, "", nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.NoFileExists(t, filepath.Join(dir, d.ID+".csv"))
+	res, _ = do(http.MethodGet, "/downloads/"+d.ID+"/data", "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = do(http.MethodGet, "/downloads/"+table.ID, "", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestServerUploads(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "0123456789abcdef0123456789abcdef"), 0o700))
+	uploads, err := internal.NewUploads(dir, time.Hour)
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(dir, "0123456789abcdef0123456789abcdef"))
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithUploads(uploads)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string) (int, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, out
+	}
+	create := func(table, body string) (int, internal.Upload) {
+		code, out := do(http.MethodPost, "/tables/"+table+"/uploads", body)
+		var u internal.Upload
+		if code == http.StatusCreated {
+			require.NoError(t, json.Unmarshal(out, &u))
+		}
+		return code, u
+	}
+
+	code, _ := create("events", `{"format": "xls"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = create("events", `{"format": "csv", "append": true}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, u := create("events", `{"format": "csv"}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Empty(t, u.Parts)
+	file := "id,kind\n1,click\n2,view\n3,click\n"
+	parts := []string{file[:10], file[10:20], file[20:]}
+	base := "/tables/events/uploads/" + u.ID
+
+	code, _ = do(http.MethodPut, base+"/parts/x", parts[0])
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, base+"/parts/2", parts[2])
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(http.MethodPut, base+"/parts/0", "garbage")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(http.MethodPost, base+"/commit", "")
+	assert.Equal(t, http.StatusBadRequest, code, "part 1 is missing")
+
+	// Parts sent again replace those received before.
+	code, out := do(http.MethodPut, base+"/parts/0", parts[0])
+	require.Equal(t, http.StatusOK, code)
+	var part internal.UploadPart
+	require.NoError(t, json.Unmarshal(out, &part))
+	sum := sha256.Sum256([]byte(parts[0]))
+	assert.Equal(t, internal.UploadPart{Number: 0, Size: 10, SHA256: hex.EncodeToString(sum[:])}, part)
+	code, _ = do(http.MethodPut, base+"/parts/1", parts[1])
+	require.Equal(t, http.StatusOK, code)
+	code, out = do(http.MethodGet, base, "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(out, &u))
+	assert.Len(t, u.Parts, 3)
+	assert.Equal(t, int64(len(file)), u.Size)
+	code, _ = do(http.MethodGet, "/tables/other/uploads/"+u.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(http.MethodPost, base+"/commit", `{"sha256": "00"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	sum = sha256.Sum256([]byte(file))
+	code, out = do(http.MethodPost, base+"/commit", `{"sha256": "`+hex.EncodeToString(sum[:])+`"}`)
+	require.Equal(t, http.StatusCreated, code, string(out))
+	var res internal.ImportResponse
+	require.NoError(t, json.Unmarshal(out, &res))
+	assert.Equal(t, internal.ImportResponse{Table: "events", Rows: 3}, res)
+	code, _ = do(http.MethodGet, base, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.NoDirExists(t, filepath.Join(dir, u.ID))
+
+	code, u = create("events", `{"format": "csv", "append": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	base = "/tables/events/uploads/" + u.ID
+	code, _ = do(http.MethodPut, base+"/parts/0", "kind,id\nview,4\n")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(http.MethodPost, base+"/commit", "")
+	assert.Equal(t, http.StatusOK, code)
+	var rows []map[string]any
+	code, out = do(http.MethodPost, "/query",
+		`{"sql": "select kind, count(*) as n from events group by kind order by kind"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(out, &rows))
+	assert.Equal(t, []map[string]any{{"kind": "click", "n": float64(2)}, {"kind": "view", "n": float64(2)}}, rows)
+
+	// The dialect of European CSV files is set instead of detected.
+	code, _ = create("prices", `{"format": "csv", "csv": {"delimiter": ";;"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = create("prices", `{"format": "parquet", "csv": {"delimiter": ";"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, u = create("prices", `{"format": "csv", "csv": {"delimiter": ";", "quote": "'", "header": true,
+		"decimal_separator": ",", "null": "-", "types": {"sku": "VARCHAR"}}}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(http.MethodPut, "/tables/prices/uploads/"+u.ID+"/parts/0",
+		"sku;price;note\n0042;1234,5;'a;b'\n0043;2,25;\n0044;-;-\n")
+	require.Equal(t, http.StatusOK, code)
+	code, out = do(http.MethodPost, "/tables/prices/uploads/"+u.ID+"/commit", "")
+	require.Equal(t, http.StatusCreated, code, string(out))
+	code, out = do(http.MethodPost, "/query",
+		`{"sql": "select sku, price, note, typeof(price) as type from prices order by sku"}`)
+	require.Equal(t, http.StatusOK, code)
+	rows = nil
+	require.NoError(t, json.Unmarshal(out, &rows))
+	assert.Equal(t, []map[string]any{
+		{"sku": "0042", "price": 1234.5, "note": "a;b", "type": "DOUBLE"},
+		{"sku": "0043", "price": 2.25, "note": "", "type": "DOUBLE"},
+		{"sku": "0044", "price": nil, "note": nil, "type": "DOUBLE"},
+	}, rows)
+
+	code, u = create("events", `{"format": "parquet", "append": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(http.MethodDelete, "/tables/events/uploads/"+u.ID, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do(http.MethodPut, "/tables/events/uploads/"+u.ID+"/parts/0", "x")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// xlsxWorkbook returns a workbook with an empty first sheet and a sheet Orders of the rows of cell XML.
+func xlsxWorkbook(t *testing.T, rows string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+			xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>
+			<sheet name="Notes" sheetId="1" r:id="rId1"/><sheet name="Orders" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/>
+			<Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>Order Date</t></si><si><r><t>Cus</t></r><r><t>tomer</t></r></si>
+			<si><t>ann</t></si></sst>`,
+		"xl/styles.xml": `<styleSheet><numFmts><numFmt numFmtId="164" formatCode="yyyy\-mm\-dd hh:mm"/></numFmts>
+			<cellXfs><xf numFmtId="0"/><xf numFmtId="14"/><xf numFmtId="164"/><xf numFmtId="2"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData/></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>` + rows + `</sheetData></worksheet>`,
+	} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestServerImportJobs(t *testing.T) {
+	uploads, err := internal.NewUploads(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	srv := internal.NewServer(store, internal.WithUploads(uploads))
+	server := httptest.NewServer(srv.NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path, body string) (*http.Response, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res, out
+	}
+
+	res, _ := do(http.MethodPost, "/tables/events/import", `{"url": "/etc/passwd", "format": "csv", "async": true}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = do(http.MethodGet, "/jobs/unknown", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, out := do(http.MethodPost, "/tables/events/uploads",
+		`{"format": "csv", "csv": {"header": true, "types": {"id": "INTEGER"}, "ignore_errors": true}}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode, string(out))
+	var u internal.Upload
+	require.NoError(t, json.Unmarshal(out, &u))
+	file := "id,kind\n1,click\nx,view\n3,click\n"
+	res, _ = do(http.MethodPut, "/tables/events/uploads/"+u.ID+"/parts/0", file)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res, out = do(http.MethodPost, "/tables/events/uploads/"+u.ID+"/commit", `{"async": true}`)
+	require.Equal(t, http.StatusAccepted, res.StatusCode, string(out))
+	var job internal.ImportJob
+	require.NoError(t, json.Unmarshal(out, &job))
+	assert.Equal(t, "/jobs/"+job.ID, res.Header.Get("Location"))
+	assert.Equal(t, internal.ImportJobUpload, job.Kind)
+	assert.Equal(t, u.ID, job.Source)
+	assert.Equal(t, int64(len(file)), job.BytesTotal)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	res, out = do(http.MethodGet, "/jobs/"+job.ID, "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.Unmarshal(out, &job))
+	assert.Equal(t, internal.JobSucceeded, job.Status, job.Error)
+	assert.Equal(t, int64(2), job.Rows)
+	assert.Equal(t, job.BytesTotal, job.BytesRead)
+	require.Len(t, job.Rejected, 1)
+	assert.Equal(t, int64(3), job.Rejected[0].Line)
+	assert.Equal(t, "id", job.Rejected[0].Column)
+	assert.Equal(t, "x", job.Rejected[0].Value)
+	assert.NotNil(t, job.FinishedAt)
+
+	// Cancelling a finished job leaves it as is.
+	res, out = do(http.MethodDelete, "/jobs/"+job.ID, "")
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	require.NoError(t, json.Unmarshal(out, &job))
+	assert.Equal(t, internal.JobSucceeded, job.Status)
+	res, out = do(http.MethodGet, "/jobs", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var jobs []internal.ImportJob
+	require.NoError(t, json.Unmarshal(out, &jobs))
+	require.Len(t, jobs, 1)
+	assert.Equal(t, job.ID, jobs[0].ID)
+
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select sum(id)::DOUBLE as n from events",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": 4.0}}, rows)
+	res, _ = do(http.MethodGet, "/tables/events/uploads/"+u.ID, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "the committed session is removed")
+}
+
+func TestServerUploadsXLSX(t *testing.T) {
+	uploads, err := internal.NewUploads(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	server := httptest.NewServer(internal.NewServer(store, internal.WithUploads(uploads)).NewServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		assert.NoError(t, store.Close())
+	})
+	do := func(method, path string, body []byte) (int, []byte) {
+		req, reqErr := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		require.NoError(t, reqErr)
+		res, doErr := http.DefaultClient.Do(req)
+		require.NoError(t, doErr)
+		defer func() {
+			_ = res.Body.Close()
+		}()
+		out, readErr := io.ReadAll(res.Body)
+		require.NoError(t, readErr)
+		return res.StatusCode, out
+	}
+	load := func(table, request string, workbook []byte) (int, []byte) {
+		code, out := do(http.MethodPost, "/tables/"+table+"/uploads", []byte(request))
+		require.Equal(t, http.StatusCreated, code, string(out))
+		var u internal.Upload
+		require.NoError(t, json.Unmarshal(out, &u))
+		code, _ = do(http.MethodPut, "/tables/"+table+"/uploads/"+u.ID+"/parts/0", workbook)
+		require.Equal(t, http.StatusOK, code)
+		return do(http.MethodPost, "/tables/"+table+"/uploads/"+u.ID+"/commit", nil)
+	}
+
+	code, _ := do(http.MethodPost, "/tables/orders/uploads", []byte(`{"format": "csv", "sheet": "Orders"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	workbook := xlsxWorkbook(t, `
+		<row r="1"><c r="A1" t="inlineStr"><is><t>Exported orders</t></is></c></row>
+		<row r="2"><c r="A2" t="s"><v>0</v></c><c r="B2" t="s"><v>1</v></c><c r="C2" t="str"><v>Total</v></c>
+			<c r="D2" t="str"><v>Paid?</v></c><c r="E2" t="str"><v>total</v></c></row>
+		<row r="3"><c r="A3" s="1"><v>45292</v></c><c r="B3" t="s"><v>2</v></c><c r="C3" s="3"><v>12.5</v></c>
+			<c r="D3" t="b"><v>1</v></c><c r="F3" t="e"><v>#DIV/0!</v></c><c r="G3"><v>7</v></c></row>
+		<row r="5"><c r="A5" s="2"><v>45292.75</v></c><c r="C5"><v>3</v></c><c r="D5" t="b"><v>0</v></c>
+			<c r="E5"><v>1</v></c></row>
+		<row r="6"><c r="B6" t="inlineStr"><is><t></t></is></c></row>`)
+
+	code, out := load("orders", `{"format": "xlsx"}`, workbook)
+	assert.Equal(t, http.StatusBadRequest, code, string(out))
+	code, out = load("orders", `{"format": "xlsx", "sheet": "Orders", "header_row": 6}`, workbook)
+	assert.Equal(t, http.StatusBadRequest, code, string(out))
+
+	code, out = load("orders", `{"format": "xlsx", "sheet": "Orders", "header_row": 2}`, workbook)
+	require.Equal(t, http.StatusCreated, code, string(out))
+	var res internal.ImportResponse
+	require.NoError(t, json.Unmarshal(out, &res))
+	assert.Equal(t, internal.ImportResponse{Table: "orders", Rows: 2}, res)
+
+	result, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select order_date, customer, total, paid, total_2, g from orders order by order_date",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"order_date": "2024-01-01", "customer": "ann", "total": 12.5, "paid": true, "total_2": nil, "g": 7.0},
+		{"order_date": "2024-01-01 18:00:00", "customer": nil, "total": 3.0, "paid": false, "total_2": 1.0, "g": nil},
+	}, result)
+
+	code, _ = do(http.MethodPost, "/tables/orders/uploads", []byte(`{"format": "xlsx"}`))
+	assert.Equal(t, http.StatusConflict, code, "the table exists")
+	code, out = load("orders", `{"format": "xlsx", "sheet": "Orders", "header_row": 2, "append": true}`,
+		[]byte("not a workbook"))
+	assert.Equal(t, http.StatusBadRequest, code, string(out))
+}
@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionIdleTimeout is how long a session is kept without queries before its connection is closed.
+	SessionIdleTimeout = 15 * time.Minute
+	// MaxSessions bounds the open sessions of a server, each of them holds a connection.
+	MaxSessions = 32
+)
+
+// SessionHeader selects the session a query runs in.
+const SessionHeader = "X-Session-ID"
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrTooManySessions = errors.New("too many sessions")
+)
+
+// Session is a connection pinned for a client, so temporary tables and session settings outlive a single request.
+// Besides reads, the statements of read-only queries may create temporary objects, modify or drop the temporary
+// objects the session created and change settings with SET SESSION.
+type Session struct {
+	store *Store
+	mu    sync.Mutex
+	conn  *sql.Conn
+	// temps are the lower cased names of the temporary objects created in the session.
+	temps map[string]bool
+}
+
+// NewSession pins a connection of the pool. It must be closed to release the connection.
+func (s *Store) NewSession(ctx context.Context) (*Session, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("session: acquiring connection: %w", err)
+	}
+	return &Session{store: s, conn: conn, temps: make(map[string]bool)}, nil
+}
+
+// Fetch is Store.Fetch on the connection of the session. Profiling is not supported.
+func (s *Session) Fetch(ctx context.Context, stmt *QueryStatement) (*QueryResult, error) {
+	if stmt != nil && stmt.Profile {
+		return nil, errors.New("session: profiling is not supported")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil, ErrSessionNotFound
+	}
+	if stmt == nil || stmt.AllowWrites {
+		return s.store.fetch(ctx, s.conn, stmt)
+	}
+
+	temps, dropped, writes, err := s.check(stmt.Query)
+	if err != nil {
+		return nil, err
+	}
+	checked := *stmt
+	checked.AllowWrites = writes
+	res, err := s.store.fetch(ctx, s.conn, &checked)
+	if err != nil {
+		// Statements before the failing one may have run. Forgetting the drops is safe, keeping a dropped name would
+		// let a later statement modify the persistent table of that name.
+		for _, name := range dropped {
+			delete(s.temps, name)
+		}
+		return nil, err
+	}
+	s.temps = temps
+	return res, nil
+}
+
+// check validates the statements of the query against the session rules. It returns the temporary objects after the
+// query, the objects it drops and whether it writes at all.
+func (s *Session) check(query string) (map[string]bool, []string, bool, error) {
+	stmts, err := ClassifySQL(query)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	temps := make(map[string]bool, len(s.temps))
+	for name := range s.temps {
+		temps[name] = true
+	}
+	var dropped []string
+	writes := false
+	for _, stmt := range stmts {
+		if stmt.Class == StatementRead {
+			continue
+		}
+		writes = true
+		if sessionSetting(stmt.tokens) {
+			continue
+		}
+		name, action, ok := sessionTarget(stmt.tokens)
+		switch {
+		case ok && action == sessionCreate:
+			temps[name] = true
+		case ok && action == sessionDrop && temps[name]:
+			delete(temps, name)
+			dropped = append(dropped, name)
+		case ok && action == sessionModify && temps[name]:
+		default:
+			return nil, nil, false, &ReadOnlyError{Keyword: stmt.Keyword, Class: stmt.Class}
+		}
+	}
+	return temps, dropped, writes, nil
+}
+
+// Close releases the connection. It is discarded rather than returned to the pool, so no temporary object or
+// setting of the session leaks into other requests.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	conn := s.conn
+	s.conn = nil
+	err := conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	if err != nil && !errors.Is(err, driver.ErrBadConn) {
+		return fmt.Errorf("session: closing connection: %w", err)
+	}
+	return nil
+}
+
+// sessionSetting reports whether the statement changes a setting of the session only. The search path is excluded,
+// since unqualified names must keep resolving to the temporary objects first.
+func sessionSetting(tokens []sqlToken) bool {
+	if len(tokens) < 3 || !tokens[1].is(sqlWord, "SESSION") {
+		return false
+	}
+	if !tokens[0].is(sqlWord, "SET") && !tokens[0].is(sqlWord, "RESET") {
+		return false
+	}
+	name := tokens[2].upper()
+	return name != "SEARCH_PATH" && name != "SCHEMA"
+}
+
+type sessionAction int
+
+const (
+	sessionCreate sessionAction = iota
+	sessionDrop
+	sessionModify
+)
+
+// sessionTarget returns the object a statement creates as temporary object, drops or modifies the rows of. Only
+// unqualified names are accepted.
+//
+//nolint:cyclop // One case per statement shape.
+func sessionTarget(tokens []sqlToken) (string, sessionAction, bool) {
+	word := func(i int, words ...string) bool {
+		if i >= len(tokens) || tokens[i].kind != sqlWord {
+			return false
+		}
+		for _, w := range words {
+			if tokens[i].upper() == w {
+				return true
+			}
+		}
+		return false
+	}
+	objects := []string{"TABLE", "VIEW", "MACRO", "FUNCTION", "SEQUENCE"}
+	var (
+		i      int
+		action sessionAction
+	)
+	switch {
+	case word(0, "CREATE"):
+		i, action = 1, sessionCreate
+		if word(i, "OR") && word(i+1, "REPLACE") {
+			i += 2
+		}
+		if !word(i, "TEMP", "TEMPORARY") || !word(i+1, objects...) {
+			return "", 0, false
+		}
+		i += 2
+		if word(i, "IF") && word(i+1, "NOT") && word(i+2, "EXISTS") {
+			i += 3
+		}
+	case word(0, "DROP"):
+		i, action = 2, sessionDrop
+		if !word(1, objects...) {
+			return "", 0, false
+		}
+		if word(i, "IF") && word(i+1, "EXISTS") {
+			i += 2
+		}
+		// A single object, no list and no cascade.
+		if len(tokens) != i+1 {
+			return "", 0, false
+		}
+	case word(0, "INSERT"):
+		i, action = 1, sessionModify
+		if word(i, "OR") && word(i+1, "REPLACE", "IGNORE") {
+			i += 2
+		}
+		if !word(i, "INTO") {
+			return "", 0, false
+		}
+		i++
+	case word(0, "UPDATE"):
+		i, action = 1, sessionModify
+	case word(0, "DELETE"):
+		i, action = 2, sessionModify
+		if !word(1, "FROM") {
+			return "", 0, false
+		}
+	default:
+		return "", 0, false
+	}
+	if i >= len(tokens) || (tokens[i].kind != sqlWord && tokens[i].kind != sqlQuotedIdent) {
+		return "", 0, false
+	}
+	if i+1 < len(tokens) && tokens[i+1].is(sqlPunct, ".") {
+		return "", 0, false
+	}
+	return strings.ToLower(tokens[i].text), action, true
+}
+
+// SessionInfo describes a session as returned by the session endpoints.
+type SessionInfo struct {
+	ID string `json:"id"`
+	// Caller created the session, only its requests may use it.
+	Caller    string    `json:"caller"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type sessionEntry struct {
+	session  *Session
+	info     SessionInfo
+	lastUsed time.Time
+}
+
+// sessions keeps the open sessions of a server. Sessions idle for SessionIdleTimeout are closed.
+type sessions struct {
+	mu   sync.Mutex
+	byID map[string]*sessionEntry
+}
+
+func newSessions() *sessions {
+	return &sessions{byID: make(map[string]*sessionEntry)}
+}
+
+// add keeps the session of the caller of the request.
+func (ss *sessions) add(r *http.Request, session *Session) (SessionInfo, error) {
+	id, err := newID()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.prune()
+	if len(ss.byID) >= MaxSessions {
+		return SessionInfo{}, ErrTooManySessions
+	}
+	now := time.Now()
+	e := &sessionEntry{
+		session:  session,
+		info:     SessionInfo{ID: id, Caller: caller(r), CreatedAt: now, ExpiresAt: now.Add(SessionIdleTimeout)},
+		lastUsed: now,
+	}
+	ss.byID[id] = e
+	return e.info, nil
+}
+
+// get returns the session if the request may use it, see ownedBy, and extends its expiry.
+func (ss *sessions) get(r *http.Request, id string) (*Session, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.prune()
+	e, ok := ss.byID[id]
+	if !ok || !ownedBy(r, e.info.Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	e.lastUsed = time.Now()
+	e.info.ExpiresAt = e.lastUsed.Add(SessionIdleTimeout)
+	return e.session, nil
+}
+
+// remove forgets the session if the request may use it.
+func (ss *sessions) remove(r *http.Request, id string) (*Session, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.byID[id]
+	if !ok || !ownedBy(r, e.info.Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	delete(ss.byID, id)
+	return e.session, nil
+}
+
+// prune closes the sessions idle for longer than SessionIdleTimeout. The caller holds the lock. Closing waits for a
+// running query, so it happens in the background.
+func (ss *sessions) prune() {
+	for id, e := range ss.byID {
+		if time.Since(e.lastUsed) > SessionIdleTimeout {
+			delete(ss.byID, id)
+			go closeSession(e.session)
+		}
+	}
+}
+
+func closeSession(session *Session) {
+	if err := session.Close(); err != nil {
+		slog.Error("closing session", "err", err)
+	}
+}
+
+// requestSession returns the session selected by the SessionHeader of the request, or nil without the header. Sessions
+// of other callers aren't found.
+func (s *Server) requestSession(r *http.Request) (*Session, error) {
+	id := r.Header.Get(SessionHeader)
+	if id == "" {
+		return nil, nil //nolint:nilnil // No session is not an error.
+	}
+	return s.sessions.get(r, id)
+}
+
+// HandleCreateSession opens a session and responds with its ID, to be sent in the SessionHeader of queries.
+func (s *Server) HandleCreateSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.store.NewSession(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle create session", err)
+		return
+	}
+	info, err := s.sessions.add(r, session)
+	if err != nil {
+		closeSession(session)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrTooManySessions) {
+			status = http.StatusTooManyRequests
+		}
+		s.writeError(w, status, "handle create session", err)
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, "handle create session: writing response", info)
+}
+
+// HandleDeleteSession closes a session along with its temporary objects.
+func (s *Server) HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.sessions.remove(r, r.PathValue("id"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle delete session", err)
+		return
+	}
+	if err = session.Close(); err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete session", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// SnapshotsTable records the snapshots of each table. It is created with the first snapshot.
+	SnapshotsTable = "_snapshots"
+	// SnapshotsSchema holds the copies of the snapshotted tables.
+	SnapshotsSchema = "snapshots"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("snapshot exists")
+)
+
+// Snapshot is a frozen copy of a table. Relation is the copy in SnapshotsSchema, which can also be queried directly.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	Table     string    `json:"table"`
+	Name      string    `json:"name,omitempty"`
+	Relation  string    `json:"relation"`
+	Rows      int64     `json:"rows"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SnapshotRequest is the body of POST /tables/{table}/snapshots. Name optionally labels the snapshot, e.g. 2024-w10,
+// and is unique per table.
+type SnapshotRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+// CreateSnapshot copies the current rows of the table into SnapshotsSchema and records the copy.
+func (s *Store) CreateSnapshot(ctx context.Context, table string, req SnapshotRequest) (*Snapshot, error) {
+	if req.Name != "" && !savedQueryNameRegex.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid snapshot name %q: must match %s", req.Name, savedQueryNameRegex)
+	}
+	if _, err := s.existingColumns(ctx, table); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		ID:        id,
+		Table:     strings.ToLower(table),
+		Name:      req.Name,
+		Relation:  strings.ToLower(table) + "_" + id,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back snapshot", "err", rollbackErr)
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s;
+		CREATE TABLE IF NOT EXISTS %s (
+			id VARCHAR PRIMARY KEY,
+			table_name VARCHAR NOT NULL,
+			name VARCHAR NOT NULL,
+			relation VARCHAR NOT NULL,
+			rows BIGINT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`, SnapshotsSchema, SnapshotsTable)); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", SnapshotsTable, err)
+	}
+	if req.Name != "" {
+		var exists bool
+		if err = tx.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT count(*) > 0 FROM %s WHERE table_name = ? AND name = ?", SnapshotsTable,
+		), snap.Table, req.Name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("reading snapshots: %w", err)
+		}
+		if exists {
+			return nil, fmt.Errorf("%w: %s of %s", ErrSnapshotExists, req.Name, table)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE %s.%s AS SELECT * FROM %s", SnapshotsSchema, quoteIdent(snap.Relation), quoteIdent(table),
+	)); err != nil {
+		return nil, fmt.Errorf("copying table: %w", err)
+	}
+	if err = tx.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT count(*) FROM %s.%s", SnapshotsSchema, quoteIdent(snap.Relation),
+	)).Scan(&snap.Rows); err != nil {
+		return nil, fmt.Errorf("counting rows: %w", err)
+	}
+	if _, err = tx.ExecContext(
+		ctx, fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?, ?)", SnapshotsTable),
+		snap.ID, snap.Table, snap.Name, snap.Relation, snap.Rows, snap.CreatedAt,
+	); err != nil {
+		return nil, fmt.Errorf("recording snapshot: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing snapshot: %w", err)
+	}
+	committed = true
+	snap.Relation = SnapshotsSchema + "." + snap.Relation
+	return snap, nil
+}
+
+// Snapshots returns the snapshots of the table, oldest first.
+func (s *Store) Snapshots(ctx context.Context, table string) ([]Snapshot, error) {
+	return s.snapshots(ctx, table, "")
+}
+
+// snapshots lists the snapshots of the table, only the one with the id or name unless ref is empty.
+func (s *Store) snapshots(ctx context.Context, table, ref string) ([]Snapshot, error) {
+	out := []Snapshot{}
+	cols, err := s.tableColumns(ctx, SnapshotsTable)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return out, nil
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT id, table_name, name, relation, rows, created_at
+		FROM %s
+		WHERE table_name = ? AND (? = '' OR id = ? OR name = ?)
+		ORDER BY created_at`, SnapshotsTable), strings.ToLower(table), ref, ref, ref)
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	for rows.Next() {
+		var snap Snapshot
+		if err = rows.Scan(&snap.ID, &snap.Table, &snap.Name, &snap.Relation, &snap.Rows, &snap.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning snapshot: %w", err)
+		}
+		snap.Relation = SnapshotsSchema + "." + snap.Relation
+		out = append(out, snap)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing snapshots: %w", err)
+	}
+	return out, nil
+}
+
+// snapshot returns the snapshot of the table with the id or name.
+func (s *Store) snapshot(ctx context.Context, table, ref string) (*Snapshot, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("%w: empty reference", ErrSnapshotNotFound)
+	}
+	snaps, err := s.snapshots(ctx, table, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, fmt.Errorf("%w: %s of %s", ErrSnapshotNotFound, ref, table)
+	}
+	return &snaps[0], nil
+}
+
+// DeleteSnapshot drops the copy of the snapshot and its record.
+func (s *Store) DeleteSnapshot(ctx context.Context, table, ref string) error {
+	snap, err := s.snapshot(ctx, table, ref)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			slog.Error("rolling back snapshot deletion", "err", rollbackErr)
+		}
+	}()
+	relation := strings.TrimPrefix(snap.Relation, SnapshotsSchema+".")
+	if _, err = tx.ExecContext(
+		ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", SnapshotsSchema, quoteIdent(relation)),
+	); err != nil {
+		return fmt.Errorf("dropping snapshot: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", SnapshotsTable), snap.ID); err != nil {
+		return fmt.Errorf("deleting snapshot record: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing snapshot deletion: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+// AsOf rewrites the single read statement of the query to read the tables in asOf, keyed by table name, from the
+// snapshots with the given id or name. The snapshots shadow the unqualified references to their tables through
+// common table expressions, references qualified with a schema still read the current table.
+func (s *Store) AsOf(ctx context.Context, query string, asOf map[string]string) (string, error) {
+	if len(asOf) == 0 {
+		return query, nil
+	}
+	query, err := (&QueryStatement{Query: query}).singleRead()
+	if err != nil {
+		return "", err
+	}
+	tables := make([]string, 0, len(asOf))
+	for table := range asOf {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	ctes := make([]string, 0, len(tables))
+	for _, table := range tables {
+		snap, snapErr := s.snapshot(ctx, table, asOf[table])
+		if snapErr != nil {
+			return "", snapErr
+		}
+		relation := strings.TrimPrefix(snap.Relation, SnapshotsSchema+".")
+		ctes = append(ctes, fmt.Sprintf("%s AS (SELECT * FROM %s.%s)", quoteIdent(table), SnapshotsSchema,
+			quoteIdent(relation)))
+	}
+	return fmt.Sprintf("WITH %s\nSELECT * FROM (\n%s\n)", strings.Join(ctes, ", "), query), nil
+}
+
+func (s *Server) HandleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snaps, err := s.store.Snapshots(r.Context(), r.PathValue("table"))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle list snapshots", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle list snapshots: writing response", snaps)
+}
+
+// HandleCreateSnapshot snapshots the table in the path, the body optionally names the snapshot.
+func (s *Server) HandleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle create snapshot: decoding request body", err)
+			return
+		}
+	}
+	snap, err := s.store.CreateSnapshot(r.Context(), r.PathValue("table"), req)
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle create snapshot", err)
+	case errors.Is(err, ErrSnapshotExists):
+		s.writeError(w, http.StatusConflict, "handle create snapshot", err)
+	case err != nil:
+		s.writeError(w, http.StatusBadRequest, "handle create snapshot", err)
+	default:
+		s.writeJSON(w, http.StatusCreated, "handle create snapshot: writing response", snap)
+	}
+}
+
+func (s *Server) HandleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DeleteSnapshot(r.Context(), r.PathValue("table"), r.PathValue("snapshot"))
+	if errors.Is(err, ErrSnapshotNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete snapshot", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete snapshot", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type sqlTokenKind int
+
+const (
+	sqlWord sqlTokenKind = iota
+	sqlQuotedIdent
+	sqlString
+	sqlNumber
+	sqlPunct
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// start and end are the byte offsets of the token in the query.
+	start, end int
+}
+
+// upper returns the upper cased text of word tokens and the raw text otherwise.
+func (t sqlToken) upper() string {
+	if t.kind == sqlWord {
+		return strings.ToUpper(t.text)
+	}
+	return t.text
+}
+
+func (t sqlToken) is(kind sqlTokenKind, text string) bool {
+	return t.kind == kind && t.upper() == text
+}
+
+var errUnterminatedSQL = errors.New("unterminated string, identifier or comment")
+
+// lexSQL splits the query into tokens, dropping whitespace and comments. It is only precise enough to classify
+// statements and find identifiers, the query is still parsed by DuckDB.
+//
+//nolint:gocognit,cyclop // A flat scanner is easier to follow than one split across functions.
+func lexSQL(query string) ([]sqlToken, error) {
+	var out []sqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return out, nil
+			}
+			i += end + 1
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, errUnterminatedSQL
+			}
+			i += end + 4
+		case c == '\'' || ((c == 'e' || c == 'E') && i+1 < len(query) && query[i+1] == '\''):
+			start := i
+			if c != '\'' {
+				i++
+			}
+			end, err := scanQuoted(query, i, '\'', c != '\'')
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sqlToken{kind: sqlString, text: query[start:end], start: start, end: end})
+			i = end
+		case c == '"':
+			end, err := scanQuoted(query, i, '"', false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sqlToken{
+				kind:  sqlQuotedIdent,
+				text:  strings.ReplaceAll(query[i+1:end-1], `""`, `"`),
+				start: i,
+				end:   end,
+			})
+			i = end
+		case c == '$':
+			tagEnd := strings.IndexByte(query[i+1:], '$')
+			tag := ""
+			if tagEnd >= 0 {
+				tag = query[i : i+tagEnd+2]
+			}
+			if tag == "" || !isDollarTag(tag[1:len(tag)-1]) {
+				// Positional parameter such as $1.
+				out = append(out, sqlToken{kind: sqlPunct, text: "$", start: i, end: i + 1})
+				i++
+				continue
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				return nil, errUnterminatedSQL
+			}
+			end += i + 2*len(tag)
+			out = append(out, sqlToken{kind: sqlString, text: query[i:end], start: i, end: end})
+			i = end
+		case isWordByte(c) && !isDigit(c):
+			start := i
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			out = append(out, sqlToken{kind: sqlWord, text: query[start:i], start: start, end: i})
+		case isDigit(c):
+			start := i
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '.') {
+				i++
+			}
+			out = append(out, sqlToken{kind: sqlNumber, text: query[start:i], start: start, end: i})
+		default:
+			out = append(out, sqlToken{kind: sqlPunct, text: string(c), start: i, end: i + 1})
+			i++
+		}
+	}
+	return out, nil
+}
+
+// scanQuoted returns the index after the closing quote of the literal starting at start. A doubled quote is an
+// escaped quote, as is a backslash escape in escape string constants.
+func scanQuoted(query string, start int, quote byte, backslash bool) (int, error) {
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case backslash && query[i] == '\\':
+			i++
+		case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+			i++
+		case query[i] == quote:
+			return i + 1, nil
+		}
+	}
+	return 0, errUnterminatedSQL
+}
+
+func isDollarTag(tag string) bool {
+	for i := 0; i < len(tag); i++ {
+		if !isWordByte(tag[i]) || isDigit(tag[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitSQLStatements groups tokens by top level semicolons, dropping empty statements.
+func splitSQLStatements(tokens []sqlToken) [][]sqlToken {
+	var out [][]sqlToken
+	start := 0
+	for i, t := range tokens {
+		if t.is(sqlPunct, ";") {
+			if i > start {
+				out = append(out, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		out = append(out, tokens[start:])
+	}
+	return out
+}
+
+// StatementClass groups statements by their effect on the database.
+type StatementClass string
+
+const (
+	// StatementRead statements only read data.
+	StatementRead StatementClass = "read"
+	// StatementWrite statements modify rows.
+	StatementWrite StatementClass = "write"
+	// StatementDDL statements modify the catalog.
+	StatementDDL StatementClass = "ddl"
+	// StatementAdmin statements change settings, sessions, extensions or attached databases.
+	StatementAdmin StatementClass = "admin"
+)
+
+// ClassifiedStatement is a single statement of a query with its leading keyword, e.g. SELECT or CREATE.
+type ClassifiedStatement struct {
+	Keyword string
+	Class   StatementClass
+	// Text is the statement without surrounding whitespace, comments or the terminating semicolon.
+	Text   string
+	tokens []sqlToken
+}
+
+var statementClasses = map[string]StatementClass{
+	"SELECT":     StatementRead,
+	"VALUES":     StatementRead,
+	"FROM":       StatementRead,
+	"TABLE":      StatementRead,
+	"SHOW":       StatementRead,
+	"DESCRIBE":   StatementRead,
+	"SUMMARIZE":  StatementRead,
+	"PIVOT":      StatementRead,
+	"UNPIVOT":    StatementRead,
+	"INSERT":     StatementWrite,
+	"UPDATE":     StatementWrite,
+	"DELETE":     StatementWrite,
+	"COPY":       StatementWrite,
+	"CREATE":     StatementDDL,
+	"DROP":       StatementDDL,
+	"ALTER":      StatementDDL,
+	"COMMENT":    StatementDDL,
+	"IMPORT":     StatementDDL,
+	"EXPORT":     StatementAdmin,
+	"ATTACH":     StatementAdmin,
+	"DETACH":     StatementAdmin,
+	"INSTALL":    StatementAdmin,
+	"LOAD":       StatementAdmin,
+	"FORCE":      StatementAdmin,
+	"SET":        StatementAdmin,
+	"RESET":      StatementAdmin,
+	"PRAGMA":     StatementAdmin,
+	"CALL":       StatementAdmin,
+	"USE":        StatementAdmin,
+	"CHECKPOINT": StatementAdmin,
+	"VACUUM":     StatementAdmin,
+	"ANALYZE":    StatementAdmin,
+	"BEGIN":      StatementAdmin,
+	"START":      StatementAdmin,
+	"COMMIT":     StatementAdmin,
+	"END":        StatementAdmin,
+	"ROLLBACK":   StatementAdmin,
+	"ABORT":      StatementAdmin,
+	"PREPARE":    StatementAdmin,
+	"EXECUTE":    StatementAdmin,
+	"DEALLOCATE": StatementAdmin,
+}
+
+// ClassifySQL splits the query into statements and classifies each of them. Unknown statements are classified as
+// admin so they are never treated as read-only.
+func ClassifySQL(query string) ([]ClassifiedStatement, error) {
+	tokens, err := lexSQL(query)
+	if err != nil {
+		return nil, fmt.Errorf("classifying sql: %w", err)
+	}
+	stmts := splitSQLStatements(tokens)
+	out := make([]ClassifiedStatement, 0, len(stmts))
+	for _, stmt := range stmts {
+		keyword, class := classifyStatement(stmt)
+		out = append(out, ClassifiedStatement{
+			Keyword: keyword,
+			Class:   class,
+			Text:    query[stmt[0].start:stmt[len(stmt)-1].end],
+			tokens:  stmt,
+		})
+	}
+	return out, nil
+}
+
+func classifyStatement(tokens []sqlToken) (string, StatementClass) {
+	// Leading parentheses wrap set operations, e.g. (SELECT 1) UNION (SELECT 2).
+	for len(tokens) > 0 && tokens[0].is(sqlPunct, "(") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 || tokens[0].kind != sqlWord {
+		return "", StatementAdmin
+	}
+	keyword := tokens[0].upper()
+	switch keyword {
+	case "WITH":
+		// The statement following the common table expressions decides, e.g. WITH t AS (...) DELETE FROM ...
+		depth := 0
+		for _, t := range tokens[1:] {
+			switch {
+			case t.is(sqlPunct, "("):
+				depth++
+			case t.is(sqlPunct, ")"):
+				depth--
+			case depth == 0 && t.kind == sqlWord:
+				if class, ok := statementClasses[t.upper()]; ok && t.upper() != "TABLE" {
+					return t.upper(), class
+				}
+			}
+		}
+		return keyword, StatementAdmin
+	case "EXPLAIN":
+		// EXPLAIN ANALYZE executes the statement, so it inherits its class.
+		if len(tokens) > 1 && tokens[1].is(sqlWord, "ANALYZE") {
+			_, class := classifyStatement(tokens[2:])
+			return keyword, class
+		}
+		return keyword, StatementRead
+	}
+	if class, ok := statementClasses[keyword]; ok {
+		return keyword, class
+	}
+	return keyword, StatementAdmin
+}
+
+// ReadOnlyError is returned when a statement that modifies the database is submitted on a read-only path.
+type ReadOnlyError struct {
+	Keyword string
+	Class   StatementClass
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("read-only query: %s statements (%s) are not allowed", e.Keyword, e.Class)
+}
+
+// unknown reports whether the statement didn't start with a keyword of a statement, which is a syntax error rather
+// than a statement the path doesn't allow.
+func (e *ReadOnlyError) unknown() bool {
+	_, known := statementClasses[e.Keyword]
+	return !known && e.Keyword != "WITH" && e.Keyword != "EXPLAIN"
+}
+
+// CheckReadOnly returns a ReadOnlyError for the first statement of the query that isn't a read.
+func CheckReadOnly(query string) error {
+	stmts, err := ClassifySQL(query)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if stmt.Class != StatementRead {
+			return &ReadOnlyError{Keyword: stmt.Keyword, Class: stmt.Class}
+		}
+	}
+	return nil
+}
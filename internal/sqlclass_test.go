@@ -0,0 +1,48 @@
+package internal_test
+
+import (
+	"scratch/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifySQL(t *testing.T) {
+	for query, expected := range map[string][]internal.StatementClass{
+		"select 1":                                    {internal.StatementRead},
+		"  -- comment\n SELECT * FROM t":              {internal.StatementRead},
+		"(select 1) union (select 2)":                 {internal.StatementRead},
+		"with t as (select 1) select * from t":        {internal.StatementRead},
+		"with t as (select 1) delete from x":          {internal.StatementWrite},
+		"from t":                                      {internal.StatementRead},
+		"explain select 1":                            {internal.StatementRead},
+		"explain analyze insert into t values (1)":    {internal.StatementWrite},
+		"select 'a;drop table t'":                     {internal.StatementRead},
+		`select "drop; table" from t`:                 {internal.StatementRead},
+		"select $$;drop$$; drop table t":              {internal.StatementRead, internal.StatementDDL},
+		"select 1; /* ; */ insert into t values (1);": {internal.StatementRead, internal.StatementWrite},
+		"attach 'x.db'":                               {internal.StatementAdmin},
+		"unknown statement":                           {internal.StatementAdmin},
+	} {
+		stmts, err := internal.ClassifySQL(query)
+		require.NoError(t, err, query)
+		classes := make([]internal.StatementClass, 0, len(stmts))
+		for _, stmt := range stmts {
+			classes = append(classes, stmt.Class)
+		}
+		assert.Equal(t, expected, classes, query)
+	}
+
+	_, err := internal.ClassifySQL("select 'unterminated")
+	require.Error(t, err)
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	require.NoError(t, internal.CheckReadOnly("select 1"))
+
+	var readOnlyErr *internal.ReadOnlyError
+	require.ErrorAs(t, internal.CheckReadOnly("select 1; drop table t"), &readOnlyErr)
+	assert.Equal(t, "DROP", readOnlyErr.Keyword)
+	assert.Equal(t, internal.StatementDDL, readOnlyErr.Class)
+}
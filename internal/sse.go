@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultStreamChunkRows = 500
+	streamProgressInterval = time.Second
+)
+
+// Event names of the query stream.
+const (
+	EventStart    = "start"
+	EventColumns  = "columns"
+	EventProgress = "progress"
+	EventRows     = "rows"
+	EventDone     = "done"
+	EventError    = "error"
+)
+
+// StreamProgress is the payload of the progress and done events.
+type StreamProgress struct {
+	Rows      int   `json:"rows"`
+	ElapsedMS int64 `json:"elapsed_ms"`
+}
+
+// StreamError is the payload of the error event.
+type StreamError struct {
+	Message string `json:"message"`
+}
+
+// HandleQueryStream runs the query and writes it as Server-Sent Events: a start event, progress events while the
+// query executes, a columns event with the result schema, rows events with chunks of the result and a final done or
+// error event. The chunk size is set with the chunk parameter.
+func (s *Server) HandleQueryStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, http.StatusInternalServerError, "handle query stream", errors.New("streaming unsupported"))
+		return
+	}
+	stmt, err := queryStatementFromURL(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle query stream: parsing parameters", err)
+		return
+	}
+	markAudit(r.Context(), AuditQuery, stmt.Query)
+	chunkSize := defaultStreamChunkRows
+	if chunk := r.URL.Query().Get("chunk"); chunk != "" {
+		if chunkSize, err = strconv.Atoi(chunk); err != nil || chunkSize <= 0 {
+			s.writeError(w, http.StatusBadRequest, "handle query stream: parsing chunk", fmt.Errorf("invalid chunk: %s", chunk))
+			return
+		}
+	}
+
+	ctx, cancel, err := s.queryContext(r, stmt)
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	defer cancel()
+	columns := make(chan []Column, 1)
+	rows := make(chan map[string]any, chunkSize)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(rows)
+		_, streamErr := s.store.Stream(ctx, stmt, func(cols []Column) error {
+			columns <- cols
+			return nil
+		}, func(row map[string]any) error {
+			select {
+			case rows <- row:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		errs <- streamErr
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	liftWriteTimeout(w)
+	w.WriteHeader(http.StatusOK)
+
+	start := time.Now()
+	progress := func(count int) StreamProgress {
+		return StreamProgress{Rows: count, ElapsedMS: time.Since(start).Milliseconds()}
+	}
+	writeEvent(w, flusher, EventStart, struct{}{})
+	ticker := time.NewTicker(streamProgressInterval)
+	defer ticker.Stop()
+
+	count := 0
+	chunk := make([]map[string]any, 0, chunkSize)
+	for {
+		select {
+		case cols := <-columns:
+			writeEvent(w, flusher, EventColumns, cols)
+		case row, open := <-rows:
+			if !open {
+				if len(chunk) > 0 {
+					writeEvent(w, flusher, EventRows, chunk)
+				}
+				if streamErr := <-errs; streamErr != nil {
+					writeEvent(w, flusher, EventError, StreamError{Message: streamErr.Error()})
+					return
+				}
+				writeEvent(w, flusher, EventDone, progress(count))
+				return
+			}
+			count++
+			chunk = append(chunk, row)
+			if len(chunk) == chunkSize {
+				writeEvent(w, flusher, EventRows, chunk)
+				chunk = chunk[:0]
+			}
+		case <-ticker.C:
+			writeEvent(w, flusher, EventProgress, progress(count))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// liftWriteTimeout exempts the response from the write timeout of the server, so a stream lasts as long as its query
+// timeout allows. Writers without deadlines, e.g. in tests, have nothing to lift.
+func liftWriteTimeout(w http.ResponseWriter) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data any) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		out, _ = json.Marshal(StreamError{Message: err.Error()})
+		event = EventError
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, out); err != nil {
+		slog.Error("handle query stream: writing event", "err", err)
+		return
+	}
+	flusher.Flush()
+}
@@ -6,9 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math/big"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/marcboeker/go-duckdb" // Underlies database/sql
 )
@@ -21,24 +25,61 @@ const (
 	DOUBLE
 	INTEGER
 	BOOLEAN
+	BIGINT
+	HUGEINT
+	DECIMAL
+	BLOB
+	GEOMETRY
+	ENUM
 )
 
 func (k DataType) DBType() string {
 	return map[DataType]string{
-		INVALID: "",
-		VARCHAR: "VARCHAR",
-		DOUBLE:  "DOUBLE",
-		INTEGER: "INTEGER",
-		BOOLEAN: "BOOLEAN",
+		INVALID:  "",
+		VARCHAR:  "VARCHAR",
+		DOUBLE:   "DOUBLE",
+		INTEGER:  "INTEGER",
+		BOOLEAN:  "BOOLEAN",
+		BIGINT:   "BIGINT",
+		HUGEINT:  "HUGEINT",
+		DECIMAL:  "DECIMAL",
+		BLOB:     "BLOB",
+		GEOMETRY: "GEOMETRY",
+		ENUM:     "ENUM",
 	}[k]
 }
 
+// ParseDataType returns the DataType of the DuckDB type name, INVALID for types ingestion doesn't create. DECIMAL
+// includes its precision and scale, e.g. DECIMAL(18,2). ENUM columns are declared by their values, not by a type name,
+// see ColumnConfig.Enum.
+func ParseDataType(name string) DataType {
+	if isDecimalType(name) {
+		return DECIMAL
+	}
+	for _, k := range []DataType{VARCHAR, DOUBLE, INTEGER, BOOLEAN, BIGINT, HUGEINT, BLOB, GEOMETRY} {
+		if strings.EqualFold(name, k.DBType()) {
+			return k
+		}
+	}
+	return INVALID
+}
+
+// NewDataType returns the DataType of the column created for the value. Ingested integers beyond 2^53 decode as
+// int64 or *big.Int, see exactRows.
 func NewDataType(in any) DataType {
 	switch in.(type) {
 	case float64, float32:
 		return DOUBLE
-	case int, int32, int64:
+	case int, int32:
 		return INTEGER
+	case int64:
+		return BIGINT
+	case *big.Int:
+		return HUGEINT
+	case Decimal:
+		return DECIMAL
+	case []byte:
+		return BLOB
 	case string:
 		return VARCHAR
 	case bool:
@@ -55,96 +96,577 @@ func (k DataType) Valid() bool {
 type Store struct {
 	db        *sql.DB
 	writeLock sync.Mutex
+	limits    Limits
+	database  DatabaseConfig
+	// exportDir is the directory local exports are written to, empty when they are disabled.
+	exportDir string
+	// backupDir is the directory local backups are kept in, empty when they are disabled.
+	backupDir string
+	// ingestLog records every insert for point-in-time recovery, nil when it is disabled.
+	ingestLog *ingestLog
+	// changeFeed records inserts and schema changes for consumers polling them, disabled by default.
+	changeFeed changeFeed
+	tails      tailHub
+	// quotas limit the inserts of tenants, nil when they are disabled. quotaReady is set once TenantUsageTable exists,
+	// guarded by the write lock.
+	quotas     *Quotas
+	quotaReady bool
+	// acls restrict the tables the keys and tokens of requests access, see TableACL.
+	acls []TableACL
+	// tenantColumn is the column of row-level security, empty when it is disabled.
+	tenantColumn string
+	// masks redact columns in the query results of keys and tokens, see ColumnMask.
+	masks []ColumnMask
+	// sqlPolicy is the firewall of the SQL of requests, nil when it is disabled.
+	sqlPolicy *SQLPolicy
+	// audit records the queries and ingests of the API, nil when it is disabled.
+	audit *auditLog
+	// deltaLock serializes the commits of Delta exports, which number their versions by listing the log.
+	deltaLock sync.Mutex
+	// settingsLock guards the limits, quotas and retentions changed by Reload from the readers not holding the write
+	// lock.
+	settingsLock sync.RWMutex
+	// memoryLimit is the DuckDB memory limit in bytes, zero when DuckDB's default applies.
+	memoryLimit int64
+	search      searchIndexes
+	columns     columnHistory
+	configs     tableConfigs
+	ingest      *ingestStats
+	// writeHooks are called with the table of every insert and import while the write lock is held.
+	writeHooks []func(table string)
+	// schemaHooks are called with the schema events of inserts while the write lock is held.
+	schemaHooks []func(SchemaEvent)
+	// generation is incremented on every write, results read at an older generation may be stale.
+	generation atomic.Int64
+	// writer is the connection of inserts and the schema changes they make, reserved from the pool.
+	writer *sql.Conn
+	// inserts are the prepared INSERT statements of the tables, on writer.
+	inserts *preparedInserts
+	// cluster replicates inserts and SQL writes through its log, nil unless the store is a cluster node.
+	cluster *Cluster
+}
+
+type StoreOption func(*Store)
+
+func WithLimits(limits Limits) StoreOption {
+	return func(s *Store) {
+		s.limits = limits
+	}
 }
 
-func NewDuckDBStore() (*Store, error) {
-	db, err := sql.Open("duckdb", "?access_mode=READ_WRITE")
+func NewDuckDBStore(opts ...StoreOption) (*Store, error) {
+	s := &Store{
+		search:  searchIndexes{byTable: make(map[string]SearchIndex)},
+		columns: newColumnHistory(),
+		configs: tableConfigs{byTable: make(map[string]TableConfig)},
+		inserts: newPreparedInserts(),
+		ingest:  newIngestStats(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.database.valid(); err != nil {
+		return nil, err
+	}
+	db, err := s.database.open()
 	if err != nil {
 		return nil, fmt.Errorf("opening duckdb: %w", err)
 	}
-	return &Store{db: db}, nil
+	s.db = db
+	s.database.tune(db)
+	// Inserts keep a connection of their own, so queries holding every other connection of the pool don't stall them.
+	if s.writer, err = db.Conn(context.Background()); err != nil {
+		return nil, errors.Join(fmt.Errorf("opening duckdb: %w", err), db.Close())
+	}
+	if err = s.applyMemoryLimit(context.Background()); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	if err = s.database.loadExtensions(context.Background(), db); err != nil {
+		return nil, errors.Join(fmt.Errorf("opening duckdb: %w", err), db.Close())
+	}
+	if s.ingestLog != nil {
+		if err = s.ingestLog.open(); err != nil {
+			return nil, errors.Join(err, db.Close())
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) Limits() Limits {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.limits
 }
 
+// Generation identifies the state of the data. It changes whenever the store writes.
+func (s *Store) Generation() int64 {
+	return s.generation.Load()
+}
+
+// Close waits for the running write, checkpoints a database file so its write-ahead log doesn't need to be replayed on
+// the next start and closes the database and the ingest log.
 func (s *Store) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	var checkpointErr error
+	if s.database.Path != "" && !s.database.ReadOnly {
+		if _, err := s.db.ExecContext(context.Background(), "CHECKPOINT"); err != nil {
+			checkpointErr = fmt.Errorf("checkpointing database: %w", err)
+		}
+	}
+	if s.ingestLog != nil {
+		checkpointErr = errors.Join(checkpointErr, s.ingestLog.close())
+	}
+	s.inserts.close()
+	if err := s.writer.Close(); err != nil {
+		checkpointErr = errors.Join(checkpointErr, fmt.Errorf("closing write connection: %w", err))
+	}
 	if err := s.db.Close(); err != nil {
-		return fmt.Errorf("closing database: %w", err)
+		return errors.Join(checkpointErr, fmt.Errorf("closing database: %w", err))
 	}
-	return nil
+	return checkpointErr
 }
 
 func (s *Store) Query(ctx context.Context, stmt *QueryStatement) ([]map[string]any, error) {
-	if err := stmt.Valid(); err != nil {
+	res, err := s.Fetch(ctx, stmt)
+	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.QueryContext(ctx, stmt.Query)
+	return res.Rows, nil
+}
+
+type QueryResult struct {
+	// Columns are in the order of the select list.
+	Columns []Column
+	Rows    []map[string]any
+	Elapsed time.Duration
+	// NextCursor is set when the statement was paginated and more rows are available.
+	NextCursor string
+	// Profile is set when the statement was run with Profile.
+	Profile *QueryProfile
+	// Truncated is set when rows were dropped to stay within MaxRows or a response size limit.
+	Truncated bool
+}
+
+// fetchRowsHint caps the rows allocated for a result before they are scanned, past it the rows grow as needed.
+const fetchRowsHint = 1 << 10
+
+// errEnoughRows stops a scan once MaxRows is exceeded.
+var errEnoughRows = errors.New("enough rows")
+
+// querier is implemented by both the pool and a single connection.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Fetch runs the statement and returns the requested page of rows along with a cursor for the next page.
+func (s *Store) Fetch(ctx context.Context, stmt *QueryStatement) (*QueryResult, error) {
+	if s.replicated(stmt) {
+		if stmt.Profile {
+			return nil, errors.New("cluster: writes can't be profiled")
+		}
+		results, err := s.cluster.fetch(ctx, []*QueryStatement{stmt}, false)
+		if err != nil {
+			return nil, err
+		}
+		return results[0], nil
+	}
+	if stmt != nil && stmt.Profile {
+		return s.fetchProfiled(ctx, stmt)
+	}
+	return s.fetch(ctx, s.db, stmt)
+}
+
+func (s *Store) fetch(ctx context.Context, q querier, stmt *QueryStatement) (*QueryResult, error) {
+	stmt, err := s.checkQuery(ctx, stmt)
 	if err != nil {
-		return nil, fmt.Errorf("query: %w", err)
+		return nil, err
+	}
+	query, params, cursor, err := stmt.page()
+	if err != nil {
+		return nil, err
+	}
+	if stmt.AllowWrites {
+		defer s.generation.Add(1)
+	}
+	start := time.Now()
+	// The page size or row limit bounds the result, up to fetchRowsHint it is allocated at once. Empty results keep
+	// nil rows.
+	hint := stmt.MaxRows
+	if cursor != nil {
+		hint = cursor.Limit + 1
+	}
+	var (
+		out       []map[string]any
+		truncated bool
+	)
+	cols, err := s.each(ctx, q, query, params, false, nil, func(row map[string]any) error {
+		if stmt.MaxRows > 0 && len(out) == stmt.MaxRows {
+			truncated = true
+			return errEnoughRows
+		}
+		if out == nil && hint > 0 {
+			out = make([]map[string]any, 0, min(hint, fetchRowsHint))
+		}
+		out = append(out, row)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errEnoughRows) {
+		return nil, err
+	}
+
+	res := &QueryResult{Columns: cols, Rows: out, Elapsed: time.Since(start), Truncated: truncated}
+	if cursor != nil && len(out) > cursor.Limit {
+		res.Rows = out[:cursor.Limit]
+		cursor.Offset += cursor.Limit
+		res.NextCursor = cursor.encode()
+	}
+	return res, nil
+}
+
+// Stream runs the statement and calls onColumns once the result columns are known and fn for each row as it is
+// scanned, without holding on to the rows. An error returned by either stops the scan and is returned as is. A Limit
+// on the statement is applied, but no cursor is issued, and MaxRows stops the scan and marks the result truncated. The
+// result carries no rows.
+func (s *Store) Stream(
+	ctx context.Context,
+	stmt *QueryStatement,
+	onColumns func(cols []Column) error,
+	fn func(row map[string]any) error,
+) (*QueryResult, error) {
+	return s.stream(ctx, stmt, false, onColumns, fn)
+}
+
+// stream is Stream, passing the same map to every call of fn when reuse is set, for callers done with a row once fn
+// returns.
+func (s *Store) stream(
+	ctx context.Context,
+	stmt *QueryStatement,
+	reuse bool,
+	onColumns func(cols []Column) error,
+	fn func(row map[string]any) error,
+) (*QueryResult, error) {
+	if s.replicated(stmt) {
+		return s.streamCluster(ctx, stmt, onColumns, fn)
+	}
+	stmt, err := s.checkQuery(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	query, params, cursor, err := stmt.page()
+	if err != nil {
+		return nil, err
+	}
+	if stmt.AllowWrites {
+		defer s.generation.Add(1)
+	}
+	start := time.Now()
+	count, truncated := 0, false
+	cols, err := s.each(ctx, s.db, query, params, reuse, onColumns, func(row map[string]any) error {
+		count++
+		if cursor != nil && count > cursor.Limit {
+			return nil
+		}
+		if stmt.MaxRows > 0 && count > stmt.MaxRows {
+			truncated = true
+			return errEnoughRows
+		}
+		return fn(row)
+	})
+	if err != nil && !errors.Is(err, errEnoughRows) {
+		return nil, err
+	}
+	return &QueryResult{Columns: cols, Elapsed: time.Since(start), Truncated: truncated}, nil
+}
+
+// Column describes a column of a query result.
+type Column struct {
+	Name string `json:"name"`
+	// Type is the DuckDB type name, e.g. BIGINT or DECIMAL(18,3).
+	Type string `json:"type"`
+}
+
+func resultColumns(rows *sql.Rows) ([]Column, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("Query response ColumnTypes: %w", err)
+	}
+	out := make([]Column, 0, len(types))
+	for _, t := range types {
+		out = append(out, Column{Name: t.Name(), Type: t.DatabaseTypeName()})
+	}
+	return out, nil
+}
+
+// each scans the rows of the query into maps keyed by column name and returns the columns in order. onColumns is
+// optional and called before the first row. With reuse, every row is scanned into the same map.
+func (s *Store) each(
+	ctx context.Context,
+	q querier,
+	query string,
+	params []any,
+	reuse bool,
+	onColumns func(cols []Column) error,
+	fn func(row map[string]any) error,
+) ([]Column, error) {
+	rows, err := q.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", s.memoryError(err))
 	}
 	defer func() {
 		if closeErr := rows.Close(); closeErr != nil {
-			slog.Error("closing rows: %w", closeErr)
+			slog.Error("closing rows", "err", closeErr)
 		}
 	}()
-	cols, err := rows.Columns()
+	cols, err := resultColumns(rows)
 	if err != nil {
-		return nil, fmt.Errorf("Query response Columns: %w", err)
+		return nil, err
 	}
-	// TODO: Find a way to estimate the size of the result set to reduce gc overhead.
-	var out []map[string]any
-	for rows.Next() {
-		columns := make([]any, len(cols))
-		// TODO: Reuse this pointer array to avoid individual allocation for synchronous process.
-		columnPointers := make([]any, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
+	if onColumns != nil {
+		if err = onColumns(cols); err != nil {
+			return nil, err
 		}
-
+	}
+	// Scan copies the values out of the driver, so the destinations serve every row.
+	columns := make([]any, len(cols))
+	columnPointers := make([]any, len(cols))
+	for i := range columns {
+		columnPointers[i] = &columns[i]
+	}
+	var m map[string]any
+	for rows.Next() {
 		if err = rows.Scan(columnPointers...); err != nil {
 			return nil, fmt.Errorf("scanning column: %w", err)
 		}
-
-		m := make(map[string]any)
-		for i, colName := range cols {
-			val, _ := columnPointers[i].(*any)
-			m[colName] = *val
+		if m == nil || !reuse {
+			m = make(map[string]any, len(cols))
+		}
+		for i, col := range cols {
+			m[col.Name] = scannedValue(columns[i])
+		}
+		if err = fn(m); err != nil {
+			return cols, err
 		}
-		out = append(out, m)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("flushing rows: %w", err)
+		return nil, fmt.Errorf("flushing rows: %w", s.memoryError(err))
 	}
-
-	return out, nil
+	return cols, nil
 }
 
+// Insert writes the statement, through the log of the cluster on a cluster node.
 func (s *Store) Insert(ctx context.Context, stmt *InsertStatement) error {
+	if s.cluster != nil {
+		return s.cluster.insert(ctx, stmt)
+	}
+	return s.applyInsert(ctx, stmt)
+}
+
+// applyInsert is Insert on this store only.
+func (s *Store) applyInsert(ctx context.Context, stmt *InsertStatement) error {
 	s.writeLock.Lock()
 	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	started := time.Now()
+	var sample ingestSample
+	err := s.insert(ctx, stmt, s.ingestLog, &sample)
+	// Statements refused for their table name aren't accounted to any table.
+	if tableNameRegex.MatchString(stmt.Table) {
+		s.ingest.record(stmt.Table, sample, time.Since(started), err != nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.written(stmt.Table)
+	return nil
+}
+
+// onWrite registers fn to be called with the table of every insert and import. It must not block or write to the
+// store.
+func (s *Store) onWrite(fn func(table string)) {
+	s.writeHooks = append(s.writeHooks, fn)
+}
+
+// written calls the write hooks for the table. The caller holds the write lock.
+func (s *Store) written(table string) {
+	for _, fn := range s.writeHooks {
+		fn(table)
+	}
+}
 
-	query, values, err := stmt.Query()
+// onSchemaEvent registers fn to be called with the tables and columns ingestion creates and the type conflicts it
+// refuses. It must not block or write to the store.
+func (s *Store) onSchemaEvent(fn func(SchemaEvent)) {
+	s.schemaHooks = append(s.schemaHooks, fn)
+}
+
+// schemaEvent calls the schema hooks with the event. The caller holds the write lock.
+func (s *Store) schemaEvent(e SchemaEvent) {
+	for _, fn := range s.schemaHooks {
+		fn(e)
+	}
+}
+
+// insert writes the statement, appending it to the log first unless the log is nil, and adds what it wrote to the
+// sample unless it is nil. The caller holds the write lock.
+func (s *Store) insert(ctx context.Context, stmt *InsertStatement, log *ingestLog, sample *ingestSample) error {
+	stmt, cfg, chunks, err := s.prepareInsert(ctx, stmt)
 	if err != nil {
 		return err
 	}
+	if err = s.checkQuota(ctx, stmt); err != nil {
+		return err
+	}
+	if err = s.syncEnums(ctx, stmt, cfg); err != nil {
+		return err
+	}
+	if log != nil {
+		if err = log.append(stmt); err != nil {
+			return err
+		}
+	}
 
+	// The chunks are committed together. A chunk failing for a missing table or column rolls the statement back, the
+	// schema is synced against the whole statement outside of the transaction, and the statement is inserted again.
+	schemaChanges := len(s.columns.history(stmt.Table))
 	for {
-		_, insertErr := s.db.ExecContext(ctx, query, values...)
-		if insertErr == nil {
+		retry, insertErr := s.insertChunks(ctx, stmt, chunks, schemaChanges)
+		if insertErr != nil {
+			return insertErr
+		}
+		if !retry {
 			break
 		}
-		handledErr := s.handleInsertError(ctx, stmt, insertErr)
-		if handledErr != nil {
-			return handledErr
+		if sample != nil {
+			sample.retries++
+		}
+	}
+	for _, chunk := range chunks {
+		s.tails.publish(stmt.Table, chunk.rows())
+		if sample != nil {
+			sample.rows += len(chunk.rows())
+			// Rows that don't encode are refused by the insert, they can't be left to measure.
+			n, _ := rowBytes(chunk.rows())
+			sample.bytes += n
 		}
 	}
-
 	return nil
 }
 
+// prepareInsert runs the checks of an insert that don't depend on other inserts and decodes its values. It returns
+// the statement stamped with the tenant of the request, the configuration of its table and its chunks. Inserts and
+// their previews both go through it.
+func (s *Store) prepareInsert(
+	ctx context.Context, stmt *InsertStatement,
+) (*InsertStatement, TableConfig, []*InsertStatement, error) {
+	// Names are quoted in the statements, validating them here covers the callers besides the API too.
+	if err := stmt.Validate(); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	if s.audit != nil && strings.EqualFold(stmt.Table, AuditTable) {
+		return nil, TableConfig{}, nil, fmt.Errorf("%w: %s is only written by the server", ErrInvalidInsert, AuditTable)
+	}
+	stmt = s.stampTenant(ctx, stmt)
+	if err := s.limits.CheckCells(stmt); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	if err := s.checkSchemaPolicy(ctx, stmt); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	cfg := s.configs.get(stmt.Table)
+	if err := stmt.checkGenerated(cfg); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	if err := stmt.decodeBlobs(cfg); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	if err := stmt.decodeGeometries(cfg); err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	chunks, err := stmt.Chunks(s.limits)
+	if err != nil {
+		return nil, TableConfig{}, nil, err
+	}
+	return stmt, cfg, chunks, nil
+}
+
+// insertChunks inserts the chunks of the statement in one transaction on the writer, along with their change feed
+// entries and usage. The schema changes since schemaChanges are recorded with the first chunk. It reports whether
+// the statement has to be inserted again because it synced the schema after a chunk failed.
+func (s *Store) insertChunks(
+	ctx context.Context, stmt *InsertStatement, chunks []*InsertStatement, schemaChanges int,
+) (bool, error) {
+	if _, err := s.writer.ExecContext(ctx, "BEGIN TRANSACTION"); err != nil {
+		return false, fmt.Errorf("inserting values: beginning transaction: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			s.rollbackInsert(ctx)
+		}
+	}()
+	for _, chunk := range chunks {
+		query, values, err := chunk.Query()
+		if err != nil {
+			return false, err
+		}
+		if err = s.inserts.exec(ctx, s.writer, stmt.Table, query, values); err != nil {
+			s.rollbackInsert(ctx)
+			committed = true
+			if err = s.handleInsertError(ctx, stmt, err); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		history := s.columns.history(stmt.Table)
+		if err = s.recordChanges(ctx, history[schemaChanges:], chunk); err != nil {
+			return false, err
+		}
+		schemaChanges = len(history)
+		if err = s.recordUsage(ctx, chunk); err != nil {
+			return false, err
+		}
+	}
+	if err := recordClusterIndex(ctx, s.writer); err != nil {
+		return false, err
+	}
+	if _, err := s.writer.ExecContext(ctx, "COMMIT"); err != nil {
+		return false, fmt.Errorf("inserting values: committing: %w", err)
+	}
+	committed = true
+	return false, nil
+}
+
+// rollbackInsert rolls back the transaction of insertChunks, even if the context is done. The tables of the change
+// feed and the usage, which it may have created, are checked again by the next insert.
+func (s *Store) rollbackInsert(ctx context.Context) {
+	if _, err := s.writer.ExecContext(context.WithoutCancel(ctx), "ROLLBACK"); err != nil {
+		slog.Error("rolling back insert", "err", err)
+	}
+	s.changeFeed.ready = false
+	s.quotaReady = false
+}
+
 var missingTableRegex = regexp.MustCompile(
-	`Catalog Error: Table with name [a-zA-Z_]+ does not exist!`,
+	`Catalog Error: Table with name [a-zA-Z0-9_]+ does not exist!`,
 )
 var missingColumnRegex = regexp.MustCompile(
-	`Binder Error: Table "[a-zA-Z_]+" does not have a column with name "([a-zA-Z_]+)"`,
+	`Binder Error: Table "[a-zA-Z0-9_]+" does not have a column with name "([a-zA-Z0-9_]+)"`,
+)
+
+var (
+	// ErrConstraintViolation is returned when an insert violates a NOT NULL, UNIQUE or CHECK constraint of the table.
+	ErrConstraintViolation = errors.New("constraint violation")
+	// ErrGeneratedColumn is returned when an insert carries a column the table configuration declares as generated or
+	// auto-increment.
+	ErrGeneratedColumn = errors.New("generated column can't be inserted")
+	// ErrConstrainedColumn is returned when an insert carries a column the table lacks that the table configuration
+	// declares constraints for.
+	ErrConstrainedColumn = errors.New("constrained column can't be added")
+	// ErrTypeConflict is returned when an insert carries a value that doesn't convert to the type of its column.
+	ErrTypeConflict = errors.New("type conflict")
+	// ErrInvalidInsert is returned for an InsertStatement that fails validation.
+	ErrInvalidInsert = errors.New("invalid InsertStatement")
 )
 
 // handleInsertError is the mechanism for syncing the given schema from the InsertStatement with the sql catalog.
@@ -156,110 +678,458 @@ func (s *Store) handleInsertError(ctx context.Context, stmt *InsertStatement, er
 		return s.CreateTable(ctx, stmt)
 	}
 	if missingColumnRegex.MatchString(err.Error()) {
-		matches := missingColumnRegex.FindStringSubmatch(err.Error())
-		return s.AddColumn(ctx, stmt, matches[1])
+		return s.addMissingColumns(ctx, stmt)
+	}
+	if strings.HasPrefix(err.Error(), "Constraint Error") {
+		return fmt.Errorf("inserting values: %w: %w", ErrConstraintViolation, err)
+	}
+	if strings.HasPrefix(err.Error(), "Conversion Error") || strings.HasPrefix(err.Error(), "Mismatch Type Error") {
+		s.schemaEvent(SchemaEvent{
+			Kind:      SchemaEventTypeConflict,
+			Table:     stmt.Table,
+			Error:     err.Error(),
+			RequestID: stmt.RequestID,
+			At:        time.Now(),
+		})
+		return fmt.Errorf("inserting values: %w: %w", ErrTypeConflict, err)
 	}
 	return fmt.Errorf("inserting values: %w", err)
 }
 
+// addMissingColumns diffs the statement against the table catalog so the column limits can be checked against the
+// whole change before any of it is applied.
+func (s *Store) addMissingColumns(ctx context.Context, stmt *InsertStatement) error {
+	existing, err := s.tableColumnsOn(ctx, s.writer, stmt.Table)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, name := range stmt.columnNames() {
+		if !existing[strings.ToLower(name)] {
+			missing = append(missing, name)
+		}
+	}
+	if err = s.limits.CheckNewColumns(stmt.Table, len(existing), missing); err != nil {
+		return err
+	}
+	before := len(s.columns.history(stmt.Table))
+	for _, name := range missing {
+		if err = s.AddColumn(ctx, stmt, name); err != nil {
+			break
+		}
+	}
+	if added := s.columns.history(stmt.Table)[before:]; len(added) > 0 {
+		s.schemaEvent(SchemaEvent{
+			Kind:      SchemaEventColumnsAdded,
+			Table:     stmt.Table,
+			Columns:   added,
+			RequestID: stmt.RequestID,
+			At:        added[len(added)-1].At,
+		})
+	}
+	return err
+}
+
+// tableColumns returns the lower cased column names of the table, matching the case-insensitivity of the catalog.
+func (s *Store) tableColumns(ctx context.Context, table string) (map[string]bool, error) {
+	return s.tableColumnsOn(ctx, s.db, table)
+}
+
+// tableColumnsOn is tableColumns on a connection of the caller's choice.
+func (s *Store) tableColumnsOn(ctx context.Context, q querier, table string) (map[string]bool, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		"SELECT column_name FROM information_schema.columns WHERE table_catalog IN "+ownCatalogs+
+			" AND lower(table_name) = lower(?)",
+		table,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scanning column name: %w", err)
+		}
+		out[strings.ToLower(name)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing column names: %w", err)
+	}
+	return out, nil
+}
+
+// CreateTable creates the table with the columns of the statement and the columns declared with a type or generated
+// in the table configuration, along with their defaults and constraints, where the configuration places it.
 func (s *Store) CreateTable(ctx context.Context, stmt *InsertStatement) error {
-	query, err := stmt.CreateTableQueryString()
+	cfg := s.configs.get(stmt.Table)
+	names := stmt.tableColumnNames(cfg)
+	if err := s.limits.CheckTableColumns(stmt.Table, 0, names); err != nil {
+		return err
+	}
+	query, err := stmt.createTableQuery(cfg, s.tablePrefix(cfg))
 	if err != nil {
 		return err
 	}
-	if _, err = s.db.ExecContext(ctx, query); err != nil {
+	for _, seq := range stmt.sequenceQueries(cfg, s.tablePrefix(cfg)) {
+		if _, err = s.writer.ExecContext(ctx, seq); err != nil {
+			return fmt.Errorf("creating sequence: %w", err)
+		}
+	}
+	if _, err = s.writer.ExecContext(ctx, query); err != nil {
 		return fmt.Errorf("creating Table: %w", err)
 	}
+	now := time.Now()
+	changes := make([]SchemaChange, 0, len(names))
+	for _, name := range names {
+		dataType, _ := stmt.columnType(name, cfg)
+		changes = append(changes, SchemaChange{
+			Kind:      SchemaCreateTable,
+			Table:     stmt.Table,
+			Column:    name,
+			Type:      dataType,
+			RequestID: stmt.RequestID,
+			At:        now,
+		})
+	}
+	s.columns.created(stmt.Table, changes)
+	s.inserts.invalidate(stmt.Table)
+	s.schemaEvent(SchemaEvent{
+		Kind:      SchemaEventTableCreated,
+		Table:     stmt.Table,
+		Columns:   changes,
+		RequestID: stmt.RequestID,
+		At:        now,
+	})
 	return nil
 }
 
+// tablePrefix returns the prefix of the name tables of the configuration are created with, see createTableQuery.
+func (s *Store) tablePrefix(cfg TableConfig) string {
+	if cfg.Placement == PlacementMemory && s.database.Path != "" {
+		// The search path of the connections resolves the unqualified name to the in-memory database from now on.
+		return quoteIdent(memoryDatabase) + ".main."
+	}
+	return ""
+}
+
 func (s *Store) AddColumn(ctx context.Context, stmt *InsertStatement, name string) error {
-	query, err := stmt.AddColumnQueryString(name)
+	cfg := s.configs.get(stmt.Table)
+	query, err := stmt.AddColumnQueryString(name, cfg)
 	if err != nil {
 		return err
 	}
-	if _, err = s.db.ExecContext(ctx, query); err != nil {
+	if _, err = s.writer.ExecContext(ctx, query); err != nil {
 		return fmt.Errorf("creating Table: %w", err)
 	}
+	s.inserts.invalidate(stmt.Table)
+	dataType, _ := stmt.columnType(name, cfg)
+	s.columns.added(SchemaChange{
+		Kind:      SchemaAddColumn,
+		Table:     stmt.Table,
+		Column:    name,
+		Type:      dataType,
+		RequestID: stmt.RequestID,
+		At:        time.Now(),
+	})
 	return nil
 }
 
+// InsertStatement holds either a single row in Columns or a batch in Rows. Rows in a batch may have differing keys,
+// missing values are inserted as NULL.
 type InsertStatement struct {
 	Table   string
 	Columns map[string]any
+	Rows    []map[string]any
+	// RequestID identifies the request the statement came from in the schema history.
+	RequestID string
+}
+
+// rows normalizes the statement to a list of rows.
+func (s *InsertStatement) rows() []map[string]any {
+	if len(s.Rows) > 0 {
+		return s.Rows
+	}
+	return []map[string]any{s.Columns}
+}
+
+// columnValues merges the rows into a map of column name to its first non-nil value, which is used for inferring
+// the column type.
+func (s *InsertStatement) columnValues() map[string]any {
+	if len(s.Rows) == 0 {
+		return s.Columns
+	}
+	out := make(map[string]any)
+	for _, row := range s.Rows {
+		for k, v := range row {
+			if out[k] == nil {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+// columnNames returns the column names of the statement in a stable order.
+func (s *InsertStatement) columnNames() []string {
+	values := s.columnValues()
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tableColumnNames returns the columns of the statement followed by the columns declared with a type or generated in
+// the table configuration that the statement lacks.
+func (s *InsertStatement) tableColumnNames(cfg TableConfig) []string {
+	names := s.columnNames()
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[strings.ToLower(name)] = true
+	}
+	for _, c := range cfg.Columns {
+		if (c.Type != "" || c.Generated != "" || len(c.Enum) > 0 || c.AutoIncrement) && !present[strings.ToLower(c.Name)] {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// checkGenerated refuses the statement if it carries a column the table configuration declares as generated or
+// auto-increment.
+func (s *InsertStatement) checkGenerated(cfg TableConfig) error {
+	for _, name := range s.columnNames() {
+		if c, ok := cfg.column(name); ok && (c.Generated != "" || c.AutoIncrement) {
+			return fmt.Errorf("%w: %s", ErrGeneratedColumn, name)
+		}
+	}
+	return nil
+}
+
+// columnType returns the type declared for the column in the table configuration, including enums, or else the type
+// inferred from its first value. It is empty for generated columns without a declared type, DuckDB infers their type
+// from the expression.
+func (s *InsertStatement) columnType(name string, cfg TableConfig) (string, error) {
+	c, declared := cfg.column(name)
+	if declared && len(c.Enum) > 0 {
+		return s.enumColumnType(c)
+	}
+	if declared && c.AutoIncrement && c.Type == "" {
+		return BIGINT.DBType(), nil
+	}
+	if declared && (c.Type != "" || c.Generated != "") {
+		return c.Type, nil
+	}
+	if cfg.DecimalStrings {
+		if dataType, ok := s.decimalType(name); ok {
+			return dataType, nil
+		}
+	}
+	v := s.columnValues()[name]
+	kind := NewDataType(v)
+	if !kind.Valid() {
+		return "", fmt.Errorf("invalid data type for column (%s): %T", name, v)
+	}
+	return kind.DBType(), nil
 }
 
-func (s *InsertStatement) CreateTableQueryString() (string, error) {
-	cols := make([]string, 0, len(s.Columns))
-	for k, v := range s.Columns {
-		kind := NewDataType(v)
-		if !kind.Valid() {
-			return "", fmt.Errorf("create Table: invalid data type for column (%s): %T", k, v)
+// CreateTableQueryString creates the table with the constraints of the columns declared in the table configuration.
+func (s *InsertStatement) CreateTableQueryString(cfg TableConfig) (string, error) {
+	return s.createTableQuery(cfg, "")
+}
+
+// createTableQuery is CreateTableQueryString with the table name qualified by the quoted database and schema prefix,
+// e.g. "ephemeral".main., if it is set.
+func (s *InsertStatement) createTableQuery(cfg TableConfig, prefix string) (string, error) {
+	names := s.tableColumnNames(cfg)
+	cols := make([]string, 0, len(names))
+	for _, k := range names {
+		dataType, err := s.columnType(k, cfg)
+		if err != nil {
+			return "", fmt.Errorf("create Table: %w", err)
 		}
-		cols = append(cols, fmt.Sprintf("%s %s", k, kind.DBType()))
+		def := strings.TrimSpace(quoteIdent(k) + " " + dataType)
+		c, ok := cfg.column(k)
+		switch {
+		case ok && c.Generated != "":
+			def += " AS (" + c.Generated + ")"
+		case ok && c.AutoIncrement:
+			def += " DEFAULT nextval(" + quoteLiteral(prefix+quoteIdent(sequenceName(s.Table, c.Name))) + ")" +
+				c.constraints()
+		case ok:
+			def += c.defaultClause() + c.constraints()
+		}
+		cols = append(cols, def)
 	}
 	return fmt.Sprintf(
-		"CREATE TABLE IF NOT EXISTS %s(%s)",
-		s.Table,
+		"CREATE TABLE IF NOT EXISTS %s%s(%s)",
+		prefix,
+		quoteIdent(s.Table),
 		strings.Join(cols, ", "),
 	), nil
 }
 
-func (s *InsertStatement) AddColumnQueryString(name string) (string, error) {
-	value, ok := s.Columns[name]
-	if !ok {
+// sequenceQueries returns the statements creating the sequences of the auto-increment columns the table is created
+// with, qualified by the prefix like createTableQuery.
+func (s *InsertStatement) sequenceQueries(cfg TableConfig, prefix string) []string {
+	var out []string
+	for _, name := range s.tableColumnNames(cfg) {
+		if c, ok := cfg.column(name); ok && c.AutoIncrement {
+			out = append(out, "CREATE SEQUENCE IF NOT EXISTS "+prefix+quoteIdent(sequenceName(s.Table, c.Name)))
+		}
+	}
+	return out
+}
+
+// AddColumnQueryString adds the column with the type and default declared in the table configuration or else the
+// inferred type. DuckDB doesn't add columns with constraints, a column with constraints in the configuration has to be
+// created with the table.
+func (s *InsertStatement) AddColumnQueryString(name string, cfg TableConfig) (string, error) {
+	if _, ok := s.columnValues()[name]; !ok {
 		return "", fmt.Errorf("add column: column not present in InsertStatement: %s", name)
 	}
-	kind := NewDataType(value)
-	if !kind.Valid() {
-		return "", fmt.Errorf("add column: invalid data type for column (%s): %T", name, value)
+	c, _ := cfg.column(name)
+	if c.Generated != "" || c.AutoIncrement {
+		return "", fmt.Errorf("add column: %w: %s is only created with the table", ErrGeneratedColumn, name)
+	}
+	if c.constraints() != "" {
+		return "", fmt.Errorf(
+			"add column: %w: %s has constraints, which only apply on table creation: declare its type in the table "+
+				"configuration", ErrConstrainedColumn, name,
+		)
+	}
+	dataType, err := s.columnType(name, cfg)
+	if err != nil {
+		return "", fmt.Errorf("add column: %w", err)
 	}
 
 	return fmt.Sprintf(
-		"ALTER TABLE %s ADD COLUMN %s %s",
-		s.Table,
-		name,
-		kind.DBType(),
+		"ALTER TABLE %s ADD COLUMN %s %s%s",
+		quoteIdent(s.Table),
+		quoteIdent(name),
+		dataType,
+		c.defaultClause(),
 	), nil
 }
 
 func (s *InsertStatement) Validate() error {
 	if s == nil {
-		return errors.New("invalid InsertStatement: nil")
+		return fmt.Errorf("%w: nil", ErrInvalidInsert)
 	}
 
-	// TODO: validate Table name to have no spaces, etc.
 	if s.Table == "" {
-		return errors.New("invalid InsertStatement: missing Table name")
+		return fmt.Errorf("%w: missing Table name", ErrInvalidInsert)
+	}
+	if !tableNameRegex.MatchString(s.Table) {
+		return fmt.Errorf("%w: table name %q must match %s", ErrInvalidInsert, s.Table, tableNameRegex)
 	}
 
-	if len(s.Columns) == 0 {
-		return errors.New("invalid InsertStatement: no Columns")
+	for i, row := range s.rows() {
+		if len(row) == 0 {
+			return fmt.Errorf("%w: no Columns in row %d", ErrInvalidInsert, i)
+		}
+	}
+	for _, name := range s.columnNames() {
+		if !tableNameRegex.MatchString(name) {
+			return fmt.Errorf("%w: column name %q must match %s", ErrInvalidInsert, name, tableNameRegex)
+		}
 	}
-	// TODO: Consider validating column names for sql acceptance.
 	return nil
 }
 
+// Query generates a single INSERT with one VALUES list per row. The column list is the union of all row keys, a row
+// lacking one of them stores the column default.
 func (s *InsertStatement) Query() (string, []any, error) {
-	keys := make([]string, 0, len(s.Columns))
-	values := make([]any, 0, len(s.Columns))
-	placeholders := make([]string, 0, len(s.Columns))
-	for k, v := range s.Columns {
-		keys = append(keys, k)
-		values = append(values, v)
-		placeholders = append(placeholders, "?")
+	keys := s.columnNames()
+	rows := s.rows()
+	values := make([]any, 0, len(keys)*len(rows))
+	tuples := make([]string, 0, len(rows))
+	placeholders := make([]string, len(keys))
+	for _, row := range rows {
+		for i, k := range keys {
+			v, ok := row[k]
+			if !ok {
+				placeholders[i] = "DEFAULT"
+				continue
+			}
+			placeholders[i] = "?"
+			if n, ok := v.(*big.Int); ok {
+				// DuckDB casts the decimal text to the type of the column.
+				v = n.String()
+			}
+			values = append(values, v)
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
 	}
 
+	cols := make([]string, len(keys))
+	for i, k := range keys {
+		cols[i] = quoteIdent(k)
+	}
 	return fmt.Sprintf(
-		"INSERT INTO %s (%s) VALUES (%s)",
-		s.Table,
-		strings.Join(keys, ", "),
-		strings.Join(placeholders, ", "),
+		"INSERT INTO %s (%s) VALUES %s",
+		quoteIdent(s.Table),
+		strings.Join(cols, ", "),
+		strings.Join(tuples, ", "),
 	), values, nil
 }
 
+// Chunks splits the statement into statements that each stay within the row and parameter limits. A single row
+// that exceeds the parameter limit on its own cannot be split and returns a LimitError.
+func (s *InsertStatement) Chunks(limits Limits) ([]*InsertStatement, error) {
+	rows := s.rows()
+	size := len(rows)
+	if limits.MaxParamsPerStatement > 0 {
+		columns := len(s.columnNames())
+		if columns > limits.MaxParamsPerStatement {
+			return nil, &LimitError{
+				Code:  LimitStatementParams,
+				Field: s.Table,
+				Limit: limits.MaxParamsPerStatement,
+				Value: columns,
+			}
+		}
+		size = min(size, limits.MaxParamsPerStatement/columns)
+	}
+	if limits.MaxRowsPerStatement > 0 {
+		size = min(size, limits.MaxRowsPerStatement)
+	}
+	if size >= len(rows) {
+		return []*InsertStatement{s}, nil
+	}
+	out := make([]*InsertStatement, 0, len(rows)/size+1)
+	for i := 0; i < len(rows); i += size {
+		out = append(out, &InsertStatement{
+			Table: s.Table,
+			Rows:  rows[i:min(i+size, len(rows))],
+		})
+	}
+	return out, nil
+}
+
 type QueryStatement struct {
-	Query string
+	Query  string
+	Params []any
+	// AllowWrites lifts the read-only check. It must only be set on explicitly privileged paths.
+	AllowWrites bool
+	// Limit caps the number of returned rows, Cursor continues from a previous page.
+	Limit  int
+	Cursor string
+	// Profile collects operator timings of the statement into QueryResult.Profile.
+	Profile bool
+	// MaxRows stops reading the result after that many rows and marks it truncated. It is meant for results that
+	// aren't paginated, a Limit should be capped instead.
+	MaxRows int
+	// secured is set on the statements checkQuery returns.
+	secured bool
 }
 
 func (s *QueryStatement) Valid() error {
@@ -270,5 +1140,8 @@ func (s *QueryStatement) Valid() error {
 	if s.Query == "" {
 		return errors.New("invalid QueryStatement: Query empty")
 	}
+	if !s.AllowWrites {
+		return CheckReadOnly(s.Query)
+	}
 	return nil
 }
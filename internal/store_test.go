@@ -2,8 +2,11 @@ package internal_test
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"scratch/internal"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -108,3 +111,385 @@ func TestStoreDataTypes(t *testing.T) {
 		require.Error(t, store.Insert(context.Background(), stmt))
 	}
 }
+
+func TestStoreLimits(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithLimits(internal.Limits{
+		MaxColumnsPerTable:      3,
+		MaxNewColumnsPerRequest: 1,
+		MaxCellBytes:            4,
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "test_table",
+		Columns: map[string]any{"column_a": 1, "column_b": "2"},
+	}))
+
+	for _, tc := range []struct {
+		columns map[string]any
+		code    internal.LimitCode
+		field   string
+	}{
+		{
+			columns: map[string]any{"column_a": "too long"},
+			code:    internal.LimitCellBytes,
+			field:   "column_a",
+		},
+		{
+			columns: map[string]any{"column_c": 1, "column_d": 2},
+			code:    internal.LimitNewColumns,
+			field:   "column_d",
+		},
+	} {
+		var limitErr *internal.LimitError
+		require.ErrorAs(t, store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "test_table",
+			Columns: tc.columns,
+		}), &limitErr)
+		assert.Equal(t, tc.code, limitErr.Code)
+		assert.Equal(t, tc.field, limitErr.Field)
+	}
+
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "test_table",
+		Columns: map[string]any{"column_c": 1},
+	}))
+	var limitErr *internal.LimitError
+	require.ErrorAs(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "test_table",
+		Columns: map[string]any{"column_d": 1},
+	}), &limitErr)
+	assert.Equal(t, internal.LimitTableColumns, limitErr.Code)
+}
+
+func TestStoreBatchInsert(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithLimits(internal.Limits{
+		MaxRowsPerStatement:   2,
+		MaxParamsPerStatement: 4,
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	stmt := &internal.InsertStatement{
+		Table: "test_table",
+		Rows: []map[string]any{
+			{"column_a": 1},
+			{"column_a": 2, "column_b": "b"},
+			{"column_b": "c"},
+			{"column_a": 4, "column_b": "d"},
+			{"column_a": 5},
+		},
+	}
+	chunks, err := stmt.Chunks(internal.Limits{MaxRowsPerStatement: 2, MaxParamsPerStatement: 4})
+	require.NoError(t, err)
+	assert.Len(t, chunks, 3)
+
+	query, values, err := chunks[0].Query()
+	require.NoError(t, err)
+	assert.Equal(t, `INSERT INTO "test_table" ("column_a", "column_b") VALUES (?, DEFAULT), (?, ?)`, query)
+	assert.Equal(t, []any{1, 2, "b"}, values)
+
+	require.NoError(t, store.Insert(context.Background(), stmt))
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select * from test_table",
+	})
+	require.NoError(t, err)
+	assert.Len(t, rows, 5)
+
+	// A later chunk adding a column inserts the statement again, a failing chunk rolls back the chunks before it.
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "test_table",
+		Rows:  []map[string]any{{"column_a": 6}, {"column_a": 7}, {"column_c": "c"}},
+	}))
+	err = store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "test_table",
+		Rows:  []map[string]any{{"column_a": 8}, {"column_a": 9}, {"column_a": "x"}},
+	})
+	require.ErrorIs(t, err, internal.ErrTypeConflict)
+	rows, err = store.Query(context.Background(), &internal.QueryStatement{
+		Query: "select column_a, column_c from test_table where column_a > 5 or column_c is not null order by column_a",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"column_a": int32(6), "column_c": nil}, {"column_a": int32(7), "column_c": nil}, {"column_a": nil, "column_c": "c"},
+	}, rows)
+
+	_, err = stmt.Chunks(internal.Limits{MaxParamsPerStatement: 1})
+	var limitErr *internal.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, internal.LimitStatementParams, limitErr.Code)
+}
+
+func TestStoreMemoryLimit(t *testing.T) {
+	store, err := internal.NewDuckDBStore(internal.WithMemoryLimit(10 << 20))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+		Query: "select count(distinct range::varchar) from range(10000000)",
+	})
+	var limitErr *internal.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, internal.LimitQueryMemory, limitErr.Code)
+	assert.Equal(t, 10<<20, limitErr.Limit)
+
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{Query: "select count(*) from range(1000)"})
+	require.NoError(t, err)
+}
+
+func TestStorePagination(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	rows := make([]map[string]any, 0, 5)
+	for i := range 5 {
+		rows = append(rows, map[string]any{"column_a": i})
+	}
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table: "test_table",
+		Rows:  rows,
+	}))
+
+	var (
+		values []any
+		cursor string
+		pages  int
+	)
+	for {
+		res, fetchErr := store.Fetch(context.Background(), &internal.QueryStatement{
+			Query:  "select * from test_table order by column_a;",
+			Limit:  2,
+			Cursor: cursor,
+		})
+		require.NoError(t, fetchErr)
+		pages++
+		for _, row := range res.Rows {
+			values = append(values, row["column_a"])
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
+	}
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, []any{int32(0), int32(1), int32(2), int32(3), int32(4)}, values)
+
+	_, err = store.Fetch(context.Background(), &internal.QueryStatement{
+		Query:  "select column_a from test_table",
+		Cursor: cursor,
+	})
+	require.ErrorIs(t, err, internal.ErrInvalidCursor)
+}
+
+func TestStoreDatabaseFileSurvivesReopen(t *testing.T) {
+	database := internal.DatabaseConfig{Path: filepath.Join(t.TempDir(), "scratch.db")}
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "test_table",
+		Columns: map[string]any{"column_a": 1},
+	}))
+	require.NoError(t, store.Close())
+
+	database.ReadOnly = true
+	store, err = internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{Query: "select * from test_table"})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+}
+
+func TestStoreDatabasePathWithQuestionMark(t *testing.T) {
+	dir := t.TempDir()
+	database := internal.DatabaseConfig{Path: filepath.Join(dir, "scratch?v=1.db")}
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+		Table:   "test_table",
+		Columns: map[string]any{"column_a": 1},
+	}))
+	rows, err := store.Query(context.Background(),
+		&internal.QueryStatement{Query: "select current_setting('temp_directory') as dir"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"dir": database.Path + ".tmp"}}, rows)
+	require.NoError(t, store.Close())
+	_, err = os.Stat(database.Path)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "scratch"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	database.ReadOnly = true
+	store, err = internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	rows, err = store.Query(context.Background(), &internal.QueryStatement{Query: "select * from test_table"})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+}
+
+func TestStoreMemoryPlacement(t *testing.T) {
+	database := internal.DatabaseConfig{Path: filepath.Join(t.TempDir(), "scratch.db")}
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	_, err = store.SetTableConfig("scratch", internal.TableConfig{Placement: "cloud"})
+	require.ErrorIs(t, err, internal.ErrInvalidTableConfig)
+	_, err = store.SetTableConfig("scratch", internal.TableConfig{Placement: internal.PlacementMemory})
+	require.NoError(t, err)
+	for _, table := range []string{"scratch", "events"} {
+		for i := 0; i < 2; i++ {
+			require.NoError(t, store.Insert(context.Background(), &internal.InsertStatement{
+				Table:   table,
+				Columns: map[string]any{"id": i},
+			}))
+		}
+	}
+	tables, err := store.Tables(context.Background())
+	require.NoError(t, err)
+	inMemory := make(map[string]bool)
+	for _, table := range tables {
+		inMemory[table.Name] = table.InMemory
+	}
+	assert.Equal(t, map[string]bool{"events": false, "scratch": true}, inMemory)
+	rows, err := store.Query(context.Background(), &internal.QueryStatement{Query: "SELECT count(*) AS n FROM scratch"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": int64(2)}}, rows)
+	require.NoError(t, store.Close())
+
+	store, err = internal.NewDuckDBStore(internal.WithDatabase(database))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	tables, err = store.Tables(context.Background())
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "events", tables[0].Name)
+}
+
+func TestStorePreparedInserts(t *testing.T) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+	ctx := context.Background()
+	insert := func(columns map[string]any) {
+		require.NoError(t, store.Insert(ctx, &internal.InsertStatement{Table: "events", Columns: columns}))
+	}
+	// The same statement runs again after each schema change, whether the store or DDL made it.
+	for _, change := range []func(){
+		func() {},
+		func() { insert(map[string]any{"a": "x", "b": 1.5}) },
+		func() { require.NoError(t, store.RenameColumn(ctx, "events", "a", "c")) },
+		func() { require.NoError(t, store.DropColumn(ctx, "events", "b")) },
+		func() {
+			_, fetchErr := store.Fetch(ctx, &internal.QueryStatement{
+				Query:       "alter table events drop column c",
+				AllowWrites: true,
+			})
+			require.NoError(t, fetchErr)
+		},
+		func() { require.NoError(t, store.DropTable(ctx, "events")) },
+	} {
+		change()
+		insert(map[string]any{"a": "y"})
+		insert(map[string]any{"a": "z"})
+	}
+	rows, err := store.Query(ctx, &internal.QueryStatement{Query: "select count(*) as n from events"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": int64(2)}}, rows)
+}
+
+func TestStoreWriterConnection(t *testing.T) {
+	_, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{MaxOpenConns: 1}))
+	require.Error(t, err)
+
+	store, err := internal.NewDuckDBStore(internal.WithDatabase(internal.DatabaseConfig{MaxOpenConns: 2}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, store.Close())
+	})
+
+	// A query holding the only connection of the pool besides the writer's doesn't hold up inserts.
+	reading, release := make(chan struct{}), make(chan struct{})
+	streamed := make(chan error, 1)
+	go func() {
+		_, streamErr := store.Stream(context.Background(), &internal.QueryStatement{Query: "select 1"}, nil,
+			func(map[string]any) error {
+				close(reading)
+				<-release
+				return nil
+			})
+		streamed <- streamErr
+	}()
+	<-reading
+	inserted := make(chan error, 1)
+	go func() {
+		inserted <- store.Insert(context.Background(), &internal.InsertStatement{
+			Table:   "events",
+			Columns: map[string]any{"n": 1},
+		})
+	}()
+	select {
+	case err = <-inserted:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("insert waited for the query")
+	}
+	close(release)
+	require.NoError(t, <-streamed)
+}
+
+// benchRows is the result the scan benchmarks read, wide enough for the per-row allocations to show.
+const benchRows = "select range as id, 'user-' || range as name, range * 1.5 as value, range % 2 = 0 as even, " +
+	"now() as ts from range(10000)"
+
+func BenchmarkStoreFetch(b *testing.B) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		assert.NoError(b, store.Close())
+	})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res, fetchErr := store.Fetch(context.Background(), &internal.QueryStatement{Query: benchRows})
+		require.NoError(b, fetchErr)
+		require.Len(b, res.Rows, 10000)
+	}
+}
+
+func BenchmarkStoreStream(b *testing.B) {
+	store, err := internal.NewDuckDBStore()
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		assert.NoError(b, store.Close())
+	})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rows := 0
+		_, streamErr := store.Stream(context.Background(), &internal.QueryStatement{Query: benchRows}, nil,
+			func(map[string]any) error {
+				rows++
+				return nil
+			})
+		require.NoError(b, streamErr)
+		require.Equal(b, 10000, rows)
+	}
+}
@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// streamBufferBytes is how much of a streamed response is buffered between writes to the connection.
+const streamBufferBytes = 32 << 10
+
+// rowWriter encodes a result row by row, so it can be written while it is scanned. begin is called once the columns
+// are known, end after the last row with the result and the number of rows written.
+type rowWriter interface {
+	begin(cols []Column) error
+	row(row map[string]any) error
+	end(res *QueryResult, rows int) error
+}
+
+// newRowWriter returns the row writer of the format, JSON for the formats without one of their own.
+func newRowWriter(w io.Writer, format Format, opts encodeOptions) rowWriter {
+	switch format {
+	case FormatCSV:
+		return &csvRows{w: csv.NewWriter(w)}
+	case FormatNDJSON:
+		return &ndjsonRows{enc: json.NewEncoder(w), bigints: opts.bigintStrings}
+	case FormatColumnar:
+		return &columnarRows{w: w, bigints: opts.bigintStrings}
+	case FormatGeoJSON:
+		return &geoJSONRows{w: w, geometry: opts.geometry, bigints: opts.bigintStrings}
+	default:
+		return &jsonRows{w: w, envelope: opts.envelope, bigints: opts.bigintStrings}
+	}
+}
+
+// writeRows writes the rows of a fetched result.
+func writeRows(rw rowWriter, res *QueryResult) error {
+	if err := rw.begin(res.Columns); err != nil {
+		return err
+	}
+	for _, row := range res.Rows {
+		if err := rw.row(row); err != nil {
+			return err
+		}
+	}
+	return rw.end(res, len(res.Rows))
+}
+
+// jsonRows writes the rows as a JSON array, or an Envelope, byte for byte as json.Marshal would.
+type jsonRows struct {
+	w        io.Writer
+	envelope bool
+	bigints  bool
+	rows     int
+}
+
+// envelopeTail holds the fields of an Envelope that follow its rows.
+type envelopeTail struct {
+	RowCount   int           `json:"row_count"`
+	ElapsedMS  int64         `json:"elapsed_ms"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Profile    *QueryProfile `json:"profile,omitempty"`
+	Truncated  bool          `json:"truncated,omitempty"`
+}
+
+func (j *jsonRows) begin(cols []Column) error {
+	if !j.envelope {
+		return nil
+	}
+	if cols == nil {
+		cols = []Column{}
+	}
+	out, err := json.Marshal(cols)
+	if err != nil {
+		return fmt.Errorf("marshalling columns: %w", err)
+	}
+	_, err = fmt.Fprintf(j.w, `{"columns":%s,"rows":[`, out)
+	return err
+}
+
+func (j *jsonRows) row(row map[string]any) error {
+	if j.bigints {
+		row = bigIntStrings(row)
+	}
+	out, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("marshalling row: %w", err)
+	}
+	sep := ","
+	if j.rows == 0 {
+		sep = ""
+		if !j.envelope {
+			sep = "["
+		}
+	}
+	j.rows++
+	_, err = io.WriteString(j.w, sep+string(out))
+	return err
+}
+
+func (j *jsonRows) end(res *QueryResult, rows int) error {
+	if !j.envelope {
+		out := "]"
+		switch {
+		case j.rows > 0:
+		case res.Rows == nil:
+			out = "null"
+		default:
+			out = "[]"
+		}
+		_, err := io.WriteString(j.w, out)
+		return err
+	}
+	out, err := json.Marshal(envelopeTail{
+		RowCount:   rows,
+		ElapsedMS:  res.Elapsed.Milliseconds(),
+		NextCursor: res.NextCursor,
+		Profile:    res.Profile,
+		Truncated:  res.Truncated,
+	})
+	if err != nil {
+		return fmt.Errorf("marshalling envelope: %w", err)
+	}
+	_, err = fmt.Fprintf(j.w, "],%s", out[1:])
+	return err
+}
+
+// ndjsonRows writes one JSON object per row and line.
+type ndjsonRows struct {
+	enc     *json.Encoder
+	bigints bool
+}
+
+func (n *ndjsonRows) begin([]Column) error { return nil }
+
+func (n *ndjsonRows) row(row map[string]any) error {
+	if n.bigints {
+		row = bigIntStrings(row)
+	}
+	if err := n.enc.Encode(row); err != nil {
+		return fmt.Errorf("encoding row: %w", err)
+	}
+	return nil
+}
+
+func (n *ndjsonRows) end(*QueryResult, int) error { return nil }
+
+// columnarRows writes the rows as a JSON object of an array per column, in select list order, so wide results don't
+// repeat the column names on every row. The arrays are held encoded until the last row.
+type columnarRows struct {
+	w       io.Writer
+	bigints bool
+	cols    []Column
+	values  []bytes.Buffer
+}
+
+func (c *columnarRows) begin(cols []Column) error {
+	seen := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		// Rows hold one value per name, a repeated name would repeat the key.
+		if !seen[col.Name] {
+			seen[col.Name] = true
+			c.cols = append(c.cols, col)
+		}
+	}
+	c.values = make([]bytes.Buffer, len(c.cols))
+	return nil
+}
+
+func (c *columnarRows) row(row map[string]any) error {
+	for i, col := range c.cols {
+		v := row[col.Name]
+		if s, ok := bigIntString(v); c.bigints && ok {
+			v = s
+		}
+		out, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("marshalling column %s: %w", col.Name, err)
+		}
+		if c.values[i].Len() > 0 {
+			c.values[i].WriteByte(',')
+		}
+		c.values[i].Write(out)
+	}
+	return nil
+}
+
+func (c *columnarRows) end(*QueryResult, int) error {
+	if _, err := io.WriteString(c.w, "{"); err != nil {
+		return err
+	}
+	for i, col := range c.cols {
+		name, err := json.Marshal(col.Name)
+		if err != nil {
+			return fmt.Errorf("marshalling column name: %w", err)
+		}
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		if _, err = fmt.Fprintf(c.w, "%s%s:[", sep, name); err != nil {
+			return err
+		}
+		if _, err = c.values[i].WriteTo(c.w); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(c.w, "]"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(c.w, "}")
+	return err
+}
+
+// streamable reports whether the result of the statement can be written while it is scanned rather than fetched
+// whole. Sessions, profiles, pages, cached results, conditional requests and byte bounds need the whole result, as
+// does failing on overflow, which must be known before the status is sent.
+func (s *Server) streamable(
+	r *http.Request,
+	stmt *QueryStatement,
+	format Format,
+	session *Session,
+	failFast bool,
+) bool {
+	switch {
+	case format != FormatJSON && format != FormatNDJSON && format != FormatCSV && format != FormatColumnar &&
+		format != FormatGeoJSON:
+		return false
+	case session != nil, stmt.Profile, stmt.Limit > 0, stmt.Cursor != "":
+		return false
+	case s.requestResultLimits(r.Context()).MaxBytes > 0, failFast && stmt.MaxRows > 0:
+		return false
+	case r.Header.Get("If-None-Match") != "":
+		return false
+	}
+	return !s.cacheable(r, stmt)
+}
+
+// writeStream writes the rows of the statement as they are scanned, so the result is never held whole. Errors before
+// the first bytes are answered with their status, later ones cut the response short. Since the headers are gone by
+// the time the scan ends, a truncated result is marked in a trailer.
+func (s *Server) writeStream(
+	w http.ResponseWriter,
+	r *http.Request,
+	stmt *QueryStatement,
+	format Format,
+	opts encodeOptions,
+) {
+	dw := &deferredHeaderWriter{w: w, contentType: format.ContentType}
+	var (
+		out io.Writer = dw
+		zw  io.WriteCloser
+	)
+	if enc := negotiateEncoding(r); enc != nil {
+		w.Header().Set("Content-Encoding", enc.name)
+		zw = enc.newWriter(dw)
+		out = zw
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Trailer", TruncatedHeader)
+	if s.cache != nil {
+		w.Header().Set(CacheStatusHeader, "miss")
+	}
+	liftWriteTimeout(w)
+	bw := bufio.NewWriterSize(out, streamBufferBytes)
+	rw := newRowWriter(bw, format, opts)
+	started, rows := time.Now(), 0
+	// The row writers are done with a row once it is encoded.
+	res, err := s.store.stream(r.Context(), stmt, true, func(cols []Column) error {
+		w.Header().Set(ColumnTypesHeader, FormatColumnTypes(cols))
+		return rw.begin(cols)
+	}, func(row map[string]any) error {
+		rows++
+		return rw.row(row)
+	})
+	if err == nil {
+		err = rw.end(res, rows)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		s.record(r, stmt, started, nil, false, err)
+		if dw.written {
+			slog.Error("handle Query: writing response", "err", err, "content_type", format.ContentType)
+			return
+		}
+		for _, header := range []string{"Content-Encoding", "Trailer", ColumnTypesHeader} {
+			w.Header().Del(header)
+		}
+		s.writeQueryError(w, err)
+		return
+	}
+	s.record(r, stmt, started, &rows, false, nil)
+	markAuditRows(r.Context(), rows)
+	if !dw.written {
+		// An empty CSV or NDJSON result writes nothing, the headers are still due.
+		_, _ = dw.Write(nil)
+	}
+	if res.Truncated {
+		w.Header().Set(TruncatedHeader, "true")
+	}
+}
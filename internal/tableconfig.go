@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidTableConfig = errors.New("invalid table config")
+
+// SchemaPolicy decides how far ingestion may change the schema of a table.
+type SchemaPolicy string
+
+const (
+	// SchemaPolicyAuto creates the table and its columns as inserts carry them, values are cast to the column type.
+	SchemaPolicyAuto SchemaPolicy = "auto"
+	// SchemaPolicyAdditiveOnly adds columns but refuses values that would be cast to the type of an existing column,
+	// e.g. a number for a VARCHAR column.
+	SchemaPolicyAdditiveOnly SchemaPolicy = "additive-only"
+	// SchemaPolicyLocked refuses inserts into a missing table and inserts carrying unknown columns.
+	SchemaPolicyLocked SchemaPolicy = "locked"
+)
+
+func (p SchemaPolicy) Valid() bool {
+	switch p {
+	case SchemaPolicyAuto, SchemaPolicyAdditiveOnly, SchemaPolicyLocked:
+		return true
+	}
+	return false
+}
+
+// TablePlacement is where the data of a table is kept.
+type TablePlacement string
+
+const (
+	// PlacementDisk keeps the table in the database file, or in memory when the whole database is.
+	PlacementDisk TablePlacement = "disk"
+	// PlacementMemory keeps the table in memory next to the database file, so high-churn tables don't grow the file.
+	// The table is lost when the server stops and is left out of backups.
+	PlacementMemory TablePlacement = "memory"
+)
+
+// TableConfig holds the settings of a table. A table without a configuration behaves as the zero value, which applies
+// SchemaPolicyAuto. The configuration may be set before the table exists, column declarations only take effect when
+// ingestion creates the table or the column.
+type TableConfig struct {
+	SchemaPolicy SchemaPolicy   `json:"schema_policy"`
+	Columns      []ColumnConfig `json:"columns,omitempty"`
+	Tiering      *TieringPolicy `json:"tiering,omitempty"`
+	// Placement takes effect when ingestion creates the table, an existing table stays where it is.
+	Placement TablePlacement `json:"placement,omitempty"`
+	// DecimalStrings infers DECIMAL rather than VARCHAR for new columns whose values are all decimal strings, e.g.
+	// "12.30", so amounts sent as strings are stored exactly.
+	DecimalStrings bool `json:"decimal_strings,omitempty"`
+}
+
+// ColumnConfig declares a column of a table along with constraints DuckDB enforces on every write.
+type ColumnConfig struct {
+	Name string `json:"name"`
+	// Type creates the column with the table even if the first insert lacks it. Without it, the type is inferred
+	// from the first value once an insert carries the column.
+	Type    string `json:"type,omitempty"`
+	NotNull bool   `json:"not_null,omitempty"`
+	Unique  bool   `json:"unique,omitempty"`
+	// Check is a boolean SQL expression over the columns of a row, e.g. amount >= 0.
+	Check string `json:"check,omitempty"`
+	// Default is the SQL expression stored for rows that lack the column, e.g. 'unknown'. A null in the row is stored
+	// as is. Rows stored before the column is added get the default as well.
+	Default string `json:"default,omitempty"`
+	// Generated is the SQL expression computing the column from the other columns of the row, e.g.
+	// date_trunc('day', ts). Generated columns are always created with the table, so the columns they read have to be
+	// declared with a type. Inserts can't carry them and DuckDB supports neither constraints nor a default on them.
+	Generated string `json:"generated,omitempty"`
+	// Enum declares the column as a DuckDB ENUM of the values, which stores low-cardinality strings as small integers
+	// and groups by them faster. Values inserted beyond them are added to the type unless StrictEnum rejects them.
+	Enum       []string `json:"enum,omitempty"`
+	StrictEnum bool     `json:"strict_enum,omitempty"`
+	// AutoIncrement fills the column with the next value of a sequence created with the table, numbering the rows
+	// from 1 in insert order, so it serves as a pagination cursor or a position to poll the table from. The column is
+	// BIGINT unless Type declares another integer type. Like generated columns, it is only created with the table and
+	// inserts can't carry it. The sequence outlives the table, a table created again continues its numbering.
+	AutoIncrement bool `json:"auto_increment,omitempty"`
+}
+
+func (c *ColumnConfig) Validate() error {
+	if !tableNameRegex.MatchString(c.Name) {
+		return fmt.Errorf("%w: column name %q must match %s", ErrInvalidTableConfig, c.Name, tableNameRegex)
+	}
+	if c.Type != "" && !ParseDataType(c.Type).Valid() {
+		return fmt.Errorf("%w: column %s: unknown type %q", ErrInvalidTableConfig, c.Name, c.Type)
+	}
+	if err := c.validateEnum(); err != nil {
+		return err
+	}
+	if c.Check != "" && !singleExpression(c.Check) {
+		return fmt.Errorf("%w: column %s: check must be a single expression", ErrInvalidTableConfig, c.Name)
+	}
+	if c.Default != "" && !singleExpression(c.Default) {
+		return fmt.Errorf("%w: column %s: default must be a single expression", ErrInvalidTableConfig, c.Name)
+	}
+	if c.Generated != "" {
+		if !singleExpression(c.Generated) {
+			return fmt.Errorf("%w: column %s: generated must be a single expression", ErrInvalidTableConfig, c.Name)
+		}
+		if c.Default != "" || c.constraints() != "" {
+			return fmt.Errorf("%w: column %s: generated columns can't have a default or constraints",
+				ErrInvalidTableConfig, c.Name)
+		}
+	}
+	return c.validateAutoIncrement()
+}
+
+// validateAutoIncrement checks the auto-increment declaration of the column.
+func (c *ColumnConfig) validateAutoIncrement() error {
+	if !c.AutoIncrement {
+		return nil
+	}
+	if c.Default != "" || c.Generated != "" || len(c.Enum) > 0 {
+		return fmt.Errorf("%w: column %s: auto-increment columns can't have a default, be generated or an enum",
+			ErrInvalidTableConfig, c.Name)
+	}
+	if c.Type == "" {
+		return nil
+	}
+	switch ParseDataType(c.Type) {
+	case INTEGER, BIGINT, HUGEINT:
+		return nil
+	default:
+		return fmt.Errorf("%w: column %s: auto-increment columns must be INTEGER, BIGINT or HUGEINT",
+			ErrInvalidTableConfig, c.Name)
+	}
+}
+
+// sequenceName returns the name of the sequence of the auto-increment column of the table, e.g. events.id.seq. The
+// dots can't appear in table and column names, so the sequences of different columns don't collide.
+func sequenceName(table, column string) string {
+	return table + "." + column + ".seq"
+}
+
+// defaultClause returns the DEFAULT clause of the column definition, with a leading space.
+func (c *ColumnConfig) defaultClause() string {
+	if c.Default == "" {
+		return ""
+	}
+	return " DEFAULT " + c.Default
+}
+
+// singleExpression reports whether the expression can be embedded into a CREATE TABLE statement in parentheses
+// without ending them or the statement.
+func singleExpression(expr string) bool {
+	stmts, err := ClassifySQL("SELECT " + expr)
+	if err != nil || len(stmts) != 1 || stmts[0].Class != StatementRead {
+		return false
+	}
+	depth := 0
+	for _, t := range stmts[0].tokens {
+		switch {
+		case t.is(sqlPunct, "("):
+			depth++
+		case t.is(sqlPunct, ")"):
+			depth--
+		}
+		if depth < 0 {
+			return false
+		}
+	}
+	return depth == 0
+}
+
+// constraints returns the constraint clauses of the column definition, with a leading space.
+func (c *ColumnConfig) constraints() string {
+	var out string
+	if c.NotNull {
+		out += " NOT NULL"
+	}
+	if c.Unique {
+		out += " UNIQUE"
+	}
+	if c.Check != "" {
+		out += " CHECK (" + c.Check + ")"
+	}
+	return out
+}
+
+// column returns the declaration of the column, matched case-insensitively.
+func (cfg TableConfig) column(name string) (ColumnConfig, bool) {
+	for _, c := range cfg.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return ColumnConfig{}, false
+}
+
+// SchemaPolicyError is returned when an insert would change the schema of a table beyond its SchemaPolicy. Nothing of
+// the insert is applied.
+type SchemaPolicyError struct {
+	Table  string       `json:"table"`
+	Policy SchemaPolicy `json:"policy"`
+	Column string       `json:"column,omitempty"`
+	Reason string       `json:"reason"`
+}
+
+func (e *SchemaPolicyError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("schema policy %s of table %s: %s", e.Policy, e.Table, e.Reason)
+	}
+	return fmt.Sprintf("schema policy %s of table %s: column %s: %s", e.Policy, e.Table, e.Column, e.Reason)
+}
+
+// tableConfigs holds the configurations by lower cased table name.
+type tableConfigs struct {
+	mu      sync.Mutex
+	byTable map[string]TableConfig
+}
+
+func (c *tableConfigs) get(table string) TableConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, ok := c.byTable[strings.ToLower(table)]
+	if !ok || cfg.SchemaPolicy == "" {
+		cfg.SchemaPolicy = SchemaPolicyAuto
+	}
+	return cfg
+}
+
+func (c *tableConfigs) renamed(from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg, ok := c.byTable[strings.ToLower(from)]
+	delete(c.byTable, strings.ToLower(from))
+	if ok {
+		c.byTable[strings.ToLower(to)] = cfg
+	}
+}
+
+func (s *Store) TableConfig(table string) TableConfig {
+	return s.configs.get(table)
+}
+
+// SetTableConfig replaces the configuration of the table. It applies to the inserts that follow.
+func (s *Store) SetTableConfig(table string, cfg TableConfig) (TableConfig, error) {
+	if !tableNameRegex.MatchString(table) {
+		return TableConfig{}, fmt.Errorf("invalid table name %q: must match %s", table, tableNameRegex)
+	}
+	if cfg.SchemaPolicy == "" {
+		cfg.SchemaPolicy = SchemaPolicyAuto
+	}
+	if !cfg.SchemaPolicy.Valid() {
+		return TableConfig{}, fmt.Errorf("%w: schema policy %q must be %s, %s or %s", ErrInvalidTableConfig,
+			cfg.SchemaPolicy, SchemaPolicyAuto, SchemaPolicyAdditiveOnly, SchemaPolicyLocked)
+	}
+	switch cfg.Placement {
+	case "", PlacementDisk, PlacementMemory:
+	default:
+		return TableConfig{}, fmt.Errorf("%w: placement %q must be %s or %s", ErrInvalidTableConfig, cfg.Placement,
+			PlacementDisk, PlacementMemory)
+	}
+	seen := make(map[string]bool, len(cfg.Columns))
+	for i := range cfg.Columns {
+		c := &cfg.Columns[i]
+		if err := c.Validate(); err != nil {
+			return TableConfig{}, err
+		}
+		if seen[strings.ToLower(c.Name)] {
+			return TableConfig{}, fmt.Errorf("%w: duplicate column %s", ErrInvalidTableConfig, c.Name)
+		}
+		seen[strings.ToLower(c.Name)] = true
+		c.Type = strings.ToUpper(c.Type)
+	}
+	if cfg.Tiering != nil {
+		tiering := *cfg.Tiering
+		if err := s.validateTiering(table, &tiering); err != nil {
+			return TableConfig{}, err
+		}
+		cfg.Tiering = &tiering
+	}
+	s.configs.mu.Lock()
+	defer s.configs.mu.Unlock()
+	s.configs.byTable[strings.ToLower(table)] = cfg
+	return cfg, nil
+}
+
+// columnTypes returns the types of the columns of the table by lower cased name.
+func (s *Store) columnTypes(ctx context.Context, table string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT column_name, data_type FROM information_schema.columns
+			WHERE table_catalog IN `+ownCatalogs+` AND table_name = ?`,
+		table,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err = rows.Scan(&name, &dataType); err != nil {
+			return nil, fmt.Errorf("scanning column: %w", err)
+		}
+		out[strings.ToLower(name)] = dataType
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing columns: %w", err)
+	}
+	return out, nil
+}
+
+// checkSchemaPolicy refuses the statement if it would change the table beyond its policy. It runs before any DDL of
+// the insert.
+func (s *Store) checkSchemaPolicy(ctx context.Context, stmt *InsertStatement) error {
+	policy := s.configs.get(stmt.Table).SchemaPolicy
+	if policy == SchemaPolicyAuto {
+		return nil
+	}
+	types, err := s.columnTypes(ctx, stmt.Table)
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 && policy == SchemaPolicyLocked {
+		return &SchemaPolicyError{Table: stmt.Table, Policy: policy, Reason: "table doesn't exist"}
+	}
+	for _, name := range stmt.columnNames() {
+		dataType, ok := types[strings.ToLower(name)]
+		if !ok {
+			if policy == SchemaPolicyLocked {
+				return &SchemaPolicyError{Table: stmt.Table, Policy: policy, Column: name, Reason: "unknown column"}
+			}
+			continue
+		}
+		if policy != SchemaPolicyAdditiveOnly {
+			continue
+		}
+		for _, row := range stmt.rows() {
+			if v := row[name]; v != nil && !matchesType(dataType, v) {
+				return &SchemaPolicyError{
+					Table:  stmt.Table,
+					Policy: policy,
+					Column: name,
+					Reason: fmt.Sprintf("%T value would be converted to %s", v, dataType),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchesType reports whether the decoded JSON value is stored in a column of the type without conversion. Types
+// ingestion never creates are not judged.
+func matchesType(dataType string, v any) bool {
+	if isDecimalType(dataType) {
+		if s, ok := v.(string); ok {
+			return decimalStringRegex.MatchString(s)
+		}
+		kind := NewDataType(v)
+		return kind == DOUBLE || kind == INTEGER || kind == BIGINT || kind == HUGEINT
+	}
+	switch dataType {
+	case VARCHAR.DBType():
+		_, ok := v.(string)
+		return ok
+	case DOUBLE.DBType():
+		return NewDataType(v) == DOUBLE || NewDataType(v) == INTEGER
+	case INTEGER.DBType(), BIGINT.DBType(), HUGEINT.DBType():
+		if n, ok := v.(float64); ok {
+			return n == math.Trunc(n)
+		}
+		switch kind := NewDataType(v); dataType {
+		case INTEGER.DBType():
+			return kind == INTEGER
+		case BIGINT.DBType():
+			return kind == INTEGER || kind == BIGINT
+		default:
+			return kind == INTEGER || kind == BIGINT || kind == HUGEINT
+		}
+	case BOOLEAN.DBType():
+		_, ok := v.(bool)
+		return ok
+	}
+	return true
+}
+
+func (s *Server) HandleGetTableConfig(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle get table config: writing response", s.store.TableConfig(r.PathValue("table")))
+}
+
+// HandlePutTableConfig replaces the configuration of the table in the path with the TableConfig in the body.
+func (s *Server) HandlePutTableConfig(w http.ResponseWriter, r *http.Request) {
+	var cfg TableConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put table config: decoding request body", err)
+		return
+	}
+	cfg, err := s.store.SetTableConfig(r.PathValue("table"), cfg)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put table config", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle put table config: writing response", cfg)
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrTableNotFound = errors.New("table not found")
+
+// filterOps maps the operators of the filter parameter to SQL. in takes a comma separated list and null takes true or
+// false, both are handled separately.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var filterOps = map[string]string{
+	"eq":    "=",
+	"ne":    "<>",
+	"lt":    "<",
+	"lte":   "<=",
+	"gt":    ">",
+	"gte":   ">=",
+	"like":  "LIKE",
+	"ilike": "ILIKE",
+}
+
+// quoteIdent quotes the name as a SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// existingColumns returns the columns of the table, or ErrTableNotFound if it doesn't exist.
+func (s *Store) existingColumns(ctx context.Context, table string) (map[string]bool, error) {
+	if !tableNameRegex.MatchString(table) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	cols, err := s.tableColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	return cols, nil
+}
+
+// column returns the quoted column if the table has it.
+func column(cols map[string]bool, name string) (string, error) {
+	if !cols[strings.ToLower(name)] {
+		return "", fmt.Errorf("unknown column %q", name)
+	}
+	return quoteIdent(name), nil
+}
+
+// filterCondition builds the condition of a filter parameter of the form column:op:value, binding the value.
+func filterCondition(cols map[string]bool, filter string) (string, []any, error) {
+	name, rest, ok := strings.Cut(filter, ":")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid filter %q: expected column:op:value", filter)
+	}
+	op, value, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid filter %q: expected column:op:value", filter)
+	}
+	col, err := column(cols, name)
+	if err != nil {
+		return "", nil, err
+	}
+	switch op {
+	case "in":
+		values := strings.Split(value, ",")
+		params := make([]any, len(values))
+		for i, v := range values {
+			params[i] = v
+		}
+		return fmt.Sprintf("%s IN (%s)", col, strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")), params, nil
+	case "null":
+		isNull, parseErr := strconv.ParseBool(value)
+		if parseErr != nil {
+			return "", nil, fmt.Errorf("invalid filter %q: null takes true or false", filter)
+		}
+		if isNull {
+			return col + " IS NULL", nil, nil
+		}
+		return col + " IS NOT NULL", nil, nil
+	}
+	sqlOp, ok := filterOps[op]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid filter %q: unknown operator %q", filter, op)
+	}
+	return fmt.Sprintf("%s %s ?", col, sqlOp), []any{value}, nil
+}
+
+// whereClause builds the WHERE clause of the filter parameters, which all have to match. It is empty without filters.
+func whereClause(cols map[string]bool, filters []string) (string, []any, error) {
+	var conditions []string
+	var params []any
+	for _, filter := range filters {
+		condition, values, err := filterCondition(cols, filter)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		params = append(params, values...)
+	}
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), params, nil
+}
+
+// sortClause builds the ORDER BY clause of a sort parameter, comma separated columns with a leading - for
+// descending order.
+func sortClause(cols map[string]bool, sort string) (string, error) {
+	if sort == "" {
+		return "", nil
+	}
+	var terms []string
+	for _, term := range strings.Split(sort, ",") {
+		name, desc := strings.CutPrefix(term, "-")
+		col, err := column(cols, name)
+		if err != nil {
+			return "", err
+		}
+		if desc {
+			col += " DESC"
+		}
+		terms = append(terms, col)
+	}
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// tableRowsStatement builds the parameterized SELECT of the rows endpoint. Column names are checked against the
+// table, values are bound as parameters and cast by DuckDB to the type of the column.
+func (s *Store) tableRowsStatement(ctx context.Context, table string, params url.Values) (*QueryStatement, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	selected := "*"
+	if v := params.Get("columns"); v != "" {
+		names := strings.Split(v, ",")
+		for i, name := range names {
+			if names[i], err = column(cols, name); err != nil {
+				return nil, err
+			}
+		}
+		selected = strings.Join(names, ", ")
+	}
+
+	stmt := &QueryStatement{Cursor: params.Get("cursor")}
+	where, values, err := whereClause(cols, params["filter"])
+	if err != nil {
+		return nil, err
+	}
+	stmt.Params = values
+	order, err := sortClause(cols, params.Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+	if v := params.Get("limit"); v != "" {
+		if stmt.Limit, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("parsing limit: %w", err)
+		}
+	}
+	stmt.Query = fmt.Sprintf("SELECT %s FROM %s%s%s", selected, quoteIdent(table), where, order)
+	return stmt, nil
+}
+
+// HandleTableRows responds with the rows of the table in the path, selected without SQL:
+// filter=column:op:value (repeatable, op one of eq, ne, lt, lte, gt, gte, like, ilike, in with comma separated values
+// and null with true or false), sort=column,-column, columns=a,b, limit and cursor. The response is negotiated like
+// the query endpoints.
+func (s *Server) HandleTableRows(w http.ResponseWriter, r *http.Request) {
+	stmt, err := s.store.tableRowsStatement(r.Context(), r.PathValue("table"), r.URL.Query())
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle table rows", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle table rows", err)
+		return
+	}
+	s.writeQuery(w, r, stmt)
+}
+
+type DeleteRowsResponse struct {
+	Table   string `json:"table"`
+	Deleted int64  `json:"deleted"`
+}
+
+// DeleteRows deletes the rows of the table matching all filters, see HandleTableRows for their form. Deleting without
+// filters has to be asked for with all, so a missing filter doesn't empty the table.
+func (s *Store) DeleteRows(ctx context.Context, table string, filters []string, all bool) (int64, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	if len(filters) == 0 && !all {
+		return 0, errors.New("invalid delete: no filter, set all=true to delete every row")
+	}
+	where, values, err := whereClause(cols, filters)
+	if err != nil {
+		return 0, err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s%s", quoteIdent(table), where), values...)
+	if err != nil {
+		return 0, fmt.Errorf("deleting rows: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// HandleDeleteRows deletes the rows of the table in the path matching the filter parameters, e.g. all rows of a user
+// with filter=user_id:eq:42. all=true deletes every row.
+func (s *Server) HandleDeleteRows(w http.ResponseWriter, r *http.Request) {
+	all := false
+	if v := r.URL.Query().Get("all"); v != "" {
+		var err error
+		if all, err = strconv.ParseBool(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "handle delete rows: parsing all", err)
+			return
+		}
+	}
+	table := r.PathValue("table")
+	deleted, err := s.store.DeleteRows(r.Context(), table, r.URL.Query()["filter"], all)
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete rows", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle delete rows", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle delete rows: writing response", DeleteRowsResponse{
+		Table:   table,
+		Deleted: deleted,
+	})
+}
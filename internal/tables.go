@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TableInfo describes a table as listed by GET /tables.
+type TableInfo struct {
+	Schema  string `json:"schema"`
+	Name    string `json:"name"`
+	Columns int    `json:"columns"`
+	// Rows is the row count DuckDB keeps in its catalog, it can be off after deletes until the next checkpoint.
+	Rows int64 `json:"rows"`
+	// ApproxBytes estimates the uncompressed size of the table from the row count and the width of the column
+	// types. Variable length values are counted with their 16 byte header only.
+	ApproxBytes int64 `json:"approx_bytes"`
+	// InMemory is set for the tables placed in memory, which are lost when the server stops.
+	InMemory bool `json:"in_memory,omitempty"`
+}
+
+// Tables lists the tables of the database, including those placed in memory, with their sizes, ordered by schema and
+// name.
+func (s *Store) Tables(ctx context.Context) ([]TableInfo, error) {
+	widths, err := s.rowWidths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT database_name, schema_name, table_name, column_count, estimated_size
+		FROM duckdb_tables()
+		WHERE database_name IN `+ownCatalogs+` AND NOT internal
+		ORDER BY schema_name, table_name`)
+	if err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := []TableInfo{}
+	for rows.Next() {
+		var (
+			t        TableInfo
+			database string
+		)
+		if err = rows.Scan(&database, &t.Schema, &t.Name, &t.Columns, &t.Rows); err != nil {
+			return nil, fmt.Errorf("scanning table: %w", err)
+		}
+		t.ApproxBytes = t.Rows * widths[database+"."+t.Schema+"."+t.Name]
+		t.InMemory = database == memoryDatabase
+		out = append(out, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing tables: %w", err)
+	}
+	return out, nil
+}
+
+// readableTables returns the tables the principal of the context may read, with their columns in order. Tables with
+// names that can't be addressed in a path are left out.
+func (s *Store) readableTables(ctx context.Context) ([]TableSchema, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT table_name, column_name, data_type, is_nullable = 'YES'
+		FROM information_schema.columns
+		WHERE table_catalog IN `+ownCatalogs+`
+		ORDER BY table_name, ordinal_position`)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	var tables []TableSchema
+	for rows.Next() {
+		var (
+			table string
+			col   ColumnInfo
+		)
+		if err = rows.Scan(&table, &col.Name, &col.Type, &col.Nullable); err != nil {
+			return nil, fmt.Errorf("scanning column: %w", err)
+		}
+		if len(tables) == 0 || tables[len(tables)-1].Table != table {
+			tables = append(tables, TableSchema{Table: table})
+		}
+		tables[len(tables)-1].Columns = append(tables[len(tables)-1].Columns, col)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing columns: %w", err)
+	}
+	out := tables[:0]
+	for _, t := range tables {
+		if !tableNameRegex.MatchString(t.Table) || s.checkAuditRoute(ctx, t.Table, false) != nil ||
+			s.checkTableAccess(ctx, t.Table, false) != nil {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// rowWidths returns the summed width of the column types of each table, keyed by database.schema.table.
+func (s *Store) rowWidths(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT database_name, schema_name, table_name, data_type
+		FROM duckdb_columns()
+		WHERE NOT internal AND database_name IN `+ownCatalogs)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns: %w", err)
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			slog.Error("closing rows", "err", closeErr)
+		}
+	}()
+	out := make(map[string]int64)
+	for rows.Next() {
+		var database, schema, table, dataType string
+		if err = rows.Scan(&database, &schema, &table, &dataType); err != nil {
+			return nil, fmt.Errorf("scanning column: %w", err)
+		}
+		out[database+"."+schema+"."+table] += typeWidth(dataType)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("flushing columns: %w", err)
+	}
+	return out, nil
+}
+
+// typeWidth is the size in bytes DuckDB stores a value of the type with. Variable length and nested types count with
+// the 16 bytes of their header.
+func typeWidth(dataType string) int64 {
+	switch dataType {
+	case "BOOLEAN", "TINYINT", "UTINYINT":
+		return 1
+	case "SMALLINT", "USMALLINT":
+		return 2
+	case "INTEGER", "UINTEGER", "FLOAT", "DATE":
+		return 4
+	case "BIGINT", "UBIGINT", "DOUBLE", "TIME", "TIMESTAMP", "TIMESTAMP WITH TIME ZONE", "TIME WITH TIME ZONE",
+		"TIMESTAMP_S", "TIMESTAMP_MS", "TIMESTAMP_NS":
+		return 8
+	}
+	if precision, ok := strings.CutPrefix(dataType, "DECIMAL("); ok {
+		width, _, _ := strings.Cut(precision, ",")
+		switch n, err := strconv.Atoi(width); {
+		case err != nil:
+			return 16
+		case n <= 4:
+			return 2
+		case n <= 9:
+			return 4
+		case n <= 18:
+			return 8
+		}
+	}
+	return 16
+}
+
+func (s *Server) HandleListTables(w http.ResponseWriter, r *http.Request) {
+	tables, err := s.store.Tables(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle list tables", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle list tables: writing response", tables)
+}
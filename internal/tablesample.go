@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultSampleRows is the size of a sample without the n parameter, MaxSampleRows bounds it.
+	DefaultSampleRows = 100
+	MaxSampleRows     = 10000
+)
+
+// sampleMethods are the sampling methods of the method parameter. reservoir picks exactly n rows out of all rows,
+// bernoulli picks each row and system each vector of rows with the same probability, see tableSampleStatement.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var sampleMethods = map[string]bool{"reservoir": true, "bernoulli": true, "system": true}
+
+// estimatedRows returns the row count DuckDB estimates for the table without scanning it.
+func (s *Store) estimatedRows(ctx context.Context, table string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT coalesce(sum(estimated_size), 0) FROM duckdb_tables() WHERE database_name IN "+ownCatalogs+
+			" AND lower(table_name) = lower(?)", table).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("estimating rows: %w", err)
+	}
+	return n, nil
+}
+
+// tableSampleStatement builds the SELECT of the sample endpoint with DuckDB's USING SAMPLE. The percentage of the
+// bernoulli and system methods is derived from the estimated row count of the table so that they return about n rows,
+// which system, sampling whole vectors of 2048 rows, only approaches on large tables.
+func (s *Store) tableSampleStatement(ctx context.Context, table string, params url.Values) (*QueryStatement, error) {
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	selected := "*"
+	if v := params.Get("columns"); v != "" {
+		names := strings.Split(v, ",")
+		for i, name := range names {
+			if names[i], err = column(cols, name); err != nil {
+				return nil, err
+			}
+		}
+		selected = strings.Join(names, ", ")
+	}
+
+	n := DefaultSampleRows
+	if v := params.Get("n"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("parsing n: %w", err)
+		}
+		if n < 1 || n > MaxSampleRows {
+			return nil, fmt.Errorf("invalid n %d: expected 1 to %d", n, MaxSampleRows)
+		}
+	}
+	method := strings.ToLower(params.Get("method"))
+	if method == "" {
+		method = "reservoir"
+	}
+	if !sampleMethods[method] {
+		return nil, fmt.Errorf("invalid method %q: expected reservoir, bernoulli or system", method)
+	}
+	repeatable := ""
+	if v := params.Get("seed"); v != "" {
+		seed, parseErr := strconv.ParseUint(v, 10, 32)
+		if parseErr != nil {
+			return nil, fmt.Errorf("parsing seed: %w", parseErr)
+		}
+		repeatable = fmt.Sprintf(" REPEATABLE (%d)", seed)
+	}
+
+	sample := fmt.Sprintf("reservoir(%d ROWS)", n)
+	limit := ""
+	if method != "reservoir" {
+		estimated, estimateErr := s.estimatedRows(ctx, table)
+		if estimateErr != nil {
+			return nil, estimateErr
+		}
+		percent := 100.0
+		if estimated > int64(n) {
+			percent = 100 * float64(n) / float64(estimated)
+		}
+		sample = fmt.Sprintf("%s(%s PERCENT)", method, strconv.FormatFloat(percent, 'f', -1, 64))
+		limit = fmt.Sprintf(" LIMIT %d", n)
+	}
+	return &QueryStatement{
+		Query: fmt.Sprintf("SELECT %s FROM %s USING SAMPLE %s%s%s", selected, quoteIdent(table), sample, repeatable, limit),
+	}, nil
+}
+
+// HandleTableSample responds with a random sample of the rows of the table in the path, without scanning the whole
+// table for the bernoulli and system methods: n=100 rows at most 10000, method=reservoir, bernoulli or system,
+// columns=a,b and seed, which makes the sample repeatable. Samples are cached like queries, until the table changes,
+// unless the request asks for a fresh one with Cache-Control: no-cache. The response is negotiated like the query
+// endpoints.
+func (s *Server) HandleTableSample(w http.ResponseWriter, r *http.Request) {
+	stmt, err := s.store.tableSampleStatement(r.Context(), r.PathValue("table"), r.URL.Query())
+	if errors.Is(err, ErrTableNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle table sample", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle table sample", err)
+		return
+	}
+	s.writeQuery(w, r, stmt)
+}
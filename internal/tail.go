@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidTail = errors.New("invalid tail")
+
+// tailBuffer is how many inserts a tail holds for a slow client before it drops rows.
+const tailBuffer = 64
+
+// TailEvent is a message of a live tail: the rows of an insert into the table that match the filters of the tail.
+type TailEvent struct {
+	Table string           `json:"table"`
+	Time  time.Time        `json:"time"`
+	Rows  []map[string]any `json:"rows"`
+	// Dropped counts the rows left out since the previous event because the client read too slowly.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// tailFilter is a filter parameter of a tail, column:op:value as on GET /tables/{table}/rows, evaluated on the
+// inserted values. like and ilike aren't supported.
+type tailFilter struct {
+	column string
+	op     string
+	values []string
+	null   bool
+}
+
+func parseTailFilter(filter string) (tailFilter, error) {
+	name, rest, ok := strings.Cut(filter, ":")
+	if !ok {
+		return tailFilter{}, fmt.Errorf("%w: filter %q: expected column:op:value", ErrInvalidTail, filter)
+	}
+	op, value, ok := strings.Cut(rest, ":")
+	if !ok {
+		return tailFilter{}, fmt.Errorf("%w: filter %q: expected column:op:value", ErrInvalidTail, filter)
+	}
+	f := tailFilter{column: name, op: op, values: []string{value}}
+	switch op {
+	case "eq", "ne", "lt", "lte", "gt", "gte":
+	case "in":
+		f.values = strings.Split(value, ",")
+	case "null":
+		var err error
+		if f.null, err = strconv.ParseBool(value); err != nil {
+			return tailFilter{}, fmt.Errorf("%w: filter %q: null takes true or false", ErrInvalidTail, filter)
+		}
+	default:
+		return tailFilter{}, fmt.Errorf("%w: filter %q: unknown operator %q", ErrInvalidTail, filter, op)
+	}
+	return f, nil
+}
+
+func (f tailFilter) match(row map[string]any) bool {
+	var v any
+	for k, value := range row {
+		if strings.EqualFold(k, f.column) {
+			v = value
+			break
+		}
+	}
+	if f.op == "null" {
+		return (v == nil) == f.null
+	}
+	if v == nil {
+		return false
+	}
+	s := fmt.Sprint(v)
+	switch f.op {
+	case "eq":
+		return s == f.values[0]
+	case "ne":
+		return s != f.values[0]
+	case "in":
+		return slices.Contains(f.values, s)
+	}
+	cmp := strings.Compare(s, f.values[0])
+	if a, err := strconv.ParseFloat(s, 64); err == nil {
+		if b, err := strconv.ParseFloat(f.values[0], 64); err == nil {
+			cmp = 0
+			if a < b {
+				cmp = -1
+			} else if a > b {
+				cmp = 1
+			}
+		}
+	}
+	switch f.op {
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	case "gt":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// Tail receives the rows inserted into a table from the moment it is opened.
+type Tail struct {
+	table   string
+	filters []tailFilter
+	events  chan TailEvent
+	dropped atomic.Int64
+}
+
+func (t *Tail) Events() <-chan TailEvent {
+	return t.events
+}
+
+// tailHub fans the inserted rows out to the open tails.
+type tailHub struct {
+	mu    sync.Mutex
+	tails map[*Tail]struct{}
+}
+
+// Tail opens a tail of the table, whose filters all have to match a row. Close it with Untail.
+func (s *Store) Tail(table string, filters []string) (*Tail, error) {
+	if !tableNameRegex.MatchString(table) {
+		return nil, fmt.Errorf("%w: table name must match %s", ErrInvalidTail, tableNameRegex)
+	}
+	t := &Tail{table: table, events: make(chan TailEvent, tailBuffer)}
+	for _, filter := range filters {
+		f, err := parseTailFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		t.filters = append(t.filters, f)
+	}
+	s.tails.mu.Lock()
+	defer s.tails.mu.Unlock()
+	if s.tails.tails == nil {
+		s.tails.tails = make(map[*Tail]struct{})
+	}
+	s.tails.tails[t] = struct{}{}
+	return t, nil
+}
+
+func (s *Store) Untail(t *Tail) {
+	s.tails.mu.Lock()
+	defer s.tails.mu.Unlock()
+	delete(s.tails.tails, t)
+}
+
+// publish passes the inserted rows to the tails of the table without waiting for slow clients, whose rows are dropped
+// and counted instead.
+func (h *tailHub) publish(table string, rows []map[string]any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().UTC()
+	for t := range h.tails {
+		if !strings.EqualFold(t.table, table) {
+			continue
+		}
+		matched := rows
+		if len(t.filters) > 0 {
+			matched = nil
+			for _, row := range rows {
+				if !slices.ContainsFunc(t.filters, func(f tailFilter) bool { return !f.match(row) }) {
+					matched = append(matched, row)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		event := TailEvent{Table: table, Time: now, Rows: matched, Dropped: t.dropped.Swap(0)}
+		select {
+		case t.events <- event:
+		default:
+			t.dropped.Add(event.Dropped + int64(len(matched)))
+		}
+	}
+}
+
+// HandleTail streams the rows inserted into the table in the path over a WebSocket, one JSON TailEvent per insert.
+// Repeated filter parameters narrow the rows.
+func (s *Server) HandleTail(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkWebSocketOrigin(r); err != nil {
+		s.writeError(w, http.StatusForbidden, "handle tail", err)
+		return
+	}
+	tail, err := s.store.Tail(r.PathValue("table"), r.URL.Query()["filter"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle tail", err)
+		return
+	}
+	defer s.store.Untail(tail)
+	conn, err := upgradeWebSocket(w, r)
+	if errors.Is(err, errNotWebSocket) {
+		s.writeError(w, http.StatusBadRequest, "handle tail", err)
+		return
+	}
+	if err != nil {
+		slog.Error("handle tail", "err", err)
+		return
+	}
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-conn.Closed():
+			return
+		case <-ping.C:
+			if err = conn.Ping(); err != nil {
+				conn.Close()
+				return
+			}
+		case event := <-tail.Events():
+			data, marshalErr := json.Marshal(event)
+			if marshalErr != nil {
+				slog.Error("handle tail: encoding event", "err", marshalErr)
+				conn.CloseWith(wsCloseInternalError, "")
+				return
+			}
+			if err = conn.WriteText(data); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TieringPolicy moves the rows of a table older than AfterDays out of DuckDB into Hive partitioned Parquet by day, e.g.
+// s3://bucket/events/dt=2024-01-31/data_<uuid>.parquet. The rows stay queryable through View, which unions the table
+// with the moved rows. The day is taken from the dt column of the table if it has one, else from TimeColumn.
+type TieringPolicy struct {
+	// URL is the object store prefix the rows are moved to. A path without scheme is relative to the export directory
+	// of the server.
+	URL string `json:"url"`
+	// TimeColumn is the date or timestamp column the age of a row is taken from.
+	TimeColumn string `json:"time_column"`
+	AfterDays  int    `json:"after_days"`
+	// View is the name of the view over the table and its moved rows, the table name with the suffix _all by
+	// default.
+	View string `json:"view,omitempty"`
+}
+
+// validateTiering checks the tiering policy of the table and fills in the default view.
+func (s *Store) validateTiering(table string, p *TieringPolicy) error {
+	if _, _, err := s.exportDestination(p.URL); err != nil {
+		return fmt.Errorf("%w: tiering: %w", ErrInvalidTableConfig, err)
+	}
+	if !tableNameRegex.MatchString(p.TimeColumn) {
+		return fmt.Errorf("%w: tiering: time column must match %s", ErrInvalidTableConfig, tableNameRegex)
+	}
+	if p.AfterDays < 1 {
+		return fmt.Errorf("%w: tiering: after days must be at least 1", ErrInvalidTableConfig)
+	}
+	if p.View == "" {
+		p.View = table + "_all"
+	}
+	if !tableNameRegex.MatchString(p.View) || strings.EqualFold(p.View, table) {
+		return fmt.Errorf("%w: tiering: view must match %s and differ from the table", ErrInvalidTableConfig,
+			tableNameRegex)
+	}
+	return nil
+}
+
+// dayPartition returns the expression of the dt partition of a date, timestamp or ISO formatted column.
+func dayPartition(col string) string {
+	return fmt.Sprintf("CAST(CAST(CAST(%s AS TIMESTAMP) AS DATE) AS VARCHAR)", col)
+}
+
+// timestampExpr returns the expression of a date, timestamp or ISO formatted column as a TIMESTAMP to compare with
+// timestamps. DuckDB compares a VARCHAR column cast to TIMESTAMP with a constant as strings instead, which orders
+// "2024-01-01T10:00" after "2024-01-01 11:00", so the cast is wrapped in a function it doesn't see through.
+func timestampExpr(col string) string {
+	return fmt.Sprintf("date_trunc('microseconds', CAST(%s AS TIMESTAMP))", col)
+}
+
+// TierResult describes a run of the tiering policy of a table.
+type TierResult struct {
+	Table string `json:"table"`
+	View  string `json:"view"`
+	// Cutoff is the start of the day before which rows were moved.
+	Cutoff time.Time `json:"cutoff"`
+	Rows   int64     `json:"rows"`
+	// Files lists every file of the moved rows, including those of earlier runs.
+	Files []string `json:"files,omitempty"`
+}
+
+// Tier moves the rows of the table past the age of its tiering policy to Parquet and recreates the view over the
+// table and the moved rows. Writes wait while it runs. The rows are deleted only once they are written, a failure in
+// between leaves them in both places until they are deleted by hand. The space of the deleted rows is reclaimed by the
+// next checkpoint.
+func (s *Store) Tier(ctx context.Context, table string) (*TierResult, error) {
+	policy := s.configs.get(table).Tiering
+	if policy == nil {
+		return nil, fmt.Errorf("%w: table %s has no tiering policy", ErrInvalidTableConfig, table)
+	}
+	cols, err := s.existingColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	timeColumn, err := column(cols, policy.TimeColumn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: tiering: time column: %w", ErrInvalidTableConfig, err)
+	}
+	dest, local, err := s.exportDestination(policy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: tiering: %w", ErrInvalidTableConfig, err)
+	}
+	dest = strings.TrimSuffix(dest, "/")
+	selected, excluded := "*", ""
+	if !cols["dt"] {
+		selected, excluded = "*, "+dayPartition(timeColumn)+" AS dt", " EXCLUDE (dt)"
+	}
+	out := &TierResult{
+		Table:  table,
+		View:   policy.View,
+		Cutoff: time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -policy.AfterDays),
+	}
+	where := timestampExpr(timeColumn) + " < ?"
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	var pending int64
+	if err = s.db.QueryRowContext(
+		ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", quoteIdent(table), where), out.Cutoff,
+	).Scan(&pending); err != nil {
+		return nil, fmt.Errorf("tiering: counting rows: %w", err)
+	}
+	if pending > 0 {
+		manifest, copyErr := s.copyToFiles(
+			ctx,
+			table,
+			fmt.Sprintf("SELECT %s FROM %s WHERE %s", selected, quoteIdent(table), where),
+			[]any{out.Cutoff},
+			exportTarget{
+				dest:        dest,
+				local:       local,
+				partitioned: true,
+				options: "FORMAT PARQUET, COMPRESSION zstd, PARTITION_BY (dt), OVERWRITE_OR_IGNORE, " +
+					"FILENAME_PATTERN 'data_{uuid}'",
+			},
+		)
+		if copyErr != nil {
+			return nil, fmt.Errorf("tiering: %w", copyErr)
+		}
+		out.Rows, out.Files = manifest.Rows, manifest.Files
+		if _, err = s.db.ExecContext(
+			ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdent(table), where), out.Cutoff,
+		); err != nil {
+			return nil, fmt.Errorf("tiering: deleting moved rows: %w", err)
+		}
+	}
+
+	files, err := s.globFiles(ctx, dest+"/**/*.parquet")
+	if err != nil {
+		return nil, fmt.Errorf("tiering: %w", err)
+	}
+	view := fmt.Sprintf("CREATE OR REPLACE VIEW %s AS SELECT * FROM %s", quoteIdent(policy.View), quoteIdent(table))
+	if len(files) > 0 {
+		view += fmt.Sprintf(
+			" UNION ALL BY NAME SELECT *%s FROM read_parquet(%s, hive_partitioning = true, union_by_name = true)",
+			excluded, quoteLiteral(dest+"/**/*.parquet"),
+		)
+	}
+	if _, err = s.db.ExecContext(ctx, view); err != nil {
+		return nil, fmt.Errorf("tiering: creating view: %w", err)
+	}
+	return out, nil
+}
+
+// Tiering runs the tiering policies of the tables every interval once Run is called.
+type Tiering struct {
+	store    *Store
+	interval time.Duration
+}
+
+// NewTiering returns a runner of the tiering policies every interval, zero to run them on demand only.
+func NewTiering(store *Store, interval time.Duration) *Tiering {
+	return &Tiering{store: store, interval: interval}
+}
+
+// Run runs the tiering policies every interval until the context is done. It returns at once without an interval.
+func (t *Tiering) Run(ctx context.Context) {
+	if t.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		tables, err := t.store.Tables(ctx)
+		if err != nil {
+			slog.Error("tiering: listing tables", "err", err)
+			continue
+		}
+		for _, table := range tables {
+			if table.Schema != "main" || t.store.configs.get(table.Name).Tiering == nil {
+				continue
+			}
+			res, tierErr := t.store.Tier(ctx, table.Name)
+			if tierErr != nil {
+				slog.Error("tiering: running policy", "table", table.Name, "err", tierErr)
+				continue
+			}
+			slog.Info("tiering: moved rows", "table", table.Name, "rows", res.Rows, "cutoff", res.Cutoff)
+		}
+	}
+}
+
+// HandleTier runs the tiering policy of the table in the path now.
+func (s *Server) HandleTier(w http.ResponseWriter, r *http.Request) {
+	res, err := s.store.Tier(r.Context(), r.PathValue("table"))
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, "handle tier", err)
+	case errors.Is(err, ErrInvalidTableConfig):
+		s.writeError(w, http.StatusBadRequest, "handle tier", err)
+	case err != nil:
+		s.writeQueryError(w, err)
+	default:
+		s.writeJSON(w, http.StatusOK, "handle tier: writing response", res)
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for a renewed certificate.
+const certCheckInterval = time.Minute
+
+// TLSConfig serves HTTPS with the certificate and key of PEM files. The files are reloaded when they change, so
+// certificates renewed in place, e.g. by certbot, are picked up without a restart.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion is 1.2 or 1.3, empty for 1.2.
+	MinVersion string `yaml:"min_version"`
+	// RedirectAddr is the address of a plaintext listener redirecting to HTTPS, e.g. :80. Empty refuses plaintext, as
+	// the server itself only speaks TLS.
+	RedirectAddr string `yaml:"redirect_addr"`
+	// ClientCAFile is a PEM file of the CAs client certificates are verified against, see ClientCert. Clients without
+	// a certificate authenticate with keys or tokens, unless RequireClientCert refuses them in the handshake.
+	ClientCAFile      string `yaml:"client_ca_file"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// NewTLSConfig loads the certificate and key of the configuration.
+func NewTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: both the certificate and the key file are required")
+	}
+	out := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch cfg.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		out.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("tls: unsupported minimum version %q, expected 1.2 or 1.3", cfg.MinVersion)
+	}
+	if cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: reading client CAs: %w", err)
+		}
+		out.ClientCAs = x509.NewCertPool()
+		if !out.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates in %s", cfg.ClientCAFile)
+		}
+		out.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			out.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if cfg.RequireClientCert {
+		return nil, errors.New("tls: requiring client certificates needs the client CA file")
+	}
+	certs := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	out.GetCertificate = certs.getCertificate
+	return out, nil
+}
+
+// certReloader serves the certificate of the files, reloading them once they change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// modified returns the time the later of the files was modified.
+func (c *certReloader) modified() (time.Time, error) {
+	var out time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("tls: %w", err)
+		}
+		if info.ModTime().After(out) {
+			out = info.ModTime()
+		}
+	}
+	return out, nil
+}
+
+// load reads the files. The caller holds the lock or has the reloader to itself.
+func (c *certReloader) load() error {
+	modTime, err := c.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: loading certificate: %w", err)
+	}
+	c.cert, c.modTime, c.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	// Failing to reload keeps the current certificate, a renewal may be writing the files right now.
+	if modTime, err := c.modified(); err != nil {
+		slog.Error("checking certificate", "err", err)
+	} else if modTime.After(c.modTime) {
+		if err = c.load(); err != nil {
+			slog.Error("reloading certificate", "err", err)
+		} else {
+			slog.Info("reloaded certificate", "file", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// RedirectHTTPS redirects every request to the same URL over HTTPS on the port of the HTTPS address.
+func RedirectHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
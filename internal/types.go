@@ -0,0 +1,155 @@
+package internal
+
+// JSONKind is the kind of a decoded JSON value as seen by the ingest path.
+type JSONKind string
+
+const (
+	JSONString JSONKind = "string"
+	JSONNumber JSONKind = "number"
+	JSONBool   JSONKind = "boolean"
+)
+
+// CoercionRule describes what happens when a JSON value is inserted into an existing column of a given type.
+type CoercionRule string
+
+const (
+	// CoercionExact stores the value as is.
+	CoercionExact CoercionRule = "exact"
+	// CoercionCast stores the value through an implicit DuckDB cast, which may lose precision.
+	CoercionCast CoercionRule = "cast"
+	// CoercionParse stores strings only if they parse as the column type, otherwise the insert is rejected.
+	CoercionParse CoercionRule = "parse"
+)
+
+type Coercion struct {
+	From JSONKind     `json:"from"`
+	Rule CoercionRule `json:"rule"`
+	Note string       `json:"note,omitempty"`
+}
+
+// TypeInfo describes a DataType for clients designing payloads.
+type TypeInfo struct {
+	Name string `json:"name"`
+	// InferredFrom lists the JSON kinds that create a column of this type when the column doesn't exist yet.
+	InferredFrom []JSONKind `json:"inferred_from"`
+	Coercions    []Coercion `json:"coercions"`
+	Note         string     `json:"note,omitempty"`
+}
+
+// TypeCatalog is the description of the type system served on GET /types.
+type TypeCatalog struct {
+	Types []TypeInfo `json:"types"`
+	// Widening describes if and how existing column types change when incompatible values arrive.
+	Widening string `json:"widening"`
+	Limits   Limits `json:"limits"`
+}
+
+// Info describes the DataType. INVALID returns an empty TypeInfo.
+func (k DataType) Info() TypeInfo {
+	switch k {
+	case VARCHAR:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{JSONString},
+			Coercions: []Coercion{
+				{From: JSONString, Rule: CoercionExact},
+				{From: JSONNumber, Rule: CoercionCast, Note: "stored as its decimal text"},
+				{From: JSONBool, Rule: CoercionCast, Note: "stored as 'true' or 'false'"},
+			},
+		}
+	case DOUBLE:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{JSONNumber},
+			Coercions: []Coercion{
+				{From: JSONNumber, Rule: CoercionExact},
+				{From: JSONBool, Rule: CoercionCast, Note: "stored as 1 or 0"},
+				{From: JSONString, Rule: CoercionParse},
+			},
+		}
+	case INTEGER:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{},
+			Coercions: []Coercion{
+				{From: JSONNumber, Rule: CoercionCast, Note: "fractions are rounded"},
+				{From: JSONBool, Rule: CoercionCast, Note: "stored as 1 or 0"},
+				{From: JSONString, Rule: CoercionParse},
+			},
+			Note: "never inferred from JSON since the numbers up to 2^53 decode as DOUBLE",
+		}
+	case BIGINT, HUGEINT:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{JSONNumber},
+			Coercions: []Coercion{
+				{From: JSONNumber, Rule: CoercionCast, Note: "fractions are rounded"},
+				{From: JSONBool, Rule: CoercionCast, Note: "stored as 1 or 0"},
+				{From: JSONString, Rule: CoercionParse},
+			},
+			Note: "inferred from integers beyond 2^53, which a DOUBLE can't hold exactly, HUGEINT past the BIGINT range",
+		}
+	case DECIMAL:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{},
+			Coercions: []Coercion{
+				{From: JSONString, Rule: CoercionParse, Note: "decimal strings are stored exactly"},
+				{From: JSONNumber, Rule: CoercionCast, Note: "decoded as DOUBLE first, rounded to the scale"},
+			},
+			Note: "declared as DECIMAL(p,s) in the table configuration or inferred from decimal strings with " +
+				"decimal_strings, returned as exact JSON numbers",
+		}
+	case BLOB:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{},
+			Coercions: []Coercion{
+				{From: JSONString, Rule: CoercionParse, Note: "decoded from standard base64"},
+			},
+			Note: "declared in the table configuration, returned as base64 strings in JSON",
+		}
+	case GEOMETRY:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{},
+			Coercions: []Coercion{
+				{From: JSONString, Rule: CoercionParse, Note: "parsed as WKT"},
+			},
+			Note: "declared in the table configuration with the spatial extension loaded, also takes GeoJSON " +
+				"geometries and objects of lat and lon",
+		}
+	case ENUM:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{},
+			Coercions: []Coercion{
+				{From: JSONString, Rule: CoercionParse, Note: "new values are added to the type unless it is strict"},
+			},
+			Note: "declared with its values in the table configuration, returned as strings",
+		}
+	case BOOLEAN:
+		return TypeInfo{
+			Name:         k.DBType(),
+			InferredFrom: []JSONKind{JSONBool},
+			Coercions: []Coercion{
+				{From: JSONBool, Rule: CoercionExact},
+				{From: JSONNumber, Rule: CoercionCast, Note: "non-zero is true"},
+				{From: JSONString, Rule: CoercionParse, Note: "accepts 'true' and 'false'"},
+			},
+		}
+	case INVALID:
+	}
+	return TypeInfo{}
+}
+
+func NewTypeCatalog(limits Limits) *TypeCatalog {
+	c := &TypeCatalog{
+		Widening: "none: column types are fixed when the column is created",
+		Limits:   limits,
+	}
+	for _, k := range []DataType{VARCHAR, DOUBLE, INTEGER, BIGINT, HUGEINT, DECIMAL, BLOB, GEOMETRY, ENUM, BOOLEAN} {
+		c.Types = append(c.Types, k.Info())
+	}
+	return c
+}
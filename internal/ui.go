@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiRoutes are the routes of the admin web UI, the files and the redirect to the index.
+//
+//nolint:gochecknoglobals // Read-only set of routes.
+var uiRoutes = map[string]bool{"GET /admin/ui/": true, "GET /admin/ui": true}
+
+//go:embed ui
+var uiFiles embed.FS
+
+// WithUI serves the admin web UI under /admin/ui/: a table browser with the schemas and first rows of the tables, a SQL
+// console and dashboards of the ingests, queries and runtime. The page itself is served without authentication, it
+// asks for an API key and sends it on its calls to the API like any other client.
+func WithUI() ServerOption {
+	return func(s *Server) {
+		s.ui = true
+	}
+}
+
+// handleUI registers the files of the web UI on the mux.
+func (s *Server) handleUI(m *routeMux) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		// The directory is embedded, it can't be missing.
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/admin/ui", http.FileServerFS(files))
+	m.Handle("GET /admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
+	m.Handle("GET /admin/ui/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The UI only talks to this server and renders the data it reads as text.
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	}))
+}
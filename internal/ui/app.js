@@ -0,0 +1,233 @@
+'use strict';
+
+// The admin web UI of scratch. It calls the JSON API of the server it is served by, with the API key or token kept in
+// the session storage of the tab. Values read from the API are only ever rendered as text.
+
+const keyStorage = 'scratch-key';
+
+function el(tag, attrs = {}, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs)) {
+    node.setAttribute(name, value);
+  }
+  for (const child of children) {
+    node.append(child);
+  }
+  return node;
+}
+
+function showError(err) {
+  const box = document.getElementById('error');
+  box.textContent = err ? err.message : '';
+  box.hidden = !err;
+}
+
+async function api(method, path, body) {
+  const headers = {Accept: 'application/json'};
+  const key = sessionStorage.getItem(keyStorage);
+  if (key) {
+    headers.Authorization = 'Bearer ' + key;
+  }
+  if (body !== undefined) {
+    headers['Content-Type'] = 'application/json';
+  }
+  const res = await fetch(path, {method, headers, body: body === undefined ? undefined : JSON.stringify(body)});
+  const data = await res.json().catch(() => null);
+  if (!res.ok) {
+    const err = new Error(data && data.message ? data.message : res.status + ' ' + res.statusText);
+    err.status = res.status;
+    throw err;
+  }
+  return data;
+}
+
+function formatValue(value) {
+  if (value === null || value === undefined) {
+    return 'null';
+  }
+  if (typeof value === 'object') {
+    return JSON.stringify(value);
+  }
+  return String(value);
+}
+
+function formatBytes(n) {
+  const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + ' ' + units[i];
+}
+
+// grid renders rows as a table with the columns, each a name and optionally a type.
+function grid(columns, rows) {
+  const head = el('tr');
+  for (const col of columns) {
+    const th = el('th', {}, col.name);
+    if (col.type) {
+      th.append(el('small', {}, col.type));
+    }
+    head.append(th);
+  }
+  const body = el('tbody');
+  for (const row of rows) {
+    const tr = el('tr');
+    for (const col of columns) {
+      const value = row[col.name];
+      tr.append(el('td', value === null || value === undefined ? {class: 'null'} : {}, formatValue(value)));
+    }
+    body.append(tr);
+  }
+  return el('div', {class: 'grid'}, el('table', {}, el('thead', {}, head), body));
+}
+
+function keyValues(obj) {
+  const rows = Object.entries(obj).map(([name, value]) => ({name, value}));
+  return grid([{name: 'name'}, {name: 'value'}], rows);
+}
+
+function message(text) {
+  return el('p', {class: 'muted'}, text);
+}
+
+// Tables
+
+async function loadTables() {
+  const list = document.getElementById('table-list');
+  try {
+    const tables = await api('GET', '/tables');
+    showError(null);
+    list.replaceChildren(...tables.map((t) => {
+      const item = el('li', {'data-table': t.name}, t.name, ' ',
+        el('span', {class: 'muted'}, t.rows + ' rows, ' + formatBytes(t.approx_bytes)));
+      item.addEventListener('click', () => showTable(t.name));
+      return item;
+    }));
+    if (tables.length === 0) {
+      list.replaceChildren(message('No tables yet.'));
+    }
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function showTable(name) {
+  for (const item of document.querySelectorAll('#table-list li')) {
+    item.classList.toggle('active', item.dataset.table === name);
+  }
+  const detail = document.getElementById('table-detail');
+  const path = '/tables/' + encodeURIComponent(name);
+  try {
+    const [schema, rows] = await Promise.all([
+      api('GET', path + '/schema'),
+      api('GET', path + '/rows?limit=100&envelope=true'),
+    ]);
+    showError(null);
+    detail.replaceChildren(
+      el('h2', {}, name),
+      el('h3', {}, 'Schema', el('span', {class: 'muted'}, schema.version ? ' version ' + schema.version : '')),
+      grid([{name: 'name'}, {name: 'type'}, {name: 'nullable'}, {name: 'default'}, {name: 'generated'},
+        {name: 'added_at'}], schema.columns),
+      el('h3', {}, 'First rows'),
+      grid(rows.columns, rows.rows),
+    );
+  } catch (err) {
+    showError(err);
+  }
+}
+
+// SQL console
+
+async function runQuery(event) {
+  event.preventDefault();
+  const status = document.getElementById('query-status');
+  const result = document.getElementById('result');
+  const path = document.getElementById('admin').checked ? '/admin/query' : '/query';
+  const limit = parseInt(document.getElementById('limit').value, 10) || 0;
+  status.textContent = 'Running…';
+  try {
+    const res = await api('POST', path + '?envelope=true', {sql: document.getElementById('sql').value, limit});
+    showError(null);
+    status.textContent = res.row_count + ' rows in ' + res.elapsed_ms + ' ms' + (res.truncated ? ', truncated' : '');
+    result.replaceChildren(grid(res.columns, res.rows));
+  } catch (err) {
+    status.textContent = '';
+    showError(err);
+  }
+}
+
+// Dashboard
+
+// card fills the card with what render makes of the loaded response, or with the hint if the endpoint is disabled.
+async function card(id, load, render, hint) {
+  const target = document.getElementById(id);
+  try {
+    target.replaceChildren(render(await load()));
+  } catch (err) {
+    target.replaceChildren(message(err.status === 404 ? hint : err.message));
+  }
+}
+
+function loadIngests() {
+  const since = new Date(Date.now() - 3600 * 1000).toISOString().replace('T', ' ').replace('Z', '');
+  return api('POST', '/query?envelope=true', {
+    sql: `SELECT target AS "table", count(*) AS requests, sum(row_count)::BIGINT AS "rows",
+        count(*) FILTER (WHERE status >= 400) AS failed, max(created_at) AS last
+      FROM _audit WHERE kind = 'ingest' AND created_at > ?::TIMESTAMP
+      GROUP BY target ORDER BY "rows" DESC NULLS LAST`,
+    params: [since],
+  });
+}
+
+function refreshDashboard() {
+  card('ingests', loadIngests, (res) => res.rows.length ? grid(res.columns, res.rows) : message('No ingests.'),
+    'Needs the audit log, see -audit-retention.');
+  card('queries', () => api('GET', '/admin/queries'),
+    (queries) => queries.length
+      ? grid([{name: 'id'}, {name: 'caller'}, {name: 'elapsed_ms'}, {name: 'sql'}], queries)
+      : message('No queries running.'),
+    'Not available.');
+  card('tenants', () => api('GET', '/admin/tenants'),
+    (usages) => grid([{name: 'tenant'}, {name: 'tables'}, {name: 'bytes'}, {name: 'rows_today'}, {name: 'quota'}],
+      usages),
+    'Needs quotas.');
+  card('checkpoint', () => api('GET', '/admin/checkpoint'), keyValues, 'Needs checkpoints of the database.');
+  card('runtime', () => api('GET', '/admin/debug/runtime'), keyValues, 'Needs -debug-endpoints.');
+}
+
+// Setup
+
+function showView(name) {
+  for (const button of document.querySelectorAll('nav button')) {
+    button.classList.toggle('active', button.dataset.view === name);
+  }
+  for (const view of document.querySelectorAll('.view')) {
+    view.hidden = view.id !== name;
+  }
+  if (name === 'dashboard') {
+    refreshDashboard();
+  }
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+  document.getElementById('key').value = sessionStorage.getItem(keyStorage) || '';
+  document.getElementById('auth').addEventListener('submit', (event) => {
+    event.preventDefault();
+    sessionStorage.setItem(keyStorage, document.getElementById('key').value.trim());
+    loadTables();
+  });
+  for (const button of document.querySelectorAll('nav button')) {
+    button.addEventListener('click', () => showView(button.dataset.view));
+  }
+  document.getElementById('refresh-tables').addEventListener('click', loadTables);
+  document.getElementById('query').addEventListener('submit', runQuery);
+  document.getElementById('refresh-dashboard').addEventListener('click', refreshDashboard);
+  let timer = null;
+  document.getElementById('auto-refresh').addEventListener('change', (event) => {
+    clearInterval(timer);
+    timer = event.target.checked ? setInterval(refreshDashboard, 5000) : null;
+  });
+  loadTables();
+});
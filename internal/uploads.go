@@ -0,0 +1,586 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUploadRetention is how long an upload session is kept after it was created unless configured otherwise.
+	DefaultUploadRetention = 24 * time.Hour
+	// maxUploadParts bounds the number of parts of an upload session.
+	maxUploadParts = 10000
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrInvalidUpload  = errors.New("invalid upload")
+	ErrUploadBusy     = errors.New("upload is being committed")
+)
+
+// uploadDirRegex matches the directories of upload sessions in the upload directory.
+var uploadDirRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// UploadRequest creates an upload session for the table in the path.
+type UploadRequest struct {
+	// Format is parquet, csv, json, which takes newline-delimited JSON too, or xlsx.
+	Format string `json:"format"`
+	// Append inserts into an existing table, matching columns by name. Otherwise the table is created on commit and
+	// must not exist yet.
+	Append bool `json:"append,omitempty"`
+	// Sheet is the sheet of an xlsx workbook to load, the first one by default.
+	Sheet string `json:"sheet,omitempty"`
+	// HeaderRow is the row of an xlsx sheet, counted from 1, that names the columns. The rows below it are loaded.
+	HeaderRow int `json:"header_row,omitempty"`
+	// CSV sets the dialect of a CSV file.
+	CSV *CSVOptions `json:"csv,omitempty"`
+}
+
+// CommitUploadRequest is the optional body of the commit of an upload session.
+type CommitUploadRequest struct {
+	// SHA256 is checked against the checksum of the assembled file if set.
+	SHA256 string `json:"sha256,omitempty"`
+	// Async commits in the background as an ImportJob, which the response is then.
+	Async bool `json:"async,omitempty"`
+}
+
+// UploadPart is a part of an upload session, stored as it was received.
+type UploadPart struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Upload is a session uploading a file in parts, numbered from 0, that are sent in any order and again after a failed
+// transfer. The commit assembles the parts and loads the file into the table in one statement, so the table sees
+// either all of its rows or none.
+type Upload struct {
+	ID        string       `json:"id"`
+	Table     string       `json:"table"`
+	Format    string       `json:"format"`
+	Append    bool         `json:"append,omitempty"`
+	Sheet     string       `json:"sheet,omitempty"`
+	HeaderRow int          `json:"header_row,omitempty"`
+	CSV       *CSVOptions  `json:"csv,omitempty"`
+	Parts     []UploadPart `json:"parts"`
+	Size      int64        `json:"size"`
+	Caller    string       `json:"caller"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+
+	committing bool
+}
+
+// Uploads keeps the parts of the upload sessions in a directory of each session until they are committed, aborted or
+// expire. The sessions themselves live in memory, the directories of an earlier run are removed when it is opened.
+type Uploads struct {
+	dir       string
+	retention time.Duration
+
+	mu   sync.Mutex
+	byID map[string]*Upload
+}
+
+// NewUploads opens the upload directory, creating it if needed. Sessions expire after the retention, the default if
+// it is zero.
+func NewUploads(dir string, retention time.Duration) (*Uploads, error) {
+	if retention <= 0 {
+		retention = DefaultUploadRetention
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("uploads: creating directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("uploads: reading directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && uploadDirRegex.MatchString(e.Name()) {
+			if err = os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return nil, fmt.Errorf("uploads: removing leftover session: %w", err)
+			}
+		}
+	}
+	return &Uploads{dir: dir, retention: retention, byID: make(map[string]*Upload)}, nil
+}
+
+// WithUploads serves the upload session endpoints. Without it, creating a session fails.
+func WithUploads(uploads *Uploads) ServerOption {
+	return func(s *Server) {
+		s.uploads = uploads
+	}
+}
+
+func (us *Uploads) path(u *Upload, name string) string {
+	return filepath.Join(us.dir, u.ID, name)
+}
+
+func (us *Uploads) add(u *Upload) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.prune()
+	us.byID[u.ID] = u
+}
+
+// get returns a copy of the session of the table if the request may see it, see ownedBy.
+func (us *Uploads) get(r *http.Request, table, id string) (Upload, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, err := us.lookup(r, table, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	out := *u
+	out.Parts = slices.Clone(u.Parts)
+	return out, nil
+}
+
+// lookup returns the session like get. The caller holds the lock.
+func (us *Uploads) lookup(r *http.Request, table, id string) (*Upload, error) {
+	us.prune()
+	u, ok := us.byID[id]
+	if !ok || !strings.EqualFold(u.Table, table) || !ownedBy(r, u.Caller) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	return u, nil
+}
+
+// setPart records the part, replacing one of the same number, unless the session is gone or being committed.
+func (us *Uploads) setPart(r *http.Request, table, id string, part UploadPart) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, err := us.lookup(r, table, id)
+	if err != nil {
+		return err
+	}
+	if u.committing {
+		return fmt.Errorf("%w: %s", ErrUploadBusy, id)
+	}
+	i, found := slices.BinarySearchFunc(u.Parts, part.Number, func(p UploadPart, n int) int { return p.Number - n })
+	if found {
+		u.Size -= u.Parts[i].Size
+		u.Parts[i] = part
+	} else {
+		u.Parts = slices.Insert(u.Parts, i, part)
+	}
+	u.Size += part.Size
+	return nil
+}
+
+// beginCommit marks the session as being committed, which refuses further parts and commits, and returns a copy.
+func (us *Uploads) beginCommit(r *http.Request, table, id string) (Upload, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, err := us.lookup(r, table, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if u.committing {
+		return Upload{}, fmt.Errorf("%w: %s", ErrUploadBusy, id)
+	}
+	u.committing = true
+	out := *u
+	out.Parts = slices.Clone(u.Parts)
+	return out, nil
+}
+
+// endCommit removes the session once it was loaded, or takes parts again after a failed commit.
+func (us *Uploads) endCommit(id string, loaded bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, ok := us.byID[id]
+	if !ok {
+		return
+	}
+	u.committing = false
+	if loaded {
+		delete(us.byID, id)
+		us.removeFiles(id)
+	}
+}
+
+// abort removes the session of the table and its parts unless it is being committed.
+func (us *Uploads) abort(r *http.Request, table, id string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, err := us.lookup(r, table, id)
+	if err != nil {
+		return err
+	}
+	if u.committing {
+		return fmt.Errorf("%w: %s", ErrUploadBusy, id)
+	}
+	delete(us.byID, id)
+	us.removeFiles(id)
+	return nil
+}
+
+// prune removes the expired sessions that aren't being committed. The caller holds the lock.
+func (us *Uploads) prune() {
+	now := time.Now()
+	for id, u := range us.byID {
+		if !u.committing && now.After(u.ExpiresAt) {
+			delete(us.byID, id)
+			us.removeFiles(id)
+		}
+	}
+}
+
+func (us *Uploads) removeFiles(id string) {
+	if err := os.RemoveAll(filepath.Join(us.dir, id)); err != nil {
+		slog.Error("uploads: removing session", "id", id, "err", err)
+	}
+}
+
+// uploadFormat returns the import format of the format of a session.
+func uploadFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	if format == "ndjson" || format == "jsonl" {
+		format = "json"
+	}
+	if _, ok := importReaders[format]; !ok && format != "xlsx" {
+		return "", fmt.Errorf("%w: unsupported format %q, use parquet, csv, json or xlsx", ErrInvalidUpload, format)
+	}
+	return format, nil
+}
+
+// writePart writes the body to the file of the part through a temporary file, so a broken transfer leaves the part
+// received before, if any, in place.
+func writePart(path string, body io.Reader) (int64, string, error) {
+	h := sha256.New()
+	n, err := copyFileAtomic(path, io.TeeReader(body, h))
+	if err != nil {
+		return 0, "", fmt.Errorf("uploads: storing part: %w", err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// assemble concatenates the parts of the session, which must be numbered from 0 without gaps, to the file at the path
+// and returns its SHA-256. The bytes are written to progress too unless it is nil.
+func (us *Uploads) assemble(u Upload, path string, progress io.Writer) (string, error) {
+	if len(u.Parts) == 0 {
+		return "", fmt.Errorf("%w: no parts were uploaded", ErrInvalidUpload)
+	}
+	for i, p := range u.Parts {
+		if p.Number != i {
+			return "", fmt.Errorf("%w: part %d is missing", ErrInvalidUpload, i)
+		}
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("uploads: creating file: %w", err)
+	}
+	h := sha256.New()
+	dst := io.MultiWriter(out, h)
+	if progress != nil {
+		dst = io.MultiWriter(out, h, progress)
+	}
+	for _, p := range u.Parts {
+		if err = appendFile(dst, us.path(&u, partName(p.Number))); err != nil {
+			break
+		}
+	}
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("uploads: closing file: %w", closeErr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("uploads: opening part: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Error("uploads: closing part", "err", closeErr)
+		}
+	}()
+	if _, err = io.Copy(w, f); err != nil {
+		return fmt.Errorf("uploads: assembling parts: %w", err)
+	}
+	return nil
+}
+
+func partName(number int) string {
+	return fmt.Sprintf("%05d.part", number)
+}
+
+// writeUploadError answers the errors of the upload session endpoints.
+func (s *Server) writeUploadError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, ErrUploadNotFound), errors.Is(err, ErrTableNotFound):
+		s.writeError(w, http.StatusNotFound, op, err)
+	case errors.Is(err, ErrUploadBusy), errors.Is(err, ErrTableExists), errors.Is(err, ErrTypeConflict),
+		errors.Is(err, ErrConstrainedColumn):
+		s.writeError(w, http.StatusConflict, op, err)
+	case errors.Is(err, ErrInvalidInsert), errors.Is(err, ErrConstraintViolation), errors.Is(err, ErrGeneratedColumn):
+		s.writeError(w, http.StatusUnprocessableEntity, op, err)
+	case errors.Is(err, ErrInvalidUpload), errors.Is(err, ErrInvalidImport):
+		s.writeError(w, http.StatusBadRequest, op, err)
+	default:
+		s.writeQueryError(w, err)
+	}
+}
+
+// HandleCreateUpload creates an upload session for the table in the path and responds with it.
+func (s *Server) HandleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle create upload: decoding request body", err)
+		return
+	}
+	if s.uploads == nil {
+		s.writeError(w, http.StatusBadRequest, "handle create upload",
+			fmt.Errorf("%w: uploads are disabled", ErrInvalidUpload))
+		return
+	}
+	format, err := uploadFormat(req.Format)
+	switch {
+	case err != nil:
+	case req.HeaderRow < 0:
+		err = fmt.Errorf("%w: header_row must be positive", ErrInvalidUpload)
+	case format != "xlsx" && (req.Sheet != "" || req.HeaderRow != 0):
+		err = fmt.Errorf("%w: sheet and header_row only apply to xlsx", ErrInvalidUpload)
+	case format == "xlsx" && req.HeaderRow == 0:
+		req.HeaderRow = 1
+	case format == "xlsx" && req.CSV != nil:
+		err = fmt.Errorf("%w: csv options only apply to csv files", ErrInvalidUpload)
+	case format != "xlsx":
+		_, err = importReader(format, "", req.CSV)
+	}
+	if err == nil {
+		err = s.store.checkImportTable(r.Context(), r.PathValue("table"), req.Append)
+	}
+	if err != nil {
+		s.writeUploadError(w, "handle create upload", err)
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle create upload", err)
+		return
+	}
+	now := time.Now().UTC()
+	u := &Upload{
+		ID:        id,
+		Table:     r.PathValue("table"),
+		Format:    format,
+		Append:    req.Append,
+		Sheet:     req.Sheet,
+		HeaderRow: req.HeaderRow,
+		CSV:       req.CSV,
+		Parts:     []UploadPart{},
+		Caller:    caller(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.uploads.retention),
+	}
+	if err = os.Mkdir(filepath.Join(s.uploads.dir, id), 0o700); err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle create upload", err)
+		return
+	}
+	s.uploads.add(u)
+	s.writeJSON(w, http.StatusCreated, "handle create upload: writing response", u)
+}
+
+// upload returns the session named in the path, or writes the error and returns false.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, op string) (Upload, bool) {
+	if s.uploads == nil {
+		s.writeError(w, http.StatusNotFound, op, fmt.Errorf("%w: %s", ErrUploadNotFound, r.PathValue("id")))
+		return Upload{}, false
+	}
+	u, err := s.uploads.get(r, r.PathValue("table"), r.PathValue("id"))
+	if err != nil {
+		s.writeUploadError(w, op, err)
+		return Upload{}, false
+	}
+	return u, true
+}
+
+// HandleGetUpload responds with the upload session, whose parts tell where an interrupted upload resumes.
+func (s *Server) HandleGetUpload(w http.ResponseWriter, r *http.Request) {
+	if u, ok := s.upload(w, r, "handle get upload"); ok {
+		s.writeJSON(w, http.StatusOK, "handle get upload: writing response", u)
+	}
+}
+
+// HandlePutUploadPart stores the body as the part numbered in the path, replacing the part if it was sent before.
+// Parts are bounded by the size of request bodies, see WithMaxBodyBytes.
+func (s *Server) HandlePutUploadPart(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.upload(w, r, "handle put upload part")
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(r.PathValue("part"))
+	if err != nil || number < 0 || number >= maxUploadParts {
+		s.writeError(w, http.StatusBadRequest, "handle put upload part",
+			fmt.Errorf("%w: part must be a number from 0 to %d", ErrInvalidUpload, maxUploadParts-1))
+		return
+	}
+	if u.committing {
+		s.writeUploadError(w, "handle put upload part", fmt.Errorf("%w: %s", ErrUploadBusy, u.ID))
+		return
+	}
+	s.limitBody(w, r)
+	liftWriteTimeout(w)
+	part := UploadPart{Number: number}
+	part.Size, part.SHA256, err = writePart(s.uploads.path(&u, partName(number)), r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle put upload part", err)
+		return
+	}
+	if err = s.uploads.setPart(r, u.Table, u.ID, part); err != nil {
+		s.writeUploadError(w, "handle put upload part", err)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(part.SHA256))
+	s.writeJSON(w, http.StatusOK, "handle put upload part: writing response", part)
+}
+
+// HandleCommitUpload assembles the parts of the upload session and loads the file into its table, in an import job if
+// the request is async. Once loaded, the session is removed, after a failed commit it takes parts and commits again.
+func (s *Server) HandleCommitUpload(w http.ResponseWriter, r *http.Request) {
+	markAudit(r.Context(), AuditIngest, r.PathValue("table"))
+	var req CommitUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.writeError(w, http.StatusBadRequest, "handle commit upload: decoding request body", err)
+		return
+	}
+	if s.uploads == nil {
+		s.writeError(w, http.StatusNotFound, "handle commit upload",
+			fmt.Errorf("%w: %s", ErrUploadNotFound, r.PathValue("id")))
+		return
+	}
+	u, err := s.uploads.beginCommit(r, r.PathValue("table"), r.PathValue("id"))
+	if err != nil {
+		s.writeUploadError(w, "handle commit upload", err)
+		return
+	}
+	if req.Async {
+		job, startErr := s.importJobs.start(r,
+			ImportJob{Kind: ImportJobUpload, Table: u.Table, Source: u.ID, BytesTotal: u.Size},
+			func(ctx context.Context, j *importJob) (*ImportResponse, error) {
+				res, err := s.commitUpload(ctx, u, req, j)
+				s.uploads.endCommit(u.ID, err == nil)
+				return res, err
+			})
+		if startErr != nil {
+			s.uploads.endCommit(u.ID, false)
+			s.writeError(w, http.StatusInternalServerError, "handle commit upload", startErr)
+			return
+		}
+		s.writeImportJob(w, "handle commit upload: writing response", job)
+		return
+	}
+	liftWriteTimeout(w)
+	res, err := s.commitUpload(r.Context(), u, req, nil)
+	s.uploads.endCommit(u.ID, err == nil)
+	var ioErr *uploadIOError
+	switch {
+	case errors.As(err, &ioErr):
+		s.writeError(w, http.StatusInternalServerError, "handle commit upload", err)
+		return
+	case err != nil:
+		s.writeUploadError(w, "handle commit upload", err)
+		return
+	}
+	markAuditRows(r.Context(), int(res.Rows))
+	code := http.StatusCreated
+	if u.Append {
+		code = http.StatusOK
+	}
+	s.writeJSON(w, code, "handle commit upload: writing response", res)
+}
+
+// uploadIOError is a failure to assemble the parts of an upload session that isn't caused by the request.
+type uploadIOError struct {
+	err error
+}
+
+func (e *uploadIOError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uploadIOError) Unwrap() error {
+	return e.err
+}
+
+// commitUpload loads the session into its table, writing the assembled bytes to progress unless it is nil.
+func (s *Server) commitUpload(
+	ctx context.Context, u Upload, req CommitUploadRequest, progress io.Writer,
+) (*ImportResponse, error) {
+	path := s.uploads.path(&u, "data."+u.Format)
+	defer func() {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("uploads: removing assembled file", "id", u.ID, "err", err)
+		}
+	}()
+	sum, err := s.uploads.assemble(u, path, progress)
+	if err != nil && !errors.Is(err, ErrInvalidUpload) {
+		return nil, &uploadIOError{err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, sum) {
+		return nil, fmt.Errorf("%w: the assembled file has the SHA-256 %s, not %s", ErrInvalidUpload, sum, req.SHA256)
+	}
+	if err = s.store.checkImportTable(ctx, u.Table, u.Append); err != nil {
+		return nil, err
+	}
+	if u.Format == "xlsx" {
+		return s.loadXLSX(ctx, u, path)
+	}
+	reader, err := importReader(u.Format, path, u.CSV)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.load(ctx, u.Table, reader, u.Append)
+}
+
+// loadXLSX inserts the rows of the sheet of the workbook like those of POST /data, which infers the types of the
+// columns. The rows are committed in chunks, see InsertStatement.Chunks.
+func (s *Server) loadXLSX(ctx context.Context, u Upload, path string) (*ImportResponse, error) {
+	rows, err := readXLSX(path, u.Sheet, u.HeaderRow)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: xlsx: no rows below the header row %d", ErrInvalidUpload, u.HeaderRow)
+	}
+	stmt := &InsertStatement{Table: u.Table, Rows: rows}
+	if err = s.store.Insert(ctx, stmt); err != nil {
+		return nil, err
+	}
+	return &ImportResponse{Table: u.Table, Rows: int64(len(rows))}, nil
+}
+
+// HandleAbortUpload removes the upload session and its parts.
+func (s *Server) HandleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.upload(w, r, "handle abort upload"); !ok {
+		return
+	}
+	if err := s.uploads.abort(r, r.PathValue("table"), r.PathValue("id")); err != nil {
+		s.writeUploadError(w, "handle abort upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
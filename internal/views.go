@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrViewNotFound = errors.New("materialized view not found")
+	ErrViewExists   = errors.New("a table with the name of the view exists")
+)
+
+// MaterializedView is a table that holds the result of SQL, refreshed on demand and, with a RefreshInterval, in the
+// background. Queries read the view by its Name like any other table.
+type MaterializedView struct {
+	Name            string `json:"name"`
+	SQL             string `json:"sql"`
+	Params          []any  `json:"params,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	NextRefresh *time.Time `json:"next_refresh,omitempty"`
+	LastRows    int64      `json:"last_rows"`
+	RefreshMS   int64      `json:"refresh_ms"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Validate checks the name and query and returns the refresh interval, zero for manual refresh only.
+func (v *MaterializedView) Validate() (time.Duration, error) {
+	if !tableNameRegex.MatchString(v.Name) {
+		return 0, fmt.Errorf("invalid materialized view: name must match %s", tableNameRegex)
+	}
+	if _, err := (&QueryStatement{Query: v.SQL}).singleRead(); err != nil {
+		return 0, err
+	}
+	if v.RefreshInterval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(v.RefreshInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid materialized view: parsing refresh interval: %w", err)
+	}
+	if interval < time.Second {
+		return 0, errors.New("invalid materialized view: refresh interval must be at least 1s")
+	}
+	return interval, nil
+}
+
+// DropTable removes the table if it exists.
+func (s *Store) DropTable(ctx context.Context, table string) error {
+	if !tableNameRegex.MatchString(table) {
+		return fmt.Errorf("drop table: invalid table name %q", table)
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	defer s.generation.Add(1)
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+		return fmt.Errorf("drop table: %w", err)
+	}
+	s.inserts.invalidate(table)
+	s.ingest.remove(table)
+	return nil
+}
+
+type viewEntry struct {
+	view       MaterializedView
+	interval   time.Duration
+	refreshing sync.Mutex
+	// deleted stops refreshes that were started before the view was deleted from recreating its table.
+	deleted bool
+}
+
+// Views manages the materialized views of a store and refreshes those with an interval once Run is called.
+type Views struct {
+	store   *Store
+	timeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*viewEntry
+	wake    chan struct{}
+}
+
+// NewViews returns a view manager whose refreshes are bound by timeout, zero for no bound.
+func NewViews(store *Store, timeout time.Duration) *Views {
+	return &Views{
+		store:   store,
+		timeout: timeout,
+		entries: make(map[string]*viewEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Put creates or redefines a view and refreshes it before returning. A view can't take over an existing table.
+func (vs *Views) Put(ctx context.Context, v MaterializedView) (MaterializedView, bool, error) {
+	interval, err := v.Validate()
+	if err != nil {
+		return MaterializedView{}, false, err
+	}
+	vs.mu.Lock()
+	_, exists := vs.entries[v.Name]
+	vs.mu.Unlock()
+	if !exists {
+		cols, colsErr := vs.store.tableColumns(ctx, v.Name)
+		if colsErr != nil {
+			return MaterializedView{}, false, colsErr
+		}
+		if len(cols) > 0 {
+			return MaterializedView{}, false, fmt.Errorf("%w: %s", ErrViewExists, v.Name)
+		}
+	}
+
+	e := &viewEntry{view: v, interval: interval}
+	e.view.LastRefresh, e.view.NextRefresh, e.view.LastRows, e.view.RefreshMS, e.view.LastError = nil, nil, 0, 0, ""
+	if err = vs.refresh(ctx, e); err != nil {
+		return MaterializedView{}, false, err
+	}
+	vs.mu.Lock()
+	vs.entries[v.Name] = e
+	out := e.view
+	vs.mu.Unlock()
+	vs.notify()
+	return out, !exists, nil
+}
+
+func (vs *Views) Get(name string) (MaterializedView, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	e, ok := vs.entries[name]
+	if !ok {
+		return MaterializedView{}, fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	return e.view, nil
+}
+
+func (vs *Views) List() []MaterializedView {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	out := make([]MaterializedView, 0, len(vs.entries))
+	for _, e := range vs.entries {
+		out = append(out, e.view)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete drops the view and its table.
+func (vs *Views) Delete(ctx context.Context, name string) error {
+	vs.mu.Lock()
+	e, ok := vs.entries[name]
+	if ok {
+		e.deleted = true
+		delete(vs.entries, name)
+	}
+	vs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	e.refreshing.Lock()
+	defer e.refreshing.Unlock()
+	return vs.store.DropTable(ctx, name)
+}
+
+// Refresh recomputes the view now and returns its state.
+func (vs *Views) Refresh(ctx context.Context, name string) (MaterializedView, error) {
+	vs.mu.Lock()
+	e, ok := vs.entries[name]
+	vs.mu.Unlock()
+	if !ok {
+		return MaterializedView{}, fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	}
+	err := vs.refresh(ctx, e)
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return e.view, err
+}
+
+// refresh replaces the table of the view with the current result of its query. Refreshes of the same view are
+// serialized, a failed refresh keeps the previous table.
+func (vs *Views) refresh(ctx context.Context, e *viewEntry) error {
+	e.refreshing.Lock()
+	defer e.refreshing.Unlock()
+	if vs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vs.timeout)
+		defer cancel()
+	}
+
+	vs.mu.Lock()
+	v, deleted := e.view, e.deleted
+	vs.mu.Unlock()
+	if deleted {
+		return fmt.Errorf("%w: %s", ErrViewNotFound, v.Name)
+	}
+	start := time.Now()
+	rows, err := vs.store.Materialize(ctx, &QueryStatement{Query: v.SQL, Params: v.Params}, v.Name, WriteReplace)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	e.view.LastRefresh = &start
+	e.view.RefreshMS = time.Since(start).Milliseconds()
+	e.view.LastError = ""
+	if err != nil {
+		e.view.LastError = err.Error()
+	} else {
+		e.view.LastRows = rows
+	}
+	if e.interval > 0 {
+		next := start.Add(e.interval)
+		e.view.NextRefresh = &next
+	}
+	return err
+}
+
+func (vs *Views) notify() {
+	select {
+	case vs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run refreshes the views that are due until ctx is done.
+func (vs *Views) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-vs.wake:
+		case <-timer.C:
+		}
+		next := vs.refreshDue(ctx)
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// refreshDue starts the refreshes that are due and returns the time until the next one.
+func (vs *Views) refreshDue(ctx context.Context) time.Duration {
+	now := time.Now()
+	wait := time.Minute
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for _, e := range vs.entries {
+		if e.view.NextRefresh == nil {
+			continue
+		}
+		if !e.view.NextRefresh.After(now) {
+			next := now.Add(e.interval)
+			e.view.NextRefresh = &next
+			go func(e *viewEntry, name string) {
+				if err := vs.refresh(ctx, e); err != nil {
+					slog.Error("views: refreshing view", "name", name, "err", err)
+				}
+			}(e, e.view.Name)
+		}
+		wait = min(wait, e.view.NextRefresh.Sub(now))
+	}
+	return wait
+}
+
+func (s *Server) HandleListViews(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list views: writing response", s.views.List())
+}
+
+// HandlePutView creates or redefines the materialized view named in the path and refreshes it.
+func (s *Server) HandlePutView(w http.ResponseWriter, r *http.Request) {
+	var v MaterializedView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put view: decoding request body", err)
+		return
+	}
+	v.Name = r.PathValue("name")
+	v, created, err := s.views.Put(r.Context(), v)
+	if errors.Is(err, ErrViewExists) {
+		s.writeError(w, http.StatusConflict, "handle put view", err)
+		return
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put view: writing response", v)
+}
+
+func (s *Server) HandleGetView(w http.ResponseWriter, r *http.Request) {
+	v, err := s.views.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get view", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get view: writing response", v)
+}
+
+func (s *Server) HandleDeleteView(w http.ResponseWriter, r *http.Request) {
+	err := s.views.Delete(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrViewNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete view", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete view", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRefreshView refreshes the view named in the path and responds with its state.
+func (s *Server) HandleRefreshView(w http.ResponseWriter, r *http.Request) {
+	v, err := s.views.Refresh(r.Context(), r.PathValue("name"))
+	if errors.Is(err, ErrViewNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle refresh view", err)
+		return
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle refresh view: writing response", v)
+}
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+)
+
+// The headers of the deliveries. The signature is the hex encoded HMAC-SHA256 of the timestamp, a dot and the body,
+// keyed with the secret of the webhook and prefixed with sha256=. Receivers compare it and refuse old timestamps to
+// reject forged and replayed deliveries.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookQueue is how many schema events wait for delivery before further ones are dropped.
+const webhookQueue = 1000
+
+// WebhookConfig configures the deliveries of schema events to webhooks and of alert notifications to their targets.
+type WebhookConfig struct {
+	// File keeps the webhooks across restarts, empty keeps them in memory only. It holds the secrets in plain text.
+	File string `yaml:"file"`
+	// MaxAttempts is how often a delivery is tried before it is given up. RetryBackoff is the wait before the first
+	// retry, doubled for each further one.
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// Timeout bounds each attempt.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultWebhookConfig tries deliveries 5 times over about 15 seconds.
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{MaxAttempts: 5, RetryBackoff: time.Second, Timeout: 10 * time.Second}
+}
+
+// Webhook is a URL that schema events are posted to as JSON, see SchemaEvent. A delivery succeeds with any 2xx
+// status and is retried otherwise.
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs the deliveries, see WebhookSignatureHeader. It is write-only, responses only carry it redacted.
+	Secret string `json:"secret,omitempty"`
+	// Events are the kinds of events posted to the webhook, empty for all of them.
+	Events []SchemaEventKind `json:"events,omitempty"`
+
+	// LastDelivery is when an event was last delivered, LastError why the last delivery was given up. They are not
+	// kept across restarts.
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+func (wh *Webhook) Validate() error {
+	if !tableNameRegex.MatchString(wh.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidWebhook, tableNameRegex)
+	}
+	if !webhookURL(wh.URL) {
+		return fmt.Errorf("%w: url must be an absolute http or https URL: %q", ErrInvalidWebhook, wh.URL)
+	}
+	for _, kind := range wh.Events {
+		switch kind {
+		case SchemaEventTableCreated, SchemaEventColumnsAdded, SchemaEventTypeConflict:
+		default:
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, kind)
+		}
+	}
+	return nil
+}
+
+// webhookURL reports whether the URL is an absolute http or https URL.
+func webhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// redact returns the webhook with the secret replaced.
+func (wh Webhook) redact() Webhook {
+	if wh.Secret != "" {
+		wh.Secret = redacted
+	}
+	return wh
+}
+
+func (wh *Webhook) wants(kind SchemaEventKind) bool {
+	return len(wh.Events) == 0 || slices.Contains(wh.Events, kind)
+}
+
+// Webhooks posts the schema events of a store to the registered webhooks once Run is called. With a file, the
+// webhooks are kept in it and loaded again by NewWebhooks.
+type Webhooks struct {
+	client *webhookClient
+	events chan SchemaEvent
+
+	mu     sync.Mutex
+	byName map[string]*Webhook
+}
+
+// NewWebhooks loads the webhooks in the file of the configuration, if it exists, and subscribes to the schema events
+// of the store.
+func NewWebhooks(store *Store, cfg WebhookConfig) (*Webhooks, error) {
+	whs := &Webhooks{
+		client: newWebhookClient(cfg),
+		events: make(chan SchemaEvent, webhookQueue),
+		byName: make(map[string]*Webhook),
+	}
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("webhooks: reading %s: %w", cfg.File, err)
+		}
+		var hooks []Webhook
+		if err == nil {
+			if err = json.Unmarshal(data, &hooks); err != nil {
+				return nil, fmt.Errorf("webhooks: parsing %s: %w", cfg.File, err)
+			}
+		}
+		for i := range hooks {
+			whs.byName[hooks[i].Name] = &hooks[i]
+		}
+	}
+	store.onSchemaEvent(whs.notify)
+	return whs, nil
+}
+
+// notify queues the event for delivery without blocking the insert that caused it. Events beyond the queue are
+// dropped.
+func (whs *Webhooks) notify(e SchemaEvent) {
+	id, err := newID()
+	if err != nil {
+		slog.Error("webhooks: generating event id", "err", err)
+		return
+	}
+	e.ID = id
+	select {
+	case whs.events <- e:
+	default:
+		slog.Error("webhooks: queue full, dropping event", "kind", e.Kind, "table", e.Table)
+	}
+}
+
+// Run delivers the queued events in order until the context is done. Each event is posted to the webhooks at once,
+// a webhook that keeps failing delays the following events until its retries are exhausted.
+func (whs *Webhooks) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-whs.events:
+			whs.deliver(ctx, e)
+		}
+	}
+}
+
+func (whs *Webhooks) deliver(ctx context.Context, e SchemaEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("webhooks: encoding event", "kind", e.Kind, "err", err)
+		return
+	}
+	whs.mu.Lock()
+	var hooks []Webhook
+	for _, wh := range whs.byName {
+		if wh.wants(e.Kind) {
+			hooks = append(hooks, *wh)
+		}
+	}
+	whs.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, wh := range hooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postErr := whs.client.post(ctx, wh.URL, wh.Secret, string(e.Kind), body)
+			if postErr != nil {
+				slog.Error("webhooks: delivering event", "webhook", wh.Name, "id", e.ID, "err", postErr)
+			}
+			whs.mu.Lock()
+			defer whs.mu.Unlock()
+			// The status goes to the webhook that was delivered to, not to one that replaced it meanwhile.
+			if current, ok := whs.byName[wh.Name]; ok && current.URL == wh.URL {
+				if postErr != nil {
+					current.LastError = postErr.Error()
+					return
+				}
+				now := time.Now().UTC()
+				current.LastDelivery, current.LastError = &now, ""
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// webhookClient posts JSON to webhook URLs, retrying as configured.
+type webhookClient struct {
+	cfg    WebhookConfig
+	client *http.Client
+}
+
+func newWebhookClient(cfg WebhookConfig) *webhookClient {
+	return &webhookClient{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// post tries to deliver the body until the target answers with a 2xx status, the attempts are exhausted or the
+// context is done. The event is sent in WebhookEventHeader, the signature only with a secret.
+func (c *webhookClient) post(ctx context.Context, target, secret, event string, body []byte) error {
+	attempts := max(c.cfg.MaxAttempts, 1)
+	backoff := c.cfg.RetryBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = c.attempt(ctx, target, secret, event, body); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+func (c *webhookClient) attempt(ctx context.Context, target, secret, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(secret, timestamp, body))
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// WebhookSignature returns the WebhookSignatureHeader of a delivery of the body at the timestamp, in Unix seconds.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Put registers the webhook and persists it. It returns the webhook redacted and reports whether it is new.
+func (whs *Webhooks) Put(wh Webhook) (Webhook, bool, error) {
+	wh.LastDelivery, wh.LastError = nil, ""
+	if err := wh.Validate(); err != nil {
+		return Webhook{}, false, err
+	}
+	whs.mu.Lock()
+	defer whs.mu.Unlock()
+	prev, exists := whs.byName[wh.Name]
+	whs.byName[wh.Name] = &wh
+	if err := whs.save(); err != nil {
+		if exists {
+			whs.byName[wh.Name] = prev
+		} else {
+			delete(whs.byName, wh.Name)
+		}
+		return Webhook{}, false, err
+	}
+	return wh.redact(), !exists, nil
+}
+
+// Get returns the webhook redacted.
+func (whs *Webhooks) Get(name string) (Webhook, error) {
+	whs.mu.Lock()
+	defer whs.mu.Unlock()
+	wh, ok := whs.byName[name]
+	if !ok {
+		return Webhook{}, fmt.Errorf("%w: %s", ErrWebhookNotFound, name)
+	}
+	return wh.redact(), nil
+}
+
+// List returns the webhooks redacted.
+func (whs *Webhooks) List() []Webhook {
+	whs.mu.Lock()
+	defer whs.mu.Unlock()
+	out := make([]Webhook, 0, len(whs.byName))
+	for _, wh := range whs.byName {
+		out = append(out, wh.redact())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Delete removes the webhook and removes it from the file. Deliveries in progress are finished.
+func (whs *Webhooks) Delete(name string) error {
+	whs.mu.Lock()
+	defer whs.mu.Unlock()
+	wh, ok := whs.byName[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrWebhookNotFound, name)
+	}
+	delete(whs.byName, name)
+	if err := whs.save(); err != nil {
+		whs.byName[name] = wh
+		return err
+	}
+	return nil
+}
+
+// save writes the webhooks to the file, replacing it atomically. The caller holds the lock.
+func (whs *Webhooks) save() error {
+	path := whs.client.cfg.File
+	if path == "" {
+		return nil
+	}
+	hooks := make([]Webhook, 0, len(whs.byName))
+	for _, wh := range whs.byName {
+		h := *wh
+		h.LastDelivery, h.LastError = nil, ""
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Name < hooks[j].Name
+	})
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("webhooks: encoding: %w", err)
+	}
+	// The file is readable by its owner only, it holds the secrets.
+	if err = writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("webhooks: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) HandleListWebhooks(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, "handle list webhooks: writing response", s.webhooks.List())
+}
+
+// HandlePutWebhook registers the webhook named in the path, replacing an existing one.
+func (s *Server) HandlePutWebhook(w http.ResponseWriter, r *http.Request) {
+	var wh Webhook
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		s.writeError(w, http.StatusBadRequest, "handle put webhook: decoding request body", err)
+		return
+	}
+	wh.Name = r.PathValue("name")
+	wh, created, err := s.webhooks.Put(wh)
+	if errors.Is(err, ErrInvalidWebhook) {
+		s.writeError(w, http.StatusBadRequest, "handle put webhook", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle put webhook", err)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	s.writeJSON(w, code, "handle put webhook: writing response", wh)
+}
+
+func (s *Server) HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	wh, err := s.webhooks.Get(r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "handle get webhook", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "handle get webhook: writing response", wh)
+}
+
+func (s *Server) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	err := s.webhooks.Delete(r.PathValue("name"))
+	if errors.Is(err, ErrWebhookNotFound) {
+		s.writeError(w, http.StatusNotFound, "handle delete webhook", err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "handle delete webhook", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // RFC 6455 derives the accept key with SHA-1.
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of the opening handshake, see RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  byte = 0x1
+	wsOpClose byte = 0x8
+	wsOpPing  byte = 0x9
+	wsOpPong  byte = 0xA
+
+	// wsMaxReadPayload bounds the frames read from clients, which only send control frames to one-way streams.
+	wsMaxReadPayload = 64 << 10
+	wsWriteTimeout   = 10 * time.Second
+	wsPingInterval   = 30 * time.Second
+
+	wsCloseInternalError = 1011
+)
+
+var (
+	// errNotWebSocket is returned for requests that aren't a WebSocket opening handshake.
+	errNotWebSocket = errors.New("not a websocket handshake")
+	// errWebSocketOrigin is returned for handshakes of pages of other origins, see checkWebSocketOrigin.
+	errWebSocketOrigin = errors.New("websocket origin not allowed")
+)
+
+// wsConn is the server side of a WebSocket connection that streams text messages to the client. Frames of the client
+// are read to answer pings and the closing handshake, their data is discarded.
+type wsConn struct {
+	conn net.Conn
+	// mu serializes the writes of the handler and of the read loop answering pings.
+	mu     sync.Mutex
+	closed chan struct{}
+	once   sync.Once
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the connection. The response can be written to
+// only if the error is errNotWebSocket.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("%w: missing upgrade headers", errNotWebSocket)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("%w: unsupported version %q", errNotWebSocket, r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("%w: missing key", errNotWebSocket)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: connection can't be taken over")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: taking over connection: %w", err)
+	}
+	c := &wsConn{conn: conn, closed: make(chan struct{})}
+	// The read and write timeouts of the server apply to the request, not to the stream.
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("websocket: clearing deadline: %w", err)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID)) //nolint:gosec // See the import.
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	c.mu.Lock()
+	err = c.writeRaw([]byte(handshake))
+	c.mu.Unlock()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("websocket: writing handshake: %w", err)
+	}
+	go c.readLoop(rw.Reader)
+	return c, nil
+}
+
+// checkWebSocketOrigin refuses the handshakes of browser pages of other origins than the server and the CORS
+// allowed origins. Browsers don't apply the same-origin policy to WebSockets, a page of any site could open a stream
+// with the cookies and TLS client certificate of the user otherwise. Clients other than browsers send no Origin.
+func (s *Server) checkWebSocketOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	if s.cors != nil {
+		if _, ok := s.cors.allowOrigin(origin); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errWebSocketOrigin, origin)
+}
+
+// headerHasToken reports whether the comma separated values of the header contain the token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Closed is closed once the connection is.
+func (c *wsConn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *wsConn) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+// CloseWith starts the closing handshake with the status code and closes the connection without waiting for the
+// answer of the client.
+func (c *wsConn) CloseWith(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	_ = c.write(wsOpClose, append(payload, reason...))
+	c.Close()
+}
+
+func (c *wsConn) WriteText(data []byte) error {
+	return c.write(wsOpText, data)
+}
+
+func (c *wsConn) Ping() error {
+	return c.write(wsOpPing, nil)
+}
+
+// write sends the payload as a single unmasked frame, servers don't mask their frames.
+func (c *wsConn) write(op byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeRaw(append(frame, payload...))
+}
+
+// writeRaw writes to the connection. The caller holds mu.
+func (c *wsConn) writeRaw(data []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return fmt.Errorf("websocket: setting deadline: %w", err)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		return fmt.Errorf("websocket: writing: %w", err)
+	}
+	return nil
+}
+
+// readLoop answers the pings and the close of the client until the connection fails or closes.
+func (c *wsConn) readLoop(r *bufio.Reader) {
+	defer c.Close()
+	for {
+		op, payload, err := readWebSocketFrame(r)
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsOpPing:
+			if err = c.write(wsOpPong, payload); err != nil {
+				return
+			}
+		case wsOpClose:
+			_ = c.write(wsOpClose, payload[:min(len(payload), 2)])
+			return
+		}
+	}
+}
+
+// readWebSocketFrame reads a frame of the client and returns its opcode and unmasked payload.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxReadPayload {
+		return 0, nil, fmt.Errorf("websocket: frame of %d bytes exceeds %d", n, wsMaxReadPayload)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
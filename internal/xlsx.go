@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxDateFormats are the built-in number formats of dates and times.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var xlsxDateFormats = map[int]bool{
+	14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true, 45: true, 46: true, 47: true,
+}
+
+// xlsxLiteralRegex matches the parts of a number format that don't format the value: quoted text, escaped characters
+// and bracketed colors or conditions.
+var xlsxLiteralRegex = regexp.MustCompile(`"[^"]*"|\\.|\[[^\]]*\]`)
+
+// sheetColumnRegex matches the runs of characters column names can't have.
+var sheetColumnRegex = regexp.MustCompile(`[^a-z0-9_]+`)
+
+type xlsxWorkbook struct {
+	Properties struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a string of a cell, either plain or split into runs of rich text.
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	var sb strings.Builder
+	sb.WriteString(t.T)
+	for _, r := range t.Runs {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxRow struct {
+	R     int `xml:"r,attr"`
+	Cells []struct {
+		R      string   `xml:"r,attr"`
+		T      string   `xml:"t,attr"`
+		S      int      `xml:"s,attr"`
+		V      string   `xml:"v"`
+		Inline xlsxText `xml:"is"`
+	} `xml:"c"`
+}
+
+// xlsxSheet reads the cells of a worksheet as the values ingestion takes: numbers as float64, booleans as bool and
+// text, dates and times as strings.
+type xlsxSheet struct {
+	strings  []string
+	dates    []bool
+	date1904 bool
+}
+
+// readXLSX reads the rows of the sheet of the workbook, the first sheet if it is empty, below the header row, counted
+// from 1, whose cells name the columns. Empty cells are left out of the rows and empty rows are skipped.
+func readXLSX(file, sheet string, headerRow int) ([]map[string]any, error) {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: xlsx: %w", ErrInvalidUpload, err)
+	}
+	defer func() {
+		if closeErr := zr.Close(); closeErr != nil {
+			slog.Error("xlsx: closing workbook", "err", closeErr)
+		}
+	}()
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	var wb xlsxWorkbook
+	var rels xlsxRelationships
+	if err = decodeXLSXPart(files, "xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	if err = decodeXLSXPart(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	target := ""
+	for _, s := range wb.Sheets {
+		if sheet != "" && s.Name != sheet {
+			continue
+		}
+		for _, rel := range rels.Relationships {
+			if rel.ID == s.RID {
+				target = rel.Target
+			}
+		}
+		break
+	}
+	if target == "" {
+		return nil, fmt.Errorf("%w: xlsx: no sheet %q", ErrInvalidUpload, sheet)
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	xs := &xlsxSheet{date1904: wb.Properties.Date1904 == "1" || wb.Properties.Date1904 == "true"}
+	var shared xlsxSharedStrings
+	if err = decodeXLSXPart(files, "xl/sharedStrings.xml", &shared); err != nil && !errors.Is(err, errXLSXPartMissing) {
+		return nil, err
+	}
+	for _, si := range shared.Items {
+		xs.strings = append(xs.strings, si.String())
+	}
+	var styles xlsxStyles
+	if err = decodeXLSXPart(files, "xl/styles.xml", &styles); err != nil && !errors.Is(err, errXLSXPartMissing) {
+		return nil, err
+	}
+	codes := make(map[int]string, len(styles.NumFmts))
+	for _, f := range styles.NumFmts {
+		codes[f.ID] = f.Code
+	}
+	for _, xf := range styles.CellXfs {
+		code, custom := codes[xf.NumFmtID]
+		xs.dates = append(xs.dates, xlsxDateFormats[xf.NumFmtID] || custom && isDateFormatCode(code))
+	}
+	return xs.rows(files, target, headerRow)
+}
+
+var errXLSXPartMissing = errors.New("missing part")
+
+func decodeXLSXPart(files map[string]*zip.File, name string, v any) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%w: xlsx: %w %s", ErrInvalidUpload, errXLSXPartMissing, name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%w: xlsx: %w", ErrInvalidUpload, err)
+	}
+	defer func() {
+		if closeErr := rc.Close(); closeErr != nil {
+			slog.Error("xlsx: closing part", "err", closeErr)
+		}
+	}()
+	if err = xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("%w: xlsx: decoding %s: %w", ErrInvalidUpload, name, err)
+	}
+	return nil
+}
+
+// rows streams the rows of the worksheet, so the sheet is never held as a whole besides its values.
+func (xs *xlsxSheet) rows(files map[string]*zip.File, name string, headerRow int) ([]map[string]any, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: xlsx: %w %s", ErrInvalidUpload, errXLSXPartMissing, name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: xlsx: %w", ErrInvalidUpload, err)
+	}
+	defer func() {
+		if closeErr := rc.Close(); closeErr != nil {
+			slog.Error("xlsx: closing sheet", "err", closeErr)
+		}
+	}()
+	var header map[int]string
+	var out []map[string]any
+	dec := xml.NewDecoder(rc)
+	number := 0
+	for {
+		tok, tokErr := dec.Token()
+		if errors.Is(tokErr, io.EOF) {
+			break
+		}
+		if tokErr != nil {
+			return nil, fmt.Errorf("%w: xlsx: decoding %s: %w", ErrInvalidUpload, name, tokErr)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		var row xlsxRow
+		if err = dec.DecodeElement(&row, &start); err != nil {
+			return nil, fmt.Errorf("%w: xlsx: decoding %s: %w", ErrInvalidUpload, name, err)
+		}
+		number++
+		if row.R > 0 {
+			number = row.R
+		}
+		cells, cellErr := xs.cells(row)
+		switch {
+		case cellErr != nil:
+			return nil, fmt.Errorf("%w: xlsx: row %d: %w", ErrInvalidUpload, number, cellErr)
+		case number < headerRow:
+		case number == headerRow:
+			header = sheetColumns(cells)
+		default:
+			if header == nil {
+				return nil, fmt.Errorf("%w: xlsx: header row %d is missing", ErrInvalidUpload, headerRow)
+			}
+			values := make(map[string]any, len(cells))
+			for i, v := range cells {
+				if _, named := header[i]; !named {
+					header[i] = newSheetColumn(header, "", i)
+				}
+				values[header[i]] = v
+			}
+			if len(values) > 0 {
+				out = append(out, values)
+			}
+		}
+	}
+	return out, nil
+}
+
+// cells returns the non-empty values of the row by their column, counted from 0.
+func (xs *xlsxSheet) cells(row xlsxRow) (map[int]any, error) {
+	out := make(map[int]any, len(row.Cells))
+	col := -1
+	for _, c := range row.Cells {
+		col++
+		if c.R != "" {
+			i, err := cellColumn(c.R)
+			if err != nil {
+				return nil, err
+			}
+			col = i
+		}
+		var v any
+		switch c.T {
+		case "s":
+			i, err := strconv.Atoi(c.V)
+			if err != nil || i < 0 || i >= len(xs.strings) {
+				return nil, fmt.Errorf("cell %s: invalid shared string %q", c.R, c.V)
+			}
+			v = xs.strings[i]
+		case "inlineStr":
+			v = c.Inline.String()
+		case "str", "d":
+			v = c.V
+		case "b":
+			v = c.V == "1"
+		case "e":
+			// Errors like #DIV/0! are left empty.
+		default:
+			if c.V == "" {
+				break
+			}
+			f, err := strconv.ParseFloat(c.V, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cell %s: invalid number %q", c.R, c.V)
+			}
+			v = f
+			if c.S >= 0 && c.S < len(xs.dates) && xs.dates[c.S] {
+				v = xs.dateString(f)
+			}
+		}
+		if s, ok := v.(string); v == nil || ok && s == "" {
+			continue
+		}
+		out[col] = v
+	}
+	return out, nil
+}
+
+// dateString formats the serial date as a DATE, TIME or TIMESTAMP literal, to the millisecond.
+func (xs *xlsxSheet) dateString(serial float64) string {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if xs.date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	days := math.Floor(serial)
+	ms := math.Round((serial - days) * 24 * 60 * 60 * 1000)
+	t := epoch.AddDate(0, 0, int(days)).Add(time.Duration(ms) * time.Millisecond)
+	switch {
+	case ms == 0:
+		return t.Format(time.DateOnly)
+	case serial < 1:
+		return t.Format("15:04:05.999")
+	default:
+		return t.Format("2006-01-02 15:04:05.999")
+	}
+}
+
+// isDateFormatCode reports whether the custom number format formats dates or times.
+func isDateFormatCode(code string) bool {
+	code = strings.ToLower(xlsxLiteralRegex.ReplaceAllString(code, ""))
+	return strings.ContainsAny(code, "dmyhs") && !strings.Contains(code, "general")
+}
+
+// cellColumn returns the column, counted from 0, of the cell reference, e.g. 2 for C7.
+func cellColumn(ref string) (int, error) {
+	col := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A'+1)
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return col - 1, nil
+}
+
+// columnLetters returns the letters of the column counted from 0, e.g. C for 2.
+func columnLetters(col int) string {
+	var out []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		out = append([]byte{byte('A' + (col-1)%26)}, out...)
+	}
+	return string(out)
+}
+
+// sheetColumns returns the column names of the header cells.
+func sheetColumns(cells map[int]any) map[int]string {
+	out := make(map[int]string, len(cells))
+	for col := 0; len(out) < len(cells); col++ {
+		if v, ok := cells[col]; ok {
+			out[col] = newSheetColumn(out, fmt.Sprint(v), col)
+		}
+	}
+	return out
+}
+
+// newSheetColumn converts the header of the column to a column name: lower case with underscores for the characters
+// column names can't have. Columns without a header are named by their letters, and repeated names are numbered.
+func newSheetColumn(taken map[int]string, header string, col int) string {
+	name := strings.Trim(sheetColumnRegex.ReplaceAllString(strings.ToLower(header), "_"), "_")
+	if name == "" {
+		name = strings.ToLower(columnLetters(col))
+	}
+	if isDigit(name[0]) {
+		name = "_" + name
+	}
+	used := make(map[string]bool, len(taken))
+	for _, n := range taken {
+		used[n] = true
+	}
+	out := name
+	for i := 2; used[out]; i++ {
+		out = fmt.Sprintf("%s_%d", name, i)
+	}
+	return out
+}
@@ -1,33 +1,403 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"scratch/internal"
-	"time"
-)
+	"scratch/internal/config"
+	"syscall"
 
-const requestTimeout = 3 * time.Second
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
 
 func main() {
-	store, err := internal.NewDuckDBStore()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves until SIGINT or SIGTERM, then stops accepting requests, drains the running requests and jobs and closes
+// the store. SIGHUP reloads the configuration.
+func run(cfg config.Config) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger, logLevel, err := internal.NewLogger(cfg.Log, os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	storeOpts := []internal.StoreOption{
+		internal.WithLimits(cfg.Limits),
+		internal.WithMemoryLimit(cfg.Query.MemoryLimit),
+		internal.WithDatabase(cfg.Database),
+		internal.WithExportDirectory(cfg.ExportDir),
+		internal.WithBackupDirectory(cfg.BackupDir),
+		internal.WithIngestLog(cfg.IngestLog),
+		internal.WithChangeFeed(cfg.ChangeFeedRetention),
+		internal.WithAuditLog(cfg.AuditRetention),
+	}
+	if cfg.Quotas.Default != (internal.Quota{}) || len(cfg.Quotas.Tenants) > 0 {
+		storeOpts = append(storeOpts, internal.WithQuotas(cfg.Quotas))
+	}
+	if err = internal.ValidateTableACLs(cfg.TableACLs); err != nil {
+		return err
+	}
+	storeOpts = append(storeOpts, internal.WithTableACLs(cfg.TableACLs))
+	if err = internal.ValidateColumnMasks(cfg.ColumnMasks); err != nil {
+		return err
+	}
+	storeOpts = append(storeOpts, internal.WithColumnMasks(cfg.ColumnMasks))
+	if err = internal.ValidateSQLPolicy(cfg.SQLPolicy); err != nil {
+		return err
+	}
+	if len(cfg.SQLPolicy.DenyStatements) > 0 || len(cfg.SQLPolicy.DenyFunctions) > 0 || cfg.SQLPolicy.DenyCrossSchema {
+		storeOpts = append(storeOpts, internal.WithSQLPolicy(cfg.SQLPolicy))
+	}
+	if cfg.RowLevelSecurity != "" {
+		storeOpts = append(storeOpts, internal.WithRowLevelSecurity(cfg.RowLevelSecurity))
+	}
+	store, err := internal.NewDuckDBStore(storeOpts...)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if closeErr := store.Close(); closeErr != nil {
-			slog.Error("closing store: %w", err)
+			err = errors.Join(err, fmt.Errorf("closing store: %w", closeErr))
 		}
 	}()
-	mux := internal.NewServer(store).NewServeMux()
-	server := &http.Server{
-		Addr:              ":8000",
-		ReadHeaderTimeout: requestTimeout,
-		Handler:           mux,
+	scheduler := internal.NewScheduler(store, cfg.Query.MaxTimeout)
+	go scheduler.Run(ctx)
+	views := internal.NewViews(store, cfg.Query.MaxTimeout)
+	go views.Run(ctx)
+	rollups := internal.NewRollups(store, cfg.Query.MaxTimeout)
+	go rollups.Run(ctx)
+	checkpointer := internal.NewCheckpointer(store, cfg.Database.CheckpointInterval)
+	go checkpointer.Run(ctx)
+	go internal.NewTiering(store, cfg.TieringInterval).Run(ctx)
+	macros, err := internal.NewMacros(ctx, store, cfg.MacrosFile)
+	if err != nil {
+		return err
+	}
+	secrets, err := internal.NewSecrets(ctx, store, cfg.SecretsFile, cfg.SecretsKey)
+	if err != nil {
+		return err
+	}
+	webhooks, err := internal.NewWebhooks(store, cfg.Webhooks)
+	if err != nil {
+		return err
+	}
+	go webhooks.Run(ctx)
+	alerts := internal.NewAlerts(store, cfg.Query.MaxTimeout, cfg.Webhooks)
+	go alerts.Run(ctx)
+	quality := internal.NewQuality(store, cfg.Query.MaxTimeout, cfg.Webhooks)
+	go quality.Run(ctx)
+	attachments := internal.NewAttachments(ctx, store, cfg.Attachments)
+	opts := []internal.ServerOption{
+		internal.WithMaxQueryTimeout(cfg.Query.MaxTimeout),
+		internal.WithScheduler(scheduler),
+		internal.WithViews(views),
+		internal.WithRollups(rollups),
+		internal.WithAlerts(alerts),
+		internal.WithQuality(quality),
+		internal.WithMacros(macros),
+		internal.WithSecrets(secrets),
+		internal.WithWebhooks(webhooks),
+		internal.WithCheckpointer(checkpointer),
+		internal.WithAttachments(attachments),
+		internal.WithQueryCacheTTL(cfg.Query.CacheTTL),
+		internal.WithResultLimits(cfg.Query.ResultLimits),
+		internal.WithQueryConcurrency(cfg.Query.MaxConcurrent, cfg.Query.MaxQueued),
+		internal.WithQueryTagConcurrency(cfg.Query.TagConcurrency, cfg.Query.MaxQueued),
+		internal.WithQueryHistory(cfg.Query.History),
+		internal.WithMaxBodyBytes(cfg.Server.MaxBodyBytes),
+		internal.WithWriteBackpressure(cfg.Server.MaxQueuedWrites, cfg.Server.MaxWriteWait),
+		internal.WithInsertCoalescing(cfg.Server.CoalesceRows),
+		internal.WithLogLevel(logLevel),
+	}
+	if cfg.Cluster.NodeID != "" {
+		if cfg.Follow != "" {
+			return errors.New("a cluster node can't follow a leader")
+		}
+		cluster, clusterErr := internal.NewCluster(store, cfg.Cluster)
+		if clusterErr != nil {
+			return clusterErr
+		}
+		defer func() {
+			if closeErr := cluster.Close(); closeErr != nil {
+				err = errors.Join(err, closeErr)
+			}
+		}()
+		opts = append(opts, internal.WithCluster(cluster))
+	}
+	if cfg.Follow != "" {
+		follower, followErr := internal.NewFollower(ctx, store, cfg.Follow, cfg.FollowKey, cfg.FollowInterval)
+		if followErr != nil {
+			return followErr
+		}
+		go follower.Run(ctx)
+		opts = append(opts, internal.WithFollower(follower))
+	}
+	var apiKeys *internal.APIKeys
+	if keys := configuredKeys(cfg); len(keys) > 0 || cfg.APIKeysFile != "" {
+		if apiKeys, err = internal.NewAPIKeys(cfg.APIKeysFile, keys); err != nil {
+			return err
+		}
+		opts = append(opts, internal.WithAPIKeys(apiKeys))
+	}
+	if cfg.JWT.Issuer != "" {
+		verifier, jwtErr := internal.NewJWTVerifier(cfg.JWT)
+		if jwtErr != nil {
+			return jwtErr
+		}
+		opts = append(opts, internal.WithJWT(verifier))
+	}
+	if cfg.DownloadDir != "" {
+		downloads, downloadErr := internal.NewDownloads(cfg.DownloadDir, cfg.DownloadRetention)
+		if downloadErr != nil {
+			return downloadErr
+		}
+		opts = append(opts, internal.WithDownloads(downloads))
+	}
+	if cfg.UploadDir != "" {
+		uploads, uploadErr := internal.NewUploads(cfg.UploadDir, cfg.UploadRetention)
+		if uploadErr != nil {
+			return uploadErr
+		}
+		opts = append(opts, internal.WithUploads(uploads))
+	}
+	if cfg.Server.Debug {
+		opts = append(opts, internal.WithDebugEndpoints())
+	}
+	if cfg.Server.UI {
+		opts = append(opts, internal.WithUI())
+	}
+	if cfg.Server.ClickHouseHTTP {
+		opts = append(opts, internal.WithClickHouseHTTP())
+	}
+	if cfg.Server.AccessLog {
+		opts = append(opts, internal.WithAccessLog(logger))
+	}
+	if len(cfg.ClientCerts) > 0 {
+		if err = internal.ValidateClientCerts(cfg.ClientCerts); err != nil {
+			return err
+		}
+		opts = append(opts, internal.WithClientCerts(cfg.ClientCerts))
+	}
+	if len(cfg.Server.CORS.AllowedOrigins) > 0 {
+		opts = append(opts, internal.WithCORS(cfg.Server.CORS))
+	}
+	srv := internal.NewServer(store, opts...)
+	listeners := cfg.Server.Listeners
+	if len(listeners) == 0 {
+		listeners = []internal.Listener{{Addr: cfg.Server.Addr}}
+	}
+	if err = internal.ValidateListeners(listeners); err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if cfg.Server.TLS.CertFile != "" {
+		if tlsConfig, err = internal.NewTLSConfig(cfg.Server.TLS); err != nil {
+			return err
+		}
+	}
+	// TLS applies to the TCP listeners, Unix domain sockets are local and stay plaintext.
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, listenErr := l.Listen()
+		if listenErr != nil {
+			for _, opened := range lns {
+				_ = opened.Close()
+			}
+			return listenErr
+		}
+		lns = append(lns, ln)
+	}
+	servers := make([]*http.Server, len(listeners))
+	serve := make([]func() error, len(listeners))
+	for i, l := range listeners {
+		ln := lns[i]
+		server := &http.Server{
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+			MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+			Handler:           srv.SurfaceHandler(l.Surface),
+		}
+		server.SetKeepAlivesEnabled(cfg.Server.KeepAlive)
+		if !cfg.Server.HTTP2 {
+			// A non-nil map keeps net/http from configuring HTTP/2.
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		servers[i] = server
+		serve[i] = func() error { return server.Serve(ln) }
+		if tlsConfig != nil && !l.Unix() {
+			server.TLSConfig = tlsConfig
+			serve[i] = func() error { return server.ServeTLS(ln, "", "") }
+		}
+		slog.Info("listening", "addr", l.Addr, "surface", l.Surface, "tls", server.TLSConfig != nil)
+	}
+	var redirect *http.Server
+	if tlsConfig != nil && cfg.Server.TLS.RedirectAddr != "" {
+		redirect = &http.Server{
+			Addr:              cfg.Server.TLS.RedirectAddr,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			Handler:           internal.RedirectHTTPS(httpsAddr(listeners)),
+		}
+	}
+	var (
+		flightServer   *grpc.Server
+		flightListener net.Listener
+	)
+	if cfg.Server.FlightSQLAddr != "" {
+		var grpcOpts []grpc.ServerOption
+		if tlsConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		if flightServer, err = srv.NewFlightSQLServer(grpcOpts...); err == nil {
+			flightListener, err = net.Listen("tcp", cfg.Server.FlightSQLAddr)
+		}
+		if err != nil {
+			for _, ln := range lns {
+				_ = ln.Close()
+			}
+			return err
+		}
+		slog.Info("serving flight sql", "addr", cfg.Server.FlightSQLAddr, "tls", tlsConfig != nil)
 	}
 
-	if err = server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	serveErr := make(chan error, len(servers)+2)
+	for _, fn := range serve {
+		go func() {
+			serveErr <- fn()
+		}()
+	}
+	if redirect != nil {
+		go func() {
+			serveErr <- redirect.ListenAndServe()
+		}()
+	}
+	if flightServer != nil {
+		go func() {
+			serveErr <- flightServer.Serve(flightListener)
+		}()
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for running := true; running; {
+		select {
+		case err = <-serveErr:
+			return err
+		case <-hangup:
+			reload(store, apiKeys)
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	stop()
+	slog.Info("shutting down", "timeout", cfg.Server.ShutdownTimeout)
+
+	shutdownCtx := context.Background()
+	if cfg.Server.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, cfg.Server.ShutdownTimeout)
+		defer cancel()
+	}
+	if redirect != nil {
+		if err = redirect.Shutdown(shutdownCtx); err != nil {
+			slog.Error("closing redirect listener", "err", err)
+		}
+	}
+	for _, server := range servers {
+		if err = server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("draining requests", "err", err)
+		}
+	}
+	if flightServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			flightServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			slog.Error("draining flight sql calls", "err", shutdownCtx.Err())
+			flightServer.Stop()
+		}
+	}
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("draining jobs", "err", err)
+	}
+	return nil
+}
+
+// httpsAddr returns the address the HTTPS redirect points to: the first TCP listener serving the public API.
+func httpsAddr(listeners []internal.Listener) string {
+	for _, l := range listeners {
+		if !l.Unix() && l.Surface != internal.SurfaceAdmin {
+			return l.Addr
+		}
+	}
+	return listeners[0].Addr
+}
+
+// configuredKeys returns the API keys of the configuration, including the admin key.
+func configuredKeys(cfg config.Config) []internal.APIKey {
+	keys := cfg.APIKeys
+	if cfg.AdminKey != "" {
+		keys = append(keys, internal.APIKey{Name: "admin", Key: cfg.AdminKey, Admin: true})
+	}
+	return keys
+}
+
+// reload loads the configuration again and applies what changes without a restart: the limits, quotas and retentions
+// of the store and the configured API keys. Each is left as it was if its new settings are refused, the rest of the
+// configuration only applies after a restart. Requests in flight are answered with the settings they started with.
+func reload(store *internal.Store, apiKeys *internal.APIKeys) {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error("reloading configuration", "err", err)
+		return
+	}
+	if err = store.Reload(internal.Settings{
+		Limits:              cfg.Limits,
+		Quotas:              cfg.Quotas,
+		ChangeFeedRetention: cfg.ChangeFeedRetention,
+		AuditRetention:      cfg.AuditRetention,
+	}); err != nil {
+		slog.Error("reloading store settings", "err", err)
+	}
+	var keysErr error
+	keys := configuredKeys(cfg)
+	switch {
+	case apiKeys != nil:
+		keysErr = apiKeys.Reload(keys)
+	case len(keys) > 0 || cfg.APIKeysFile != "":
+		keysErr = fmt.Errorf("%w: api keys were disabled on startup", internal.ErrRestartRequired)
+	}
+	if keysErr != nil {
+		slog.Error("reloading api keys", "err", keysErr)
 	}
+	slog.Info("reloaded configuration")
 }